@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// mutelookupd is a relay which tunnels key server lookups to hide the IP
+// addresses of clients from the key servers.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/keyserver/lookupd"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/release"
+	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/home"
+	"github.com/mutecomm/mute/util/interrupt"
+	"github.com/mutecomm/mute/util/metrics"
+	"github.com/urfave/cli"
+)
+
+var (
+	defaultHomeDir = home.AppDataDir("mute", false)
+	defaultLogDir  = filepath.Join(defaultHomeDir, "log")
+)
+
+func init() {
+	cli.VersionPrinter = release.PrintVersion
+}
+
+func serve(c *cli.Context) error {
+	// create the necessary directories if they don't already exist
+	err := util.CreateDirs(c.String("homedir"), c.String("logdir"))
+	if err != nil {
+		return err
+	}
+	// initialize logging framework
+	err = log.InitFormat(c.String("loglevel"), "lkupd", c.String("logdir"),
+		c.Bool("logconsole"), c.String("logformat"))
+	if err != nil {
+		return err
+	}
+	// load key server URLs from configuration
+	if err := def.InitMuteFromFile(c.String("homedir")); err != nil {
+		return err
+	}
+	upstreams := lookupd.UpstreamsFromConfig(def.ConfigMap)
+	if len(upstreams) == 0 {
+		return log.Error("mutelookupd: no key servers configured")
+	}
+	relay, err := lookupd.New(upstreams)
+	if err != nil {
+		return err
+	}
+	if c.IsSet("metrics") {
+		reg := metrics.NewRegistry()
+		relay.SetMetrics(reg)
+		go reg.ListenAndServe(c.String("metrics"))
+	}
+	srv := &http.Server{
+		Addr:           c.String("listen"),
+		Handler:        relay,
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+		MaxHeaderBytes: 1 << 20, // 1 MB
+	}
+	for domain := range upstreams {
+		log.Infof("relay lookups for domain %s", domain)
+	}
+	log.Infof("listen on %s", srv.Addr)
+	if c.IsSet("cert") {
+		return srv.ListenAndServeTLS(c.String("cert"), c.String("key"))
+	}
+	return srv.ListenAndServe()
+}
+
+func mutelookupdMain() error {
+	defer log.Flush()
+
+	app := cli.NewApp()
+	app.Usage = "relay which tunnels key server lookups to hide client IPs"
+	app.Version = version.Number
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "homedir",
+			Value:  defaultHomeDir,
+			Usage:  "set home directory (to load configuration)",
+			EnvVar: home.HomeDirEnv,
+		},
+		home.PortableFlag,
+		cli.StringFlag{
+			Name:  "listen",
+			Value: "localhost:3443",
+			Usage: "address to listen on",
+		},
+		cli.StringFlag{
+			Name:  "cert",
+			Usage: "TLS certificate file (plain HTTP, if not set)",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "TLS private key file",
+		},
+		cli.StringFlag{
+			Name:  "metrics",
+			Usage: "address to serve metrics on (disabled, if not set)",
+		},
+		cli.StringFlag{
+			Name:  "loglevel",
+			Value: "info",
+			Usage: "logging level {trace, debug, info, warn, error, critical}",
+		},
+		cli.StringFlag{
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
+		},
+		cli.BoolFlag{
+			Name:  "logconsole",
+			Usage: "enable logging to console",
+		},
+		cli.StringFlag{
+			Name:  "logformat",
+			Value: log.FormatText,
+			Usage: fmt.Sprintf("logging format {%s, %s}", log.FormatText, log.FormatJSON),
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if len(c.Args()) > 0 {
+			return log.Errorf("superfluous argument(s): %s", c.Args())
+		}
+		if c.IsSet("cert") != c.IsSet("key") {
+			return log.Error("options --cert and --key require each other")
+		}
+		return home.ApplyDirs(c, "")
+	}
+	var err error
+	app.Action = func(c *cli.Context) {
+		err = serve(c)
+	}
+
+	// add interrupt handler
+	interrupt.AddInterruptHandler(func() {
+		log.Infof("gracefully shutting down...")
+	})
+
+	// start relay
+	go func() {
+		if rErr := app.Run(os.Args); rErr != nil {
+			interrupt.ShutdownChannel <- rErr
+			return
+		}
+		interrupt.ShutdownChannel <- err
+	}()
+
+	return <-interrupt.ShutdownChannel
+}
+
+func main() {
+	// work around defer not working after os.Exit()
+	if err := mutelookupdMain(); err != nil {
+		util.Fatal(err)
+	}
+}
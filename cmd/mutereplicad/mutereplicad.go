@@ -0,0 +1,455 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// mutereplicad replicates the key server hash chain from a primary to warm
+// standby nodes and promotes standby nodes after a fail over.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/replica"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/release"
+	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/home"
+	"github.com/mutecomm/mute/util/interrupt"
+	"github.com/mutecomm/mute/util/metrics"
+	"github.com/urfave/cli"
+)
+
+var (
+	defaultHomeDir = home.AppDataDir("mute", false)
+	defaultLogDir  = filepath.Join(defaultHomeDir, "log")
+	defaultDataDir = filepath.Join(defaultHomeDir, "replica")
+)
+
+func init() {
+	cli.VersionPrinter = release.PrintVersion
+}
+
+func initLog(c *cli.Context) error {
+	err := util.CreateDirs(c.GlobalString("logdir"))
+	if err != nil {
+		return err
+	}
+	return log.InitFormat(c.GlobalString("loglevel"), "repld", c.GlobalString("logdir"),
+		c.GlobalBool("logconsole"), c.GlobalString("logformat"))
+}
+
+func readKey(filename string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return base64.Decode(strings.TrimSpace(string(buf)))
+}
+
+func keygen(c *cli.Context) error {
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(c.String("key"),
+		[]byte(base64.Encode(key.PrivateKey()[:])+"\n"), 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	fmt.Println(base64.Encode(key.PublicKey()[:]))
+	return nil
+}
+
+// startMetrics serves metrics on the address given by --metrics and returns
+// the registry (nil, if metrics are disabled).
+func startMetrics(c *cli.Context) metrics.Metrics {
+	if !c.GlobalIsSet("metrics") {
+		return nil
+	}
+	reg := metrics.NewRegistry()
+	go reg.ListenAndServe(c.GlobalString("metrics"))
+	return reg
+}
+
+// readCACert reads the CA certificate file given by option name, if set.
+func readCACert(c *cli.Context, name string) ([]byte, error) {
+	if !c.IsSet(name) {
+		return nil, nil
+	}
+	caCert, err := ioutil.ReadFile(c.String(name))
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return caCert, nil
+}
+
+// serveStore serves the hash chain in store: it is streamed to standby nodes
+// (if --key is set), fed from the primary key server (if --keyserver is set),
+// and served with the key server JSON-RPC methods (if the store has been
+// promoted).
+func serveStore(c *cli.Context, store *replica.FileStore) error {
+	mux := http.NewServeMux()
+	m := startMetrics(c)
+	if c.IsSet("key") {
+		privKey, err := readKey(c.String("key"))
+		if err != nil {
+			return err
+		}
+		var key [64]byte
+		copy(key[:], privKey)
+		streamer, err := replica.NewStreamer(store, &key)
+		if err != nil {
+			return err
+		}
+		streamer.SetMetrics(m)
+		mux.Handle("/replicate", streamer)
+	}
+	promoted, err := store.Promoted()
+	if err != nil {
+		return err
+	}
+	if promoted {
+		if !c.IsSet("domain") {
+			return log.Error("option --domain is mandatory on promoted node")
+		}
+		var sigPubKeys []string
+		if c.IsSet("sigpubkey") {
+			sigPubKeys = []string{c.String("sigpubkey")}
+		}
+		handler, err := replica.NewKeyserverHandler(store, c.String("domain"),
+			sigPubKeys)
+		if err != nil {
+			return err
+		}
+		mux.Handle("/", handler)
+		log.Infof("serve key server hash chain for %s", c.String("domain"))
+	} else if c.IsSet("keyserver") {
+		caCert, err := readCACert(c, "keyserver-cacert")
+		if err != nil {
+			return err
+		}
+		source, err := replica.NewSource(store, c.String("keyserver"), caCert)
+		if err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		interrupt.AddInterruptHandler(func() {
+			close(stop)
+		})
+		go func() {
+			if err := source.Run(stop); err != nil {
+				interrupt.ShutdownChannel <- err
+			}
+		}()
+		log.Infof("feed hash chain from key server %s", c.String("keyserver"))
+	}
+	srv := &http.Server{
+		Addr:           c.String("listen"),
+		Handler:        mux,
+		MaxHeaderBytes: 1 << 20, // 1 MB
+	}
+	log.Infof("listen on %s", srv.Addr)
+	return srv.ListenAndServeTLS(c.String("cert"), c.String("tlskey"))
+}
+
+func serve(c *cli.Context) error {
+	store, err := replica.OpenFileStore(c.GlobalString("datadir"))
+	if err != nil {
+		return err
+	}
+	return serveStore(c, store)
+}
+
+func follow(c *cli.Context) error {
+	store, err := replica.OpenFileStore(c.GlobalString("datadir"))
+	if err != nil {
+		return err
+	}
+	pubKey, err := base64.Decode(c.String("pubkey"))
+	if err != nil {
+		return err
+	}
+	if len(pubKey) != 32 {
+		return log.Error("mutereplicad: public key has wrong length")
+	}
+	var key [32]byte
+	copy(key[:], pubKey)
+	client := http.DefaultClient
+	caCert, err := readCACert(c, "cacert")
+	if err != nil {
+		return err
+	}
+	if caCert != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return log.Error("mutereplicad: cannot load CA certificate")
+		}
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	standby, err := replica.NewStandby(store, c.String("primary"), &key, client)
+	if err != nil {
+		return err
+	}
+	standby.SetMetrics(startMetrics(c))
+	stop := make(chan struct{})
+	interrupt.AddInterruptHandler(func() {
+		close(stop)
+	})
+	log.Infof("follow primary %s", c.String("primary"))
+	return standby.Follow(stop)
+}
+
+func promote(c *cli.Context) error {
+	store, err := replica.OpenFileStore(c.GlobalString("datadir"))
+	if err != nil {
+		return err
+	}
+	last, err := replica.Promote(store)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("promoted to primary at hash chain position %d\n", last)
+	return serveStore(c, store)
+}
+
+// serveFlags are the flags of the commands which serve the hash chain.
+var serveFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "listen",
+		Value: "localhost:3444",
+		Usage: "address to listen on",
+	},
+	cli.StringFlag{
+		Name:  "cert",
+		Usage: "TLS certificate file",
+	},
+	cli.StringFlag{
+		Name:  "tlskey",
+		Usage: "TLS private key file",
+	},
+	cli.StringFlag{
+		Name:  "domain",
+		Usage: "domain of key server (served after promotion)",
+	},
+	cli.StringFlag{
+		Name:  "sigpubkey",
+		Usage: "public signature key of key server (announced after promotion)",
+	},
+}
+
+func checkServeFlags(c *cli.Context) error {
+	if !c.IsSet("cert") || !c.IsSet("tlskey") {
+		return log.Error("options --cert and --tlskey are mandatory")
+	}
+	return nil
+}
+
+func mutereplicadMain() error {
+	defer log.Flush()
+
+	app := cli.NewApp()
+	app.Usage = "warm standby replication of the key server hash chain"
+	app.Version = version.Number
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "datadir",
+			Value: defaultDataDir,
+			Usage: "directory of local hash chain copy",
+		},
+		home.PortableFlag,
+		cli.StringFlag{
+			Name:  "loglevel",
+			Value: "info",
+			Usage: "logging level {trace, debug, info, warn, error, critical}",
+		},
+		cli.StringFlag{
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
+		},
+		cli.BoolFlag{
+			Name:  "logconsole",
+			Usage: "enable logging to console",
+		},
+		cli.StringFlag{
+			Name:  "logformat",
+			Value: log.FormatText,
+			Usage: fmt.Sprintf("logging format {%s, %s}", log.FormatText, log.FormatJSON),
+		},
+		cli.StringFlag{
+			Name:  "metrics",
+			Usage: "address to serve metrics on (disabled, if not set)",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		return home.ApplyDirs(c, "replica")
+	}
+	var err error
+	app.Commands = []cli.Command{
+		{
+			Name:  "keygen",
+			Usage: "generate replication key (prints public key)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "file to write private replication key to",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("key") {
+					return log.Error("option --key is mandatory")
+				}
+				return initLog(c)
+			},
+			Action: func(c *cli.Context) {
+				err = keygen(c)
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "stream hash chain to standby nodes (primary)",
+			Description: `
+Streams the hash chain to standby nodes. With --keyserver new entries of the
+primary key server are fetched and appended to the local copy, otherwise the
+key server has to append them to the hash chain file in --datadir. On a
+promoted node the hash chain is also served with the key server JSON-RPC
+methods.
+`,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "private replication key file",
+				},
+				cli.StringFlag{
+					Name:  "keyserver",
+					Usage: "JSON-RPC URL of primary key server to feed hash chain from",
+				},
+				cli.StringFlag{
+					Name:  "keyserver-cacert",
+					Usage: "CA certificate file to verify key server",
+				},
+			}, serveFlags...),
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("key") {
+					return log.Error("option --key is mandatory")
+				}
+				if err := checkServeFlags(c); err != nil {
+					return err
+				}
+				return initLog(c)
+			},
+			Action: func(c *cli.Context) {
+				err = serve(c)
+			},
+		},
+		{
+			Name:  "follow",
+			Usage: "replicate hash chain from primary (standby)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "primary",
+					Usage: "replication URL of primary (https://HOST/replicate)",
+				},
+				cli.StringFlag{
+					Name:  "pubkey",
+					Usage: "public replication key of primary",
+				},
+				cli.StringFlag{
+					Name:  "cacert",
+					Usage: "CA certificate file to verify primary",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("primary") {
+					return log.Error("option --primary is mandatory")
+				}
+				if !c.IsSet("pubkey") {
+					return log.Error("option --pubkey is mandatory")
+				}
+				return initLog(c)
+			},
+			Action: func(c *cli.Context) {
+				err = follow(c)
+			},
+		},
+		{
+			Name:  "promote",
+			Usage: "promote standby node to primary",
+			Description: `
+Validates the local hash chain copy and permanently marks it as promoted, which
+stops the replication on this node. Make sure the old primary is fenced
+(stopped and unreachable for clients) before the promotion, otherwise the hash
+chain can fork. Afterwards the node serves the hash chain with the key server
+JSON-RPC methods (hash chain sync and lookups, the key repository is not
+replicated) and streams it to the remaining standby nodes (if --key is set).
+`,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "private replication key file (to stream to standby nodes)",
+				},
+			}, serveFlags...),
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("domain") {
+					return log.Error("option --domain is mandatory")
+				}
+				if err := checkServeFlags(c); err != nil {
+					return err
+				}
+				return initLog(c)
+			},
+			Action: func(c *cli.Context) {
+				err = promote(c)
+			},
+		},
+	}
+
+	// add interrupt handler
+	interrupt.AddInterruptHandler(func() {
+		log.Infof("gracefully shutting down...")
+	})
+
+	go func() {
+		if rErr := app.Run(os.Args); rErr != nil {
+			interrupt.ShutdownChannel <- rErr
+			return
+		}
+		interrupt.ShutdownChannel <- err
+	}()
+
+	return <-interrupt.ShutdownChannel
+}
+
+func main() {
+	// work around defer not working after os.Exit()
+	if err := mutereplicadMain(); err != nil {
+		util.Fatal(err)
+	}
+}
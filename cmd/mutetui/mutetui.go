@@ -9,11 +9,11 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/frankbraun/codechain/util/home"
 	"github.com/mutecomm/mute/def/version"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/release"
 	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/home"
 	"github.com/urfave/cli"
 )
 
@@ -37,12 +37,17 @@ func muteApp() *cli.App {
 			Usage: "logging level {trace, debug, info, warn, error, critical}",
 		},
 		cli.StringFlag{
-			Name:  "logdir",
-			Value: defaultLogDir,
-			Usage: "directory to log output",
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
 		},
+		home.PortableFlag,
 	}
 	app.Before = func(c *cli.Context) error {
+		if err := home.ApplyDirs(c, ""); err != nil {
+			return err
+		}
 		return log.Init(c.GlobalString("loglevel"), " tui ",
 			c.GlobalString("logdir"), false)
 	}
@@ -13,11 +13,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/mutecomm/mute/configclient/cahash"
 	"github.com/mutecomm/mute/configclient/roundrobin"
 	"github.com/mutecomm/mute/configclient/sortedmap"
+	"github.com/mutecomm/mute/util/netproxy"
 	"github.com/mutecomm/mute/util/times"
 )
 
@@ -26,8 +28,21 @@ var (
 	ErrHashWrong = errors.New("configclient: CACert hash wrong")
 	// ErrNoServers is returned if no valid servers were configured.
 	ErrNoServers = errors.New("configclient: no available servers")
+	// ErrRollback is returned if a config has a lower version than the
+	// current one.
+	ErrRollback = errors.New("configclient: config version rollback")
+	// ErrNoSignature is returned if a config without signature is verified.
+	ErrNoSignature = errors.New("configclient: config not signed")
+	// ErrVersion is returned if the version of a config does not match its
+	// configuration map.
+	ErrVersion = errors.New("configclient: config version mismatch")
 )
 
+// VersionKey is the key of the config version in the configuration map. The
+// version must never decrease. Configs without version count as version 0,
+// they are protected against rollbacks by their (monotonic) sign date only.
+const VersionKey = "config.Version"
+
 // MaxReadBody is the maximum size of the body that is transferred.
 const MaxReadBody = 1048576
 
@@ -40,6 +55,8 @@ type Config struct {
 	CACert       []byte            // The current CACert, if any. Will always be set after config update
 	Map          map[string]string // The configuration map. If set it will be overwritten
 	LastSignDate uint64            // The last signdate, will be updated
+	Signature    []byte            // Signature of Map and LastSignDate, will be updated
+	Version      uint64            // The config version, will be updated (must not decrease)
 	Timeout      int64             // Timeout, can be zero (will be set to 30)
 	servers      []string          // list of servers generated from URLList
 	curServer    int               // current server in servers list
@@ -59,17 +76,27 @@ func (c *Config) Update() error {
 	ts := roundrobin.ParseServers(c.URLList)
 	sort.Sort(ts)
 	c.servers = ts.Order()
+	c.curServer = 0
 	if len(c.servers) < 1 {
 		return ErrNoServers
 	}
 	if c.LastSignDate == 0 {
 		c.LastSignDate = uint64(times.Now() - skew)
 	}
+	var version uint64
 GetConfigLoop:
 	for ; c.curServer < len(c.servers); c.curServer++ {
 		cert, err = getConfig(c.servers[c.curServer], c.PublicKey, c.LastSignDate, c.Timeout)
 		if err == nil {
-			break GetConfigLoop
+			// reject rollbacks (try next server)
+			var found bool
+			version, found, err = mapVersion(cert.Config)
+			if err == nil && found && version < c.Version {
+				err = ErrRollback
+			}
+			if err == nil {
+				break GetConfigLoop
+			}
 		}
 	}
 	if err != nil {
@@ -80,8 +107,7 @@ GetConfigLoop:
 	c.curServer = 0
 
 	if hisHash, ok = cert.Config["CACertHash"]; !ok {
-		c.Map = cert.Config
-		c.LastSignDate = cert.SignDate
+		c.setCert(cert, version)
 		return nil
 	}
 	if certHashb, err = hex.DecodeString(hisHash); err != nil {
@@ -104,11 +130,68 @@ GetConfigLoop:
 	if err != nil {
 		return err
 	}
+	c.setCert(cert, version)
+	return nil
+}
+
+// setCert sets the configuration map and its signature from cert.
+func (c *Config) setCert(cert *sortedmap.SignedMap, version uint64) {
 	c.Map = cert.Config
 	c.LastSignDate = cert.SignDate
+	c.Signature = cert.Signature
+	c.Version = version
+}
+
+// mapVersion returns the config version contained in the configuration map m
+// and whether m contains a version at all.
+func mapVersion(m map[string]string) (uint64, bool, error) {
+	v, ok := m[VersionKey]
+	if !ok {
+		return 0, false, nil
+	}
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, true, ErrVersion
+	}
+	return version, true, nil
+}
+
+// Verify verifies the signature of the configuration map (as set by Update)
+// with the (pinned) ed25519 publicKey and that the version matches the map.
+// Use it to verify stored configurations before they are applied.
+func (c *Config) Verify(publicKey []byte) error {
+	if len(c.Signature) == 0 {
+		return ErrNoSignature
+	}
+	so := sortedmap.StringMap(c.Map).Sort()
+	if !so.Verify(c.LastSignDate, publicKey, c.Signature) {
+		return sortedmap.ErrNoVerify
+	}
+	version, _, err := mapVersion(c.Map)
+	if err != nil {
+		return err
+	}
+	if version != c.Version {
+		return ErrVersion
+	}
 	return nil
 }
 
+// Overlay returns a copy of c with the entries of overrides layered on top of
+// its configuration map. The map of the returned config is not signed
+// anymore, it is only meant to be applied.
+func (c *Config) Overlay(overrides map[string]string) *Config {
+	config := *c
+	config.Map = make(map[string]string)
+	for k, v := range c.Map {
+		config.Map[k] = v
+	}
+	for k, v := range overrides {
+		config.Map[k] = v
+	}
+	return &config
+}
+
 func readBody(rc io.ReadCloser) ([]byte, error) {
 	defer rc.Close()
 	p, err := ioutil.ReadAll(&io.LimitedReader{R: rc, N: MaxReadBody})
@@ -130,7 +213,10 @@ func fixURL(URL string) string {
 // consideration. Timeout is in seconds. Configuration can be accessed via
 // cert.Config (map[string]string).
 func getConfig(configURL string, publicKey []byte, lastSignDate uint64, timeout int64) (cert *sortedmap.SignedMap, err error) {
-	c := &http.Client{Timeout: time.Second * time.Duration(timeout)}
+	c := &http.Client{
+		Transport: netproxy.NewTransport(),
+		Timeout:   time.Second * time.Duration(timeout),
+	}
 	resp, err := c.Get(fixURL(configURL) + "config")
 	if err != nil {
 		return nil, err
@@ -145,7 +231,10 @@ func getConfig(configURL string, publicKey []byte, lastSignDate uint64, timeout
 // getCACert returns the ca certificate (verified). certHash is from
 // GetConfig().Config["CACertHash"]
 func getCACert(configURL string, certHash string, timeout int64) ([]byte, error) {
-	c := &http.Client{Timeout: time.Second * time.Duration(timeout)}
+	c := &http.Client{
+		Transport: netproxy.NewTransport(),
+		Timeout:   time.Second * time.Duration(timeout),
+	}
 	resp, err := c.Get(fixURL(configURL) + "cacert")
 	if err != nil {
 		return nil, err
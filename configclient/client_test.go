@@ -5,9 +5,16 @@
 package configclient
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/hex"
 	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/mutecomm/mute/configclient/sortedmap"
 )
 
 var pubkeyStr = "f6b5289bbe4bfc678b1f670b3b2a4bc837f052108092ca926d09f7afca9f485f"
@@ -16,7 +23,6 @@ var server bool
 
 func init() {
 	flag.BoolVar(&server, "server", false, "run server tests")
-	flag.Parse()
 }
 
 func TestClient(t *testing.T) {
@@ -69,3 +75,139 @@ func TestUpdate(t *testing.T) {
 		t.Fatal("Map not set")
 	}
 }
+
+// configServer returns a test config server which serves the configuration
+// map m signed with privKey.
+func configServer(t *testing.T, m *sortedmap.StringMap, privKey ed25519.PrivateKey) *httptest.Server {
+	var key [ed25519.PrivateKeySize]byte
+	copy(key[:], privKey)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert, err := m.GenerateCertificate(&key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(cert)
+	}))
+}
+
+func TestUpdateVersion(t *testing.T) {
+	publicKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := sortedmap.StringMap{"a": "b", VersionKey: "2"}
+	srv := configServer(t, &m, privKey)
+	defer srv.Close()
+
+	c := &Config{
+		PublicKey: publicKey,
+		URLList:   "10," + strings.TrimPrefix(srv.URL, "http://"),
+	}
+	if err := c.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 2 || c.Map["a"] != "b" {
+		t.Errorf("wrong config: version=%d, map=%v", c.Version, c.Map)
+	}
+	if err := c.Verify(publicKey); err != nil {
+		t.Error(err)
+	}
+	// the same version is accepted
+	if err := c.Update(); err != nil {
+		t.Error(err)
+	}
+	// rollback
+	m[VersionKey] = "1"
+	if err := c.Update(); err != ErrRollback {
+		t.Errorf("should fail with ErrRollback: %v", err)
+	}
+	if c.Version != 2 || c.Map[VersionKey] != "2" {
+		t.Error("rollback should not change config")
+	}
+	m[VersionKey] = "x"
+	if err := c.Update(); err != ErrVersion {
+		t.Errorf("should fail with ErrVersion: %v", err)
+	}
+	// missing version after a signed config has been seen counts as 0
+	delete(m, VersionKey)
+	for i := 0; i < 2; i++ {
+		if err := c.Update(); err != nil {
+			t.Fatal(err)
+		}
+		if c.Version != 0 {
+			t.Errorf("missing version should count as 0: %d", c.Version)
+		}
+		if err := c.Verify(publicKey); err != nil {
+			t.Error(err)
+		}
+	}
+	// versions are accepted again afterwards
+	m[VersionKey] = "1"
+	if err := c.Update(); err != nil {
+		t.Error(err)
+	}
+	if c.Version != 1 {
+		t.Errorf("wrong version: %d", c.Version)
+	}
+	// legacy (unsigned) config
+	c = &Config{
+		PublicKey: publicKey,
+		URLList:   "10," + strings.TrimPrefix(srv.URL, "http://"),
+	}
+	if err := c.Update(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	publicKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key [ed25519.PrivateKeySize]byte
+	copy(key[:], privKey)
+	m := sortedmap.StringMap{"keyserver.mute.one": "https://a", VersionKey: "3"}
+	cert, err := m.GenerateCertificate(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := sortedmap.Certify(0, publicKey, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err := c.Verify(publicKey); err != ErrNoSignature {
+		t.Errorf("should fail with ErrNoSignature: %v", err)
+	}
+	c.setCert(sm, 3)
+	if err := c.Verify(publicKey); err != nil {
+		t.Error(err)
+	}
+	if err := c.Verify(otherKey); err != sortedmap.ErrNoVerify {
+		t.Errorf("should fail with ErrNoVerify: %v", err)
+	}
+	c.Version = 4
+	if err := c.Verify(publicKey); err != ErrVersion {
+		t.Errorf("should fail with ErrVersion: %v", err)
+	}
+	c.Version = 3
+	// overrides do not modify the signed map
+	o := c.Overlay(map[string]string{"keyserver.mute.one": "https://b"})
+	if o.Map["keyserver.mute.one"] != "https://b" || o.Map[VersionKey] != "3" {
+		t.Errorf("wrong overlay: %v", o.Map)
+	}
+	if err := c.Verify(publicKey); err != nil {
+		t.Error(err)
+	}
+	if err := o.Verify(publicKey); err != sortedmap.ErrNoVerify {
+		t.Errorf("overlay should not verify: %v", err)
+	}
+	c.Map["keyserver.mute.one"] = "https://c"
+	if err := c.Verify(publicKey); err != sortedmap.ErrNoVerify {
+		t.Errorf("should fail with ErrNoVerify: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util"
+)
+
+// BackupKeyDB returns the schema version and a consistent copy of the
+// (still encrypted) files of the key database.
+func (ce *CryptEngine) BackupKeyDB() (version string, dbData, keyData []byte, err error) {
+	version, err = ce.keyDB.Version()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dbData, keyData, err = ce.keyDB.Snapshot()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return version, dbData, keyData, nil
+}
+
+// RestoreKeyDB restores the key database in homedir from archive a. The key
+// database must not exist already. The restored database is verified by
+// opening it with passphrase, if that fails the restored files are removed.
+func RestoreKeyDB(homedir string, a *encdb.Archive, passphrase []byte) error {
+	keydbname := filepath.Join(homedir, "keys")
+	dbVersion, dbData, keyData, err := a.Database("keys")
+	if err != nil {
+		return log.Error(err)
+	}
+	archived, err := strconv.ParseUint(dbVersion, 10, 64)
+	if err != nil {
+		return log.Error(err)
+	}
+	supported, err := strconv.ParseUint(keydb.Version, 10, 64)
+	if err != nil {
+		return log.Error(err)
+	}
+	if archived > supported {
+		return log.Error(keydb.ErrNewerVersion)
+	}
+	log.Infof("restore keyDB '%s'", keydbname)
+	if err := encdb.WriteFiles(keydbname, dbData, keyData); err != nil {
+		return log.Error(err)
+	}
+	keyDB, err := keydb.Open(keydbname, passphrase)
+	if err != nil {
+		os.Remove(keydbname + encdb.DBSuffix)
+		os.Remove(keydbname + encdb.KeySuffix)
+		return err
+	}
+	return keyDB.Close()
+}
+
+// backup the KeyDB to the archive file out (encrypted with the passphrase of
+// KeyDB).
+func (ce *CryptEngine) dbBackup(out string, iterations int) error {
+	// read passphrase
+	log.Infof("read passphrase from fd %d", ce.fileTable.PassphraseFD)
+	passphrase, err := util.Readline(ce.fileTable.PassphraseFP)
+	if err != nil {
+		return err
+	}
+	defer bzero.Bytes(passphrase)
+	log.Info("done")
+	if err := ce.openKeyDBWithPassphrase(passphrase); err != nil {
+		return err
+	}
+	dbVersion, dbData, keyData, err := ce.BackupKeyDB()
+	if err != nil {
+		return err
+	}
+	a := encdb.NewArchive("mutecrypt " + version.Number)
+	if err := a.AddDatabase("keys", dbVersion, dbData, keyData); err != nil {
+		return log.Error(err)
+	}
+	// write archive (never overwrite existing files)
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := a.Write(f, passphrase, iterations); err != nil {
+		f.Close()
+		os.Remove(out)
+		return log.Error(err)
+	}
+	if err := f.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("keyDB backup written to %s", out)
+	return nil
+}
+
+// restore the KeyDB from the archive file in (which must have been encrypted
+// with the passphrase read from the passphrase fd).
+func (ce *CryptEngine) dbRestore(homedir, in string) error {
+	// read passphrase
+	log.Infof("read passphrase from fd %d", ce.fileTable.PassphraseFD)
+	passphrase, err := util.Readline(ce.fileTable.PassphraseFP)
+	if err != nil {
+		return err
+	}
+	defer bzero.Bytes(passphrase)
+	log.Info("done")
+	f, err := os.Open(in)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer f.Close()
+	a, err := encdb.ReadArchive(f, passphrase)
+	if err != nil {
+		return log.Error(err)
+	}
+	return RestoreKeyDB(homedir, a, passphrase)
+}
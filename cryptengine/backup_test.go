@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/keydb"
+)
+
+func TestBackupRestoreKeyDB(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "cryptengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := keydb.Create(filepath.Join(tmpdir, "keys"), passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	ce, err := Open(tmpdir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, dbData, keyData, err := ce.BackupKeyDB()
+	ce.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != keydb.Version {
+		t.Errorf("wrong version: %s", version)
+	}
+	a := encdb.NewArchive("test")
+	if err := a.AddDatabase("keys", version, dbData, keyData); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	a, err = encdb.ReadArchive(&buf, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restoring over an existing keyDB must fail
+	if err := RestoreKeyDB(tmpdir, a, passphrase); err == nil {
+		t.Error("RestoreKeyDB() should fail")
+	}
+	// restore into empty directory
+	restoredir := filepath.Join(tmpdir, "restore")
+	if err := os.Mkdir(restoredir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreKeyDB(restoredir, a, []byte("wrong")); err == nil {
+		t.Error("RestoreKeyDB() with wrong passphrase should fail")
+	}
+	if _, err := os.Stat(filepath.Join(restoredir, "keys"+encdb.DBSuffix)); !os.IsNotExist(err) {
+		t.Error("failed restore must not leave files behind")
+	}
+	if err := RestoreKeyDB(restoredir, a, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	ce, err = Open(restoredir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce.Close()
+	// newer versions are refused
+	b := encdb.NewArchive("test")
+	if err := b.AddDatabase("keys", "999", dbData, keyData); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreKeyDB(filepath.Join(tmpdir, "other"), b, passphrase); err != keydb.ErrNewerVersion {
+		t.Errorf("RestoreKeyDB() should fail with ErrNewerVersion: %v", err)
+	}
+}
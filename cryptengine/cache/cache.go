@@ -3,54 +3,149 @@
 // license that can be found in the LICENSE file.
 
 // Package cache caches the key server capabilities and clients used for
-// mutecrypt's cryptengine.
+// mutecrypt's cryptengine. The clients share a pool of keep-alive connections.
 package cache
 
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/keydb"
 	"github.com/mutecomm/mute/keyserver/capabilities"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/jsonclient"
+	"github.com/mutecomm/mute/util/times"
 )
 
+// DefaultTTL is the default time key server capabilities are used from the
+// persistent store before they are requested again.
+const DefaultTTL = 24 * time.Hour
+
+// A Store persists snapshots of key server capabilities (see keydb.KeyDB).
+// GetCapabilities returns nil, if no usable snapshot is stored.
+type Store interface {
+	GetCapabilities(domain string) (*keydb.CapabilitiesSnapshot, error)
+	SetCapabilities(domain string, snap *keydb.CapabilitiesSnapshot) error
+}
+
 // A Cache caches key server capabilities and clients used for mutecrypt's
 // cryptengine.
 type Cache struct {
 	clients      map[string]*jsonclient.URLClient      // maps domain to JSON-RPC client
 	capabilities map[string]*capabilities.Capabilities // maps domain to
+	breakers     map[string]*jsonclient.Breaker        // maps domain to circuit breaker
+	relay        string                                // optional lookup relay URL
+	newClient    ClientFactory                         // creates JSON-RPC clients
+	store        Store                                 // optional persistent store
+	ttl          time.Duration                         // lifetime of stored capabilities
+	offline      bool                                  // only use stored capabilities
+	pool         *jsonclient.Pool                      // shared connections of default clients
 }
 
+// A ClientFactory creates a new JSON-RPC client for the key server at domain
+// on port. If altHost is defined, it is used as the alternate hostname for
+// the given domain name. Otherwise, if relay is defined, the request is routed
+// through the lookup relay. homedir is used to load key server certificates.
+type ClientFactory func(domain, port, altHost, relay, homedir string) (*jsonclient.URLClient, error)
+
 // New returns a new cache.
 func New() *Cache {
-	return &Cache{
+	c := &Cache{
 		clients:      make(map[string]*jsonclient.URLClient),
 		capabilities: make(map[string]*capabilities.Capabilities),
+		breakers:     make(map[string]*jsonclient.Breaker),
+		ttl:          DefaultTTL,
+		pool: jsonclient.NewPool(jsonclient.DefaultMaxConnsPerHost,
+			jsonclient.DefaultRetries, jsonclient.DefaultBackoff),
 	}
+	c.newClient = c.pooledClient
+	return c
+}
+
+// SetStore sets the persistent store for key server capabilities. Stored
+// capabilities are used instead of requesting them from the key server until
+// they are older than ttl. A nil store disables the persistent cache.
+func (c *Cache) SetStore(store Store, ttl time.Duration) {
+	c.store = store
+	c.ttl = ttl
+}
+
+// SetOffline enables or disables the offline mode. In offline mode the
+// capabilities are never requested from the key server, stored capabilities
+// are used regardless of their age.
+func (c *Cache) SetOffline(offline bool) {
+	c.offline = offline
+}
+
+// SetClientFactory sets the function used to create JSON-RPC clients for key
+// servers (for example, to talk to a fake key server in tests). A nil factory
+// restores the default. All cached clients are flushed.
+func (c *Cache) SetClientFactory(factory ClientFactory) {
+	if factory == nil {
+		factory = c.pooledClient
+	}
+	c.newClient = factory
+	c.FlushClients()
+}
+
+// breaker returns the circuit breaker for the key server at domain. The
+// breaker outlives the cached clients, so repeatedly failing servers are not
+// contacted during the cool-down period.
+func (c *Cache) breaker(domain string) *jsonclient.Breaker {
+	b := c.breakers[domain]
+	if b == nil {
+		b = jsonclient.NewBreaker(jsonclient.DefaultFailureThreshold,
+			jsonclient.DefaultCoolDown)
+		c.breakers[domain] = b
+	}
+	return b
+}
+
+// FlushClients removes all cached JSON-RPC clients (for example, after the
+// configuration changed). Capabilities, circuit breakers, and pooled
+// connections are kept.
+func (c *Cache) FlushClients() {
+	c.clients = make(map[string]*jsonclient.URLClient)
+}
+
+// SetRelay sets the URL of a lookup relay (see mutelookupd) all key server
+// connections are tunneled through, if no alternate hostname is given. The
+// TLS connections to the key servers run end-to-end through the tunnel. An
+// empty relayURL disables the relay.
+func (c *Cache) SetRelay(relayURL string) {
+	c.relay = strings.TrimSuffix(relayURL, "/")
+}
+
+// CloseIdleConnections closes the idle keep-alive connections to all key
+// servers.
+func (c *Cache) CloseIdleConnections() {
+	c.pool.CloseIdleConnections()
 }
 
-// newClient creats a new JSON-RPC client for the key server at domain on
-// port. If altHost is defined, it is used as the alternate hostname for the
-// given domain name. homedir is used to load key server certificates.
-func newClient(domain, port, altHost, homedir string) (*jsonclient.URLClient, error) {
+// pooledClient is the default ClientFactory, the created clients share the
+// connections of the cache's pool.
+func (c *Cache) pooledClient(domain, port, altHost, relay, homedir string) (*jsonclient.URLClient, error) {
 	// determine used host string
 	var url string
 	if altHost != "" {
 		url = "https://" + altHost + port + "/"
+		relay = ""
 	} else {
 		var ok bool
-		key := "keyserver." + domain
-		url, ok = def.ConfigMap[key]
+		url, ok = def.KeyServerURL(domain)
 		if !ok {
 			return nil,
-				log.Errorf("cache: no configuration for %s found", key)
+				log.Errorf("cache: no key server configured for domain %s", domain)
 		}
 	}
-	// create client
-	client, err := jsonclient.New(url, def.CACert)
+	// create client (tunneled through the relay, if defined)
+	client, err := c.pool.NewRelayed(url, relay, def.CACert)
 	if err != nil {
 		return nil, err
 	}
@@ -61,12 +156,18 @@ func newClient(domain, port, altHost, homedir string) (*jsonclient.URLClient, er
 // and port and caches the used JSON-RPC client and the resulting
 // capabilities. If altHost is defined, it is used as the alternate hostname
 // for the given domain name. homedir is used to load key server certificates.
+// If a persistent store is set, the capabilities are stored in it.
 func (c *Cache) Set(domain, port, altHost, homedir string) error {
+	if c.offline {
+		return log.Errorf("cache: cannot request capabilities of key server %s in offline mode",
+			domain)
+	}
 	// create new JSON-RPC client
-	client, err := newClient(domain, port, altHost, homedir)
+	client, err := c.newClient(domain, port, altHost, c.relay, homedir)
 	if err != nil {
 		return err
 	}
+	client.SetBreaker(c.breaker(domain))
 	// request capabilities from key server
 	reply, err := client.JSONRPCRequest("KeyRepository.Capabilities", nil)
 	if err != nil {
@@ -89,20 +190,55 @@ func (c *Cache) Set(domain, port, altHost, homedir string) error {
 	// cache client and capabilities
 	c.clients[domain] = client
 	c.capabilities[domain] = &caps
+	if c.store != nil {
+		now := times.Now()
+		err := c.store.SetCapabilities(domain, &keydb.CapabilitiesSnapshot{
+			Capabilities: &caps,
+			Fetched:      now,
+			Expires:      now + int64(c.ttl/time.Second),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// load fills the cache for the given domain. Capabilities from the
+// persistent store are used, if they are not expired (or in offline mode).
+// Otherwise, the capabilities are requested with the Set method.
+func (c *Cache) load(domain, port, altHost, homedir string) error {
+	if c.store != nil {
+		snap, err := c.store.GetCapabilities(domain)
+		if err != nil {
+			return err
+		}
+		if snap != nil && (c.offline || !snap.Expired(times.Now())) {
+			log.Debugf("cache: use stored capabilities of key server %s", domain)
+			client, err := c.newClient(domain, port, altHost, c.relay, homedir)
+			if err != nil {
+				return err
+			}
+			client.SetBreaker(c.breaker(domain))
+			c.clients[domain] = client
+			c.capabilities[domain] = snap.Capabilities
+			return nil
+		}
+	}
+	return c.Set(domain, port, altHost, homedir)
+}
+
 // Get returns the cached JSON-RPC client and capabilities for the given
 // domain and makes sure that the requiredMethod is supported. If no client
-// has been cached, the cache is filled using the Set method with the given
-// domain, port, altHost, and homedir parameters.
+// has been cached, the cache is filled from the persistent store or using the
+// Set method with the given domain, port, altHost, and homedir parameters.
 func (c *Cache) Get(
 	domain, port, altHost, homedir, requiredMethod string,
 ) (*jsonclient.URLClient, *capabilities.Capabilities, error) {
-	// check/set cache
+	// check/set cache (clients might have been flushed)
 	caps := c.capabilities[domain]
-	if caps == nil {
-		if err := c.Set(domain, port, altHost, homedir); err != nil {
+	if caps == nil || c.clients[domain] == nil {
+		if err := c.load(domain, port, altHost, homedir); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -121,14 +257,14 @@ func (c *Cache) Get(
 }
 
 // ShowCapabilities shows the cached capabilities of the key server at domain
-// on stdout. If no capabilities have been cached, the cache is filled using
-// the Set method with the given domain, port, altHost, and homedir
-// parameters.
+// on stdout. If no capabilities have been cached, the cache is filled from
+// the persistent store or using the Set method with the given domain, port,
+// altHost, and homedir parameters.
 func (c *Cache) ShowCapabilities(domain, port, altHost, homedir string) error {
 	// check/set cache
 	caps := c.capabilities[domain]
 	if caps == nil {
-		if err := c.Set(domain, port, altHost, homedir); err != nil {
+		if err := c.load(domain, port, altHost, homedir); err != nil {
 			return err
 		}
 	}
@@ -141,3 +277,27 @@ func (c *Cache) ShowCapabilities(domain, port, altHost, homedir string) error {
 	fmt.Println(string(jsn))
 	return nil
 }
+
+// ShowStatus writes the circuit breaker status of all key servers contacted
+// so far and the connection pool metrics to w.
+func (c *Cache) ShowStatus(w io.Writer) {
+	var domains []string
+	for domain := range c.breakers {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		state, failures, openUntil, lastErr := c.breakers[domain].Status()
+		fmt.Fprintf(w, "%s\t%s\tfailures=%d", domain, state, failures)
+		if state == jsonclient.StateOpen {
+			fmt.Fprintf(w, "\tuntil=%s", openUntil.UTC().Format(time.RFC3339))
+		}
+		if lastErr != nil {
+			fmt.Fprintf(w, "\terror=%s", lastErr)
+		}
+		fmt.Fprintln(w)
+	}
+	stats := c.pool.Stats()
+	fmt.Fprintf(w, "connections\trequests=%d\treused=%d (%.0f%%)\tretries=%d\n",
+		stats.Requests, stats.Reused, 100*stats.ReuseRate(), stats.Retries)
+}
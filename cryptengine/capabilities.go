@@ -6,9 +6,53 @@ package cryptengine
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"strings"
+
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util"
 )
 
+// capabilitiesStore stores snapshots of key server capabilities in keyDB
+// (see cache.Store). A stored snapshot is only used while the signature keys
+// it lists contain the current signature key of the key server, as known
+// from the signed UID message of keyserver@domain in the hash chain.
+type capabilitiesStore struct {
+	keyDB *keydb.KeyDB
+}
+
+func (s *capabilitiesStore) GetCapabilities(domain string) (
+	*keydb.CapabilitiesSnapshot,
+	error,
+) {
+	snap, err := s.keyDB.GetCapabilities(domain)
+	if err != nil || snap == nil {
+		return nil, err
+	}
+	srvUID, _, found, err := s.keyDB.GetPublicUID(
+		"keyserver@"+identity.MapDomain(domain), math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	if found && !util.ContainsString(snap.Capabilities.SIGPUBKEYS,
+		srvUID.UIDContent.SIGKEY.PUBKEY) {
+		log.Warnf("cryptengine: stored capabilities of key server %s do not "+
+			"match its signature key, ignored", domain)
+		return nil, nil
+	}
+	return snap, nil
+}
+
+func (s *capabilitiesStore) SetCapabilities(
+	domain string,
+	snap *keydb.CapabilitiesSnapshot,
+) error {
+	return s.keyDB.SetCapabilities(domain, snap)
+}
+
 func (ce *CryptEngine) getCapabilities(domainAndPort, altHost string) error {
 	if altHost == "" && ce.keydHost != "" {
 		altHost = ce.keydHost
@@ -35,3 +79,10 @@ func (ce *CryptEngine) showCapabilities(domain, altHost string) error {
 	}
 	return ce.cache.ShowCapabilities(domain, ce.keydPort, altHost, ce.homedir)
 }
+
+// ShowKeyServerStatus writes the availability status of all key servers
+// contacted by crypt engine ce to w.
+func (ce *CryptEngine) ShowKeyServerStatus(w io.Writer) error {
+	ce.cache.ShowStatus(w)
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mutecomm/mute/cryptengine/cache"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+func TestCapabilitiesStore(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	// newCache simulates a new process
+	newCache := func(offline bool) {
+		ce.cache = cache.New()
+		ce.cache.SetClientFactory(func(domain, port, altHost, relay, homedir string) (*jsonclient.URLClient, error) {
+			return jsonclient.New(srv.URL, nil)
+		})
+		ce.cache.SetStore(&capabilitiesStore{ce.keyDB}, cache.DefaultTTL)
+		ce.cache.SetOffline(offline)
+	}
+	getCaps := func() error {
+		_, _, err := ce.cache.Get(testDomain, "", "", "",
+			"KeyRepository.Capabilities")
+		return err
+	}
+
+	// capabilities are requested and stored
+	if err := getCaps(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("KeyRepository.Capabilities"); n != 1 {
+		t.Fatalf("Capabilities called %d times, expected 1", n)
+	}
+	snap, err := ce.keyDB.GetCapabilities(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap == nil || snap.Expires-snap.Fetched != int64(cache.DefaultTTL.Seconds()) {
+		t.Fatal("capabilities not stored")
+	}
+
+	// stored capabilities are used
+	newCache(false)
+	if err := getCaps(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("KeyRepository.Capabilities"); n != 1 {
+		t.Errorf("Capabilities called %d times, expected 1", n)
+	}
+
+	// expired capabilities are requested again
+	expired := &keydb.CapabilitiesSnapshot{
+		Capabilities: snap.Capabilities,
+		Fetched:      snap.Fetched - 2,
+		Expires:      snap.Fetched - 1,
+	}
+	if err := ce.keyDB.SetCapabilities(testDomain, expired); err != nil {
+		t.Fatal(err)
+	}
+	newCache(false)
+	if err := getCaps(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("KeyRepository.Capabilities"); n != 2 {
+		t.Errorf("Capabilities called %d times, expected 2", n)
+	}
+
+	// offline mode uses expired capabilities, but never requests them
+	srv.Handle("KeyRepository.Capabilities",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return nil, errors.New("offline")
+		})
+	if err := ce.keyDB.SetCapabilities(testDomain, expired); err != nil {
+		t.Fatal(err)
+	}
+	newCache(true)
+	if err := getCaps(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.keyDB.DelCapabilities(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	newCache(true)
+	if err := getCaps(); err == nil {
+		t.Error("should fail")
+	}
+	srv.Handle("KeyRepository.Capabilities", nil)
+
+	// capabilities which do not match the key server UID are ignored
+	newCache(false)
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	store := &capabilitiesStore{ce.keyDB}
+	snap, err = store.GetCapabilities(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap == nil {
+		t.Fatal("capabilities should match key server UID")
+	}
+	snap.Capabilities.SIGPUBKEYS = []string{"forged"}
+	if err := ce.keyDB.SetCapabilities(testDomain, snap); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = store.GetCapabilities(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap != nil {
+		t.Error("forged capabilities should be ignored")
+	}
+}
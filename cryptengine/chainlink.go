@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// genlink generates an update for the (registered) nym which links it to the
+// nym foreign in a foreign key hashchain and stores it in keydb (see
+// uid.ChainLinkVersion). The foreign nym must be one of our own nyms and the
+// foreign hash chain must have been synced, its last entry is used as
+// CHAINLINK.LAST. Authoritative links have to be signed by the key server
+// upon registration with 'uid update'.
+func (ce *CryptEngine) genlink(pseudonym, foreign string, authoritative bool) error {
+	// map pseudonyms
+	id, domain, err := identity.MapPlus(pseudonym)
+	if err != nil {
+		return err
+	}
+	foreignID, foreignDomain, err := identity.MapPlus(foreign)
+	if err != nil {
+		return err
+	}
+	if foreignDomain == domain {
+		return log.Errorf("cryptengine: cannot link '%s' to the same domain", id)
+	}
+	// the foreign nym must be ours
+	if _, _, err := ce.keyDB.GetPrivateUID(foreignID, false); err != nil {
+		return err
+	}
+	// get last entry of foreign hash chain
+	last, err := ce.keyDB.GetLastHashChainEntry(foreignDomain)
+	if err != nil {
+		return err
+	}
+	// get old UID from keyDB
+	oldUID, _, err := ce.keyDB.GetPrivateUID(id, true)
+	if err != nil {
+		return err
+	}
+	// generate new UID
+	newUID, err := oldUID.Link(&uid.ChainLink{
+		URI:           []string{foreignDomain},
+		LAST:          last,
+		AUTHORITATIVE: authoritative,
+		DOMAINS:       []string{foreignDomain},
+		IDENTITY:      foreignID,
+	}, cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	// store new UID in keyDB
+	return ce.keyDB.AddPrivateUID(newUID)
+}
+
+// verifyChainLink verifies the chain link of the UID message msg found at the
+// given position of its hash chain and stores it in keydb. Authoritative links
+// must be signed by the escrow key of the key server. If the foreign hash
+// chain has been synced, it is recorded whether CHAINLINK.LAST is contained
+// in it. Chain links which are superseded by a UID message without chain link
+// are removed.
+func (ce *CryptEngine) verifyChainLink(msg *uid.Message, position uint64) error {
+	id := msg.Identity()
+	if !msg.HasChainLink() {
+		link, err := ce.keyDB.GetChainLink(id)
+		if err != nil {
+			return err
+		}
+		if link != nil && link.Position < position {
+			return ce.keyDB.DelChainLink(id)
+		}
+		return nil
+	}
+	if err := msg.Check(); err != nil {
+		return err
+	}
+	link := msg.UIDContent.CHAINLINK
+
+	// verify link authority
+	if link.AUTHORITATIVE {
+		srvUID, _, found, err := ce.keyDB.GetPublicUID("keyserver@"+msg.Domain(),
+			position)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return log.Errorf("cryptengine: no keyserver escrow key found for domain '%s'",
+				msg.Domain())
+		}
+		if err := msg.VerifyLinkAuthority(srvUID); err != nil {
+			return err
+		}
+	}
+
+	// look for LAST in the foreign hash chain
+	_, foreignDomain, err := identity.Split(link.IDENTITY)
+	if err != nil {
+		return err
+	}
+	positions, err := ce.keyDB.GetHashChainPositions(foreignDomain)
+	if err != nil {
+		return err
+	}
+	var lastSeen bool
+	for _, pos := range positions {
+		entry, err := ce.keyDB.GetHashChainEntry(foreignDomain, pos)
+		if err != nil {
+			return err
+		}
+		if entry == link.LAST {
+			lastSeen = true
+			break
+		}
+	}
+	if !lastSeen {
+		log.Warnf("cryptengine: last entry of chain link '%s' -> '%s' not found "+
+			"(sync hash chain of '%s')", id, link.IDENTITY, foreignDomain)
+	}
+
+	// store chain link
+	return ce.keyDB.AddChainLink(id, &keydb.ChainLink{
+		Link:     link,
+		Position: position,
+		LastSeen: lastSeen,
+	})
+}
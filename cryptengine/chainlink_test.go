@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+func TestChainLink(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	foreign, err := keyservertest.New("mute.one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+	servers := map[string]*keyservertest.Server{
+		srv.Domain:     srv,
+		foreign.Domain: foreign,
+	}
+	factory := func(domain, port, altHost, relay, homedir string) (*jsonclient.URLClient, error) {
+		return jsonclient.New(servers[domain].URL, nil)
+	}
+
+	// alice has user IDs in both key hashchains
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	ce.cache.SetClientFactory(factory)
+	aliceOne := addUser(t, foreign, "alice@mute.one")
+	if err := ce.keyDB.AddPrivateUID(aliceOne); err != nil {
+		t.Fatal(err)
+	}
+	alice := addUser(t, srv, "alice@mute.berlin")
+	if err := ce.keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.genlink("alice@mute.berlin", "alice@mute.one", true); err == nil {
+		t.Error("should fail without foreign hash chain")
+	}
+	if err := ce.syncHashChain("mute.one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.genlink("alice@mute.berlin", "alice@mute.one", true); err != nil {
+		t.Fatal(err)
+	}
+	linked, _, err := ce.keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !linked.HasChainLink() {
+		t.Fatal("chain link missing")
+	}
+	// key server confirms the authoritative link
+	if err := linked.SignLinkAuthority(srv.KeyserverUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(linked); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob claims an authoritative link without confirmation
+	bob := addUser(t, srv, "bob@mute.berlin")
+	bobLinked, err := bob.Link(&uid.ChainLink{
+		URI:           []string{"mute.one"},
+		LAST:          foreign.LastEntry(),
+		AUTHORITATIVE: true,
+		DOMAINS:       []string{"mute.one"},
+		IDENTITY:      "bob@mute.one",
+	}, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(bobLinked); err != nil {
+		t.Fatal(err)
+	}
+
+	// another user verifies the links
+	ce2, cleanup2 := newTestEngine(t, srv)
+	defer cleanup2()
+	ce2.cache.SetClientFactory(factory)
+	for _, domain := range []string{testDomain, "mute.one"} {
+		if err := ce2.syncHashChain(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ce2.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce2.searchHashChain("alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	link, err := ce2.keyDB.GetChainLink("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link == nil {
+		t.Fatal("chain link not stored")
+	}
+	if link.Link.IDENTITY != "alice@mute.one" || !link.Link.AUTHORITATIVE ||
+		!link.LastSeen {
+		t.Errorf("wrong chain link: %+v", link)
+	}
+	if err := ce2.searchHashChain("bob@mute.berlin", false); err == nil {
+		t.Error("should fail with invalid link authority")
+	}
+}
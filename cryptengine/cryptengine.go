@@ -11,17 +11,24 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/frankbraun/codechain/util/bzero"
-	"github.com/frankbraun/codechain/util/home"
+	"github.com/mutecomm/mute/configclient"
 	"github.com/mutecomm/mute/cryptengine/cache"
+	"github.com/mutecomm/mute/cryptengine/hcindex"
 	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/def/version"
 	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/keyserver/bloom"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/descriptors"
+	"github.com/mutecomm/mute/util/home"
+	"github.com/mutecomm/mute/util/idle"
+	"github.com/mutecomm/mute/util/netproxy"
 	"github.com/urfave/cli"
 )
 
@@ -39,30 +46,54 @@ var (
 
 // CryptEngine abstracts a mutecrypt command engine.
 type CryptEngine struct {
-	prepared  bool
-	fileTable *descriptors.Table
-	keydHost  string
-	keydPort  string
-	homedir   string
-	keyDB     *keydb.KeyDB
-	cache     *cache.Cache
-	app       *cli.App
-	err       error
+	prepared   bool
+	configured bool // options of invocation applied (see configure)
+	fileTable  *descriptors.Table
+	keydHost   string
+	keydPort   string
+	homedir    string
+	keyDB      *keydb.KeyDB
+	cache      *cache.Cache
+	hcIndex    *hcindex.Index // optional in-memory hash chain index
+	app        *cli.App
+	err        error
+}
+
+// configure applies the key server options of an invocation. It is called
+// once per process or, for in-process use, once per Exec.
+func (ce *CryptEngine) configure(c *cli.Context) {
+	ce.keydHost = c.GlobalString("keyhost")
+	ce.keydPort = c.GlobalString("keyport")
+	ce.cache.SetRelay(c.GlobalString("lookuprelay"))
+	ce.cache.SetOffline(c.GlobalBool("offline"))
+	ce.configured = true
 }
 
 func (ce *CryptEngine) prepare(c *cli.Context, openKeyDB bool) error {
+	if !ce.configured {
+		ce.configure(c)
+	}
 	if !ce.prepared {
-		ce.keydHost = c.GlobalString("keyhost")
-		ce.keydPort = c.GlobalString("keyport")
 		ce.homedir = c.GlobalString("homedir")
+		err := netproxy.Apply(c.GlobalString("proxy"),
+			c.GlobalString("proxy-domains"))
+		if err != nil {
+			return err
+		}
+		if c.GlobalBool("hashchain-index") {
+			ce.hcIndex = hcindex.New()
+		}
 
 		// create the necessary directories if they don't already exist
-		err := util.CreateDirs(c.GlobalString("homedir"), c.GlobalString("logdir"))
+		err = util.CreateDirs(c.GlobalString("homedir"), c.GlobalString("logdir"))
 		if err != nil {
 			return err
 		}
 
 		// initialize logging framework
+		if err := home.SetLogOptions(c); err != nil {
+			return err
+		}
 		err = log.Init(c.GlobalString("loglevel"), "crypt",
 			c.GlobalString("logdir"), c.GlobalBool("logconsole"))
 		if err != nil {
@@ -113,37 +144,31 @@ func (ce *CryptEngine) loop(c *cli.Context) {
 
 	scanner := bufio.NewScanner(ce.fileTable.CommandFP)
 
+	// lock keyDB after inactivity
+	timeout := c.GlobalDuration("idle-lock")
+	idleLock := idle.New(timeout, func() {
+		if ce.keyDB != nil {
+			log.Infof("lock keyDB after %s of inactivity", timeout)
+			if err := ce.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+	})
+	defer idleLock.Stop()
+
 	for scanner.Scan() {
-		args := []string{ce.app.Name}
 		line := scanner.Text()
 		if line == "" {
 			log.Infof("read empty line")
 			continue
 		}
 		log.Infof("read: %s", line)
-		args = append(args, strings.Fields(line)...)
-		if err := ce.app.Run(args); err != nil {
-			// command execution failed -> issue status and continue
-			log.Infof("command execution failed (app): %s", err)
-			fmt.Fprintln(ce.fileTable.StatusFP, err)
-			continue
-		}
-		if ce.err != nil {
-			if ce.err == errExit {
-				// exit requested -> return
-				log.Info("cryptengine: stopping (exit requested)")
-				fmt.Fprintln(ce.fileTable.StatusFP, "QUITTING")
-				ce.err = nil
-				return
-			}
-			// command execution failed -> issue status and continue
-			log.Infof("command execution failed (cmd): %s", ce.err)
-			fmt.Fprintln(ce.fileTable.StatusFP, ce.err)
-			ce.err = nil
-		} else {
-			log.Info("command successful")
+		idleLock.Begin()
+		exit := ce.execute(line)
+		idleLock.End()
+		if exit {
+			return
 		}
-		fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
 	}
 	if err := scanner.Err(); err != nil {
 		ce.err = log.Errorf("cryptengine: %s", err)
@@ -152,6 +177,36 @@ func (ce *CryptEngine) loop(c *cli.Context) {
 	return
 }
 
+// execute executes the command line read in the loop. It returns true, if an
+// exit has been requested.
+func (ce *CryptEngine) execute(line string) bool {
+	args := []string{ce.app.Name}
+	args = append(args, strings.Fields(line)...)
+	if err := ce.app.Run(args); err != nil {
+		// command execution failed -> issue status and continue
+		log.Infof("command execution failed (app): %s", err)
+		fmt.Fprintln(ce.fileTable.StatusFP, err)
+		return false
+	}
+	if ce.err != nil {
+		if ce.err == errExit {
+			// exit requested -> return
+			log.Info("cryptengine: stopping (exit requested)")
+			fmt.Fprintln(ce.fileTable.StatusFP, "QUITTING")
+			ce.err = nil
+			return true
+		}
+		// command execution failed -> issue status and continue
+		log.Infof("command execution failed (cmd): %s", ce.err)
+		fmt.Fprintln(ce.fileTable.StatusFP, ce.err)
+		ce.err = nil
+	} else {
+		log.Info("command successful")
+	}
+	fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
+	return false
+}
+
 // New returns a new Mute crypt engine.
 func New() *CryptEngine {
 	var ce CryptEngine
@@ -160,10 +215,12 @@ func New() *CryptEngine {
 	ce.app.Version = version.Number
 	ce.app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "homedir",
-			Value: defaultHomeDir,
-			Usage: "set home directory",
+			Name:   "homedir",
+			Value:  defaultHomeDir,
+			Usage:  "set home directory",
+			EnvVar: home.HomeDirEnv,
 		},
+		home.PortableFlag,
 		cli.BoolFlag{
 			Name:  "keyserver",
 			Usage: "create key for key server",
@@ -176,6 +233,22 @@ func New() *CryptEngine {
 			Name:  "keyport",
 			Usage: "alternative port for key server",
 		},
+		netproxy.ProxyFlag,
+		netproxy.ProxyDomainsFlag,
+		cli.StringFlag{
+			Name:   "lookuprelay",
+			Usage:  "route key server requests through lookup relay (URL)",
+			EnvVar: "MUTELOOKUPRELAY",
+		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "do not request key server capabilities, use cached ones",
+		},
+		cli.BoolFlag{
+			Name:   "hashchain-index",
+			Usage:  "keep in-memory index of hash chain entries (for repeated searches)",
+			EnvVar: "MUTEHASHCHAININDEX",
+		},
 		descriptors.InputFDFlag,
 		descriptors.OutputFDFlag,
 		descriptors.StatusFDFlag,
@@ -187,16 +260,29 @@ func New() *CryptEngine {
 			Usage: "logging level {trace, debug, info, warn, error, critical}",
 		},
 		cli.StringFlag{
-			Name:  "logdir",
-			Value: defaultLogDir,
-			Usage: "directory to log output",
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
 		},
 		cli.BoolFlag{
 			Name:  "logconsole",
 			Usage: "enable logging to console",
 		},
+		home.LogRotateFlag,
+		home.LogMaxSizeFlag,
+		home.LogRetainFlag,
+		home.LogUnsafeFlag,
+		cli.DurationFlag{
+			Name:   "idle-lock",
+			Usage:  "lock keyDB after inactivity in command loop (0 disables)",
+			EnvVar: "MUTEIDLELOCK",
+		},
 	}
 	ce.app.Before = func(c *cli.Context) error {
+		if err := home.ApplyDirs(c, ""); err != nil {
+			return err
+		}
 		return ce.prepare(c, false)
 	}
 	ce.app.Action = func(c *cli.Context) {
@@ -206,6 +292,11 @@ func New() *CryptEngine {
 		Name:  "domain",
 		Usage: "key server domain",
 	}
+	numKeysFlag := cli.IntFlag{
+		Name:  "num-keys",
+		Value: msg.NumOfFutureKeys,
+		Usage: "number of precomputed future message keys",
+	}
 	ce.app.Commands = []cli.Command{
 		{
 			Name:  "db",
@@ -217,8 +308,16 @@ func New() *CryptEngine {
 					Flags: []cli.Flag{
 						cli.IntFlag{
 							Name:  "iterations",
-							Value: encdb.KDFIterations,
-							Usage: "number of KDF iterations used for KeyDB creation",
+							Usage: "number of KDF iterations used for KeyDB creation (0: calibrate)",
+						},
+						cli.DurationFlag{
+							Name:  "unlock-time",
+							Value: encdb.DefaultUnlockTime,
+							Usage: "unlock time the KDF iterations are calibrated for",
+						},
+						cli.BoolFlag{
+							Name:  "weak-passphrase",
+							Usage: "allow passphrase which is estimated to be weak",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -229,7 +328,8 @@ func New() *CryptEngine {
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.dbCreate(c.GlobalString("homedir"),
-							c.Int("iterations"))
+							c.Int("iterations"), c.Duration("unlock-time"),
+							c.Bool("weak-passphrase"))
 					},
 				},
 				{
@@ -253,6 +353,56 @@ func New() *CryptEngine {
 							c.Int("iterations"))
 					},
 				},
+				{
+					Name:  "backup",
+					Usage: "Backup KeyDB to passphrase-protected archive",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "archive file to write (must not exist)",
+						},
+						cli.IntFlag{
+							Name:  "iterations",
+							Value: encdb.KDFIterations,
+							Usage: "number of KDF iterations used for archive encryption",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("out") {
+							return log.Error("option --out is mandatory")
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbBackup(c.String("out"), c.Int("iterations"))
+					},
+				},
+				{
+					Name:  "restore",
+					Usage: "Restore KeyDB from passphrase-protected archive",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "in",
+							Usage: "archive file to read",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("in") {
+							return log.Error("option --in is mandatory")
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbRestore(c.GlobalString("homedir"),
+							c.String("in"))
+					},
+				},
 				/*
 					{
 						Name:  "status",
@@ -319,6 +469,74 @@ func New() *CryptEngine {
 						},
 					},
 				*/
+				{
+					Name:  "cleanup",
+					Usage: "Delete unused sessions and expired keys",
+					Description: `
+Delete sessions which have not been used for the given duration, message keys
+which do not belong to a remaining session, and session keys past their
+cleanup time. The number of deleted entries is reported on output-fd.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "unused",
+							Value: "2160h",
+							Usage: "delete sessions unused for this duration",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only report entries which would be deleted",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbCleanup(ce.fileTable.OutputFP,
+							c.String("unused"), c.Bool("dry-run"))
+					},
+				},
+				{
+					Name:  "audit-fs",
+					Usage: "Audit KeyDB for key material violating forward secrecy",
+					Description: `
+Scan KeyDB for retained key material which should have been deleted under the
+forward-secrecy rules: chain keys of sessions unused for the --unused duration,
+message keys which do not belong to a used session, private KeyInit keys past
+their expiry, and private session keys past their cleanup time. Each finding is
+reported on output-fd as a tab-separated line of the form:
+
+  TABLE	ROWID	REASON
+
+With --purge the found key material is deleted and overwritten.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "unused",
+							Value: "2160h",
+							Usage: "sessions unused for this duration are old",
+						},
+						cli.BoolFlag{
+							Name:  "purge",
+							Usage: "delete and overwrite found key material",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbAuditFS(ce.fileTable.OutputFP,
+							c.String("unused"), c.Bool("purge"))
+					},
+				},
 				{
 					Name:  "version",
 					Usage: "Show DB version",
@@ -333,6 +551,49 @@ func New() *CryptEngine {
 						ce.err = ce.dbVersion(ce.fileTable.OutputFP)
 					},
 				},
+				{
+					Name:  "schema",
+					Usage: "Show DB schema and version",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbSchema(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "sql",
+					Usage: "Execute read-only SQL queries (debugging only!)",
+					Description: `
+Reads SQL queries line by line from input-fd and executes them against the
+decrypted KeyDB. The output contains secret key material, handle with care!
+Only read-only access is supported and option --readonly is mandatory.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "readonly",
+							Usage: "acknowledge read-only access (mandatory)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !c.Bool("readonly") {
+							return log.Error("option --readonly is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbSQL(ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, ce.fileTable.InputFP)
+					},
+				},
 			},
 		},
 		{
@@ -342,6 +603,11 @@ func New() *CryptEngine {
 				{
 					Name:  "get",
 					Usage: "get key server capabilities",
+					Description: `
+Requests the capabilities from the key server and stores them in the key
+database, where they are used for the next 24 hours (or indefinitely with
+--offline) without contacting the key server again.
+`,
 					Flags: []cli.Flag{
 						domainFlag,
 						cli.StringFlag{
@@ -365,6 +631,11 @@ func New() *CryptEngine {
 				{
 					Name:  "show",
 					Usage: "show key server capabilities",
+					Description: `
+Shows the capabilities of the key server. Capabilities stored in the key
+database are used, if they are not expired (or --offline is set). Otherwise,
+they are requested from the key server.
+`,
 					Flags: []cli.Flag{
 						domainFlag,
 						cli.StringFlag{
@@ -385,6 +656,24 @@ func New() *CryptEngine {
 						ce.err = ce.showCapabilities(c.String("domain"), c.String("host"))
 					},
 				},
+				{
+					Name:  "status",
+					Usage: "show availability status of contacted key servers",
+					Description: `
+Shows the circuit breaker status of all key servers contacted by this
+process. After repeated failures a key server is not contacted for a
+cool-down period (state 'open') and dependent operations fail early.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.ShowKeyServerStatus(ce.fileTable.OutputFP)
+					},
+				},
 			},
 		},
 		{
@@ -396,13 +685,28 @@ func New() *CryptEngine {
 					Usage: "generate a user ID",
 					Description: `
 Generates a new user ID (UID) and stores the keys locally, but doesn't
-register the UID message with the keyserver yet.
+register the UID message with the keyserver yet. By default the UID message is
+valid for one year and renewed with every update. With --valid-from or
+--valid-for the UID message gets a fixed validity period (at least one day)
+which is not renewed, e.g., for short-lived user IDs.
 `,
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
 							Usage: "user ID to generate",
 						},
+						cli.StringFlag{
+							Name:  "valid-from",
+							Usage: "start of fixed validity period (RFC 3339, default: now)",
+						},
+						cli.DurationFlag{
+							Name:  "valid-for",
+							Usage: "duration of fixed validity period (default: 8760h)",
+						},
+						cli.BoolFlag{
+							Name:  "sigescrow",
+							Usage: "include escrow key to recover user ID (see 'uid escrow')",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -415,7 +719,8 @@ register the UID message with the keyserver yet.
 					},
 					Action: func(c *cli.Context) {
 						ce.err = ce.generate(c.String("id"), c.GlobalBool("keyserver"),
-							ce.fileTable.OutputFP)
+							c.String("valid-from"), c.Duration("valid-for"),
+							c.Bool("sigescrow"), ce.fileTable.OutputFP)
 					},
 				},
 				{
@@ -433,6 +738,10 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 							Name:  "token",
 							Usage: "payment token",
 						},
+						cli.StringFlag{
+							Name:  "invitation",
+							Usage: "invitation code (if required by key server)",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -447,17 +756,29 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.register(c.String("id"), c.String("token"))
+						ce.err = ce.register(c.String("id"), c.String("token"),
+							c.String("invitation"))
 					},
 				},
 				{
 					Name:  "genupdate",
 					Usage: "generate update for user ID",
+					Description: `
+Generate an update for a (registered) user ID. With --msgsigkey a dedicated
+long-term message signing key is added to the user ID (protocol version 1.1).
+Messages are then signed with this key instead of the signature key of the user
+ID, which is rotated with every update. The update has to be registered with
+the key server with 'uid update'.
+`,
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
 							Usage: "user ID to update",
 						},
+						cli.BoolFlag{
+							Name:  "msgsigkey",
+							Usage: "add dedicated message signing key",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -469,20 +790,31 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.genupdate(c.String("id"))
+						ce.err = ce.genupdate(c.String("id"), c.Bool("msgsigkey"))
 					},
 				},
 				{
-					Name:  "update",
-					Usage: "update user ID",
+					Name:  "genlink",
+					Usage: "generate update which links user ID to foreign key hashchain",
+					Description: `
+Generate an update for a (registered) user ID which links it to another user ID
+of the user in a foreign key hashchain (protocol version 1.3). The hash chain
+of the foreign domain must have been synced. With --authoritative the link has
+to be confirmed by the key server. The update has to be registered with the key
+server with 'uid update'.
+`,
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
-							Usage: "user ID to update",
+							Usage: "user ID to link",
 						},
 						cli.StringFlag{
-							Name:  "token",
-							Usage: "payment token",
+							Name:  "foreign",
+							Usage: "own user ID in foreign key hashchain",
+						},
+						cli.BoolFlag{
+							Name:  "authoritative",
+							Usage: "request authoritative link",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -492,29 +824,27 @@ Tries to register a pregenerated UID message with the corresponding keyserver.
 						if !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
-						if !c.IsSet("token") {
-							return log.Error("option --token is mandatory")
+						if !c.IsSet("foreign") {
+							return log.Error("option --foreign is mandatory")
 						}
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.update(c.String("id"), c.String("token"))
+						ce.err = ce.genlink(c.String("id"), c.String("foreign"),
+							c.Bool("authoritative"))
 					},
 				},
 				{
-					Name:  "delete",
-					Usage: "delete user ID",
+					Name:  "gentombstone",
+					Usage: "generate tombstone for user ID",
 					Description: `
-Delete a user ID (registered or unregistered).
+Generate the final update for a (registered) user ID which marks it as deleted.
+The tombstone has to be registered with the key server with 'uid update'.
 `,
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
-							Usage: "user ID to delete",
-						},
-						cli.BoolFlag{
-							Name:  "force",
-							Usage: "force deletion (do not prompt)",
+							Usage: "user ID to retire",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -527,43 +857,16 @@ Delete a user ID (registered or unregistered).
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.deleteUID(c.String("id"), c.Bool("force"))
-					},
-				},
-				{
-					Name:  "list",
-					Usage: "list own (mapped) user IDs",
-					Before: func(c *cli.Context) error {
-						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						return ce.prepare(c, true)
-					},
-					Action: func(c *cli.Context) {
-						ce.err = ce.listUIDs(ce.fileTable.OutputFP)
+						ce.err = ce.gentombstone(c.String("id"))
 					},
 				},
-			},
-		},
-		{
-			Name:  "keyinit",
-			Usage: "commands for KeyInit messages",
-			Subcommands: []cli.Command{
 				{
-					Name:  "add",
-					Usage: "add new KeyInit message",
+					Name:  "update",
+					Usage: "update user ID",
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
-							Usage: "user ID",
-						},
-						cli.StringFlag{
-							Name:  "mixaddress",
-							Usage: "mix address for KeyInit message",
-						},
-						cli.StringFlag{
-							Name:  "nymaddress",
-							Usage: "nym address for KeyInit message",
+							Usage: "user ID to update",
 						},
 						cli.StringFlag{
 							Name:  "token",
@@ -577,30 +880,29 @@ Delete a user ID (registered or unregistered).
 						if !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
-						if !c.IsSet("mixaddress") {
-							return log.Error("option --mixaddress is mandatory")
-						}
-						if !c.IsSet("nymaddress") {
-							return log.Error("option --nymaddress is mandatory")
-						}
 						if !c.IsSet("token") {
 							return log.Error("option --token is mandatory")
 						}
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.addKeyInit(c.String("id"),
-							c.String("mixaddress"), c.String("nymaddress"),
-							c.String("token"))
+						ce.err = ce.update(c.String("id"), c.String("token"))
 					},
 				},
 				{
-					Name:  "fetch",
-					Usage: "fetch a KeyInit message",
+					Name:  "delete",
+					Usage: "delete user ID",
+					Description: `
+Delete a user ID (registered or unregistered).
+`,
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
-							Usage: "user ID",
+							Usage: "user ID to delete",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "force deletion (do not prompt)",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -613,12 +915,12 @@ Delete a user ID (registered or unregistered).
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.fetchKeyInit(c.String("id"))
+						ce.err = ce.deleteUID(c.String("id"), c.Bool("force"))
 					},
 				},
 				{
-					Name:  "flush",
-					Usage: "flush KeyInit messages",
+					Name:  "sigkeyhash",
+					Usage: "show SIGKEYHASH of user ID on output-fd",
 					Flags: []cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
@@ -635,20 +937,330 @@ Delete a user ID (registered or unregistered).
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.flushKeyInit(c.String("id"))
+						ce.err = ce.showSigKeyHash(ce.fileTable.OutputFP,
+							c.String("id"))
 					},
 				},
-			},
-		},
-		{
-			Name:  "hashchain",
-			Usage: "commands for hash chain operations",
-			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "show public UID message of user ID on output-fd",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.showPublicUID(ce.fileTable.OutputFP,
+							c.String("id"))
+					},
+				},
+				{
+					Name:  "expiry",
+					Usage: "show expiry times of UID and KeyInit messages of user ID on output-fd",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.showExpiry(ce.fileTable.OutputFP,
+							c.String("id"))
+					},
+				},
+				{
+					Name:  "escrow",
+					Usage: "commands for escrow keys of user IDs",
+					Description: `
+User IDs generated with 'uid generate --sigescrow' contain an escrow key which
+can authorize a successor UID message, if the signature key of the user ID has
+been lost. Export the escrow key with 'uid escrow export --delete' and store it
+offline. To recover the user ID, import the escrow key with 'uid escrow import'
+(on a new device), search the hash chain for the user ID, generate the
+successor with 'uid escrow recover', and register it with 'uid update'. The
+successor contains a new escrow key which has to be exported again.
+`,
+					Subcommands: []cli.Command{
+						{
+							Name:  "export",
+							Usage: "export private escrow key of user ID to output-fd",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:  "id",
+									Usage: "user ID",
+								},
+								cli.BoolFlag{
+									Name:  "delete",
+									Usage: "delete escrow key from keyDB after export",
+								},
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								return ce.prepare(c, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.exportEscrow(ce.fileTable.OutputFP,
+									c.String("id"), c.Bool("delete"))
+							},
+						},
+						{
+							Name:  "import",
+							Usage: "import private escrow key from input-fd",
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								return ce.prepare(c, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.importEscrow(ce.fileTable.InputFP)
+							},
+						},
+						{
+							Name:  "recover",
+							Usage: "generate successor of user ID authorized by escrow key",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:  "id",
+									Usage: "user ID to recover",
+								},
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								return ce.prepare(c, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.recoverEscrow(c.String("id"))
+							},
+						},
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list own (mapped) user IDs",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.listUIDs(ce.fileTable.OutputFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "keyinit",
+			Usage: "commands for KeyInit messages",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "add new KeyInit message",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+						cli.StringFlag{
+							Name:  "mixaddress",
+							Usage: "mix address for KeyInit message",
+						},
+						cli.StringFlag{
+							Name:  "nymaddress",
+							Usage: "nym address for KeyInit message",
+						},
+						cli.StringSliceFlag{
+							Name:  "token",
+							Usage: "payment token (one per KeyInit message)",
+						},
+						cli.IntFlag{
+							Name:  "buckets",
+							Usage: "number of time-bucketed KeyInit messages (0 for a single fallback KeyInit)",
+						},
+						cli.DurationFlag{
+							Name:  "bucket-duration",
+							Value: 24 * time.Hour,
+							Usage: "validity duration of a time-bucketed KeyInit message",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("mixaddress") {
+							return log.Error("option --mixaddress is mandatory")
+						}
+						if !c.IsSet("nymaddress") {
+							return log.Error("option --nymaddress is mandatory")
+						}
+						if !c.IsSet("token") {
+							return log.Error("option --token is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.addKeyInit(c.String("id"),
+							c.String("mixaddress"), c.String("nymaddress"),
+							c.StringSlice("token"), c.Int("buckets"),
+							c.Duration("bucket-duration"))
+					},
+				},
+				{
+					Name:  "due",
+					Usage: "show number of time-bucketed KeyInit messages to add",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+						cli.IntFlag{
+							Name:  "buckets",
+							Value: 7,
+							Usage: "number of buckets to cover",
+						},
+						cli.DurationFlag{
+							Name:  "bucket-duration",
+							Value: 24 * time.Hour,
+							Usage: "validity duration of a time-bucketed KeyInit message",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dueKeyInit(ce.fileTable.OutputFP,
+							c.String("id"), c.Int("buckets"),
+							c.Duration("bucket-duration"))
+					},
+				},
+				{
+					Name:  "fetch",
+					Usage: "fetch a KeyInit message",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.fetchKeyInit(c.String("id"))
+					},
+				},
+				{
+					Name:  "flush",
+					Usage: "flush KeyInit messages",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.flushKeyInit(c.String("id"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "hashchain",
+			Usage: "commands for hash chain operations",
+			Subcommands: []cli.Command{
 				{
 					Name:  "sync",
 					Usage: "sync hash chain with key server",
+					Description: `
+Syncs the local hash chain copy with the key server. If option --filter is set
+only the entries matching a bloom filter of all known identities of the domain
+(and the ones given with --id) are downloaded. A filtered hash chain cannot be
+fully validated, a later sync without --filter replaces it with a complete one.
+
+Without --filter the missing entries are fetched in batches of --batch entries
+with up to --parallel concurrent requests. Every batch is stored in a single
+transaction, an interrupted sync resumes after the last stored batch. The
+progress of the sync is reported on status-fd.
+`,
 					Flags: []cli.Flag{
 						domainFlag,
+						cli.BoolFlag{
+							Name:  "filter",
+							Usage: "only sync entries matching known identities",
+						},
+						cli.StringSliceFlag{
+							Name:  "id",
+							Usage: "additional user ID to add to filter",
+						},
+						cli.Float64Flag{
+							Name:  "rate",
+							Value: bloom.DefaultRate,
+							Usage: "false positive rate of filter",
+						},
+						cli.IntFlag{
+							Name:  "batch",
+							Value: defaultSyncBatch,
+							Usage: "number of entries fetched per request",
+						},
+						cli.IntFlag{
+							Name:  "parallel",
+							Value: defaultSyncParallel,
+							Usage: "number of concurrent requests",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -657,10 +1269,26 @@ Delete a user ID (registered or unregistered).
 						if !c.IsSet("domain") {
 							return log.Error("option --domain is mandatory")
 						}
+						if !c.Bool("filter") && (c.IsSet("id") || c.IsSet("rate")) {
+							return log.Error("options --id and --rate require --filter")
+						}
+						if c.Bool("filter") && (c.IsSet("batch") || c.IsSet("parallel")) {
+							return log.Error("options --batch and --parallel exclude --filter")
+						}
+						if c.Int("batch") < 1 || c.Int("parallel") < 1 {
+							return log.Error("options --batch and --parallel must be positive")
+						}
 						return ce.prepare(c, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.syncHashChain(c.String("domain"))
+						if c.Bool("filter") {
+							ce.err = ce.syncHashChainFiltered(c.String("domain"),
+								c.StringSlice("id"), c.Float64("rate"))
+						} else {
+							ce.err = ce.syncHashChainBatched(c.String("domain"),
+								uint64(c.Int("batch")), c.Int("parallel"),
+								ce.fileTable.StatusFP)
+						}
 					},
 				},
 				{
@@ -682,6 +1310,50 @@ Delete a user ID (registered or unregistered).
 						ce.err = ce.validateHashChain(c.String("domain"))
 					},
 				},
+				{
+					Name:  "pin",
+					Usage: "pin known-good hash chain head",
+					Description: `
+Validates the local hash chain and pins the entry at the given position (or the
+last entry, if --position is not set) as a known-good hash chain head. Later
+syncs and validations fail, if the key server rolled back its hash chain to a
+position before the pinned one or replaced the pinned entry.
+`,
+					Flags: []cli.Flag{
+						domainFlag,
+						cli.IntFlag{
+							Name:  "position",
+							Usage: "hash chain position to pin",
+						},
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "remove pin instead",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("domain") {
+							return log.Error("option --domain is mandatory")
+						}
+						if c.Bool("remove") && c.IsSet("position") {
+							return log.Error("options --remove and --position exclude each other")
+						}
+						if c.Int("position") < 0 {
+							return log.Error("option --position must not be negative")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						if c.Bool("remove") {
+							ce.err = ce.keyDB.DelPinnedHashChainPos(c.String("domain"))
+						} else {
+							ce.err = ce.pinHashChain(c.String("domain"),
+								uint64(c.Int("position")), !c.IsSet("position"))
+						}
+					},
+				},
 				{
 					Name:  "search",
 					Usage: "search local hash chain and add UID messages",
@@ -791,6 +1463,15 @@ Delete a user ID (registered or unregistered).
 					Name:  "nymaddress",
 					Usage: "nymaddress to receive future messages at",
 				},
+				numKeysFlag,
+				cli.BoolFlag{
+					Name:  "small-padding",
+					Usage: "pad message to smallest fitting size (low-bandwidth)",
+				},
+				cli.BoolFlag{
+					Name:  "reset",
+					Usage: "restart session with recipient (after 'session unknown' errors)",
+				},
 			},
 			Before: func(c *cli.Context) error {
 				if len(c.Args()) > 0 {
@@ -810,12 +1491,16 @@ Delete a user ID (registered or unregistered).
 			Action: func(c *cli.Context) {
 				ce.err = ce.encrypt(ce.fileTable.OutputFP, c.String("from"),
 					c.String("to"), c.Bool("sign"), c.String("nymaddress"),
-					ce.fileTable.InputFP, ce.fileTable.StatusFP)
+					uint64(c.Int("num-keys")), c.Bool("small-padding"),
+					c.Bool("reset"), ce.fileTable.InputFP, ce.fileTable.StatusFP)
 			},
 		},
 		{
 			Name:  "decrypt",
 			Usage: "decrypt message",
+			Flags: []cli.Flag{
+				numKeysFlag,
+			},
 			Before: func(c *cli.Context) error {
 				if len(c.Args()) > 0 {
 					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
@@ -823,10 +1508,278 @@ Delete a user ID (registered or unregistered).
 				return ce.prepare(c, true)
 			},
 			Action: func(c *cli.Context) {
-				ce.err = ce.decrypt(ce.fileTable.OutputFP, ce.fileTable.InputFP,
+				ce.err = ce.decrypt(ce.fileTable.OutputFP,
+					uint64(c.Int("num-keys")), ce.fileTable.InputFP,
 					ce.fileTable.StatusFP)
 			},
 		},
+		{
+			Name:  "sync",
+			Usage: "commands for multi-device synchronization",
+			Subcommands: []cli.Command{
+				{
+					Name:  "export",
+					Usage: "export key material for other devices to output-fd",
+					Description: `
+Writes all private UIDs, private KeyInits, sessions, session states, and
+session keys as JSON to output-fd. The output contains secret key material,
+handle with care! Use 'mutectrl sync export' to get an encrypted bundle.
+With --observer the private signature keys are omitted, the importing device
+can decrypt messages but cannot sign them.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "observer",
+							Usage: "omit private signature keys (decryption-only)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.ExportSync(ce.fileTable.OutputFP,
+							c.Bool("observer"))
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "import key material of other devices from input-fd",
+					Description: `
+Reads key material exported with 'sync export' on another device from input-fd
+and merges it into the keyDB. Existing entries are kept, except for session
+states which are replaced by more advanced ones.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.ImportSync(ce.fileTable.InputFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "transcript",
+			Usage: "commands for conversation transcripts",
+			Subcommands: []cli.Command{
+				{
+					Name:  "sign",
+					Usage: "add key history to transcript and sign it",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID (exporter)",
+						},
+						cli.StringFlag{
+							Name:  "contact",
+							Usage: "user ID of contact",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.signTranscript(ce.fileTable.OutputFP,
+							ce.fileTable.InputFP, c.String("id"),
+							c.String("contact"))
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "verify transcript and check key history against local hash chain",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.verifyTranscript(ce.fileTable.InputFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "session",
+			Usage: "commands for session states",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list session states on output-fd",
+					Description: `
+List all session states as tab-separated lines of the form:
+
+  ID	CONTACT	SESSIONSTATEKEY	NUMBER_OF_SENT_MESSAGES
+
+Session states which cannot be mapped to a known pair of user IDs are listed
+with ID and CONTACT '?'.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.listSessions(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "show",
+					Usage: "show session state with contact on output-fd",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+						cli.StringFlag{
+							Name:  "contact",
+							Usage: "user ID of contact",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.showSession(ce.fileTable.OutputFP,
+							c.String("id"), c.String("contact"))
+					},
+				},
+				{
+					Name:  "reset",
+					Usage: "reset session state with contact",
+					Description: `
+Delete the session state with contact. The next message to contact starts a
+new key agreement and restarts the session on the side of contact.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "user ID",
+						},
+						cli.StringFlag{
+							Name:  "contact",
+							Usage: "user ID of contact",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.resetSession(c.String("id"),
+							c.String("contact"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "debug",
+			Usage: "commands for debugging",
+			Subcommands: []cli.Command{
+				{
+					Name:  "loglevel",
+					Usage: "show or change logging level",
+					Description: `
+Without --level the current logging level is shown on output-fd. With --level
+the logging level is changed at runtime, which is useful in interactive mode
+to temporarily enable debug logging without restarting the session.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "level",
+							Usage: "new logging level {trace, debug, info, warn, error, critical}",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = debugLogLevel(ce.fileTable.OutputFP, c.String("level"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "protocol",
+			Usage: "commands for protocol information",
+			Subcommands: []cli.Command{
+				{
+					Name:  "describe",
+					Usage: "describe protocol on output-fd",
+					Description: `
+Describe the protocol-visible behavior of this version: supported message format
+versions, UID protocol versions, ciphersuites, and feature flags.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "output description as JSON",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = def.WriteProtocol(ce.fileTable.OutputFP,
+							c.Bool("json"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: "lock keyDB (passphrase is read again by the next command)",
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				return ce.prepare(c, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = ce.Close()
+			},
+		},
 		{
 			Name:  "quit",
 			Usage: "end program",
@@ -842,6 +1795,10 @@ Delete a user ID (registered or unregistered).
 		},
 	}
 	ce.cache = cache.New()
+	// key server clients depend on the configuration
+	def.OnConfigChange(func(*configclient.Config) {
+		ce.cache.FlushClients()
+	})
 	return &ce
 }
 
@@ -858,6 +1815,69 @@ func (ce *CryptEngine) Start(args []string) error {
 	return nil
 }
 
+// NewInProcess returns a new crypt engine for in-process use with the key
+// database in homedir, which is not opened yet (see Unlock and Exec). The
+// caller is responsible to initialize the Mute configuration (see
+// def.InitMute) and logging beforehand.
+func NewInProcess(homedir string) *CryptEngine {
+	ce := New()
+	ce.homedir = homedir
+	ce.prepared = true
+	return ce
+}
+
+// Open returns a new crypt engine for in-process use with the key database
+// in homedir opened with passphrase (see NewInProcess).
+func Open(homedir string, passphrase []byte) (*CryptEngine, error) {
+	ce := NewInProcess(homedir)
+	if err := ce.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return ce, nil
+}
+
+// Unlock opens the key database of the in-process crypt engine with
+// passphrase, if it is not open already.
+func (ce *CryptEngine) Unlock(passphrase []byte) error {
+	if ce.keyDB != nil {
+		return nil
+	}
+	return ce.openKeyDBWithPassphrase(passphrase)
+}
+
+// Exec executes the mutecrypt command line args (including the program name)
+// with the in-process crypt engine. The file descriptors given on the command
+// line are ignored, files is used instead. If the command requires the key
+// database and it is not open yet, the passphrase is read from
+// files.PassphraseFP. The key database stays open after Exec returns.
+func (ce *CryptEngine) Exec(args []string, files *descriptors.Table) error {
+	ce.fileTable = files
+	ce.configured = false
+	ce.err = nil
+	ce.app.Name = args[0]
+	if err := ce.app.Run(args); err != nil {
+		return err
+	}
+	err := ce.err
+	ce.err = nil
+	if err == errExit {
+		return nil
+	}
+	return err
+}
+
+func (ce *CryptEngine) openKeyDBWithPassphrase(passphrase []byte) error {
+	keydbname := filepath.Join(ce.homedir, "keys")
+	log.Infof("open keyDB %s", keydbname)
+	var err error
+	ce.keyDB, err = keydb.Open(keydbname, passphrase)
+	if err != nil {
+		return err
+	}
+	ce.cache.SetStore(&capabilitiesStore{ce.keyDB}, cache.DefaultTTL)
+	return nil
+}
+
 func (ce *CryptEngine) openKeyDB() error {
 	// read passphrase
 	log.Infof("read passphrase from fd %d", ce.fileTable.PassphraseFD)
@@ -868,18 +1888,14 @@ func (ce *CryptEngine) openKeyDB() error {
 	defer bzero.Bytes(passphrase)
 	log.Info("done")
 	// open keyDB
-	keydbname := filepath.Join(ce.homedir, "keys")
-	log.Infof("open keyDB %s", keydbname)
-	ce.keyDB, err = keydb.Open(keydbname, passphrase)
-	if err != nil {
-		return err
-	}
-	return nil
+	return ce.openKeyDBWithPassphrase(passphrase)
 }
 
 // Close the underlying database of the crypt engine.
 func (ce *CryptEngine) Close() error {
+	ce.cache.CloseIdleConnections()
 	if ce.keyDB != nil {
+		ce.cache.SetStore(nil, cache.DefaultTTL)
 		err := ce.keyDB.Close()
 		ce.keyDB = nil
 		return err
@@ -10,14 +10,24 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/keydb"
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/strength"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // create a new KeyDB.
-func (ce *CryptEngine) dbCreate(homedir string, iterations int) error {
+func (ce *CryptEngine) dbCreate(
+	homedir string,
+	iterations int,
+	unlockTime time.Duration,
+	allowWeak bool,
+) error {
 	keydbname := filepath.Join(homedir, "keys")
 	// read passphrase
 	log.Infof("read passphrase from fd %d", ce.fileTable.PassphraseFD)
@@ -42,6 +52,20 @@ func (ce *CryptEngine) dbCreate(homedir string, iterations int) error {
 	if !bytes.Equal(passphrase, passphrase2) {
 		return log.Error("passphrases differ")
 	}
+	// check passphrase strength
+	if r := strength.Estimate(passphrase); r.Weak() {
+		if !allowWeak {
+			return log.Errorf("passphrase too weak: %s (use --weak-passphrase to override)",
+				r.Warning)
+		}
+		log.Warnf("weak passphrase: %s", r.Warning)
+	}
+	// calibrate KDF
+	if iterations == 0 {
+		iterations = encdb.Calibrate(unlockTime)
+		log.Infof("calibrated %d KDF iterations for unlock time %s",
+			iterations, unlockTime)
+	}
 	// create keyDB
 	log.Infof("create keyDB '%s'", keydbname)
 	return keydb.Create(keydbname, passphrase, iterations)
@@ -106,6 +130,50 @@ func (ce *CryptEngine) dbIncremental(pagesToRemove int64) error {
 	return ce.keyDB.Incremental(pagesToRemove)
 }
 
+// dbCleanup deletes sessions unused for the given duration and expired keys
+// from keyDB and writes a report to w. If dryRun is true, nothing is deleted.
+func (ce *CryptEngine) dbCleanup(w io.Writer, unused string, dryRun bool) error {
+	duration, err := time.ParseDuration(unused)
+	if err != nil {
+		return log.Error(err)
+	}
+	now := times.Now()
+	report, err := ce.keyDB.Cleanup(now-int64(duration.Seconds()), now, dryRun)
+	if err != nil {
+		return err
+	}
+	action := "deleted"
+	if dryRun {
+		action = "to delete"
+	}
+	fmt.Fprintf(w, "sessions %s: %d\n", action, report.Sessions)
+	fmt.Fprintf(w, "message keys %s: %d\n", action, report.MessageKeys)
+	fmt.Fprintf(w, "session keys %s: %d\n", action, report.SessionKeys)
+	return nil
+}
+
+// dbAuditFS audits keyDB for retained key material which violates forward
+// secrecy and writes the findings to w. If purge is true, the found key
+// material is deleted.
+func (ce *CryptEngine) dbAuditFS(w io.Writer, unused string, purge bool) error {
+	duration, err := time.ParseDuration(unused)
+	if err != nil {
+		return log.Error(err)
+	}
+	now := times.Now()
+	findings, err := ce.keyDB.AuditFS(now-int64(duration.Seconds()), now, purge)
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", f.Table, f.ID, f.Reason)
+	}
+	if purge {
+		log.Infof("cryptengine: %d finding(s) purged", len(findings))
+	}
+	return nil
+}
+
 func (ce *CryptEngine) dbVersion(w io.Writer) error {
 	version, err := ce.keyDB.Version()
 	if err != nil {
@@ -115,3 +183,49 @@ func (ce *CryptEngine) dbVersion(w io.Writer) error {
 	fmt.Fprintf(w, "version=%s\n", version)
 	return nil
 }
+
+func (ce *CryptEngine) dbSchema(w io.Writer) error {
+	version, err := ce.keyDB.Version()
+	if err != nil {
+		return err
+	}
+	schema, err := ce.keyDB.Schema()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "keydb:\n")
+	fmt.Fprintf(w, "version=%s\n", version)
+	for _, stmt := range schema {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	return nil
+}
+
+// execute read-only SQL queries read line by line from r against KeyDB.
+func (ce *CryptEngine) dbSQL(w, statusfp io.Writer, r io.Reader) error {
+	fmt.Fprintf(statusfp, "WARNING: debug SQL console for KeyDB, output "+
+		"contains secret key material!\n")
+	log.Warn("debug SQL console for KeyDB opened")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		query := strings.TrimSpace(scanner.Text())
+		if query == "" {
+			continue
+		}
+		columns, rows, err := ce.keyDB.QueryReadOnly(query)
+		if err != nil {
+			// report error and continue with next query
+			fmt.Fprintf(statusfp, "error: %s\n", err)
+			continue
+		}
+		fmt.Fprintln(w, strings.Join(columns, "|"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "|"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return log.Error(err)
+	}
+	log.Info("debug SQL console for KeyDB closed")
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// debugLogLevel changes the logging level to level (if defined) and writes
+// the current logging level to w.
+func debugLogLevel(w io.Writer, level string) error {
+	if level != "" {
+		if err := log.SetLevel(level); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "loglevel=%s\n", log.Level())
+	return nil
+}
@@ -16,8 +16,9 @@ import (
 	"github.com/mutecomm/mute/uid"
 )
 
-// TODO: better selection of identities. Take NOTBEFORE and NOTAFTER into account.
-// At the moment only the most current UID message is used for every identity.
+// getRecipientIdentities returns all UID messages which can be used to
+// decrypt messages: the most current UID message of every identity and all
+// prior UID messages which are not expired yet (see keydb.GetPrivateUIDs).
 func (ce *CryptEngine) getRecipientIdentities() ([]*uid.Message, error) {
 	var uidMsgs []*uid.Message
 	identities, err := ce.keyDB.GetPrivateIdentities()
@@ -26,41 +27,47 @@ func (ce *CryptEngine) getRecipientIdentities() ([]*uid.Message, error) {
 	}
 	for _, identity := range identities {
 		log.Debugf("identity=%s", identity)
-		// TODO: get all UID messages for given identity which are not expired
-		uidMsg, _, err := ce.keyDB.GetPrivateUID(identity, true)
+		msgs, err := ce.keyDB.GetPrivateUIDs(identity)
 		if err != nil {
 			return nil, err
 		}
-		uidMsgs = append(uidMsgs, uidMsg)
+		uidMsgs = append(uidMsgs, msgs...)
 	}
 	return uidMsgs, nil
 }
 
-func (ce *CryptEngine) decrypt(w io.Writer, r io.Reader, statusfp *os.File) error {
+// Decrypt decrypts the base64 encoded message read from r and writes the
+// plaintext to w. It is the in-process equivalent of `mutecrypt decrypt` and
+// returns the identity of the sender and the signature of the message (if
+// any). For messages of unknown sessions msg.ErrSessionUnknown is returned
+// together with the identity of the sender.
+func (ce *CryptEngine) Decrypt(
+	w io.Writer,
+	numOfKeys uint64,
+	r io.Reader,
+) (senderID, sig string, err error) {
 	// retrieve all possible recipient identities from keyDB
 	identities, err := ce.getRecipientIdentities()
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	// read pre-header
 	r = base64.NewDecoder(r)
 	version, preHeader, err := msg.ReadFirstOuterHeader(r)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	// check version
 	if version > msg.Version {
-		return log.Errorf("cryptengine: newer message version, please update software")
+		return "", "", log.Errorf("cryptengine: newer message version, please update software")
 	}
 	if version < msg.Version {
-		return log.Errorf("cryptengine: outdated message version, cannot process")
+		return "", "", log.Errorf("cryptengine: outdated message version, cannot process")
 	}
 
 	// decrypt message
-	var senderID string
-	var sig string
 	args := &msg.DecryptArgs{
 		Writer:     w,
 		Identities: identities,
@@ -68,11 +75,26 @@ func (ce *CryptEngine) decrypt(w io.Writer, r io.Reader, statusfp *os.File) erro
 		Reader:     r,
 		Rand:       cipher.RandReader,
 		KeyStore:   ce,
+		NumOfKeys:  numOfKeys,
+	}
+	// TODO: handle msg.ErrStatusError, should trigger a subsequent
+	// encrypted message with StatusError
+	return msg.Decrypt(args)
+}
+
+func (ce *CryptEngine) decrypt(
+	w io.Writer,
+	numOfKeys uint64,
+	r io.Reader,
+	statusfp *os.File,
+) error {
+	senderID, sig, err := ce.Decrypt(w, numOfKeys, r)
+	if err == msg.ErrSessionUnknown {
+		// report sender, the session has to be restarted
+		fmt.Fprintf(statusfp, "SENDERIDENTITY:\t%s\n", senderID)
+		return err
 	}
-	senderID, sig, err = msg.Decrypt(args)
 	if err != nil {
-		// TODO: handle msg.ErrStatusError, should trigger a subsequent
-		// encrypted message with StatusError
 		return err
 	}
 	fmt.Fprintf(statusfp, "SENDERIDENTITY:\t%s\n", senderID)
@@ -13,49 +13,61 @@ import (
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 )
 
 // encrypt reads data from r, encrypts it for identity to (with identity from
 // as sender), and writes it to w.
-func (ce *CryptEngine) encrypt(
+// Encrypt encrypts the message read from r from user ID from to user ID to
+// and writes it base64 encoded to w. It is the in-process equivalent of
+// `mutecrypt encrypt` and returns the nymaddress the message has to be
+// delivered to. If reset is true or the session with to has been reset with
+// `mutecrypt session reset`, the session with to is restarted (see
+// msg.ErrSessionUnknown).
+func (ce *CryptEngine) Encrypt(
 	w io.Writer,
 	from, to string,
 	sign bool,
 	nymAddress string,
+	numOfKeys uint64,
+	smallPadding bool,
+	reset bool,
 	r io.Reader,
-	statusfp *os.File,
-) error {
+) (string, error) {
 	// map pseudonyms
 	fromID, fromDomain, err := identity.MapPlus(from)
 	if err != nil {
-		return err
+		return "", err
 	}
 	toID, err := identity.Map(to)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// get fromUID from keyDB
 	fromUID, _, err := ce.keyDB.GetPrivateUID(fromID, true)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// get toUID from keyDB
 	toUID, _, found, err := ce.keyDB.GetPublicUID(toID, math.MaxInt64) // TODO: use simpler API
 	if err != nil {
-		return err
+		return "", err
 	}
 	if !found {
-		return log.Errorf("not UID for '%s' found", toID)
+		return "", log.Errorf("not UID for '%s' found", toID)
+	}
+	if toUID.IsTombstone() {
+		return "", log.Errorf("%s: %s", uid.ErrTombstone, toID)
 	}
 	// encrypt message
 	senderLastKeychainHash, err := ce.keyDB.GetLastHashChainEntry(fromDomain)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var privateSigKey *[64]byte
 	if sign {
-		privateSigKey = fromUID.PrivateSigKey64()
+		privateSigKey = fromUID.PrivateMsgSigKey64()
 	}
 	args := &msg.EncryptArgs{
 		Writer:                 w,
@@ -67,8 +79,46 @@ func (ce *CryptEngine) encrypt(
 		Reader:                 r,
 		Rand:                   cipher.RandReader,
 		KeyStore:               ce,
+		NumOfKeys:              numOfKeys,
+		SmallPadding:           smallPadding,
+	}
+	// sessions reset with `session reset` are restarted with the next message
+	stateKey, err := sessionStateKey(fromUID, toUID)
+	if err != nil {
+		return "", err
+	}
+	marked, err := ce.keyDB.GetSessionReset(stateKey)
+	if err != nil {
+		return "", err
+	}
+	if reset || marked {
+		args.StatusCode = msg.StatusReset
 	}
 	nymAddress, err = msg.Encrypt(args)
+	if err != nil {
+		return "", err
+	}
+	if marked {
+		if err := ce.keyDB.DelSessionReset(stateKey); err != nil {
+			return "", err
+		}
+	}
+	return nymAddress, nil
+}
+
+func (ce *CryptEngine) encrypt(
+	w io.Writer,
+	from, to string,
+	sign bool,
+	nymAddress string,
+	numOfKeys uint64,
+	smallPadding bool,
+	reset bool,
+	r io.Reader,
+	statusfp *os.File,
+) error {
+	nymAddress, err := ce.Encrypt(w, from, to, sign, nymAddress, numOfKeys,
+		smallPadding, reset, r)
 	if err != nil {
 		return err
 	}
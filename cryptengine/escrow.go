@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// escrowKey is the export format of the private escrow key of a user ID (see
+// uid.SigEscrowVersion).
+type escrowKey struct {
+	IDENTITY string // mapped user ID
+	PUBKEY   string // public escrow key (UIDContent.SIGESCROW.PUBKEY)
+	PRIVKEY  string // private escrow key
+}
+
+// latestUID returns the most recent UID message of id, the private one is
+// preferred. If no UID message exists, nil is returned.
+func (ce *CryptEngine) latestUID(id string) (*uid.Message, error) {
+	ids, err := ce.keyDB.GetPrivateIdentities()
+	if err != nil {
+		return nil, err
+	}
+	for _, privID := range ids {
+		if privID == id {
+			msg, _, err := ce.keyDB.GetPrivateUID(id, false)
+			return msg, err
+		}
+	}
+	msg, _, _, err := ce.keyDB.GetPublicUID(id, math.MaxInt64)
+	return msg, err
+}
+
+// exportEscrow writes the private escrow key of pseudonym to w. If del is
+// true, the escrow key is deleted from the keyDB afterwards, so that it is
+// only available from the export (which should be stored offline).
+func (ce *CryptEngine) exportEscrow(w io.Writer, pseudonym string, del bool) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, err := ce.keyDB.GetPrivateUID(id, false)
+	if err != nil {
+		return err
+	}
+	if !msg.HasSigEscrow() {
+		return log.Errorf("cryptengine: %s: %s", uid.ErrNoSigEscrow, id)
+	}
+	privkey, err := ce.keyDB.GetSigEscrowKey(id)
+	if err != nil {
+		return err
+	}
+	if privkey == "" {
+		return log.Errorf("cryptengine: no private escrow key for '%s' stored", id)
+	}
+	e := escrowKey{
+		IDENTITY: id,
+		PUBKEY:   msg.UIDContent.SIGESCROW.PUBKEY,
+		PRIVKEY:  privkey,
+	}
+	if err := json.NewEncoder(w).Encode(&e); err != nil {
+		return log.Error(err)
+	}
+	if del {
+		if err := ce.keyDB.DelSigEscrowKey(id); err != nil {
+			return err
+		}
+		log.Infof("private escrow key of '%s' deleted", id)
+	}
+	return nil
+}
+
+// importEscrow reads a private escrow key exported with exportEscrow from r
+// and stores it in the keyDB. If a UID message of the user ID is known, the
+// escrow key must belong to it.
+func (ce *CryptEngine) importEscrow(r io.Reader) error {
+	var e escrowKey
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return log.Error(err)
+	}
+	id, err := identity.Map(e.IDENTITY)
+	if err != nil {
+		return err
+	}
+	msg, err := ce.latestUID(id)
+	if err != nil {
+		return err
+	}
+	if msg != nil {
+		if err := msg.SetPrivateSigEscrowKey(e.PRIVKEY); err != nil {
+			return err
+		}
+	}
+	if err := ce.keyDB.SetSigEscrowKey(id, e.PRIVKEY); err != nil {
+		return err
+	}
+	log.Infof("private escrow key of '%s' imported", id)
+	return nil
+}
+
+// recoverEscrow generates a successor of the latest public UID message of
+// pseudonym which is authorized by the imported escrow key (see
+// uid.Message.Recover) and stores it in the keyDB. It has to be registered
+// with the key server with 'uid update' and the new escrow key has to be
+// exported again.
+func (ce *CryptEngine) recoverEscrow(pseudonym string) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	privkey, err := ce.keyDB.GetSigEscrowKey(id)
+	if err != nil {
+		return err
+	}
+	if privkey == "" {
+		return log.Errorf("cryptengine: no private escrow key for '%s' stored (use 'uid escrow import')",
+			id)
+	}
+	msg, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("cryptengine: no UID message for '%s' found (use 'hashchain search')",
+			id)
+	}
+	successor, err := msg.Recover(privkey, cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	// also replaces the stored escrow key with the new one
+	if err := ce.keyDB.AddPrivateUID(successor); err != nil {
+		return err
+	}
+	log.Infof("nym '%s' recovered, register it with 'uid update' and export the new escrow key",
+		id)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/uid"
+)
+
+func TestEscrowRecover(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// device with user ID which includes an escrow key
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	alice, err := uid.Create("alice@mute.berlin", true, "", "", uid.Strict,
+		srv.LastEntry(), cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := ce.exportEscrow(&export, "alice@mute.berlin", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.exportEscrow(&bytes.Buffer{}, "alice@mute.berlin", false); err == nil {
+		t.Error("escrow key should be deleted after export")
+	}
+
+	// new device (signature key has been lost)
+	ce2, cleanup2 := newTestEngine(t, srv)
+	defer cleanup2()
+	if err := ce2.importEscrow(&export); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce2.recoverEscrow("alice@mute.berlin"); err == nil {
+		t.Error("should fail without public UID message")
+	}
+	if err := ce2.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce2.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce2.searchHashChain("alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce2.recoverEscrow("alice@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	successor, _, err := ce2.keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := successor.VerifyEscrowSig(alice); err != nil {
+		t.Error(err)
+	}
+	// the new escrow key is stored and can be exported again
+	if successor.PrivateSigEscrowKey() == "" {
+		t.Error("new escrow key not stored")
+	}
+	export.Reset()
+	if err := ce2.exportEscrow(&export, "alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// escrow keys must match known UID messages
+	if err := ce.importEscrow(&export); err != uid.ErrEscrowKeyMismatch {
+		t.Errorf("should fail with uid.ErrEscrowKeyMismatch: %v", err)
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"math"
+	"sort"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/cipher/aes256"
 	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/bloom"
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid"
@@ -22,6 +26,21 @@ import (
 // domain. It just downloads the new entries and does not validate them
 // whatsoever.
 func (ce *CryptEngine) syncHashChain(domain string) error {
+	return ce.syncHashChainBatched(domain, defaultSyncBatch,
+		defaultSyncParallel, nil)
+}
+
+// syncHashChainBatched brings local hash chain in sync with key server at the
+// given domain. The missing entries are fetched in batches of the given size
+// with up to parallel concurrent requests and every batch is stored in a
+// single transaction. An interrupted sync resumes after the last stored
+// batch. If progress is not nil, the progress of the sync is written to it.
+func (ce *CryptEngine) syncHashChainBatched(
+	domain string,
+	batch uint64,
+	parallel int,
+	progress io.Writer,
+) error {
 	// get JSON-RPC client
 	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost, ce.homedir,
 		"KeyHashchain.FetchLastHashChain")
@@ -44,7 +63,32 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 		return log.Error("cryptengine: fetch last hash chain position reply has the wrong type")
 	}
 	hcPos := uint64(hcPosFloat)
-	log.Debugf("cryptengine: last HC#%d: %s", hcPos, hcEntry)
+	log.Debugf("cryptengine: last HC#%d: %s", hcPos, log.Sensitive(hcEntry))
+	if err := ce.checkHashChainPin(domain, hcPos, hcEntry); err != nil {
+		return err
+	}
+
+	// a filtered hash chain cannot be completed, start all over again
+	_, filtered, err := ce.keyDB.GetFilteredHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if filtered {
+		log.Debugf("cryptengine: replace filtered hash chain for domain '%s'",
+			domain)
+		if err := ce.keyDB.DelHashChain(domain); err != nil {
+			return err
+		}
+		if ce.hcIndex != nil {
+			ce.hcIndex.Delete(domain)
+		}
+		if err := ce.keyDB.DelFilteredHashChainPos(domain); err != nil {
+			return err
+		}
+		if err := ce.keyDB.DelValidatedHashChainPos(domain); err != nil {
+			return err
+		}
+	}
 
 	// determine what we already have
 	pos, found, err := ce.keyDB.GetLastHashChainPos(domain)
@@ -75,43 +119,231 @@ func (ce *CryptEngine) syncHashChain(domain string) error {
 		return err
 	}
 	// get missing chain entries
+	return fetchHashChain(client, ce.keyDB, domain, start, end, batch,
+		parallel, progress)
+}
+
+// fetchLastHashChainPos returns the position of the last hash chain entry
+// from the key server at the given domain.
+func (ce *CryptEngine) fetchLastHashChainPos(domain string) (uint64, error) {
+	// get JSON-RPC client
+	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost, ce.homedir,
+		"KeyHashchain.FetchLastHashChain")
+	if err != nil {
+		return 0, err
+	}
+	// get last hash chain entry from key server
+	reply, err := client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err != nil {
+		return 0, err
+	}
+	// parse hash chain position
+	hcPosFloat, ok := reply["HCPos"].(float64)
+	if !ok {
+		return 0, log.Error("cryptengine: fetch last hash chain position reply has the wrong type")
+	}
+	return uint64(hcPosFloat), nil
+}
+
+// syncHashChainFiltered brings the local hash chain in sync with the key
+// server at the given domain, but only downloads the entries which match a
+// bloom filter built from the given ids and all known identities of the
+// domain. The false positive rate of the filter is given by rate.
+// A filtered hash chain can only be partially validated.
+func (ce *CryptEngine) syncHashChainFiltered(
+	domain string,
+	ids []string,
+	rate float64,
+) error {
+	// a complete hash chain is never replaced by a filtered one
+	lastPos, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	filteredPos, filtered, err := ce.keyDB.GetFilteredHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if found && !filtered {
+		log.Debugf("cryptengine: complete hash chain for domain '%s' "+
+			"found, sync without filter", domain)
+		return ce.syncHashChain(domain)
+	}
+
+	// collect identities
+	dmn := identity.MapDomain(domain)
+	identities := make(map[string]bool)
+	for _, id := range ids {
+		mappedID, idDomain, err := identity.MapPlus(id)
+		if err != nil {
+			return err
+		}
+		if idDomain != dmn {
+			return log.Errorf("cryptengine: id '%s' is not in domain '%s'",
+				id, domain)
+		}
+		identities[mappedID] = true
+	}
+	privIDs, err := ce.keyDB.GetPrivateIdentitiesForDomain(domain)
+	if err != nil {
+		return err
+	}
+	pubIDs, err := ce.keyDB.GetPublicIdentitiesForDomain(domain)
+	if err != nil {
+		return err
+	}
+	for _, id := range append(privIDs, pubIDs...) {
+		identities[id] = true
+	}
+	if len(identities) == 0 {
+		return log.Errorf("cryptengine: no identities known for domain '%s'",
+			domain)
+	}
+
+	// build filter
+	filter, err := bloom.New(len(identities), rate)
+	if err != nil {
+		return err
+	}
+	for id := range identities {
+		filter.Add([]byte(id))
+	}
+
+	// determine range
+	hcPos, err := ce.fetchLastHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	var start uint64
+	if filtered {
+		if filteredPos >= hcPos {
+			log.Debugf("cryptengine: filtered hash chain already in sync")
+			return nil
+		}
+		start = filteredPos + 1
+	}
+	log.Debugf("cryptengine: filtered sync from %d to %d (last local: %d)",
+		start, hcPos, lastPos)
+
+	// get JSON-RPC client
+	client, _, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost, ce.homedir,
+		"KeyHashchain.FetchFilteredHashChain")
+	if err != nil {
+		return err
+	}
+	// get matching chain entries
 	content := make(map[string]interface{})
 	content["StartPosition"] = start
-	content["EndPosition"] = end
-	reply, err = client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
+	content["EndPosition"] = hcPos
+	content["Filter"] = filter.Marshal()
+	reply, err := client.JSONRPCRequest("KeyHashchain.FetchFilteredHashChain",
+		content)
 	if err != nil {
 		return err
 	}
-	// parse hash chain entries
-	hcEntries, ok := reply["HCEntries"].([]interface{})
+	hcPositions, ok := reply["HCPositions"].([]interface{})
 	if !ok {
-		return log.Error("cryptengine: fetch hash chain entries reply has the wrong type")
+		return log.Error("cryptengine: fetch filtered hash chain positions reply has the wrong type")
 	}
-	// parse first hash chain position
-	hcPosFirstFloat := reply["HCFirstPos"].(float64)
+	hcEntries, ok := reply["HCEntries"].([]interface{})
 	if !ok {
-		return log.Error("cryptengine: fetch hash chain first position reply has the wrong type")
+		return log.Error("cryptengine: fetch filtered hash chain entries reply has the wrong type")
+	}
+	if len(hcPositions) != len(hcEntries) {
+		return log.Error("cryptengine: fetch filtered hash chain reply has inconsistent length")
 	}
-	hcFirstPos := uint64(hcPosFirstFloat)
-	for i := hcFirstPos; i <= hcPos; i++ {
-		entry, ok := hcEntries[i-hcFirstPos].(string)
+	for i := range hcPositions {
+		posFloat, ok := hcPositions[i].(float64)
+		if !ok {
+			return log.Error("cryptengine: fetch filtered hash chain position is not a number")
+		}
+		pos := uint64(posFloat)
+		if pos < start || pos > hcPos {
+			return log.Errorf("cryptengine: fetch filtered hash chain position %d out of range", pos)
+		}
+		entry, ok := hcEntries[i].(string)
 		if !ok {
-			return log.Error("cryptengine: fetch hash chain entry is not a string")
+			return log.Error("cryptengine: fetch filtered hash chain entry is not a string")
+		}
+		if _, _, _, _, _, _, err := hashchain.SplitEntry(entry); err != nil {
+			return err
 		}
-		log.Debugf("cryptengine: HC#%d: %s", i, entry)
+		log.Debugf("cryptengine: HC#%d: %s", pos, log.Sensitive(entry))
 		// store entry in database
-		err := ce.keyDB.AddHashChainEntry(domain, i, entry)
-		if err != nil {
-			return nil
+		if err := ce.keyDB.AddHashChainEntry(domain, pos, entry); err != nil {
+			return err
 		}
 	}
+	log.Debugf("cryptengine: %d of %d hash chain entries matched filter",
+		len(hcEntries), hcPos-start+1)
+	return ce.keyDB.SetFilteredHashChainPos(domain, hcPos)
+}
 
+// checkHashChainPin makes sure that the hash chain of the key server at the
+// given domain, which ends with entry hcEntry at position hcPos, has not been
+// rolled back behind the pinned hash chain head (see pinHashChain).
+func (ce *CryptEngine) checkHashChainPin(
+	domain string,
+	hcPos uint64,
+	hcEntry string,
+) error {
+	pinPos, pinEntry, found, err := ce.keyDB.GetPinnedHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	if hcPos < pinPos {
+		return log.Errorf("cryptengine: key server rolled back hash chain for domain '%s' (last position %d < pinned position %d)",
+			domain, hcPos, pinPos)
+	}
+	if hcPos == pinPos && hcEntry != pinEntry {
+		return log.Errorf("cryptengine: hash chain entry %d for domain '%s' differs from pinned entry",
+			pinPos, domain)
+	}
 	return nil
 }
 
+// pinHashChain validates the local hash chain for the given domain and pins
+// the entry at position pos (or the last entry, if last is true) as a
+// known-good hash chain head. Later syncs and validations fail, if the key
+// server reports a shorter hash chain or a different entry at the pinned
+// position.
+func (ce *CryptEngine) pinHashChain(domain string, pos uint64, last bool) error {
+	if err := ce.validateHashChain(domain); err != nil {
+		return err
+	}
+	_, filtered, err := ce.keyDB.GetFilteredHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if filtered {
+		return log.Errorf("cryptengine: cannot pin filtered hash chain for domain '%s'",
+			domain)
+	}
+	max, _, err := ce.keyDB.GetLastHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if last {
+		pos = max
+	} else if pos > max {
+		return log.Errorf("cryptengine: hash chain position %d for domain '%s' not synced",
+			pos, domain)
+	}
+	entry, err := ce.keyDB.GetHashChainEntry(domain, pos)
+	if err != nil {
+		return err
+	}
+	log.Infof("cryptengine: pin hash chain entry %d for domain '%s'", pos, domain)
+	return ce.keyDB.SetPinnedHashChainPos(domain, pos, entry)
+}
+
 // validateHashChain validates the local hash chain for the given domain.
 // That is, it checks that each entry has the correct length and the links are
-// valid.
+// valid. Complete hash chains are only validated from the last validation
+// checkpoint onwards, which is updated afterwards.
 func (ce *CryptEngine) validateHashChain(domain string) error {
 	// make sure we have a hashchain for the given domain
 	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
@@ -122,18 +354,76 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 		return log.Errorf("no hash chain entries found for domain '%s'", domain)
 	}
 
+	// filtered hash chains have gaps, only links between consecutive
+	// entries can be validated
+	_, filtered, err := ce.keyDB.GetFilteredHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	positions, err := ce.keyDB.GetHashChainPositions(domain)
+	if err != nil {
+		return err
+	}
+
+	// make sure the pinned entry has not been replaced
+	pinPos, pinEntry, pinned, err := ce.keyDB.GetPinnedHashChainPos(domain)
+	if err != nil {
+		return err
+	}
+	if pinned && hasPosition(positions, pinPos) {
+		entry, err := ce.keyDB.GetHashChainEntry(domain, pinPos)
+		if err != nil {
+			return err
+		}
+		if entry != pinEntry {
+			return log.Errorf("cryptengine: hash chain entry %d differs from pinned entry", pinPos)
+		}
+	}
+
+	// continue from validation checkpoint, if the checkpoint entry is
+	// unchanged (a hash chain with missing entries is validated from the
+	// start)
 	var hashEntryN, TYPE, NONCE, HashID, CrUID, UIDIndex, hashEntryNminus1 []byte
-	for i := uint64(0); i <= max; i++ {
+	var start int
+	if !filtered {
+		cpPos, cpEntry, found, err := ce.keyDB.GetValidatedHashChainPos(domain)
+		if err != nil {
+			return err
+		}
+		if found && cpPos <= max && uint64(len(positions)) == max+1 {
+			entry, err := ce.keyDB.GetHashChainEntry(domain, cpPos)
+			if err != nil {
+				return err
+			}
+			if entry != cpEntry {
+				return log.Errorf("cryptengine: hash chain entry %d differs from validation checkpoint", cpPos)
+			}
+			hashEntryN, _, _, _, _, _, err = hashchain.SplitEntry(entry)
+			if err != nil {
+				return err
+			}
+			start = int(cpPos) + 1
+			log.Debugf("cryptengine: validate hash chain from checkpoint %d", cpPos)
+		}
+	}
+	for j := start; j < len(positions); j++ {
+		i := positions[j]
+		if !filtered && i != uint64(j) {
+			return log.Errorf("cryptengine: hash chain entry %d missing", j)
+		}
 		entry, err := ce.keyDB.GetHashChainEntry(domain, i)
 		if err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: validate entry %d: %s", i, entry)
+		log.Debugf("cryptengine: validate entry %d: %s", i, log.Sensitive(entry))
 
+		link := true
 		if i == 0 {
 			hashEntryNminus1 = make([]byte, sha256.Size)
-		} else {
+		} else if j > 0 && positions[j-1] == i-1 {
 			hashEntryNminus1 = hashEntryN
+		} else {
+			link = false // predecessor not available
 		}
 		hashEntryN, TYPE, NONCE, HashID, CrUID, UIDIndex, err = hashchain.SplitEntry(entry)
 		if err != nil {
@@ -142,6 +432,10 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 		if !bytes.Equal(TYPE, hashchain.Type) {
 			return log.Error("cryptengine: invalid hash chain entry type")
 		}
+		if !link {
+			log.Debugf("cryptengine: cannot validate link of entry %d", i)
+			continue
+		}
 
 		entryN := make([]byte, 153)
 		copy(entryN, TYPE)
@@ -154,6 +448,15 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 			return log.Errorf("cryptengine: hash chain entry %d invalid", i)
 		}
 	}
+	if !filtered && start < len(positions) {
+		entry, err := ce.keyDB.GetHashChainEntry(domain, max)
+		if err != nil {
+			return err
+		}
+		if err := ce.keyDB.SetValidatedHashChainPos(domain, max, entry); err != nil {
+			return err
+		}
+	}
 
 	// get all private identities for the given domain
 	ids, err := ce.keyDB.GetPrivateIdentitiesForDomain(domain)
@@ -167,7 +470,8 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 		if err != nil {
 			return err
 		}
-		if msgReply != nil && msgReply.ENTRY.HASHCHAINPOS <= max {
+		if msgReply != nil && msgReply.ENTRY.HASHCHAINPOS <= max &&
+			!(filtered && !hasPosition(positions, msgReply.ENTRY.HASHCHAINPOS)) {
 			entry, err := ce.keyDB.GetHashChainEntry(domain, msgReply.ENTRY.HASHCHAINPOS)
 			if err != nil {
 				return err
@@ -181,6 +485,14 @@ func (ce *CryptEngine) validateHashChain(domain string) error {
 	return nil
 }
 
+// hasPosition reports whether pos is contained in the sorted positions.
+func hasPosition(positions []uint64, pos uint64) bool {
+	i := sort.Search(len(positions), func(i int) bool {
+		return positions[i] >= pos
+	})
+	return i < len(positions) && positions[i] == pos
+}
+
 func (ce *CryptEngine) fetchUID(
 	domain string,
 	UIDIndex []byte,
@@ -213,7 +525,7 @@ func (ce *CryptEngine) fetchUID(
 	if !ok {
 		return nil, log.Error("cryptengine: KeyRepository.FetchUID UIDMESSAGEENCRYPTED has the wrong type")
 	}
-	log.Debugf("cryptengine: UIDMessageEncrypted=%s", entry.UIDMESSAGEENCRYPTED)
+	log.Debugf("cryptengine: UIDMessageEncrypted=%s", log.Sensitive(entry.UIDMESSAGEENCRYPTED))
 	entry.HASHCHAINENTRY, ok = e["HASHCHAINENTRY"].(string)
 	if !ok {
 		return nil, log.Error("cryptengine: KeyRepository.FetchUID HASHCHAINENTRY has the wrong type")
@@ -263,6 +575,49 @@ func (ce *CryptEngine) verifyServerSig(
 	return nil
 }
 
+// verifyUIDChain makes sure that the UID message msg found at the given hash
+// chain position is a valid successor of the last UID message of the same
+// identity stored in keyDB before that position. That is, the MSGCOUNT must be
+// incremented by one and msg must be signed with the signature key (or the
+// escrow key, for recovered identities) of its predecessor. The first UID
+// message of an identity must have MSGCOUNT 0.
+func (ce *CryptEngine) verifyUIDChain(msg *uid.Message, position uint64) error {
+	var (
+		preMsg *uid.Message
+		prePos uint64
+		found  bool
+		err    error
+	)
+	if position > 0 {
+		preMsg, prePos, found, err = ce.keyDB.GetPublicUID(msg.Identity(),
+			position-1)
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		if msg.UIDContent.MSGCOUNT != 0 {
+			return log.Errorf("cryptengine: UID chain of '%s' breaks at position %d: no predecessor of MSGCOUNT %d",
+				msg.Identity(), position, msg.UIDContent.MSGCOUNT)
+		}
+		return nil
+	}
+	if preMsg.IsTombstone() {
+		return log.Errorf("cryptengine: UID chain of '%s' breaks at position %d: successor of deleted UID at position %d",
+			msg.Identity(), position, prePos)
+	}
+	if msg.ESCROWSIGNATURE != "" {
+		err = msg.VerifyEscrowSig(preMsg)
+	} else {
+		err = msg.VerifyUserSig(preMsg)
+	}
+	if err != nil {
+		return log.Errorf("cryptengine: UID chain of '%s' breaks between positions %d and %d: %s",
+			msg.Identity(), prePos, position, err)
+	}
+	return nil
+}
+
 // searchHashChain searches the local hash chain corresponding to the given id
 // for the id. It talks to the corresponding key server to retrieve necessary
 // UIDMessageReplys and stores found UIDMessages in the local keyDB.
@@ -273,22 +628,30 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 		return err
 	}
 	// make sure we have a hashchain for the given domain
-	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	positions, err := ce.keyDB.GetHashChainPositions(domain)
 	if err != nil {
 		return err
 	}
-	if !found {
+	if len(positions) == 0 {
 		return log.Errorf("no hash chain entries found for domain '%s'", domain)
 	}
+	// restrict search to matching entries, if we have an index
+	if ce.hcIndex != nil {
+		positions, err = ce.hcIndex.Search(domain, mappedID, positions,
+			ce.keyDB.GetHashChainEntry)
+		if err != nil {
+			return err
+		}
+	}
 
 	var TYPE, NONCE, HashID, CrUID, UIDIndex []byte
 	var matchFound bool
-	for i := uint64(0); i <= max; i++ {
+	for _, i := range positions {
 		hcEntry, err := ce.keyDB.GetHashChainEntry(domain, i)
 		if err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: search hash chain entry %d: %s", i, hcEntry)
+		log.Debugf("cryptengine: search hash chain entry %d: %s", i, log.Sensitive(hcEntry))
 
 		_, TYPE, NONCE, HashID, CrUID, UIDIndex, err = hashchain.SplitEntry(hcEntry)
 		if err != nil {
@@ -314,7 +677,7 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 		if searchOnly {
 			return nil
 		}
-		log.Debugf("cryptengine: UIDIndex=%s", base64.Encode(UIDIndex))
+		log.Debugf("cryptengine: UIDIndex=%s", log.Sensitive(base64.Encode(UIDIndex)))
 
 		// Check UID already exists in keyDB
 		_, pos, found, err := ce.keyDB.GetPublicUID(mappedID, i)
@@ -341,14 +704,14 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 
 		// Decrypt UIDHash = AES_256_CBC_Decrypt( IDKEY, CrUID)
 		UIDHash := aes256.CBCDecrypt(IDKEY, CrUID)
-		log.Debugf("cryptengine: UIDHash=%s", base64.Encode(UIDHash))
+		log.Debugf("cryptengine: UIDHash=%s", log.Sensitive(base64.Encode(UIDHash)))
 
 		// Decrypt UIDMessageReply.UIDMessage with UIDHash
 		index, uid, err := msgReply.Decrypt(UIDHash)
 		if err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: UIDMessage=%s", uid.JSON())
+		log.Debugf("cryptengine: UIDMessage=%s", log.Sensitive(uid.JSON()))
 
 		// Check index
 		if !bytes.Equal(index, UIDIndex) {
@@ -365,7 +728,15 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 			return err
 		}
 
-		// TODO: make sure the whole chain of UIDMessages is valid
+		// Verify chain link
+		if err := ce.verifyChainLink(uid, i); err != nil {
+			return err
+		}
+
+		// Make sure the whole chain of UIDMessages is valid
+		if err := ce.verifyUIDChain(uid, i); err != nil {
+			return err
+		}
 
 		// Store UIDMessage
 		if err := ce.keyDB.AddPublicUID(uid, i); err != nil {
@@ -377,6 +748,14 @@ func (ce *CryptEngine) searchHashChain(id string, searchOnly bool) error {
 	}
 
 	if matchFound {
+		// check whether the user ID has been deleted
+		msg, _, _, err := ce.keyDB.GetPublicUID(mappedID, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		if msg != nil && msg.IsTombstone() {
+			return log.Errorf("%s: %s", uid.ErrTombstone, id)
+		}
 		return nil
 	}
 
@@ -442,7 +821,7 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 		if !bytes.Equal(HashID, HashIDTest) {
 			return log.Error("cryptengine: lookup ID returned bogus position")
 		}
-		log.Debugf("cryptengine: UIDIndex=%s", base64.Encode(UIDIndex))
+		log.Debugf("cryptengine: UIDIndex=%s", log.Sensitive(base64.Encode(UIDIndex)))
 
 		// Check UID already exists in keyDB
 		_, pos, found, err := ce.keyDB.GetPublicUID(mappedID, hcPos)
@@ -469,14 +848,14 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 
 		// Decrypt UIDHash = AES_256_CBC_Decrypt( IDKEY, CrUID)
 		UIDHash := aes256.CBCDecrypt(IDKEY, CrUID)
-		log.Debugf("cryptengine: UIDHash=%s", base64.Encode(UIDHash))
+		log.Debugf("cryptengine: UIDHash=%s", log.Sensitive(base64.Encode(UIDHash)))
 
 		// Decrypt UIDMessageReply.UIDMessage with UIDHash
 		index, uid, err := msgReply.Decrypt(UIDHash)
 		if err != nil {
 			return err
 		}
-		log.Debugf("cryptengine: UIDMessage=%s", uid.JSON())
+		log.Debugf("cryptengine: UIDMessage=%s", log.Sensitive(uid.JSON()))
 
 		// Check index
 		if !bytes.Equal(index, UIDIndex) {
@@ -493,7 +872,15 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 			return err
 		}
 
-		// TODO: make sure the whole chain of UIDMessages is valid
+		// Verify chain link
+		if err := ce.verifyChainLink(uid, hcPos); err != nil {
+			return err
+		}
+
+		// Make sure the whole chain of UIDMessages is valid
+		if err := ce.verifyUIDChain(uid, hcPos); err != nil {
+			return err
+		}
 
 		// Store UIDMessage
 		if err := ce.keyDB.AddPublicUID(uid, hcPos); err != nil {
@@ -514,16 +901,16 @@ func (ce *CryptEngine) lookupHashChain(id string) error {
 // showHashChain shows the hash chain of the given domain on output-fd.
 func (ce *CryptEngine) showHashChain(domain string) error {
 	// make sure we have a hashchain for the given domain
-	max, found, err := ce.keyDB.GetLastHashChainPos(domain)
+	positions, err := ce.keyDB.GetHashChainPositions(domain)
 	if err != nil {
 		return err
 	}
-	if !found {
+	if len(positions) == 0 {
 		return log.Errorf("no hash chain entries found for domain '%s'", domain)
 	}
 
 	// show hash chain
-	for i := uint64(0); i <= max; i++ {
+	for _, i := range positions {
 		entry, err := ce.keyDB.GetHashChainEntry(domain, i)
 		if err != nil {
 			return err
@@ -536,5 +923,14 @@ func (ce *CryptEngine) showHashChain(domain string) error {
 
 // deleteHashChain deletes the local hash chain copy of the given domain.
 func (ce *CryptEngine) deleteHashChain(domain string) error {
-	return ce.keyDB.DelHashChain(domain)
+	if err := ce.keyDB.DelHashChain(domain); err != nil {
+		return err
+	}
+	if ce.hcIndex != nil {
+		ce.hcIndex.Delete(domain)
+	}
+	if err := ce.keyDB.DelValidatedHashChainPos(domain); err != nil {
+		return err
+	}
+	return ce.keyDB.DelFilteredHashChainPos(domain)
 }
@@ -0,0 +1,478 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+const testDomain = "mute.berlin"
+
+// newTestEngine returns a crypt engine with a fresh keyDB which talks to the
+// fake key server srv.
+func newTestEngine(t *testing.T, srv *keyservertest.Server) (*CryptEngine, func()) {
+	tmpdir, err := ioutil.TempDir("", "cryptengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbname := filepath.Join(tmpdir, "keys")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := keydb.Create(dbname, passphrase, 64000); err != nil {
+		os.RemoveAll(tmpdir)
+		t.Fatal(err)
+	}
+	ce := New()
+	ce.homedir = tmpdir
+	if err := ce.openKeyDBWithPassphrase(passphrase); err != nil {
+		os.RemoveAll(tmpdir)
+		t.Fatal(err)
+	}
+	ce.cache.SetClientFactory(func(domain, port, altHost, relay, homedir string) (*jsonclient.URLClient, error) {
+		return jsonclient.New(srv.URL, nil)
+	})
+	return ce, func() {
+		ce.Close()
+		os.RemoveAll(tmpdir)
+	}
+}
+
+// addUser registers a new UID message for id at srv.
+func addUser(t *testing.T, srv *keyservertest.Server, id string) *uid.Message {
+	msg, err := uid.Create(id, false, "", "", uid.Strict, srv.LastEntry(),
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSyncHashChain(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	addUser(t, srv, "alice@mute.berlin")
+
+	// initial sync
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	pos, found, err := ce.keyDB.GetLastHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 {
+		t.Fatalf("last position = %d (found=%v), expected 1", pos, found)
+	}
+	if err := ce.validateHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	// already in sync -> no entries fetched
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("KeyHashchain.FetchHashChain"); n != 1 {
+		t.Errorf("FetchHashChain called %d times, expected 1", n)
+	}
+
+	// incremental sync
+	addUser(t, srv, "bob@mute.berlin")
+	addUser(t, srv, "carol@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	pos, _, err = ce.keyDB.GetLastHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 3 {
+		t.Fatalf("last position = %d, expected 3", pos)
+	}
+	chain := srv.HashChain()
+	for i, exp := range chain {
+		entry, err := ce.keyDB.GetHashChainEntry(testDomain, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != exp {
+			t.Errorf("hash chain entry %d differs", i)
+		}
+	}
+	if err := ce.validateHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncHashChainBatched(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	for _, id := range []string{"alice", "bob", "carol", "dave", "eve", "frank"} {
+		addUser(t, srv, id+"@mute.berlin")
+	}
+
+	// interrupted sync
+	errFail := errors.New("fail")
+	srv.Handle("KeyHashchain.FetchHashChain",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			if args["StartPosition"].(float64) >= 4 {
+				return nil, errFail
+			}
+			start := uint64(args["StartPosition"].(float64))
+			end := uint64(args["EndPosition"].(float64))
+			return map[string]interface{}{
+				"HCEntries":  srv.HashChain()[start : end+1],
+				"HCFirstPos": start,
+			}, nil
+		})
+	// (sequential fetches, the batches before the failing one are stored)
+	if err := ce.syncHashChainBatched(testDomain, 2, 1, nil); err == nil {
+		t.Fatal("should fail")
+	}
+	pos, found, err := ce.keyDB.GetLastHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 3 {
+		t.Fatalf("last position = %d (found=%v), expected 3", pos, found)
+	}
+	positions, err := ce.keyDB.GetHashChainPositions(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 4 {
+		t.Fatalf("hash chain has gaps: %v", positions)
+	}
+
+	// resume
+	srv.Handle("KeyHashchain.FetchHashChain", nil)
+	var progress bytes.Buffer
+	if err := ce.syncHashChainBatched(testDomain, 2, 3, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(progress.String(), "HASHCHAIN SYNC: 3/3 entries") {
+		t.Errorf("progress output misses last batch:\n%s", progress.String())
+	}
+	for i, exp := range srv.HashChain() {
+		entry, err := ce.keyDB.GetHashChainEntry(testDomain, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != exp {
+			t.Errorf("hash chain entry %d differs", i)
+		}
+	}
+	if err := ce.validateHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashChainPin(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	addUser(t, srv, "alice@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.pinHashChain(testDomain, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	chain := srv.HashChain()
+	pos, entry, found, err := ce.keyDB.GetValidatedHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 || entry != chain[1] {
+		t.Errorf("wrong validation checkpoint %d", pos)
+	}
+	pos, entry, found, err = ce.keyDB.GetPinnedHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 || entry != chain[1] {
+		t.Errorf("wrong pinned position %d", pos)
+	}
+
+	// incremental validation
+	addUser(t, srv, "bob@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.validateHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	pos, _, _, err = ce.keyDB.GetValidatedHashChainPos(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 2 {
+		t.Errorf("validation checkpoint = %d, expected 2", pos)
+	}
+
+	// changed checkpoint entry
+	if err := ce.keyDB.SetValidatedHashChainPos(testDomain, 1, chain[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.validateHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+
+	// rollback
+	srv.Handle("KeyHashchain.FetchLastHashChain",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"HCEntry": chain[0], "HCPos": 0}, nil
+		})
+	if err := ce.syncHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+	srv.Handle("KeyHashchain.FetchLastHashChain",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"HCEntry": chain[0], "HCPos": 1}, nil
+		})
+	if err := ce.syncHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestSyncHashChainErrors(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+
+	// server error
+	errFail := errors.New("fail")
+	srv.Handle("KeyHashchain.FetchLastHashChain",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return nil, errFail
+		})
+	if err := ce.syncHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+
+	// malformed reply
+	srv.Handle("KeyHashchain.FetchLastHashChain",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"HCEntry": 1, "HCPos": 0}, nil
+		})
+	if err := ce.syncHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+
+	// method not supported by key server
+	srv.Handle("KeyHashchain.FetchLastHashChain", nil)
+	srv.Handle("KeyRepository.Capabilities",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"CAPABILITIES": map[string]interface{}{
+					"METHODS": []string{"KeyRepository.Capabilities"},
+				},
+			}, nil
+		})
+	// (new engine, the capabilities are cached)
+	ce2, cleanup2 := newTestEngine(t, srv)
+	defer cleanup2()
+	if err := ce2.syncHashChain(testDomain); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestSearchHashChain(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	alice := addUser(t, srv, "alice@mute.berlin")
+	bob := addUser(t, srv, "bob@mute.berlin")
+
+	// no local hash chain
+	if err := ce.searchHashChain("alice@mute.berlin", false); err == nil {
+		t.Error("should fail")
+	}
+
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	// the key server UID is needed to verify server signatures
+	if err := ce.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	msg, pos, found, err := ce.keyDB.GetPublicUID("alice@mute.berlin", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 {
+		t.Fatalf("UID of alice not found at position 1")
+	}
+	if string(msg.JSON()) != string(alice.JSON()) {
+		t.Error("UID of alice differs")
+	}
+
+	// searching again does not fetch the UID again
+	calls := srv.Calls("KeyRepository.FetchUID")
+	if err := ce.searchHashChain("alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("KeyRepository.FetchUID"); n != calls {
+		t.Errorf("FetchUID called %d times, expected %d", n, calls)
+	}
+
+	// unknown user
+	if err := ce.searchHashChain("mallory@mute.berlin", false); err == nil {
+		t.Error("should fail")
+	}
+
+	// forged server signature
+	srv.Handle("KeyRepository.FetchUID",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			key, err := cipher.Ed25519Generate(cipher.RandReader)
+			if err != nil {
+				return nil, err
+			}
+			_, _, enc := bob.Encrypt()
+			reply := uid.CreateReply(enc, srv.HashChain()[2], 2, key)
+			return map[string]interface{}{"UIDMessageReply": reply}, nil
+		})
+	if err := ce.searchHashChain("bob@mute.berlin", false); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestVerifyUIDChain(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	alice := addUser(t, srv, "alice@mute.berlin")
+	up, err := alice.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(up); err != nil {
+		t.Fatal(err)
+	}
+	// bob skips a UID message
+	bob := addUser(t, srv, "bob@mute.berlin")
+	up, err = bob.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err = up.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.AddUID(up); err != nil {
+		t.Fatal(err)
+	}
+	// carol's update is not signed by her previous key
+	carol := addUser(t, srv, "carol@mute.berlin")
+	up, err = carol.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.USERSIGNATURE = up.SELFSIGNATURE
+	if _, err := srv.AddUID(up); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("alice@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	msg, pos, found, err := ce.keyDB.GetPublicUID("alice@mute.berlin", math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 2 || msg.UIDContent.MSGCOUNT != 1 {
+		t.Error("update of alice not found")
+	}
+	err = ce.searchHashChain("bob@mute.berlin", false)
+	if err == nil || !strings.Contains(err.Error(), "breaks between positions 3 and 4") {
+		t.Errorf("searchHashChain(bob) = %v, expected broken chain", err)
+	}
+	err = ce.searchHashChain("carol@mute.berlin", false)
+	if err == nil || !strings.Contains(err.Error(), "breaks between positions 5 and 6") {
+		t.Errorf("searchHashChain(carol) = %v, expected broken chain", err)
+	}
+}
+
+func TestLookupHashChain(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	addUser(t, srv, "alice@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.lookupHashChain("keyserver@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.lookupHashChain("alice@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found, err := ce.keyDB.GetPublicUID("alice@mute.berlin", 1); err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Error("UID of alice not found")
+	}
+	// bogus position
+	srv.Handle("KeyHashchain.LookupUID",
+		func(args map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"HCPositions": []uint64{0}}, nil
+		})
+	if err := ce.lookupHashChain("alice@mute.berlin"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+const (
+	// defaultSyncBatch is the default number of hash chain entries fetched
+	// with a single KeyHashchain.FetchHashChain request.
+	defaultSyncBatch = 1000
+	// defaultSyncParallel is the default number of concurrent
+	// KeyHashchain.FetchHashChain requests.
+	defaultSyncParallel = 4
+)
+
+// hcRange is a range of hash chain positions (inclusive).
+type hcRange struct {
+	first, last uint64
+}
+
+// hcBatch is the result of fetching a hcRange.
+type hcBatch struct {
+	index   int
+	entries []string
+	err     error
+}
+
+// syncProgress reports the progress of a hash chain sync.
+type syncProgress struct {
+	w     io.Writer
+	total uint64
+	done  uint64
+	start time.Time
+}
+
+// add records that n more entries have been stored and reports the progress.
+func (p *syncProgress) add(n uint64) {
+	p.done += n
+	if p.w == nil {
+		return
+	}
+	var rate float64
+	var eta time.Duration
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	if rate > 0 {
+		eta = time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+	}
+	fmt.Fprintf(p.w, "HASHCHAIN SYNC: %d/%d entries (%.0f entries/s, ETA %s)\n",
+		p.done, p.total, rate, eta.Round(time.Second))
+}
+
+// fetchHashChainRange fetches the hash chain entries in range r from the key
+// server.
+func fetchHashChainRange(
+	client *jsonclient.URLClient,
+	r hcRange,
+) ([]string, error) {
+	content := make(map[string]interface{})
+	content["StartPosition"] = r.first
+	content["EndPosition"] = r.last
+	reply, err := client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
+	if err != nil {
+		return nil, err
+	}
+	// parse hash chain entries
+	hcEntries, ok := reply["HCEntries"].([]interface{})
+	if !ok {
+		return nil, log.Error("cryptengine: fetch hash chain entries reply has the wrong type")
+	}
+	// parse first hash chain position
+	hcPosFirstFloat, ok := reply["HCFirstPos"].(float64)
+	if !ok {
+		return nil, log.Error("cryptengine: fetch hash chain first position reply has the wrong type")
+	}
+	if uint64(hcPosFirstFloat) != r.first ||
+		uint64(len(hcEntries)) != r.last-r.first+1 {
+		return nil, log.Errorf("cryptengine: fetch hash chain reply does not match range %d-%d",
+			r.first, r.last)
+	}
+	entries := make([]string, len(hcEntries))
+	for i := range hcEntries {
+		entry, ok := hcEntries[i].(string)
+		if !ok {
+			return nil, log.Error("cryptengine: fetch hash chain entry is not a string")
+		}
+		log.Debugf("cryptengine: HC#%d: %s", r.first+uint64(i), log.Sensitive(entry))
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// fetchHashChain fetches the hash chain entries from position start to end
+// (inclusive) for the given domain from the key server and stores them in
+// keyDB. The entries are fetched in batches of the given size with up to
+// parallel concurrent requests. The batches are stored in order, each one in
+// a single transaction, so that the stored hash chain never has gaps and an
+// interrupted sync can be resumed after the last stored entry.
+func fetchHashChain(
+	client *jsonclient.URLClient,
+	keyDB *keydb.KeyDB,
+	domain string,
+	start, end, batch uint64,
+	parallel int,
+	progress io.Writer,
+) error {
+	if batch == 0 {
+		return log.Error("cryptengine: hash chain sync batch size must be positive")
+	}
+	if parallel < 1 {
+		return log.Error("cryptengine: hash chain sync parallelism must be positive")
+	}
+	var ranges []hcRange
+	for first := start; first <= end; first += batch {
+		last := first + batch - 1
+		if last > end || last < first {
+			last = end
+		}
+		ranges = append(ranges, hcRange{first, last})
+		if last == end {
+			break
+		}
+	}
+	p := &syncProgress{w: progress, total: end - start + 1, start: time.Now()}
+
+	// the window limits the number of fetched, but not yet stored batches
+	done := make(chan struct{})
+	defer close(done)
+	window := make(chan struct{}, 2*parallel)
+	jobs := make(chan int)
+	results := make(chan *hcBatch)
+	go func() {
+		defer close(jobs)
+		for i := range ranges {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < parallel; w++ {
+		go func() {
+			for i := range jobs {
+				entries, err := fetchHashChainRange(client, ranges[i])
+				select {
+				case results <- &hcBatch{i, entries, err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// store batches in order
+	pending := make(map[int][]string)
+	for next := 0; next < len(ranges); {
+		res := <-results
+		if res.err != nil {
+			return res.err
+		}
+		pending[res.index] = res.entries
+		for entries, ok := pending[next]; ok; entries, ok = pending[next] {
+			delete(pending, next)
+			err := keyDB.AddHashChainEntries(domain, ranges[next].first, entries)
+			if err != nil {
+				return err
+			}
+			p.add(uint64(len(entries)))
+			<-window
+			next++
+		}
+	}
+	return nil
+}
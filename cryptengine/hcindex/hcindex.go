@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hcindex implements an in-memory index of key hash chain entries.
+//
+// Searching an identity in a hash chain requires to compute
+// HASH(k1 | Identity) for every entry, where k1 is derived from the NONCE of
+// the entry. Without an index every search reads and decodes all entries from
+// the key database and derives k1 again. The index keeps the derived k1 and
+// the HashID of every entry in memory, so repeated searches (e.g., from
+// monitoring tools) only have to read the matching entries.
+package hcindex
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+type entry struct {
+	pos    uint64 // position in hash chain
+	k1     []byte // first key derived from NONCE
+	hashID []byte // HASH(k1 | Identity)
+}
+
+type domainIndex struct {
+	entries []entry
+	indexed map[uint64]bool // indexed positions
+}
+
+// An Index is an in-memory index of the hash chain entries of multiple
+// domains. It is safe for concurrent use.
+type Index struct {
+	mutex   sync.Mutex
+	domains map[string]*domainIndex
+}
+
+// New returns a new empty index.
+func New() *Index {
+	return &Index{domains: make(map[string]*domainIndex)}
+}
+
+// EntryFunc returns the base64 encoded hash chain entry of domain at
+// position pos (e.g., KeyDB.GetHashChainEntry).
+type EntryFunc func(domain string, pos uint64) (string, error)
+
+// update adds all positions which are not yet indexed to the index of domain.
+func (idx *Index) update(
+	domain string,
+	positions []uint64,
+	getEntry EntryFunc,
+) (*domainIndex, error) {
+	di := idx.domains[domain]
+	if di == nil {
+		di = &domainIndex{indexed: make(map[uint64]bool)}
+		idx.domains[domain] = di
+	}
+	for _, pos := range positions {
+		if di.indexed[pos] {
+			continue
+		}
+		hcEntry, err := getEntry(domain, pos)
+		if err != nil {
+			return nil, err
+		}
+		_, _, nonce, hashID, _, _, err := hashchain.SplitEntry(hcEntry)
+		if err != nil {
+			return nil, err
+		}
+		k1, _ := cipher.CKDF(nonce)
+		di.entries = append(di.entries, entry{
+			pos:    pos,
+			k1:     k1,
+			hashID: append([]byte{}, hashID...),
+		})
+		di.indexed[pos] = true
+	}
+	return di, nil
+}
+
+// Search returns the positions (in the order of the given positions) of all
+// hash chain entries of domain which refer to the mapped identity id. Before
+// the search all positions which are not indexed yet are read with getEntry
+// and added to the index.
+func (idx *Index) Search(
+	domain, id string,
+	positions []uint64,
+	getEntry EntryFunc,
+) ([]uint64, error) {
+	if err := identity.IsMapped(id); err != nil {
+		return nil, log.Error(err)
+	}
+	domain = identity.MapDomain(domain)
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	di, err := idx.update(domain, positions, getEntry)
+	if err != nil {
+		return nil, err
+	}
+	matches := make(map[uint64]bool)
+	for _, e := range di.entries {
+		// HashIDTest = HASH(k1 | Identity)
+		tmp := make([]byte, len(e.k1)+len(id))
+		copy(tmp, e.k1)
+		copy(tmp[len(e.k1):], id)
+		if bytes.Equal(e.hashID, cipher.SHA256(tmp)) {
+			matches[e.pos] = true
+		}
+	}
+	var found []uint64
+	for _, pos := range positions {
+		if matches[pos] {
+			found = append(found, pos)
+		}
+	}
+	return found, nil
+}
+
+// Delete removes the index of domain. It must be called whenever the hash
+// chain of domain is deleted or replaced.
+func (idx *Index) Delete(domain string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	delete(idx.domains, identity.MapDomain(domain))
+}
+
+// Len returns the number of indexed entries of domain.
+func (idx *Index) Len(domain string) int {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	di := idx.domains[identity.MapDomain(domain)]
+	if di == nil {
+		return 0
+	}
+	return len(di.entries)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hcindex
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+)
+
+// testChain returns hash chain entries where entry i refers to ids[i].
+func testChain(ids []string) []string {
+	chain := hashchain.TestChain(len(ids))
+	for i, id := range ids {
+		e, _ := base64.Decode(chain[i])
+		nonce := e[33:41]
+		k1, _ := cipher.CKDF(nonce)
+		copy(e[41:73], cipher.SHA256(append(append([]byte{}, k1...), id...)))
+		chain[i] = base64.Encode(e)
+	}
+	return chain
+}
+
+func TestIndex(t *testing.T) {
+	chain := testChain([]string{
+		"alice@mute.berlin",
+		"bob@mute.berlin",
+		"alice@mute.berlin",
+	})
+	reads := 0
+	getEntry := func(domain string, pos uint64) (string, error) {
+		reads++
+		if pos >= uint64(len(chain)) {
+			return "", fmt.Errorf("no entry at position %d", pos)
+		}
+		return chain[pos], nil
+	}
+	idx := New()
+	found, err := idx.Search("mute.berlin", "alice@mute.berlin",
+		[]uint64{0, 1, 2}, getEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []uint64{0, 2}) {
+		t.Errorf("found = %v, want [0 2]", found)
+	}
+	// second search must not read entries again
+	found, err = idx.Search("mute.berlin", "bob@mute.berlin",
+		[]uint64{0, 1, 2}, getEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []uint64{1}) {
+		t.Errorf("found = %v, want [1]", found)
+	}
+	if reads != 3 {
+		t.Errorf("reads = %d, want 3", reads)
+	}
+	if idx.Len("mute.berlin") != 3 {
+		t.Errorf("idx.Len() = %d, want 3", idx.Len("mute.berlin"))
+	}
+	// unknown identity
+	found, err = idx.Search("mute.berlin", "carol@mute.berlin",
+		[]uint64{0, 1, 2}, getEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("found = %v, want []", found)
+	}
+	// delete
+	idx.Delete("mute.berlin")
+	if idx.Len("mute.berlin") != 0 {
+		t.Error("index not deleted")
+	}
+	// errors
+	if _, err := idx.Search("mute.berlin", "alice@mute.berlin",
+		[]uint64{3}, getEntry); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := idx.Search("mute.berlin", "Alice@mute.berlin",
+		[]uint64{0}, getEntry); err == nil {
+		t.Error("should fail for unmapped identity")
+	}
+}
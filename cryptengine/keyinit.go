@@ -5,16 +5,56 @@
 package cryptengine
 
 import (
+	"fmt"
+	"io"
 	"math"
+	"time"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/log"
+	mixMsg "github.com/mutecomm/mute/msg"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 	"github.com/mutecomm/mute/util/times"
 )
 
-func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token string) error {
+// keyInitWindows returns the validity windows for buckets many time-bucketed
+// KeyInit messages of the given duration. The windows start after the last
+// private time-bucketed KeyInit message of msg expires (or now), so that
+// consecutive calls rotate the KeyInit messages. The fallback KeyInit message
+// is ignored.
+func (ce *CryptEngine) keyInitWindows(
+	msg *uid.Message,
+	buckets int,
+	duration time.Duration,
+) ([]uid.KeyInitWindow, error) {
+	if duration < time.Second {
+		return nil, log.Error("cryptengine: bucket duration must be at least 1s")
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return nil, err
+	}
+	start, err := ce.keyDB.GetPrivateKeyInitNotAfter(sigKeyHash, false)
+	if err != nil {
+		return nil, err
+	}
+	if now := uint64(times.Now()); start < now {
+		start = now
+	}
+	return uid.KeyInitWindows(start, uint64(duration.Seconds()), buckets), nil
+}
+
+// addKeyInit adds KeyInit messages for pseudonym to the key server. If
+// buckets is 0, a single fallback KeyInit message valid for 90 days is added.
+// Otherwise, buckets many time-bucketed KeyInit messages (each valid for
+// bucketDuration) are added. One token is required per KeyInit message.
+func (ce *CryptEngine) addKeyInit(
+	pseudonym, mixaddress, nymaddress string,
+	tokens []string,
+	buckets int,
+	bucketDuration time.Duration,
+) error {
 	// map pseudonym
 	id, domain, err := identity.MapPlus(pseudonym)
 	if err != nil {
@@ -26,23 +66,43 @@ func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token strin
 	if err != nil {
 		return err
 	}
-	// TODO: fix parameter!
-	ki, pubKeyHash, privateKey, err := msg.KeyInit(0,
-		uint64(times.NinetyDaysLater()), 0, true, domain, mixaddress,
-		nymaddress, cipher.RandReader)
-	if err != nil {
-		return err
-	}
 	var (
 		kis          []*uid.KeyInit
 		pubKeyHashes []string
 		privateKeys  []string
-		tokens       []string
 	)
-	kis = append(kis, ki)
-	pubKeyHashes = append(pubKeyHashes, pubKeyHash)
-	privateKeys = append(privateKeys, privateKey)
-	tokens = append(tokens, token)
+	if buckets == 0 {
+		// TODO: fix parameter!
+		ki, pubKeyHash, privateKey, err := msg.KeyInit(0,
+			uint64(times.NinetyDaysLater()), 0, true, domain, mixaddress,
+			nymaddress, cipher.RandReader)
+		if err != nil {
+			return err
+		}
+		kis = append(kis, ki)
+		pubKeyHashes = append(pubKeyHashes, pubKeyHash)
+		privateKeys = append(privateKeys, privateKey)
+	} else {
+		windows, err := ce.keyInitWindows(msg, buckets, bucketDuration)
+		if err != nil {
+			return err
+		}
+		for _, w := range windows {
+			ki, pubKeyHash, privateKey, err := msg.KeyInit(0, w.NotAfter,
+				w.NotBefore, false, domain, mixaddress, nymaddress,
+				cipher.RandReader)
+			if err != nil {
+				return err
+			}
+			kis = append(kis, ki)
+			pubKeyHashes = append(pubKeyHashes, pubKeyHash)
+			privateKeys = append(privateKeys, privateKey)
+		}
+	}
+	if len(tokens) != len(kis) {
+		return log.Errorf("cryptengine: %d token(s) given, %d required",
+			len(tokens), len(kis))
+	}
 	// get JSON-RPC client and capabilities
 	client, caps, err := ce.cache.Get(domain, ce.keydPort, ce.keydHost,
 		ce.homedir, "KeyInitRepository.AddKeyInit")
@@ -83,6 +143,61 @@ func (ce *CryptEngine) addKeyInit(pseudonym, mixaddress, nymaddress, token strin
 			return err
 		}
 	}
+	// remove expired private KeyInits (retaining them for messages in transit)
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	before := uint64(times.Now()) - mixMsg.CleanupTime
+	n, err := ce.keyDB.DelExpiredPrivateKeyInits(sigKeyHash, before)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("cryptengine: removed %d expired KeyInit messages", n)
+	}
+	return nil
+}
+
+// dueKeyInit writes the number of time-bucketed KeyInit messages (each valid
+// for bucketDuration) which have to be added for pseudonym to w, so that
+// KeyInit messages are available for the next buckets many buckets.
+func (ce *CryptEngine) dueKeyInit(
+	w io.Writer,
+	pseudonym string,
+	buckets int,
+	bucketDuration time.Duration,
+) error {
+	id, _, err := identity.MapPlus(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	notAfter, err := ce.keyDB.GetPrivateKeyInitNotAfter(sigKeyHash, false)
+	if err != nil {
+		return err
+	}
+	duration := uint64(bucketDuration.Seconds())
+	if duration == 0 {
+		return log.Error("cryptengine: bucket duration must be at least 1s")
+	}
+	now := uint64(times.Now())
+	horizon := now - now%duration + uint64(buckets)*duration
+	var due uint64
+	if notAfter < horizon {
+		if notAfter < now {
+			notAfter = now - now%duration
+		}
+		due = (horizon - notAfter + duration - 1) / duration
+	}
+	fmt.Fprintln(w, due)
 	return nil
 }
 
@@ -100,6 +215,9 @@ func (ce *CryptEngine) fetchKeyInit(pseudonym string) error {
 	if !found {
 		return log.Errorf("not UID for '%s' found", id)
 	}
+	if msg.IsTombstone() {
+		return log.Errorf("%s: %s", uid.ErrTombstone, id)
+	}
 	// get SIGKEYHASH
 	sigKeyHash, err := msg.SigKeyHash()
 	if err != nil {
@@ -57,7 +57,7 @@ func (ce *CryptEngine) HasSession(sessionKey string) bool {
 
 // GetPrivateKeyEntry implements corresponding method for msg.KeyStore interface.
 func (ce *CryptEngine) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error) {
-	log.Debugf("ce.FindKeyEntry: pubKeyHash=%s", pubKeyHash)
+	log.Debugf("ce.FindKeyEntry: pubKeyHash=%s", log.Sensitive(pubKeyHash))
 	ki, sigPubKey, privateKey, err := ce.keyDB.GetPrivateKeyInit(pubKeyHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -70,6 +70,10 @@ func (ce *CryptEngine) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, err
 	if err != nil {
 		return nil, err
 	}
+	if privateKey == "" {
+		// single-use KeyInit has already been used
+		return ke, log.Error(session.ErrKeyEntryUsed)
+	}
 	// set private key
 	if err := ke.SetPrivateKey(privateKey); err != nil {
 		return nil, err
@@ -77,6 +81,18 @@ func (ce *CryptEngine) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, err
 	return ke, nil
 }
 
+// DelPrivateKeyEntry implements corresponding method for msg.KeyStore interface.
+func (ce *CryptEngine) DelPrivateKeyEntry(pubKeyHash string) error {
+	ki, _, _, err := ce.keyDB.GetPrivateKeyInit(pubKeyHash)
+	if err != nil {
+		return err
+	}
+	if ki.Fallback() {
+		return nil
+	}
+	return ce.keyDB.UsePrivateKeyInit(pubKeyHash)
+}
+
 // GetPublicKeyEntry implements corresponding method for msg.KeyStore interface.
 func (ce *CryptEngine) GetPublicKeyEntry(uidMsg *uid.Message) (*uid.KeyEntry, string, error) {
 	log.Debugf("ce.FindKeyEntry: uidMsg.Identity()=%s", uidMsg.Identity())
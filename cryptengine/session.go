@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg/session"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// sessionStateKey returns the session state key of the session between the
+// private UID own and the public UID peer (for the negotiated ciphersuite).
+func sessionStateKey(own, peer *uid.Message) (string, error) {
+	ciphersuite, err := uid.Negotiate(own, peer)
+	if err != nil {
+		return "", err
+	}
+	ownID, err := own.PubKeyFor(ciphersuite)
+	if err != nil {
+		return "", err
+	}
+	peerID, err := peer.PubKeyFor(ciphersuite)
+	if err != nil {
+		return "", err
+	}
+	return session.CalcStateKey(ownID.PublicKey32(), peerID.PublicKey32()), nil
+}
+
+// getSessionStateKey returns the session state key of the session between
+// pseudonym and contact.
+func (ce *CryptEngine) getSessionStateKey(pseudonym, contact string) (string, error) {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return "", err
+	}
+	contactID, err := identity.Map(contact)
+	if err != nil {
+		return "", err
+	}
+	own, _, err := ce.keyDB.GetPrivateUID(id, false)
+	if err != nil {
+		return "", err
+	}
+	peer, _, found, err := ce.keyDB.GetPublicUID(contactID, math.MaxInt64)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", log.Errorf("not UID for '%s' found", contactID)
+	}
+	return sessionStateKey(own, peer)
+}
+
+// listSessions writes the sessions of all private identities with known
+// contacts to w. For each session the pseudonym, the contact, the session
+// state key, and the total number of messages sent in the session are shown.
+// Session states which cannot be mapped to a pair of known identities are
+// listed with unknown pseudonym and contact.
+func (ce *CryptEngine) listSessions(w io.Writer) error {
+	keys, err := ce.keyDB.GetSessionStateKeys()
+	if err != nil {
+		return err
+	}
+	unmapped := make(map[string]bool)
+	for _, key := range keys {
+		unmapped[key] = true
+	}
+	ids, err := ce.keyDB.GetPrivateIdentities()
+	if err != nil {
+		return err
+	}
+	contacts, err := ce.keyDB.GetPublicIdentities()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		own, _, err := ce.keyDB.GetPrivateUID(id, false)
+		if err != nil {
+			return err
+		}
+		for _, contact := range contacts {
+			if contact == id {
+				continue
+			}
+			peer, _, found, err := ce.keyDB.GetPublicUID(contact, math.MaxInt64)
+			if err != nil {
+				return err
+			}
+			if !found || peer.IsTombstone() {
+				continue
+			}
+			key, err := sessionStateKey(own, peer)
+			if err != nil {
+				// no common ciphersuite -> no session possible
+				continue
+			}
+			if !unmapped[key] {
+				continue
+			}
+			delete(unmapped, key)
+			ss, err := ce.keyDB.GetSessionState(key)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", id, contact, key,
+				ss.SenderSessionCount+ss.SenderMessageCount)
+		}
+	}
+	for _, key := range keys {
+		if !unmapped[key] {
+			continue
+		}
+		ss, err := ce.keyDB.GetSessionState(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "?\t?\t%s\t%d\n", key,
+			ss.SenderSessionCount+ss.SenderMessageCount)
+	}
+	return nil
+}
+
+// showSession writes the session state of the session between pseudonym and
+// contact to w.
+func (ce *CryptEngine) showSession(w io.Writer, pseudonym, contact string) error {
+	key, err := ce.getSessionStateKey(pseudonym, contact)
+	if err != nil {
+		return err
+	}
+	reset, err := ce.keyDB.GetSessionReset(key)
+	if err != nil {
+		return err
+	}
+	ss, err := ce.keyDB.GetSessionState(key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "SESSIONSTATEKEY:\t%s\n", key)
+	fmt.Fprintf(w, "RESET:\t%t\n", reset)
+	if ss == nil {
+		fmt.Fprintf(w, "SESSIONSTATE:\tnone\n")
+		return nil
+	}
+	fmt.Fprintf(w, "SENDERSESSIONCOUNT:\t%d\n", ss.SenderSessionCount)
+	fmt.Fprintf(w, "SENDERMESSAGECOUNT:\t%d\n", ss.SenderMessageCount)
+	fmt.Fprintf(w, "MAXRECIPIENTCOUNT:\t%d\n", ss.MaxRecipientCount)
+	fmt.Fprintf(w, "RECIPIENTTEMP:\t%s\n", ss.RecipientTemp.HASH)
+	fmt.Fprintf(w, "SENDERSESSIONPUB:\t%s\n", ss.SenderSessionPub.HASH)
+	if ss.NextSenderSessionPub != nil {
+		fmt.Fprintf(w, "NEXTSENDERSESSIONPUB:\t%s\n",
+			ss.NextSenderSessionPub.HASH)
+	}
+	if ss.NextRecipientSessionPubSeen != nil {
+		fmt.Fprintf(w, "NEXTRECIPIENTSESSIONPUBSEEN:\t%s\n",
+			ss.NextRecipientSessionPubSeen.HASH)
+	}
+	fmt.Fprintf(w, "NYMADDRESS:\t%s\n", ss.NymAddress)
+	fmt.Fprintf(w, "KEYINITSESSION:\t%t\n", ss.KeyInitSession)
+	return nil
+}
+
+// resetSession deletes the session state of the session between pseudonym
+// and contact. The next message to contact starts a new key agreement and
+// restarts the session on the side of contact (see msg.StatusReset).
+func (ce *CryptEngine) resetSession(pseudonym, contact string) error {
+	key, err := ce.getSessionStateKey(pseudonym, contact)
+	if err != nil {
+		return err
+	}
+	return ce.keyDB.DelSessionState(key)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/msg/session"
+	"github.com/mutecomm/mute/uid"
+)
+
+func TestSessionCommands(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	alice := addUser(t, srv, "alice@mute.berlin")
+	if err := ce.keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	bob := addUser(t, srv, "bob@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("keyserver@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ce.searchHashChain("bob@mute.berlin", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// add session state between alice and bob
+	key, err := ce.getSessionStateKey("alice@mute.berlin", "bob@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphersuite, err := uid.Negotiate(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ke, err := bob.PubKeyFor(ciphersuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &session.State{
+		SenderSessionCount: 3,
+		SenderMessageCount: 2,
+		RecipientTemp:      *ke,
+		SenderSessionPub:   *ke,
+	}
+	if err := ce.keyDB.SetSessionState(key, ss); err != nil {
+		t.Fatal(err)
+	}
+
+	// list
+	var out bytes.Buffer
+	if err := ce.listSessions(&out); err != nil {
+		t.Fatal(err)
+	}
+	line := "alice@mute.berlin\tbob@mute.berlin\t" + key + "\t5\n"
+	if out.String() != line {
+		t.Errorf("listSessions() = %q, want %q", out.String(), line)
+	}
+
+	// show
+	out.Reset()
+	if err := ce.showSession(&out, "alice@mute.berlin", "bob@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "SENDERMESSAGECOUNT:\t2\n") {
+		t.Errorf("showSession() output misses message count:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "RESET:\tfalse\n") {
+		t.Errorf("showSession() output misses reset status:\n%s", out.String())
+	}
+
+	// reset
+	if err := ce.resetSession("alice@mute.berlin", "bob@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	ss, err = ce.keyDB.GetSessionState(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss != nil {
+		t.Error("session state should be deleted")
+	}
+	out.Reset()
+	if err := ce.showSession(&out, "alice@mute.berlin", "bob@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "RESET:\ttrue\n") {
+		t.Errorf("showSession() output misses reset status:\n%s", out.String())
+	}
+	out.Reset()
+	if err := ce.listSessions(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("listSessions() = %q, want empty list", out.String())
+	}
+}
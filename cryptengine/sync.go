@@ -0,0 +1,41 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+)
+
+// ExportSync writes the key material which has to be synchronized with other
+// devices of the user as JSON to w (see keydb.ExportSync). If observer is
+// true, private signature keys are omitted (see keydb.SyncDelta.Observer).
+// The output contains secret key material, handle with care!
+func (ce *CryptEngine) ExportSync(w io.Writer, observer bool) error {
+	d, err := ce.keyDB.ExportSync()
+	if err != nil {
+		return err
+	}
+	if observer {
+		d = d.Observer()
+	}
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// ImportSync reads key material exported with ExportSync on another device of
+// the user from r and merges it into the key database (see keydb.ImportSync).
+func (ce *CryptEngine) ImportSync(r io.Reader) error {
+	var d keydb.SyncDelta
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return log.Error(err)
+	}
+	return ce.keyDB.ImportSync(&d)
+}
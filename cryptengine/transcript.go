@@ -0,0 +1,161 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/cipher/aes256"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/mutecomm/mute/util/transcript"
+)
+
+func transcriptKey(msg *uid.Message, position uint64) *transcript.Key {
+	return &transcript.Key{
+		Identity:  msg.Identity(),
+		MsgCount:  msg.UIDContent.MSGCOUNT,
+		Position:  position,
+		SigPubKey: msg.SigPubKey(),
+		UIDHash:   base64.Encode(cipher.SHA256(msg.JSON())),
+	}
+}
+
+// signTranscript reads an unsigned transcript of the conversation between
+// pseudonym and contact from r, adds the key history of both from keyDB, signs
+// it with the current signature key of pseudonym, and writes it to w.
+func (ce *CryptEngine) signTranscript(
+	w io.Writer,
+	r io.Reader,
+	pseudonym, contact string,
+) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	contactID, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	t, err := transcript.Read(r)
+	if err != nil {
+		return err
+	}
+	msg, _, err := ce.keyDB.GetPrivateUID(id, true)
+	if err != nil {
+		return err
+	}
+	// key history
+	t.KeyHistory = nil
+	var signerKnown bool
+	for _, ident := range []string{id, contactID} {
+		msgs, positions, err := ce.keyDB.GetPublicUIDs(ident)
+		if err != nil {
+			return err
+		}
+		for i, m := range msgs {
+			if m.SigPubKey() == msg.SigPubKey() {
+				signerKnown = true
+			}
+			t.KeyHistory = append(t.KeyHistory, transcriptKey(m, positions[i]))
+		}
+	}
+	if !signerKnown {
+		// the signature key has not been seen in the hash chain (yet)
+		log.Warnf("cryptengine: signature key of %s not found in hash chain", id)
+		t.KeyHistory = append(t.KeyHistory, transcriptKey(msg, 0))
+	}
+	// sign
+	t.Exporter = id
+	t.Contact = contactID
+	t.Created = times.Now()
+	if err := t.Sign(msg.SigPubKey(), msg.PrivateSigKey64()); err != nil {
+		return err
+	}
+	return t.Write(w)
+}
+
+// checkTranscriptKey checks that key from the key history of a transcript is
+// anchored in the local hash chain: the hash chain entry at key.Position must
+// belong to key.Identity and to the UID message with hash key.UIDHash, and the
+// UID message (as looked up before and stored in keyDB) must contain the
+// claimed message counter and signature key.
+func (ce *CryptEngine) checkTranscriptKey(key *transcript.Key) error {
+	_, domain, err := identity.Split(key.Identity)
+	if err != nil {
+		return err
+	}
+	hcEntry, err := ce.keyDB.GetHashChainEntry(domain, key.Position)
+	if err != nil {
+		return log.Errorf("cryptengine: hash chain entry %d of %s not in local hash chain (sync hash chain first)",
+			key.Position, domain)
+	}
+	_, TYPE, NONCE, HashID, CrUID, UIDIndex, err := hashchain.SplitEntry(hcEntry)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(TYPE, hashchain.Type) {
+		return log.Error("cryptengine: invalid hash chain entry type")
+	}
+	k1, k2 := cipher.CKDF(NONCE)
+	// HashID = HASH(k1 | Identity)
+	if !bytes.Equal(HashID, cipher.SHA256(append(append([]byte{}, k1...), key.Identity...))) {
+		return log.Errorf("cryptengine: hash chain entry %d does not belong to %s",
+			key.Position, key.Identity)
+	}
+	UIDHash, err := base64.Decode(key.UIDHash)
+	if err != nil {
+		return err
+	}
+	// UIDIndex = HASH(UIDHash) and UIDHash = AES_256_CBC_Decrypt(IDKEY, CrUID)
+	IDKEY := cipher.SHA256(append(append([]byte{}, k2...), key.Identity...))
+	if !bytes.Equal(UIDIndex, cipher.SHA256(UIDHash)) ||
+		!bytes.Equal(aes256.CBCDecrypt(IDKEY, CrUID), UIDHash) {
+		return log.Errorf("cryptengine: UID hash of %s does not match hash chain entry %d",
+			key.Identity, key.Position)
+	}
+	msg, pos, found, err := ce.keyDB.GetPublicUID(key.Identity, key.Position)
+	if err != nil {
+		return err
+	}
+	if !found || pos != key.Position {
+		return log.Errorf("cryptengine: UID message of %s at position %d unknown (lookup UID first)",
+			key.Identity, key.Position)
+	}
+	if !bytes.Equal(cipher.SHA256(msg.JSON()), UIDHash) ||
+		msg.UIDContent.MSGCOUNT != key.MsgCount ||
+		msg.SigPubKey() != key.SigPubKey {
+		return log.Errorf("cryptengine: key history entry of %s does not match UID message at position %d",
+			key.Identity, key.Position)
+	}
+	return nil
+}
+
+// VerifyTranscript verifies the signature of transcript t and checks its
+// complete key history against the local hash chain (see
+// transcript.Transcript.VerifyKeyHistory). Only transcripts which pass both
+// checks are valid.
+func (ce *CryptEngine) VerifyTranscript(t *transcript.Transcript) error {
+	if err := t.Verify(); err != nil {
+		return err
+	}
+	return t.VerifyKeyHistory(ce.checkTranscriptKey)
+}
+
+// verifyTranscript reads a transcript from r and verifies it with
+// VerifyTranscript.
+func (ce *CryptEngine) verifyTranscript(r io.Reader) error {
+	t, err := transcript.Read(r)
+	if err != nil {
+		return err
+	}
+	return ce.VerifyTranscript(t)
+}
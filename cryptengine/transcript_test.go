@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cryptengine
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/util/transcript"
+)
+
+func TestVerifyTranscript(t *testing.T) {
+	srv, err := keyservertest.New(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ce, cleanup := newTestEngine(t, srv)
+	defer cleanup()
+	alice := addUser(t, srv, "alice@mute.berlin")
+	addUser(t, srv, "bob@mute.berlin")
+	if err := ce.syncHashChain(testDomain); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"keyserver@mute.berlin", "alice@mute.berlin", "bob@mute.berlin"}
+	for _, id := range ids {
+		if err := ce.searchHashChain(id, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// create transcript with key history from keyDB
+	newTranscript := func() *transcript.Transcript {
+		tr := &transcript.Transcript{
+			Exporter: "alice@mute.berlin",
+			Contact:  "bob@mute.berlin",
+			Messages: []*transcript.Message{
+				{MsgNum: 1, From: "bob@mute.berlin", To: "alice@mute.berlin",
+					Message: "subject\nbody", Signature: "valid"},
+			},
+		}
+		for _, id := range []string{tr.Exporter, tr.Contact} {
+			msgs, positions, err := ce.keyDB.GetPublicUIDs(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range msgs {
+				tr.KeyHistory = append(tr.KeyHistory, transcriptKey(m, positions[i]))
+			}
+		}
+		return tr
+	}
+	sign := func(tr *transcript.Transcript) {
+		if err := tr.Sign(alice.SigPubKey(), alice.PrivateSigKey64()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := newTranscript()
+	sign(tr)
+	if err := ce.VerifyTranscript(tr); err != nil {
+		t.Fatal(err)
+	}
+
+	// self-asserted position
+	tr = newTranscript()
+	tr.KeyHistory[1].Position = tr.KeyHistory[0].Position
+	sign(tr)
+	if err := ce.VerifyTranscript(tr); err != transcript.ErrKeyNotAnchored {
+		t.Errorf("VerifyTranscript() = %v, want %v", err, transcript.ErrKeyNotAnchored)
+	}
+
+	// self-asserted signature key of contact
+	tr = newTranscript()
+	tr.KeyHistory[1].SigPubKey = alice.SigPubKey()
+	sign(tr)
+	if err := ce.VerifyTranscript(tr); err != transcript.ErrKeyNotAnchored {
+		t.Errorf("VerifyTranscript() = %v, want %v", err, transcript.ErrKeyNotAnchored)
+	}
+
+	// self-asserted UID hash
+	tr = newTranscript()
+	tr.KeyHistory[0].UIDHash = tr.KeyHistory[1].UIDHash
+	sign(tr)
+	if err := ce.VerifyTranscript(tr); err != transcript.ErrKeyNotAnchored {
+		t.Errorf("VerifyTranscript() = %v, want %v", err, transcript.ErrKeyNotAnchored)
+	}
+
+	// signing key not in hash chain
+	tr = newTranscript()
+	tr.KeyHistory = append(tr.KeyHistory, &transcript.Key{
+		Identity:  "alice@mute.berlin",
+		SigPubKey: alice.SigPubKey(),
+	})
+	tr.KeyHistory = tr.KeyHistory[1:]
+	sign(tr)
+	if err := ce.VerifyTranscript(tr); err != transcript.ErrKeyNotAnchored {
+		t.Errorf("VerifyTranscript() = %v, want %v", err, transcript.ErrKeyNotAnchored)
+	}
+}
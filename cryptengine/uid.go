@@ -8,19 +8,30 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/admission"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
 )
 
-// generate a new nym and store it in keydb.
+// generate a new nym and store it in keydb. If validFrom (RFC 3339) or
+// validFor are set, the UID message has the fixed validity period validFor
+// starting at validFrom (default: now). If sigescrow is true, the UID message
+// contains an escrow key (see exportEscrow).
 func (ce *CryptEngine) generate(
 	pseudonym string,
 	keyserver bool,
+	validFrom string,
+	validFor time.Duration,
+	sigescrow bool,
 	outputfp *os.File,
 ) error {
 	// map pseudonym
@@ -38,25 +49,43 @@ func (ce *CryptEngine) generate(
 			return err
 		}
 	}
-	uid, err := uid.Create(id, false, "", "", uid.Strict, lastEntry,
-		cipher.RandReader)
+	var msg *uid.Message
+	if validFrom == "" && validFor == 0 {
+		msg, err = uid.Create(id, sigescrow, "", "", uid.Strict, lastEntry,
+			cipher.RandReader)
+	} else {
+		notbefore := times.Now()
+		if validFrom != "" {
+			t, err := time.Parse(time.RFC3339, validFrom)
+			if err != nil {
+				return log.Error(err)
+			}
+			notbefore = t.Unix()
+		}
+		if validFor == 0 {
+			validFor = 365 * 24 * time.Hour
+		}
+		notafter := notbefore + int64(validFor.Seconds())
+		msg, err = uid.CreateWithValidity(id, sigescrow, "", "", uid.Strict,
+			lastEntry, uint64(notafter), uint64(notbefore), cipher.RandReader)
+	}
 	if err != nil {
 		return err
 	}
 	if !keyserver {
 		// store UID in keyDB
-		if err := ce.keyDB.AddPrivateUID(uid); err != nil {
+		if err := ce.keyDB.AddPrivateUID(msg); err != nil {
 			return err
 		}
 	} else {
 		// a private key for the keyserver is not stored in the keyDB
 		var out bytes.Buffer
-		if err := json.Indent(&out, []byte(uid.JSON()), "", "  "); err != nil {
+		if err := json.Indent(&out, []byte(msg.JSON()), "", "  "); err != nil {
 			return err
 		}
 		fmt.Fprintln(outputfp, out.String())
 		if keyserver {
-			fmt.Fprintf(outputfp, "{\"PRIVSIGKEY\": %q}\n", uid.PrivateSigKey())
+			fmt.Fprintf(outputfp, "{\"PRIVSIGKEY\": %q}\n", msg.PrivateSigKey())
 		}
 	}
 	log.Infof("nym '%s' generated successfully", id)
@@ -64,7 +93,7 @@ func (ce *CryptEngine) generate(
 }
 
 func (ce *CryptEngine) registerOrUpdate(
-	pseudonym, token, command, verb string,
+	pseudonym, token, invitation, command, verb string,
 ) error {
 	// map pseudonym
 	id, domain, err := identity.MapPlus(pseudonym)
@@ -90,6 +119,23 @@ func (ce *CryptEngine) registerOrUpdate(
 	content := make(map[string]interface{})
 	content["UIDMessage"] = msg
 	content["Token"] = token
+	if command == "CreateUID" {
+		// admission control of key server
+		if caps.INVITATION {
+			if invitation == "" {
+				return log.Error(admission.ErrInvitationRequired)
+			}
+			content["Invitation"] = invitation
+		}
+		if caps.POWBITS > 0 {
+			log.Infof("compute proof-of-work (%d bits)", caps.POWBITS)
+			proof, err := admission.ProofOfWork(msg.JSON(), caps.POWBITS)
+			if err != nil {
+				return log.Error(err)
+			}
+			content["ProofOfWork"] = proof
+		}
+	}
 	reply, err := client.JSONRPCRequest("KeyRepository."+command, content)
 	if err != nil {
 		return err
@@ -126,12 +172,15 @@ func (ce *CryptEngine) registerOrUpdate(
 }
 
 // register already generated nym (stored in keyDB) with key server.
-func (ce *CryptEngine) register(pseudonym, tokenString string) error {
-	return ce.registerOrUpdate(pseudonym, tokenString, "CreateUID", "registered")
+// The invitation code is only used, if the key server requires one.
+func (ce *CryptEngine) register(pseudonym, tokenString, invitation string) error {
+	return ce.registerOrUpdate(pseudonym, tokenString, invitation, "CreateUID",
+		"registered")
 }
 
 // genupdate generates an update for the (registered) nym and stores it in keydb.
-func (ce *CryptEngine) genupdate(pseudonym string) error {
+// If msgSigKey is true, a dedicated message signing key is added to the nym.
+func (ce *CryptEngine) genupdate(pseudonym string, msgSigKey bool) error {
 	// map pseudonym
 	id, err := identity.Map(pseudonym)
 	if err != nil {
@@ -143,7 +192,12 @@ func (ce *CryptEngine) genupdate(pseudonym string) error {
 		return err
 	}
 	// generate new UID
-	newUID, err := oldUID.Update(cipher.RandReader)
+	var newUID *uid.Message
+	if msgSigKey {
+		newUID, err = oldUID.AddMsgSigKey(cipher.RandReader)
+	} else {
+		newUID, err = oldUID.Update(cipher.RandReader)
+	}
 	if err != nil {
 		return err
 	}
@@ -151,9 +205,32 @@ func (ce *CryptEngine) genupdate(pseudonym string) error {
 	return ce.keyDB.AddPrivateUID(newUID)
 }
 
+// gentombstone generates the final update for the (registered) nym which
+// marks it as deleted on the key server and stores it in keydb.
+func (ce *CryptEngine) gentombstone(pseudonym string) error {
+	// map pseudonym
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	// get old UID from keyDB
+	oldUID, _, err := ce.keyDB.GetPrivateUID(id, true)
+	if err != nil {
+		return err
+	}
+	// generate tombstone
+	tombstone, err := oldUID.Tombstone(cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	// store tombstone in keyDB
+	return ce.keyDB.AddPrivateUID(tombstone)
+}
+
 // update an already generated nym update (stored in keyDB) with key server.
 func (ce *CryptEngine) update(pseudonym, tokenString string) error {
-	return ce.registerOrUpdate(pseudonym, tokenString, "UpdateUID", "updated")
+	return ce.registerOrUpdate(pseudonym, tokenString, "", "UpdateUID",
+		"updated")
 }
 
 // deleteUID deletes a nym.
@@ -188,6 +265,89 @@ func (ce *CryptEngine) deleteUID(pseudonym string, force bool) error {
 	return ce.keyDB.DelPrivateUID(msg)
 }
 
+// showSigKeyHash writes the SIGKEYHASH of the most recent UID message of
+// pseudonym to w. For own user IDs without public UID message the private
+// UID message is used.
+func (ce *CryptEngine) showSigKeyHash(w io.Writer, pseudonym string) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if !found {
+		ids, err := ce.keyDB.GetPrivateIdentities()
+		if err != nil {
+			return err
+		}
+		for _, privID := range ids {
+			if privID == id {
+				msg, _, err = ce.keyDB.GetPrivateUID(id, false)
+				if err != nil {
+					return err
+				}
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return log.Errorf("not UID for '%s' found", id)
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, sigKeyHash)
+	return nil
+}
+
+// showPublicUID writes the latest public UID message of pseudonym to w.
+func (ce *CryptEngine) showPublicUID(w io.Writer, pseudonym string) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, found, err := ce.keyDB.GetPublicUID(id, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return log.Errorf("not UID for '%s' found", id)
+	}
+	fmt.Fprintln(w, string(msg.JSON()))
+	return nil
+}
+
+// showExpiry writes the expiry times (NOTAFTER, as Unix time) of the current
+// private UID message of pseudonym and of its latest KeyInit message (0, if
+// no KeyInit message exists) to w. It also writes whether the UID message is
+// renewable (see uid.Message.Renewable).
+func (ce *CryptEngine) showExpiry(w io.Writer, pseudonym string) error {
+	id, err := identity.Map(pseudonym)
+	if err != nil {
+		return err
+	}
+	msg, _, err := ce.keyDB.GetPrivateUID(id, false)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := msg.SigKeyHash()
+	if err != nil {
+		return err
+	}
+	keyInitNotAfter, err := ce.keyDB.GetPrivateKeyInitNotAfter(sigKeyHash, true)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "UID:\t%d\n", msg.UIDContent.NOTAFTER)
+	fmt.Fprintf(w, "RENEWABLE:\t%t\n", msg.Renewable())
+	fmt.Fprintf(w, "KEYINIT:\t%d\n", keyInitNotAfter)
+	return nil
+}
+
 // list UIDs shows all own (mapped) users IDs on outfp.
 func (ce *CryptEngine) listUIDs(outfp *os.File) error {
 	ids, err := ce.keyDB.GetPrivateIdentities()
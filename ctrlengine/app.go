@@ -15,6 +15,7 @@ import (
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/util/browser"
+	"github.com/mutecomm/mute/util/ratelimit"
 	"github.com/urfave/cli"
 )
 
@@ -113,6 +114,80 @@ func (sh *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sh.handler.ServeHTTP(w, r)
 }
 
+// Rate limits for external callers of the HTTP API and the control socket of
+// the daemon. Expensive commands (like login, fetch, or hash chain sync) are
+// additionally capped in their concurrency, so that a misbehaving frontend
+// cannot starve the scheduled tasks of the engine.
+var (
+	apiLimiter       = ratelimit.New(10, 50) // 10 calls/s, bursts of 50
+	expensiveLimiter = ratelimit.New(0.2, 3) // 1 call/5s, bursts of 3
+	expensiveCap     = ratelimit.NewCap(1)
+)
+
+// limiterCleanup is the interval in which idle callers are removed from the
+// rate limiters.
+const limiterCleanup = time.Minute
+
+// cleanupLimiters periodically removes idle callers from the rate limiters
+// until done is closed.
+func cleanupLimiters(done <-chan struct{}) {
+	ticker := time.NewTicker(limiterCleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			apiLimiter.Cleanup()
+			expensiveLimiter.Cleanup()
+		case <-done:
+			return
+		}
+	}
+}
+
+// callerKey returns the rate limiting key of the caller of request r.
+// The HTTP API listens on localhost, where the remote address is the same for
+// all callers. Therefore, callers with a valid session cookie (the logged in
+// frontend) get their own bucket, all other callers share the bucket of their
+// host address. This way unauthenticated callers cannot starve the frontend.
+func callerKey(r *http.Request) string {
+	if cookie, err := r.Cookie("mute"); err == nil && cookie.Value != "" {
+		auth.RLock()
+		secret := auth.secret
+		auth.RUnlock()
+		if cookie.Value == secret {
+			return "session"
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "host:" + host
+}
+
+// limitHandler wraps handler with per-caller rate limiting.
+type limitHandler struct {
+	handler http.Handler
+	limiter *ratelimit.Limiter
+	cap     *ratelimit.Cap // optional concurrency cap
+}
+
+func (lh *limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !lh.limiter.Allow(callerKey(r)) {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if lh.cap != nil {
+		if !lh.cap.TryAcquire() {
+			http.Error(w, "too many concurrent requests",
+				http.StatusServiceUnavailable)
+			return
+		}
+		defer lh.cap.Release()
+	}
+	lh.handler.ServeHTTP(w, r)
+}
+
 func (ce *CtrlEngine) appStart(
 	c *cli.Context,
 	statusfp io.Writer,
@@ -126,22 +201,32 @@ func (ce *CtrlEngine) appStart(
 	}
 	// create muxer
 	muxer := http.NewServeMux()
-	// register handlers
+	// register handlers (expensive ones are limited separately)
 	muxer.Handle("/", &staticHandler{
 		handler: http.FileServer(http.Dir(docroot)),
 	})
-	muxer.Handle("/login", &loginHandler{
-		ce:       ce,
-		c:        c,
-		statusfp: statusfp,
+	muxer.Handle("/login", &limitHandler{
+		handler: &loginHandler{
+			ce:       ce,
+			c:        c,
+			statusfp: statusfp,
+		},
+		limiter: expensiveLimiter,
+		cap:     expensiveCap,
 	})
-	// create HTTP server
+	// create HTTP server, all requests are rate limited
 	srv := &http.Server{
-		Handler:        muxer,
+		Handler: &limitHandler{
+			handler: muxer,
+			limiter: apiLimiter,
+		},
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20, // 1 MB
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go cleanupLimiters(done)
 	// start HTTP server
 	ch := make(chan error)
 	go func() {
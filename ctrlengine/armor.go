@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mutecomm/mute/encode/armor"
+	"github.com/mutecomm/mute/log"
+)
+
+// armorTypes maps the --type names of the armor commands to armor types.
+var armorTypes = map[string]string{
+	"contact":    armor.TypeContact,
+	"signature":  armor.TypeSignature,
+	"sync":       armor.TypeSync,
+	"token":      armor.TypeToken,
+	"transcript": armor.TypeTranscript,
+}
+
+// armorType returns the armor type for the --type name.
+func armorType(name string) (string, error) {
+	typ, ok := armorTypes[strings.ToLower(name)]
+	if !ok {
+		return "", log.Errorf("ctrlengine: unknown armor type '%s'", name)
+	}
+	return typ, nil
+}
+
+// writeArtifact writes data to w, armored as type typ if armored is true.
+func writeArtifact(w io.Writer, typ string, data []byte, armored bool) error {
+	if armored {
+		var err error
+		data, err = armor.Encode(typ, data)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	if _, err := w.Write(data); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// readArtifact returns the unarmored data of an artifact of type typ. Data
+// which is not armored is returned unchanged.
+func readArtifact(typ string, data []byte) ([]byte, error) {
+	if !armor.IsArmored(data) {
+		return data, nil
+	}
+	data, err := armor.DecodeType(typ, data)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return data, nil
+}
+
+// armorArtifact reads an artifact from r and writes it to w, armored as the
+// type given by name.
+func armorArtifact(w io.Writer, r io.Reader, name string) error {
+	typ, err := armorType(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return log.Error(err)
+	}
+	return writeArtifact(w, typ, data, true)
+}
+
+// dearmorArtifact reads an armored artifact from r and writes the unarmored
+// data to w. If name is not empty, the type of the artifact must match.
+func dearmorArtifact(w io.Writer, r io.Reader, name string) error {
+	armored, err := ioutil.ReadAll(r)
+	if err != nil {
+		return log.Error(err)
+	}
+	var data []byte
+	if name != "" {
+		typ, err := armorType(name)
+		if err != nil {
+			return err
+		}
+		data, err = armor.DecodeType(typ, armored)
+		if err != nil {
+			return log.Error(err)
+		}
+	} else {
+		_, data, err = armor.Decode(armored)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	if _, err := w.Write(data); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// readAttachments reads the given files as attachments.
+func readAttachments(files []string) ([]*msgdb.Attachment, error) {
+	var (
+		attachments []*msgdb.Attachment
+		size        int
+	)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		size += len(data)
+		if size > mimeMsg.MaxMsgSize {
+			return nil, log.Errorf("ctrlengine: attachments exceed maximum size of %d bytes",
+				mimeMsg.MaxMsgSize)
+		}
+		attachments = append(attachments, &msgdb.Attachment{
+			Filename: filepath.Base(file),
+			Data:     data,
+		})
+	}
+	return attachments, nil
+}
+
+// chunkOverhead is the space reserved for the header of a chunk.
+const chunkOverhead = 2048
+
+// encodeMessage returns the MIME encoding of message with the given header
+// and attachments. Encodings which do not fit into a single message are
+// split into multiple chunks, if chunking is enabled (see def.FeatureChunking).
+func encodeMessage(
+	header mimeMsg.Header,
+	message string,
+	attachments []*msgdb.Attachment,
+) ([]string, error) {
+	var mimeAttachments []*mimeMsg.Attachment
+	for _, attachment := range attachments {
+		mimeAttachments = append(mimeAttachments, &mimeMsg.Attachment{
+			Filename: attachment.Filename,
+			Reader:   bytes.NewReader(attachment.Data),
+		})
+	}
+	var buf bytes.Buffer
+	if err := mimeMsg.New(&buf, header, message, mimeAttachments); err != nil {
+		return nil, err
+	}
+	if buf.Len() > mimeMsg.MaxMsgSize {
+		return nil, log.Errorf("ctrlengine: encoded message too large (%d > %d bytes)",
+			buf.Len(), mimeMsg.MaxMsgSize)
+	}
+	if buf.Len() <= msg.MaxContentLength {
+		return []string{buf.String()}, nil
+	}
+	if !def.FeatureEnabled(def.FeatureChunking) {
+		return nil, log.Errorf("ctrlengine: encoded message too large (%d > %d bytes), chunking disabled",
+			buf.Len(), msg.MaxContentLength)
+	}
+	chunks, err := mimeMsg.EncodeChunks(header, buf.String(),
+		msg.MaxContentLength-chunkOverhead)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("ctrlengine: message %s split into %d chunks", header.MessageID,
+		len(chunks))
+	return chunks, nil
+}
+
+// decodeAttachments reads the data of the given MIME attachments.
+func decodeAttachments(
+	mimeAttachments []*mimeMsg.Attachment,
+) ([]*msgdb.Attachment, error) {
+	var attachments []*msgdb.Attachment
+	for _, attachment := range mimeAttachments {
+		data, err := ioutil.ReadAll(attachment.Reader)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		attachments = append(attachments, &msgdb.Attachment{
+			Filename: attachment.Filename,
+			Data:     data,
+		})
+	}
+	return attachments, nil
+}
+
+func (ce *CtrlEngine) msgAttachmentsList(
+	w io.Writer,
+	id string,
+	msgNum int64,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgNum)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		if attachment.Deleted {
+			fmt.Fprintf(w, "%d\t%s\tdeleted\n", attachment.AttachID,
+				attachment.Filename)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\t%d\n", attachment.AttachID,
+				attachment.Filename, len(attachment.Data))
+		}
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) msgAttachmentsExtract(
+	id string,
+	msgNum int64,
+	attachID int64,
+	dir string,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, msgNum)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, attachment := range attachments {
+		if attachID != 0 && attachment.AttachID != attachID {
+			continue
+		}
+		found = true
+		if attachment.Deleted {
+			log.Warnf("ctrlengine: attachment %d has been deleted", attachment.AttachID)
+			continue
+		}
+		// never trust the filenames of received attachments
+		filename := filepath.Base(attachment.Filename)
+		if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+			filename = fmt.Sprintf("attachment-%d", attachment.AttachID)
+		}
+		path := filepath.Join(dir, filename)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return log.Error(err)
+		}
+		if _, err := f.Write(attachment.Data); err != nil {
+			f.Close()
+			return log.Error(err)
+		}
+		if err := f.Close(); err != nil {
+			return log.Error(err)
+		}
+		fmt.Fprintf(ce.fileTable.StatusFP, "attachment saved as %s\n", path)
+	}
+	if attachID != 0 && !found {
+		return log.Errorf("ctrlengine: unknown attachment %d", attachID)
+	}
+	return nil
+}
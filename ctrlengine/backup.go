@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mutecomm/mute/cryptengine"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/urfave/cli"
+)
+
+// backupKeyDB adds the keyDB to archive a.
+func (ce *CtrlEngine) backupKeyDB(c *cli.Context, a *encdb.Archive) error {
+	if subprocess(c) {
+		// let mutecrypt write a keyDB archive to a temporary directory
+		tmpdir, err := ioutil.TempDir("", "mutebackup")
+		if err != nil {
+			return log.Error(err)
+		}
+		defer os.RemoveAll(tmpdir)
+		tmpfile := filepath.Join(tmpdir, "keys.bak")
+		_, err = ce.mutecryptRun(c, "", ce.passphrase, "db", "backup",
+			"--out", tmpfile,
+			"--iterations", strconv.Itoa(c.Int("iterations")))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(tmpfile)
+		if err != nil {
+			return log.Error(err)
+		}
+		defer f.Close()
+		keys, err := encdb.ReadArchive(f, ce.passphrase)
+		if err != nil {
+			return log.Error(err)
+		}
+		dbVersion, dbData, keyData, err := keys.Database("keys")
+		if err != nil {
+			return log.Error(err)
+		}
+		return a.AddDatabase("keys", dbVersion, dbData, keyData)
+	}
+	cryptEng, err := ce.cryptEngine(c)
+	if err != nil {
+		return err
+	}
+	dbVersion, dbData, keyData, err := cryptEng.BackupKeyDB()
+	if err != nil {
+		return err
+	}
+	return a.AddDatabase("keys", dbVersion, dbData, keyData)
+}
+
+// dbBackup writes a backup of msgDB and keyDB to the archive file out. The
+// archive is encrypted with the passphrase of the databases and contains a
+// manifest with the database versions and the checksums of all files.
+func (ce *CtrlEngine) dbBackup(c *cli.Context, statfp io.Writer, out string) error {
+	a := encdb.NewArchive("mutectrl " + version.Number)
+	dbVersion, err := ce.msgDB.Version()
+	if err != nil {
+		return err
+	}
+	dbData, keyData, err := ce.msgDB.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := a.AddDatabase("msgs", dbVersion, dbData, keyData); err != nil {
+		return log.Error(err)
+	}
+	if err := ce.backupKeyDB(c, a); err != nil {
+		return err
+	}
+	// write archive (never overwrite existing files)
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := a.Write(f, ce.passphrase, c.Int("iterations")); err != nil {
+		f.Close()
+		os.Remove(out)
+		return log.Error(err)
+	}
+	if err := f.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("ctrlengine: backup written to %s", out)
+	fmt.Fprintf(statfp, "backup written to %s\n", out)
+	return nil
+}
+
+// restoreMsgDB restores msgDB from archive a and verifies it by opening it.
+func restoreMsgDB(msgdbname string, a *encdb.Archive, passphrase []byte) error {
+	dbVersion, dbData, keyData, err := a.Database("msgs")
+	if err != nil {
+		return log.Error(err)
+	}
+	archived, err := strconv.ParseUint(dbVersion, 10, 64)
+	if err != nil {
+		return log.Error(err)
+	}
+	supported, err := strconv.ParseUint(msgdb.Version, 10, 64)
+	if err != nil {
+		return log.Error(err)
+	}
+	if archived > supported {
+		return log.Error(msgdb.ErrNewerVersion)
+	}
+	log.Infof("restore msgDB '%s'", msgdbname)
+	if err := encdb.WriteFiles(msgdbname, dbData, keyData); err != nil {
+		return log.Error(err)
+	}
+	msgDB, err := msgdb.Open(msgdbname, passphrase)
+	if err != nil {
+		removeDB(msgdbname)
+		return err
+	}
+	return msgDB.Close()
+}
+
+func removeDB(dbname string) {
+	os.Remove(dbname + encdb.DBSuffix)
+	os.Remove(dbname + encdb.KeySuffix)
+}
+
+// dbRestore restores msgDB and keyDB from the archive file in. The archive is
+// verified (authenticity, manifest, and checksums) before any file is written
+// and the databases must not exist already. The restored databases are
+// verified by opening them, if that fails no restored file is left behind.
+func (ce *CtrlEngine) dbRestore(c *cli.Context, statfp io.Writer, in string) error {
+	homedir := c.GlobalString("homedir")
+	// get passphrase (read it, if necessary)
+	if _, err := ce.getPassphrase(statfp, homedir); err != nil {
+		return err
+	}
+	// read and verify archive
+	f, err := os.Open(in)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer f.Close()
+	a, err := encdb.ReadArchive(f, ce.passphrase)
+	if err != nil {
+		return log.Error(err)
+	}
+	// restore msgDB
+	msgdbname := filepath.Join(homedir, "msgs")
+	if err := restoreMsgDB(msgdbname, a, ce.passphrase); err != nil {
+		return err
+	}
+	// restore keyDB (the in-process crypt engine reopens it on next use)
+	if ce.cryptEng != nil {
+		ce.cryptEng.Close()
+	}
+	if subprocess(c) {
+		_, err = ce.mutecryptRun(c, "", ce.passphrase, "db", "restore", "--in", in)
+	} else {
+		err = cryptengine.RestoreKeyDB(homedir, a, ce.passphrase)
+	}
+	if err != nil {
+		removeDB(msgdbname)
+		return err
+	}
+	log.Infof("ctrlengine: backup %s restored", in)
+	fmt.Fprintf(statfp, "backup %s (created %s) restored: %d database(s), %d file(s) verified\n",
+		in, time.Unix(a.Manifest.CREATED, 0).Format(time.RFC3339), len(a.Manifest.DATABASES),
+		len(a.Manifest.FILES))
+	return nil
+}
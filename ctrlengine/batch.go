@@ -0,0 +1,177 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
+	"github.com/urfave/cli"
+)
+
+// Results of batch commands.
+const (
+	batchOK         = "ok"
+	batchFailed     = "failed"
+	batchSkipped    = "skipped"
+	batchRolledBack = "rolledback"
+)
+
+// batchForbidden contains the commands which cannot be used in batches,
+// because they do not return or manage the databases themselves.
+var batchForbidden = []string{"app", "batch", "daemon", "db", "lock", "quit"}
+
+// batchResult is the result of a single command of a batch.
+type batchResult struct {
+	command string
+	result  string
+	err     error
+}
+
+// readBatch reads the commands of a batch from r (one command per line,
+// empty lines and lines starting with '#' are ignored).
+func readBatch(r io.Reader) ([]string, error) {
+	var commands []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ln := strings.TrimSpace(scanner.Text())
+		if ln == "" || strings.HasPrefix(ln, "#") {
+			continue
+		}
+		fields := strings.Fields(ln)
+		for _, cmd := range batchForbidden {
+			if fields[0] == cmd {
+				return nil, log.Errorf("ctrlengine: command '%s' not allowed in batch",
+					cmd)
+			}
+		}
+		commands = append(commands, ln)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return commands, nil
+}
+
+// restoreMsgDBSnapshot closes the databases and replaces msgDB with the files
+// dbData and keyData (see msgdb.Snapshot). Afterwards msgDB is opened again.
+func (ce *CtrlEngine) restoreMsgDBSnapshot(
+	homedir string,
+	dbData, keyData []byte,
+) error {
+	passphrase := append([]byte(nil), ce.passphrase...)
+	ce.lock()
+	msgdbname := filepath.Join(homedir, "msgs")
+	removeDB(msgdbname)
+	if err := encdb.WriteFiles(msgdbname, dbData, keyData); err != nil {
+		bzero.Bytes(passphrase)
+		return log.Error(err)
+	}
+	ce.passphrase = passphrase
+	return ce.openMsgDB(homedir)
+}
+
+// batch executes the commands read from the command-fd one after another,
+// like commands given on the command line. By default, the batch stops at
+// the first failed command and the remaining commands are skipped. With
+// keepGoing all commands are executed. If atomic is set, msgDB is restored
+// to its state before the batch, if a command fails (all-or-nothing).
+// Changes which are not recorded in msgDB (keyDB, key server, sent messages)
+// cannot be rolled back.
+//
+// For every command a line 'index<TAB>result<TAB>command<TAB>error' is
+// written to w, where result is one of ok, failed, skipped, and rolledback.
+// The final line 'batch<TAB>result' contains the result of the whole batch
+// (ok, failed, or rolledback).
+func (ce *CtrlEngine) batch(
+	c *cli.Context,
+	w io.Writer,
+	atomic, keepGoing bool,
+) error {
+	if atomic && keepGoing {
+		return log.Error("ctrlengine: options --atomic and --keep-going are mutually exclusive")
+	}
+	commands, err := readBatch(ce.fileTable.CommandFP)
+	if err != nil {
+		return err
+	}
+	homedir := c.GlobalString("homedir")
+	var dbData, keyData []byte
+	if atomic {
+		dbData, keyData, err = ce.msgDB.Snapshot()
+		if err != nil {
+			return err
+		}
+		defer bzero.Bytes(dbData)
+		defer bzero.Bytes(keyData)
+	}
+
+	// execute commands (help texts of failed commands go to the status-fd,
+	// the output-fd is reserved for the output of the commands and the results)
+	writer := ce.app.Writer
+	ce.app.Writer = ce.fileTable.StatusFP
+	defer func() { ce.app.Writer = writer }()
+	results := make([]batchResult, len(commands))
+	failed := 0
+	for i, command := range commands {
+		results[i].command = command
+		if failed > 0 && !keepGoing {
+			results[i].result = batchSkipped
+			continue
+		}
+		log.Infof("ctrlengine: batch command %d: %s", i+1, command)
+		if err := ce.app.Run(ce.commandArgs(c, command)); err != nil {
+			results[i].err = err
+		} else if ce.err != nil {
+			results[i].err = ce.translateError(ce.err)
+			ce.err = nil
+		}
+		if results[i].err != nil {
+			results[i].result = batchFailed
+			failed++
+		} else {
+			results[i].result = batchOK
+		}
+	}
+
+	// roll back, if necessary
+	result := batchOK
+	if failed > 0 {
+		result = batchFailed
+		if atomic {
+			if err := ce.restoreMsgDBSnapshot(homedir, dbData, keyData); err != nil {
+				return err
+			}
+			for i := range results {
+				if results[i].result == batchOK {
+					results[i].result = batchRolledBack
+				}
+			}
+			result = batchRolledBack
+			log.Info("ctrlengine: batch rolled back")
+		}
+	}
+
+	// write results
+	for i, r := range results {
+		var errStr string
+		if r.err != nil {
+			errStr = strings.Join(strings.Fields(r.err.Error()), " ")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, r.result, r.command, errStr)
+	}
+	fmt.Fprintf(w, "batch\t%s\n", result)
+	if failed > 0 {
+		return log.Errorf("ctrlengine: batch %s: %d of %d command(s) failed",
+			result, failed, len(commands))
+	}
+	return nil
+}
@@ -6,18 +6,22 @@ package ctrlengine
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/encode/armor"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/serviceguard/client"
 	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/identicon"
 	"github.com/urfave/cli"
 )
 
@@ -30,24 +34,20 @@ import (
 //TODO:
 //  - kill mutecrypt process in case of failure?
 //  - make more efficient
-func mutecryptAddContact(
+func (ce *CtrlEngine) mutecryptAddContact(
 	c *cli.Context,
 	passphrase []byte,
 	id, domain, host string,
 	client *client.Client,
 ) error {
-	log.Infof("mutecryptAddContact(): id=%s, domain=%s", id, domain)
+	log.Infof("ce.mutecryptAddContact(): id=%s, domain=%s", id, domain)
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 	}
-	if host != "" {
-		args = append(args,
-			"--keyhost", host,
-			"--keyport", ":8080") // TODO: remove keyport hack!
-	}
-	cmd := exec.Command("mutecrypt", args...)
+	args = append(args, keyServerArgs(c, host)...)
+	cmd := ce.mutecrypt(c, args...)
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -269,7 +269,7 @@ func (ce *CtrlEngine) contactAdd(
 		return nil
 	}
 	// add new contact
-	err = mutecryptAddContact(c, ce.passphrase, contactMapped, domain, host, ce.client)
+	err = ce.mutecryptAddContact(c, ce.passphrase, contactMapped, domain, host, ce.client)
 	if err != nil {
 		return err
 	}
@@ -277,7 +277,9 @@ func (ce *CtrlEngine) contactAdd(
 	return add(ce.msgDB, idMapped, contactMapped, fullName, contactType)
 }
 
-func (ce *CtrlEngine) contactEdit(id, contact, fullName string) error {
+// contactEdit edits the contact entry of contact for user ID id. Only the
+// options given in c are changed.
+func (ce *CtrlEngine) contactEdit(c *cli.Context, id, contact string) error {
 	idMapped, err := identity.Map(id)
 	if err != nil {
 		return err
@@ -286,18 +288,78 @@ func (ce *CtrlEngine) contactEdit(id, contact, fullName string) error {
 	if err != nil {
 		return err
 	}
-	unmappedID, _, contactType, err := ce.msgDB.GetContact(idMapped, contactMapped)
+	unmappedID, fullName, contactType, err := ce.msgDB.GetContact(idMapped,
+		contactMapped)
 	if err != nil {
 		return err
 	}
 	if unmappedID == "" {
 		return log.Errorf("ctrlengine: contact %s unknown", contact)
 	}
+	// determine delay bounds
+	minDelay, maxDelay, err := ce.msgDB.GetContactDelays(idMapped,
+		contactMapped)
+	if err != nil {
+		return err
+	}
+	setDelays := c.IsSet("mindelay") || c.IsSet("maxdelay")
+	if c.Bool("receipts") && c.Bool("no-receipts") {
+		return log.Error("ctrlengine: --receipts and --no-receipts are mutually exclusive")
+	}
+	if c.Bool("reset-delays") {
+		if setDelays {
+			return log.Error("ctrlengine: --reset-delays cannot be combined " +
+				"with --mindelay or --maxdelay")
+		}
+		minDelay, maxDelay = 0, 0
+	} else if setDelays {
+		// unset bounds are taken from the contact or the account
+		if minDelay == 0 {
+			_, _, _, minDelay, maxDelay, _, err = ce.msgDB.GetAccount(idMapped, "")
+			if err != nil {
+				return err
+			}
+		}
+		if c.IsSet("mindelay") {
+			minDelay, err = def.ParseDelay(c.String("mindelay"))
+			if err != nil {
+				return log.Errorf("--mindelay: %s", err)
+			}
+		}
+		if c.IsSet("maxdelay") {
+			maxDelay, err = def.ParseDelay(c.String("maxdelay"))
+			if err != nil {
+				return log.Errorf("--maxdelay: %s", err)
+			}
+		}
+		if !c.Bool("nodelaycheck") {
+			if err := def.CheckDelays(minDelay, maxDelay); err != nil {
+				return log.Error(err)
+			}
+		}
+	}
+	if c.IsSet("full-name") {
+		fullName = c.String("full-name")
+	}
 	err = ce.msgDB.AddContact(idMapped, contactMapped, contact, fullName,
 		contactType)
 	if err != nil {
 		return err
 	}
+	if setDelays || c.Bool("reset-delays") {
+		err := ce.msgDB.SetContactDelays(idMapped, contactMapped, minDelay,
+			maxDelay)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Bool("receipts") || c.Bool("no-receipts") {
+		err := ce.msgDB.SetContactReceipts(idMapped, contactMapped,
+			c.Bool("receipts"))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -324,7 +386,7 @@ func (ce *CtrlEngine) contactBlock(id, contact string) error {
 		return err
 	}
 
-	// TODO: call mutecryptAddContact() like in addContact() ?
+	// TODO: call ce.mutecryptAddContact() like in addContact() ?
 	return add(ce.msgDB, idMapped, contactMapped, "", msgdb.BlackList)
 }
 
@@ -357,12 +419,50 @@ func (ce *CtrlEngine) contactUnblock(id, contact string) error {
 	return nil
 }
 
-func (ce *CtrlEngine) contactList(outfp io.Writer, id string) error {
+// contactList lists the white listed contacts of user ID id (only favorite
+// ones, if favorites is true) together with their verification state.
+func (ce *CtrlEngine) contactList(
+	c *cli.Context,
+	outfp, statfp io.Writer,
+	id string,
+	favorites bool,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	var contacts []string
+	if favorites {
+		contacts, err = ce.msgDB.GetFavorites(idMapped)
+	} else {
+		contacts, err = ce.msgDB.GetContacts(idMapped, false)
+	}
+	if err != nil {
+		return err
+	}
+	return ce.writeContacts(c, outfp, statfp, idMapped, contacts)
+}
+
+// contactFavorite marks contact of user ID id as favorite (or as normal
+// contact, if favorite is false).
+func (ce *CtrlEngine) contactFavorite(id, contact string, favorite bool) error {
 	idMapped, err := identity.Map(id)
 	if err != nil {
 		return err
 	}
-	return get(outfp, ce.msgDB, idMapped, false)
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	unmappedID, _, contactType, err := ce.msgDB.GetContact(idMapped,
+		contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" || contactType != msgdb.WhiteList {
+		return log.Errorf("ctrlengine: contact %s unknown", contact)
+	}
+	return ce.msgDB.SetFavorite(idMapped, contactMapped, favorite)
 }
 
 func (ce *CtrlEngine) contactBlacklist(outfp io.Writer, id string) error {
@@ -372,3 +472,124 @@ func (ce *CtrlEngine) contactBlacklist(outfp io.Writer, id string) error {
 	}
 	return get(outfp, ce.msgDB, idMapped, true)
 }
+
+// contactIdenticon writes the identicon of the signature key of contact in
+// the given format ("png" or "svg") and size to outfp. The identicon encodes
+// only a part of the SIGKEYHASH, therefore the full SIGKEYHASH is written to
+// statfp.
+func (ce *CtrlEngine) contactIdenticon(
+	c *cli.Context,
+	outfp, statfp io.Writer,
+	id, contact, format string,
+	size int,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	unmappedID, _, _, err := ce.msgDB.GetContact(idMapped, contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" {
+		return log.Errorf("ctrlengine: contact %s not found", contact)
+	}
+	sigKeyHash, err := ce.sigKeyHash(c, contactMapped)
+	if err != nil {
+		return err
+	}
+	ic, err := identicon.New(sigKeyHash)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(statfp, "SIGKEYHASH:\t%s\n", sigKeyHash)
+	if format == "svg" {
+		return ic.SVG(outfp, size)
+	}
+	return ic.PNG(outfp, size)
+}
+
+// contactBundleVersion is the current version of the contact bundle format.
+const contactBundleVersion = "1.0"
+
+// contactBundle is the public bundle format used to share contacts.
+type contactBundle struct {
+	VERSION    string          // bundle format version
+	IDENTITY   string          // mapped user ID of contact
+	UNMAPPEDID string          // unmapped user ID of contact
+	FULLNAME   string          // full name of contact
+	SIGKEYHASH string          // SIGKEYHASH of contact's UID message
+	UIDMESSAGE json.RawMessage // public UID message of contact
+}
+
+// contactShare writes the public bundle of the white listed contact of id to
+// the file out (which must not exist), ASCII armored if armored is true.
+func (ce *CtrlEngine) contactShare(
+	c *cli.Context,
+	id, contact, out string,
+	armored bool,
+	statfp io.Writer,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	unmappedID, fullName, contactType, err := ce.msgDB.GetContact(idMapped,
+		contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" {
+		return log.Errorf("ctrlengine: contact %s not found", contact)
+	}
+	if contactType != msgdb.WhiteList {
+		return log.Errorf("ctrlengine: contact %s is not white listed", contact)
+	}
+	// get public UID message and SIGKEYHASH
+	uidMsg, err := ce.mutecryptRun(c, "", ce.passphrase, "uid", "show",
+		"--id", contactMapped)
+	if err != nil {
+		return err
+	}
+	sigKeyHash, err := ce.mutecryptRun(c, "", ce.passphrase, "uid", "sigkeyhash",
+		"--id", contactMapped)
+	if err != nil {
+		return err
+	}
+	bundle := &contactBundle{
+		VERSION:    contactBundleVersion,
+		IDENTITY:   contactMapped,
+		UNMAPPEDID: unmappedID,
+		FULLNAME:   fullName,
+		SIGKEYHASH: strings.TrimSpace(string(sigKeyHash)),
+		UIDMESSAGE: json.RawMessage(bytes.TrimSpace(uidMsg)),
+	}
+	jsn, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return log.Error(err)
+	}
+	// write bundle (never overwrite existing files)
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	err = writeArtifact(f, armor.TypeContact, append(jsn, '\n'), armored)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("ctrlengine: contact %s written to %s", contactMapped, out)
+	fmt.Fprintf(statfp, "contact %s written to %s\n", contactMapped, out)
+	return nil
+}
@@ -6,9 +6,11 @@
 package ctrlengine
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -17,8 +19,8 @@ import (
 	"crypto/ed25519"
 
 	"github.com/frankbraun/codechain/util/bzero"
-	"github.com/frankbraun/codechain/util/home"
 	"github.com/mutecomm/mute/configclient"
+	"github.com/mutecomm/mute/cryptengine"
 	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/def/version"
 	"github.com/mutecomm/mute/encdb"
@@ -27,10 +29,15 @@ import (
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/release"
 	"github.com/mutecomm/mute/serviceguard/client"
-	"github.com/mutecomm/mute/serviceguard/client/trivial"
+	_ "github.com/mutecomm/mute/serviceguard/client/trivial" // default wallet backend
 	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/addressbook"
 	"github.com/mutecomm/mute/util/descriptors"
 	"github.com/mutecomm/mute/util/git"
+	"github.com/mutecomm/mute/util/home"
+	"github.com/mutecomm/mute/util/idle"
+	"github.com/mutecomm/mute/util/mailbox"
+	"github.com/mutecomm/mute/util/netproxy"
 	"github.com/peterh/liner"
 	"github.com/urfave/cli"
 )
@@ -54,15 +61,24 @@ var (
 
 // CtrlEngine abstracts a mutectrl command engine.
 type CtrlEngine struct {
-	prepared   bool
-	fileTable  *descriptors.Table
-	state      int
-	msgDB      *msgdb.MsgDB
-	passphrase []byte
-	client     *client.Client // service guard client
-	config     configclient.Config
-	app        *cli.App
-	err        error
+	prepared    bool
+	fileTable   *descriptors.Table
+	state       int
+	msgDB       *msgdb.MsgDB
+	passphrase  []byte
+	client      *client.Client // service guard client
+	config      configclient.Config
+	app         *cli.App
+	err         error
+	faults      FaultInjector            // for testing
+	profileName string                   // name of network profile
+	profile     *networkProfile          // active network profile
+	cryptEng    *cryptengine.CryptEngine // in-process crypt engine
+
+	passphraseScanner  *bufio.Scanner // reads passphrases from passphrase fd
+	passphraseFDClosed bool           // passphrase fd has been closed
+	preflightDone      bool           // external binaries have been checked
+	wentOnline         bool           // switched from --offline mode with 'online'
 }
 
 func (ce *CtrlEngine) translateError(err error) error {
@@ -97,8 +113,8 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 		if err := json.Unmarshal([]byte(jsn), &ce.config); err != nil {
 			return err
 		}
-		// apply old configuration
-		err := def.InitMute(&ce.config)
+		// apply old configuration (verified, with local overrides)
+		err := def.ApplyConfig(homedir, &ce.config)
 		if err != nil {
 			// init failed -> update config (which will try init again)
 			fmt.Fprintf(ce.fileTable.StatusFP,
@@ -112,6 +128,17 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 			if err != nil {
 				return err
 			}
+		} else if len(ce.config.Signature) == 0 && !offline {
+			// replace unsigned legacy config (applied with a warning)
+			fmt.Fprintf(ce.fileTable.StatusFP,
+				"unsigned legacy config, fetch signed config\n")
+			err := ce.upkeepFetchconf(ce.msgDB, homedir, false, nil,
+				ce.fileTable.StatusFP)
+			if err != nil {
+				log.Warnf("ctrlengine: cannot replace legacy config: %s", err)
+				fmt.Fprintf(ce.fileTable.StatusFP,
+					"cannot replace legacy config: %s\n", err)
+			}
 		} else {
 			// fetch new configuration, if last fetch is older than 24h
 			timestr, err := ce.msgDB.GetValue("time." + netDomain)
@@ -124,7 +151,7 @@ func (ce *CtrlEngine) getConfig(homedir string, offline bool) error {
 					return log.Error(err)
 				}
 				last := time.Now().Sub(time.Unix(t, 0))
-				if last > def.FetchconfMinDuration {
+				if last > ce.networkProfile().fetchconfPeriod {
 					if offline {
 						if last > def.FetchconfMaxDuration {
 							return log.Error("ctrlengine: configuration is " +
@@ -213,10 +240,20 @@ func startWallet(msgDB *msgdb.MsgDB, offline bool) (*client.Client, error) {
 	}
 
 	// create wallet
-	client, err := trivial.New(msgDB.DB(), walletKey, def.CACert)
+	client, err := client.NewBackend(def.WalletBackend, msgDB.DB(), walletKey,
+		def.CACert)
+	if err != nil {
+		return nil, err
+	}
+	storeKey, err := walletStoreKey(msgDB, false)
 	if err != nil {
 		return nil, err
 	}
+	if storeKey != nil {
+		if err := client.SetStoreKey(storeKey); err != nil {
+			return nil, log.Error(err)
+		}
+	}
 	if !offline {
 		client.GoOnline()
 		err = client.GetVerifyKeys()
@@ -240,11 +277,17 @@ func (ce *CtrlEngine) prepare(
 		}
 
 		// initialize logging framework
+		if err := home.SetLogOptions(c); err != nil {
+			return err
+		}
 		err = log.Init(c.GlobalString("loglevel"), "ctrl ",
 			c.GlobalString("logdir"), c.GlobalBool("logconsole"))
 		if err != nil {
 			return err
 		}
+		if ce.faults != nil {
+			log.Warn("ctrlengine: fault injection enabled")
+		}
 
 		// initialize file descriptors
 		ce.fileTable, err = descriptors.NewTable(c)
@@ -252,6 +295,12 @@ func (ce *CtrlEngine) prepare(
 			return err
 		}
 
+		// configure proxy given on the command line
+		err = netproxy.Apply(c.GlobalString("proxy"), c.GlobalString("proxy-domains"))
+		if err != nil {
+			return err
+		}
+
 		ce.prepared = true
 	}
 
@@ -260,7 +309,7 @@ func (ce *CtrlEngine) prepare(
 	// open MsgDB, if necessary
 	if openMsgDB {
 		homedir := c.GlobalString("homedir")
-		offline := c.GlobalBool("offline")
+		offline := ce.isOffline(c)
 
 		// open messsage DB, if necessary
 		if ce.msgDB == nil {
@@ -270,13 +319,28 @@ func (ce *CtrlEngine) prepare(
 			}
 		}
 
+		// load network profile
+		if err := ce.loadProfile(); err != nil {
+			return err
+		}
+
+		// load proxy configuration
+		if err := ce.loadProxy(c); err != nil {
+			return err
+		}
+
 		// get config
 		if err := ce.getConfig(homedir, offline); err != nil {
 			return err
 		}
 
+		// load additional service domains
+		if err := ce.loadDomains(); err != nil {
+			return err
+		}
+
 		// check for updates, if necessary
-		if checkUpdates {
+		if checkUpdates && ce.profile.checkUpdates {
 			if err := ce.checkUpdates(); err != nil {
 				return err
 			}
@@ -288,6 +352,9 @@ func (ce *CtrlEngine) prepare(
 		if err != nil {
 			return err
 		}
+		if err := ce.startReplenish(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -328,30 +395,33 @@ func (ce *CtrlEngine) loop(c *cli.Context) {
 	line = liner.NewLiner()
 	defer line.Close()
 	line.SetCtrlCAborts(true)
-	commands := buildCmdList(c.App.Commands, "")
-	line.SetCompleter(func(line string) (c []string) {
-		for _, command := range commands {
-			if strings.HasPrefix(command, line) {
-				c = append(c, command)
-			}
+
+	// lock databases after inactivity
+	statusfp := ce.fileTable.StatusFP
+	timeout := c.GlobalDuration("idle-lock")
+	idleLock := idle.New(timeout, func() {
+		if !ce.locked() {
+			ce.lock()
+			fmt.Fprintf(statusfp, "databases locked after %s of inactivity\n",
+				timeout)
 		}
-		return
 	})
+	defer idleLock.Stop()
+
+	line.SetCompleter(newCompleter(ce, c.App.Commands, idleLock).complete)
 
 	for {
-		active, err := ce.msgDB.GetValue(msgdb.ActiveUID)
+		idleLock.Begin()
+		err := ce.printActive(statusfp)
+		idleLock.End()
 		if err != nil {
 			util.Fatal(err)
 		}
-		if active == "" {
-			active = "none"
-		}
-		fmt.Fprintf(ce.fileTable.StatusFP, "active user ID: %s\n", active)
-		fmt.Fprintln(ce.fileTable.StatusFP, "READY.")
+		fmt.Fprintln(statusfp, "READY.")
 		ln, err := line.Prompt("")
 		if err != nil {
 			if err == liner.ErrPromptAborted {
-				fmt.Fprintf(ce.fileTable.StatusFP, "aborting...\n")
+				fmt.Fprintf(statusfp, "aborting...\n")
 			}
 			log.Info("ctrlengine: stopping (error)")
 			log.Error(err)
@@ -359,40 +429,82 @@ func (ce *CtrlEngine) loop(c *cli.Context) {
 		}
 		line.AppendHistory(ln)
 
-		args := []string{ce.app.Name}
 		if ln == "" {
 			log.Infof("read empty line")
 			continue
 		}
 		log.Infof("read: %s", ln)
-		// in the loop these global variables are reset, therefore we have to
-		// pass them in again
-		args = append(args,
-			"--homedir", c.GlobalString("homedir"),
-			"--logdir", c.GlobalString("logdir"),
-			"--loglevel", c.GlobalString("loglevel"),
-		)
-		args = append(args, strings.Fields(ln)...)
-		if err := ce.app.Run(args); err != nil {
-			// command execution failed -> issue status and continue
-			log.Infof("command execution failed (app): %s", err)
-			fmt.Fprintln(ce.fileTable.StatusFP, err)
-			continue
+		idleLock.Begin()
+		ln, err = ce.expandAlias(ln)
+		if err != nil {
+			idleLock.End()
+			util.Fatal(err)
 		}
-		if ce.err != nil {
-			if ce.err == errExit {
-				// exit requested -> return
-				log.Info("ctrlengine: stopping (exit requested)")
-				ce.err = nil
-				return
-			}
-			// command execution failed -> issue status and continue
-			fmt.Fprintln(ce.fileTable.StatusFP, ce.translateError(ce.err))
+		exit := ce.execute(c, ln)
+		idleLock.End()
+		if exit {
+			return
+		}
+	}
+}
+
+// printActive writes the active user ID to statusfp (if the databases are
+// not locked).
+func (ce *CtrlEngine) printActive(statusfp io.Writer) error {
+	if ce.msgDB == nil {
+		fmt.Fprintln(statusfp, "databases locked")
+		return nil
+	}
+	active, err := ce.msgDB.GetValue(msgdb.ActiveUID)
+	if err != nil {
+		return err
+	}
+	if active == "" {
+		active = "none"
+	}
+	fmt.Fprintf(statusfp, "active user ID: %s\n", active)
+	return nil
+}
+
+// execute executes the command line ln read in the loop. It returns true, if
+// an exit has been requested.
+func (ce *CtrlEngine) execute(c *cli.Context, ln string) bool {
+	if err := ce.app.Run(ce.commandArgs(c, ln)); err != nil {
+		// command execution failed -> issue status and continue
+		log.Infof("command execution failed (app): %s", err)
+		fmt.Fprintln(ce.fileTable.StatusFP, err)
+		return false
+	}
+	if ce.err != nil {
+		if ce.err == errExit {
+			// exit requested -> return
+			log.Info("ctrlengine: stopping (exit requested)")
 			ce.err = nil
-		} else {
-			log.Info("command successful")
+			return true
 		}
+		// command execution failed -> issue status and continue
+		fmt.Fprintln(ce.fileTable.StatusFP, ce.translateError(ce.err))
+		ce.err = nil
+	} else {
+		log.Info("command successful")
+	}
+	return false
+}
+
+// commandArgs returns the arguments to run the command line ln with.
+func (ce *CtrlEngine) commandArgs(c *cli.Context, ln string) []string {
+	args := []string{ce.app.Name}
+	// in the loop these global variables are reset, therefore we have to
+	// pass them in again
+	args = append(args,
+		"--homedir", c.GlobalString("homedir"),
+		"--logdir", c.GlobalString("logdir"),
+		"--loglevel", log.Level(),
+	)
+	if ce.isOffline(c) {
+		args = append(args, "--offline")
 	}
+	return append(args, strings.Fields(ln)...)
 }
 
 func (ce *CtrlEngine) getID(c *cli.Context) string {
@@ -407,16 +519,33 @@ func (ce *CtrlEngine) getID(c *cli.Context) string {
 	return id
 }
 
+// parseDelayArgs parses the options --mindelay and --maxdelay (duration
+// strings like "90s", "15m", or "2h", or plain seconds) and returns the
+// normalized delays in seconds.
+func parseDelayArgs(c *cli.Context) (minDelay, maxDelay int32, err error) {
+	minDelay, err = def.ParseDelay(c.String("mindelay"))
+	if err != nil {
+		return 0, 0, log.Errorf("--mindelay: %s", err)
+	}
+	maxDelay, err = def.ParseDelay(c.String("maxdelay"))
+	if err != nil {
+		return 0, 0, log.Errorf("--maxdelay: %s", err)
+	}
+	return minDelay, maxDelay, nil
+}
+
+// checkDelayArgs parses the options --mindelay and --maxdelay and validates
+// them against the limits of the client and the mixes (unless
+// --nodelaycheck is set). The mix limits are only known after the
+// configuration has been loaded (see prepare).
 func checkDelayArgs(c *cli.Context) error {
+	minDelay, maxDelay, err := parseDelayArgs(c)
+	if err != nil {
+		return err
+	}
 	if !c.Bool("nodelaycheck") {
-		if c.Int("mindelay") < def.MinMinDelay {
-			return log.Errorf("--mindelay must be at least %d", def.MinMinDelay)
-		}
-		if c.Int("maxdelay") < def.MinMaxDelay {
-			return log.Errorf("--maxdelay must be at least %d", def.MinMaxDelay)
-		}
-		if c.Int("mindelay") >= c.Int("maxdelay") {
-			return log.Error("--mindelay must be strictly smaller than --maxdelay")
+		if err := def.CheckDelays(minDelay, maxDelay); err != nil {
+			return log.Error(err)
 		}
 	}
 	return nil
@@ -430,10 +559,12 @@ func New() *CtrlEngine {
 	ce.app.Version = version.Number
 	ce.app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "homedir",
-			Value: defaultHomeDir,
-			Usage: "set home directory",
+			Name:   "homedir",
+			Value:  defaultHomeDir,
+			Usage:  "set home directory",
+			EnvVar: home.HomeDirEnv,
 		},
+		home.PortableFlag,
 		descriptors.InputFDFlag,
 		descriptors.OutputFDFlag,
 		descriptors.StatusFDFlag,
@@ -443,23 +574,63 @@ func New() *CtrlEngine {
 			Name:  "offline",
 			Usage: "use offline mode",
 		},
+		netproxy.ProxyFlag,
+		netproxy.ProxyDomainsFlag,
 		cli.StringFlag{
 			Name:  "loglevel",
 			Value: "info",
 			Usage: "logging level {trace, debug, info, warn, error, critical}",
 		},
 		cli.StringFlag{
-			Name:  "logdir",
-			Value: defaultLogDir,
-			Usage: "directory to log output",
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
 		},
 		cli.BoolFlag{
 			Name:  "logconsole",
 			Usage: "enable logging to console",
 		},
+		home.LogRotateFlag,
+		home.LogMaxSizeFlag,
+		home.LogRetainFlag,
+		home.LogUnsafeFlag,
+		cli.StringFlag{
+			Name:   "keyport",
+			Usage:  "alternative port for key servers (e.g., :8080)",
+			EnvVar: "MUTEKEYPORT",
+		},
+		cli.BoolFlag{
+			Name:   "subprocess",
+			Usage:  "execute mutecrypt and muteproto as subprocesses",
+			EnvVar: "MUTESUBPROCESS",
+		},
+		cli.DurationFlag{
+			Name:   "idle-lock",
+			Value:  defaultIdleLock,
+			Usage:  "lock databases after inactivity in interactive mode (0 disables)",
+			EnvVar: "MUTEIDLELOCK",
+		},
 	}
+	ce.app.Flags = append(ce.app.Flags, faultFlags...)
 	ce.app.Before = func(c *cli.Context) error {
-		return ce.prepare(c, false, false)
+		if err := home.ApplyDirs(c, ""); err != nil {
+			return err
+		}
+		if err := ce.setFaults(c); err != nil {
+			return err
+		}
+		if err := ce.prepare(c, false, false); err != nil {
+			return err
+		}
+		// check external binaries once before accepting commands
+		if subprocess(c) && !ce.preflightDone {
+			if err := preflight(c, ce.fileTable.StatusFP); err != nil {
+				return err
+			}
+			ce.preflightDone = true
+		}
+		return nil
 	}
 	ce.app.After = func(c *cli.Context) error {
 		// TODO: close all file descriptors?
@@ -491,15 +662,17 @@ func New() *CtrlEngine {
 		Name:  "host",
 		Usage: "alternative hostname",
 	}
-	mindelayFlag := cli.IntFlag{
+	mindelayFlag := cli.StringFlag{
 		Name:  "mindelay",
-		Value: int(def.MinDelay),
-		Usage: fmt.Sprintf("minimum delay for mix (min. %ds)", def.MinMinDelay),
+		Value: def.FormatDelay(def.MinDelay),
+		Usage: fmt.Sprintf("minimum delay for mix, e.g. 90s, 15m, or 2h (min. %s)",
+			def.FormatDelay(def.MinMinDelay)),
 	}
-	maxdelayFlag := cli.IntFlag{
+	maxdelayFlag := cli.StringFlag{
 		Name:  "maxdelay",
-		Value: int(def.MaxDelay),
-		Usage: fmt.Sprintf("maximum delay for mix (min. %ds)", def.MinMaxDelay),
+		Value: def.FormatDelay(def.MaxDelay),
+		Usage: fmt.Sprintf("maximum delay for mix, e.g. 90s, 15m, or 2h (min. %s)",
+			def.FormatDelay(def.MinMaxDelay)),
 	}
 	nodelaycheckFlag := cli.BoolFlag{
 		Name:  "nodelaycheck",
@@ -509,6 +682,10 @@ func New() *CtrlEngine {
 		Name:  "msgnum",
 		Usage: "message ID to process",
 	}
+	armorFlag := cli.BoolFlag{
+		Name:  "armor",
+		Usage: "write ASCII armored output (survives copy-paste through email and chat)",
+	}
 	ce.app.Commands = []cli.Command{
 		{
 			Name:  "app",
@@ -546,8 +723,16 @@ func New() *CtrlEngine {
 					Flags: []cli.Flag{
 						cli.IntFlag{
 							Name:  "iterations",
-							Value: encdb.KDFIterations,
-							Usage: "number of KDF iterations used for DB creation",
+							Usage: "number of KDF iterations used for DB creation (0: calibrate)",
+						},
+						cli.DurationFlag{
+							Name:  "unlock-time",
+							Value: encdb.DefaultUnlockTime,
+							Usage: "unlock time the KDF iterations are calibrated for",
+						},
+						cli.BoolFlag{
+							Name:  "weak-passphrase",
+							Usage: "allow passphrase which is estimated to be weak",
 						},
 						cli.StringFlag{
 							Name:  "walletkey",
@@ -585,6 +770,140 @@ func New() *CtrlEngine {
 						ce.err = ce.dbRekey(ce.fileTable.StatusFP, c)
 					},
 				},
+				{
+					Name:  "lockout",
+					Usage: "Show failed unlock attempts and set lockout",
+					Description: `
+Every failed attempt to unlock the databases is counted. After three failures
+further attempts are delayed exponentially. With --max-failures the key files
+of the databases are destroyed after that many consecutive failures (panic
+lockout), afterwards they can only be restored from a backup.
+`,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "max-failures",
+							Usage: "destroy key files after that many failed unlock attempts (0 disables)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						// changing the lockout requires the passphrase
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbLockout(ce.fileTable.OutputFP, c)
+					},
+				},
+				{
+					Name:  "addkeyfile",
+					Usage: "Require keyfile (or secret from keychain/TPM) to unlock databases",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "keyfile",
+							Usage: "keyfile to unlock databases with",
+						},
+						cli.StringFlag{
+							Name:  "command",
+							Usage: "command which prints secret to unlock databases with (e.g., 'secret-tool lookup app mute' or 'tpm2_unseal -c mute.ctx')",
+						},
+						cli.BoolFlag{
+							Name:  "generate",
+							Usage: "generate new keyfile with random secret",
+						},
+						cli.BoolFlag{
+							Name:  "keyfile-only",
+							Usage: "do not require passphrase in addition to keyfile",
+						},
+						cli.IntFlag{
+							Name:  "iterations",
+							Value: encdb.KDFIterations,
+							Usage: "number of KDF iterations used for DB rekeying",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if c.String("keyfile") == "" && c.String("command") == "" {
+							return log.Error("option --keyfile or --command is mandatory")
+						}
+						return ce.prepare(c, false, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbAddKeyfile(ce.fileTable.StatusFP, c)
+					},
+				},
+				{
+					Name:  "removekeyfile",
+					Usage: "Unlock databases with new passphrase alone",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "iterations",
+							Value: encdb.KDFIterations,
+							Usage: "number of KDF iterations used for DB rekeying",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbRemoveKeyfile(ce.fileTable.StatusFP, c)
+					},
+				},
+				{
+					Name:  "backup",
+					Usage: "Backup databases to passphrase-protected archive",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "archive file to write (must not exist)",
+						},
+						cli.IntFlag{
+							Name:  "iterations",
+							Value: encdb.KDFIterations,
+							Usage: "number of KDF iterations used for archive encryption",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("out") {
+							return log.Error("option --out is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbBackup(c, ce.fileTable.StatusFP, c.String("out"))
+					},
+				},
+				{
+					Name:  "restore",
+					Usage: "Restore databases from passphrase-protected archive",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "in",
+							Usage: "archive file to read",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("in") {
+							return log.Error("option --in is mandatory")
+						}
+						return ce.prepare(c, false, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.dbRestore(c, ce.fileTable.StatusFP, c.String("in"))
+					},
+				},
 				/*
 					{
 						Name:  "status",
@@ -665,88 +984,266 @@ func New() *CtrlEngine {
 						ce.err = ce.dbVersion(c, ce.fileTable.OutputFP)
 					},
 				},
-			},
-		},
-		{
-			Name:  "uid",
-			Usage: "Commands for user IDs",
-			Subcommands: []cli.Command{
 				{
-					Name:  "new",
-					Usage: "register a new user ID",
-					Description: `
-Tries to register a new user ID with the corresponding key server.
-`,
-					Flags: []cli.Flag{
-						idFlag,
-						fullNameFlag,
-						hostFlag,
-						mindelayFlag,
-						maxdelayFlag,
-						nodelaycheckFlag,
-					},
+					Name:  "schema",
+					Usage: "Show DB schemas and versions",
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						if !c.IsSet("id") {
-							return log.Error("option --id is mandatory")
-						}
-						if err := checkDelayArgs(c); err != nil {
-							return err
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
 						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.uidNew(c, int32(c.Int("mindelay")),
-							int32(c.Int("maxdelay")), c.String("host"))
+						ce.err = ce.dbSchema(c, ce.fileTable.OutputFP)
 					},
 				},
 				{
-					Name:  "edit",
-					Usage: "edit an existing user ID",
+					Name:  "sql",
+					Usage: "Open read-only SQL prompt (for support engineers only!)",
+					Description: `
+Opens a read-only SQL prompt against the decrypted MsgDB (or KeyDB, if --keydb
+is given). Queries are read line by line. The output contains private messages
+and secret key material, never share it with anybody you do not fully trust!
+Only read-only access is supported and option --readonly is mandatory.
+`,
 					Flags: []cli.Flag{
-						idFlag,
-						fullNameFlag,
+						cli.BoolFlag{
+							Name:  "readonly",
+							Usage: "acknowledge read-only access (mandatory)",
+						},
+						cli.BoolFlag{
+							Name:  "keydb",
+							Usage: "query KeyDB instead of MsgDB",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
 						}
-						if !c.IsSet("id") {
-							return log.Error("option --id is mandatory")
+						if !c.Bool("readonly") {
+							return log.Error("option --readonly is mandatory")
 						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.uidEdit(c.String("id"), c.String("full-name"))
+						ce.err = ce.dbSQL(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, c.Bool("keydb"), line,
+							ce.fileTable.InputFP)
 					},
 				},
-				{
-					Name:  "active",
-					Usage: "show active user ID",
-					Before: func(c *cli.Context) error {
-						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						return ce.prepare(c, true, true)
-					},
-					Action: func(c *cli.Context) {
-						ce.err = ce.uidActive(c, ce.fileTable.OutputFD,
-							ce.fileTable.OutputFP)
-					},
+			},
+		},
+		{
+			Name:  "migrate-legacy",
+			Usage: "Migrate home directory of legacy Mute version",
+			Description: `
+Detects the database versions of the legacy home directory given with --from,
+copies the databases and config files to the home directory (if it differs),
+upgrades the database schemas, and converts the configuration. The legacy
+home directory is left untouched (unless it is the home directory itself).
+A report of all migration steps is written to output-fd.
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "legacy home directory",
 				},
-				{
-					Name:  "switch",
-					Usage: "switch active user ID",
-					Flags: []cli.Flag{
-						idFlag,
-					},
-					Before: func(c *cli.Context) error {
-						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						if !c.IsSet("id") {
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("from") {
+					return log.Error("option --from is mandatory")
+				}
+				return ce.prepare(c, false, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = ce.migrateLegacy(c, ce.fileTable.OutputFP,
+					ce.fileTable.StatusFP, c.String("from"))
+			},
+		},
+		{
+			Name:  "armor",
+			Usage: "ASCII armor artifact read from stdin",
+			Description: `
+Reads an artifact (contact bundle, detached signature, sync bundle, token
+transfer, or transcript) from stdin and writes it ASCII armored to stdout.
+Armored artifacts survive copy-paste through email and chat and are accepted
+by all commands which read artifacts.
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type",
+					Usage: "artifact type (contact, signature, sync, token, or transcript)",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !c.IsSet("type") {
+					return log.Error("option --type is mandatory")
+				}
+				return ce.prepare(c, false, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = armorArtifact(ce.fileTable.OutputFP,
+					ce.fileTable.InputFP, c.String("type"))
+			},
+		},
+		{
+			Name:  "dearmor",
+			Usage: "remove ASCII armor from artifact read from stdin",
+			Description: `
+Reads an ASCII armored artifact from stdin, verifies its checksum, and writes
+the unarmored artifact to stdout. Text before and after the armored artifact
+is ignored.
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type",
+					Usage: "expected artifact type (default: any)",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				return ce.prepare(c, false, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = dearmorArtifact(ce.fileTable.OutputFP,
+					ce.fileTable.InputFP, c.String("type"))
+			},
+		},
+		{
+			Name:  "uid",
+			Usage: "Commands for user IDs",
+			Subcommands: []cli.Command{
+				{
+					Name:  "new",
+					Usage: "register a new user ID",
+					Description: `
+Tries to register a new user ID with the corresponding key server.
+
+If the key server or the account server requires an invitation code and none
+is given with --invitation, the code is read from the input file descriptor.
+
+By default the user ID is valid for one year and renewed with every update.
+With --valid-from or --valid-for the user ID gets a fixed validity period (at
+least one day) which is not renewed, e.g., for short-lived user IDs.
+
+With --sigescrow the user ID contains an escrow key which allows to recover the
+user ID, if its keys are lost. Export it with 'mutecrypt uid escrow export'.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						fullNameFlag,
+						hostFlag,
+						mindelayFlag,
+						maxdelayFlag,
+						nodelaycheckFlag,
+						cli.StringFlag{
+							Name:  "invitation",
+							Usage: "invitation code (if required by the servers)",
+						},
+						cli.StringFlag{
+							Name:  "valid-from",
+							Usage: "start of fixed validity period (RFC 3339, default: now)",
+						},
+						cli.DurationFlag{
+							Name:  "valid-for",
+							Usage: "duration of fixed validity period (default: 8760h)",
+						},
+						cli.BoolFlag{
+							Name:  "sigescrow",
+							Usage: "include escrow key to recover user ID (see 'mutecrypt uid escrow')",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if err := ce.prepare(c, true, true); err != nil {
+							return err
+						}
+						return checkDelayArgs(c)
+					},
+					Action: func(c *cli.Context) {
+						minDelay, maxDelay, err := parseDelayArgs(c)
+						if err != nil {
+							ce.err = err
+							return
+						}
+						ce.err = ce.uidNew(c, minDelay, maxDelay, c.String("host"),
+							c.String("valid-from"), c.Duration("valid-for"))
+					},
+				},
+				{
+					Name:  "edit",
+					Usage: "edit an existing user ID",
+					Description: `
+Edit the full name of an existing user ID or its signature. The signature is
+read from the file given with --signature-file and appended to every new
+message added with 'msg add' (unless --no-signature is given), separated by
+the usual "-- " line.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						fullNameFlag,
+						cli.StringFlag{
+							Name:  "signature-file",
+							Usage: "read signature for new messages from file",
+						},
+						cli.BoolFlag{
+							Name:  "remove-signature",
+							Usage: "remove signature",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.uidEdit(c, c.String("id"))
+					},
+				},
+				{
+					Name:  "active",
+					Usage: "show active user ID",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.uidActive(c, ce.fileTable.OutputFD,
+							ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "switch",
+					Usage: "switch active user ID",
+					Flags: []cli.Flag{
+						idFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
 						return ce.prepare(c, true, true)
@@ -758,12 +1255,23 @@ Tries to register a new user ID with the corresponding key server.
 				{
 					Name:  "delete",
 					Usage: "delete own user ID",
+					Description: `
+Deletes a user ID and all its contacts and messages. Before the local deletion
+a tombstone (the final update of the user ID) is registered with the key
+server, so that searches reveal that the user ID has been retired. With
+--local only the local state is removed.
+`,
 					Flags: []cli.Flag{
 						idFlag,
+						hostFlag,
 						cli.BoolFlag{
 							Name:  "force",
 							Usage: "force deletion (do not prompt)",
 						},
+						cli.BoolFlag{
+							Name:  "local",
+							Usage: "only delete locally (no tombstone on key server)",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -775,8 +1283,8 @@ Tries to register a new user ID with the corresponding key server.
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.uidDelete(c, c.String("id"), c.Bool("force"),
-							ce.fileTable.StatusFP)
+						ce.err = ce.uidDelete(c, c.String("id"), c.String("host"),
+							c.Bool("force"), c.Bool("local"), ce.fileTable.StatusFP)
 					},
 				},
 				{
@@ -825,13 +1333,99 @@ Tries to register a new user ID with the corresponding key server.
 							msgdb.WhiteList, c)
 					},
 				},
+				{
+					Name:  "import",
+					Usage: "import contacts from address book (vCard or CSV)",
+					Description: `
+Imports the contacts of an address book exported by another application as
+vCard or CSV file (with a header line naming the columns) to the white list of
+a user ID. Every email address which is a Mute identity (the key lookup
+succeeds) becomes a contact with the full name of the address book entry.
+Known contacts and duplicates are skipped.
+
+With --dry-run the contacts which would be imported are only listed (without
+key lookups).
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "format",
+							Value: addressbook.FormatVCard,
+							Usage: "address book format {vcard, csv}",
+						},
+						cli.StringFlag{
+							Name:  "input",
+							Usage: "address book file",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only list contacts which would be imported",
+						},
+						hostFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("input") {
+							return log.Error("option --input is mandatory")
+						}
+						switch c.String("format") {
+						case addressbook.FormatVCard, addressbook.FormatCSV:
+						default:
+							return log.Errorf("unknown address book format '%s'", c.String("format"))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.contactImport(ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, c, ce.getID(c),
+							c.String("format"), c.String("input"),
+							c.String("host"), c.Bool("dry-run"))
+					},
+				},
 				{
 					Name:  "edit",
 					Usage: "edit contact entry of active user ID",
+					Description: `
+Edits the full name, the delivery delay bounds, and the receipt setting of a
+contact. The delay bounds are used as default delays for messages to the
+contact and for the nymaddresses the contact uses to reply. Without delay
+bounds (or after --reset-delays) the delays of the account apply.
+
+With --receipts delivery and read receipts are exchanged with the contact:
+receipts for messages from the contact are sent back automatically (with
+'msg send') and receipts from the contact are shown by 'msg list'. Receipts are
+disabled by default, they reveal when messages are fetched and read.
+`,
 					Flags: []cli.Flag{
 						idFlag,
 						contactFlag,
 						fullNameFlag,
+						cli.StringFlag{
+							Name:  "mindelay",
+							Usage: "minimum delay for contact, e.g. 90s, 15m, or 2h",
+						},
+						cli.StringFlag{
+							Name:  "maxdelay",
+							Usage: "maximum delay for contact, e.g. 90s, 15m, or 2h",
+						},
+						cli.BoolFlag{
+							Name:  "reset-delays",
+							Usage: "reset delay bounds of contact to account defaults",
+						},
+						cli.BoolFlag{
+							Name:  "receipts",
+							Usage: "exchange delivery and read receipts with contact",
+						},
+						cli.BoolFlag{
+							Name:  "no-receipts",
+							Usage: "do not exchange receipts with contact (default)",
+						},
+						nodelaycheckFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -846,8 +1440,8 @@ Tries to register a new user ID with the corresponding key server.
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.contactEdit(ce.getID(c),
-							c.String("contact"), c.String("full-name"))
+						ce.err = ce.contactEdit(c, ce.getID(c),
+							c.String("contact"))
 					},
 				},
 				{
@@ -927,6 +1521,35 @@ Tries to register a new user ID with the corresponding key server.
 					Usage: "list contacts for active user ID (white list)",
 					Flags: []cli.Flag{
 						idFlag,
+						cli.BoolFlag{
+							Name:  "favorites",
+							Usage: "list only favorite contacts",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.contactList(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, ce.getID(c), c.Bool("favorites"))
+					},
+				},
+				{
+					Name:  "favorite",
+					Usage: "mark contact of active user ID as favorite",
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "unmark contact as favorite",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -935,10 +1558,14 @@ Tries to register a new user ID with the corresponding key server.
 						if !interactive && !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.contactList(ce.fileTable.OutputFP, ce.getID(c))
+						ce.err = ce.contactFavorite(ce.getID(c),
+							c.String("contact"), !c.Bool("remove"))
 					},
 				},
 				{
@@ -961,79 +1588,254 @@ Tries to register a new user ID with the corresponding key server.
 							ce.getID(c))
 					},
 				},
-			},
-		},
-		{
-			Name:  "msg",
-			Usage: "Commands for message processing",
-			Subcommands: []cli.Command{
 				{
-					Name:  "add",
-					Usage: "add a new message to outqueue",
+					Name:  "verify",
+					Usage: "verify contact's signature key out-of-band",
 					Description: `
-Add a new message to outqueue.
-If option --mail-input is set the input is parsed as an email message and the
-'To' field is used as recipient and the optional 'Subject' combined with the
-email body as the actual message.
+Shows the fingerprints of the signature keys (SIGKEYHASH) of the contact and
+the active user ID, and a short authentication string (SAS) derived from both.
+Compare the SAS (or the contact's fingerprint) with the contact over a trusted
+channel, e.g., in person or on the phone, and mark the contact as verified with
+--mark. Alternatively, the contact can show the printed URI as QR code, which
+is compared automatically with --uri.
+
+Verified contacts are annotated in 'contact list'. If the key of a verified
+contact changes, a warning is shown and the contact has to be verified again.
 `,
 					Flags: []cli.Flag{
-						cli.StringFlag{
-							Name:  "from, id",
-							Usage: "user ID to send message from",
+						idFlag,
+						contactFlag,
+						cli.BoolFlag{
+							Name:  "mark",
+							Usage: "mark contact as verified",
 						},
-						cli.StringFlag{
-							Name:  "to",
-							Usage: "user ID to send message to",
+						cli.BoolFlag{
+							Name:  "unmark",
+							Usage: "mark contact as unverified",
 						},
 						cli.StringFlag{
-							Name:  "file",
-							Usage: "read message from file",
+							Name:  "uri",
+							Usage: "verification URI scanned from contact",
 						},
-						cli.BoolFlag{
-							Name:  "mail-input",
-							Usage: "treat input as email message",
-						},
-						// TODO: implement options
-						/*
-							cli.StringSliceFlag{
-								Name:  "attach",
-								Usage: "file to append as attachment",
-							},
-							cli.BoolFlag{
-								Name:  "permanent-signature",
-								Usage: "add permanent sign. to message",
-							},
-						*/
-						mindelayFlag,
-						maxdelayFlag,
-						nodelaycheckFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s",
-								strings.Join(c.Args(), " "))
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
 						}
-						if !interactive && !c.IsSet("from") {
-							return log.Error("option --from is mandatory")
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
 						}
-						if !c.IsSet("mail-input") && !c.IsSet("to") {
-							return log.Error("option --to is mandatory")
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
 						}
-						if c.IsSet("mail-input") && c.IsSet("to") {
-							return log.Error("options --to and --mail-input exclude each other")
+						if c.Bool("unmark") && (c.Bool("mark") || c.IsSet("uri")) {
+							return log.Error("option --unmark cannot be combined with --mark or --uri")
 						}
-						if err := checkDelayArgs(c); err != nil {
-							return err
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.contactVerify(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, ce.getID(c), c.String("contact"),
+							c.String("uri"), c.Bool("mark"), c.Bool("unmark"))
+					},
+				},
+				{
+					Name:  "identicon",
+					Usage: "write identicon of contact's signature key to output-fd",
+					Description: `
+Writes the identicon of the contact's signature key to output-fd and the full
+SIGKEYHASH to status-fd. The identicon encodes only 39 bits of the SIGKEYHASH,
+it is a visual aid and does not replace comparing the full SIGKEYHASH.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						cli.StringFlag{
+							Name:  "format",
+							Value: "png",
+							Usage: "image format {png, svg}",
+						},
+						cli.IntFlag{
+							Name:  "size",
+							Value: 120,
+							Usage: "image size in pixels",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						if c.String("format") != "png" && c.String("format") != "svg" {
+							return log.Errorf("unknown format '%s'", c.String("format"))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.contactIdenticon(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, ce.getID(c), c.String("contact"),
+							c.String("format"), c.Int("size"))
+					},
+				},
+				{
+					Name:  "share",
+					Usage: "export contact to share it with another user",
+					Description: `
+Export a single (white listed) contact as a public bundle which contains the
+contact's user ID, full name, SIGKEYHASH, and public UID message. The receiver
+can compare the SIGKEYHASH (or the identicon) after adding the contact instead
+of verifying it again. Existing files are not overwritten.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "file to write contact bundle to",
+						},
+						armorFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						if !c.IsSet("out") {
+							return log.Error("option --out is mandatory")
 						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgAdd(c, ce.getID(c), c.String("to"),
-							c.String("file"), c.Bool("mail-input"),
+						ce.err = ce.contactShare(c, ce.getID(c),
+							c.String("contact"), c.String("out"),
+							c.Bool("armor"), ce.fileTable.StatusFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "msg",
+			Usage: "Commands for message processing",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "add a new message to outqueue",
+					Description: `
+Add a new message to outqueue.
+The options --to and --cc can be given multiple times. Every recipient gets
+its own copy of the message which is encrypted and delivered separately, the
+delivery status per recipient is shown by 'msg recipients'. Unset delays are
+taken from the first --to contact.
+If option --mail-input is set the input is parsed as an email message and the
+'To' field is used as recipient and the optional 'Subject' combined with the
+email body as the actual message.
+In interactive mode the message is composed with the editor given by $VISUAL
+or $EDITOR (if set), the first line is the subject.
+With --send-after the message is not sent before the given time (RFC 3339 or
+a duration from now, like 2h30m), 'msg send' and the daemon skip it until
+then. This allows to batch deliveries into specific time windows.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "from, id",
+							Usage: "user ID to send message from",
+						},
+						cli.StringSliceFlag{
+							Name:  "to",
+							Usage: "user ID to send message to ('To:' recipient)",
+						},
+						cli.StringSliceFlag{
+							Name:  "cc",
+							Usage: "user ID to send a copy of the message to ('Cc:' recipient)",
+						},
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "read message from file",
+						},
+						cli.BoolFlag{
+							Name:  "mail-input",
+							Usage: "treat input as email message",
+						},
+						cli.IntFlag{
+							Name:  "reply-to",
+							Usage: "message ID (msgnum) of the message to reply to",
+						},
+						cli.StringSliceFlag{
+							Name:  "attach",
+							Usage: "file to append as attachment",
+						},
+						// TODO: implement options
+						/*
+							cli.BoolFlag{
+								Name:  "permanent-signature",
+								Usage: "add permanent sign. to message",
+							},
+						*/
+						mindelayFlag,
+						maxdelayFlag,
+						nodelaycheckFlag,
+						cli.StringFlag{
+							Name:  "send-after",
+							Usage: "do not send message before time (RFC 3339 or duration)",
+						},
+						cli.BoolFlag{
+							Name:  "no-signature",
+							Usage: "do not append signature of user ID (see 'uid edit')",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("from") {
+							return log.Error("option --from is mandatory")
+						}
+						if !c.IsSet("mail-input") && !c.IsSet("to") {
+							return log.Error("option --to is mandatory")
+						}
+						if c.IsSet("mail-input") && (c.IsSet("to") || c.IsSet("cc")) {
+							return log.Error("options --to/--cc and --mail-input exclude each other")
+						}
+						if err := ce.prepare(c, true, true); err != nil {
+							return err
+						}
+						return checkDelayArgs(c)
+					},
+					Action: func(c *cli.Context) {
+						minDelay, maxDelay, err := parseDelayArgs(c)
+						if err != nil {
+							ce.err = err
+							return
+						}
+						// unset delays are taken from the contact
+						if !c.IsSet("mindelay") {
+							minDelay = 0
+						}
+						if !c.IsSet("maxdelay") {
+							maxDelay = 0
+						}
+						sendAfter, err := parseSendAfter(c.String("send-after"))
+						if err != nil {
+							ce.err = err
+							return
+						}
+						ce.err = ce.msgAdd(c, ce.getID(c), c.StringSlice("to"),
+							c.StringSlice("cc"), c.String("file"), c.Bool("mail-input"),
 							c.Bool("permanent-signature"),
-							c.StringSlice("attach"),
-							int32(c.Int("mindelay")), int32(c.Int("maxdelay")),
-							line, ce.fileTable.InputFP)
+							c.StringSlice("attach"), int64(c.Int("reply-to")),
+							minDelay, maxDelay, sendAfter, c.Bool("no-signature"), line,
+							ce.fileTable.InputFP)
 					},
 				},
 				{
@@ -1057,8 +1859,36 @@ email body as the actual message.
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgSend(c, ce.getID(c), c.Bool("all"),
-							c.Bool("fail-delivery"))
+						if c.Bool("fail-delivery") {
+							defer ce.failDelivery()()
+						}
+						ce.err = ce.msgSend(c, ce.getID(c), c.Bool("all"))
+					},
+				},
+				{
+					Name:  "estimate",
+					Usage: "estimate tokens needed to send pending messages",
+					Description: `
+Shows the number of pending messages, the number of message tokens needed to
+send them, and the message tokens available in the local wallet. The cached
+price list of the service guard operator is shown as well.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						allFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("all") && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgEstimate(ce.fileTable.OutputFP, ce.getID(c),
+							c.Bool("all"))
 					},
 				},
 				{
@@ -1086,8 +1916,169 @@ email body as the actual message.
 				{
 					Name:  "list",
 					Usage: "list messages",
+					Description: `
+Lists messages, one per line, prefixed by direction ('>' incoming, '<'
+outgoing) and status. Incoming: N (new), R (read). Outgoing: P (pending),
+L (pending, scheduled for later with 'msg add --send-after'), S (sent),
+D (delivered), R (read), the latter two only for contacts receipts are
+exchanged with (see 'contact edit --receipts').
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.BoolFlag{
+							Name:  "starred",
+							Usage: "list only starred messages",
+						},
+						cli.StringFlag{
+							Name:  "from",
+							Usage: "list only messages from sender",
+						},
+						cli.StringFlag{
+							Name:  "since",
+							Usage: "list only messages since date (YYYY-MM-DD or RFC 3339)",
+						},
+						cli.StringFlag{
+							Name:  "subject",
+							Usage: "list only messages with subject containing string",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgList(ce.fileTable.OutputFP, ce.getID(c),
+							c.Bool("starred"), c.String("from"), c.String("since"),
+							c.String("subject"))
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "export messages to mailbox (mbox or Maildir)",
+					Description: `
+Exports the messages of a user ID which match the filters (see 'msg list') to
+a standard mailbox in the output directory: the mbox file <id>.mbox or the
+Maildir <id>. Existing mailboxes are not overwritten. The exported messages
+are not marked as read.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "format",
+							Value: mailbox.FormatMbox,
+							Usage: "mailbox format {mbox, maildir}",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "output directory",
+						},
+						cli.BoolFlag{
+							Name:  "starred",
+							Usage: "export only starred messages",
+						},
+						cli.StringFlag{
+							Name:  "from",
+							Usage: "export only messages from sender",
+						},
+						cli.StringFlag{
+							Name:  "since",
+							Usage: "export only messages since date (YYYY-MM-DD or RFC 3339)",
+						},
+						cli.StringFlag{
+							Name:  "subject",
+							Usage: "export only messages with subject containing string",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("output") {
+							return log.Error("option --output is mandatory")
+						}
+						switch c.String("format") {
+						case mailbox.FormatMbox, mailbox.FormatMaildir:
+						default:
+							return log.Errorf("unknown mailbox format '%s'", c.String("format"))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgExport(ce.fileTable.StatusFP, ce.getID(c),
+							c.String("format"), c.String("output"),
+							c.Bool("starred"), c.String("from"), c.String("since"),
+							c.String("subject"))
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "import messages from mailbox (mbox, Maildir, or EML)",
+					Description: `
+Imports the messages of a mailbox (an mbox file, a Maildir, or a single EML
+file or a directory of *.eml files) into a user ID. Messages from the user ID
+are imported as sent messages (they are not sent again), all other messages as
+received messages. The sender (or a recipient of sent messages) must be a Mute
+identity, unknown senders are added as contacts (after a key lookup). Messages
+which have been imported before (same Message-ID) are skipped.
+
+With --dry-run the messages which would be imported are only listed (without
+key lookups).
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "format",
+							Value: mailbox.FormatMbox,
+							Usage: "mailbox format {mbox, maildir, eml}",
+						},
+						cli.StringFlag{
+							Name:  "input",
+							Usage: "mailbox file or directory",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only list messages which would be imported",
+						},
+						hostFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("input") {
+							return log.Error("option --input is mandatory")
+						}
+						switch c.String("format") {
+						case mailbox.FormatMbox, mailbox.FormatMaildir, mailbox.FormatEML:
+						default:
+							return log.Errorf("unknown mailbox format '%s'", c.String("format"))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgImport(ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, c, ce.getID(c),
+							c.String("format"), c.String("input"),
+							c.String("host"), c.Bool("dry-run"))
+					},
+				},
+				{
+					Name:  "read",
+					Usage: "read message",
 					Flags: []cli.Flag{
 						idFlag,
+						msgNumFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
@@ -1096,77 +2087,1649 @@ email body as the actual message.
 						if !interactive && !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
-						return ce.prepare(c, true, true)
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgRead(ce.fileTable.OutputFP, ce.getID(c),
+							int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "recipients",
+					Usage: "show delivery status per recipient of sent message",
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgRecipients(ce.fileTable.OutputFP,
+							ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "star",
+					Usage: "star message",
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgStar(ce.getID(c), int64(c.Int("msgnum")), true)
+					},
+				},
+				{
+					Name:  "unstar",
+					Usage: "remove star from message",
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgStar(ce.getID(c), int64(c.Int("msgnum")), false)
+					},
+				},
+				{
+					Name:  "thread",
+					Usage: "list conversation a message belongs to",
+					Description: `
+Lists all messages of the conversation the given message belongs to in
+chronological order. Conversations are determined by the 'In-Reply-To'
+references of the messages (see 'msg add --reply-to').
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgThread(ce.fileTable.OutputFP, ce.getID(c),
+							int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "attachments",
+					Usage: "Commands for message attachments",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list attachments of message",
+							Flags: []cli.Flag{
+								idFlag,
+								msgNumFlag,
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !interactive && !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								if !c.IsSet("msgnum") {
+									return log.Error("option --msgnum is mandatory")
+								}
+								return ce.prepare(c, true, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.msgAttachmentsList(ce.fileTable.OutputFP,
+									ce.getID(c), int64(c.Int("msgnum")))
+							},
+						},
+						{
+							Name:  "extract",
+							Usage: "save attachments of message to disk",
+							Description: `
+Saves the attachments of the given message in the directory --dir (all
+attachments, if --attachid is not set). Existing files are never overwritten.
+`,
+							Flags: []cli.Flag{
+								idFlag,
+								msgNumFlag,
+								cli.IntFlag{
+									Name:  "attachid",
+									Usage: "ID of attachment to save (see 'msg attachments list')",
+								},
+								cli.StringFlag{
+									Name:  "dir",
+									Value: ".",
+									Usage: "directory to save attachments in",
+								},
+							},
+							Before: func(c *cli.Context) error {
+								if len(c.Args()) > 0 {
+									return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+								}
+								if !interactive && !c.IsSet("id") {
+									return log.Error("option --id is mandatory")
+								}
+								if !c.IsSet("msgnum") {
+									return log.Error("option --msgnum is mandatory")
+								}
+								return ce.prepare(c, true, true)
+							},
+							Action: func(c *cli.Context) {
+								ce.err = ce.msgAttachmentsExtract(ce.getID(c),
+									int64(c.Int("msgnum")), int64(c.Int("attachid")),
+									c.String("dir"))
+							},
+						},
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "delete a message",
+					Description: `
+Deletes a message.					
+A deleted message is permanently gone. Handle with care!
+					`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgDelete(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "export-transcript",
+					Usage: "export signed transcript of conversation with contact",
+					Description: `
+Writes a signed and timestamped transcript of the conversation with the given
+contact (messages, signature verification results, and the key history of
+both parties) as JSON to stdout. The transcript is signed with the current
+signature key of the user ID and can be verified with
+'msg verify-transcript'.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						armorFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgExportTranscript(c, ce.fileTable.OutputFP,
+							ce.getID(c), c.String("contact"), c.Bool("armor"))
+					},
+				},
+				{
+					Name:  "verify-transcript",
+					Usage: "verify (optionally armored) transcript read from stdin",
+					Description: `
+Verifies the signature of the transcript read from stdin and checks the key
+history of both parties against the local copy of the key server hash chain.
+The UID messages of exporter and contact must have been looked up before
+(e.g., with 'contact add'). The creation time is claimed by the exporter.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.msgVerifyTranscript(c, ce.fileTable.OutputFP,
+							ce.fileTable.InputFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "note",
+			Usage: "Commands for private notes on contacts and messages",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "attach note to contact or message",
+					Description: `
+Attaches a private note to a contact (--contact) or message (--msgnum).
+Notes are only stored in the local encrypted database and never transmitted.
+If --note is not given, the note is read from stdin (or the terminal).
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						msgNumFlag,
+						cli.StringFlag{
+							Name:  "note",
+							Usage: "the note to attach",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if c.IsSet("contact") == c.IsSet("msgnum") {
+							return log.Error("either option --contact or --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.noteAdd(ce.getID(c), c.String("contact"),
+							int64(c.Int("msgnum")), c.String("note"), line,
+							ce.fileTable.InputFP)
+					},
+				},
+				{
+					Name:  "show",
+					Usage: "show notes of contact or message",
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if c.IsSet("contact") == c.IsSet("msgnum") {
+							return log.Error("either option --contact or --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.noteShow(ce.fileTable.OutputFP, ce.getID(c),
+							c.String("contact"), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "search",
+					Usage: "search notes of active user ID",
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "search",
+							Usage: "text to search for",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("search") {
+							return log.Error("option --search is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.noteSearch(ce.fileTable.OutputFP,
+							ce.getID(c), c.String("search"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "policy",
+			Usage: "Commands for receive policies",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "show receive policy",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.policyShow(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "set receive policy",
+					Description: `
+Sets the receive policy which is enforced on all decrypted incoming messages.
+Messages violating the policy are quarantined rather than stored (see
+'quarantine list'). Options which are not given keep their current value.
+`,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "max-size",
+							Usage: "maximum message size in bytes (0: unlimited)",
+						},
+						cli.IntFlag{
+							Name:  "max-attachments",
+							Usage: "maximum number of attachments (-1: unlimited)",
+						},
+						cli.BoolTFlag{
+							Name:  "reject-executables",
+							Usage: "reject messages with executable attachments",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.policySet(c)
+					},
+				},
+			},
+		},
+		{
+			Name:  "profile",
+			Usage: "Commands for network profiles",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "show active network profile",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.profileShow(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "switch network profile",
+					Description: fmt.Sprintf(`
+Switches the network profile. The profile '%s' is meant for satellite or
+metered connections: it precomputes fewer message keys, pads short messages to
+smaller sizes, batches upkeep tasks into daily runs, and defers non-essential
+syncs (config fetches and update checks). Use '%s' to switch back.
+`, msgdb.ProfileConstrained, msgdb.ProfileNormal),
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "name",
+							Usage: fmt.Sprintf("profile name {%s, %s}",
+								msgdb.ProfileNormal, msgdb.ProfileConstrained),
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("name") {
+							return log.Error("option --name is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.profileSet(c.String("name"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "proxy",
+			Usage: "Commands for the network proxy",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "show stored proxy configuration",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.proxyShow(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "store proxy configuration",
+					Description: `
+Stores the SOCKS5 proxy which is used for all network connections (key
+servers, mix delivery, account servers, and config fetches). For Tor use
+--url socks5://127.0.0.1:9050. Host names are resolved by the proxy, so no
+DNS requests leak past it. Per-domain overrides are given as a comma-separated
+list of domain=URL or domain=direct. An empty --url and --domains disable the
+proxy. The global options --proxy and --proxy-domains take precedence over the
+stored configuration.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "url",
+							Usage: "SOCKS5 proxy URL",
+						},
+						cli.StringFlag{
+							Name:  "domains",
+							Usage: "per-domain proxy overrides (domain=URL|direct,...)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.proxySet(c.String("url"), c.String("domains"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "domain",
+			Usage: "Commands for service domains",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list service domains",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.domainList(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "add",
+					Usage: "add service domain",
+					Description: `
+Adds (or updates) a service domain with its own key server, mix, and account
+server. New user IDs in the domain are registered with these services (see
+'uid new'). Additional domains share the wallet and the CA certificate of the
+network config. Domains defined by the network config cannot be changed.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "service domain",
+						},
+						cli.StringFlag{
+							Name:  "keyserver",
+							Usage: "key server URL",
+						},
+						cli.StringFlag{
+							Name:  "mix",
+							Usage: "mix address",
+						},
+						cli.StringFlag{
+							Name:  "account-server",
+							Usage: "account server (default of network config, if empty)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("domain") {
+							return log.Error("option --domain is mandatory")
+						}
+						if !c.IsSet("keyserver") {
+							return log.Error("option --keyserver is mandatory")
+						}
+						if !c.IsSet("mix") {
+							return log.Error("option --mix is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.domainAdd(c.GlobalString("homedir"),
+							c.String("domain"), c.String("keyserver"),
+							c.String("mix"), c.String("account-server"))
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "remove service domain",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "service domain",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("domain") {
+							return log.Error("option --domain is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.domainRemove(c.GlobalString("homedir"),
+							c.String("domain"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "quarantine",
+			Usage: "Commands for quarantined messages",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list quarantined messages",
+					Flags: []cli.Flag{
+						idFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.quarantineList(ce.fileTable.OutputFP,
+							ce.getID(c))
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "delete quarantined message",
+					Flags: []cli.Flag{
+						idFlag,
+						cli.IntFlag{
+							Name:  "qid",
+							Usage: "ID of quarantined message",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("qid") {
+							return log.Error("option --qid is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.quarantineDelete(ce.getID(c),
+							int64(c.Int("qid")))
+					},
+				},
+			},
+		},
+		{
+			Name:  "pending",
+			Usage: "Commands for messages of unknown sessions",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list pending messages",
+					Description: `
+Lists received messages which could not be decrypted, because they belong to
+an unknown session. Pending messages are retried after the next message of the
+sender has been decrypted. The sender is taken from the unauthenticated message
+header and could be forged. Entries are written as:
+  <pid> <date> <claimed sender> <size> <restart>
+`,
+					Flags: []cli.Flag{
+						idFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.pendingList(ce.fileTable.OutputFP,
+							ce.getID(c))
+					},
+				},
+				{
+					Name:  "restart",
+					Usage: "restart session with sender of pending messages",
+					Description: `
+Restarts the session with the contact given by --contact with the next message
+sent to it. Only use this command, if you expect messages from the contact,
+because the claimed sender of pending messages is not authenticated.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.pendingRestart(ce.fileTable.StatusFP,
+							ce.getID(c), c.String("contact"))
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "delete pending message",
+					Flags: []cli.Flag{
+						idFlag,
+						cli.IntFlag{
+							Name:  "pid",
+							Usage: "ID of pending message",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("pid") {
+							return log.Error("option --pid is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.pendingDelete(ce.getID(c),
+							int64(c.Int("pid")))
+					},
+				},
+			},
+		},
+		{
+			Name:  "queue",
+			Usage: "Commands for outqueue and inqueue",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list pending outqueue and inqueue entries",
+					Description: `
+Lists the pending entries of the outqueue (messages waiting for delivery) and
+the inqueue (received messages waiting for decryption).
+Outqueue entries are written as:
+  out <msgnum> <peer> <mindelay>-<maxdelay> <state> <failed attempts> <size>
+where state is one of 'encrypted', 'ready', 'resend', or 'retry <time>'.
+Inqueue entries are written as:
+  in <index> <contact> <date> <state> <size>
+`,
+					Flags: []cli.Flag{
+						idFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.queueList(ce.fileTable.OutputFP, ce.getID(c))
+					},
+				},
+				{
+					Name:  "retry",
+					Usage: "retry delivery of queued message(s)",
+					Description: `
+Clears the resend status and postponed deliveries of the queued message given
+by --msgnum (of all queued messages, if --msgnum is not set). The messages are
+delivered with the next 'msg send'.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.queueRetry(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+				{
+					Name:  "drop",
+					Usage: "cancel delivery of queued message",
+					Description: `
+Cancels the delivery of a queued message by removing it from the outqueue.
+The message itself is kept (unsent) and can be deleted with 'msg delete'.
+Parts of a message which has been sent in chunks might have been delivered
+already.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						msgNumFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("msgnum") {
+							return log.Error("option --msgnum is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.queueDrop(ce.getID(c), int64(c.Int("msgnum")))
+					},
+				},
+			},
+		},
+		{
+			Name:  "upkeep",
+			Usage: "Commands for upkeep (maintenance)",
+			Subcommands: []cli.Command{
+				{
+					Name:  "all",
+					Usage: "Perform all upkeep tasks for user ID",
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "period",
+							Usage: "perform task only if last execution was earlier than period",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("period") {
+							return log.Error("option --period is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepAll(c, ce.getID(c),
+							c.String("period"), ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "cleanup",
+					Usage: "Clean up expired accounts and deleted contacts",
+					Description: `
+Delete accounts which expired (past their load time) and remove contacts whose
+user IDs have been deleted on the key server. Every cleanup action has to be
+confirmed, unless --force is given. Contacts without messages exchanged for the
+--inactive duration are reported.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "inactive",
+							Value: "8760h",
+							Usage: "report contacts without messages for this duration",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "perform cleanup without prompting",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepCleanup(c, ce.getID(c),
+							c.String("inactive"), c.Bool("force"),
+							ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "keys",
+					Usage: "Delete unused sessions and expired keys",
+					Description: `
+Delete sessions which have not been used for the --unused duration, message
+keys which do not belong to a remaining session, and session keys past their
+cleanup time from the key database. The number of deleted entries is reported.
+With --dry-run nothing is deleted.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "unused",
+							Value: "2160h",
+							Usage: "delete sessions unused for this duration",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only report entries which would be deleted",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepKeys(c, c.String("unused"),
+							c.Bool("dry-run"), ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "expiry",
+					Usage: "Show expiry of UID and KeyInit messages",
+					Description: `
+List the expiry times of the UID and KeyInit messages of the given user ID (or
+all user IDs) on output-fd and warn on status-fd about UID messages which
+expire within the --warn duration and KeyInit messages which expire within one
+bucket duration. With --auto expiring UID messages are renewed with
+'uid genupdate' and 'uid update' and KeyInit messages are refreshed, if wallet
+tokens are available. 'upkeep all' performs the check without --auto.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						allFlag,
+						hostFlag,
+						cli.DurationFlag{
+							Name:  "warn",
+							Value: def.ExpiryWarning,
+							Usage: "warn about UID messages expiring within this duration",
+						},
+						cli.BoolFlag{
+							Name:  "auto",
+							Usage: "renew expiring UID and KeyInit messages",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("all") && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepExpiry(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, ce.getID(c), c.Bool("all"),
+							c.String("host"), c.Duration("warn"), c.Bool("auto"))
+					},
+				},
+				{
+					Name:  "fetchconf",
+					Usage: "Fetch current Mute system config",
+					Description: `
+Fetches the signed system config from the configuration server. The signature
+is verified with the pinned public key and configs with a lower version than
+the current one are rejected (rollback protection). Once a signed config has
+been fetched, configs without version are rejected, too. Unsigned legacy
+configs stored by older versions are applied with a warning until they are
+replaced by the next fetch. Local overrides in the file
+config/NETDOMAIN.override (a JSON object) in the home directory are applied
+on top of the signed config, the signed config itself is stored unmodified.
+`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "show",
+							Usage: "Show config on output-fd",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepFetchconf(ce.msgDB,
+							c.GlobalString("homedir"), c.Bool("show"),
+							ce.fileTable.OutputFP, ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "update",
+					Usage: "Update Mute binaries (from source)",
+					// TODO: "Update Mute binaries (from source or download binaries)",
+					/*
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "source",
+								Usage: "Force update from source",
+							},
+							cli.BoolFlag{
+								Name:  "binary",
+								Usage: "Force binary update",
+							},
+						},
+					*/
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						/*
+							if c.Bool("source") && c.Bool("binary") {
+								return log.Error("options --source and --binary exclude each other")
+							}
+						*/
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepUpdate(c.GlobalString("homedir"),
+							/* c.Bool("source"), c.Bool("binary"), */
+							ce.fileTable.OutputFP, ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "accounts",
+					Usage: "Renew accounts on server",
+					Description: `
+Renews the accounts of the given user ID which expire within the renewal window
+(--remaining). Every account is renewed at a random time within the first half
+of the window, so that the accounts are not renewed all at once. Failed
+renewals are retried with the next run, a warning is written to status-fd if
+no tokens are available or if a renewal failed repeatedly.
+
+The defaults of --period and --remaining are taken from the config entries
+accounts.Period and accounts.Remaining (6h and 2160h, if not set). In daemon
+mode the accounts are checked every --accounts-interval.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						cli.StringFlag{
+							Name:  "period",
+							Usage: "perform task only if last execution was earlier than period (default from config)",
+						},
+						cli.StringFlag{
+							Name:  "remaining",
+							Usage: "renew account only if remaining time is less than remaining (default from config)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepAccounts(ce.getID(c),
+							c.String("period"), c.String("remaining"),
+							ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "migrate-account",
+					Usage: "Move account for contact to another account server",
+					Description: `
+Creates a new account on the account server --server and uses it for all
+messages from --contact: the nymaddresses sent to the contact with new messages
+point to the new account. If the contact already has a dedicated account, the
+remaining messages are fetched from it before it is replaced. This allows to
+move off a failing account server without losing mail.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						contactFlag,
+						cli.StringFlag{
+							Name:  "server",
+							Usage: "new account server",
+						},
+						cli.StringFlag{
+							Name:  "invitation",
+							Usage: "invitation code (if required by the server)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						if !c.IsSet("contact") {
+							return log.Error("option --contact is mandatory")
+						}
+						if !c.IsSet("server") {
+							return log.Error("option --server is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepMigrateAccount(c, ce.getID(c),
+							c.String("contact"), c.String("server"),
+							ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "hashchain",
+					Usage: "Sync and verify hashchain for the given domain.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "key server domain",
+						},
+						hostFlag,
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("domain") {
+							return log.Error("option --domain is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepHashchain(c, c.String("domain"),
+							c.String("host"))
+					},
+				},
+				{
+					Name:  "keyinit",
+					Usage: "Rotate time-bucketed KeyInit messages on key server",
+					Flags: []cli.Flag{
+						idFlag,
+						hostFlag,
+						cli.IntFlag{
+							Name:  "buckets",
+							Value: def.KeyInitBuckets,
+							Usage: "number of buckets to keep KeyInit messages for",
+						},
+						cli.DurationFlag{
+							Name:  "bucket-duration",
+							Value: def.KeyInitBucketDuration,
+							Usage: "validity duration of a KeyInit message",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !interactive && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.upkeepKeyInit(c, ce.getID(c),
+							c.String("host"), c.Int("buckets"),
+							c.Duration("bucket-duration"), ce.fileTable.StatusFP)
+					},
+				},
+			},
+		},
+		{
+			Name:  "sync",
+			Usage: "Commands for synchronization between devices",
+			Description: `
+Synchronizes nyms, contacts, key material (including session states), and
+messages between several devices of the same user. Sync bundles are encrypted
+and authenticated with a sync key which has to be shared between all devices:
+show the key with 'sync key' on the first device and set it with
+'sync key --set' on the others. Then export a bundle with 'sync export' and
+import it with 'sync import' on the other device (and vice versa).
+
+Conflicts are resolved as follows: existing nyms, contacts, and messages keep
+their local settings (read and star flags are merged), existing sessions keep
+their local message keys, and of two states for the same session the more
+advanced one wins. Do not use both devices to send messages to the same
+contact between two syncs.
+
+A bundle exported with 'sync export --observer' provisions a read-only
+observer device (e.g., an assistant reading a shared mailbox): it contains the
+key material to decrypt messages, but no private signature keys. Observers can
+fetch and read messages, but cannot send messages or create UIDs in the name of
+the owner. Importing a full bundle turns an observer into a full device.
+`,
+			Subcommands: []cli.Command{
+				{
+					Name:  "key",
+					Usage: "Show sync key (generated, if necessary) or set it",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "set",
+							Usage: "set sync key (from 'sync key' on other device)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.syncShowKey(ce.fileTable.OutputFP,
+							c.String("set"))
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "Export encrypted sync bundle",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "file to write sync bundle to (not overwritten)",
+						},
+						cli.DurationFlag{
+							Name:  "since",
+							Usage: "only export messages of the given last duration (default: all)",
+						},
+						armorFlag,
+						cli.BoolFlag{
+							Name:  "observer",
+							Usage: "export bundle for decryption-only observer device",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("out") {
+							return log.Error("option --out is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.syncExport(c, ce.fileTable.StatusFP,
+							c.String("out"), c.Duration("since"),
+							c.Bool("armor"), c.Bool("observer"))
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "Import encrypted sync bundle",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "in",
+							Usage: "file to read (optionally armored) sync bundle from",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("in") {
+							return log.Error("option --in is mandatory")
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.syncImport(c, ce.fileTable.StatusFP,
+							c.String("in"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "wallet",
+			Usage: "Commands for wallet management",
+			Subcommands: []cli.Command{
+				{
+					Name:  "pubkey",
+					Usage: "Show public key of wallet",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletPubkey(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "rotate",
+					Usage: "Replace wallet key",
+					Description: `
+Replaces the wallet key with a new one (generated, if --walletkey is not given)
+and shows the new public wallet key. The old key is archived (see 'wallet
+archived'). Tokens in the local wallet stay usable, interrupted reissues of
+tokens are finished with the key they were started with.
+
+The wallet server does not allow to transfer tokens between wallet keys: the
+tokens left on the wallet server for the old key are shown, send the new public
+wallet key to the service guard operator to have them transferred.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "walletkey",
+							Usage: "new private wallet key (base64 encoded)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletRotate(c, ce.fileTable.OutputFP,
+							ce.fileTable.StatusFP, c.String("walletkey"))
+					},
+				},
+				{
+					Name:  "encrypt",
+					Usage: "Encrypt tokens and private keys in wallet storage",
+					Description: `
+Generates a key to encrypt token data, private keys, and state in the wallet
+storage (if there is none yet) and encrypts all existing entries with it.
+Afterwards unencrypted entries are rejected. If the command is interrupted,
+run it again to encrypt the remaining entries.
+`,
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletEncrypt(c, ce.fileTable.StatusFP)
+					},
+				},
+				{
+					Name:  "archived",
+					Usage: "Show archived public keys of wallet",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletArchived(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "balance",
+					Usage: "Show balance key of wallet",
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletBalance(ce.fileTable.OutputFP)
+					},
+				},
+				{
+					Name:  "history",
+					Usage: "Show tokens spent per day and week",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Value: 28,
+							Usage: "number of days to show",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletHistory(ce.fileTable.OutputFP, c.Int("days"))
+					},
+				},
+				{
+					Name:  "prefetch",
+					Usage: "Acquire tokens ahead of time (e.g., before going offline)",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "usage",
+							Value: "Message",
+							Usage: "usage of tokens to prefetch",
+						},
+						cli.IntFlag{
+							Name:  "count",
+							Usage: "number of tokens which should be available",
+						},
+						cli.StringFlag{
+							Name:  "owner",
+							Usage: "owner public key of tokens (base64, default depends on usage)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						if !c.IsSet("count") {
+							return log.Error("option --count is mandatory")
+						}
+						return ce.prepare(c, true, true)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletPrefetch(ce.fileTable.OutputFP,
+							c.String("usage"), c.String("owner"), c.Int("count"))
+					},
+				},
+				{
+					Name:  "replenish",
+					Usage: "Show or set low-water marks for automatic wallet replenishment",
+					Description: `
+If the balance of own tokens for a usage drops below its low-water mark,
+tokens are fetched from the service guard in the background until the
+low-water mark is reached again. Replenishments (and failures) are reported
+on status-fd. Without options the current low-water marks are shown, a
+low-water mark of 0 disables automatic replenishment for the usage.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "usage",
+							Value: "Message",
+							Usage: "usage of tokens to replenish",
+						},
+						cli.IntFlag{
+							Name:  "low",
+							Usage: "low-water mark (0 disables replenishment)",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, true, false)
+					},
+					Action: func(c *cli.Context) {
+						ce.err = ce.walletReplenish(ce.fileTable.OutputFP,
+							c.String("usage"), int64(c.Int("low")), c.IsSet("low"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "debug",
+			Usage: "Commands for debugging and support",
+			Subcommands: []cli.Command{
+				{
+					Name:  "loglevel",
+					Usage: "Show or change logging level",
+					Description: `
+Without --level the current logging level is shown on output-fd. With --level
+the logging level is changed at runtime, which is useful in interactive mode
+to temporarily enable debug logging without restarting the session.
+`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "level",
+							Usage: "new logging level {trace, debug, info, warn, error, critical}",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if len(c.Args()) > 0 {
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
+						}
+						return ce.prepare(c, false, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgList(ce.fileTable.OutputFP, ce.getID(c))
+						ce.err = debugLogLevel(ce.fileTable.OutputFP, c.String("level"))
 					},
 				},
 				{
-					Name:  "read",
-					Usage: "read message",
+					Name:  "support-bundle",
+					Usage: "Create support bundle to attach to bug reports",
+					Description: `
+Collects sanitized logs, config versions, DB schema versions, queue statistics,
+and doctor output into a single .tar.gz archive. Keys and plaintexts are
+never included, user IDs in logs are replaced by pseudonyms.
+Please review the archive before sharing it anyway.
+`,
 					Flags: []cli.Flag{
-						idFlag,
-						msgNumFlag,
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "archive file to write (default: mute-support-DATE.tar.gz)",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						if !interactive && !c.IsSet("id") {
-							return log.Error("option --id is mandatory")
-						}
-						if !c.IsSet("msgnum") {
-							return log.Error("option --msgnum is mandatory")
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
 						}
-						return ce.prepare(c, true, true)
+						return ce.prepare(c, true, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgRead(ce.fileTable.OutputFP, ce.getID(c),
-							int64(c.Int("msgnum")))
+						ce.err = ce.debugSupportBundle(c, ce.fileTable.StatusFP,
+							c.String("output"))
 					},
 				},
+			},
+		},
+		{
+			Name:  "protocol",
+			Usage: "Commands for protocol information",
+			Subcommands: []cli.Command{
 				{
-					Name:  "delete",
-					Usage: "delete a message",
+					Name:  "describe",
+					Usage: "Describe protocol on output-fd",
 					Description: `
-Deletes a message.					
-A deleted message is permanently gone. Handle with care!
-					`,
+Describe the protocol-visible behavior of this version: supported message format
+versions, UID protocol versions, ciphersuites, and feature flags.
+`,
 					Flags: []cli.Flag{
-						idFlag,
-						msgNumFlag,
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "output description as JSON",
+						},
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
-						}
-						if !interactive && !c.IsSet("id") {
-							return log.Error("option --id is mandatory")
-						}
-						if !c.IsSet("msgnum") {
-							return log.Error("option --msgnum is mandatory")
+							return log.Errorf("superfluous argument(s): %s",
+								strings.Join(c.Args(), " "))
 						}
-						return ce.prepare(c, true, true)
+						return ce.prepare(c, false, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.msgDelete(ce.getID(c), int64(c.Int("msgnum")))
+						ce.err = def.WriteProtocol(ce.fileTable.OutputFP,
+							c.Bool("json"))
 					},
 				},
 			},
 		},
 		{
-			Name:  "upkeep",
-			Usage: "Commands for upkeep (maintenance)",
+			Name:  "online",
+			Usage: "Go online and flush queued messages",
+			Description: `
+Switches from --offline mode to online mode (in interactive mode for the rest
+of the session) and flushes all messages queued with 'msg add' while offline,
+followed by a fetch of new messages. In --offline mode 'msg send' and 'msg
+fetch' do not fail, messages stay queued until 'online' is run.
+
+With --wait the network is probed every --interval until it becomes available,
+which allows to run 'online' as connectivity watcher. Progress is reported on
+status-fd.
+`,
+			Flags: []cli.Flag{
+				idFlag,
+				allFlag,
+				cli.BoolFlag{
+					Name:  "wait",
+					Usage: "wait until the network becomes available",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 30 * time.Second,
+					Usage: "interval between network probes (with --wait)",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				if !interactive && !c.IsSet("all") && !c.IsSet("id") {
+					return log.Error("option --id is mandatory")
+				}
+				// prepare in --offline mode, going online is done by the action
+				if err := c.GlobalSet("offline", "true"); err != nil {
+					return log.Error(err)
+				}
+				return ce.prepare(c, true, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = ce.online(c, ce.getID(c), c.Bool("all"), c.Bool("wait"),
+					c.Duration("interval"), ce.fileTable.StatusFP)
+			},
+		},
+		{
+			Name:  "daemon",
+			Usage: "Commands for daemon mode (periodic send/fetch)",
 			Subcommands: []cli.Command{
 				{
-					Name:  "all",
-					Usage: "Perform all upkeep tasks for user ID",
+					Name:  "start",
+					Usage: "Run mutectrl as daemon",
+					Description: `
+Run mutectrl as a long-lived process which periodically fetches messages, sends
+messages, and performs all upkeep tasks for the given user ID (or all user IDs).
+The next execution time of every task is randomized by up to --jitter.
+
+The daemon listens on a local control socket (default: daemon/mutectrl.sock in
+the home directory) which is used by 'daemon control' to trigger immediate runs
+and to stop the daemon. The directory of the control socket must only be
+accessible by the user. The daemon is stopped with SIGINT or SIGTERM.
+`,
 					Flags: []cli.Flag{
 						idFlag,
+						allFlag,
+						cli.DurationFlag{
+							Name:  "fetch-interval",
+							Value: 5 * time.Minute,
+							Usage: "interval between message fetches",
+						},
+						cli.DurationFlag{
+							Name:  "send-interval",
+							Value: time.Minute,
+							Usage: "interval between message sends",
+						},
+						cli.DurationFlag{
+							Name:  "upkeep-interval",
+							Value: 24 * time.Hour,
+							Usage: "interval between upkeep runs",
+						},
+						cli.DurationFlag{
+							Name:  "accounts-interval",
+							Value: def.AccountsPeriod,
+							Usage: "interval between account renewal checks",
+						},
+						cli.DurationFlag{
+							Name:  "jitter",
+							Value: 30 * time.Second,
+							Usage: "maximum random delay added to intervals",
+						},
 						cli.StringFlag{
-							Name:  "period",
-							Usage: "perform task only if last execution was earlier than period",
+							Name:  "socket",
+							Usage: "path of control socket",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -1174,26 +3737,50 @@ A deleted message is permanently gone. Handle with care!
 							return log.Errorf("superfluous argument(s): %s",
 								strings.Join(c.Args(), " "))
 						}
-						if !interactive && !c.IsSet("id") {
+						if !interactive && !c.IsSet("all") && !c.IsSet("id") {
 							return log.Error("option --id is mandatory")
 						}
-						if !c.IsSet("period") {
-							return log.Error("option --period is mandatory")
-						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.upkeepAll(c, ce.getID(c),
-							c.String("period"), ce.fileTable.StatusFP)
+						ce.err = ce.daemon(c, ce.getID(c), c.Bool("all"),
+							c.Duration("fetch-interval"),
+							c.Duration("send-interval"),
+							c.Duration("upkeep-interval"),
+							c.Duration("accounts-interval"),
+							c.Duration("jitter"), c.String("socket"),
+							ce.fileTable.StatusFP)
 					},
 				},
 				{
-					Name:  "fetchconf",
-					Usage: "Fetch current Mute system config",
+					Name:  "smtp",
+					Usage: "Run SMTP submission bridge for local mail clients",
+					Description: `
+Run an SMTP server on a loopback address which accepts mails from local mail
+clients (like Thunderbird) and adds them as Mute messages (like 'msg add').
+The sender (MAIL FROM) must be the given user ID (or any user ID with --all)
+and every recipient (RCPT TO) must be a contact of the sender. Recipients in the
+'To' header become 'To:' recipients, all other recipients 'Cc:' recipients.
+Attachments are supported. Unless --nosend is given, messages are sent right
+away (like 'msg send').
+
+The server does not support TLS, but requires authentication (AUTH PLAIN or
+LOGIN) with the user ID as username. The password is generated on start and
+shown on the status output, it changes with every run. Configure the mail
+client to use the listen address as outgoing server without encryption and
+with password authentication. The sender must be the authenticated user ID.
+`,
 					Flags: []cli.Flag{
+						idFlag,
+						allFlag,
+						cli.StringFlag{
+							Name:  "listen",
+							Value: defaultSMTPListen,
+							Usage: "loopback address to listen on",
+						},
 						cli.BoolFlag{
-							Name:  "show",
-							Usage: "Show config on output-fd",
+							Name:  "nosend",
+							Usage: "only add messages (send them with 'msg send' or daemon)",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -1201,61 +3788,84 @@ A deleted message is permanently gone. Handle with care!
 							return log.Errorf("superfluous argument(s): %s",
 								strings.Join(c.Args(), " "))
 						}
+						if !interactive && !c.IsSet("all") && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
 						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.upkeepFetchconf(ce.msgDB,
-							c.GlobalString("homedir"), c.Bool("show"),
-							ce.fileTable.OutputFP, ce.fileTable.StatusFP)
+						ce.err = ce.smtpBridge(c, ce.getID(c), c.Bool("all"),
+							c.String("listen"), c.Bool("nosend"),
+							ce.fileTable.StatusFP)
 					},
 				},
 				{
-					Name:  "update",
-					Usage: "Update Mute binaries (from source)",
-					// TODO: "Update Mute binaries (from source or download binaries)",
-					/*
-						Flags: []cli.Flag{
-							cli.BoolFlag{
-								Name:  "source",
-								Usage: "Force update from source",
-							},
-							cli.BoolFlag{
-								Name:  "binary",
-								Usage: "Force binary update",
-							},
+					Name:  "imap",
+					Usage: "Run IMAP bridge for local mail clients",
+					Description: `
+Run an IMAP server on a loopback address which gives local mail clients (like
+Thunderbird) read access to Mute messages. Every user ID is an IMAP account
+(login with the user ID as username) with the folders INBOX (received
+messages), Sent (sent messages), and Archive (archived messages).
+
+Read and starred messages have the flags \Seen and \Flagged. Flag changes are
+synced back: marking a message as seen marks it as read and sends a read
+receipt (like 'msg read'), which cannot be undone. Moving messages to Archive
+archives them, moving them back to INBOX or Sent unarchives them. Messages
+cannot be deleted or copied, copies of sent mails saved in Sent are discarded
+(use the SMTP bridge 'daemon smtp' to send messages).
+
+The server does not support TLS. The password of every account is generated
+on start and shown on the status output, it changes with every run. Configure
+the mail client to use the listen address as incoming server without
+encryption and with the shown password.
+`,
+					Flags: []cli.Flag{
+						idFlag,
+						allFlag,
+						cli.StringFlag{
+							Name:  "listen",
+							Value: defaultIMAPListen,
+							Usage: "loopback address to listen on",
 						},
-					*/
+					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
 							return log.Errorf("superfluous argument(s): %s",
 								strings.Join(c.Args(), " "))
 						}
-						/*
-							if c.Bool("source") && c.Bool("binary") {
-								return log.Error("options --source and --binary exclude each other")
-							}
-						*/
-						return ce.prepare(c, true, false)
+						if !interactive && !c.IsSet("all") && !c.IsSet("id") {
+							return log.Error("option --id is mandatory")
+						}
+						return ce.prepare(c, true, true)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.upkeepUpdate(c.GlobalString("homedir"),
-							/* c.Bool("source"), c.Bool("binary"), */
-							ce.fileTable.OutputFP, ce.fileTable.StatusFP)
+						ce.err = ce.imapBridge(ce.getID(c), c.Bool("all"),
+							c.String("listen"), ce.fileTable.StatusFP)
 					},
 				},
 				{
-					Name:  "accounts",
-					Usage: "Renew accounts on server",
+					Name:  "control",
+					Usage: "Send command to running daemon",
+					Description: `
+Send a command to a running daemon. Possible commands:
+
+  fetch     fetch messages now
+  send      send messages now
+  upkeep    perform upkeep tasks now
+  accounts  renew expiring accounts now
+  run       perform all tasks now
+  status    show next execution times
+  stop      stop daemon
+`,
 					Flags: []cli.Flag{
-						idFlag,
 						cli.StringFlag{
-							Name:  "period",
-							Usage: "perform task only if last execution was earlier than period",
+							Name:  "command",
+							Usage: "command to send",
 						},
 						cli.StringFlag{
-							Name:  "remaining",
-							Value: "2160h",
-							Usage: "renew account only if remaining time is less than remaining",
+							Name:  "socket",
+							Usage: "path of control socket",
 						},
 					},
 					Before: func(c *cli.Context) error {
@@ -1263,81 +3873,159 @@ A deleted message is permanently gone. Handle with care!
 							return log.Errorf("superfluous argument(s): %s",
 								strings.Join(c.Args(), " "))
 						}
-						if !interactive && !c.IsSet("id") {
-							return log.Error("option --id is mandatory")
-						}
-						if !c.IsSet("period") {
-							return log.Error("option --period is mandatory")
+						if !c.IsSet("command") {
+							return log.Error("option --command is mandatory")
 						}
-						return ce.prepare(c, true, true)
+						return ce.prepare(c, false, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.upkeepAccounts(ce.getID(c),
-							c.String("period"), c.String("remaining"),
-							ce.fileTable.StatusFP)
+						ce.err = daemonControl(c.GlobalString("homedir"),
+							c.String("socket"), c.String("command"),
+							ce.fileTable.OutputFP)
 					},
 				},
+			},
+		},
+		{
+			Name:  "alias",
+			Usage: "Commands for command aliases of the interactive mode",
+			Subcommands: []cli.Command{
 				{
-					Name:  "hashchain",
-					Usage: "Sync and verify hashchain for the given domain.",
+					Name:  "set",
+					Usage: "define alias for command",
+					Description: `
+Defines an alias for a command (with options) in interactive mode. A command
+line starting with the alias is expanded to the command, further arguments are
+appended. For example, after
+
+  alias set --name mb --command "msg add --to bob@mute.one"
+
+the command line 'mb --attach file' adds a message to bob@mute.one with an
+attachment. Aliases are stored in the message database.
+`,
 					Flags: []cli.Flag{
 						cli.StringFlag{
-							Name:  "domain",
-							Usage: "key server domain",
+							Name:  "name",
+							Usage: "name of alias",
+						},
+						cli.StringFlag{
+							Name:  "command",
+							Usage: "command the alias expands to",
 						},
-						hostFlag,
 					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s",
-								strings.Join(c.Args(), " "))
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
 						}
-						if !c.IsSet("domain") {
-							return log.Error("option --domain is mandatory")
+						if !c.IsSet("name") {
+							return log.Error("option --name is mandatory")
 						}
-						return ce.prepare(c, true, true)
+						if !c.IsSet("command") {
+							return log.Error("option --command is mandatory")
+						}
+						return ce.prepare(c, true, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.upkeepHashchain(c, c.String("domain"),
-							c.String("host"))
+						ce.err = ce.aliasSet(c.String("name"), c.String("command"))
 					},
 				},
-			},
-		},
-		{
-			Name:  "wallet",
-			Usage: "Commands for wallet management",
-			Subcommands: []cli.Command{
 				{
-					Name:  "pubkey",
-					Usage: "Show public key of wallet",
+					Name:  "remove",
+					Usage: "remove alias",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "name of alias",
+						},
+					},
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s",
-								strings.Join(c.Args(), " "))
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
 						}
-						return ce.prepare(c, true, true)
+						if !c.IsSet("name") {
+							return log.Error("option --name is mandatory")
+						}
+						return ce.prepare(c, true, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.walletPubkey(ce.fileTable.OutputFP)
+						ce.err = ce.aliasRemove(c.String("name"))
 					},
 				},
 				{
-					Name:  "balance",
-					Usage: "Show balance key of wallet",
+					Name:  "list",
+					Usage: "list aliases",
 					Before: func(c *cli.Context) error {
 						if len(c.Args()) > 0 {
-							return log.Errorf("superfluous argument(s): %s",
-								strings.Join(c.Args(), " "))
+							return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
 						}
-						return ce.prepare(c, true, true)
+						return ce.prepare(c, true, false)
 					},
 					Action: func(c *cli.Context) {
-						ce.err = ce.walletBalance(ce.fileTable.OutputFP)
+						ce.err = ce.aliasList(ce.fileTable.OutputFP)
 					},
 				},
 			},
 		},
+		{
+			Name:  "batch",
+			Usage: "Execute commands read from command-fd as a batch",
+			Description: `
+Reads commands from command-fd (one command per line, without the program
+name; empty lines and lines starting with '#' are ignored) and executes them
+one after another. The commands app, batch, daemon, db, lock, and quit are
+not allowed in batches.
+
+By default, the batch stops at the first failed command and the remaining
+commands are skipped. With --keep-going all commands are executed.
+
+With --atomic the batch has all-or-nothing semantics: if a command fails, the
+message database is restored to its state before the batch (e.g., contact
+imports are undone). Changes outside of the message database (key database,
+key server registrations, sent messages) cannot be rolled back.
+
+For every command a line with the tab-separated fields
+
+  index result command error
+
+is written to output-fd, where result is one of ok, failed, skipped, or
+rolledback. The final line 'batch<TAB>result' contains the result of the
+whole batch (ok, failed, or rolledback). If a command failed, the batch
+itself fails.
+`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "atomic",
+					Usage: "restore message DB, if a command fails",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going",
+					Usage: "execute remaining commands after a failure",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				return ce.prepare(c, c.Bool("atomic"), false)
+			},
+			Action: func(c *cli.Context) {
+				ce.err = ce.batch(c, ce.fileTable.OutputFP,
+					c.Bool("atomic"), c.Bool("keep-going"))
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: "Lock databases (passphrase is requested again by the next command)",
+			Before: func(c *cli.Context) error {
+				if len(c.Args()) > 0 {
+					return log.Errorf("superfluous argument(s): %s", strings.Join(c.Args(), " "))
+				}
+				return ce.prepare(c, false, false)
+			},
+			Action: func(c *cli.Context) {
+				ce.lockCmd(ce.fileTable.StatusFP)
+			},
+		},
 		{
 			Name:  "quit",
 			Usage: "End program",
@@ -1381,26 +4069,20 @@ func decodeWalletKey(p string) (*[ed25519.PrivateKeySize]byte, error) {
 func (ce *CtrlEngine) openMsgDB(
 	homedir string,
 ) error {
-	// read passphrase, if necessary
-	if ce.passphrase == nil {
-		fmt.Fprintf(ce.fileTable.StatusFP, "read passphrase from fd %d (not echoed)\n",
-			ce.fileTable.PassphraseFD)
-		log.Infof("read passphrase from fd %d (not echoed)",
-			ce.fileTable.PassphraseFD)
-		var err error
-		ce.passphrase, err = util.Readline(ce.fileTable.PassphraseFP)
-		if err != nil {
-			return err
-		}
-		log.Info("done")
+	// get passphrase (read it, if necessary)
+	passphrase, err := ce.getPassphrase(ce.fileTable.StatusFP, homedir)
+	if err != nil {
+		return err
 	}
 
 	// open msgDB
 	msgdbname := filepath.Join(homedir, "msgs")
 	log.Infof("open msgDB %s", msgdbname)
-	var err error
-	ce.msgDB, err = msgdb.Open(msgdbname, ce.passphrase)
+	ce.msgDB, err = msgdb.Open(msgdbname, passphrase)
 	if err != nil {
+		// do not reuse a wrong passphrase, every attempt is counted
+		bzero.Bytes(ce.passphrase)
+		ce.passphrase = nil
 		return err
 	}
 	return nil
@@ -1416,5 +4098,9 @@ func (ce *CtrlEngine) Close() {
 		ce.msgDB.Close()
 		ce.msgDB = nil
 	}
+	if ce.cryptEng != nil {
+		ce.cryptEng.Close()
+		ce.cryptEng = nil
+	}
 	bzero.Bytes(ce.passphrase)
 }
@@ -0,0 +1,429 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/interrupt"
+	"github.com/urfave/cli"
+)
+
+// Commands understood by the control socket of the daemon.
+const (
+	daemonFetch    = "fetch"    // fetch messages now
+	daemonSend     = "send"     // send messages now
+	daemonUpkeep   = "upkeep"   // perform upkeep now
+	daemonAccounts = "accounts" // check accounts for renewal now
+	daemonRun      = "run"      // run all tasks now
+	daemonStatus   = "status"   // show time of next runs
+	daemonStop     = "stop"     // shutdown daemon
+)
+
+// daemonDir is the directory of the default control socket in the home
+// directory. It is only accessible by the user.
+const daemonDir = "daemon"
+
+// daemonSocket is the default name of the control socket in daemonDir.
+const daemonSocket = "mutectrl.sock"
+
+// daemonSocketPath returns the path of the control socket. If socket is
+// empty, the default control socket in homedir is used.
+func daemonSocketPath(homedir, socket string) string {
+	if socket == "" {
+		return filepath.Join(homedir, daemonDir, daemonSocket)
+	}
+	return socket
+}
+
+// checkSocketDir makes sure that the directory of the control socket is only
+// accessible by the user, so that the socket is never exposed to other users
+// (not even before its permissions have been set).
+func checkSocketDir(socket string) error {
+	if runtime.GOOS == "windows" {
+		return nil // no Unix permissions
+	}
+	dir := filepath.Dir(socket)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return log.Error(err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return log.Errorf("ctrlengine: directory of control socket '%s' "+
+			"must only be accessible by the user (mode 0700)", dir)
+	}
+	return nil
+}
+
+// daemonRequest is a command received on the control socket.
+type daemonRequest struct {
+	cmd   string
+	reply chan string
+}
+
+// daemonTask is a periodic task of the daemon.
+type daemonTask struct {
+	name     string
+	interval time.Duration
+	next     time.Time
+	run      func() error
+}
+
+// schedule sets the next execution time of task to interval plus a random
+// jitter in [0, jitter) from now.
+func (task *daemonTask) schedule(jitter time.Duration) {
+	task.next = time.Now().Add(task.interval + randDuration(jitter))
+}
+
+// randDuration returns a random duration in [0, max).
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(cipher.RandReader, big.NewInt(int64(max)))
+	if err != nil {
+		panic(log.Critical(err))
+	}
+	return time.Duration(n.Int64())
+}
+
+// daemonCaller is the rate limiting key of the control socket. The socket is
+// only accessible by the user running the daemon, therefore all connections
+// share one bucket.
+const daemonCaller = "socket"
+
+// allowDaemonCommand returns true, if the command cmd received on the control
+// socket is within the rate limits. Commands which run tasks are limited as
+// expensive commands.
+func allowDaemonCommand(cmd string) bool {
+	if !apiLimiter.Allow(daemonCaller) {
+		return false
+	}
+	switch cmd {
+	case daemonFetch, daemonSend, daemonUpkeep, daemonAccounts, daemonRun:
+		return expensiveLimiter.Allow(daemonCaller)
+	}
+	return true
+}
+
+// serveDaemonSocket accepts connections on the control socket l and passes
+// the received commands to the daemon loop via reqs until done is closed.
+func serveDaemonSocket(
+	l net.Listener,
+	reqs chan<- *daemonRequest,
+	done <-chan struct{},
+) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		go serveDaemonConn(conn, reqs, done)
+	}
+}
+
+// serveDaemonConn passes the commands received on conn to the daemon loop via
+// reqs. The connection is closed after the daemon stopped (done is closed).
+func serveDaemonConn(
+	conn net.Conn,
+	reqs chan<- *daemonRequest,
+	done <-chan struct{},
+) {
+	defer conn.Close()
+	// do not keep idle connections open after the daemon stopped
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if !allowDaemonCommand(cmd) {
+			fmt.Fprintln(conn, "error: rate limit exceeded")
+			continue
+		}
+		req := &daemonRequest{cmd: cmd, reply: make(chan string, 1)}
+		select {
+		case reqs <- req:
+		case <-done:
+			fmt.Fprintln(conn, "error: daemon stopped")
+			return
+		}
+		fmt.Fprintln(conn, <-req.reply)
+		if cmd == daemonStop {
+			return
+		}
+	}
+}
+
+// daemon runs mutectrl as a long-lived background process which periodically
+// fetches messages, sends messages, performs upkeep tasks, and renews expiring
+// accounts for the user ID id (or all user IDs). The next execution time of
+// every task is randomized by up to jitter. A local control socket allows to trigger immediate runs,
+// to query the status, and to shutdown the daemon.
+func (ce *CtrlEngine) daemon(
+	c *cli.Context,
+	id string,
+	all bool,
+	fetchInterval, sendInterval, upkeepInterval, accountsInterval,
+	jitter time.Duration,
+	socket string,
+	statfp io.Writer,
+) error {
+	if fetchInterval <= 0 || sendInterval <= 0 || upkeepInterval <= 0 ||
+		accountsInterval <= 0 {
+		return log.Error("ctrlengine: daemon intervals must be positive")
+	}
+	if jitter < 0 {
+		return log.Error("ctrlengine: daemon jitter must not be negative")
+	}
+	// the user IDs are determined for every run, they may change while the
+	// daemon is running
+	if _, err := ce.getNyms(id, all); err != nil {
+		return err
+	}
+	homedir := c.GlobalString("homedir")
+	if socket == "" {
+		// default socket directory is only accessible by the user
+		dir := filepath.Join(homedir, daemonDir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return log.Error(err)
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			return log.Error(err)
+		}
+	}
+	socket = daemonSocketPath(homedir, socket)
+	if err := checkSocketDir(socket); err != nil {
+		return err
+	}
+
+	// define tasks
+	fetch := &daemonTask{
+		name:     daemonFetch,
+		interval: fetchInterval,
+		run: func() error {
+			return ce.msgFetch(c, id, all, "")
+		},
+	}
+	send := &daemonTask{
+		name:     daemonSend,
+		interval: sendInterval,
+		run: func() error {
+			return ce.msgSend(c, id, all)
+		},
+	}
+	upkeep := &daemonTask{
+		name:     daemonUpkeep,
+		interval: upkeepInterval,
+		run: func() error {
+			nyms, err := ce.getNyms(id, all)
+			if err != nil {
+				return err
+			}
+			for _, nym := range nyms {
+				err := ce.upkeepAll(c, nym, upkeepInterval.String(), statfp)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	accounts := &daemonTask{
+		name:     daemonAccounts,
+		interval: accountsInterval,
+		run: func() error {
+			nyms, err := ce.getNyms(id, all)
+			if err != nil {
+				return err
+			}
+			// renewal failures of one user ID do not affect the others
+			var renewErr error
+			for _, nym := range nyms {
+				err := ce.upkeepAccounts(nym, accountsInterval.String(), "",
+					statfp)
+				if err != nil {
+					renewErr = err
+				}
+			}
+			return renewErr
+		},
+	}
+	tasks := []*daemonTask{fetch, send, upkeep, accounts}
+	observer, err := ce.observer()
+	if err != nil {
+		return err
+	}
+	if observer {
+		tasks = tasks[:1] // observers can only fetch
+	}
+
+	// run a task, failures are reported but do not stop the daemon
+	run := func(task *daemonTask) string {
+		log.Infof("ctrlengine: daemon: %s", task.name)
+		err := task.run()
+		task.schedule(jitter)
+		if err != nil {
+			err = ce.translateError(err)
+			log.Errorf("ctrlengine: daemon: %s failed: %s", task.name, err)
+			fmt.Fprintf(statfp, "ctrlengine: daemon: %s failed: %s\n",
+				task.name, err)
+			return fmt.Sprintf("error: %s", err)
+		}
+		return "ok"
+	}
+
+	// open control socket (remove stale socket of crashed daemon first)
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return log.Errorf("ctrlengine: daemon already running on %s", socket)
+		}
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		return log.Error(err)
+	}
+	reqs := make(chan *daemonRequest)
+	done := make(chan struct{})
+	defer close(done)
+	go serveDaemonSocket(l, reqs, done)
+	go cleanupLimiters(done)
+
+	// handle interrupts and termination requests (the interrupt handlers of
+	// the caller must not close the databases while a task is running)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	defer interrupt.Suspend()()
+
+	// reopen log file on SIGHUP (after external log rotation)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	log.Infof("ctrlengine: daemon started (control socket %s)", socket)
+	fmt.Fprintf(statfp, "ctrlengine: daemon started (control socket %s)\n",
+		socket)
+
+	// run all tasks once at startup
+	for _, task := range tasks {
+		run(task)
+	}
+
+	// main loop
+	for {
+		next := tasks[0]
+		for _, task := range tasks[1:] {
+			if task.next.Before(next.next) {
+				next = task
+			}
+		}
+		timer := time.NewTimer(next.next.Sub(time.Now()))
+		select {
+		case <-timer.C:
+			run(next)
+		case req := <-reqs:
+			timer.Stop()
+			switch req.cmd {
+			case daemonFetch:
+				req.reply <- run(fetch)
+			case daemonSend:
+				req.reply <- run(send)
+			case daemonUpkeep:
+				req.reply <- run(upkeep)
+			case daemonAccounts:
+				req.reply <- run(accounts)
+			case daemonRun:
+				reply := "ok"
+				for _, task := range tasks {
+					if r := run(task); r != "ok" {
+						reply = r
+					}
+				}
+				req.reply <- reply
+			case daemonStatus:
+				var status []string
+				for _, task := range tasks {
+					status = append(status, fmt.Sprintf("%s=%s", task.name,
+						task.next.Format(time.RFC3339)))
+				}
+				req.reply <- strings.Join(status, " ")
+			case daemonStop:
+				req.reply <- "ok"
+				log.Info("ctrlengine: daemon stopped (control socket)")
+				fmt.Fprintln(statfp, "ctrlengine: daemon stopped")
+				return nil
+			default:
+				req.reply <- fmt.Sprintf("error: unknown command '%s'", req.cmd)
+			}
+		case <-hups:
+			timer.Stop()
+			if err := log.Reopen(); err != nil {
+				fmt.Fprintf(statfp, "ctrlengine: cannot reopen log: %s\n", err)
+			}
+			log.Info("ctrlengine: log reopened (SIGHUP)")
+		case sig := <-sigs:
+			timer.Stop()
+			log.Infof("ctrlengine: daemon stopped (%s)", sig)
+			fmt.Fprintln(statfp, "ctrlengine: daemon stopped")
+			return nil
+		}
+	}
+}
+
+// daemonControl sends the command cmd to the daemon listening on the control
+// socket and writes the reply to w.
+func daemonControl(homedir, socket, cmd string, w io.Writer) error {
+	socket = daemonSocketPath(homedir, socket)
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return log.Errorf("ctrlengine: daemon not running: %s", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return log.Error(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return log.Error(err)
+	}
+	reply = strings.TrimSpace(reply)
+	if strings.HasPrefix(reply, "error: ") {
+		return log.Errorf("ctrlengine: daemon: %s",
+			strings.TrimPrefix(reply, "error: "))
+	}
+	fmt.Fprintln(w, reply)
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mutecomm/mute/util/ratelimit"
+)
+
+// resetLimiters replaces the global rate limiters with fresh ones and returns
+// a function to restore them.
+func resetLimiters() func() {
+	api, expensive := apiLimiter, expensiveLimiter
+	apiLimiter = ratelimit.New(10, 50)
+	expensiveLimiter = ratelimit.New(0.2, 3)
+	return func() {
+		apiLimiter, expensiveLimiter = api, expensive
+	}
+}
+
+func TestDaemonSocket(t *testing.T) {
+	defer resetLimiters()()
+	tmpdir, err := ioutil.TempDir("", "ctrlengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	socket := daemonSocketPath(tmpdir, "")
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocketDir(socket); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	reqs := make(chan *daemonRequest)
+	done := make(chan struct{})
+	go serveDaemonSocket(l, reqs, done)
+
+	// fake daemon loop
+	go func() {
+		for i := 0; i < 2; i++ {
+			req := <-reqs
+			switch req.cmd {
+			case daemonStatus:
+				req.reply <- "fetch=now"
+			default:
+				req.reply <- "error: failed"
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	if err := daemonControl(tmpdir, "", daemonStatus, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "fetch=now\n" {
+		t.Errorf("wrong reply: %q", buf.String())
+	}
+	err = daemonControl(tmpdir, "", daemonFetch, &buf)
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("daemonControl() should fail: %v", err)
+	}
+
+	// open connection of a client while the daemon stops
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	close(done)
+	// connection handlers do not block after the daemon stopped
+	errc := make(chan error, 1)
+	go func() {
+		errc <- daemonControl(tmpdir, "", daemonStatus, ioutil.Discard)
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("daemonControl() should fail after the daemon stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemonControl() blocks after the daemon stopped")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("idle connection should be closed after the daemon stopped")
+	}
+}
+
+func TestCheckSocketDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+	tmpdir, err := ioutil.TempDir("", "ctrlengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	socket := filepath.Join(tmpdir, daemonSocket)
+	if err := os.Chmod(tmpdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocketDir(socket); err == nil {
+		t.Error("checkSocketDir() should fail for world readable directory")
+	}
+	if err := os.Chmod(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocketDir(socket); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllowDaemonCommand(t *testing.T) {
+	defer resetLimiters()()
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if allowDaemonCommand(daemonRun) {
+			allowed++
+		}
+	}
+	if allowed == 0 || allowed == 10 {
+		t.Errorf("expensive commands should be limited: %d allowed", allowed)
+	}
+	if !allowDaemonCommand(daemonStatus) {
+		t.Error("cheap commands should not be limited by expensive ones")
+	}
+}
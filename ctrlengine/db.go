@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -19,18 +18,22 @@ import (
 
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/util/strength"
+	"github.com/mutecomm/mute/util/unlock"
+	"github.com/peterh/liner"
 	"github.com/urfave/cli"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
-func createKeyDB(
+func (ce *CtrlEngine) createKeyDB(
 	c *cli.Context,
 	w io.Writer,
 	outputFD uintptr,
 	passphrase []byte,
+	iterations int,
 ) error {
 	args := []string{
 		"--output-fd", strconv.Itoa(int(outputFD)),
@@ -44,9 +47,10 @@ func createKeyDB(
 	}
 	args = append(args,
 		"db", "create",
-		"--iterations", strconv.Itoa(c.Int("iterations")),
+		"--iterations", strconv.Itoa(iterations),
+		"--weak-passphrase", // passphrase strength already checked
 	)
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
@@ -81,59 +85,44 @@ func (ce *CtrlEngine) dbCreate(
 	c *cli.Context,
 ) error {
 	msgdbname := filepath.Join(c.GlobalString("homedir"), "msgs")
-	// read passphrase
-	fmt.Fprintf(statusfp, "read passphrase from fd %d (not echoed)\n",
-		ce.fileTable.PassphraseFD)
-	log.Infof("read passphrase from fd %d (not echoed)",
-		ce.fileTable.PassphraseFD)
-	var (
-		scanner     *bufio.Scanner
-		passphrase  []byte
-		passphrase2 []byte
-		err         error
-	)
+	// read passphrase twice
+	passphrase, err := ce.readPassphrase(statusfp, "passphrase", false)
 	defer bzero.Bytes(passphrase)
-	defer bzero.Bytes(passphrase2)
-	isTerminal := terminal.IsTerminal(int(ce.fileTable.PassphraseFD))
-	if isTerminal {
-		passphrase, err = terminal.ReadPassword(int(ce.fileTable.PassphraseFD))
-		if err != nil {
-			return log.Error(err)
-		}
-	} else {
-		scanner = bufio.NewScanner(ce.fileTable.PassphraseFP)
-		if scanner.Scan() {
-			passphrase = scanner.Bytes()
-		} else if err := scanner.Err(); err != nil {
-			return log.Error(err)
-		}
+	if err != nil {
+		return err
 	}
-	log.Info("done")
-	// read passphrase again
-	fmt.Fprintf(statusfp, "read passphrase from fd %d again (not echoed)\n",
-		ce.fileTable.PassphraseFD)
-	log.Infof("read passphrase from fd %d again (not echoed)",
-		ce.fileTable.PassphraseFD)
-	if isTerminal {
-		passphrase2, err = terminal.ReadPassword(int(ce.fileTable.PassphraseFD))
-		if err != nil {
-			return log.Error(err)
-		}
-	} else {
-		if scanner.Scan() {
-			passphrase2 = scanner.Bytes()
-		} else if err := scanner.Err(); err != nil {
-			return log.Error(err)
-		}
+	passphrase2, err := ce.readPassphrase(statusfp, "passphrase", true)
+	defer bzero.Bytes(passphrase2)
+	if err != nil {
+		return err
 	}
-	log.Info("done")
+	ce.closePassphraseFD()
 	// compare passphrases
 	if !bytes.Equal(passphrase, passphrase2) {
 		return log.Error(ErrPassphrasesDiffer)
 	}
+	// check passphrase strength
+	if r := strength.Estimate(passphrase); r.Weak() {
+		if !c.Bool("weak-passphrase") {
+			return log.Errorf("passphrase too weak: %s (use --weak-passphrase to override)",
+				r.Warning)
+		}
+		fmt.Fprintf(statusfp, "WARNING: weak passphrase: %s\n", r.Warning)
+		log.Warnf("weak passphrase: %s", r.Warning)
+	}
+	// calibrate KDF
+	iterations := c.Int("iterations")
+	if iterations == 0 {
+		unlockTime := c.Duration("unlock-time")
+		fmt.Fprintf(statusfp, "calibrating KDF for unlock time %s...\n",
+			unlockTime)
+		iterations = encdb.Calibrate(unlockTime)
+		fmt.Fprintf(statusfp, "using %d KDF iterations\n", iterations)
+		log.Infof("calibrated %d KDF iterations", iterations)
+	}
 	// create msgDB
 	log.Infof("create msgDB '%s'", msgdbname)
-	if err := msgdb.Create(msgdbname, passphrase, c.Int("iterations")); err != nil {
+	if err := msgdb.Create(msgdbname, passphrase, iterations); err != nil {
 		return err
 	}
 	// open msgDB
@@ -142,6 +131,11 @@ func (ce *CtrlEngine) dbCreate(
 		return err
 	}
 	defer msgDB.Close()
+	// store KDF iterations
+	err = msgDB.AddValue(msgdb.KDFIterations, strconv.Itoa(iterations))
+	if err != nil {
+		return err
+	}
 	// configure to make sure mutecrypt has config file
 	err = ce.upkeepFetchconf(msgDB, homedir, false, nil, statusfp)
 	if err != nil {
@@ -149,7 +143,8 @@ func (ce *CtrlEngine) dbCreate(
 	}
 	// create keyDB
 	log.Info("create keyDB")
-	if err := createKeyDB(c, w, ce.fileTable.OutputFD, passphrase); err != nil {
+	err = ce.createKeyDB(c, w, ce.fileTable.OutputFD, passphrase, iterations)
+	if err != nil {
 		return err
 	}
 	// status
@@ -173,134 +168,93 @@ func (ce *CtrlEngine) dbCreate(
 	return printWalletKey(w, walletKey)
 }
 
-func rekeyKeyDB(c *cli.Context, oldPassphrase, newPassphrase []byte) error {
-	cmd := exec.Command("mutecrypt",
-		"--passphrase-fd", "stdin",
-		"--homedir", c.GlobalString("homedir"),
-		"--loglevel", c.GlobalString("loglevel"),
-		"--logdir", c.GlobalString("logdir"),
-		"db", "rekey",
-		"--iterations", strconv.Itoa(c.Int("iterations")))
-	stdin, err := cmd.StdinPipe()
+// rekey MsgDB and KeyDB.
+func (ce *CtrlEngine) dbRekey(statusfp io.Writer, c *cli.Context) error {
+	homedir := c.GlobalString("homedir")
+	cfg, err := unlock.Load(homedir)
 	if err != nil {
-		return err
-	}
-	var errbuf bytes.Buffer
-	cmd.Stderr = &errbuf
-	if err := cmd.Start(); err != nil {
-		return err
+		return log.Error(err)
 	}
-	olen := len(oldPassphrase)
-	nlen := len(newPassphrase)
-	buf := make([]byte, olen+1+nlen+1+nlen+1)
-	defer bzero.Bytes(buf)
-	copy(buf, oldPassphrase)
-	copy(buf[olen:], []byte("\n"))
-	copy(buf[olen+1:], newPassphrase)
-	copy(buf[olen+1+nlen:], []byte("\n"))
-	copy(buf[olen+1+nlen+1:], newPassphrase)
-	copy(buf[olen+1+nlen+1+nlen:], []byte("\n"))
-	if _, err := stdin.Write(buf); err != nil {
-		return err
+	if !cfg.NeedsPassphrase() {
+		return log.Errorf("ctrlengine: databases are unlocked with %s alone "+
+			"(use 'db removekeyfile' first)", cfg.Source())
 	}
-	stdin.Close()
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	// use passphrase from guarded buffer as old passphrase, if available
+	var oldPassphrase []byte
+	if ce.passphrase != nil {
+		oldPassphrase = append([]byte(nil), ce.passphrase...)
+	} else {
+		oldPassphrase, err = ce.unlockPassphrase(statusfp, homedir, "old passphrase")
 	}
-	return nil
-}
-
-// rekey MsgDB and KeyDB.
-func (ce *CtrlEngine) dbRekey(statusfp io.Writer, c *cli.Context) error {
-	msgdbname := filepath.Join(c.GlobalString("homedir"), "msgs")
-	// read old passphrase
-	fmt.Fprintf(statusfp, "read old passphrase from fd %d (not echoed)\n",
-		ce.fileTable.PassphraseFD)
-	log.Infof("read old passphrase from fd %d (not echoed)",
-		ce.fileTable.PassphraseFD)
-	var (
-		scanner        *bufio.Scanner
-		oldPassphrase  []byte
-		newPassphrase  []byte
-		newPassphrase2 []byte
-		err            error
-	)
 	defer bzero.Bytes(oldPassphrase)
-	defer bzero.Bytes(newPassphrase)
-	defer bzero.Bytes(newPassphrase2)
-	isTerminal := terminal.IsTerminal(int(ce.fileTable.PassphraseFD))
-	if isTerminal {
-		oldPassphrase, err = terminal.ReadPassword(int(ce.fileTable.PassphraseFD))
-		if err != nil {
-			return log.Error(err)
-		}
-	} else {
-		scanner = bufio.NewScanner(ce.fileTable.PassphraseFP)
-		if scanner.Scan() {
-			oldPassphrase = scanner.Bytes()
-		} else if err := scanner.Err(); err != nil {
-			return log.Error(err)
-		}
+	if err != nil {
+		return err
 	}
-	log.Info("done")
-	// read new passphrase
-	fmt.Fprintf(statusfp, "read new passphrase from fd %d (not echoed)\n",
-		ce.fileTable.PassphraseFD)
-	log.Infof("read new passphrase from fd %d (not echoed)",
-		ce.fileTable.PassphraseFD)
-	if isTerminal {
-		newPassphrase, err = terminal.ReadPassword(int(ce.fileTable.PassphraseFD))
-		if err != nil {
-			return log.Error(err)
-		}
-	} else {
-		if scanner.Scan() {
-			newPassphrase = scanner.Bytes()
-		} else if err := scanner.Err(); err != nil {
-			return log.Error(err)
-		}
+	// read new passphrase twice
+	newPassphrase, err := ce.readPassphrase(statusfp, "new passphrase", false)
+	defer bzero.Bytes(newPassphrase)
+	if err != nil {
+		return err
 	}
-	log.Info("done")
-	// read new passphrase again
-	fmt.Fprintf(statusfp, "read new passphrase from fd %d again (not echoed)\n",
-		ce.fileTable.PassphraseFD)
-	log.Infof("read new passphrase from fd %d again (not echoed)",
-		ce.fileTable.PassphraseFD)
-	if isTerminal {
-		newPassphrase2, err = terminal.ReadPassword(int(ce.fileTable.PassphraseFD))
-		if err != nil {
-			return log.Error(err)
-		}
-	} else {
-		if scanner.Scan() {
-			newPassphrase2 = scanner.Bytes()
-		} else if err := scanner.Err(); err != nil {
-			return log.Error(err)
-		}
+	newPassphrase2, err := ce.readPassphrase(statusfp, "new passphrase", true)
+	defer bzero.Bytes(newPassphrase2)
+	if err != nil {
+		return err
 	}
-	log.Info("done")
+	ce.closePassphraseFD()
 	// compare new passphrases
 	if !bytes.Equal(newPassphrase, newPassphrase2) {
 		return log.Error(ErrPassphrasesDiffer)
 	}
-	// rekey msgDB
-	log.Infof("rekey msgDB '%s'", msgdbname)
-	if err := msgdb.Rekey(msgdbname, oldPassphrase, newPassphrase, c.Int("iterations")); err != nil {
-		return err
+	// keep keyfile, if configured
+	newSecret, err := cfg.Unlock(newPassphrase)
+	if err != nil {
+		return log.Error(err)
 	}
-	// rekey keyDB
-	log.Info("rekey keyDB")
-	return rekeyKeyDB(c, oldPassphrase, newPassphrase)
+	defer bzero.Bytes(newSecret)
+	return ce.rekeyDBs(c, oldPassphrase, newSecret)
 }
 
-func mutecryptDBStatus(c *cli.Context, w io.Writer, passphrase []byte) error {
+// rekeyCommit is the name of the commit marker file in the home directory
+// which is used to rekey msgDB and keyDB consistently (see encdb.BeginRekeys).
+const rekeyCommit = "rekey.commit"
+
+// rekeyDBs rekeys msgDB and keyDB from the unlock secret oldSecret to
+// newSecret. The rekey operations are journaled together, an interrupted
+// rekey is either rolled back or completed for both databases on the next
+// open.
+func (ce *CtrlEngine) rekeyDBs(c *cli.Context, oldSecret, newSecret []byte) error {
+	homedir := c.GlobalString("homedir")
+	dbnames := []string{
+		filepath.Join(homedir, "msgs"),
+		filepath.Join(homedir, "keys"),
+	}
+	marker := filepath.Join(homedir, rekeyCommit)
+	log.Infof("rekey msgDB and keyDB in '%s'", homedir)
+	err := encdb.BeginRekeys(marker, dbnames, oldSecret, newSecret,
+		c.Int("iterations"))
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := encdb.CommitRekeys(marker, dbnames); err != nil {
+		return log.Error(err)
+	}
+	// keep guarded buffer in sync for the rest of the session
+	if ce.passphrase != nil {
+		bzero.Bytes(ce.passphrase)
+		ce.passphrase = append([]byte(nil), newSecret...)
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) mutecryptDBStatus(c *cli.Context, w io.Writer, passphrase []byte) error {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 		"db", "status",
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	cmd.Stdout = w
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -329,13 +283,13 @@ func (ce *CtrlEngine) dbStatus(c *cli.Context, w io.Writer) error {
 	fmt.Fprintf(w, "msgdb:\n")
 	fmt.Fprintf(w, "auto_vacuum=%s\n", autoVacuum)
 	fmt.Fprintf(w, "freelist_count=%d\n", freelistCount)
-	if err := mutecryptDBStatus(c, w, ce.passphrase); err != nil {
+	if err := ce.mutecryptDBStatus(c, w, ce.passphrase); err != nil {
 		return log.Error(err)
 	}
 	return nil
 }
 
-func mutecryptDBVacuum(
+func (ce *CtrlEngine) mutecryptDBVacuum(
 	c *cli.Context,
 	passphrase []byte,
 	autoVacuumMode string,
@@ -349,7 +303,7 @@ func mutecryptDBVacuum(
 	if autoVacuumMode != "" {
 		args = append(args, "--auto-vacuum", autoVacuumMode)
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -373,13 +327,13 @@ func (ce *CtrlEngine) dbVacuum(c *cli.Context, autoVacuumMode string) error {
 	if err := ce.msgDB.Vacuum(autoVacuumMode); err != nil {
 		return err
 	}
-	if err := mutecryptDBVacuum(c, ce.passphrase, autoVacuumMode); err != nil {
+	if err := ce.mutecryptDBVacuum(c, ce.passphrase, autoVacuumMode); err != nil {
 		return log.Error(err)
 	}
 	return nil
 }
 
-func mutecryptDBIncremental(
+func (ce *CtrlEngine) mutecryptDBIncremental(
 	c *cli.Context,
 	passphrase []byte,
 	pages int64,
@@ -393,7 +347,7 @@ func mutecryptDBIncremental(
 	if pages != 0 {
 		args = append(args, "--pages", strconv.FormatInt(pages, 10))
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -417,21 +371,21 @@ func (ce *CtrlEngine) dbIncremental(c *cli.Context, pagesToRemove int64) error {
 	if err := ce.msgDB.Incremental(pagesToRemove); err != nil {
 		return err
 	}
-	err := mutecryptDBIncremental(c, ce.passphrase, pagesToRemove)
+	err := ce.mutecryptDBIncremental(c, ce.passphrase, pagesToRemove)
 	if err != nil {
 		return log.Error(err)
 	}
 	return nil
 }
 
-func mutecryptDBVersion(c *cli.Context, w io.Writer, passphrase []byte) error {
+func (ce *CtrlEngine) mutecryptDBVersion(c *cli.Context, w io.Writer, passphrase []byte) error {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 		"db", "version",
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	cmd.Stdout = w
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
@@ -459,8 +413,174 @@ func (ce *CtrlEngine) dbVersion(c *cli.Context, w io.Writer) error {
 	}
 	fmt.Fprintf(w, "msgdb:\n")
 	fmt.Fprintf(w, "version=%s\n", version)
-	if err := mutecryptDBVersion(c, w, ce.passphrase); err != nil {
+	if err := ce.mutecryptDBVersion(c, w, ce.passphrase); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) mutecryptDBSchema(c *cli.Context, w io.Writer, passphrase []byte) error {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"db", "schema",
+	}
+	cmd := ce.mutecrypt(c, args...)
+	cmd.Stdout = w
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) dbSchema(c *cli.Context, w io.Writer) error {
+	version, err := ce.msgDB.Version()
+	if err != nil {
+		return err
+	}
+	schema, err := ce.msgDB.Schema()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "msgdb:\n")
+	fmt.Fprintf(w, "version=%s\n", version)
+	for _, stmt := range schema {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	if err := ce.mutecryptDBSchema(c, w, ce.passphrase); err != nil {
 		return log.Error(err)
 	}
 	return nil
 }
+
+// mutecryptDBSQL starts a 'mutecrypt db sql' process which reads queries
+// from the returned writer.
+func (ce *CtrlEngine) mutecryptDBSQL(
+	c *cli.Context,
+	w, statusfp io.Writer,
+	passphrase []byte,
+) (*cryptCmd, io.WriteCloser, error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"db", "sql", "--readonly",
+	}
+	cmd := ce.mutecrypt(c, args...)
+	cmd.Stdout = w
+	cmd.Stderr = statusfp
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	// the in-process engine reads the passphrase after Start returns
+	cmd.closeAfterWait(ppR)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return cmd, stdin, nil
+}
+
+// open a read-only SQL prompt against MsgDB (or KeyDB, if keyDB is true).
+func (ce *CtrlEngine) dbSQL(
+	c *cli.Context,
+	w, statusfp io.Writer,
+	keyDB bool,
+	line *liner.State,
+	r io.Reader,
+) error {
+	dbname := "MsgDB"
+	if keyDB {
+		dbname = "KeyDB"
+	}
+	fmt.Fprintf(statusfp, "WARNING: debug SQL console for %s!\n", dbname)
+	fmt.Fprintf(statusfp, "WARNING: output contains private messages and "+
+		"secret key material, handle with care!\n")
+	log.Warnf("debug SQL console for %s opened", dbname)
+	var (
+		cmd   *cryptCmd
+		query io.WriteCloser
+		err   error
+	)
+	if keyDB {
+		cmd, query, err = ce.mutecryptDBSQL(c, w, statusfp, ce.passphrase)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	var scanner *bufio.Scanner
+	if line != nil {
+		fmt.Fprintln(statusfp, "enter queries (end with Ctrl-D on empty line):")
+	} else {
+		scanner = bufio.NewScanner(r)
+	}
+	for {
+		var ln string
+		if line != nil {
+			ln, err = line.Prompt("sql> ")
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return log.Error(err)
+			}
+		} else {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return log.Error(err)
+				}
+				break
+			}
+			ln = scanner.Text()
+		}
+		ln = strings.TrimSpace(ln)
+		if ln == "" {
+			continue
+		}
+		if keyDB {
+			if _, err := io.WriteString(query, ln+"\n"); err != nil {
+				return log.Error(err)
+			}
+			continue
+		}
+		columns, rows, err := ce.msgDB.QueryReadOnly(ln)
+		if err != nil {
+			// report error and continue with next query
+			fmt.Fprintf(statusfp, "error: %s\n", err)
+			continue
+		}
+		fmt.Fprintln(w, strings.Join(columns, "|"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "|"))
+		}
+	}
+	if keyDB {
+		query.Close()
+		if err := cmd.Wait(); err != nil {
+			return log.Error(err)
+		}
+	}
+	log.Infof("debug SQL console for %s closed", dbname)
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/release"
+	"github.com/urfave/cli"
+)
+
+var (
+	// identities are replaced by pseudonyms (to allow correlation)
+	identityRegexp = regexp.MustCompile(`[a-zA-Z0-9._+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]+`)
+	// long base64 or hex strings might be keys or message content
+	secretRegexp = regexp.MustCompile(`[A-Za-z0-9+/=_-]{40,}`)
+)
+
+// sanitize removes identities and potential key material from log output.
+func sanitize(buf []byte) []byte {
+	buf = secretRegexp.ReplaceAll(buf, []byte("<redacted>"))
+	return identityRegexp.ReplaceAllFunc(buf, func(id []byte) []byte {
+		h := sha256.Sum256(id)
+		return []byte("<id-" + hex.EncodeToString(h[:4]) + ">")
+	})
+}
+
+// supportBundle collects the files of a support bundle.
+type supportBundle struct {
+	files map[string][]byte
+}
+
+// add adds a copy of buf as file name to the support bundle.
+func (sb *supportBundle) add(name string, buf []byte) {
+	sb.files[name] = append([]byte(nil), buf...)
+}
+
+// write writes the support bundle as a .tar.gz archive to w.
+func (sb *supportBundle) write(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	var names []string
+	for name := range sb.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(filepath.Join("mute-support", name)),
+			Mode:    0600,
+			Size:    int64(len(sb.files[name])),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(sb.files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// doctor performs basic health checks and writes the results to w.
+func (ce *CtrlEngine) doctor(w io.Writer, homedir, logdir string) {
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(w, "%s: FAIL (%s)\n", name, err)
+		} else {
+			fmt.Fprintf(w, "%s: OK\n", name)
+		}
+	}
+	// database integrity
+	var result string
+	err := ce.msgDB.DB().QueryRow("PRAGMA integrity_check;").Scan(&result)
+	if err == nil && result != "ok" {
+		err = fmt.Errorf("%s", result)
+	}
+	check("msgdb integrity", err)
+	// interrupted rekey operations
+	for _, dbname := range []string{"msgs", "keys"} {
+		pending, err := encdb.RekeyPending(filepath.Join(homedir, dbname))
+		if err == nil && pending {
+			err = fmt.Errorf("interrupted rekey detected")
+		}
+		check(dbname+" rekey", err)
+	}
+	// configuration
+	if ce.config.Map == nil {
+		err = fmt.Errorf("no configuration")
+	} else {
+		err = nil
+	}
+	check("config", err)
+	// log directory
+	_, err = os.Stat(logdir)
+	check("logdir", err)
+	// key servers contacted by the in-process crypt engine
+	if ce.cryptEng != nil {
+		fmt.Fprintf(w, "key servers:\n")
+		ce.cryptEng.ShowKeyServerStatus(w)
+	}
+}
+
+// create a support bundle which contains sanitized logs, config versions, DB
+// schema versions, queue statistics, and doctor output, but no keys and no
+// plaintexts.
+func (ce *CtrlEngine) debugSupportBundle(
+	c *cli.Context,
+	statusfp io.Writer,
+	output string,
+) error {
+	homedir := c.GlobalString("homedir")
+	logdir := c.GlobalString("logdir")
+	sb := &supportBundle{files: make(map[string][]byte)}
+
+	// versions
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version=%s\n", version.Number)
+	fmt.Fprintf(&buf, "commit=%s\n", release.Commit)
+	fmt.Fprintf(&buf, "date=%s\n", release.Date)
+	fmt.Fprintf(&buf, "go=%s\n", runtime.Version())
+	fmt.Fprintf(&buf, "os=%s\n", runtime.GOOS)
+	fmt.Fprintf(&buf, "arch=%s\n", runtime.GOARCH)
+	sb.add("version.txt", buf.Bytes())
+
+	// config versions
+	buf.Reset()
+	netDomain, _, _ := def.ConfigParams()
+	fmt.Fprintf(&buf, "netdomain=%s\n", netDomain)
+	fmt.Fprintf(&buf, "lastsigndate=%d\n", ce.config.LastSignDate)
+	fmt.Fprintf(&buf, "configversion=%d\n", ce.config.Version)
+	var features []string
+	for name := range def.Features {
+		features = append(features, name)
+	}
+	sort.Strings(features)
+	for _, name := range features {
+		fmt.Fprintf(&buf, "%s%s=%s\n", def.FeaturePrefix, name,
+			def.Features[name])
+	}
+	sb.add("config.txt", buf.Bytes())
+
+	// DB schema versions
+	buf.Reset()
+	if err := ce.dbVersion(c, &buf); err != nil {
+		return err
+	}
+	sb.add("db.txt", buf.Bytes())
+
+	// queue statistics
+	stats, err := ce.msgDB.QueueStats()
+	if err != nil {
+		return err
+	}
+	buf.Reset()
+	fmt.Fprintf(&buf, "outqueue=%d\n", stats.OutQueue)
+	fmt.Fprintf(&buf, "outqueue_envelope=%d\n", stats.OutQueueEnvelope)
+	fmt.Fprintf(&buf, "outqueue_resend=%d\n", stats.OutQueueResend)
+	fmt.Fprintf(&buf, "inqueue=%d\n", stats.InQueue)
+	fmt.Fprintf(&buf, "inqueue_envelope=%d\n", stats.InQueueEnvelope)
+	fmt.Fprintf(&buf, "undelivered=%d\n", stats.Undelivered)
+	sb.add("queues.txt", buf.Bytes())
+
+	// doctor output
+	buf.Reset()
+	ce.doctor(&buf, homedir, logdir)
+	sb.add("doctor.txt", buf.Bytes())
+
+	// sanitized logs
+	logfiles, err := filepath.Glob(filepath.Join(logdir, "*.log*"))
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, logfile := range logfiles {
+		content, err := ioutil.ReadFile(logfile)
+		if err != nil {
+			return log.Error(err)
+		}
+		sb.add(filepath.Join("log", filepath.Base(logfile)), sanitize(content))
+	}
+
+	// write archive
+	if output == "" {
+		output = "mute-support-" + time.Now().UTC().Format("20060102-150405") +
+			".tar.gz"
+	}
+	fp, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer fp.Close()
+	if err := sb.write(fp); err != nil {
+		return log.Error(err)
+	}
+	if err := fp.Close(); err != nil {
+		return log.Error(err)
+	}
+	fmt.Fprintf(statusfp, "support bundle written to %s\n", output)
+	fmt.Fprintf(statusfp, "please review the contents before sharing it\n")
+	log.Infof("support bundle written to %s", output)
+	return nil
+}
+
+// debugLogLevel changes the logging level to level (if defined) and writes
+// the current logging level to w. Subsequently started mutecrypt and
+// muteproto processes use the new level, too.
+func debugLogLevel(w io.Writer, level string) error {
+	if level != "" {
+		if err := log.SetLevel(level); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "loglevel=%s\n", log.Level())
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util"
+)
+
+// getDomains returns the additional service domains stored in msgDB.
+func (ce *CtrlEngine) getDomains() (map[string]*def.Domain, error) {
+	domains := make(map[string]*def.Domain)
+	value, err := ce.msgDB.GetValue(msgdb.Domains)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &domains); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return domains, nil
+}
+
+// setDomains stores the additional service domains in msgDB and in the
+// domains file of homedir (for the other Mute binaries) and activates them.
+func (ce *CtrlEngine) setDomains(
+	homedir string,
+	domains map[string]*def.Domain,
+) error {
+	jsn, err := json.Marshal(domains)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := ce.msgDB.AddValue(msgdb.Domains, string(jsn)); err != nil {
+		return err
+	}
+	if err := def.WriteDomainsFile(homedir, domains); err != nil {
+		return err
+	}
+	def.SetDomains(domains)
+	return nil
+}
+
+// loadDomains activates the additional service domains stored in msgDB.
+func (ce *CtrlEngine) loadDomains() error {
+	domains, err := ce.getDomains()
+	if err != nil {
+		return err
+	}
+	def.SetDomains(domains)
+	return nil
+}
+
+// configDomains returns the domains defined by the system config.
+func configDomains() []string {
+	var domains []string
+	for key := range def.ConfigMap {
+		if strings.HasPrefix(key, "keyserver.") {
+			domains = append(domains, strings.TrimPrefix(key, "keyserver."))
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// domainList writes all service domains to w. The domains of the system
+// config are marked as default.
+func (ce *CtrlEngine) domainList(w io.Writer) error {
+	for _, domain := range configDomains() {
+		fmt.Fprintf(w, "%s\t%s\t%s\tdefault\n", domain,
+			def.ConfigMap["keyserver."+domain], util.MixAddress)
+	}
+	domains, err := ce.getDomains()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := domains[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, d.KeyServer, d.MixAddress,
+			d.AccountServer)
+	}
+	return nil
+}
+
+// domainAdd adds (or updates) the additional service domain name.
+func (ce *CtrlEngine) domainAdd(
+	homedir, name, keyServer, mixAddress, accountServer string,
+) error {
+	name = identity.MapDomain(name)
+	if name == "" || strings.ContainsAny(name, "@ \t") {
+		return log.Errorf("ctrlengine: invalid domain '%s'", name)
+	}
+	if _, ok := def.ConfigMap["keyserver."+name]; ok {
+		return log.Errorf("ctrlengine: domain %s is defined by the system config",
+			name)
+	}
+	u, err := url.Parse(keyServer)
+	if err != nil {
+		return log.Error(err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return log.Errorf("ctrlengine: key server '%s' is not an https URL",
+			keyServer)
+	}
+	domains, err := ce.getDomains()
+	if err != nil {
+		return err
+	}
+	domains[name] = &def.Domain{
+		KeyServer:     keyServer,
+		MixAddress:    mixAddress,
+		AccountServer: accountServer,
+	}
+	return ce.setDomains(homedir, domains)
+}
+
+// domainRemove removes the additional service domain name. Domains which are
+// still used by our own user IDs cannot be removed.
+func (ce *CtrlEngine) domainRemove(homedir, name string) error {
+	name = identity.MapDomain(name)
+	domains, err := ce.getDomains()
+	if err != nil {
+		return err
+	}
+	if _, ok := domains[name]; !ok {
+		return log.Errorf("ctrlengine: unknown domain %s", name)
+	}
+	nyms, err := ce.msgDB.GetNyms(true)
+	if err != nil {
+		return err
+	}
+	for _, nym := range nyms {
+		_, domain, err := identity.Split(nym)
+		if err != nil {
+			return err
+		}
+		if domain == name {
+			return log.Errorf("ctrlengine: domain %s is used by user ID %s",
+				name, nym)
+		}
+	}
+	delete(domains, name)
+	return ce.setDomains(homedir, domains)
+}
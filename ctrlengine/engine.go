@@ -0,0 +1,271 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/log"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/unlock"
+	"github.com/urfave/cli"
+)
+
+// Options defines the options of an Engine. Empty fields are set to the
+// defaults of the corresponding mutectrl options.
+type Options struct {
+	HomeDir    string   // home directory (--homedir)
+	LogDir     string   // directory to log output (--logdir)
+	LogLevel   string   // logging level (--loglevel)
+	LogConsole bool     // enable logging to console (--logconsole)
+	Offline    bool     // use offline mode (--offline)
+	KeyPort    string   // alternative port for key servers (--keyport)
+	Passphrase []byte   // passphrase of the message database (see 'db addkeyfile')
+	Status     *os.File // status output (discarded, if nil)
+}
+
+// Engine is a Go API for the functionality of mutectrl. In contrast to
+// CtrlEngine it does not read commands, passphrases, and input from file
+// descriptors and returns typed results instead of writing them to the
+// output file descriptor.
+type Engine struct {
+	ce      *CtrlEngine
+	c       *cli.Context // global options for mutecrypt and muteproto calls
+	devNull *os.File     // status output, if none was given in Options
+}
+
+// Message is a message returned by Engine.MsgRead.
+type Message struct {
+	MsgID   int64  // message ID
+	From    string // sender
+	To      string // recipient
+	Date    int64  // date of message (Unix time)
+	Subject string // subject line
+	Body    string // message body (without subject line)
+}
+
+// Open opens the message database in the home directory given in opts and
+// returns a new Engine for it. The message database must have been created
+// with `mutectrl db create` beforehand.
+func Open(opts *Options) (*Engine, error) {
+	ce := New()
+	set := flag.NewFlagSet(ce.app.Name, flag.ContinueOnError)
+	for _, f := range ce.app.Flags {
+		f.Apply(set)
+	}
+	set.SetOutput(ioutil.Discard)
+	global := map[string]string{
+		"homedir":  opts.HomeDir,
+		"logdir":   opts.LogDir,
+		"loglevel": opts.LogLevel,
+		"keyport":  opts.KeyPort,
+	}
+	for name, value := range global {
+		if value != "" {
+			if err := set.Set(name, value); err != nil {
+				return nil, log.Error(err)
+			}
+		}
+	}
+	if opts.LogConsole {
+		set.Set("logconsole", "true")
+	}
+	if opts.Offline {
+		set.Set("offline", "true")
+	}
+	e := &Engine{
+		ce: ce,
+		c:  cli.NewContext(ce.app, set, nil),
+	}
+	if err := ce.prepare(e.c, false, false); err != nil {
+		return nil, err
+	}
+	// replace file descriptors
+	status := opts.Status
+	if status == nil {
+		var err error
+		status, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		e.devNull = status
+	}
+	ce.fileTable.StatusFP = status
+	ce.fileTable.StatusFD = status.Fd()
+	ce.fileTable.OutputFP = status
+	ce.fileTable.OutputFD = status.Fd()
+	ce.fileTable.InputFP = nil
+	ce.fileTable.PassphraseFP = nil
+	ce.passphraseFDClosed = true // passphrase is only taken from opts
+	ce.fileTable.CommandFP = nil
+	cfg, err := unlock.Load(e.c.GlobalString("homedir"))
+	if err != nil {
+		e.Close()
+		return nil, log.Error(err)
+	}
+	if cfg.NeedsPassphrase() && len(opts.Passphrase) == 0 {
+		e.Close()
+		return nil, log.Error("ctrlengine: passphrase is mandatory")
+	}
+	ce.passphrase, err = cfg.Unlock(opts.Passphrase)
+	if err != nil {
+		e.Close()
+		return nil, log.Error(err)
+	}
+	if err := ce.prepare(e.c, true, false); err != nil {
+		err = ce.translateError(err)
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close closes the engine.
+func (e *Engine) Close() {
+	e.ce.Close()
+	if e.devNull != nil {
+		e.devNull.Close()
+		e.devNull = nil
+	}
+}
+
+// context returns a command context with the given string options.
+func (e *Engine) context(options map[string]string) *cli.Context {
+	set := flag.NewFlagSet("engine", flag.ContinueOnError)
+	for name, value := range options {
+		set.String(name, value, "")
+	}
+	return cli.NewContext(e.ce.app, set, e.c)
+}
+
+// SetFaultInjector sets the fault injector of the engine (see
+// FaultInjector).
+func (e *Engine) SetFaultInjector(fi FaultInjector) {
+	e.ce.SetFaultInjector(fi)
+}
+
+// UIDNew creates the new user ID id with the given fullName and mix delays
+// (0 uses the defaults). If host is not empty, it is used as alternative key
+// server hostname.
+func (e *Engine) UIDNew(id, fullName, host string, minDelay, maxDelay int32) error {
+	if minDelay == 0 {
+		minDelay = def.MinDelay
+	}
+	if maxDelay == 0 {
+		maxDelay = def.MaxDelay
+	}
+	c := e.context(map[string]string{
+		"id":        id,
+		"full-name": fullName,
+		"host":      host,
+	})
+	err := e.ce.uidNew(c, minDelay, maxDelay, host, "", 0)
+	return e.ce.translateError(err)
+}
+
+// UIDList returns the (unmapped) user IDs.
+func (e *Engine) UIDList() ([]string, error) {
+	return e.ce.msgDB.GetNyms(false)
+}
+
+// ContactAdd adds contact to the white list of user ID id. If host is not
+// empty, it is used as alternative key server hostname.
+func (e *Engine) ContactAdd(id, contact, fullName, host string) error {
+	return e.ce.translateError(e.ce.contactAdd(id, contact, fullName, host,
+		msgdb.WhiteList, e.c))
+}
+
+// ContactList returns the white listed contacts of user ID id (if blocked
+// is true the black listed contacts are returned instead).
+func (e *Engine) ContactList(id string, blocked bool) ([]string, error) {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return nil, err
+	}
+	return e.ce.msgDB.GetContacts(idMapped, blocked)
+}
+
+// MsgAdd adds the message msg from user ID from to contact to to the message
+// database (it is sent with MsgSend). If inReplyTo is not 0, the message is
+// a reply to the message with that msgID. Mix delays of 0 use the delay
+// bounds of the contact (or the defaults, if the contact has none).
+func (e *Engine) MsgAdd(
+	from, to string,
+	msg []byte,
+	inReplyTo int64,
+	permanentSignature bool,
+	minDelay, maxDelay int32,
+) error {
+	return e.ce.translateError(e.ce.msgAdd(e.c, from, []string{to}, nil, "",
+		false, permanentSignature, nil, inReplyTo, minDelay, maxDelay, 0, false,
+		nil, bytes.NewReader(msg)))
+}
+
+// MsgSend sends all undelivered messages of user ID id (or all user IDs,
+// if all is true).
+func (e *Engine) MsgSend(id string, all bool) error {
+	return e.ce.translateError(e.ce.msgSend(e.c, id, all))
+}
+
+// MsgFetch fetches new messages for user ID id (or all user IDs, if all is
+// true). If host is not empty, it is used as alternative key server
+// hostname.
+func (e *Engine) MsgFetch(id string, all bool, host string) error {
+	return e.ce.translateError(e.ce.msgFetch(e.c, id, all, host))
+}
+
+// MsgList returns the messages of user ID id.
+func (e *Engine) MsgList(id string) ([]*msgdb.MsgID, error) {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return nil, err
+	}
+	return e.ce.msgDB.GetMsgIDs(idMapped)
+}
+
+// MsgThread returns the conversation the message msgID of user ID id belongs
+// to, in chronological order.
+func (e *Engine) MsgThread(id string, msgID int64) ([]*msgdb.MsgID, error) {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return nil, err
+	}
+	return e.ce.msgDB.GetThread(idMapped, msgID)
+}
+
+// MsgRead returns the message msgID of user ID id and marks it as read.
+func (e *Engine) MsgRead(id string, msgID int64) (*Message, error) {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return nil, err
+	}
+	from, to, msg, date, err := e.ce.msgDB.GetMessage(idMapped, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.ce.msgDB.ReadMessage(msgID); err != nil {
+		return nil, err
+	}
+	subject, body := mimeMsg.SplitMessage(msg)
+	return &Message{
+		MsgID:   msgID,
+		From:    from,
+		To:      to,
+		Date:    date,
+		Subject: subject,
+		Body:    body,
+	}, nil
+}
+
+// MsgDelete deletes the message msgID of user ID id.
+func (e *Engine) MsgDelete(id string, msgID int64) error {
+	return e.ce.msgDelete(id, msgID)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/configclient"
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/msgdb"
+)
+
+var testPassphrase = []byte("passphrase")
+
+// createTestHome creates a message database in a temporary home directory
+// which can be opened in offline mode and returns the home directory.
+func createTestHome(t *testing.T, withConfig bool) string {
+	tmpdir, err := ioutil.TempDir("", "ctrlengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgdbname := filepath.Join(tmpdir, "msgs")
+	if err := msgdb.Create(msgdbname, testPassphrase, 64); err != nil {
+		os.RemoveAll(tmpdir)
+		t.Fatal(err)
+	}
+	msgDB, err := msgdb.Open(msgdbname, testPassphrase)
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		t.Fatal(err)
+	}
+	defer msgDB.Close()
+	_, privateKey, err := ed25519.GenerateKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.AddValue(msgdb.WalletKey, base64.Encode(privateKey[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !withConfig {
+		return tmpdir
+	}
+	// unsigned legacy config (applied without verification)
+	pubKey := hex.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	config := configclient.Config{
+		Map: map[string]string{
+			"mixclient.MixAddress":    "mix@mute.one",
+			"mixclient.AccountServer": "accounts.mute.one",
+			"mixclient.Sender":        "sender.mute.one",
+			"walletrpc.ServiceURL":    "https://wallet.mute.one/",
+			"keylookup.ServiceURL":    "https://keylookup.mute.one/",
+			"guardrpc.ServiceURL":     "https://guard.mute.one/",
+			"serviceguard.TrustRoot":  pubKey,
+			"mix.MaxDelay":            "1h",
+			"muteaccd.owner":          pubKey,
+			"muteaccd.usage":          "Accounts",
+		},
+	}
+	jsn, err := json.Marshal(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netDomain, _, _ := def.ConfigParams()
+	if err := msgDB.AddValue(netDomain, string(jsn)); err != nil {
+		t.Fatal(err)
+	}
+	return tmpdir
+}
+
+func TestEngine(t *testing.T) {
+	homedir := createTestHome(t, true)
+	defer os.RemoveAll(homedir)
+	e, err := Open(&Options{
+		HomeDir:    homedir,
+		LogDir:     homedir,
+		Offline:    true,
+		Passphrase: testPassphrase,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ids, err := e.UIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("new database should not contain user IDs: %v", ids)
+	}
+	// add a user ID and a contact directly
+	if err := e.ce.msgDB.AddNym("alice@mute.one", "Alice@mute.one", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	err = e.ce.msgDB.AddContact("alice@mute.one", "bob@mute.one",
+		"bob@mute.one", "Bob", msgdb.WhiteList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = e.UIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "Alice <Alice@mute.one>" {
+		t.Errorf("wrong user IDs: %v", ids)
+	}
+	contacts, err := e.ContactList("Alice@mute.one", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0] != "Bob <bob@mute.one>" {
+		t.Errorf("wrong contacts: %v", contacts)
+	}
+	contacts, err = e.ContactList("alice@mute.one", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 0 {
+		t.Errorf("blocked contacts should be empty: %v", contacts)
+	}
+	msgs, err := e.MsgList("alice@mute.one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("new user ID should not have messages: %v", msgs)
+	}
+	// adding a message for an unknown user ID fails
+	err = e.MsgAdd("carol@mute.one", "bob@mute.one", []byte("hello"), 0, false,
+		0, 0)
+	if err == nil {
+		t.Error("MsgAdd() should fail for unknown user ID")
+	}
+	if _, err := e.MsgRead("alice@mute.one", 1); err == nil {
+		t.Error("MsgRead() should fail for unknown message")
+	}
+}
+
+func TestEngineOpenFails(t *testing.T) {
+	homedir := createTestHome(t, false)
+	defer os.RemoveAll(homedir)
+	opts := &Options{
+		HomeDir: homedir,
+		LogDir:  homedir,
+		Offline: true,
+	}
+	if _, err := Open(opts); err == nil {
+		t.Error("Open() should fail without passphrase")
+	}
+	opts.Passphrase = []byte("wrong")
+	if _, err := Open(opts); err == nil {
+		t.Error("Open() should fail with wrong passphrase")
+	}
+	// config cannot be fetched in offline mode
+	opts.Passphrase = testPassphrase
+	if _, err := Open(opts); err == nil {
+		t.Error("Open() should fail without config in offline mode")
+	}
+}
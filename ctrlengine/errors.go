@@ -5,13 +5,23 @@
 package ctrlengine
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 )
 
 // ErrPassphrasesDiffer is raised when the supplied passphrases during a DB
 // creation or rekey operation differ.
 var ErrPassphrasesDiffer = errors.New("ctrlengine: passphrases differ")
 
+// ErrPassphraseFDClosed is raised when a passphrase has to be read after the
+// passphrase file descriptor has been closed outside of interactive mode.
+var ErrPassphraseFDClosed = errors.New("ctrlengine: passphrase fd closed already")
+
+// ErrObserver is raised when a command which requires the private signature
+// keys of a nym is executed on a decryption-only observer device.
+var ErrObserver = errors.New("ctrlengine: not possible on observer device (decryption-only)")
+
 // ErrUserIDOwned is raised during UID message creation, if a user ID is
 // already owned by the same user
 var ErrUserIDOwned = errors.New("user ID already owned")
@@ -23,3 +33,24 @@ var ErrUserIDTaken = errors.New("user ID already taken")
 // ErrDeliveryFailed is raised when the message delivery failed due to option
 // --fail-delivery.
 var ErrDeliveryFailed = errors.New("ctrlengine: delivery failed")
+
+// ErrInjectedFault is raised when processing failed due to an injected fault
+// (see FaultInjector).
+var ErrInjectedFault = errors.New("ctrlengine: injected fault")
+
+// SendError is returned by 'msg send --all', if sending the messages of some
+// user IDs failed. The messages of all other user IDs have been sent.
+type SendError struct {
+	Nyms   []string         // user IDs for which sending failed (in order)
+	Errors map[string]error // maps failed user IDs to their error
+}
+
+// Error returns a summary of all failed user IDs.
+func (e *SendError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "ctrlengine: sending failed for %d user ID(s):", len(e.Nyms))
+	for _, nym := range e.Nyms {
+		fmt.Fprintf(&b, "\n%s: %s", nym, e.Errors[nym])
+	}
+	return b.String()
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/mutecomm/mute/util/wallet"
+	"github.com/urfave/cli"
+)
+
+// Expiry states of UID and KeyInit messages (see upkeepExpiry).
+const (
+	expiryOK       = "ok"
+	expiryExpiring = "expiring"
+	expiryExpired  = "expired"
+)
+
+// getExpiry returns the expiry times (as Unix time) of the current UID
+// message and the latest KeyInit message (0, if there is none) of mappedID
+// and whether the UID message is renewable.
+func (ce *CtrlEngine) getExpiry(
+	c *cli.Context,
+	mappedID, host string,
+) (uidNotAfter, keyInitNotAfter int64, renewable bool, err error) {
+	out, err := ce.mutecryptRun(c, host, ce.passphrase,
+		"uid", "expiry", "--id", mappedID)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	scanner := bufio.NewScanner(bytes.NewBuffer(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "UID:":
+			uidNotAfter, err = strconv.ParseInt(parts[1], 10, 64)
+		case "RENEWABLE:":
+			renewable, err = strconv.ParseBool(parts[1])
+		case "KEYINIT:":
+			keyInitNotAfter, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if err != nil {
+			return 0, 0, false, log.Error(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, false, log.Error(err)
+	}
+	return
+}
+
+// expiryState returns the expiry state of a message which expires at notAfter
+// (Unix time), if the user is warned for the duration warn before.
+func expiryState(now, notAfter int64, warn time.Duration) string {
+	switch {
+	case notAfter <= now:
+		return expiryExpired
+	case notAfter <= now+int64(warn.Seconds()):
+		return expiryExpiring
+	default:
+		return expiryOK
+	}
+}
+
+// upkeepExpiry lists the expiry times of the UID and KeyInit messages of user
+// ID id (or all user IDs) on w and writes warnings to statfp for messages
+// which expire within warn. KeyInit messages are rotated continuously and are
+// only reported when they expire within one bucket duration. With auto set,
+// expiring UID messages are renewed on the key server and KeyInit messages
+// are refreshed, if wallet tokens are available (otherwise only a warning is
+// written). UID messages with a fixed validity period (see
+// 'uid new --valid-for') are never renewed.
+func (ce *CtrlEngine) upkeepExpiry(
+	c *cli.Context,
+	w, statfp io.Writer,
+	id string,
+	all bool,
+	host string,
+	warn time.Duration,
+	auto bool,
+) error {
+	if auto {
+		if c.GlobalBool("offline") {
+			return log.Error("ctrlengine: cannot renew messages in offline mode")
+		}
+		if err := ce.checkObserver(); err != nil {
+			return err
+		}
+	}
+	nyms, err := ce.getNyms(id, all)
+	if err != nil {
+		return err
+	}
+	now := times.Now()
+	for _, nym := range nyms {
+		uidNotAfter, keyInitNotAfter, renewable, err := ce.getExpiry(c, nym,
+			host)
+		if err != nil {
+			return err
+		}
+
+		// UID message
+		state := expiryState(now, uidNotAfter, warn)
+		fmt.Fprintf(w, "%s\tUID\t%s\t%s\n", nym,
+			time.Unix(uidNotAfter, 0).UTC().Format(time.RFC3339), state)
+		if state != expiryOK {
+			log.Warnf("ctrlengine: UID message of %s %s", nym, state)
+			fmt.Fprintf(statfp, "WARNING: UID message of %s %s at %s\n", nym,
+				state, time.Unix(uidNotAfter, 0).UTC().Format(time.RFC3339))
+			if !renewable {
+				fmt.Fprintf(statfp, "WARNING: user ID %s has a fixed validity "+
+					"period and cannot be renewed\n", nym)
+			} else if auto {
+				if err := ce.uidRenew(c, nym, host, statfp); err != nil {
+					return err
+				}
+			}
+		}
+
+		// KeyInit messages
+		if keyInitNotAfter == 0 {
+			state = expiryExpired
+			fmt.Fprintf(w, "%s\tKEYINIT\t-\t%s\n", nym, state)
+		} else {
+			state = expiryState(now, keyInitNotAfter, def.KeyInitBucketDuration)
+			fmt.Fprintf(w, "%s\tKEYINIT\t%s\t%s\n", nym,
+				time.Unix(keyInitNotAfter, 0).UTC().Format(time.RFC3339), state)
+		}
+		if state != expiryOK {
+			log.Warnf("ctrlengine: KeyInit messages of %s %s", nym, state)
+			fmt.Fprintf(statfp, "WARNING: KeyInit messages of %s %s\n", nym,
+				state)
+			if auto {
+				err := ce.upkeepKeyInit(c, nym, host, def.KeyInitBuckets,
+					def.KeyInitBucketDuration, statfp)
+				if err != nil {
+					// typically no wallet token is available, continue
+					log.Warnf("ctrlengine: cannot refresh KeyInit messages of %s: %s",
+						nym, err)
+					fmt.Fprintf(statfp, "WARNING: cannot refresh KeyInit messages "+
+						"of %s, refresh manually: %s\n", nym, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// uidRenew generates an update of the UID message of mappedID (which renews
+// its validity) and registers it with the key server. If no wallet token is
+// available, a warning is written to statfp and the UID message is not
+// renewed.
+func (ce *CtrlEngine) uidRenew(
+	c *cli.Context,
+	mappedID, host string,
+	statfp io.Writer,
+) error {
+	_, domain, err := identity.Split(mappedID)
+	if err != nil {
+		return err
+	}
+
+	// get capabilities
+	out, err := ce.mutecryptRun(c, host, ce.passphrase,
+		"caps", "show", "--domain", domain)
+	if err != nil {
+		return err
+	}
+	var caps capabilities.Capabilities
+	if err := json.Unmarshal(out, &caps); err != nil {
+		return log.Error(err)
+	}
+	owner, err := decodeED25519PubKeyBase64(caps.TKNPUBKEY)
+	if err != nil {
+		return err
+	}
+
+	// get token first, the update is only generated if it can be registered
+	token, err := wallet.GetToken(ce.client, "UID", owner)
+	if err != nil {
+		log.Warnf("ctrlengine: no wallet token available to renew %s: %s",
+			mappedID, err)
+		fmt.Fprintf(statfp, "WARNING: no wallet token available, "+
+			"renew user ID %s manually\n", mappedID)
+		return nil
+	}
+
+	// generate and register update
+	_, err = ce.mutecryptRun(c, host, ce.passphrase,
+		"uid", "genupdate", "--id", mappedID)
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return err
+	}
+	_, err = ce.mutecryptRun(c, host, ce.passphrase,
+		"uid", "update",
+		"--id", mappedID,
+		"--token", base64.Encode(token.Token))
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return err
+	}
+	ce.client.DelToken(token.Hash)
+	log.Infof("ctrlengine: user ID %s renewed on key server", mappedID)
+	fmt.Fprintf(statfp, "ctrlengine: user ID %s renewed on key server\n",
+		mappedID)
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/mailbox"
+)
+
+// mailMessageID converts the Mute message ID messageID to the RFC 5322 form.
+// Old messages without message ID get an ID derived from msgID, date, and
+// sender.
+func mailMessageID(messageID string, msgID, date int64, from string) string {
+	if messageID == "" {
+		return fmt.Sprintf("<%d.%d.%s>", date, msgID, from)
+	}
+	return "<" + messageID + ">"
+}
+
+// exportMessage converts message msgID of user ID idMapped into a mailbox
+// message. The message is not marked as read.
+func (ce *CtrlEngine) exportMessage(
+	idMapped string,
+	id *msgdb.MsgID,
+) (*mailbox.Message, error) {
+	from, to, msg, date, err := ce.msgDB.GetMessage(idMapped, id.MsgID)
+	if err != nil {
+		return nil, err
+	}
+	toList, ccList, err := ce.msgDB.GetMessageRecipients(idMapped, id.MsgID)
+	if err != nil {
+		return nil, err
+	}
+	header := mimeMsg.Header{
+		From:      from,
+		To:        to,
+		Cc:        ccList,
+		MessageID: mailMessageID(id.MessageID, id.MsgID, date, from),
+	}
+	if len(toList) > 1 {
+		header.To = strings.Join(toList, ", ")
+	}
+	if id.InReplyTo != "" {
+		header.InReplyTo = "<" + id.InReplyTo + ">"
+	}
+	attachments, err := ce.msgDB.GetAttachments(idMapped, id.MsgID)
+	if err != nil {
+		return nil, err
+	}
+	var mimeAttachments []*mimeMsg.Attachment
+	for _, a := range attachments {
+		if a.Deleted {
+			continue
+		}
+		mimeAttachments = append(mimeAttachments, &mimeMsg.Attachment{
+			Filename: a.Filename,
+			Reader:   bytes.NewReader(a.Data),
+		})
+	}
+	var buf bytes.Buffer
+	t := time.Unix(date, 0)
+	if err := mimeMsg.Export(&buf, header, t, msg, mimeAttachments); err != nil {
+		return nil, err
+	}
+	return &mailbox.Message{
+		From:    from,
+		Date:    t,
+		Data:    buf.Bytes(),
+		Seen:    !id.Incoming || id.Read,
+		Flagged: id.Star,
+	}, nil
+}
+
+// msgExport exports the messages of user ID id which match the filters of
+// 'msg list' to a mailbox with the given format in directory outDir: an mbox
+// file <id>.mbox or a Maildir <id>.
+func (ce *CtrlEngine) msgExport(
+	statusfp io.Writer,
+	id, format, outDir string,
+	starred bool,
+	from, since, subject string,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.filterMsgIDs(idMapped, starred, from, since, subject)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return log.Error(err)
+	}
+	path := filepath.Join(outDir, idMapped)
+	if format == mailbox.FormatMbox {
+		path += ".mbox"
+	}
+	w, err := mailbox.Create(format, path)
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, id := range ids {
+		msg, err := ce.exportMessage(idMapped, id)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Write(msg); err != nil {
+			w.Close()
+			return log.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("exported %d messages of %s to %s", len(ids), idMapped, path)
+	fmt.Fprintf(statusfp, "exported %d messages to %s\n", len(ids), path)
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// FaultPoint denotes a point in the processing of the outqueue and inqueue
+// where a fault can be injected.
+type FaultPoint int
+
+// Fault points.
+const (
+	// FaultEncrypt fails after a message has been encrypted, but before it
+	// has been added to the outqueue.
+	FaultEncrypt FaultPoint = iota
+	// FaultTokenSpent fails after the token for a message has been spent
+	// (and the envelope stored), but before the delivery.
+	FaultTokenSpent
+	// FaultDelivery fails in the middle of the delivery, before the
+	// envelope is handed to muteproto.
+	FaultDelivery
+	// FaultDBWrite fails before the result of a processing step is written
+	// to the message database.
+	FaultDBWrite
+)
+
+var faultPointNames = []string{
+	FaultEncrypt:    "encrypt",
+	FaultTokenSpent: "token-spent",
+	FaultDelivery:   "delivery",
+	FaultDBWrite:    "db-write",
+}
+
+// String returns the name of the fault point.
+func (point FaultPoint) String() string {
+	if int(point) < len(faultPointNames) {
+		return faultPointNames[point]
+	}
+	return "unknown"
+}
+
+// FaultInjector decides whether a fault is injected at a fault point.
+// Integration tests use it to verify the crash-consistency of the outqueue
+// and inqueue state machines.
+type FaultInjector interface {
+	// Fault returns a non-nil error, if processing should fail at point.
+	Fault(point FaultPoint) error
+}
+
+// FaultSet is a FaultInjector which fails exactly once at each of its fault
+// points, on the n-th time the fault point is reached.
+type FaultSet struct {
+	mutex  sync.Mutex
+	points map[FaultPoint]int // remaining hits until fault
+}
+
+// NewFaultSet returns a new fault set which fails on the n-th time the fault
+// point is reached, as given in points.
+func NewFaultSet(points map[FaultPoint]int) *FaultSet {
+	fs := &FaultSet{points: make(map[FaultPoint]int)}
+	for point, n := range points {
+		fs.points[point] = n
+	}
+	return fs
+}
+
+// ParseFaultSet parses a fault set specification of the form
+// "point[:n],point[:n],...", e.g. "encrypt,db-write:2".
+func ParseFaultSet(spec string) (*FaultSet, error) {
+	points := make(map[FaultPoint]int)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		parts := strings.SplitN(part, ":", 2)
+		n := 1
+		if len(parts) == 2 {
+			var err error
+			n, err = strconv.Atoi(parts[1])
+			if err != nil || n < 1 {
+				return nil, log.Errorf("ctrlengine: invalid fault count in '%s'", part)
+			}
+		}
+		var found bool
+		for point, name := range faultPointNames {
+			if name == parts[0] {
+				points[FaultPoint(point)] = n
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, log.Errorf("ctrlengine: unknown fault point '%s'", parts[0])
+		}
+	}
+	return NewFaultSet(points), nil
+}
+
+// Fault implements FaultInjector.
+func (fs *FaultSet) Fault(point FaultPoint) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	n, ok := fs.points[point]
+	if !ok {
+		return nil
+	}
+	n--
+	if n > 0 {
+		fs.points[point] = n
+		return nil
+	}
+	delete(fs.points, point)
+	return log.Errorf("%s (fault point '%s')", ErrInjectedFault, point)
+}
+
+// SetFaultInjector sets the fault injector of the control engine (nil
+// disables fault injection).
+func (ce *CtrlEngine) SetFaultInjector(fi FaultInjector) {
+	ce.faults = fi
+}
+
+// fault returns an error, if a fault is injected at point.
+func (ce *CtrlEngine) fault(point FaultPoint) error {
+	if ce.faults == nil {
+		return nil
+	}
+	return ce.faults.Fault(point)
+}
+
+// deliveryFault is a FaultInjector which fails every delivery with
+// ErrDeliveryFailed and passes the other fault points on to next.
+type deliveryFault struct {
+	next FaultInjector
+}
+
+// Fault implements FaultInjector.
+func (df deliveryFault) Fault(point FaultPoint) error {
+	if point == FaultDelivery {
+		return log.Error(ErrDeliveryFailed)
+	}
+	if df.next == nil {
+		return nil
+	}
+	return df.next.Fault(point)
+}
+
+// failDelivery lets every delivery fail (option --fail-delivery) and returns
+// a function which restores the previous fault injector.
+func (ce *CtrlEngine) failDelivery() func() {
+	faults := ce.faults
+	ce.faults = deliveryFault{next: faults}
+	return func() {
+		ce.faults = faults
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"testing"
+)
+
+func TestFailDelivery(t *testing.T) {
+	ce := &CtrlEngine{}
+	restore := ce.failDelivery()
+	if err := ce.fault(FaultDelivery); err != ErrDeliveryFailed {
+		t.Errorf("delivery should fail with ErrDeliveryFailed: %v", err)
+	}
+	if err := ce.fault(FaultEncrypt); err != nil {
+		t.Error(err)
+	}
+	restore()
+	if err := ce.fault(FaultDelivery); err != nil {
+		t.Error(err)
+	}
+	// other fault points are passed on
+	faults, err := ParseFaultSet("encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce.SetFaultInjector(faults)
+	defer ce.failDelivery()()
+	if err := ce.fault(FaultEncrypt); err == nil {
+		t.Error("encrypt should fail")
+	}
+	if err := ce.fault(FaultDelivery); err != ErrDeliveryFailed {
+		t.Errorf("delivery should fail with ErrDeliveryFailed: %v", err)
+	}
+}
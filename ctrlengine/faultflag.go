@@ -0,0 +1,35 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build faultinject
+
+package ctrlengine
+
+import (
+	"github.com/urfave/cli"
+)
+
+// faultFlags are the global flags to inject faults from the command line,
+// they are only available in builds with the faultinject tag.
+var faultFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "faults",
+		Usage:  "inject faults for testing (e.g., encrypt,db-write:2)",
+		EnvVar: "MUTEFAULTS",
+	},
+}
+
+// setFaults sets the fault injector given by option --faults (unless one has
+// been set already).
+func (ce *CtrlEngine) setFaults(c *cli.Context) error {
+	if !c.IsSet("faults") || ce.faults != nil {
+		return nil
+	}
+	faults, err := ParseFaultSet(c.String("faults"))
+	if err != nil {
+		return err
+	}
+	ce.faults = faults
+	return nil
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/imapd"
+	"github.com/mutecomm/mute/util/smtpd"
+)
+
+// defaultIMAPListen is the default listen address of the IMAP bridge.
+const defaultIMAPListen = "127.0.0.1:1143"
+
+// Mailboxes of the IMAP bridge.
+const (
+	imapInbox   = "INBOX"
+	imapSent    = "Sent"
+	imapArchive = "Archive"
+)
+
+// imapHandler implements imapd.Backend by passing the requests of the IMAP
+// sessions to the loop of the IMAP bridge (the message DB is not accessed
+// concurrently).
+type imapHandler struct {
+	ce       *CtrlEngine
+	nyms     []string
+	password string // generated password of the bridge
+	reqs     chan<- func()
+}
+
+// do executes f in the loop of the IMAP bridge.
+func (h *imapHandler) do(f func() error) error {
+	reply := make(chan error, 1)
+	h.reqs <- func() { reply <- f() }
+	return <-reply
+}
+
+// bridgePassword returns a new random password for a mail bridge. It is
+// generated on every run of the bridge and shown on the status output.
+func bridgePassword() string {
+	return cipher.RandPass(cipher.RandReader)
+}
+
+// checkBridgePassword reports whether password equals the bridge password
+// want (compared in constant time).
+func checkBridgePassword(password, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// Login logs in the user ID username, if password is the password of the
+// bridge.
+func (h *imapHandler) Login(username, password string) (imapd.User, error) {
+	if !checkBridgePassword(password, h.password) {
+		log.Warnf("ctrlengine: IMAP bridge: wrong password for %s", username)
+		return nil, imapd.ErrAuth
+	}
+	idMapped, err := identity.Map(username)
+	if err != nil {
+		return nil, imapd.ErrAuth
+	}
+	for _, nym := range h.nyms {
+		if nym == idMapped {
+			return &imapUser{h: h, idMapped: idMapped}, nil
+		}
+	}
+	return nil, imapd.ErrAuth
+}
+
+// imapUser implements imapd.User for the user ID idMapped.
+type imapUser struct {
+	h        *imapHandler
+	idMapped string
+}
+
+func (u *imapUser) Mailboxes() ([]*imapd.MailboxInfo, error) {
+	return []*imapd.MailboxInfo{
+		{Name: imapInbox},
+		{Name: imapSent, Attributes: []string{`\Sent`}},
+		{Name: imapArchive, Attributes: []string{`\Archive`}},
+	}, nil
+}
+
+// inMailbox reports whether the message id is in mailbox: received messages
+// are in INBOX, sent messages in Sent, and archived messages in Archive.
+func inMailbox(id *msgdb.MsgID, mailbox string) bool {
+	switch mailbox {
+	case imapInbox:
+		return id.Incoming && !id.Archive
+	case imapSent:
+		return !id.Incoming && !id.Archive
+	case imapArchive:
+		return id.Archive
+	}
+	return false
+}
+
+// imapFlags returns the IMAP flags of the message id.
+func imapFlags(id *msgdb.MsgID) []string {
+	var flags []string
+	if !id.Incoming || id.Read {
+		flags = append(flags, imapd.FlagSeen)
+	}
+	if id.Star {
+		flags = append(flags, imapd.FlagFlagged)
+	}
+	return flags
+}
+
+// msgIDs returns the messages in mailbox, ordered by message number.
+func (u *imapUser) msgIDs(mailbox string) ([]*msgdb.MsgID, error) {
+	ids, err := u.h.ce.msgDB.GetMsgIDs(u.idMapped)
+	if err != nil {
+		return nil, err
+	}
+	var msgIDs []*msgdb.MsgID
+	for _, id := range ids {
+		if inMailbox(id, mailbox) {
+			msgIDs = append(msgIDs, id)
+		}
+	}
+	sort.Slice(msgIDs, func(i, j int) bool {
+		return msgIDs[i].MsgID < msgIDs[j].MsgID
+	})
+	return msgIDs, nil
+}
+
+// msgID returns the message with the given uid in mailbox.
+func (u *imapUser) msgID(mailbox string, uid uint32) (*msgdb.MsgID, error) {
+	ids, err := u.msgIDs(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if id.MsgID == int64(uid) {
+			return id, nil
+		}
+	}
+	return nil, log.Errorf("ctrlengine: unknown message %d in %s", uid, mailbox)
+}
+
+func (u *imapUser) Messages(mailbox string) ([]*imapd.Message, error) {
+	var msgs []*imapd.Message
+	err := u.h.do(func() error {
+		ids, err := u.msgIDs(mailbox)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			msgs = append(msgs, &imapd.Message{
+				UID:   uint32(id.MsgID),
+				Date:  time.Unix(id.Date, 0),
+				Flags: imapFlags(id),
+			})
+		}
+		return nil
+	})
+	return msgs, err
+}
+
+func (u *imapUser) Data(mailbox string, uid uint32) ([]byte, error) {
+	var data []byte
+	err := u.h.do(func() error {
+		id, err := u.msgID(mailbox, uid)
+		if err != nil {
+			return err
+		}
+		msg, err := u.h.ce.exportMessage(u.idMapped, id)
+		if err != nil {
+			return err
+		}
+		data = msg.Data
+		return nil
+	})
+	return data, err
+}
+
+// SetFlags syncs the flags back to the message DB. Marking a received message
+// as seen marks it as read and queues a read receipt (like 'msg read'), which
+// cannot be undone.
+func (u *imapUser) SetFlags(mailbox string, uid uint32, flags []string) error {
+	return u.h.do(func() error {
+		id, err := u.msgID(mailbox, uid)
+		if err != nil {
+			return err
+		}
+		m := &imapd.Message{Flags: flags}
+		if id.Incoming && !id.Read && m.HasFlag(imapd.FlagSeen) {
+			if err := u.h.ce.msgDB.ReadMessage(id.MsgID); err != nil {
+				return err
+			}
+			// queue read receipt (only if sender opted in)
+			err := u.h.ce.msgDB.QueueReceipt(u.idMapped, id.MsgID,
+				msgdb.ReceiptRead)
+			if err != nil {
+				return err
+			}
+		}
+		if star := m.HasFlag(imapd.FlagFlagged); star != id.Star {
+			return u.h.ce.msgDB.StarMessage(u.idMapped, id.MsgID, star)
+		}
+		return nil
+	})
+}
+
+// Move archives messages (moved to Archive) or moves them back from the
+// archive (moved to INBOX or Sent, depending on the direction).
+func (u *imapUser) Move(mailbox string, uid uint32, dest string) error {
+	return u.h.do(func() error {
+		id, err := u.msgID(mailbox, uid)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		switch dest {
+		case imapArchive:
+			ok = !id.Archive
+		case imapInbox:
+			ok = id.Archive && id.Incoming
+		case imapSent:
+			ok = id.Archive && !id.Incoming
+		}
+		if !ok {
+			return log.Errorf("ctrlengine: cannot move message %d from %s to %s",
+				uid, mailbox, dest)
+		}
+		return u.h.ce.msgDB.ArchiveMessage(u.idMapped, id.MsgID,
+			dest == imapArchive)
+	})
+}
+
+// Append accepts (and discards) messages appended to Sent: mail clients save
+// copies of sent mails there, which have already been added by the SMTP
+// bridge.
+func (u *imapUser) Append(mailbox string, flags []string, date time.Time, data []byte) error {
+	if mailbox != imapSent {
+		return log.Errorf("ctrlengine: cannot append messages to %s", mailbox)
+	}
+	return nil
+}
+
+// imapBridge runs an IMAP server on the loopback address listen which gives
+// local mail clients access to the messages of the user ID id (or all user
+// IDs). Every user ID is an IMAP account (the user ID is the username) with
+// the mailboxes INBOX, Sent, and Archive. The password is generated for
+// every run and written to statfp. Read and starred messages are
+// mapped to the flags \Seen and \Flagged, flag changes and moves to and from
+// the archive are synced back to the message DB.
+func (ce *CtrlEngine) imapBridge(
+	id string,
+	all bool,
+	listen string,
+	statfp io.Writer,
+) error {
+	if !smtpd.IsLoopback(listen) {
+		return log.Errorf("ctrlengine: IMAP bridge must listen on loopback address, not %s",
+			listen)
+	}
+	nyms, err := ce.getNyms(id, all)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer l.Close()
+	reqs := make(chan func())
+	password := bridgePassword()
+	srv := &imapd.Server{
+		Backend: &imapHandler{
+			ce:       ce,
+			nyms:     nyms,
+			password: password,
+			reqs:     reqs,
+		},
+	}
+	go srv.Serve(l)
+
+	// handle interrupts
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	log.Infof("ctrlengine: IMAP bridge listening on %s", l.Addr())
+	fmt.Fprintf(statfp, "ctrlengine: IMAP bridge listening on %s\n", l.Addr())
+	fmt.Fprintf(statfp, "ctrlengine: IMAP bridge password: %s\n", password)
+
+	for {
+		select {
+		case req := <-reqs:
+			req()
+		case <-sigs:
+			log.Info("ctrlengine: IMAP bridge stopped (interrupt)")
+			fmt.Fprintln(statfp, "ctrlengine: IMAP bridge stopped")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/util/imapd"
+)
+
+func TestIMAPLogin(t *testing.T) {
+	password := bridgePassword()
+	h := &imapHandler{nyms: []string{"alice@mute.berlin"}, password: password}
+	if _, err := h.Login("Alice@mute.berlin", password); err != nil {
+		t.Error(err)
+	}
+	if _, err := h.Login("alice@mute.berlin", "wrong"); err != imapd.ErrAuth {
+		t.Errorf("wrong password should be rejected: %v", err)
+	}
+	if _, err := h.Login("alice@mute.berlin", ""); err != imapd.ErrAuth {
+		t.Errorf("empty password should be rejected: %v", err)
+	}
+	if _, err := h.Login("bob@mute.berlin", password); err != imapd.ErrAuth {
+		t.Errorf("unknown user ID should be rejected: %v", err)
+	}
+	if bridgePassword() == password {
+		t.Error("bridge passwords should be generated fresh")
+	}
+}
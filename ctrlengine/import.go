@@ -0,0 +1,319 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/addressbook"
+	"github.com/mutecomm/mute/util/mailbox"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/urfave/cli"
+)
+
+// importer maps addresses of imported contacts and messages to contacts of a
+// user ID. Unknown contacts are added (which requires a successful key
+// lookup), unless in dry-run mode.
+type importer struct {
+	ce       *CtrlEngine
+	c        *cli.Context
+	idMapped string
+	host     string
+	dryRun   bool
+	failed   map[string]bool // addresses without Mute identity
+	added    map[string]bool // contacts added (or to add in dry-run mode)
+}
+
+func (ce *CtrlEngine) newImporter(
+	c *cli.Context,
+	idMapped, host string,
+	dryRun bool,
+) *importer {
+	return &importer{
+		ce:       ce,
+		c:        c,
+		idMapped: idMapped,
+		host:     host,
+		dryRun:   dryRun,
+		failed:   make(map[string]bool),
+		added:    make(map[string]bool),
+	}
+}
+
+// known returns true, if the mapped contactMapped is a contact of the user ID.
+func (im *importer) known(contactMapped string) (bool, error) {
+	unmappedID, _, _, err := im.ce.msgDB.GetContact(im.idMapped, contactMapped)
+	if err != nil {
+		return false, err
+	}
+	return unmappedID != "", nil
+}
+
+// contact maps address to a contact of the user ID and adds the contact with
+// the given full name and contact type, if it is unknown. If address cannot be
+// mapped to a Mute identity, ok is false.
+func (im *importer) contact(
+	address, fullName string,
+	contactType msgdb.ContactType,
+) (contactMapped string, ok bool, err error) {
+	contactMapped, err = identity.Map(address)
+	if err != nil || im.failed[contactMapped] {
+		return "", false, nil
+	}
+	if im.added[contactMapped] {
+		return contactMapped, true, nil
+	}
+	known, err := im.known(contactMapped)
+	if err != nil {
+		return "", false, err
+	}
+	if known || contactMapped == im.idMapped {
+		return contactMapped, true, nil
+	}
+	if !im.dryRun {
+		err := im.ce.contactAdd(im.idMapped, address, fullName, im.host,
+			contactType, im.c)
+		if err != nil {
+			log.Infof("ctrlengine: cannot add contact %s: %s", address, err)
+			im.failed[contactMapped] = true
+			return "", false, nil
+		}
+		// contactAdd does not set the full name for new contacts
+		if fullName != "" {
+			err := im.ce.msgDB.AddContact(im.idMapped, contactMapped, address,
+				fullName, contactType)
+			if err != nil {
+				return "", false, err
+			}
+		}
+	}
+	im.added[contactMapped] = true
+	return contactMapped, true, nil
+}
+
+// contactImport imports the contacts from the address book file input with
+// the given format for user ID id. Every address which can be mapped to a
+// Mute identity becomes a contact, known contacts are skipped. In dry-run
+// mode the contacts are only listed.
+func (ce *CtrlEngine) contactImport(
+	outfp, statusfp io.Writer,
+	c *cli.Context,
+	id, format, input, host string,
+	dryRun bool,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(input)
+	if err != nil {
+		return log.Error(err)
+	}
+	entries, err := addressbook.Read(format, fp)
+	fp.Close()
+	if err != nil {
+		return log.Error(err)
+	}
+	im := ce.newImporter(c, idMapped, host, dryRun)
+	var added, skipped int
+	for _, entry := range entries {
+		for _, address := range entry.Addresses {
+			contactMapped, err := identity.Map(address)
+			if err != nil {
+				fmt.Fprintf(outfp, "skip\t%s\tnot a Mute identity\n", address)
+				skipped++
+				continue
+			}
+			if im.added[contactMapped] {
+				fmt.Fprintf(outfp, "skip\t%s\tduplicate\n", address)
+				skipped++
+				continue
+			}
+			known, err := im.known(contactMapped)
+			if err != nil {
+				return err
+			}
+			if known || contactMapped == idMapped {
+				fmt.Fprintf(outfp, "skip\t%s\tknown contact\n", address)
+				skipped++
+				continue
+			}
+			_, ok, err := im.contact(address, entry.Name, msgdb.WhiteList)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Fprintf(outfp, "skip\t%s\tnot a Mute identity\n", address)
+				skipped++
+				continue
+			}
+			fmt.Fprintf(outfp, "add\t%s\t%s\n", address, entry.Name)
+			added++
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(statusfp, "would import %d contacts (%d skipped)\n",
+			added, skipped)
+	} else {
+		log.Infof("imported %d contacts for %s from %s", added, idMapped, input)
+		fmt.Fprintf(statusfp, "imported %d contacts (%d skipped)\n", added,
+			skipped)
+	}
+	return nil
+}
+
+// importMessageID returns the message ID of an imported message. Messages
+// without message ID get an ID derived from their content, to allow the
+// deduplication of repeated imports.
+func importMessageID(messageID string, data []byte) string {
+	if messageID != "" {
+		return messageID
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:16]) + "@import"
+}
+
+// msgImport imports the messages from the mailbox input with the given format
+// into user ID id. Messages from (or to) the user ID are imported as sent
+// messages, all other messages as received messages. The senders (and
+// recipients of sent messages) must be mapped to Mute identities, unknown
+// contacts are added. Messages which have been imported before (with the same
+// message ID) are skipped. In dry-run mode the messages are only listed.
+func (ce *CtrlEngine) msgImport(
+	outfp, statusfp io.Writer,
+	c *cli.Context,
+	id, format, input, host string,
+	dryRun bool,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	msgs, err := mailbox.Read(format, input)
+	if err != nil {
+		return log.Error(err)
+	}
+	im := ce.newImporter(c, idMapped, host, dryRun)
+	seen := make(map[string]bool)
+	var imported, skipped int
+	for i, msg := range msgs {
+		header, date, subject, message, mimeAttachments, err :=
+			mimeMsg.ParseMail(bytes.NewReader(msg.Data))
+		if err != nil {
+			fmt.Fprintf(outfp, "skip\t%d\tcannot parse: %s\n", i+1, err)
+			skipped++
+			continue
+		}
+		messageID := importMessageID(header.MessageID, msg.Data)
+		exists, err := ce.msgDB.HasMessageID(idMapped, messageID)
+		if err != nil {
+			return err
+		}
+		if exists || seen[messageID] {
+			fmt.Fprintf(outfp, "skip\t%d\tduplicate %s\n", i+1, messageID)
+			skipped++
+			continue
+		}
+		seen[messageID] = true
+		// map addresses
+		var to, cc []string
+		if header.To != "" {
+			for _, address := range strings.Split(header.To, ", ") {
+				if mapped, err := identity.Map(address); err == nil {
+					address = mapped
+				}
+				to = append(to, address)
+			}
+		}
+		for _, address := range header.Cc {
+			if mapped, err := identity.Map(address); err == nil {
+				address = mapped
+			}
+			cc = append(cc, address)
+		}
+		from, ok, err := im.contact(header.From, "", msgdb.GrayList)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(outfp, "skip\t%d\tsender %s is not a Mute identity\n",
+				i+1, header.From)
+			skipped++
+			continue
+		}
+		sent := from == idMapped
+		peer := from
+		if sent {
+			peer = ""
+			for _, address := range append(append([]string(nil), to...), cc...) {
+				if address == idMapped {
+					continue
+				}
+				contactMapped, ok, err := im.contact(address, "", msgdb.WhiteList)
+				if err != nil {
+					return err
+				}
+				if ok {
+					peer = contactMapped
+					break
+				}
+			}
+			if peer == "" {
+				fmt.Fprintf(outfp,
+					"skip\t%d\tno recipient is a Mute identity\n", i+1)
+				skipped++
+				continue
+			}
+		}
+		// determine delivery date
+		if date.IsZero() {
+			date = msg.Date
+		}
+		if date.IsZero() {
+			date = time.Unix(times.Now(), 0)
+		}
+		direction := '>'
+		if sent {
+			direction = '<'
+		}
+		fmt.Fprintf(outfp, "%c\t%s\t%s\t%s\n", direction, peer,
+			date.UTC().Format("2006-01-02T15:04:05Z"), subject)
+		imported++
+		if dryRun {
+			continue
+		}
+		attachments, err := decodeAttachments(mimeAttachments)
+		if err != nil {
+			return err
+		}
+		err = ce.msgDB.ImportMessage(idMapped, peer, to, cc, date.Unix(), sent,
+			subject+"\n"+message, messageID, header.InReplyTo, attachments,
+			sent || msg.Seen, msg.Flagged)
+		if err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(statusfp, "would import %d messages (%d skipped)\n",
+			imported, skipped)
+	} else {
+		log.Infof("imported %d messages for %s from %s", imported, idMapped,
+			input)
+		fmt.Fprintf(statusfp, "imported %d messages (%d skipped)\n", imported,
+			skipped)
+	}
+	return nil
+}
@@ -0,0 +1,583 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mutecomm/mute/cryptengine"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+	mixclient "github.com/mutecomm/mute/mix/client"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/protoengine"
+	"github.com/mutecomm/mute/serviceguard/client"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/descriptors"
+	"github.com/urfave/cli"
+)
+
+// The functions in this file call the crypt engine and the proto engine
+// in-process. With the global option --subprocess the external binaries
+// mutecrypt and muteproto are executed instead.
+
+// subprocess returns true, if mutecrypt and muteproto should be executed as
+// subprocesses.
+func subprocess(c *cli.Context) bool {
+	return c.GlobalBool("subprocess")
+}
+
+// inprocCryptEngine returns the in-process crypt engine, the key database is
+// not necessarily open.
+func (ce *CtrlEngine) inprocCryptEngine(c *cli.Context) *cryptengine.CryptEngine {
+	if ce.cryptEng == nil {
+		ce.cryptEng = cryptengine.NewInProcess(c.GlobalString("homedir"))
+	}
+	return ce.cryptEng
+}
+
+// cryptEngine returns the in-process crypt engine (key database opened on
+// first use).
+func (ce *CtrlEngine) cryptEngine(c *cli.Context) (*cryptengine.CryptEngine, error) {
+	cryptEng := ce.inprocCryptEngine(c)
+	if err := cryptEng.Unlock(ce.passphrase); err != nil {
+		return nil, err
+	}
+	return cryptEng, nil
+}
+
+// cryptCmd is a mutecrypt command which is executed with the in-process crypt
+// engine or, with --subprocess, by an external mutecrypt process. It provides
+// the subset of exec.Cmd which is used to call mutecrypt, all mutecrypt
+// commands must be called with it (see mutecrypt). In both modes the
+// passphrase and command descriptors are passed in ExtraFiles.
+type cryptCmd struct {
+	Args       []string   // arguments (without the program name)
+	Stdin      io.Reader  // file descriptor 0
+	Stdout     io.Writer  // file descriptor 1
+	Stderr     io.Writer  // file descriptor 2
+	ExtraFiles []*os.File // file descriptors 3, 4, ...
+
+	cmd      *exec.Cmd                // external process
+	cryptEng *cryptengine.CryptEngine // in-process engine
+	stdin    *os.File                 // in-process input set by StdinPipe
+	stdout   *os.File                 // in-process output set by StdoutPipe
+	stderr   *os.File                 // in-process status set by StderrPipe
+	closeIn  []*os.File               // closed after Wait
+	closeOut []*os.File               // closed after execution
+	copies   sync.WaitGroup           // pending output copies
+	done     chan error               // result of in-process execution
+}
+
+// mutecrypt returns a cryptCmd to execute mutecrypt with the given args.
+func (ce *CtrlEngine) mutecrypt(c *cli.Context, args ...string) *cryptCmd {
+	cc := &cryptCmd{Args: args}
+	if subprocess(c) {
+		cc.cmd = exec.Command("mutecrypt", args...)
+	} else {
+		cc.cryptEng = ce.inprocCryptEngine(c)
+	}
+	return cc
+}
+
+// StdinPipe returns a pipe connected to the input of the command.
+func (cc *cryptCmd) StdinPipe() (io.WriteCloser, error) {
+	if cc.cmd != nil {
+		return cc.cmd.StdinPipe()
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cc.stdin = r
+	cc.closeIn = append(cc.closeIn, r)
+	return w, nil
+}
+
+// StdoutPipe returns a pipe connected to the output of the command.
+func (cc *cryptCmd) StdoutPipe() (io.ReadCloser, error) {
+	if cc.cmd != nil {
+		return cc.cmd.StdoutPipe()
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cc.stdout = w
+	cc.closeOut = append(cc.closeOut, w)
+	return r, nil
+}
+
+// StderrPipe returns a pipe connected to the status output of the command.
+func (cc *cryptCmd) StderrPipe() (io.ReadCloser, error) {
+	if cc.cmd != nil {
+		return cc.cmd.StderrPipe()
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cc.stderr = w
+	cc.closeOut = append(cc.closeOut, w)
+	return r, nil
+}
+
+// inputFile returns the file to read the input r from.
+func (cc *cryptCmd) inputFile(r io.Reader) (*os.File, error) {
+	if f, ok := r.(*os.File); ok {
+		return f, nil
+	}
+	if r == nil {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			return nil, err
+		}
+		cc.closeIn = append(cc.closeIn, f)
+		return f, nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cc.closeIn = append(cc.closeIn, pr)
+	go func() {
+		io.Copy(pw, r)
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// outputFile returns the file to write the output for w to.
+func (cc *cryptCmd) outputFile(w io.Writer) (*os.File, error) {
+	if f, ok := w.(*os.File); ok {
+		return f, nil
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cc.closeOut = append(cc.closeOut, pw)
+	cc.copies.Add(1)
+	go func() {
+		io.Copy(w, pr)
+		pr.Close()
+		cc.copies.Done()
+	}()
+	return pw, nil
+}
+
+// fileTable returns the file descriptor table for in-process execution. The
+// descriptor options in Args are resolved like in an external process: 0, 1,
+// and 2 are the standard descriptors, 3 and above are the ExtraFiles.
+func (cc *cryptCmd) fileTable() (*descriptors.Table, error) {
+	var err error
+	files := make([]*os.File, 3, 3+len(cc.ExtraFiles))
+	if files[0] = cc.stdin; files[0] == nil {
+		if files[0], err = cc.inputFile(cc.Stdin); err != nil {
+			return nil, err
+		}
+	}
+	if files[1] = cc.stdout; files[1] == nil {
+		if files[1], err = cc.outputFile(cc.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	if files[2] = cc.stderr; files[2] == nil {
+		if files[2], err = cc.outputFile(cc.Stderr); err != nil {
+			return nil, err
+		}
+	}
+	files = append(files, cc.ExtraFiles...)
+	fds := map[string]string{
+		"input-fd":      "stdin",
+		"output-fd":     "stdout",
+		"status-fd":     "stderr",
+		"passphrase-fd": "3",
+		"command-fd":    "4",
+	}
+	for i := 0; i < len(cc.Args)-1; i++ {
+		name := strings.TrimLeft(cc.Args[i], "-")
+		if _, ok := fds[name]; ok && strings.HasPrefix(cc.Args[i], "--") {
+			fds[name] = cc.Args[i+1]
+		}
+	}
+	lookup := func(name string) (uintptr, *os.File) {
+		var fd int
+		switch fds[name] {
+		case "stdin":
+			fd = 0
+		case "stdout":
+			fd = 1
+		case "stderr":
+			fd = 2
+		default:
+			fd, err = strconv.Atoi(fds[name])
+			if err != nil || fd < 0 || fd >= len(files) {
+				return 0, nil // not available, like in an external process
+			}
+		}
+		return uintptr(fd), files[fd]
+	}
+	var t descriptors.Table
+	t.InputFD, t.InputFP = lookup("input-fd")
+	t.OutputFD, t.OutputFP = lookup("output-fd")
+	t.StatusFD, t.StatusFP = lookup("status-fd")
+	t.PassphraseFD, t.PassphraseFP = lookup("passphrase-fd")
+	t.CommandFD, t.CommandFP = lookup("command-fd")
+	return &t, nil
+}
+
+// Start starts the command.
+func (cc *cryptCmd) Start() error {
+	if cc.cmd != nil {
+		if cc.Stdin != nil {
+			cc.cmd.Stdin = cc.Stdin
+		}
+		if cc.Stdout != nil {
+			cc.cmd.Stdout = cc.Stdout
+		}
+		if cc.Stderr != nil {
+			cc.cmd.Stderr = cc.Stderr
+		}
+		cc.cmd.ExtraFiles = cc.ExtraFiles
+		if err := cc.cmd.Start(); err != nil {
+			cc.closeFiles()
+			return err
+		}
+		return nil
+	}
+	files, err := cc.fileTable()
+	if err != nil {
+		cc.closeFiles()
+		return err
+	}
+	cc.done = make(chan error, 1)
+	args := append([]string{"mutecrypt"}, cc.Args...)
+	go func() {
+		err := cc.cryptEng.Exec(args, files)
+		// signal end of output to readers
+		for _, f := range cc.closeOut {
+			f.Close()
+		}
+		cc.done <- err
+	}()
+	return nil
+}
+
+// closeAfterWait closes f after the command completed (or failed to start).
+func (cc *cryptCmd) closeAfterWait(f *os.File) {
+	cc.closeIn = append(cc.closeIn, f)
+}
+
+// closeFiles closes the in-process pipes and the files registered with
+// closeAfterWait.
+func (cc *cryptCmd) closeFiles() {
+	for _, f := range cc.closeOut {
+		f.Close()
+	}
+	for _, f := range cc.closeIn {
+		f.Close()
+	}
+}
+
+// Wait waits for the command to complete.
+func (cc *cryptCmd) Wait() error {
+	var err error
+	if cc.cmd != nil {
+		err = cc.cmd.Wait()
+	} else {
+		err = <-cc.done
+		cc.copies.Wait()
+	}
+	for _, f := range cc.closeIn {
+		f.Close()
+	}
+	return err
+}
+
+// Run starts the command and waits for it to complete.
+func (cc *cryptCmd) Run() error {
+	if err := cc.Start(); err != nil {
+		return err
+	}
+	return cc.Wait()
+}
+
+// encrypt encrypts msg from user ID from to user ID to and returns the
+// encrypted message and the nymaddress to deliver it to. If a session restart
+// has been requested for to (see msgdb.RequestRestart), the session is restarted
+// with this message.
+func (ce *CtrlEngine) encrypt(
+	c *cli.Context,
+	from, to string,
+	msg []byte,
+	sign bool,
+	nymAddress string,
+) (enc, nymaddress string, err error) {
+	reset, err := ce.msgDB.RestartRequested(from, to)
+	if err != nil {
+		return "", "", err
+	}
+	enc, nymaddress, err = ce.encryptStatus(c, from, to, msg, sign,
+		nymAddress, reset)
+	if err != nil {
+		return "", "", err
+	}
+	if reset {
+		log.Infof("session %s -> %s restarted", from, to)
+		if err := ce.msgDB.ClearRestart(from, to); err != nil {
+			return "", "", err
+		}
+	}
+	return enc, nymaddress, nil
+}
+
+// encryptStatus encrypts msg from user ID from to user ID to and restarts the
+// session, if reset is true.
+func (ce *CtrlEngine) encryptStatus(
+	c *cli.Context,
+	from, to string,
+	msg []byte,
+	sign bool,
+	nymAddress string,
+	reset bool,
+) (enc, nymaddress string, err error) {
+	profile := ce.networkProfile()
+	if subprocess(c) {
+		return ce.mutecryptEncrypt(c, from, to, ce.passphrase, msg, sign,
+			nymAddress, reset, profile)
+	}
+	if err := identity.IsMapped(from); err != nil {
+		return "", "", log.Error(err)
+	}
+	if err := identity.IsMapped(to); err != nil {
+		return "", "", log.Error(err)
+	}
+	cryptEng, err := ce.cryptEngine(c)
+	if err != nil {
+		return "", "", err
+	}
+	var outbuf bytes.Buffer
+	nymaddress, err = cryptEng.Encrypt(&outbuf, from, to, sign, nymAddress,
+		uint64(profile.numOfKeys), profile.smallPadding, reset,
+		bytes.NewReader(msg))
+	if err != nil {
+		return "", "", err
+	}
+	return outbuf.String(), nymaddress, nil
+}
+
+// decrypt decrypts the encrypted message enc and returns the sender, the
+// plaintext, and the verified signature (empty for unsigned messages).
+// Messages which cannot be decrypted are reported on statusFP and an empty
+// senderID is returned. Messages of unknown sessions are reported
+// with msg.ErrSessionUnknown and the senderID (see isSessionUnknown).
+func (ce *CtrlEngine) decrypt(
+	c *cli.Context,
+	enc []byte,
+	statusFP io.Writer,
+) (senderID, message, sig string, err error) {
+	profile := ce.networkProfile()
+	if subprocess(c) {
+		return ce.mutecryptDecrypt(c, ce.passphrase, enc, profile, statusFP)
+	}
+	cryptEng, err := ce.cryptEngine(c)
+	if err != nil {
+		return "", "", "", err
+	}
+	var outbuf bytes.Buffer
+	senderID, sig, err = cryptEng.Decrypt(&outbuf, uint64(profile.numOfKeys),
+		bytes.NewReader(enc))
+	if err != nil {
+		if err == msg.ErrNoPreHeaderKey {
+			log.Warn("could not decrypt pre-header, message dropped")
+			fmt.Fprintf(statusFP,
+				"could not decrypt pre-header, message dropped\n")
+			return "", "", "", nil
+		}
+		if isSessionUnknown(err) {
+			return senderID, "", "", err
+		}
+		return "", "", "", err
+	}
+	return senderID, outbuf.String(), sig, nil
+}
+
+// protoCreate creates an envelope for the encrypted message msg.
+func protoCreate(
+	c *cli.Context,
+	msg string,
+	minDelay, maxDelay int32,
+	token, nymaddress string,
+) (string, error) {
+	if subprocess(c) {
+		return muteprotoCreate(c, msg, minDelay, maxDelay, token, nymaddress)
+	}
+	return protoengine.Create(minDelay, maxDelay, token, nymaddress, msg)
+}
+
+// protoDeliver delivers the given envelope. If resend is true, the delivery
+// has to be repeated later.
+func protoDeliver(c *cli.Context, envelope io.Reader) (resend bool, err error) {
+	if subprocess(c) {
+		return muteprotoDeliver(c, envelope)
+	}
+	resend, err = protoengine.DeliverFrom(envelope)
+	if err != nil {
+		if resend {
+			log.Warnf("RESEND:\t%s", err)
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// finalError reports whether the delivery error err returned by protoDeliver
+// is the final service guard error (the token expired).
+func finalError(c *cli.Context, err error) bool {
+	if subprocess(c) {
+		// Matching the error message string is not optimal, but the best
+		// available solution since the error results from calling another
+		// binary (muteproto).
+		return strings.HasSuffix(err.Error(), client.ErrFinal.Error())
+	}
+	return errors.Is(err, client.ErrFinal)
+}
+
+// protoFetch puts new messages for the account of myID and contactID into
+// the inqueue and returns the receive time of the newest message (0, if
+// there were no new messages).
+func protoFetch(
+	myID, contactID string,
+	msgDB *msgdb.MsgDB,
+	c *cli.Context,
+	privkey *[ed25519.PrivateKeySize]byte,
+	server string,
+	lastMessageTime int64,
+) (newMessageTime int64, err error) {
+	if subprocess(c) {
+		return muteprotoFetch(myID, contactID, msgDB, c,
+			base64.Encode(privkey[:]), server, lastMessageTime)
+	}
+	log.Debug("protoFetch()")
+	messages, err := protoengine.ListMessages(privkey, server, lastMessageTime)
+	if err != nil {
+		return 0, err
+	}
+	src := &protoSource{privkey: privkey, server: server, messages: messages}
+	return storeMessages(myID, contactID, msgDB, src)
+}
+
+// messageSource lists the messages of an account (newest first) for
+// storeMessages.
+type messageSource interface {
+	// next returns the ID of the next message, ok is false if there are no
+	// more messages.
+	next() (messageID string, ok bool, err error)
+	// fetch returns the message with the ID last returned by next.
+	fetch() (receiveTime int64, enc string, err error)
+	// quit stops listing messages.
+	quit()
+}
+
+// storeMessages puts the messages from src into the inqueue for myID and
+// contactID until a message is found which is already in the message ID
+// cache. It returns the receive time of the newest message (0, if there were
+// no new messages).
+func storeMessages(
+	myID, contactID string,
+	msgDB *msgdb.MsgDB,
+	src messageSource,
+) (newMessageTime int64, err error) {
+	cache, err := msgDB.GetMessageIDCache(myID, contactID)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		messageID, ok, err := src.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		log.Debugf("messageID=%s", messageID)
+		if cache[messageID] {
+			// message known -> abort fetching messages and remove old IDs from cache
+			src.quit()
+			err := msgDB.RemoveMessageIDCache(myID, contactID, messageID)
+			if err != nil {
+				return 0, log.Error(err)
+			}
+			break
+		}
+		// message unknown -> fetch it and add messageID to cache
+		err = msgDB.AddMessageIDCache(myID, contactID, messageID)
+		if err != nil {
+			return 0, log.Error(err)
+		}
+		receiveTime, enc, err := src.fetch()
+		if err != nil {
+			return 0, err
+		}
+		err = msgDB.AddInQueue(myID, contactID, receiveTime, enc)
+		if err != nil {
+			return 0, err
+		}
+		if newMessageTime == 0 {
+			newMessageTime = receiveTime
+		}
+	}
+	return newMessageTime, nil
+}
+
+// protoSource is the messageSource of the in-process proto engine.
+type protoSource struct {
+	privkey  *[ed25519.PrivateKeySize]byte
+	server   string
+	messages []mixclient.MessageMeta
+	pos      int
+}
+
+func (src *protoSource) next() (string, bool, error) {
+	if src.pos >= len(src.messages) {
+		return "", false, nil
+	}
+	src.pos++
+	return base64.Encode(src.messages[src.pos-1].MessageID), true, nil
+}
+
+func (src *protoSource) fetch() (int64, string, error) {
+	message := src.messages[src.pos-1]
+	enc, err := protoengine.FetchMessage(src.privkey, message.MessageID,
+		src.server)
+	if err != nil {
+		return 0, "", err
+	}
+	return message.ReceiveTime, enc, nil
+}
+
+func (src *protoSource) quit() {}
+
+// isSessionUnknown returns true, if err reports a message of an unknown
+// session (see msg.ErrSessionUnknown).
+func isSessionUnknown(err error) bool {
+	return err == msg.ErrSessionUnknown
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/cryptengine"
+)
+
+func TestCryptCmdInProcess(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "ctrlengine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	var outbuf bytes.Buffer
+	cmd := &cryptCmd{
+		Args:     []string{"--homedir", tmpdir, "protocol", "describe"},
+		Stdout:   &outbuf,
+		cryptEng: cryptengine.NewInProcess(tmpdir),
+	}
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if outbuf.Len() == 0 {
+		t.Error("protocol description missing")
+	}
+	// unknown command fails like an external process
+	cmd = &cryptCmd{
+		Args:     []string{"--homedir", tmpdir, "nosuchcommand"},
+		cryptEng: cmd.cryptEng,
+	}
+	if err := cmd.Run(); err == nil {
+		t.Error("unknown command should fail")
+	}
+}
+
+func TestCryptCmdFileTable(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	cmd := &cryptCmd{
+		Args:       []string{"--status-fd", "3", "--passphrase-fd", "stdin"},
+		Stdin:      r,
+		ExtraFiles: []*os.File{w},
+	}
+	files, err := cmd.fileTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.closeFiles()
+	if files.StatusFD != 3 || files.StatusFP != w {
+		t.Errorf("status-fd not mapped to extra file: %d", files.StatusFD)
+	}
+	if files.PassphraseFD != 0 || files.PassphraseFP != r {
+		t.Errorf("passphrase-fd not mapped to stdin: %d", files.PassphraseFD)
+	}
+	// command-fd 4 is not available
+	if files.CommandFP != nil {
+		t.Error("command-fd should not be available")
+	}
+}
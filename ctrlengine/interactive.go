@@ -0,0 +1,336 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/idle"
+	"github.com/urfave/cli"
+)
+
+// getAliases returns the command aliases of the interactive mode stored in
+// msgDB (maps alias to command).
+func (ce *CtrlEngine) getAliases() (map[string]string, error) {
+	aliases := make(map[string]string)
+	value, err := ce.msgDB.GetValue(msgdb.Aliases)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &aliases); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return aliases, nil
+}
+
+func (ce *CtrlEngine) setAliases(aliases map[string]string) error {
+	jsn, err := json.Marshal(aliases)
+	if err != nil {
+		return log.Error(err)
+	}
+	return ce.msgDB.AddValue(msgdb.Aliases, string(jsn))
+}
+
+// aliasSet defines the alias name for command.
+func (ce *CtrlEngine) aliasSet(name, command string) error {
+	if strings.ContainsAny(name, " \t") {
+		return log.Errorf("ctrlengine: alias '%s' contains whitespace", name)
+	}
+	if ce.app.Command(name) != nil {
+		return log.Errorf("ctrlengine: alias '%s' is a command", name)
+	}
+	command = strings.Join(strings.Fields(command), " ")
+	if command == "" {
+		return log.Error("ctrlengine: alias command is empty")
+	}
+	aliases, err := ce.getAliases()
+	if err != nil {
+		return err
+	}
+	aliases[name] = command
+	return ce.setAliases(aliases)
+}
+
+// aliasRemove removes the alias name.
+func (ce *CtrlEngine) aliasRemove(name string) error {
+	aliases, err := ce.getAliases()
+	if err != nil {
+		return err
+	}
+	if _, ok := aliases[name]; !ok {
+		return log.Errorf("ctrlengine: unknown alias '%s'", name)
+	}
+	delete(aliases, name)
+	return ce.setAliases(aliases)
+}
+
+// aliasList writes all aliases to w.
+func (ce *CtrlEngine) aliasList(w io.Writer) error {
+	aliases, err := ce.getAliases()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, aliases[name])
+	}
+	return nil
+}
+
+// expandAlias replaces an alias at the beginning of the command line ln with
+// its command. Aliases are not expanded while the databases are locked.
+func (ce *CtrlEngine) expandAlias(ln string) (string, error) {
+	fields := strings.Fields(ln)
+	if len(fields) == 0 || ce.msgDB == nil {
+		return ln, nil
+	}
+	aliases, err := ce.getAliases()
+	if err != nil {
+		return "", err
+	}
+	command, ok := aliases[fields[0]]
+	if !ok {
+		return ln, nil
+	}
+	return strings.Join(append([]string{command}, fields[1:]...), " "), nil
+}
+
+// completer completes command lines in interactive mode: commands (and
+// aliases), the flags of commands, and user IDs and contacts as values of
+// the corresponding flags.
+type completer struct {
+	ce       *CtrlEngine
+	idle     *idle.Timer
+	commands []string            // full command names, like "msg add"
+	flags    map[string][]string // command -> flag names
+}
+
+func buildFlagMap(commands []cli.Command, prefix string, flags map[string][]string) {
+	for _, cmd := range commands {
+		if cmd.Subcommands != nil {
+			buildFlagMap(cmd.Subcommands, prefix+cmd.Name+" ", flags)
+			continue
+		}
+		var names []string
+		for _, flag := range cmd.Flags {
+			for _, name := range strings.Split(flag.GetName(), ",") {
+				names = append(names, "--"+strings.TrimSpace(name))
+			}
+		}
+		flags[prefix+cmd.Name] = names
+	}
+}
+
+func newCompleter(ce *CtrlEngine, commands []cli.Command, idleLock *idle.Timer) *completer {
+	cp := &completer{
+		ce:       ce,
+		idle:     idleLock,
+		commands: buildCmdList(commands, ""),
+		flags:    make(map[string][]string),
+	}
+	buildFlagMap(commands, "", cp.flags)
+	return cp
+}
+
+// candidate is a completion candidate for a flag value, which also matches
+// its (optional) full name.
+type candidate struct {
+	value    string
+	fullName string
+}
+
+// userIDs returns the user IDs of the message DB (unmapped).
+func (cp *completer) userIDs() []candidate {
+	nyms, err := cp.ce.msgDB.GetNyms(false)
+	if err != nil {
+		return nil
+	}
+	var candidates []candidate
+	for _, nym := range nyms {
+		candidates = append(candidates, candidate{value: nym})
+	}
+	return candidates
+}
+
+// contacts returns the contacts of user ID id (or the active user ID, if id
+// is empty).
+func (cp *completer) contacts(id string) []candidate {
+	if id == "" {
+		active, err := cp.ce.msgDB.GetValue(msgdb.ActiveUID)
+		if err != nil {
+			return nil
+		}
+		id = active
+	}
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return nil
+	}
+	contacts, err := cp.ce.msgDB.GetContacts(idMapped, false)
+	if err != nil {
+		return nil
+	}
+	var candidates []candidate
+	for _, contact := range contacts {
+		// contacts with full name have the form "Full Name <id>"
+		if i := strings.LastIndex(contact, " <"); i >= 0 {
+			candidates = append(candidates, candidate{
+				value:    strings.TrimSuffix(contact[i+2:], ">"),
+				fullName: contact[:i],
+			})
+		} else {
+			candidates = append(candidates, candidate{value: contact})
+		}
+	}
+	return candidates
+}
+
+// values returns the possible values of flag in the (partial) command line
+// fields, which are read from the message DB.
+func (cp *completer) values(flag string, fields []string) []candidate {
+	cp.idle.Begin()
+	defer cp.idle.End()
+	if cp.ce.msgDB == nil {
+		return nil // databases locked
+	}
+	switch flag {
+	case "--id", "--from":
+		return cp.userIDs()
+	case "--to", "--cc", "--contact":
+		var id string
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "--id" || fields[i] == "--from" {
+				id = fields[i+1]
+			}
+		}
+		return cp.contacts(id)
+	}
+	return nil
+}
+
+// aliases returns the defined aliases.
+func (cp *completer) aliases() []string {
+	cp.idle.Begin()
+	defer cp.idle.End()
+	if cp.ce.msgDB == nil {
+		return nil // databases locked
+	}
+	aliases, err := cp.ce.getAliases()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// complete returns the completions of the command line ln.
+func (cp *completer) complete(ln string) (c []string) {
+	// determine command
+	var command string
+	for _, cmd := range cp.commands {
+		if strings.HasPrefix(ln, cmd+" ") && len(cmd) > len(command) {
+			command = cmd
+		}
+	}
+	if command == "" {
+		commands := append(append([]string(nil), cp.commands...), cp.aliases()...)
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd, ln) {
+				c = append(c, cmd)
+			}
+		}
+		return
+	}
+	// complete the last (partial) word
+	fields := strings.Fields(ln[len(command):])
+	var partial string
+	if !strings.HasSuffix(ln, " ") && len(fields) > 0 {
+		partial = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	base := ln[:len(ln)-len(partial)]
+	if strings.HasPrefix(partial, "-") {
+		for _, flag := range cp.flags[command] {
+			if strings.HasPrefix(flag, partial) {
+				c = append(c, base+flag)
+			}
+		}
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	// complete flag value (contacts also match by full name)
+	lower := strings.ToLower(partial)
+	for _, cand := range cp.values(fields[len(fields)-1], fields) {
+		if strings.HasPrefix(cand.value, partial) ||
+			strings.HasPrefix(strings.ToLower(cand.fullName), lower) && partial != "" {
+			c = append(c, base+cand.value)
+		}
+	}
+	return
+}
+
+// editorCommand returns the editor to compose messages with ($VISUAL or
+// $EDITOR, "" if neither is set).
+func editorCommand() string {
+	if editor := os.Getenv("VISUAL"); editor != "" {
+		return editor
+	}
+	return os.Getenv("EDITOR")
+}
+
+// editMessage composes a message with the editor in a temporary file in the
+// home directory (the message is not written to a shared temp directory).
+// The file is overwritten and removed afterwards.
+func editMessage(c *cli.Context, editor string) ([]byte, error) {
+	fp, err := ioutil.TempFile(c.GlobalString("homedir"), "compose")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	filename := fp.Name()
+	fp.Close()
+	defer os.Remove(filename)
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], filename)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, log.Errorf("ctrlengine: editor %s failed: %s", editor, err)
+	}
+	msg, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	// overwrite message before removal
+	if err := ioutil.WriteFile(filename, make([]byte, len(msg)), 0600); err != nil {
+		return nil, log.Error(err)
+	}
+	if len(strings.TrimSpace(string(msg))) == 0 {
+		return nil, log.Error("ctrlengine: empty message, aborting")
+	}
+	return msg, nil
+}
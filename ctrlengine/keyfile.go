@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/unlock"
+	"github.com/urfave/cli"
+)
+
+// dbAddKeyfile binds the databases to a keyfile (or the secret printed by a
+// command) by rekeying them with the unlock secret derived from the
+// passphrase and the keyfile.
+func (ce *CtrlEngine) dbAddKeyfile(statusfp io.Writer, c *cli.Context) error {
+	homedir := c.GlobalString("homedir")
+	cfg, err := unlock.Load(homedir)
+	if err != nil {
+		return log.Error(err)
+	}
+	if cfg != nil {
+		return log.Errorf("ctrlengine: databases are already unlocked with %s "+
+			"(use 'db removekeyfile' first)", cfg.Source())
+	}
+	cfg = &unlock.Config{
+		Mode:    unlock.ModeCombined,
+		Keyfile: c.String("keyfile"),
+		Command: c.String("command"),
+	}
+	if c.Bool("keyfile-only") {
+		cfg.Mode = unlock.ModeKeyfile
+	}
+	if c.Bool("generate") {
+		if cfg.Keyfile == "" {
+			return log.Error("ctrlengine: option --generate requires --keyfile")
+		}
+		if err := unlock.GenerateKeyfile(cfg.Keyfile); err != nil {
+			return log.Error(err)
+		}
+		fmt.Fprintf(statusfp, "keyfile '%s' generated\n", cfg.Keyfile)
+		log.Infof("keyfile '%s' generated", cfg.Keyfile)
+	}
+	// get current passphrase
+	var passphrase []byte
+	if ce.passphrase != nil {
+		passphrase = append([]byte(nil), ce.passphrase...)
+	} else {
+		passphrase, err = ce.readPassphrase(statusfp, "passphrase", false)
+	}
+	defer bzero.Bytes(passphrase)
+	if err != nil {
+		return err
+	}
+	ce.closePassphraseFD()
+	// derive new unlock secret
+	secret, err := cfg.Unlock(passphrase)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer bzero.Bytes(secret)
+	// save configuration before the rekey, the databases cannot be unlocked
+	// without it afterwards
+	if err := cfg.Save(homedir); err != nil {
+		return log.Error(err)
+	}
+	if err := ce.rekeyDBs(c, passphrase, secret); err != nil {
+		if err := unlock.Remove(homedir); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	fmt.Fprintf(statusfp, "databases are unlocked with %s (%s mode)\n",
+		cfg.Source(), cfg.Mode)
+	if cfg.Mode == unlock.ModeKeyfile {
+		fmt.Fprintf(statusfp, "WARNING: the passphrase is not required "+
+			"anymore, protect the keyfile accordingly\n")
+	}
+	log.Infof("added %s (%s mode)", cfg.Source(), cfg.Mode)
+	return nil
+}
+
+// dbRemoveKeyfile removes the keyfile binding of the databases by rekeying
+// them with a new passphrase alone.
+func (ce *CtrlEngine) dbRemoveKeyfile(statusfp io.Writer, c *cli.Context) error {
+	homedir := c.GlobalString("homedir")
+	cfg, err := unlock.Load(homedir)
+	if err != nil {
+		return log.Error(err)
+	}
+	if cfg == nil {
+		return log.Error("ctrlengine: databases are not unlocked with a keyfile")
+	}
+	// get current unlock secret
+	var oldSecret []byte
+	if ce.passphrase != nil {
+		oldSecret = append([]byte(nil), ce.passphrase...)
+	} else {
+		oldSecret, err = ce.unlockPassphrase(statusfp, homedir, "passphrase")
+	}
+	defer bzero.Bytes(oldSecret)
+	if err != nil {
+		return err
+	}
+	// read new passphrase twice
+	newPassphrase, err := ce.readPassphrase(statusfp, "new passphrase", false)
+	defer bzero.Bytes(newPassphrase)
+	if err != nil {
+		return err
+	}
+	newPassphrase2, err := ce.readPassphrase(statusfp, "new passphrase", true)
+	defer bzero.Bytes(newPassphrase2)
+	if err != nil {
+		return err
+	}
+	ce.closePassphraseFD()
+	if !bytes.Equal(newPassphrase, newPassphrase2) {
+		return log.Error(ErrPassphrasesDiffer)
+	}
+	// remove configuration before the rekey, restore it on failure
+	if err := unlock.Remove(homedir); err != nil {
+		return log.Error(err)
+	}
+	if err := ce.rekeyDBs(c, oldSecret, newPassphrase); err != nil {
+		if err := cfg.Save(homedir); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	fmt.Fprintf(statusfp, "removed %s, databases are unlocked with "+
+		"passphrase alone\n", cfg.Source())
+	log.Infof("removed %s", cfg.Source())
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/serviceguard/client"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/mutecomm/mute/util/wallet"
+	"github.com/urfave/cli"
+)
+
+// keyServerArgs returns the mutecrypt options for the alternative key server
+// hostname host (if not empty) and the key server port given by --keyport.
+func keyServerArgs(c *cli.Context, host string) []string {
+	var args []string
+	if host != "" {
+		args = append(args, "--keyhost", host)
+	}
+	if port := c.GlobalString("keyport"); port != "" {
+		args = append(args, "--keyport", port)
+	}
+	return args
+}
+
+// mutecryptRun runs mutecrypt with the given args and returns its output.
+func (ce *CtrlEngine) mutecryptRun(
+	c *cli.Context,
+	host string,
+	passphrase []byte,
+	cmdArgs ...string,
+) ([]byte, error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+	}
+	if c.GlobalBool("offline") {
+		args = append(args, "--offline")
+	}
+	args = append(args, keyServerArgs(c, host)...)
+	args = append(args, cmdArgs...)
+	cmd := ce.mutecrypt(c, args...)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return nil, log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return outbuf.Bytes(), nil
+}
+
+// upkeepKeyInit makes sure that time-bucketed KeyInit messages for the next
+// buckets many buckets of the given duration are available on the key server
+// for unmappedID. KeyInit messages which are missing are added, expired ones
+// are removed by mutecrypt.
+func (ce *CtrlEngine) upkeepKeyInit(
+	c *cli.Context,
+	unmappedID, host string,
+	buckets int,
+	duration time.Duration,
+	statfp io.Writer,
+) error {
+	mappedID, domain, err := identity.MapPlus(unmappedID)
+	if err != nil {
+		return err
+	}
+
+	// how many KeyInit messages are due?
+	out, err := ce.mutecryptRun(c, host, ce.passphrase,
+		"keyinit", "due",
+		"--id", mappedID,
+		"--buckets", strconv.Itoa(buckets),
+		"--bucket-duration", duration.String())
+	if err != nil {
+		return err
+	}
+	due, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return log.Error(err)
+	}
+	if due == 0 {
+		log.Info("ctrlengine: upkeep keyinit not due")
+		fmt.Fprintf(statfp, "ctrlengine: upkeep keyinit not due\n")
+		return nil
+	}
+
+	// get capabilities
+	out, err = ce.mutecryptRun(c, host, ce.passphrase,
+		"caps", "show", "--domain", domain)
+	if err != nil {
+		return err
+	}
+	var caps capabilities.Capabilities
+	if err := json.Unmarshal(out, &caps); err != nil {
+		return log.Error(err)
+	}
+	owner, err := decodeED25519PubKeyBase64(caps.TKNPUBKEY)
+	if err != nil {
+		return err
+	}
+
+	// get mixaddress and nymaddress for KeyInit messages
+	privkey, server, secret, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(mappedID, "")
+	if err != nil {
+		return err
+	}
+	expire := times.ThirtyDaysLater() // TODO: make this settable
+	singleUse := false                // TODO correct?
+	var pubkey [ed25519.PublicKeySize]byte
+	copy(pubkey[:], privkey[32:])
+	mixaddress, nymaddress, err := util.NewNymAddress(domain, secret[:], expire,
+		singleUse, minDelay, maxDelay, mappedID, &pubkey, server, def.CACert)
+	if err != nil {
+		return err
+	}
+
+	// get tokens from wallet
+	var tokens []*client.TokenEntry
+	unlock := func() {
+		for _, token := range tokens {
+			ce.client.UnlockToken(token.Hash)
+		}
+	}
+	args := []string{
+		"keyinit", "add",
+		"--id", mappedID,
+		"--mixaddress", mixaddress,
+		"--nymaddress", nymaddress,
+		"--buckets", strconv.Itoa(due),
+		"--bucket-duration", duration.String(),
+	}
+	for i := 0; i < due; i++ {
+		token, err := wallet.GetToken(ce.client, "Message", owner)
+		if err != nil {
+			unlock()
+			return err
+		}
+		tokens = append(tokens, token)
+		args = append(args, "--token", base64.Encode(token.Token))
+	}
+
+	// add KeyInit messages
+	if _, err := ce.mutecryptRun(c, host, ce.passphrase, args...); err != nil {
+		unlock()
+		return err
+	}
+	for _, token := range tokens {
+		ce.client.DelToken(token.Hash)
+	}
+	log.Infof("ctrlengine: added %d KeyInit messages", due)
+	fmt.Fprintf(statfp, "ctrlengine: added %d KeyInit messages\n", due)
+	return nil
+}
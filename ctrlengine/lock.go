@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
+	"github.com/urfave/cli"
+)
+
+// defaultIdleLock is the default inactivity after which the databases are
+// locked in interactive mode (see option --idle-lock).
+const defaultIdleLock = 15 * time.Minute
+
+// locked reports whether the databases are locked (closed and the passphrase
+// is not in the guarded buffer).
+func (ce *CtrlEngine) locked() bool {
+	return ce.msgDB == nil && ce.cryptEng == nil && ce.passphrase == nil
+}
+
+// lock closes the databases and zeroes the guarded passphrase buffer. The
+// next command which needs the databases requests re-entry of the passphrase
+// (see getPassphrase).
+func (ce *CtrlEngine) lock() {
+	if ce.locked() {
+		return
+	}
+	ce.Close()
+	ce.passphrase = nil
+	ce.client = nil
+	log.Info("databases locked")
+}
+
+// lockCmd implements the 'lock' command.
+func (ce *CtrlEngine) lockCmd(statusfp io.Writer) {
+	ce.lock()
+	fmt.Fprintln(statusfp, "databases locked")
+}
+
+// dbLockout shows the failed unlock attempts of msgDB and keyDB and sets the
+// maximum number of failures after which their key files are destroyed, if
+// the option --max-failures is given.
+func (ce *CtrlEngine) dbLockout(w io.Writer, c *cli.Context) error {
+	homedir := c.GlobalString("homedir")
+	for _, name := range []string{"msgs", "keys"} {
+		dbname := filepath.Join(homedir, name)
+		if c.IsSet("max-failures") {
+			err := encdb.SetMaxFailures(dbname, c.Int("max-failures"))
+			if err != nil {
+				return log.Error(err)
+			}
+			log.Infof("set maximum number of failures of '%s' to %d", dbname,
+				c.Int("max-failures"))
+		}
+		failures, maxFailures, err := encdb.Attempts(dbname)
+		if err != nil {
+			return log.Error(err)
+		}
+		lockout := "disabled"
+		if maxFailures > 0 {
+			lockout = fmt.Sprintf("after %d failures", maxFailures)
+		}
+		fmt.Fprintf(w, "%s:\tfailures=%d\tlockout=%s\n", name, failures,
+			lockout)
+	}
+	return nil
+}
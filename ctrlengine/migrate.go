@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/util"
+	"github.com/urfave/cli"
+)
+
+// legacyDBs are the databases of a Mute home directory.
+var legacyDBs = []string{"msgs", "keys"}
+
+// legacyDBVersion returns the schema version of the encrypted database
+// dbname without upgrading it.
+func legacyDBVersion(dbname string, passphrase []byte) (string, error) {
+	db, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var version string
+	err = db.QueryRow("SELECT ValueEntry FROM KeyValueStore WHERE KeyEntry='Version';").
+		Scan(&version)
+	if err != nil {
+		return "", log.Error(err)
+	}
+	return version, nil
+}
+
+// copyLegacyFile copies the file src to dst (which must not exist).
+func copyLegacyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return log.Error(err)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return log.Error(err)
+	}
+	return f.Close()
+}
+
+// copyLegacyHome copies the databases and config files from the legacy home
+// directory from to homedir. Existing files are never overwritten.
+func copyLegacyHome(w io.Writer, from, homedir string) error {
+	for _, dbname := range legacyDBs {
+		for _, suffix := range []string{encdb.DBSuffix, encdb.KeySuffix} {
+			dst := filepath.Join(homedir, dbname+suffix)
+			if _, err := os.Stat(dst); err == nil {
+				return log.Errorf("ctrlengine: database file '%s' exists already, "+
+					"cannot migrate into existing home directory", dst)
+			}
+		}
+	}
+	for _, dbname := range legacyDBs {
+		for _, suffix := range []string{encdb.DBSuffix, encdb.KeySuffix} {
+			src := filepath.Join(from, dbname+suffix)
+			dst := filepath.Join(homedir, dbname+suffix)
+			if err := copyLegacyFile(src, dst); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "copied %s\n", src)
+		}
+	}
+	configdir := filepath.Join(from, "config")
+	files, err := ioutil.ReadDir(configdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return log.Error(err)
+	}
+	if err := util.CreateDirs(filepath.Join(homedir, "config")); err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		src := filepath.Join(configdir, fi.Name())
+		dst := filepath.Join(homedir, "config", fi.Name())
+		if _, err := os.Stat(dst); err == nil {
+			fmt.Fprintf(w, "skipped %s (exists already)\n", src)
+			continue
+		}
+		if err := copyLegacyFile(src, dst); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "copied %s\n", src)
+	}
+	return nil
+}
+
+// upgradeKeyDB upgrades the keyDB in homedir by opening it.
+func (ce *CtrlEngine) upgradeKeyDB(c *cli.Context, homedir string) error {
+	if subprocess(c) {
+		return ce.mutecryptDBVersion(c, ioutil.Discard, ce.passphrase)
+	}
+	keyDB, err := keydb.Open(filepath.Join(homedir, "keys"), ce.passphrase)
+	if err != nil {
+		return err
+	}
+	return keyDB.Close()
+}
+
+// convertLegacyConfig converts the configuration of legacy home directories:
+// Alpha versions stored the configuration under the plain default domain
+// instead of the network domain (e.g., "mute.one" instead of
+// "mainnet@mute.one"), in msgDB as well as in the config directory.
+func convertLegacyConfig(w io.Writer, msgDB *msgdb.MsgDB, homedir string) error {
+	netDomain, _, _ := def.ConfigParams()
+	legacyDomain := netDomain[strings.Index(netDomain, "@")+1:]
+	// configuration stored in msgDB
+	jsn, err := msgDB.GetValue(netDomain)
+	if err != nil {
+		return err
+	}
+	if jsn == "" {
+		legacy, err := msgDB.GetValue(legacyDomain)
+		if err != nil {
+			return err
+		}
+		if legacy != "" {
+			if err := msgDB.AddValue(netDomain, legacy); err != nil {
+				return err
+			}
+			t, err := msgDB.GetValue("time." + legacyDomain)
+			if err != nil {
+				return err
+			}
+			if t != "" {
+				if err := msgDB.AddValue("time."+netDomain, t); err != nil {
+					return err
+				}
+			}
+			jsn = legacy
+			fmt.Fprintf(w, "config: converted msgdb entry '%s' to '%s'\n",
+				legacyDomain, netDomain)
+		}
+	}
+	// configuration file
+	configdir := filepath.Join(homedir, "config")
+	filename := filepath.Join(configdir, netDomain)
+	if _, err := os.Stat(filename); err == nil {
+		fmt.Fprintf(w, "config: file '%s' up to date\n", filename)
+		return nil
+	}
+	legacyFile := filepath.Join(configdir, legacyDomain)
+	if _, err := os.Stat(legacyFile); err == nil {
+		if err := os.Rename(legacyFile, filename); err != nil {
+			return log.Error(err)
+		}
+		fmt.Fprintf(w, "config: renamed file '%s' to '%s'\n", legacyFile,
+			filename)
+		return nil
+	}
+	if jsn == "" {
+		fmt.Fprintf(w, "config: no configuration found (run `mutectrl upkeep fetchconf`)\n")
+		return nil
+	}
+	if err := writeConfigFile(homedir, netDomain, []byte(jsn)); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "config: wrote file '%s' from msgdb\n", filename)
+	return nil
+}
+
+// migrateLegacy migrates the legacy Mute home directory from to the current
+// home directory (in place, if they are the same): the databases (and config
+// files) are copied, the database schemas are upgraded, and the configuration
+// is converted. A report of all steps is written to w.
+func (ce *CtrlEngine) migrateLegacy(c *cli.Context, w, statfp io.Writer, from string) error {
+	homedir, err := filepath.Abs(c.GlobalString("homedir"))
+	if err != nil {
+		return log.Error(err)
+	}
+	from, err = filepath.Abs(from)
+	if err != nil {
+		return log.Error(err)
+	}
+	// detect legacy home directory
+	for _, dbname := range legacyDBs {
+		for _, suffix := range []string{encdb.DBSuffix, encdb.KeySuffix} {
+			filename := filepath.Join(from, dbname+suffix)
+			if _, err := os.Stat(filename); err != nil {
+				return log.Errorf("ctrlengine: '%s' is not a Mute home "+
+					"directory: %s", from, err)
+			}
+		}
+	}
+	// get passphrase (read it, if necessary)
+	if _, err := ce.getPassphrase(statfp, from); err != nil {
+		return err
+	}
+	// determine versions before migration
+	before := make(map[string]string)
+	for _, dbname := range legacyDBs {
+		before[dbname], err = legacyDBVersion(filepath.Join(from, dbname),
+			ce.passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	// copy legacy home directory, if necessary
+	if from != homedir {
+		fmt.Fprintf(w, "migrate %s -> %s\n", from, homedir)
+		if err := copyLegacyHome(w, from, homedir); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(w, "migrate %s in place\n", homedir)
+	}
+	// upgrade databases
+	msgDB, err := msgdb.Open(filepath.Join(homedir, "msgs"), ce.passphrase)
+	if err != nil {
+		return err
+	}
+	defer msgDB.Close()
+	if err := ce.upgradeKeyDB(c, homedir); err != nil {
+		return err
+	}
+	for _, dbname := range legacyDBs {
+		after, err := legacyDBVersion(filepath.Join(homedir, dbname),
+			ce.passphrase)
+		if err != nil {
+			return err
+		}
+		if before[dbname] == after {
+			fmt.Fprintf(w, "%s: version %s up to date\n", dbname, after)
+		} else {
+			fmt.Fprintf(w, "%s: upgraded from version %s to %s\n", dbname,
+				before[dbname], after)
+		}
+	}
+	// convert configuration
+	if err := convertLegacyConfig(w, msgDB, homedir); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: migrated legacy home directory %s", from)
+	fmt.Fprintf(w, "migration complete\n")
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"crypto/ed25519"
@@ -28,22 +29,26 @@ import (
 	"github.com/mutecomm/mute/mix/nymaddr"
 	"github.com/mutecomm/mute/msg"
 	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msg/msgid"
 	"github.com/mutecomm/mute/msgdb"
-	"github.com/mutecomm/mute/serviceguard/client"
 	"github.com/mutecomm/mute/uid/identity"
 	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/jsonclient"
+	"github.com/mutecomm/mute/util/ratelimit"
 	"github.com/mutecomm/mute/util/times"
 	"github.com/mutecomm/mute/util/wallet"
 	"github.com/peterh/liner"
 	"github.com/urfave/cli"
 )
 
-func mutecryptEncrypt(
+func (ce *CtrlEngine) mutecryptEncrypt(
 	c *cli.Context,
 	from, to string,
 	passphrase, msg []byte,
 	sign bool,
 	nymAddress string,
+	reset bool,
+	profile *networkProfile,
 ) (enc, nymaddress string, err error) {
 	if err := identity.IsMapped(from); err != nil {
 		return "", "", log.Error(err)
@@ -59,11 +64,18 @@ func mutecryptEncrypt(
 		"--from", from,
 		"--to", to,
 		"--nymaddress", nymAddress,
+		"--num-keys", strconv.Itoa(profile.numOfKeys),
 	}
 	if sign {
 		args = append(args, "--sign")
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	if profile.smallPadding {
+		args = append(args, "--small-padding")
+	}
+	if reset {
+		args = append(args, "--reset")
+	}
+	cmd := ce.mutecrypt(c, args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return "", "", err
@@ -103,15 +115,53 @@ func mutecryptEncrypt(
 	return
 }
 
+// mapRecipients maps the recipients of a message from user ID from (mapped
+// to fromMapped) and makes sure they are contacts on the white list.
+func (ce *CtrlEngine) mapRecipients(
+	fromMapped, from string,
+	recipients []string,
+) ([]string, error) {
+	var mapped []string
+	for _, recipient := range recipients {
+		recipientMapped, err := identity.Map(recipient)
+		if err != nil {
+			return nil, err
+		}
+		prev, _, contactType, err := ce.msgDB.GetContact(fromMapped,
+			recipientMapped)
+		if err != nil {
+			return nil, err
+		}
+		if prev == "" || contactType == msgdb.GrayList ||
+			contactType == msgdb.BlackList {
+			return nil, log.Errorf("contact %s not found (for user ID %s)",
+				recipient, from)
+		}
+		mapped = append(mapped, recipientMapped)
+	}
+	return mapped, nil
+}
+
+// msgAdd adds a new message from user ID from to the 'To:' recipients to and
+// the 'Cc:' recipients cc. Every recipient gets its own copy which is
+// encrypted and delivered separately (see msgdb.AddMultiMessage).
 func (ce *CtrlEngine) msgAdd(
 	c *cli.Context,
-	from, to, file string,
+	from string,
+	to, cc []string,
+	file string,
 	mailInput, permanentSignature bool,
 	attachments []string,
+	inReplyTo int64,
 	minDelay, maxDelay int32,
+	sendAfter int64,
+	noSignature bool,
 	line *liner.State,
 	r io.Reader,
 ) error {
+	if err := ce.checkObserver(); err != nil {
+		return err
+	}
 	fromMapped, err := identity.Map(from)
 	if err != nil {
 		return err
@@ -124,7 +174,6 @@ func (ce *CtrlEngine) msgAdd(
 		return log.Errorf("user ID %s not found", from)
 	}
 
-	// TODO: handle attachments
 	var msg []byte
 	if file != "" {
 		// read message from file
@@ -132,6 +181,12 @@ func (ce *CtrlEngine) msgAdd(
 		if err != nil {
 			return log.Error(err)
 		}
+	} else if editor := editorCommand(); line != nil && editor != "" {
+		// compose message with editor
+		msg, err = editMessage(c, editor)
+		if err != nil {
+			return err
+		}
 	} else if line != nil {
 		// read message from terminal
 		fmt.Fprintln(ce.fileTable.StatusFP,
@@ -161,38 +216,151 @@ func (ce *CtrlEngine) msgAdd(
 		if err != nil {
 			return err
 		}
-		to = recipient
+		to = []string{recipient}
 		msg = []byte(message)
 	}
 
-	toMapped, err := identity.Map(to)
-	if err != nil {
-		return err
+	// append signature of user ID
+	if !noSignature {
+		signature, err := ce.msgDB.GetSignature(fromMapped)
+		if err != nil {
+			return err
+		}
+		msg = appendSignature(msg, signature)
 	}
-	prev, _, contactType, err := ce.msgDB.GetContact(fromMapped, toMapped)
+
+	// read attachments
+	msgAttachments, err := readAttachments(attachments)
 	if err != nil {
 		return err
 	}
-	if prev == "" || contactType == msgdb.GrayList || contactType == msgdb.BlackList {
-		return log.Errorf("contact %s not found (for user ID %s)", to, from)
+
+	// determine message ID of message to reply to
+	var replyID string
+	if inReplyTo > 0 {
+		replyID, _, err = ce.msgDB.GetMessageHeader(fromMapped, inReplyTo)
+		if err != nil {
+			return err
+		}
+		if replyID == "" {
+			log.Warnf("ctrlengine: message %d has no message ID, cannot reply to it",
+				inReplyTo)
+		}
 	}
 
-	// store message in message DB
-	now := times.Now()
-	err = ce.msgDB.AddMessage(fromMapped, toMapped, now, true, string(msg),
-		permanentSignature, minDelay, maxDelay)
+	err = ce.addMessage(c, fromMapped, from, to, cc, string(msg),
+		msgAttachments, replyID, permanentSignature, minDelay, maxDelay,
+		sendAfter)
 	if err != nil {
 		return err
 	}
 
 	log.Info("message added")
-	if line != nil {
+	if ce.isOffline(c) {
+		fmt.Fprintln(ce.fileTable.StatusFP,
+			"message queued, it is sent after going 'online'")
+	} else if line != nil {
 		fmt.Fprintln(ce.fileTable.StatusFP, "message added")
 	}
 
 	return nil
 }
 
+// appendSignature appends the signature to msg, separated by a signature
+// separator line ("-- ").
+func appendSignature(msg []byte, signature string) []byte {
+	if signature == "" {
+		return msg
+	}
+	msg = bytes.TrimRight(msg, "\r\n")
+	return append(msg, []byte("\n\n-- \n"+signature+"\n")...)
+}
+
+// addMessage adds the message msg with the given attachments from user ID
+// fromMapped (from unmapped) to the 'To:' and 'Cc:' recipients to and cc to
+// the message DB (for sending with 'msg send'). replyID is the message ID of
+// the message this message replies to (can be empty). Unset delays (0) are
+// taken from the (first) contact or the defaults. If sendAfter is set, the
+// message is not sent before that time.
+func (ce *CtrlEngine) addMessage(
+	c *cli.Context,
+	fromMapped, from string,
+	to, cc []string,
+	msg string,
+	msgAttachments []*msgdb.Attachment,
+	replyID string,
+	permanentSignature bool,
+	minDelay, maxDelay int32,
+	sendAfter int64,
+) error {
+	toMapped, err := ce.mapRecipients(fromMapped, from, to)
+	if err != nil {
+		return err
+	}
+	ccMapped, err := ce.mapRecipients(fromMapped, from, cc)
+	if err != nil {
+		return err
+	}
+	// warn about recipients whose verified key changed
+	for _, recipient := range append(append([]string{}, toMapped...), ccMapped...) {
+		_, err := ce.checkVerified(c, ce.fileTable.StatusFP, fromMapped, recipient)
+		if err != nil {
+			if !ce.isOffline(c) {
+				return err
+			}
+			// always queue in --offline mode, the key is checked on sending
+			log.Warnf("ctrlengine: cannot check key of %s in --offline mode: %s",
+				recipient, err)
+		}
+	}
+
+	// unset delays (0) are taken from the (first) contact or the defaults
+	if minDelay == 0 || maxDelay == 0 {
+		contactMinDelay, contactMaxDelay, err :=
+			ce.msgDB.GetContactDelays(fromMapped, toMapped[0])
+		if err != nil {
+			return err
+		}
+		if contactMinDelay == 0 {
+			contactMinDelay, contactMaxDelay = def.MinDelay, def.MaxDelay
+		}
+		if minDelay == 0 {
+			minDelay = contactMinDelay
+		}
+		if maxDelay == 0 {
+			maxDelay = contactMaxDelay
+		}
+		if !c.Bool("nodelaycheck") {
+			if err := def.CheckDelays(minDelay, maxDelay); err != nil {
+				return log.Error(err)
+			}
+		}
+	}
+
+	// determine message ID for threading
+	messageID, err := msgid.Generate(fromMapped, cipher.RandReader)
+	if err != nil {
+		return log.Error(err)
+	}
+
+	// store message in message DB
+	now := times.Now()
+	// make sure the encoded message can be sent
+	header := mimeMsg.Header{
+		From:      fromMapped,
+		To:        strings.Join(toMapped, ","),
+		Cc:        ccMapped,
+		MessageID: messageID,
+		InReplyTo: replyID,
+	}
+	if _, err := encodeMessage(header, msg, msgAttachments); err != nil {
+		return err
+	}
+	return ce.msgDB.AddMultiMessage(fromMapped, toMapped, ccMapped, now,
+		msg, messageID, replyID, msgAttachments, permanentSignature,
+		minDelay, maxDelay, sendAfter)
+}
+
 func muteprotoCreate(
 	c *cli.Context,
 	msg string,
@@ -233,7 +401,7 @@ func muteprotoCreate(
 
 func muteprotoDeliver(
 	c *cli.Context,
-	envelope string,
+	envelope io.Reader,
 ) (resend bool, err error) {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
@@ -251,7 +419,7 @@ func muteprotoDeliver(
 	if err := cmd.Start(); err != nil {
 		return false, err
 	}
-	if _, err := io.WriteString(stdin, envelope); err != nil {
+	if _, err := io.Copy(stdin, envelope); err != nil {
 		return false, err
 	}
 	stdin.Close()
@@ -271,26 +439,90 @@ func muteprotoDeliver(
 	return
 }
 
+// recvNymAddress returns the nymaddress peer uses to send messages to nym.
+// The account of nym dedicated to peer is used, if one exists (accounts lists
+// the accounts of nym, see msgdb.GetAccounts). The delay bounds configured
+// for peer take precedence over the delays of the account.
+func (ce *CtrlEngine) recvNymAddress(
+	nym, peer string,
+	accounts []string,
+) (string, error) {
+	var contact string
+	for _, account := range accounts {
+		if account == peer {
+			contact = peer
+			break
+		}
+	}
+	privkey, server, secret, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(nym, contact)
+	if err != nil {
+		return "", err
+	}
+	contactMinDelay, contactMaxDelay, err := ce.msgDB.GetContactDelays(nym, peer)
+	if err != nil {
+		return "", err
+	}
+	if contactMinDelay > 0 {
+		minDelay, maxDelay = contactMinDelay, contactMaxDelay
+	}
+	_, domain, err := identity.Split(nym)
+	if err != nil {
+		return "", err
+	}
+	expire := times.ThirtyDaysLater() // TODO: make this settable
+	singleUse := false                // TODO correct?
+	var pubkey [ed25519.PublicKeySize]byte
+	copy(pubkey[:], privkey[32:])
+	_, nymaddress, err := util.NewNymAddress(domain, secret[:], expire,
+		singleUse, minDelay, maxDelay, nym, &pubkey, server, def.CACert)
+	if err != nil {
+		return "", err
+	}
+	return nymaddress, nil
+}
+
+// outQueueRetry returns the duration the delivery of an outqueue entry is
+// postponed after the given number of failed delivery attempts.
+func outQueueRetry(attempts int64) time.Duration {
+	d := def.OutQueueRetryMin
+	for i := int64(0); i < attempts && d < def.OutQueueRetryMax; i++ {
+		d *= 2
+	}
+	if d > def.OutQueueRetryMax {
+		d = def.OutQueueRetryMax
+	}
+	return d
+}
+
+// procOutQueue delivers the outqueue of nym. Small messages are delivered
+// before large ones and envelopes are streamed from the database. If the
+// delivery of an entry fails, the entry is postponed (with exponential
+// backoff) and the remaining entries are processed. Postponed entries keep
+// their envelope, a later call resumes their delivery without spending
+// another token. Messages sent in chunks only redeliver the chunks which
+// failed. The last delivery error is returned.
 func (ce *CtrlEngine) procOutQueue(
 	c *cli.Context,
 	nym string,
-	failDelivery bool,
 ) error {
 	log.Debug("procOutQueue()")
+	var deliveryErr error
 	for {
-		oqIdx, msg, nymaddress, minDelay, maxDelay, envelope, err :=
-			ce.msgDB.GetOutQueue(nym)
+		entry, err := ce.msgDB.GetOutQueueEntry(nym, times.Now(),
+			def.OutQueueLargeSize)
 		if err != nil {
 			return err
 		}
-		if msg == "" {
+		if entry == nil {
 			log.Debug("break")
-			break // no more messages in outqueue
+			break // no more messages in outqueue (which are due)
 		}
-		if !envelope {
+		oqIdx := entry.OQIdx
+		if !entry.Envelope {
 			log.Debug("envelope")
 			// parse nymaddress
-			na, err := base64.Decode(nymaddress)
+			na, err := base64.Decode(entry.NymAddress)
 			if err != nil {
 				return log.Error(na)
 			}
@@ -298,6 +530,10 @@ func (ce *CtrlEngine) procOutQueue(
 			if err != nil {
 				return err
 			}
+			msg, err := ce.msgDB.GetOutQueueMsg(oqIdx)
+			if err != nil {
+				return err
+			}
 			// get token from wallet
 			var pubkey [32]byte
 			copy(pubkey[:], addr.TokenPubKey)
@@ -305,42 +541,54 @@ func (ce *CtrlEngine) procOutQueue(
 			if err != nil {
 				return err
 			}
-			// `muteproto create`
-			env, err := muteprotoCreate(c, msg, minDelay, maxDelay,
-				base64.Encode(token.Token), nymaddress)
+			// create envelope
+			env, err := protoCreate(c, msg, entry.MinDelay, entry.MaxDelay,
+				base64.Encode(token.Token), entry.NymAddress)
 			if err != nil {
 				return log.Error(err)
 			}
 			// update outqueue
+			if err := ce.fault(FaultDBWrite); err != nil {
+				ce.client.UnlockToken(token.Hash)
+				return err
+			}
 			if err := ce.msgDB.SetOutQueue(oqIdx, env); err != nil {
 				ce.client.UnlockToken(token.Hash)
 				return err
 			}
 			ce.client.DelToken(token.Hash)
-			msg = env
+			if err := ce.fault(FaultTokenSpent); err != nil {
+				return err
+			}
 		}
-		// `muteproto deliver`
-		if failDelivery {
-			return log.Error(ErrDeliveryFailed)
+		// deliver envelope
+		if err := ce.fault(FaultDelivery); err != nil {
+			return err
 		}
-		sendTime := times.Now() + int64(minDelay) // earliest
-		resend, err := muteprotoDeliver(c, msg)
+		sendTime := times.Now() + int64(entry.MinDelay) // earliest
+		resend, err := protoDeliver(c, ce.msgDB.OutQueueReader(oqIdx))
 		if err != nil {
 			// If the message delivery failed because the token expired in the
 			// meantime we retract the message from the outqueue (setting it
 			// back to 'ToSend') and start the delivery process for this
 			// message all over again.
-			// Matching the error message string is not optimal, but the best
-			// available solution since the error results from calling another
-			// binary (muteproto).
-			if strings.HasSuffix(err.Error(), client.ErrFinal.Error()) {
+			if finalError(c, err) {
 				log.Debug("retract")
 				if err := ce.msgDB.RetractOutQueue(oqIdx); err != nil {
 					return err
 				}
 				continue
 			}
-			return log.Error(err)
+			// postpone entry and continue with the next one
+			retry := outQueueRetry(entry.Attempts)
+			log.Warnf("ctrlengine: delivery of outqueue entry %d failed, "+
+				"retry in %s: %s", oqIdx, retry, err)
+			next := times.Now() + int64(retry/time.Second)
+			if err := ce.msgDB.PostponeOutQueue(oqIdx, next); err != nil {
+				return err
+			}
+			deliveryErr = err
+			continue
 		}
 		if resend {
 			// set resend status
@@ -356,7 +604,7 @@ func (ce *CtrlEngine) procOutQueue(
 			}
 		}
 	}
-	return nil
+	return deliveryErr
 }
 
 func (ce *CtrlEngine) getNyms(id string, all bool) ([]string, error) {
@@ -384,93 +632,188 @@ func (ce *CtrlEngine) getNyms(id string, all bool) ([]string, error) {
 	return nyms, nil
 }
 
+// msgSend sends all pending messages of user ID id (or all user IDs). With
+// all set every user ID is processed independently: if sending fails for
+// some of them, the others are processed anyway and a *SendError with the
+// results of the failed ones is returned.
 func (ce *CtrlEngine) msgSend(
 	c *cli.Context,
 	id string,
 	all bool,
-	failDelivery bool,
 ) error {
+	if err := ce.checkObserver(); err != nil {
+		return err
+	}
 	nyms, err := ce.getNyms(id, all)
 	if err != nil {
 		return err
 	}
+	if ce.isOffline(c) {
+		// keep messages queued until we go online
+		pending, err := ce.pendingCount(nyms)
+		if err != nil {
+			return err
+		}
+		log.Infof("ctrlengine: --offline mode, %d message(s) stay queued",
+			pending)
+		fmt.Fprintf(ce.fileTable.StatusFP,
+			"offline: %d message(s) stay queued until 'online'\n", pending)
+		return nil
+	}
+	if !all {
+		for _, nym := range nyms {
+			if err := ce.msgSendNym(c, nym); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sendErr := &SendError{Errors: make(map[string]error)}
 	for _, nym := range nyms {
-		// clear resend status for old messages in outqueue
-		if err := ce.msgDB.ClearResendOutQueue(nym); err != nil {
+		if err := ce.msgSendNym(c, nym); err != nil {
+			log.Warnf("ctrlengine: sending messages of %s failed: %s", nym, err)
+			fmt.Fprintf(ce.fileTable.StatusFP,
+				"sending messages of %s failed: %s\n", nym, err)
+			sendErr.Nyms = append(sendErr.Nyms, nym)
+			sendErr.Errors[nym] = err
+		}
+	}
+	if len(sendErr.Nyms) > 0 {
+		fmt.Fprintf(ce.fileTable.StatusFP,
+			"messages of %d of %d user IDs sent\n",
+			len(nyms)-len(sendErr.Nyms), len(nyms))
+		return sendErr
+	}
+	return nil
+}
+
+// msgSendNym sends all pending messages of the user ID nym.
+func (ce *CtrlEngine) msgSendNym(
+	c *cli.Context,
+	nym string,
+) error {
+	// clear resend status for old messages in outqueue
+	if err := ce.msgDB.ClearResendOutQueue(nym); err != nil {
+		return err
+	}
+
+	// process old messages in outqueue
+	if err := ce.procOutQueue(c, nym); err != nil {
+		return err
+	}
+
+	/*
+		ids, err := ce.msgDB.GetMsgIDs(nym)
+		if err != nil {
 			return err
 		}
+		for _, id := range ids {
+			log.Debugf("id=%d, to=%s", id.MsgID, id.To)
+		}
+	*/
+
+	// determine accounts of nym (for contact specific accounts)
+	accounts, err := ce.msgDB.GetAccounts(nym)
+	if err != nil {
+		return err
+	}
 
-		// process old messages in outqueue
-		if err := ce.procOutQueue(c, nym, failDelivery); err != nil {
+	// add all undelivered messages to outqueue
+	recvNymAddresses := make(map[string]string) // peer -> nymaddress
+	for {
+		msgID, peer, msg, sign, minDelay, maxDelay, err :=
+			ce.msgDB.GetUndeliveredMessage(nym, times.Now())
+		if err != nil {
 			return err
 		}
+		if peer == "" {
+			log.Debug("break")
+			break // no more undelivered messages
+		}
 
-		/*
-			ids, err := ce.msgDB.GetMsgIDs(nym)
+		// determine recipient nymaddress for encryption, if necessary
+		recvNymAddress, ok := recvNymAddresses[peer]
+		if !ok {
+			recvNymAddress, err = ce.recvNymAddress(nym, peer, accounts)
 			if err != nil {
 				return err
 			}
-			for _, id := range ids {
-				log.Debugf("id=%d, to=%s", id.MsgID, id.To)
-			}
-		*/
+			recvNymAddresses[peer] = recvNymAddress
+		}
 
-		// add all undelivered messages to outqueue
-		var recvNymAddress string
-		for {
-			msgID, peer, msg, sign, minDelay, maxDelay, err :=
-				ce.msgDB.GetUndeliveredMessage(nym)
+		// encode message with header, if it has a message ID
+		messageID, inReplyTo, err := ce.msgDB.GetMessageHeader(nym, msgID)
+		if err != nil {
+			return err
+		}
+		chunks := []string{string(msg)}
+		if messageID != "" {
+			attachments, err := ce.msgDB.GetAttachments(nym, msgID)
 			if err != nil {
 				return err
 			}
-			if peer == "" {
-				log.Debug("break")
-				break // no more undelivered messages
+			to, cc, err := ce.msgDB.GetMessageRecipients(nym, msgID)
+			if err != nil {
+				return err
 			}
-
-			// determine recipient nymaddress for encryption, if necessary
-			if recvNymAddress == "" {
-				// TODO! (implement more accounts? delay settings?)
-				privkey, server, secret, minDelay, maxDelay, _, err :=
-					ce.msgDB.GetAccount(nym, "")
-				if err != nil {
-					return err
-				}
-				_, domain, err := identity.Split(nym)
-				if err != nil {
-					return err
-				}
-				expire := times.ThirtyDaysLater() // TODO: make this settable
-				singleUse := false                // TODO correct?
-				var pubkey [ed25519.PublicKeySize]byte
-				copy(pubkey[:], privkey[32:])
-				_, recvNymAddress, err = util.NewNymAddress(domain, secret[:],
-					expire, singleUse, minDelay, maxDelay, nym, &pubkey, server,
-					def.CACert)
-				if err != nil {
-					return err
-				}
+			header := mimeMsg.Header{
+				From:      nym,
+				To:        strings.Join(to, ","),
+				Cc:        cc,
+				MessageID: messageID,
+				InReplyTo: inReplyTo,
 			}
-
-			// encrypt
-			enc, nymaddress, err := mutecryptEncrypt(c, nym, peer,
-				ce.passphrase, msg, sign, recvNymAddress)
+			chunks, err = encodeMessage(header, string(msg), attachments)
 			if err != nil {
-				return log.Error(err)
+				return err
 			}
-			// add to outqueue
-			log.Debug("add")
-			err = ce.msgDB.AddOutQueue(nym, msgID, enc, nymaddress,
-				minDelay, maxDelay)
+		}
+
+		// encrypt (every chunk separately)
+		var (
+			encs       []string
+			nymaddress string
+		)
+		for _, chunk := range chunks {
+			var enc string
+			enc, nymaddress, err = ce.encrypt(c, nym, peer, []byte(chunk),
+				sign, recvNymAddress)
 			if err != nil {
-				return log.Error(err)
+				break
 			}
+			encs = append(encs, enc)
 		}
-
-		// process new messages in outqueue
-		if err := ce.procOutQueue(c, nym, failDelivery); err != nil {
+		if err == jsonclient.ErrCircuitOpen {
+			// key server unavailable: keep remaining messages queued
+			log.Warnf("ctrlengine: key server unavailable, messages of %s stay queued",
+				nym)
+			fmt.Fprintf(ce.fileTable.StatusFP,
+				"key server unavailable, messages of %s stay queued\n", nym)
+			break
+		}
+		if err != nil {
+			return log.Error(err)
+		}
+		if err := ce.fault(FaultEncrypt); err != nil {
 			return err
 		}
+		// add to outqueue
+		log.Debug("add")
+		err = ce.msgDB.AddOutQueueChunks(nym, msgID, encs, nymaddress,
+			minDelay, maxDelay)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+
+	// add all pending receipts to outqueue
+	if err := ce.sendReceipts(c, nym, accounts, recvNymAddresses); err != nil {
+		return err
+	}
+
+	// process new messages in outqueue
+	if err := ce.procOutQueue(c, nym); err != nil {
+		return err
 	}
 	return nil
 }
@@ -518,15 +861,17 @@ func muteprotoFetch(
 	if err := cmd.Start(); err != nil {
 		return 0, err
 	}
-	var outbuf bytes.Buffer
-	status := bufio.NewReader(stderr)
-	input := make(chan []byte)
+	src := &muteprotoSource{
+		status: bufio.NewReader(stderr),
+		cmdW:   cmdW,
+		input:  make(chan []byte),
+	}
 	go func() {
 		for {
 			buf := make([]byte, 4096)
 			n, err := stdout.Read(buf)
 			if n > 0 {
-				input <- buf[:n]
+				src.input <- buf[:n]
 			}
 			if err != nil {
 				if err == io.EOF {
@@ -537,108 +882,13 @@ func muteprotoFetch(
 			}
 		}
 	}()
-	firstMessage := true
-	cache, err := msgDB.GetMessageIDCache(myID, contactID)
+	newMessageTime, err = storeMessages(myID, contactID, msgDB, src)
 	if err != nil {
 		return 0, err
 	}
-	for {
-		// read status output
-		line, err := status.ReadString('\n')
-		if err != nil {
-			return 0, log.Error(err)
-		}
-		line = strings.TrimSpace(line)
-		if line == "NONE" {
-			log.Debug("read: NONE")
-			break
-		}
-		if strings.HasSuffix(line, "accountdb: nothing found") {
-			log.Info("account has no messages")
-			return 0, nil
-		}
-		parts := strings.Split(line, "\t")
-		if len(parts) != 2 || parts[0] != "MESSAGEID:" {
-			return 0, log.Errorf("ctrlengine: MESSAGEID line expected from muteproto, got: %s", line)
-		}
-		messageID := parts[1]
-		log.Debugf("read: MESSAGEID:\t%s", messageID)
-		if cache[messageID] {
-			// message known -> abort fetching messages and remove old IDs from cache
-			log.Debug("write: QUIT")
-			fmt.Fprintln(cmdW, "QUIT")
-			err := msgDB.RemoveMessageIDCache(myID, contactID, messageID)
-			if err != nil {
-				return 0, log.Error(err)
-			}
-			break
-		} else {
-			// message unknown -> fetch it and add messageID to cache
-			log.Debug("write: NEXT")
-			fmt.Fprintln(cmdW, "NEXT")
-			err := msgDB.AddMessageIDCache(myID, contactID, messageID)
-			if err != nil {
-				return 0, log.Error(err)
-			}
-		}
-		// read message
-		stop := make(chan uint64)
-		done := make(chan bool)
-		go func() {
-			for {
-				select {
-				case buf := <-input:
-					outbuf.Write(buf)
-				case length := <-stop:
-					for uint64(outbuf.Len()) < length {
-						buf := <-input
-						outbuf.Write(buf)
-					}
-					done <- true
-					return
-				}
-			}
-		}()
-		// read LENGTH
-		line, err = status.ReadString('\n')
-		if err != nil {
-			return 0, log.Error(err)
-		}
-		parts = strings.Split(strings.TrimRight(line, "\n"), "\t")
-		if len(parts) != 2 || parts[0] != "LENGTH:" {
-			return 0, log.Errorf("ctrlengine: LENGTH line expected from muteproto, got: %s", line)
-		}
-		length, err := strconv.ParseUint(parts[1], 10, 64)
-		if err != nil {
-			return 0, log.Error(err)
-		}
-		log.Debugf("read: LENGTH:\t%d", length)
-		// read RECEIVETIME
-		line, err = status.ReadString('\n')
-		if err != nil {
-			return 0, log.Error(err)
-		}
-		parts = strings.Split(strings.TrimRight(line, "\n"), "\t")
-		if len(parts) != 2 || parts[0] != "RECEIVETIME:" {
-			return 0, log.Errorf("ctrlengine: RECEIVETIME line expected from muteproto, got: %s", line)
-		}
-		receiveTime, err := strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return 0, log.Error(err)
-		}
-		log.Debugf("read: RECEIVETIME:\t%d", receiveTime)
-
-		stop <- length
-		<-done
-		err = msgDB.AddInQueue(myID, contactID, receiveTime, outbuf.String())
-		if err != nil {
-			return 0, err
-		}
-		if firstMessage {
-			newMessageTime = receiveTime
-			firstMessage = false
-		}
-		outbuf.Reset()
+	if src.nothingFound {
+		log.Info("account has no messages")
+		return 0, nil
 	}
 	if err := cmd.Wait(); err != nil {
 		return 0, err
@@ -646,21 +896,117 @@ func muteprotoFetch(
 	return
 }
 
-func mutecryptDecrypt(
+// muteprotoSource is the messageSource of a 'muteproto fetch' process.
+type muteprotoSource struct {
+	status       *bufio.Reader // status output of muteproto
+	cmdW         io.Writer     // commands for muteproto
+	input        chan []byte   // output of muteproto
+	outbuf       bytes.Buffer
+	nothingFound bool // account has no messages
+}
+
+func (src *muteprotoSource) next() (string, bool, error) {
+	// read status output
+	line, err := src.status.ReadString('\n')
+	if err != nil {
+		return "", false, log.Error(err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "NONE" {
+		log.Debug("read: NONE")
+		return "", false, nil
+	}
+	if strings.HasSuffix(line, "accountdb: nothing found") {
+		src.nothingFound = true
+		return "", false, nil
+	}
+	parts := strings.Split(line, "\t")
+	if len(parts) != 2 || parts[0] != "MESSAGEID:" {
+		return "", false, log.Errorf("ctrlengine: MESSAGEID line expected from muteproto, got: %s", line)
+	}
+	log.Debugf("read: MESSAGEID:\t%s", parts[1])
+	return parts[1], true, nil
+}
+
+func (src *muteprotoSource) quit() {
+	log.Debug("write: QUIT")
+	fmt.Fprintln(src.cmdW, "QUIT")
+}
+
+func (src *muteprotoSource) fetch() (int64, string, error) {
+	log.Debug("write: NEXT")
+	fmt.Fprintln(src.cmdW, "NEXT")
+	// read message
+	stop := make(chan uint64)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case buf := <-src.input:
+				src.outbuf.Write(buf)
+			case length := <-stop:
+				for uint64(src.outbuf.Len()) < length {
+					buf := <-src.input
+					src.outbuf.Write(buf)
+				}
+				done <- true
+				return
+			}
+		}
+	}()
+	// read LENGTH
+	line, err := src.status.ReadString('\n')
+	if err != nil {
+		return 0, "", log.Error(err)
+	}
+	parts := strings.Split(strings.TrimRight(line, "\n"), "\t")
+	if len(parts) != 2 || parts[0] != "LENGTH:" {
+		return 0, "", log.Errorf("ctrlengine: LENGTH line expected from muteproto, got: %s", line)
+	}
+	length, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", log.Error(err)
+	}
+	log.Debugf("read: LENGTH:\t%d", length)
+	// read RECEIVETIME
+	line, err = src.status.ReadString('\n')
+	if err != nil {
+		return 0, "", log.Error(err)
+	}
+	parts = strings.Split(strings.TrimRight(line, "\n"), "\t")
+	if len(parts) != 2 || parts[0] != "RECEIVETIME:" {
+		return 0, "", log.Errorf("ctrlengine: RECEIVETIME line expected from muteproto, got: %s", line)
+	}
+	receiveTime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", log.Error(err)
+	}
+	log.Debugf("read: RECEIVETIME:\t%d", receiveTime)
+
+	stop <- length
+	<-done
+	enc := src.outbuf.String()
+	src.outbuf.Reset()
+	return receiveTime, enc, nil
+}
+
+func (ce *CtrlEngine) mutecryptDecrypt(
 	c *cli.Context,
 	passphrase, enc []byte,
+	profile *networkProfile,
 	statusFP io.Writer,
-) (senderID, message string, err error) {
+) (senderID, message, sig string, err error) {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 		"decrypt",
+		"--num-keys", strconv.Itoa(profile.numOfKeys),
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	var outbuf bytes.Buffer
 	cmd.Stdout = &outbuf
@@ -668,17 +1014,17 @@ func mutecryptDecrypt(
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
 	if err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", log.Error(err)
 	}
 	defer ppR.Close()
 	ppW.Write(passphrase)
 	ppW.Close()
 	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
 	if err := cmd.Start(); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", log.Error(err)
 	}
 	if _, err := stdin.Write(enc); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", log.Error(err)
 	}
 	stdin.Close()
 	if err := cmd.Wait(); err != nil {
@@ -687,33 +1033,89 @@ func mutecryptDecrypt(
 			log.Warn("could not decrypt pre-header, message dropped")
 			fmt.Fprintf(statusFP,
 				"could not decrypt pre-header, message dropped\n")
-			return "", "", nil
+			return "", "", "", nil
 		}
-		return "", "", log.Errorf("%s: %s", err, errstr)
+		if strings.HasSuffix(errstr, msg.ErrSessionUnknown.Error()) {
+			// get sender from status output
+			parts := strings.Split(strings.SplitN(errstr, "\n", 2)[0], "\t")
+			if len(parts) != 2 || parts[0] != "SENDERIDENTITY:" {
+				return "", "", "",
+					log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", errstr)
+			}
+			return parts[1], "", "", msg.ErrSessionUnknown
+		}
+		return "", "", "", log.Errorf("%s: %s", err, errstr)
 	}
-	// TODO: parse and process signature!
 	scanner := bufio.NewScanner(&errbuf)
 	if scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.Split(line, "\t")
 		if len(parts) != 2 || parts[0] != "SENDERIDENTITY:" {
-			return "", "",
+			return "", "", "",
 				log.Errorf("ctrlengine: mutecrypt status output not parsable: %s", line)
 		}
 		senderID = parts[1]
 	} else {
-		return "", "", log.Error("ctrlengine: expecting mutecrypt output")
+		return "", "", "", log.Error("ctrlengine: expecting mutecrypt output")
+	}
+	// optional signature (only reported if it could be verified)
+	if scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(line, "\t")
+		if len(parts) == 2 && parts[0] == "SIGNATURE:" {
+			sig = parts[1]
+		}
 	}
 	if err := scanner.Err(); err != nil {
-		return "", "", log.Error(err)
+		return "", "", "", log.Error(err)
 	}
 
 	message = outbuf.String()
 	return
 }
 
+// countUnverifiedEnvelope records that the signed envelope with index iqIdx
+// for myID could not be verified. The envelope is kept and processed like an
+// unsigned one, since not all mixes sign relay messages yet.
+func (ce *CtrlEngine) countUnverifiedEnvelope(iqIdx int64, myID string, reason error) error {
+	value, err := ce.msgDB.GetValue(msgdb.UnverifiedEnvelopes)
+	if err != nil {
+		return err
+	}
+	var unverified int64
+	if value != "" {
+		unverified, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	unverified++
+	err = ce.msgDB.AddValue(msgdb.UnverifiedEnvelopes,
+		strconv.FormatInt(unverified, 10))
+	if err != nil {
+		return err
+	}
+	log.Warnf("ctrlengine: envelope %d for %s not verified: %s", iqIdx, myID, reason)
+	fmt.Fprintf(ce.fileTable.StatusFP,
+		"envelope for %s not verified (not signed by known mix): %s (%d unverified so far)\n",
+		myID, reason, unverified)
+	return nil
+}
+
 func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 	log.Debug("procInQueue()")
+	policy, err := ce.msgDB.GetReceivePolicy()
+	if err != nil {
+		return err
+	}
+	// delete chunks of messages which will never be completed
+	n, err := ce.msgDB.ExpireChunks(times.Now() - chunkExpiry)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("ctrlengine: %d chunks of incomplete messages expired", n)
+	}
 	for {
 		// get message from msgDB
 		iqIdx, myID, contactID, msg, envelope, err := ce.msgDB.GetInQueue()
@@ -740,6 +1142,17 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 			}
 			var pubkey [32]byte
 			copy(pubkey[:], privkey[32:])
+			// verify envelope, if it was signed by a mix (from the config)
+			message, signed, err := mixcrypt.VerifyRelay(util.MixSigningKeys,
+				message)
+			if !signed {
+				log.Debugf("envelope %d not signed by mix", iqIdx)
+			} else if err != nil {
+				// keep envelope, it is only logged for now
+				if err := ce.countUnverifiedEnvelope(iqIdx, myID, err); err != nil {
+					return err
+				}
+			}
 			dec, nym, err := mixcrypt.ReceiveFromMix(receiveTemplate,
 				util.MailboxAddress(&pubkey, server), message)
 			if err != nil {
@@ -753,6 +1166,9 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 				}
 			} else {
 				log.Info("envelope successfully decrypted")
+				if err := ce.fault(FaultDBWrite); err != nil {
+					return err
+				}
 				err := ce.msgDB.SetInQueue(iqIdx, base64.Encode(dec))
 				if err != nil {
 					return err
@@ -760,8 +1176,23 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 			}
 		} else {
 			log.Debugf("decrypt message (iqIdx=%d)", iqIdx)
-			senderID, plainMsg, err := mutecryptDecrypt(c, ce.passphrase,
-				[]byte(msg), ce.fileTable.StatusFP)
+			senderID, plainMsg, sig, err := ce.decrypt(c, []byte(msg),
+				ce.fileTable.StatusFP)
+			if isSessionUnknown(err) {
+				// Keep message, it is retried once a message from the sender
+				// has been decrypted. The sender ID is taken from the
+				// unauthenticated header, therefore the session is only
+				// restarted on request of the user (see pendingRestart).
+				log.Warnf("ctrlengine: session %s -> %s unknown, message pending",
+					senderID, myID)
+				fmt.Fprintf(ce.fileTable.StatusFP,
+					"message claiming to be from %s belongs to unknown session, message pending (use 'pending restart' to restart the session)\n",
+					senderID)
+				if err := ce.msgDB.PendInQueue(iqIdx, senderID); err != nil {
+					return err
+				}
+				continue
+			}
 			if err != nil {
 				return err
 			}
@@ -772,6 +1203,33 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 				}
 				continue
 			}
+			// the session with senderID is known, retry its pending messages
+			n, err := ce.msgDB.RetryPending(myID, senderID)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				log.Infof("ctrlengine: retry %d pending message(s) from %s", n,
+					senderID)
+			}
+			// collect chunks of large messages until they are complete
+			if mimeMsg.IsChunk(plainMsg) {
+				parts, err := ce.addChunk(iqIdx, plainMsg, senderID)
+				if err != nil {
+					return err
+				}
+				if parts == nil {
+					continue // message not complete yet
+				}
+				plainMsg = strings.Join(parts, "")
+			}
+			// receipts are processed directly (never stored as messages)
+			if mimeMsg.IsReceipt(plainMsg) {
+				if err := ce.procReceipt(iqIdx, myID, senderID, plainMsg); err != nil {
+					return err
+				}
+				continue
+			}
 			// check if contact exists
 			contact, _, contactType, err := ce.msgDB.GetContact(myID, senderID)
 			if err != nil {
@@ -781,17 +1239,51 @@ func (ce *CtrlEngine) procInQueue(c *cli.Context, host string) error {
 			// here, but we should use the one contained in the message and
 			// compare it with hash chain entry (doesn't compromise anonymity)
 			var drop bool
-			if contact == "" {
+			if contactType == msgdb.BlackList && contact != "" {
+				// messages from black listed contacts are dropped directly
+				log.Debug("message from black listed contact dropped")
+				drop = true
+			} else if reason := checkReceivePolicy(policy, plainMsg); reason != "" {
+				// messages violating the receive policy are quarantined
+				log.Warnf("ctrlengine: message from %s quarantined: %s",
+					senderID, reason)
+				fmt.Fprintf(ce.fileTable.StatusFP,
+					"message from %s quarantined: %s\n", senderID, reason)
+				err := ce.msgDB.QuarantineInQueue(iqIdx, plainMsg, senderID,
+					reason)
+				if err != nil {
+					return err
+				}
+				_, messageID, _, _, err := parseMessage(plainMsg, senderID)
+				if err != nil {
+					return err
+				}
+				if messageID != "" {
+					if err := ce.msgDB.DelChunks(myID, messageID); err != nil {
+						return err
+					}
+				}
+				continue
+			} else if contact == "" {
 				err := ce.contactAdd(myID, senderID, "", host, msgdb.GrayList, c)
 				if err != nil {
 					return log.Error(err)
 				}
-			} else if contactType == msgdb.BlackList {
-				// messages from black listed contacts are dropped directly
-				log.Debug("message from black listed contact dropped")
-				drop = true
 			}
-			err = ce.msgDB.RemoveInQueue(iqIdx, plainMsg, senderID, drop)
+			if err := ce.fault(FaultDBWrite); err != nil {
+				return err
+			}
+			message, messageID, inReplyTo, attachments, err :=
+				parseMessage(plainMsg, senderID)
+			if err != nil {
+				return err
+			}
+			sigStatus := msgdb.SigStatusUnsigned
+			if sig != "" {
+				sigStatus = msgdb.SigStatusValid
+			}
+			err = ce.msgDB.RemoveInQueue(iqIdx, message, messageID, inReplyTo,
+				senderID, sigStatus, attachments, drop)
 			if err != nil {
 				return err
 			}
@@ -806,6 +1298,13 @@ func (ce *CtrlEngine) msgFetch(
 	all bool,
 	host string,
 ) error {
+	if ce.isOffline(c) {
+		log.Info("ctrlengine: --offline mode, fetch postponed")
+		fmt.Fprintln(ce.fileTable.StatusFP,
+			"offline: fetch postponed until 'online'")
+		return nil
+	}
+
 	// process old messages in inqueue
 	if err := ce.procInQueue(c, host); err != nil {
 		return err
@@ -817,43 +1316,197 @@ func (ce *CtrlEngine) msgFetch(
 	}
 
 	// put new messages from server into in inqueue
+	fetchErr := ce.fetchAccounts(c, nyms)
+
+	// process new messages in inqueue
+	if err := ce.procInQueue(c, host); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+// fetchAccount is an account new messages are fetched from.
+type fetchAccount struct {
+	nym     string // mapped user ID
+	contact string // mapped contact ID ("" for the default account)
+}
+
+// fetchErrors aggregates the errors of all accounts new messages could not
+// be fetched from.
+type fetchErrors []error
+
+func (e fetchErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("ctrlengine: fetching failed for %d account(s): %s",
+		len(e), strings.Join(msgs, "; "))
+}
+
+// fetchAccounts fetches new messages from all accounts of the given nyms and
+// puts them into the inqueue. The accounts are fetched concurrently by up to
+// def.FetchWorkers workers, the requests per account server are rate limited.
+// Accounts which fail do not abort the fetching of the other accounts, all
+// errors are returned together as fetchErrors.
+func (ce *CtrlEngine) fetchAccounts(c *cli.Context, nyms []string) error {
+	var accounts []fetchAccount
 	for _, nym := range nyms {
 		contacts, err := ce.msgDB.GetAccounts(nym)
 		if err != nil {
 			return err
 		}
 		for _, contact := range contacts {
-			privkey, server, _, _, _, lastMessageTime, err := ce.msgDB.GetAccount(nym, contact)
-			if err != nil {
-				return err
-			}
-			newMessageTime, err := muteprotoFetch(nym, contact, ce.msgDB, c,
-				base64.Encode(privkey[:]), server, lastMessageTime)
-			if err != nil {
-				return log.Error(err)
-			}
-			if newMessageTime > 0 {
-				err = ce.msgDB.SetAccountLastMsg(nym, contact, newMessageTime)
-				if err != nil {
-					return log.Error(err)
+			accounts = append(accounts, fetchAccount{nym: nym, contact: contact})
+		}
+	}
+	var (
+		errs    fetchErrors
+		errLock sync.Mutex
+		wg      sync.WaitGroup
+	)
+	limiter := ratelimit.New(def.FetchServerRate, def.FetchServerBurst)
+	jobs := make(chan fetchAccount)
+	workers := def.FetchWorkers
+	if len(accounts) < workers {
+		workers = len(accounts)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				// the database calls of the workers are single statements
+				// and wait for each other (busy timeout of encdb)
+				if err := ce.fetchFromAccount(c, limiter, a); err != nil {
+					log.Error(err)
+					errLock.Lock()
+					errs = append(errs, fmt.Errorf("%s (contact '%s'): %s",
+						a.nym, a.contact, err))
+					errLock.Unlock()
 				}
 			}
-		}
+		}()
 	}
-
-	// process new messages in inqueue
-	return ce.procInQueue(c, host)
+	for _, a := range accounts {
+		jobs <- a
+	}
+	close(jobs)
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-func (ce *CtrlEngine) msgList(w io.Writer, id string) error {
-	idMapped, err := identity.Map(id)
+// fetchFromAccount fetches new messages from account a and puts them into
+// the inqueue.
+func (ce *CtrlEngine) fetchFromAccount(
+	c *cli.Context,
+	limiter *ratelimit.Limiter,
+	a fetchAccount,
+) error {
+	privkey, server, _, _, _, lastMessageTime, err :=
+		ce.msgDB.GetAccount(a.nym, a.contact)
 	if err != nil {
 		return err
 	}
-	ids, err := ce.msgDB.GetMsgIDs(idMapped)
+	limiter.Wait(server)
+	newMessageTime, err := protoFetch(a.nym, a.contact, ce.msgDB, c,
+		privkey, server, lastMessageTime)
 	if err != nil {
 		return err
 	}
+	if newMessageTime > 0 {
+		err = ce.msgDB.SetAccountLastMsg(a.nym, a.contact, newMessageTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkExpiry is the time after which the chunks of incomplete messages are
+// deleted (in seconds).
+const chunkExpiry = 7 * 24 * 60 * 60
+
+// maxChunks is the maximum number of chunks a message can be split into
+// (see encodeMessage).
+const maxChunks = mimeMsg.MaxMsgSize/(msg.MaxContentLength-chunkOverhead) + 1
+
+// discardChunk removes the chunk contained in the inqueue entry with index
+// iqIdx, because of the given reason.
+func (ce *CtrlEngine) discardChunk(iqIdx int64, reason string) error {
+	log.Warnf("ctrlengine: %s -> discard chunk", reason)
+	fmt.Fprintf(ce.fileTable.StatusFP, "%s -> discard chunk\n", reason)
+	return ce.msgDB.DelInQueue(iqIdx)
+}
+
+// addChunk adds the decrypted chunk from senderID contained in the inqueue
+// entry with index iqIdx to the message database. If the message is
+// complete, the parts of the message are returned in order. Chunks are only
+// accepted, if chunking is enabled (see def.FeatureChunking). The number of
+// chunks and their size are limited, so that reassembled messages are not
+// larger than the largest message which can be sent.
+func (ce *CtrlEngine) addChunk(iqIdx int64, chunk, senderID string) (
+	[]string,
+	error,
+) {
+	if !def.FeatureEnabled(def.FeatureChunking) {
+		return nil, ce.discardChunk(iqIdx,
+			fmt.Sprintf("chunking disabled, chunk from %s", senderID))
+	}
+	header, part, piece, count, err := mimeMsg.DecodeChunk(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if msgid.Parse(header.MessageID) != senderID {
+		return nil, ce.discardChunk(iqIdx,
+			fmt.Sprintf("chunk ID %s does not belong to sender %s",
+				header.MessageID, senderID))
+	}
+	if count > maxChunks || len(part) > msg.MaxContentLength {
+		return nil, ce.discardChunk(iqIdx,
+			fmt.Sprintf("chunk %d of %d of message %s too large",
+				piece, count, header.MessageID))
+	}
+	log.Debugf("chunk %d of %d of message %s", piece, count, header.MessageID)
+	parts, err := ce.msgDB.AddChunk(iqIdx, header.MessageID, piece, count, part)
+	if err == msgdb.ErrInvalidChunk {
+		return nil, ce.discardChunk(iqIdx,
+			fmt.Sprintf("invalid chunk %d of %d of message %s", piece, count,
+				header.MessageID))
+	}
+	return parts, err
+}
+
+// parseMessage parses the decrypted message plainMsg from senderID and
+// returns the actual message, the message IDs used for threading, and the
+// attachments. Plain messages without header (sent by older clients) are
+// returned unchanged. Message IDs which do not belong to senderID are ignored.
+func parseMessage(plainMsg, senderID string) (
+	message, messageID, inReplyTo string,
+	attachments []*msgdb.Attachment,
+	err error,
+) {
+	header, _, message, mimeAttachments, err :=
+		mimeMsg.Parse(strings.NewReader(plainMsg))
+	if err != nil {
+		return plainMsg, "", "", nil, nil
+	}
+	attachments, err = decodeAttachments(mimeAttachments)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	if msgid.Parse(header.MessageID) != senderID {
+		log.Warnf("ctrlengine: message ID %s does not belong to sender %s",
+			header.MessageID, senderID)
+		return message, "", "", attachments, nil
+	}
+	return message, header.MessageID, header.InReplyTo, attachments, nil
+}
+
+func writeMsgIDs(w io.Writer, ids []*msgdb.MsgID) {
 	for _, id := range ids {
 		var (
 			direction rune
@@ -868,9 +1521,16 @@ func (ce *CtrlEngine) msgList(w io.Writer, id string) error {
 			}
 		} else {
 			direction = '<'
-			if id.Sent {
+			switch {
+			case id.Receipt == msgdb.ReceiptRead:
+				status = 'R'
+			case id.Receipt == msgdb.ReceiptDelivered:
+				status = 'D'
+			case id.Sent:
 				status = 'S'
-			} else {
+			case id.SendAfter > times.Now():
+				status = 'L'
+			default:
 				status = 'P'
 			}
 		}
@@ -883,6 +1543,128 @@ func (ce *CtrlEngine) msgList(w io.Writer, id string) error {
 			id.To,
 			id.Subject)
 	}
+}
+
+// parseSince parses the date given with --since (either as date or as RFC
+// 3339 timestamp) and returns it as Unix time (0, if since is empty).
+func parseSince(since string) (int64, error) {
+	if since == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("2006-01-02", since)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return 0, log.Errorf("ctrlengine: cannot parse --since date '%s' "+
+				"(use YYYY-MM-DD or RFC 3339)", since)
+		}
+	}
+	return t.Unix(), nil
+}
+
+// parseSendAfter parses the time given with --send-after (either as RFC 3339
+// timestamp or as duration from now, like "2h30m") and returns it as Unix time
+// (0, if sendAfter is empty).
+func parseSendAfter(sendAfter string) (int64, error) {
+	if sendAfter == "" {
+		return 0, nil
+	}
+	now := times.Now()
+	if d, err := time.ParseDuration(sendAfter); err == nil {
+		if d < 0 {
+			return 0, log.Errorf("ctrlengine: --send-after duration '%s' is negative",
+				sendAfter)
+		}
+		return now + int64(d/time.Second), nil
+	}
+	t, err := time.Parse(time.RFC3339, sendAfter)
+	if err != nil {
+		return 0, log.Errorf("ctrlengine: cannot parse --send-after time '%s' "+
+			"(use RFC 3339 or a duration like 2h30m)", sendAfter)
+	}
+	if t.Unix() < now {
+		return 0, log.Errorf("ctrlengine: --send-after time '%s' lies in the past",
+			sendAfter)
+	}
+	return t.Unix(), nil
+}
+
+// msgList lists the messages of user ID id (only starred ones, if starred is
+// true) which match the given sender, date, and subject filters.
+func (ce *CtrlEngine) msgList(
+	w io.Writer,
+	id string,
+	starred bool,
+	from, since, subject string,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.filterMsgIDs(idMapped, starred, from, since, subject)
+	if err != nil {
+		return err
+	}
+	writeMsgIDs(w, ids)
+	return nil
+}
+
+// filterMsgIDs returns the message IDs of the mapped user ID idMapped which
+// match the filters of 'msg list' (empty filters match all messages).
+func (ce *CtrlEngine) filterMsgIDs(
+	idMapped string,
+	starred bool,
+	from, since, subject string,
+) ([]*msgdb.MsgID, error) {
+	var (
+		ids []*msgdb.MsgID
+		err error
+	)
+	if from == "" && since == "" && subject == "" {
+		ids, err = ce.msgDB.GetMsgIDs(idMapped)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// use search index
+		filter := &msgdb.SearchFilter{Subject: subject}
+		if from != "" {
+			filter.From, err = identity.Map(from)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filter.Since, err = parseSince(since)
+		if err != nil {
+			return nil, err
+		}
+		ids, err = ce.msgDB.SearchMsgIDs(idMapped, filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if starred {
+		var starredIDs []*msgdb.MsgID
+		for _, id := range ids {
+			if id.Star {
+				starredIDs = append(starredIDs, id)
+			}
+		}
+		ids = starredIDs
+	}
+	return ids, nil
+}
+
+func (ce *CtrlEngine) msgThread(w io.Writer, id string, msgID int64) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	ids, err := ce.msgDB.GetThread(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	writeMsgIDs(w, ids)
 	return nil
 }
 
@@ -895,17 +1677,43 @@ func (ce *CtrlEngine) msgRead(w io.Writer, myID string, msgID int64) error {
 	if err != nil {
 		return err
 	}
+	messageID, inReplyTo, err := ce.msgDB.GetMessageHeader(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	toList, ccList, err := ce.msgDB.GetMessageRecipients(idMapped, msgID)
+	if err != nil {
+		return err
+	}
 	if err := ce.msgDB.ReadMessage(msgID); err != nil {
 		return err
 	}
+	// queue read receipt (only if sender opted in)
+	if err := ce.msgDB.QueueReceipt(idMapped, msgID, msgdb.ReceiptRead); err != nil {
+		return err
+	}
 	subject, message := mimeMsg.SplitMessage(msg)
 	fmt.Fprintf(w, "Date: %s\r\n",
 		time.Unix(date, 0).UTC().Format(time.RFC1123Z))
 	fmt.Fprintf(w, "From: %s\r\n", from)
-	fmt.Fprintf(w, "To: %s\r\n", to)
+	if len(toList) > 1 || len(ccList) > 0 {
+		// multi-recipient message
+		fmt.Fprintf(w, "To: %s\r\n", strings.Join(toList, ", "))
+		if len(ccList) > 0 {
+			fmt.Fprintf(w, "Cc: %s\r\n", strings.Join(ccList, ", "))
+		}
+	} else {
+		fmt.Fprintf(w, "To: %s\r\n", to)
+	}
 	if subject != "" {
 		fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
 	}
+	if messageID != "" {
+		fmt.Fprintf(w, "Message-ID: %s\r\n", messageID)
+	}
+	if inReplyTo != "" {
+		fmt.Fprintf(w, "In-Reply-To: %s\r\n", inReplyTo)
+	}
 	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
 	fmt.Fprintf(w, "Content-Type: text/plain; charset=UTF-8\r\n")
 	fmt.Fprintf(w, "\r\n")
@@ -913,6 +1721,42 @@ func (ce *CtrlEngine) msgRead(w io.Writer, myID string, msgID int64) error {
 	return nil
 }
 
+// msgRecipients writes the delivery status of every recipient of the sent
+// message msgID of user ID myID to w.
+func (ce *CtrlEngine) msgRecipients(w io.Writer, myID string, msgID int64) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	to, _, err := ce.msgDB.GetMessageRecipients(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	status, err := ce.msgDB.GetRecipientStatus(idMapped, msgID)
+	if err != nil {
+		return err
+	}
+	for _, rs := range status {
+		field := "Cc"
+		if containsID(to, rs.Recipient) {
+			field = "To"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", rs.MsgNum, field, rs.Recipient,
+			rs.Status)
+	}
+	return nil
+}
+
+// msgStar stars (or unstars, if star is false) the message with msgID of
+// user ID myID.
+func (ce *CtrlEngine) msgStar(myID string, msgID int64, star bool) error {
+	idMapped, err := identity.Map(myID)
+	if err != nil {
+		return err
+	}
+	return ce.msgDB.StarMessage(idMapped, msgID, star)
+}
+
 func (ce *CtrlEngine) msgDelete(myID string, msgID int64) error {
 	idMapped, err := identity.Map(myID)
 	if err != nil {
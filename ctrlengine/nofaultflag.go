@@ -0,0 +1,20 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !faultinject
+
+package ctrlengine
+
+import (
+	"github.com/urfave/cli"
+)
+
+// faultFlags is empty, faults can only be injected from the command line in
+// builds with the faultinject tag (see SetFaultInjector otherwise).
+var faultFlags []cli.Flag
+
+// setFaults does nothing without the faultinject tag.
+func (ce *CtrlEngine) setFaults(c *cli.Context) error {
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/peterh/liner"
+)
+
+func (ce *CtrlEngine) noteAdd(
+	id, contact string,
+	msgNum int64,
+	note string,
+	line *liner.State,
+	r io.Reader,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	if note == "" {
+		if line != nil {
+			// read note from terminal
+			fmt.Fprintln(ce.fileTable.StatusFP,
+				"type note (end with Ctrl-D on empty line):")
+			var inbuf bytes.Buffer
+			for {
+				ln, err := line.Prompt("")
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					return log.Error(err)
+				}
+				inbuf.WriteString(ln + "\n")
+			}
+			note = inbuf.String()
+		} else {
+			// read note from stdin
+			buf, err := ioutil.ReadAll(r)
+			if err != nil {
+				return log.Error(err)
+			}
+			note = string(buf)
+		}
+		note = strings.TrimSpace(note)
+		if note == "" {
+			return log.Error("ctrlengine: note is empty")
+		}
+	}
+	if contact != "" {
+		contactMapped, err := identity.Map(contact)
+		if err != nil {
+			return err
+		}
+		return ce.msgDB.AddContactNote(idMapped, contactMapped, times.Now(),
+			note)
+	}
+	return ce.msgDB.AddMessageNote(idMapped, msgNum, times.Now(), note)
+}
+
+func printNotes(w io.Writer, notes []*msgdb.Note) {
+	for _, note := range notes {
+		date := time.Unix(note.Date, 0).Format(time.RFC3339)
+		if note.Contact != "" {
+			fmt.Fprintf(w, "%d\t%s\tcontact=%s\n", note.NoteID, date,
+				note.Contact)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\tmsgnum=%d\n", note.NoteID, date,
+				note.MsgID)
+		}
+		fmt.Fprintf(w, "%s\n", note.Note)
+	}
+}
+
+func (ce *CtrlEngine) noteShow(
+	w io.Writer,
+	id, contact string,
+	msgNum int64,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	var notes []*msgdb.Note
+	if contact != "" {
+		contactMapped, err := identity.Map(contact)
+		if err != nil {
+			return err
+		}
+		notes, err = ce.msgDB.GetContactNotes(idMapped, contactMapped)
+		if err != nil {
+			return err
+		}
+	} else {
+		notes, err = ce.msgDB.GetMessageNotes(idMapped, msgNum)
+		if err != nil {
+			return err
+		}
+	}
+	printNotes(w, notes)
+	return nil
+}
+
+func (ce *CtrlEngine) noteSearch(w io.Writer, id, search string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	notes, err := ce.msgDB.SearchNotes(idMapped, search)
+	if err != nil {
+		return err
+	}
+	printNotes(w, notes)
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/urfave/cli"
+)
+
+// isOffline returns true, if the engine runs in --offline mode and has not
+// been switched online with the 'online' command.
+func (ce *CtrlEngine) isOffline(c *cli.Context) bool {
+	return c.GlobalBool("offline") && !ce.wentOnline
+}
+
+// pendingCount returns the number of pending messages of the given nyms
+// (not encrypted yet and in outqueue).
+func (ce *CtrlEngine) pendingCount(nyms []string) (int64, error) {
+	var pending int64
+	for _, nym := range nyms {
+		toSend, outQueue, err := ce.msgDB.GetPendingCount(nym)
+		if err != nil {
+			return 0, err
+		}
+		pending += toSend + outQueue
+	}
+	return pending, nil
+}
+
+// goOnline checks whether the network is available by connecting the wallet
+// to the service guard. If it is, the engine stays online for the remainder
+// of the session.
+func (ce *CtrlEngine) goOnline(c *cli.Context) error {
+	ce.client.GoOnline()
+	if err := ce.client.GetVerifyKeys(); err != nil {
+		ce.client.GoOffline()
+		return err
+	}
+	ce.wentOnline = true
+	// update outdated config, now that we can
+	return ce.getConfig(c.GlobalString("homedir"), false)
+}
+
+// online switches from --offline mode to online mode and flushes the
+// outqueue and the pending fetches of user ID id (or all user IDs). With
+// wait set the network is probed every interval until it becomes available
+// (or until interrupted). Progress is reported on statfp.
+func (ce *CtrlEngine) online(
+	c *cli.Context,
+	id string,
+	all, wait bool,
+	interval time.Duration,
+	statfp io.Writer,
+) error {
+	if interval <= 0 {
+		return log.Error("ctrlengine: online interval must be positive")
+	}
+	nyms, err := ce.getNyms(id, all)
+	if err != nil {
+		return err
+	}
+
+	// wait for network
+	if !ce.wentOnline {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		defer signal.Stop(sigs)
+		for {
+			err := ce.goOnline(c)
+			if err == nil {
+				break
+			}
+			if !wait {
+				return log.Errorf("ctrlengine: network not available: %s", err)
+			}
+			log.Infof("ctrlengine: network not available, retry in %s: %s",
+				interval, err)
+			fmt.Fprintf(statfp, "network not available, retry in %s\n",
+				interval)
+			select {
+			case <-time.After(interval):
+			case <-sigs:
+				return log.Error("ctrlengine: online: interrupted")
+			}
+		}
+	}
+	log.Info("ctrlengine: online")
+	fmt.Fprintln(statfp, "online")
+
+	// flush outqueue
+	observer, err := ce.observer()
+	if err != nil {
+		return err
+	}
+	if !observer {
+		pending, err := ce.pendingCount(nyms)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(statfp, "sending %d pending message(s)\n", pending)
+		if err := ce.msgSend(c, id, all); err != nil {
+			return err
+		}
+		left, err := ce.pendingCount(nyms)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(statfp, "%d message(s) sent, %d pending\n",
+			pending-left, left)
+	}
+
+	// pending fetches
+	fmt.Fprintln(statfp, "fetching messages")
+	if err := ce.msgFetch(c, id, all, ""); err != nil {
+		return err
+	}
+	fmt.Fprintln(statfp, "messages fetched")
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/unlock"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+/*
+Passphrase lifecycle:
+
+Every command reads the passphrases it needs from the passphrase file
+descriptor at once (see readPassphrase) and closes the descriptor right
+afterwards (see closePassphraseFD), no descriptor is left open for later
+commands. Terminals and the standard descriptors are never closed.
+
+The passphrase of the databases is kept in ce.passphrase (the guarded buffer,
+zeroed by Close). Later commands of the same session (interactive mode)
+consume the guarded buffer instead of reading the passphrase again. If a
+command needs a passphrase which is not in the guarded buffer (e.g., the new
+passphrase of 'db rekey') after the descriptor has been closed, re-entry is
+requested with the structured status prompt
+
+  PASSPHRASE:\t<description>
+
+and the passphrase is read from the terminal.
+
+If the databases are bound to a keyfile (see 'db addkeyfile'), the guarded
+buffer holds the unlock secret derived from the passphrase and the keyfile
+instead (see unlockPassphrase). In keyfile mode no passphrase is read at all.
+*/
+
+// readPassphrase reads a single passphrase described by name (e.g., "old
+// passphrase") from the passphrase file descriptor. If again is true, the
+// passphrase is read again for confirmation. The returned passphrase is a
+// copy which should be zeroed by the caller.
+func (ce *CtrlEngine) readPassphrase(
+	statusfp io.Writer,
+	name string,
+	again bool,
+) ([]byte, error) {
+	var repeat string
+	if again {
+		repeat = " again"
+	}
+	if ce.passphraseFDClosed {
+		// request re-entry
+		if !interactive {
+			return nil, log.Error(ErrPassphraseFDClosed)
+		}
+		fmt.Fprintf(statusfp, "PASSPHRASE:\t%s%s\n", name, repeat)
+		log.Infof("request re-entry of %s%s", name, repeat)
+		passphrase, err := line.PasswordPrompt("")
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		return []byte(passphrase), nil
+	}
+	fd := ce.fileTable.PassphraseFD
+	fmt.Fprintf(statusfp, "read %s from fd %d%s (not echoed)\n", name, fd,
+		repeat)
+	log.Infof("read %s from fd %d%s (not echoed)", name, fd, repeat)
+	if terminal.IsTerminal(int(fd)) {
+		passphrase, err := terminal.ReadPassword(int(fd))
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		log.Info("done")
+		return passphrase, nil
+	}
+	if ce.passphraseScanner == nil {
+		ce.passphraseScanner = bufio.NewScanner(ce.fileTable.PassphraseFP)
+	}
+	if !ce.passphraseScanner.Scan() {
+		if err := ce.passphraseScanner.Err(); err != nil {
+			return nil, log.Error(err)
+		}
+		return nil, log.Errorf("ctrlengine: cannot read %s: fd %d closed",
+			name, fd)
+	}
+	// copy passphrase out of the scanner buffer
+	passphrase := append([]byte(nil), ce.passphraseScanner.Bytes()...)
+	log.Info("done")
+	return passphrase, nil
+}
+
+// closePassphraseFD closes the passphrase file descriptor after all
+// passphrases of a command have been read. Terminals and the standard
+// descriptors (stdin, stdout, and stderr) are kept open.
+func (ce *CtrlEngine) closePassphraseFD() {
+	fd := ce.fileTable.PassphraseFD
+	if ce.passphraseFDClosed || fd <= 2 || terminal.IsTerminal(int(fd)) {
+		return
+	}
+	if err := ce.fileTable.PassphraseFP.Close(); err != nil {
+		log.Warnf("ctrlengine: cannot close passphrase fd %d: %s", fd, err)
+	}
+	log.Infof("closed passphrase fd %d", fd)
+	ce.passphraseScanner = nil
+	ce.passphraseFDClosed = true
+}
+
+// getPassphrase returns the unlock secret of the databases in homedir from
+// the guarded buffer. If the buffer is empty, the passphrase is read from the
+// passphrase file descriptor (which is closed afterwards) and the unlock
+// secret is derived from it (see unlockPassphrase).
+func (ce *CtrlEngine) getPassphrase(statusfp io.Writer, homedir string) ([]byte, error) {
+	if ce.passphrase == nil {
+		passphrase, err := ce.unlockPassphrase(statusfp, homedir, "passphrase")
+		if err != nil {
+			return nil, err
+		}
+		ce.closePassphraseFD()
+		ce.passphrase = passphrase
+	}
+	return ce.passphrase, nil
+}
+
+// unlockPassphrase reads the passphrase described by name and returns the
+// unlock secret of the databases in homedir derived from it. If the
+// databases are unlocked with a keyfile (see 'db addkeyfile'), the secret is
+// combined with the passphrase or, in keyfile mode, no passphrase is read at
+// all. The returned secret should be zeroed by the caller.
+func (ce *CtrlEngine) unlockPassphrase(
+	statusfp io.Writer,
+	homedir, name string,
+) ([]byte, error) {
+	cfg, err := unlock.Load(homedir)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var passphrase []byte
+	defer bzero.Bytes(passphrase)
+	if cfg.NeedsPassphrase() {
+		passphrase, err = ce.readPassphrase(statusfp, name, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg != nil {
+		log.Infof("unlock with %s (%s mode)", cfg.Source(), cfg.Mode)
+	}
+	secret, err := cfg.Unlock(passphrase)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return secret, nil
+}
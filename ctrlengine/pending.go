@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+func (ce *CtrlEngine) pendingList(w io.Writer, id string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	entries, err := ce.msgDB.GetPending(idMapped)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		date := time.Unix(e.Date, 0).Format(time.RFC3339)
+		restart := "-"
+		if e.Restart {
+			restart = "restart"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", e.PID, date, e.From, e.Size,
+			restart)
+	}
+	return nil
+}
+
+// pendingRestart requests a session restart with contact, which is sent
+// with the next message to contact. Pending messages from contact are
+// retried after the first message of the new session has been received.
+func (ce *CtrlEngine) pendingRestart(statfp io.Writer, id, contact string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	if err := ce.msgDB.RequestRestart(idMapped, contactMapped); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: session restart %s -> %s requested", idMapped,
+		contactMapped)
+	fmt.Fprintf(statfp, "session with %s is restarted with next message to %s\n",
+		contactMapped, contactMapped)
+	return nil
+}
+
+func (ce *CtrlEngine) pendingDelete(id string, pid int64) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	if err := ce.msgDB.DelPending(idMapped, pid); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: pending message %d deleted", pid)
+	return nil
+}
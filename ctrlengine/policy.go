@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/urfave/cli"
+)
+
+// checkReceivePolicy checks the decrypted message plainMsg against policy.
+// If the message violates the policy, the reason is returned (otherwise "").
+func checkReceivePolicy(policy *msgdb.ReceivePolicy, plainMsg string) string {
+	if policy.MaxMsgSize > 0 && len(plainMsg) > policy.MaxMsgSize {
+		return fmt.Sprintf("message size %d exceeds maximum of %d bytes",
+			len(plainMsg), policy.MaxMsgSize)
+	}
+	// plain text messages have no attachments
+	_, _, _, attachments, err := mime.Parse(strings.NewReader(plainMsg))
+	if err != nil {
+		return ""
+	}
+	if policy.MaxAttachments >= 0 && len(attachments) > policy.MaxAttachments {
+		return fmt.Sprintf("%d attachments exceed maximum of %d",
+			len(attachments), policy.MaxAttachments)
+	}
+	if policy.RejectExecutables {
+		for _, attachment := range attachments {
+			if attachment.IsExecutable() {
+				return fmt.Sprintf("executable attachment '%s'",
+					attachment.Filename)
+			}
+		}
+	}
+	return ""
+}
+
+func (ce *CtrlEngine) policyShow(w io.Writer) error {
+	policy, err := ce.msgDB.GetReceivePolicy()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "max-size=%d\n", policy.MaxMsgSize)
+	fmt.Fprintf(w, "max-attachments=%d\n", policy.MaxAttachments)
+	fmt.Fprintf(w, "reject-executables=%t\n", policy.RejectExecutables)
+	return nil
+}
+
+func (ce *CtrlEngine) policySet(c *cli.Context) error {
+	policy, err := ce.msgDB.GetReceivePolicy()
+	if err != nil {
+		return err
+	}
+	if c.IsSet("max-size") {
+		policy.MaxMsgSize = c.Int("max-size")
+	}
+	if c.IsSet("max-attachments") {
+		policy.MaxAttachments = c.Int("max-attachments")
+	}
+	if c.IsSet("reject-executables") {
+		policy.RejectExecutables = c.BoolT("reject-executables")
+	}
+	return ce.msgDB.SetReceivePolicy(policy)
+}
+
+func (ce *CtrlEngine) quarantineList(w io.Writer, id string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	entries, err := ce.msgDB.GetQuarantine(idMapped)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		date := time.Unix(e.Date, 0).Format(time.RFC3339)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", e.QID, date, e.From, e.Size,
+			e.Reason)
+	}
+	return nil
+}
+
+func (ce *CtrlEngine) quarantineDelete(id string, qid int64) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	if err := ce.msgDB.DelQuarantine(idMapped, qid); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: quarantined message %d deleted", qid)
+	return nil
+}
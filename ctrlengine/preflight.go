@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
+	"github.com/urfave/cli"
+)
+
+// preflight checks that the external binaries mutecrypt and muteproto (which
+// are executed in subprocess mode) can be found in PATH and match the version
+// of mutectrl. Problems are reported on statfp together with a remediation,
+// before any command is accepted.
+func preflight(c *cli.Context, statfp io.Writer) error {
+	// mutecrypt: protocol handshake
+	if err := lookBinary(statfp, "mutecrypt"); err != nil {
+		return err
+	}
+	// --keyserver: the handshake must work before a configuration exists
+	out, err := preflightRun(c, "mutecrypt", "--keyserver", "protocol",
+		"describe", "--json")
+	if err != nil {
+		fmt.Fprintf(statfp, "PREFLIGHT:\tmutecrypt does not work (%s), "+
+			"reinstall Mute\n", err)
+		return err
+	}
+	var p def.Protocol
+	if err := json.Unmarshal(out, &p); err != nil {
+		fmt.Fprintf(statfp, "PREFLIGHT:\tmutecrypt is too old (no protocol "+
+			"description), reinstall Mute\n")
+		return log.Error(err)
+	}
+	if err := checkBinaryVersion(statfp, "mutecrypt", p.Version); err != nil {
+		return err
+	}
+	supported := false
+	for _, v := range p.MessageVersions {
+		if v == msg.Version {
+			supported = true
+		}
+	}
+	if !supported {
+		fmt.Fprintf(statfp, "PREFLIGHT:\tmutecrypt does not support message "+
+			"version %d, reinstall Mute\n", msg.Version)
+		return log.Errorf("ctrlengine: mutecrypt does not support message version %d",
+			msg.Version)
+	}
+	// muteproto: version only
+	if err := lookBinary(statfp, "muteproto"); err != nil {
+		return err
+	}
+	out, err = preflightRun(c, "muteproto", "--version")
+	if err != nil {
+		fmt.Fprintf(statfp, "PREFLIGHT:\tmuteproto does not work (%s), "+
+			"reinstall Mute\n", err)
+		return err
+	}
+	// first line of output: "muteproto version X" (see release.PrintVersion)
+	firstLine := strings.SplitN(string(out), "\n", 2)[0]
+	fields := strings.Fields(firstLine)
+	var v string
+	if len(fields) > 0 {
+		v = fields[len(fields)-1]
+	}
+	if err := checkBinaryVersion(statfp, "muteproto", v); err != nil {
+		return err
+	}
+	log.Info("ctrlengine: preflight successful")
+	return nil
+}
+
+// preflightRun runs the binary name with the global options of c and the
+// given args and returns its output.
+func preflightRun(c *cli.Context, name string, cmdArgs ...string) ([]byte, error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+	}
+	args = append(args, cmdArgs...)
+	cmd := exec.Command(name, args...)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		return nil, log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return outbuf.Bytes(), nil
+}
+
+// lookBinary checks that the binary name can be found in PATH.
+func lookBinary(statfp io.Writer, name string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		fmt.Fprintf(statfp, "PREFLIGHT:\t%s not found in PATH, install it "+
+			"next to mutectrl or add its directory to PATH\n", name)
+		return log.Errorf("ctrlengine: %s not found in PATH", name)
+	}
+	log.Infof("ctrlengine: preflight: %s found at %s", name, path)
+	return nil
+}
+
+// checkBinaryVersion checks that the binary name has the same version v as
+// mutectrl.
+func checkBinaryVersion(statfp io.Writer, name, v string) error {
+	if v != version.Number {
+		fmt.Fprintf(statfp, "PREFLIGHT:\t%s has version %s, but mutectrl has "+
+			"version %s, install matching versions\n", name, v, version.Number)
+		return log.Errorf("ctrlengine: %s version mismatch (%s != %s)", name,
+			v, version.Number)
+	}
+	return nil
+}
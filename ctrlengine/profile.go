@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/msgdb"
+)
+
+// networkProfile defines the network related settings of a profile.
+type networkProfile struct {
+	numOfKeys       int           // number of precomputed future message keys
+	smallPadding    bool          // pad messages to smallest fitting size
+	fetchconfPeriod time.Duration // minimum duration between config fetches
+	checkUpdates    bool          // check for software updates
+	upkeepPeriod    time.Duration // minimum period of `upkeep all` (batching)
+}
+
+var networkProfiles = map[string]*networkProfile{
+	msgdb.ProfileNormal: {
+		numOfKeys:       msg.NumOfFutureKeys,
+		smallPadding:    false,
+		fetchconfPeriod: def.FetchconfMinDuration,
+		checkUpdates:    true,
+		upkeepPeriod:    0,
+	},
+	// the constrained profile reduces the traffic for users on satellite or
+	// metered connections: less key material is precomputed, short messages
+	// are padded to smaller sizes, upkeep tasks are batched into daily runs,
+	// and non-essential syncs (config fetches, update checks) are deferred.
+	msgdb.ProfileConstrained: {
+		numOfKeys:       10,
+		smallPadding:    true,
+		fetchconfPeriod: def.FetchconfMaxDuration - 24*time.Hour,
+		checkUpdates:    false,
+		upkeepPeriod:    24 * time.Hour,
+	},
+}
+
+// loadProfile loads the network profile stored in msgDB.
+func (ce *CtrlEngine) loadProfile() error {
+	name, err := ce.msgDB.GetNetworkProfile()
+	if err != nil {
+		return err
+	}
+	profile, ok := networkProfiles[name]
+	if !ok {
+		profile = networkProfiles[msgdb.ProfileNormal]
+	}
+	ce.profileName = name
+	ce.profile = profile
+	return nil
+}
+
+// networkProfile returns the active network profile.
+func (ce *CtrlEngine) networkProfile() *networkProfile {
+	if ce.profile == nil {
+		return networkProfiles[msgdb.ProfileNormal]
+	}
+	return ce.profile
+}
+
+func (ce *CtrlEngine) profileShow(w io.Writer) error {
+	if err := ce.loadProfile(); err != nil {
+		return err
+	}
+	p := ce.profile
+	fmt.Fprintf(w, "profile=%s\n", ce.profileName)
+	fmt.Fprintf(w, "num-keys=%d\n", p.numOfKeys)
+	fmt.Fprintf(w, "small-padding=%t\n", p.smallPadding)
+	fmt.Fprintf(w, "fetchconf-period=%s\n", p.fetchconfPeriod)
+	fmt.Fprintf(w, "check-updates=%t\n", p.checkUpdates)
+	fmt.Fprintf(w, "upkeep-period=%s\n", p.upkeepPeriod)
+	return nil
+}
+
+// profileSet switches to the network profile with the given name. The switch
+// takes effect immediately (also in interactive mode).
+func (ce *CtrlEngine) profileSet(name string) error {
+	if err := ce.msgDB.SetNetworkProfile(name); err != nil {
+		return err
+	}
+	return ce.loadProfile()
+}
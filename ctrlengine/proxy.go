@@ -0,0 +1,49 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mutecomm/mute/util/netproxy"
+	"github.com/urfave/cli"
+)
+
+// loadProxy configures the proxy stored in msgDB, unless a proxy has been
+// given on the command line (or in the environment), which takes precedence.
+func (ce *CtrlEngine) loadProxy(c *cli.Context) error {
+	if c.GlobalString("proxy") != "" || c.GlobalString("proxy-domains") != "" {
+		return nil
+	}
+	proxyURL, domainProxies, err := ce.msgDB.GetProxy()
+	if err != nil {
+		return err
+	}
+	if proxyURL == "" && domainProxies == "" {
+		return nil
+	}
+	return netproxy.Apply(proxyURL, domainProxies)
+}
+
+func (ce *CtrlEngine) proxyShow(w io.Writer) error {
+	proxyURL, domainProxies, err := ce.msgDB.GetProxy()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "proxy=%s\n", proxyURL)
+	fmt.Fprintf(w, "proxy-domains=%s\n", domainProxies)
+	return nil
+}
+
+// proxySet stores the proxy configuration in msgDB. The new configuration
+// takes effect immediately (also in interactive mode).
+func (ce *CtrlEngine) proxySet(proxyURL, domainProxies string) error {
+	// validate configuration before storing it
+	if err := netproxy.Apply(proxyURL, domainProxies); err != nil {
+		return err
+	}
+	return ce.msgDB.SetProxy(proxyURL, domainProxies)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
+)
+
+// outQueueState returns the delivery state of the given outqueue entry.
+func outQueueState(e *msgdb.OutQueueInfo, now int64) string {
+	switch {
+	case e.Resend:
+		return "resend"
+	case e.NextAttempt > now:
+		return "retry " + time.Unix(e.NextAttempt, 0).Format(time.RFC3339)
+	case e.Envelope:
+		return "ready"
+	default:
+		return "encrypted"
+	}
+}
+
+// queueList writes the outqueue and inqueue entries of user ID id to w.
+func (ce *CtrlEngine) queueList(w io.Writer, id string) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	outEntries, err := ce.msgDB.ListOutQueue(idMapped)
+	if err != nil {
+		return err
+	}
+	now := times.Now()
+	for _, e := range outEntries {
+		fmt.Fprintf(w, "out\t%d\t%s\t%s-%s\t%s\t%d\t%d\n", e.MsgID, e.Peer,
+			def.FormatDelay(e.MinDelay), def.FormatDelay(e.MaxDelay),
+			outQueueState(e, now), e.Attempts, e.Size)
+	}
+	inEntries, err := ce.msgDB.ListInQueue(idMapped)
+	if err != nil {
+		return err
+	}
+	for _, e := range inEntries {
+		contact := e.ContactID
+		if contact == "" {
+			contact = "-"
+		}
+		state := "encrypted"
+		if e.Envelope {
+			state = "envelope"
+		}
+		fmt.Fprintf(w, "in\t%d\t%s\t%s\t%s\t%d\n", e.IQIdx, contact,
+			time.Unix(e.Date, 0).Format(time.RFC3339), state, e.Size)
+	}
+	return nil
+}
+
+// queueRetry retries the delivery of message msgID of user ID id (of all
+// queued messages, if msgID is 0).
+func (ce *CtrlEngine) queueRetry(id string, msgID int64) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	if err := ce.msgDB.RetryOutQueue(idMapped, msgID); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: retry delivery of queued message(s) of %s", id)
+	return nil
+}
+
+// queueDrop cancels the delivery of the queued message msgID of user ID id.
+func (ce *CtrlEngine) queueDrop(id string, msgID int64) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	if err := ce.msgDB.DropOutQueue(idMapped, msgID); err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: delivery of message %d cancelled", msgID)
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/log"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msg/msgid"
+	"github.com/mutecomm/mute/util/jsonclient"
+	"github.com/urfave/cli"
+)
+
+// sendReceipts encrypts all pending receipts of nym and adds them to the
+// outqueue. Receipts are only pending for contacts which opted in (see
+// msgdb.SetContactReceipts). The nymaddresses in recvNymAddresses are reused
+// and extended (see msgSendNym).
+func (ce *CtrlEngine) sendReceipts(
+	c *cli.Context,
+	nym string,
+	accounts []string,
+	recvNymAddresses map[string]string,
+) error {
+	for {
+		msgNum, peer, ackID, status, err := ce.msgDB.GetPendingReceipt(nym)
+		if err != nil {
+			return err
+		}
+		if msgNum == 0 {
+			return nil // no more pending receipts
+		}
+		recvNymAddress, ok := recvNymAddresses[peer]
+		if !ok {
+			recvNymAddress, err = ce.recvNymAddress(nym, peer, accounts)
+			if err != nil {
+				return err
+			}
+			recvNymAddresses[peer] = recvNymAddress
+		}
+		messageID, err := msgid.Generate(nym, cipher.RandReader)
+		if err != nil {
+			return log.Error(err)
+		}
+		header := mimeMsg.Header{
+			From:      nym,
+			To:        peer,
+			MessageID: messageID,
+			InReplyTo: ackID,
+		}
+		var receipt bytes.Buffer
+		if err := mimeMsg.NewReceipt(&receipt, header, status); err != nil {
+			return err
+		}
+		enc, nymaddress, err := ce.encrypt(c, nym, peer, receipt.Bytes(),
+			false, recvNymAddress)
+		if err == jsonclient.ErrCircuitOpen {
+			// key server unavailable: keep remaining receipts pending
+			log.Warnf("ctrlengine: key server unavailable, receipts of %s stay pending",
+				nym)
+			fmt.Fprintf(ce.fileTable.StatusFP,
+				"key server unavailable, receipts of %s stay pending\n", nym)
+			return nil
+		}
+		if err != nil {
+			return log.Error(err)
+		}
+		minDelay, maxDelay, err := ce.msgDB.GetContactDelays(nym, peer)
+		if err != nil {
+			return err
+		}
+		if minDelay == 0 {
+			minDelay, maxDelay = def.MinDelay, def.MaxDelay
+		}
+		log.Debugf("add '%s' receipt for message %d", status, msgNum)
+		err = ce.msgDB.AddOutQueueReceipt(nym, msgNum, enc, nymaddress,
+			minDelay, maxDelay, status)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// procReceipt processes the decrypted receipt from senderID contained in the
+// inqueue entry with index iqIdx for user ID myID. Receipts from contacts
+// which did not opt in are discarded.
+func (ce *CtrlEngine) procReceipt(iqIdx int64, myID, senderID, receipt string) error {
+	header, status, err := mimeMsg.DecodeReceipt(receipt)
+	if err != nil {
+		log.Warnf("ctrlengine: cannot decode receipt from %s -> discard receipt: %s",
+			senderID, err)
+		return ce.msgDB.DelInQueue(iqIdx)
+	}
+	if msgid.Parse(header.MessageID) != senderID ||
+		msgid.Parse(header.InReplyTo) != myID {
+		log.Warnf("ctrlengine: receipt IDs do not match %s and %s -> discard receipt",
+			senderID, myID)
+		return ce.msgDB.DelInQueue(iqIdx)
+	}
+	receipts, err := ce.msgDB.GetContactReceipts(myID, senderID)
+	if err != nil {
+		return err
+	}
+	if receipts {
+		log.Debugf("'%s' receipt for message %s", status, header.InReplyTo)
+		err := ce.msgDB.SetMessageReceipt(myID, senderID, header.InReplyTo,
+			status)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("ctrlengine: receipts disabled for %s -> discard receipt",
+			senderID)
+	}
+	return ce.msgDB.DelInQueue(iqIdx)
+}
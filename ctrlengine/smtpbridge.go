@@ -0,0 +1,275 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	mimeMsg "github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/smtpd"
+	"github.com/urfave/cli"
+)
+
+// defaultSMTPListen is the default listen address of the SMTP bridge.
+const defaultSMTPListen = "127.0.0.1:2525"
+
+// smtpRequest is a request of an SMTP session which is processed by the loop
+// of the SMTP bridge (the message DB is not accessed concurrently).
+type smtpRequest struct {
+	cmd   string // "MAIL", "RCPT", or "DATA"
+	user  string // authenticated user ID (MAIL only)
+	from  string
+	to    []string
+	data  []byte
+	reply chan error
+}
+
+// smtpHandler implements smtpd.Handler by passing the requests to the loop of
+// the SMTP bridge.
+type smtpHandler struct {
+	reqs chan<- *smtpRequest
+}
+
+func (h *smtpHandler) do(req *smtpRequest) error {
+	req.reply = make(chan error, 1)
+	h.reqs <- req
+	return <-req.reply
+}
+
+func (h *smtpHandler) Mail(user, from string) error {
+	return h.do(&smtpRequest{cmd: "MAIL", user: user, from: from})
+}
+
+func (h *smtpHandler) Rcpt(from, to string) error {
+	return h.do(&smtpRequest{cmd: "RCPT", from: from, to: []string{to}})
+}
+
+func (h *smtpHandler) Data(from string, to []string, data []byte) error {
+	return h.do(&smtpRequest{cmd: "DATA", from: from, to: to, data: data})
+}
+
+// smtpMail checks that the sender from is one of the user IDs nyms.
+func smtpMail(from string, nyms []string) (string, error) {
+	fromMapped, err := identity.Map(from)
+	if err == nil {
+		for _, nym := range nyms {
+			if nym == fromMapped {
+				return fromMapped, nil
+			}
+		}
+	}
+	return "", &smtpd.Error{
+		Code: 553,
+		Msg:  fmt.Sprintf("sender %s is not a user ID of this bridge", from),
+	}
+}
+
+// smtpAuth checks that username is one of the user IDs nyms and password the
+// password of the bridge.
+func smtpAuth(username, password, bridgePassword string, nyms []string) error {
+	if !checkBridgePassword(password, bridgePassword) {
+		return log.Errorf("ctrlengine: SMTP bridge: wrong password for %s",
+			username)
+	}
+	_, err := smtpMail(username, nyms)
+	return err
+}
+
+// smtpMailFrom checks that the sender from is the authenticated user ID user.
+func smtpMailFrom(user, fromMapped string) error {
+	userMapped, err := identity.Map(user)
+	if err != nil || userMapped != fromMapped {
+		return &smtpd.Error{
+			Code: 553,
+			Msg: fmt.Sprintf("sender %s is not the authenticated user ID %s",
+				fromMapped, user),
+		}
+	}
+	return nil
+}
+
+// smtpRcpt checks that the recipient to is a (white listed) contact of the
+// user ID fromMapped.
+func (ce *CtrlEngine) smtpRcpt(fromMapped, to string) error {
+	toMapped, err := identity.Map(to)
+	if err != nil {
+		return &smtpd.Error{Code: 553, Msg: err.Error()}
+	}
+	unmappedID, _, contactType, err := ce.msgDB.GetContact(fromMapped, toMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" || contactType != msgdb.WhiteList {
+		return &smtpd.Error{
+			Code: 550,
+			Msg:  fmt.Sprintf("%s is not a contact of %s", to, fromMapped),
+		}
+	}
+	return nil
+}
+
+// smtpData adds the submitted mail data from user ID fromMapped (from
+// unmapped) to the recipients rcpts to the message DB. Recipients in the 'To'
+// header are 'To:' recipients, all other recipients (also 'Bcc') are 'Cc:'
+// recipients.
+func (ce *CtrlEngine) smtpData(
+	c *cli.Context,
+	fromMapped, from string,
+	rcpts []string,
+	data []byte,
+) error {
+	header, _, subject, message, mimeAttachments, err :=
+		mimeMsg.ParseMail(bytes.NewReader(data))
+	if err != nil {
+		return &smtpd.Error{Code: 554, Msg: err.Error()}
+	}
+	toHeader := make(map[string]bool)
+	if header.To != "" {
+		for _, address := range strings.Split(header.To, ", ") {
+			if mapped, err := identity.Map(address); err == nil {
+				toHeader[mapped] = true
+			}
+		}
+	}
+	var to, cc []string
+	for _, rcpt := range rcpts {
+		mapped, err := identity.Map(rcpt)
+		if err != nil {
+			return err
+		}
+		if toHeader[mapped] {
+			to = append(to, rcpt)
+		} else {
+			cc = append(cc, rcpt)
+		}
+	}
+	if len(to) == 0 {
+		to, cc = cc, nil
+	}
+	attachments, err := decodeAttachments(mimeAttachments)
+	if err != nil {
+		return err
+	}
+	// only reply to known messages
+	var replyID string
+	if header.InReplyTo != "" {
+		exists, err := ce.msgDB.HasMessageID(fromMapped, header.InReplyTo)
+		if err != nil {
+			return err
+		}
+		if exists {
+			replyID = header.InReplyTo
+		}
+	}
+	return ce.addMessage(c, fromMapped, from, to, cc, subject+"\n"+message,
+		attachments, replyID, false, 0, 0, 0)
+}
+
+// smtpBridge runs an SMTP server on the loopback address listen which accepts
+// mails from local mail clients and adds them as messages from the user ID id
+// (or all user IDs) to the message DB (like 'msg add'). Clients must
+// authenticate as the sending user ID with the password of the bridge, which
+// is generated for every run and written to statfp. The recipients must be
+// contacts of the sending user ID. Unless noSend is set, added messages are
+// sent right away (like 'msg send').
+func (ce *CtrlEngine) smtpBridge(
+	c *cli.Context,
+	id string,
+	all bool,
+	listen string,
+	noSend bool,
+	statfp io.Writer,
+) error {
+	if err := ce.checkObserver(); err != nil {
+		return err
+	}
+	if !smtpd.IsLoopback(listen) {
+		return log.Errorf("ctrlengine: SMTP bridge must listen on loopback address, not %s",
+			listen)
+	}
+	nyms, err := ce.getNyms(id, all)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer l.Close()
+	reqs := make(chan *smtpRequest)
+	password := bridgePassword()
+	srv := &smtpd.Server{
+		Hostname: "localhost",
+		MaxSize:  mimeMsg.MaxMsgSize,
+		Handler:  &smtpHandler{reqs: reqs},
+		Auth: func(username, pw string) error {
+			return smtpAuth(username, pw, password, nyms)
+		},
+	}
+	go srv.Serve(l)
+
+	// handle interrupts
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	log.Infof("ctrlengine: SMTP bridge listening on %s", l.Addr())
+	fmt.Fprintf(statfp, "ctrlengine: SMTP bridge listening on %s\n", l.Addr())
+	fmt.Fprintf(statfp, "ctrlengine: SMTP bridge password: %s\n", password)
+
+	for {
+		select {
+		case req := <-reqs:
+			fromMapped, err := smtpMail(req.from, nyms)
+			if err != nil {
+				req.reply <- err
+				continue
+			}
+			switch req.cmd {
+			case "MAIL":
+				req.reply <- smtpMailFrom(req.user, fromMapped)
+			case "RCPT":
+				req.reply <- ce.smtpRcpt(fromMapped, req.to[0])
+			case "DATA":
+				err := ce.smtpData(c, fromMapped, req.from, req.to, req.data)
+				if err != nil {
+					if _, ok := err.(*smtpd.Error); !ok {
+						err = ce.translateError(err)
+					}
+					log.Warnf("ctrlengine: SMTP bridge: message from %s rejected: %s",
+						fromMapped, err)
+					req.reply <- err
+					continue
+				}
+				req.reply <- nil
+				log.Infof("ctrlengine: SMTP bridge: message from %s added",
+					fromMapped)
+				fmt.Fprintf(statfp, "message from %s added\n", fromMapped)
+				if noSend {
+					continue
+				}
+				if err := ce.msgSend(c, fromMapped, false); err != nil {
+					err = ce.translateError(err)
+					log.Errorf("ctrlengine: SMTP bridge: send failed: %s", err)
+					fmt.Fprintf(statfp, "ctrlengine: SMTP bridge: send failed: %s\n",
+						err)
+				}
+			}
+		case <-sigs:
+			log.Info("ctrlengine: SMTP bridge stopped (interrupt)")
+			fmt.Fprintln(statfp, "ctrlengine: SMTP bridge stopped")
+			return nil
+		}
+	}
+}
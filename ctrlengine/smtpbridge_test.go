@@ -0,0 +1,29 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"testing"
+)
+
+func TestSMTPAuth(t *testing.T) {
+	password := bridgePassword()
+	nyms := []string{"alice@mute.berlin"}
+	if err := smtpAuth("Alice@mute.berlin", password, password, nyms); err != nil {
+		t.Error(err)
+	}
+	if err := smtpAuth("alice@mute.berlin", "wrong", password, nyms); err == nil {
+		t.Error("wrong password should be rejected")
+	}
+	if err := smtpAuth("bob@mute.berlin", password, password, nyms); err == nil {
+		t.Error("unknown user ID should be rejected")
+	}
+	if err := smtpMailFrom("Alice@mute.berlin", "alice@mute.berlin"); err != nil {
+		t.Error(err)
+	}
+	if err := smtpMailFrom("bob@mute.berlin", "alice@mute.berlin"); err == nil {
+		t.Error("sender other than the authenticated user ID should be rejected")
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/armor"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keydb"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// syncBundleVersion is the current version of sync bundles.
+const syncBundleVersion = "1.0"
+
+// syncBundle is the content of a sync file exchanged between the devices of
+// a user. It is encrypted and authenticated with the sync key shared between
+// the devices (see syncKey).
+type syncBundle struct {
+	VERSION  string           // version of the bundle format
+	CREATED  int64            // creation time of the bundle (Unix time)
+	SINCE    int64            // messages older than this time are not included
+	OBSERVER bool             // bundle without private signature keys
+	MSGDB    *msgdb.SyncDelta // state of msgDB
+	KEYDB    *keydb.SyncDelta // state of keyDB
+}
+
+// observer returns true, if this device is a decryption-only observer (see
+// 'sync export --observer').
+func (ce *CtrlEngine) observer() (bool, error) {
+	value, err := ce.msgDB.GetValue(msgdb.ObserverMode)
+	if err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
+
+// checkObserver returns ErrObserver, if this device is a decryption-only
+// observer.
+func (ce *CtrlEngine) checkObserver() error {
+	observer, err := ce.observer()
+	if err != nil {
+		return err
+	}
+	if observer {
+		return log.Error(ErrObserver)
+	}
+	return nil
+}
+
+// syncKey returns the sync key stored in msgDB. If no sync key exists and
+// generate is true, a new one is generated and stored.
+func (ce *CtrlEngine) syncKey(generate bool) (*[32]byte, error) {
+	value, err := ce.msgDB.GetValue(msgdb.SyncKey)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	if value == "" {
+		if !generate {
+			return nil, log.Error("ctrlengine: no sync key defined, use 'sync key' first")
+		}
+		if _, err := io.ReadFull(cipher.RandReader, key[:]); err != nil {
+			return nil, log.Error(err)
+		}
+		if err := ce.msgDB.AddValue(msgdb.SyncKey, base64.Encode(key[:])); err != nil {
+			return nil, err
+		}
+		return &key, nil
+	}
+	k, err := base64.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != len(key) {
+		return nil, log.Error("ctrlengine: sync key has wrong length")
+	}
+	copy(key[:], k)
+	return &key, nil
+}
+
+// syncShowKey writes the sync key to w (generating it, if necessary). If set
+// is not empty, it is stored as the new sync key instead.
+func (ce *CtrlEngine) syncShowKey(w io.Writer, set string) error {
+	if set != "" {
+		k, err := base64.Decode(set)
+		if err != nil {
+			return err
+		}
+		if len(k) != 32 {
+			return log.Error("ctrlengine: sync key must be 32 bytes long")
+		}
+		return ce.msgDB.AddValue(msgdb.SyncKey, set)
+	}
+	key, err := ce.syncKey(true)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "SYNCKEY:\t%s\n", base64.Encode(key[:]))
+	return nil
+}
+
+func (ce *CtrlEngine) mutecryptImportSync(
+	c *cli.Context,
+	passphrase []byte,
+	d *keydb.SyncDelta,
+) error {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"sync", "import",
+	}
+	cmd := ce.mutecrypt(c, args...)
+	var inbuf bytes.Buffer
+	if err := json.NewEncoder(&inbuf).Encode(d); err != nil {
+		return log.Error(err)
+	}
+	cmd.Stdin = &inbuf
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return log.Error(err)
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return nil
+}
+
+// exportKeySync returns the key material of keyDB to synchronize (without
+// private signature keys, if observer is true).
+func (ce *CtrlEngine) exportKeySync(
+	c *cli.Context,
+	observer bool,
+) (*keydb.SyncDelta, error) {
+	var buf bytes.Buffer
+	if subprocess(c) {
+		args := []string{"sync", "export"}
+		if observer {
+			args = append(args, "--observer")
+		}
+		out, err := ce.mutecryptRun(c, "", ce.passphrase, args...)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(out)
+	} else {
+		cryptEng, err := ce.cryptEngine(c)
+		if err != nil {
+			return nil, err
+		}
+		if err := cryptEng.ExportSync(&buf, observer); err != nil {
+			return nil, err
+		}
+	}
+	var d keydb.SyncDelta
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		return nil, log.Error(err)
+	}
+	return &d, nil
+}
+
+// importKeySync merges the key material d into keyDB.
+func (ce *CtrlEngine) importKeySync(c *cli.Context, d *keydb.SyncDelta) error {
+	if subprocess(c) {
+		return ce.mutecryptImportSync(c, ce.passphrase, d)
+	}
+	cryptEng, err := ce.cryptEngine(c)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(d); err != nil {
+		return log.Error(err)
+	}
+	return cryptEng.ImportSync(&buf)
+}
+
+// syncExport writes an encrypted sync bundle with all nyms, contacts, key
+// material, and the messages of the last duration (all messages, if duration
+// is 0) to the file out, ASCII armored if armored is true. If observer is true
+// (or this device is an observer itself), the bundle provisions a
+// decryption-only observer device: it contains no private signature keys.
+func (ce *CtrlEngine) syncExport(
+	c *cli.Context,
+	statfp io.Writer,
+	out string,
+	duration time.Duration,
+	armored bool,
+	observer bool,
+) error {
+	key, err := ce.syncKey(false)
+	if err != nil {
+		return err
+	}
+	isObserver, err := ce.observer()
+	if err != nil {
+		return err
+	}
+	observer = observer || isObserver
+	var since int64
+	if duration > 0 {
+		since = times.Now() - int64(duration/time.Second)
+	}
+	bundle := &syncBundle{
+		VERSION:  syncBundleVersion,
+		CREATED:  times.Now(),
+		SINCE:    since,
+		OBSERVER: observer,
+	}
+	bundle.MSGDB, err = ce.msgDB.ExportSync(since)
+	if err != nil {
+		return err
+	}
+	bundle.KEYDB, err = ce.exportKeySync(c, observer)
+	if err != nil {
+		return err
+	}
+	jsn, err := json.Marshal(bundle)
+	if err != nil {
+		return log.Error(err)
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(cipher.RandReader, nonce[:]); err != nil {
+		return log.Error(err)
+	}
+	enc := secretbox.Seal(nonce[:], jsn, &nonce, key)
+	// write bundle (never overwrite existing files)
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := writeArtifact(f, armor.TypeSync, enc, armored); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return log.Error(err)
+	}
+	log.Infof("ctrlengine: sync bundle written to %s", out)
+	fmt.Fprintf(statfp, "sync bundle written to %s: %d nym(s), %d contact(s), %d message(s)\n",
+		out, len(bundle.MSGDB.Nyms), len(bundle.MSGDB.Contacts),
+		len(bundle.MSGDB.Messages))
+	return nil
+}
+
+// syncImport decrypts the (optionally ASCII armored) sync bundle in file in
+// and merges it into the local databases. Key material is imported first, so that imported nyms are
+// usable right away.
+func (ce *CtrlEngine) syncImport(c *cli.Context, statfp io.Writer, in string) error {
+	key, err := ce.syncKey(false)
+	if err != nil {
+		return err
+	}
+	enc, err := ioutil.ReadFile(in)
+	if err != nil {
+		return log.Error(err)
+	}
+	enc, err = readArtifact(armor.TypeSync, enc)
+	if err != nil {
+		return err
+	}
+	if len(enc) < 24+secretbox.Overhead {
+		return log.Error("ctrlengine: sync bundle too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], enc[:24])
+	jsn, ok := secretbox.Open(nil, enc[24:], &nonce, key)
+	if !ok {
+		return log.Error("ctrlengine: cannot decrypt sync bundle (wrong sync key?)")
+	}
+	var bundle syncBundle
+	if err := json.Unmarshal(jsn, &bundle); err != nil {
+		return log.Error(err)
+	}
+	if bundle.VERSION != syncBundleVersion {
+		return log.Errorf("ctrlengine: unsupported sync bundle version %s",
+			bundle.VERSION)
+	}
+	// an observer bundle only turns a fresh device into an observer (full
+	// devices keep their keys), a full bundle promotes an observer
+	nyms, err := ce.msgDB.GetNyms(true)
+	if err != nil {
+		return err
+	}
+	if bundle.KEYDB != nil {
+		if err := ce.importKeySync(c, bundle.KEYDB); err != nil {
+			return err
+		}
+	}
+	if !bundle.OBSERVER {
+		if err := ce.msgDB.AddValue(msgdb.ObserverMode, ""); err != nil {
+			return err
+		}
+	} else if len(nyms) == 0 {
+		if err := ce.msgDB.AddValue(msgdb.ObserverMode, "true"); err != nil {
+			return err
+		}
+		fmt.Fprintf(statfp, "observer mode: messages can be read, but not sent\n")
+	}
+	if bundle.MSGDB != nil {
+		if err := ce.msgDB.ImportSync(bundle.MSGDB); err != nil {
+			return err
+		}
+		fmt.Fprintf(statfp, "sync bundle imported: %d nym(s), %d contact(s), %d message(s)\n",
+			len(bundle.MSGDB.Nyms), len(bundle.MSGDB.Contacts),
+			len(bundle.MSGDB.Messages))
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mutecomm/mute/encode/armor"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/transcript"
+	"github.com/urfave/cli"
+)
+
+func containsID(ids []string, id string) bool {
+	for _, i := range ids {
+		if strings.TrimSpace(i) == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (ce *CtrlEngine) mutecryptSignTranscript(
+	c *cli.Context,
+	passphrase []byte,
+	id, contact string,
+	t *transcript.Transcript,
+) (*transcript.Transcript, error) {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"transcript", "sign",
+		"--id", id,
+		"--contact", contact,
+	}
+	cmd := ce.mutecrypt(c, args...)
+	var inbuf bytes.Buffer
+	if err := t.Write(&inbuf); err != nil {
+		return nil, err
+	}
+	cmd.Stdin = &inbuf
+	var outbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return nil, log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return transcript.Read(&outbuf)
+}
+
+// msgExportTranscript writes a signed transcript of the conversation between
+// id and contact to w, ASCII armored if armored is true.
+func (ce *CtrlEngine) msgExportTranscript(
+	c *cli.Context,
+	w io.Writer,
+	id, contact string,
+	armored bool,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	unmappedContact, _, _, err := ce.msgDB.GetContact(idMapped, contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedContact == "" {
+		return log.Errorf("ctrlengine: unknown contact %s", contact)
+	}
+	msgIDs, err := ce.msgDB.GetMsgIDs(idMapped)
+	if err != nil {
+		return err
+	}
+	t := &transcript.Transcript{
+		Exporter: idMapped,
+		Contact:  contactMapped,
+	}
+	for _, msgID := range msgIDs {
+		if msgID.From != contactMapped &&
+			!containsID(strings.Split(msgID.To, ","), contactMapped) {
+			continue
+		}
+		from, to, msg, date, err := ce.msgDB.GetMessage(idMapped, msgID.MsgID)
+		if err != nil {
+			return err
+		}
+		sigStatus, err := ce.msgDB.GetMessageSigStatus(idMapped, msgID.MsgID)
+		if err != nil {
+			return err
+		}
+		t.Messages = append(t.Messages, &transcript.Message{
+			MsgNum:    msgID.MsgID,
+			Incoming:  msgID.Incoming,
+			From:      from,
+			To:        to,
+			Date:      date,
+			Message:   msg,
+			Signature: sigStatus,
+		})
+	}
+	t, err = ce.mutecryptSignTranscript(c, ce.passphrase, idMapped, contactMapped, t)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := t.Write(&buf); err != nil {
+		return err
+	}
+	return writeArtifact(w, armor.TypeTranscript, buf.Bytes(), armored)
+}
+
+func (ce *CtrlEngine) mutecryptVerifyTranscript(
+	c *cli.Context,
+	passphrase []byte,
+	t *transcript.Transcript,
+) error {
+	args := []string{
+		"--homedir", c.GlobalString("homedir"),
+		"--loglevel", c.GlobalString("loglevel"),
+		"--logdir", c.GlobalString("logdir"),
+		"transcript", "verify",
+	}
+	cmd := ce.mutecrypt(c, args...)
+	var inbuf bytes.Buffer
+	if err := t.Write(&inbuf); err != nil {
+		return err
+	}
+	cmd.Stdin = &inbuf
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	ppR, ppW, err := os.Pipe()
+	if err != nil {
+		return log.Error(err)
+	}
+	defer ppR.Close()
+	ppW.Write(passphrase)
+	ppW.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ppR)
+	if err := cmd.Run(); err != nil {
+		return log.Errorf("%s: %s", err, strings.TrimSpace(errbuf.String()))
+	}
+	return nil
+}
+
+// verifyTranscript verifies the signature of transcript t and checks its key
+// history against the local hash chain.
+func (ce *CtrlEngine) verifyTranscript(
+	c *cli.Context,
+	t *transcript.Transcript,
+) error {
+	if subprocess(c) {
+		return ce.mutecryptVerifyTranscript(c, ce.passphrase, t)
+	}
+	cryptEng, err := ce.cryptEngine(c)
+	if err != nil {
+		return err
+	}
+	return cryptEng.VerifyTranscript(t)
+}
+
+// msgVerifyTranscript verifies the (optionally ASCII armored) transcript read
+// from r and writes a summary to w. The key history of the transcript is
+// checked against the local hash chain, the UID messages of exporter and
+// contact must have been looked up before.
+func (ce *CtrlEngine) msgVerifyTranscript(
+	c *cli.Context,
+	w io.Writer,
+	r io.Reader,
+) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return log.Error(err)
+	}
+	data, err = readArtifact(armor.TypeTranscript, data)
+	if err != nil {
+		return err
+	}
+	t, err := transcript.Read(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := ce.verifyTranscript(c, t); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "transcript signature: valid\n")
+	fmt.Fprintf(w, "key history: anchored in hash chain\n")
+	fmt.Fprintf(w, "exporter: %s\n", t.Exporter)
+	fmt.Fprintf(w, "contact: %s\n", t.Contact)
+	fmt.Fprintf(w, "created: %s (claimed by exporter)\n",
+		time.Unix(t.Created, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "messages: %d\n", len(t.Messages))
+	fmt.Fprintf(w, "keys: %d\n", len(t.KeyHistory))
+	return nil
+}
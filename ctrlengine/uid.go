@@ -12,19 +12,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/frankbraun/codechain/util/bzero"
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/admission"
 	"github.com/mutecomm/mute/keyserver/capabilities"
 	"github.com/mutecomm/mute/log"
 	mixclient "github.com/mutecomm/mute/mix/client"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/serviceguard/client"
+	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/times"
@@ -42,24 +45,24 @@ func decodeED25519PubKeyBase64(p string) (*[ed25519.PublicKeySize]byte, error) {
 	return ret, nil
 }
 
-func mutecryptNewUID(
+func (ce *CtrlEngine) mutecryptNewUID(
 	c *cli.Context,
 	passphrase []byte,
 	id, domain, host, mixaddress, nymaddress string,
+	validFrom string,
+	validFor time.Duration,
+	sigescrow bool,
 	client *client.Client,
+	invitationCode func(c *cli.Context) (string, error),
 ) error {
-	log.Infof("mutecryptNewUID(): id=%s, domain=%s", id, domain)
+	log.Infof("ce.mutecryptNewUID(): id=%s, domain=%s", id, domain)
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 	}
-	if host != "" {
-		args = append(args,
-			"--keyhost", host,
-			"--keyport", ":8080") // TODO: remove keyport hack!
-	}
-	cmd := exec.Command("mutecrypt", args...)
+	args = append(args, keyServerArgs(c, host)...)
+	cmd := ce.mutecrypt(c, args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -81,9 +84,17 @@ func mutecryptNewUID(
 	cmd.ExtraFiles = append(cmd.ExtraFiles, commandReader)
 
 	// generate UID
-	_, err = io.WriteString(commandWriter, strings.Join([]string{
-		"uid", "generate", "--id", id + "\n",
-	}, " "))
+	generate := []string{"uid", "generate", "--id", id}
+	if validFrom != "" {
+		generate = append(generate, "--valid-from", validFrom)
+	}
+	if validFor != 0 {
+		generate = append(generate, "--valid-for", validFor.String())
+	}
+	if sigescrow {
+		generate = append(generate, "--sigescrow")
+	}
+	_, err = io.WriteString(commandWriter, strings.Join(generate, " ")+"\n")
 	if err != nil {
 		return err
 	}
@@ -161,11 +172,21 @@ func mutecryptNewUID(
 	}
 
 	// try to register UID
-	_, err = io.WriteString(commandWriter, strings.Join([]string{
+	args = []string{
 		"uid", "register",
 		"--id", id,
-		"--token", base64.Encode(token.Token) + "\n",
-	}, " "))
+		"--token", base64.Encode(token.Token),
+	}
+	if caps.INVITATION {
+		invitation, err := invitationCode(c)
+		if err != nil {
+			client.UnlockToken(token.Hash)
+			return err
+		}
+		args = append(args, "--invitation", invitation)
+	}
+	args = append(args, "\n")
+	_, err = io.WriteString(commandWriter, strings.Join(args, " "))
 	if err != nil {
 		client.UnlockToken(token.Hash)
 		return err
@@ -266,7 +287,7 @@ func mutecryptNewUID(
 	return nil
 }
 
-func mutecryptHashchainSearch(
+func (ce *CtrlEngine) mutecryptHashchainSearch(
 	c *cli.Context,
 	id, host string,
 	passphrase []byte,
@@ -276,17 +297,13 @@ func mutecryptHashchainSearch(
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 	}
-	if host != "" {
-		args = append(args,
-			"--keyhost", host,
-			"--keyport", ":8080") // TODO: remove keyport hack!
-	}
+	args = append(args, keyServerArgs(c, host)...)
 	args = append(args,
 		"hashchain", "search",
 		"--search-only",
 		"--id", id,
 	)
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -303,17 +320,53 @@ func mutecryptHashchainSearch(
 	return nil
 }
 
+// checkValidity checks the fixed validity period of a new UID message given
+// by validFrom (RFC 3339) and validFor (see 'mutecrypt uid generate'), before
+// any tokens are spent.
+func checkValidity(validFrom string, validFor time.Duration) error {
+	if validFrom != "" {
+		t, err := time.Parse(time.RFC3339, validFrom)
+		if err != nil {
+			return log.Error(err)
+		}
+		if t.Unix()+int64(validFor.Seconds()) < times.Now() {
+			return log.Error(uid.ErrExpired)
+		}
+	}
+	if validFor != 0 {
+		if validFor < time.Duration(uid.MinValidity)*time.Second {
+			return log.Error(uid.ErrShortValidity)
+		}
+		if validFor > time.Duration(uid.MaxValidity)*time.Second {
+			return log.Error(uid.ErrFuture)
+		}
+	}
+	return nil
+}
+
 func (ce *CtrlEngine) uidNew(
 	c *cli.Context,
 	minDelay, maxDelay int32,
 	host string,
+	validFrom string,
+	validFor time.Duration,
 ) error {
+	if err := ce.checkObserver(); err != nil {
+		return err
+	}
 	// make sure the ID is well-formed
 	unmapped := c.String("id")
 	id, domain, err := identity.MapPlus(unmapped)
 	if err != nil {
 		return err
 	}
+	if err := checkValidity(validFrom, validFor); err != nil {
+		return err
+	}
+	if _, ok := def.KeyServerURL(domain); !ok {
+		return log.Errorf("ctrlengine: unknown domain %s (see 'domain add')",
+			domain)
+	}
 
 	// sync corresponding hashchain
 	if id != "keyserver" {
@@ -332,11 +385,20 @@ func (ce *CtrlEngine) uidNew(
 	}
 
 	// check that ID has not been registered already by other user
-	err = mutecryptHashchainSearch(c, id, c.String("host"), ce.passphrase)
+	err = ce.mutecryptHashchainSearch(c, id, c.String("host"), ce.passphrase)
 	if err == nil {
 		return log.Error(ErrUserIDTaken)
 	}
 
+	// get invitation code for account server, if required
+	var invitation string
+	if mixclient.AccountInvitation {
+		invitation, err = ce.invitationCode(c)
+		if err != nil {
+			return err
+		}
+	}
+
 	// get token from wallet
 	token, err := wallet.GetToken(ce.client, def.AccdUsage, def.AccdOwner)
 	if err != nil {
@@ -350,7 +412,8 @@ func (ce *CtrlEngine) uidNew(
 	}
 	var privkey [ed25519.PrivateKeySize]byte
 	copy(privkey[:], sk)
-	server, err := mixclient.PayAccount(&privkey, token.Token, "", def.CACert)
+	server, err := mixclient.PayNewAccount(&privkey, token.Token,
+		def.AccountServer(domain), invitation, def.CACert)
 	if err != nil {
 		ce.client.UnlockToken(token.Hash)
 		return log.Error(err)
@@ -375,8 +438,9 @@ func (ce *CtrlEngine) uidNew(
 	}
 
 	// generate UID
-	err = mutecryptNewUID(c, ce.passphrase, id, domain, host, mixaddress,
-		nymaddress, ce.client)
+	err = ce.mutecryptNewUID(c, ce.passphrase, id, domain, host, mixaddress,
+		nymaddress, validFrom, validFor, c.Bool("sigescrow"), ce.client,
+		ce.invitationCode)
 	if err != nil {
 		return err
 	}
@@ -406,19 +470,66 @@ func (ce *CtrlEngine) uidNew(
 	return nil
 }
 
-func (ce *CtrlEngine) uidEdit(unmappedID, fullName string) error {
+// invitationCode returns the invitation code given with --invitation. If no
+// code was given, it is read from the input file descriptor (once).
+func (ce *CtrlEngine) invitationCode(c *cli.Context) (string, error) {
+	if c.String("invitation") == "" {
+		if ce.fileTable.InputFP == nil {
+			return "", log.Error(admission.ErrInvitationRequired)
+		}
+		fmt.Fprintf(ce.fileTable.StatusFP,
+			"invitation code required, read it from fd %d\n",
+			ce.fileTable.InputFD)
+		line, err := util.Readline(ce.fileTable.InputFP)
+		if err != nil {
+			return "", err
+		}
+		if len(line) == 0 {
+			return "", log.Error(admission.ErrInvitationRequired)
+		}
+		if err := c.Set("invitation", string(line)); err != nil {
+			return "", log.Error(err)
+		}
+	}
+	return c.String("invitation"), nil
+}
+
+// uidEdit edits the user ID unmappedID: the full name (--full-name) and the
+// signature which is appended to new messages (--signature-file or
+// --remove-signature).
+func (ce *CtrlEngine) uidEdit(c *cli.Context, unmappedID string) error {
 	mappedID, err := identity.Map(unmappedID)
 	if err != nil {
 		return err
 	}
-	old, _, err := ce.msgDB.GetNym(mappedID)
+	old, fullName, err := ce.msgDB.GetNym(mappedID)
 	if err != nil {
 		return err
 	}
 	if old == "" {
 		return log.Errorf("user ID %s unknown", unmappedID)
 	}
-	return ce.msgDB.AddNym(mappedID, unmappedID, fullName)
+	if c.IsSet("signature-file") && c.Bool("remove-signature") {
+		return log.Error("ctrlengine: --signature-file and --remove-signature are mutually exclusive")
+	}
+	if c.IsSet("full-name") {
+		fullName = c.String("full-name")
+	}
+	if err := ce.msgDB.AddNym(mappedID, unmappedID, fullName); err != nil {
+		return err
+	}
+	switch {
+	case c.IsSet("signature-file"):
+		signature, err := ioutil.ReadFile(c.String("signature-file"))
+		if err != nil {
+			return log.Error(err)
+		}
+		return ce.msgDB.SetSignature(mappedID,
+			strings.TrimRight(string(signature), "\r\n"))
+	case c.Bool("remove-signature"):
+		return ce.msgDB.SetSignature(mappedID, "")
+	}
+	return nil
 }
 
 func (ce *CtrlEngine) uidActive(
@@ -453,7 +564,7 @@ func (ce *CtrlEngine) uidSwitch(unmappedID string) error {
 	return ce.msgDB.AddValue(msgdb.ActiveUID, mappedID)
 }
 
-func mutecryptDeleteUID(c *cli.Context, id string, passphrase []byte) error {
+func (ce *CtrlEngine) mutecryptDeleteUID(c *cli.Context, id string, passphrase []byte) error {
 	args := []string{
 		"--homedir", c.GlobalString("homedir"),
 		"--loglevel", c.GlobalString("loglevel"),
@@ -462,7 +573,7 @@ func mutecryptDeleteUID(c *cli.Context, id string, passphrase []byte) error {
 		"--id", id,
 		"--force",
 	}
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -479,10 +590,68 @@ func mutecryptDeleteUID(c *cli.Context, id string, passphrase []byte) error {
 	return nil
 }
 
+// uidTombstone registers a tombstone for mappedID with the key server, so
+// that searches reveal that the user ID has been retired and peers stop
+// encrypting to its keys.
+func (ce *CtrlEngine) uidTombstone(
+	c *cli.Context,
+	mappedID, host string,
+	statfp io.Writer,
+) error {
+	if c.GlobalBool("offline") {
+		return log.Error("ctrlengine: cannot retire user ID on key server in offline mode (use --local)")
+	}
+	_, domain, err := identity.Split(mappedID)
+	if err != nil {
+		return err
+	}
+
+	// get capabilities
+	out, err := ce.mutecryptRun(c, host, ce.passphrase,
+		"caps", "show", "--domain", domain)
+	if err != nil {
+		return err
+	}
+	var caps capabilities.Capabilities
+	if err := json.Unmarshal(out, &caps); err != nil {
+		return log.Error(err)
+	}
+	owner, err := decodeED25519PubKeyBase64(caps.TKNPUBKEY)
+	if err != nil {
+		return err
+	}
+
+	// generate tombstone
+	_, err = ce.mutecryptRun(c, host, ce.passphrase,
+		"uid", "gentombstone", "--id", mappedID)
+	if err != nil {
+		return err
+	}
+
+	// register tombstone
+	token, err := wallet.GetToken(ce.client, "UID", owner)
+	if err != nil {
+		return err
+	}
+	_, err = ce.mutecryptRun(c, host, ce.passphrase,
+		"uid", "update",
+		"--id", mappedID,
+		"--token", base64.Encode(token.Token))
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return err
+	}
+	ce.client.DelToken(token.Hash)
+	log.Infof("ctrlengine: user ID %s retired on key server", mappedID)
+	fmt.Fprintf(statfp, "ctrlengine: user ID %s retired on key server\n",
+		mappedID)
+	return nil
+}
+
 func (ce *CtrlEngine) uidDelete(
 	c *cli.Context,
-	unmappedID string,
-	force bool,
+	unmappedID, host string,
+	force, local bool,
 	statfp io.Writer,
 ) error {
 	mappedID, err := identity.Map(unmappedID)
@@ -513,6 +682,13 @@ func (ce *CtrlEngine) uidDelete(
 		}
 	}
 
+	// retire user ID on key server
+	if !local {
+		if err := ce.uidTombstone(c, mappedID, host, statfp); err != nil {
+			return err
+		}
+	}
+
 	// get account information before deletion
 	contacts, err := ce.msgDB.GetAccounts(mappedID)
 	if err != nil {
@@ -535,7 +711,7 @@ func (ce *CtrlEngine) uidDelete(
 	}
 
 	// remove user ID from key DB
-	if err := mutecryptDeleteUID(c, mappedID, ce.passphrase); err != nil {
+	if err := ce.mutecryptDeleteUID(c, mappedID, ce.passphrase); err != nil {
 		return err
 	}
 
@@ -6,6 +6,7 @@ package ctrlengine
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -18,14 +19,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/log"
 	mixclient "github.com/mutecomm/mute/mix/client"
 	"github.com/mutecomm/mute/msgdb"
 	"github.com/mutecomm/mute/release"
+	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
 	"github.com/mutecomm/mute/util/git"
 	"github.com/mutecomm/mute/util/gotool"
+	"github.com/mutecomm/mute/util/ratelimit"
 	"github.com/mutecomm/mute/util/times"
 	"github.com/mutecomm/mute/util/wallet"
 	"github.com/urfave/cli"
@@ -69,6 +73,19 @@ func (ce *CtrlEngine) upkeepAll(
 		return err
 	}
 
+	// batch upkeep tasks, if required by network profile
+	if minPeriod := ce.networkProfile().upkeepPeriod; minPeriod > 0 {
+		duration, err := time.ParseDuration(period)
+		if err != nil {
+			return log.Error(err)
+		}
+		if duration < minPeriod {
+			log.Infof("ctrlengine: network profile raises upkeep period to %s",
+				minPeriod)
+			period = minPeriod.String()
+		}
+	}
+
 	exec, now, err := checkExecution(mappedID, period,
 		func(mappedID string) (int64, error) {
 			return ce.msgDB.GetUpkeepAll(mappedID)
@@ -82,17 +99,79 @@ func (ce *CtrlEngine) upkeepAll(
 		return nil
 	}
 
-	// `upkeep accounts`
-	if err := ce.upkeepAccounts(unmappedID, period, "2160h", statfp); err != nil {
+	// `upkeep accounts` (failed renewals are reported and retried later)
+	if err := ce.upkeepAccounts(unmappedID, period, "", statfp); err != nil {
+		log.Warnf("ctrlengine: upkeep accounts failed: %s", err)
+	}
+
+	// `upkeep expiry` (warnings only)
+	err = ce.upkeepExpiry(c, ioutil.Discard, statfp, unmappedID, false, "",
+		def.ExpiryWarning, false)
+	if err != nil {
+		return err
+	}
+
+	// `upkeep keys`
+	if err := ce.upkeepKeys(c, "2160h", false, statfp); err != nil {
 		return err
 	}
 
+	// refresh key server capabilities
+	if !c.GlobalBool("offline") {
+		_, domain, err := identity.Split(mappedID)
+		if err != nil {
+			return err
+		}
+		if err := ce.upkeepCapabilities(c, domain, statfp); err != nil {
+			return err
+		}
+	}
+
 	// TODO: call all upkeep tasks in mutecrypt
 
 	// record time of execution
 	return ce.msgDB.SetUpkeepAll(mappedID, now)
 }
 
+// upkeepKeys deletes sessions unused for the given duration and expired keys
+// from the key database (see `mutecrypt db cleanup`) and writes the report to
+// statfp. If dryRun is true, nothing is deleted.
+func (ce *CtrlEngine) upkeepKeys(
+	c *cli.Context,
+	unused string,
+	dryRun bool,
+	statfp io.Writer,
+) error {
+	args := []string{"db", "cleanup", "--unused", unused}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	out, err := ce.mutecryptRun(c, "", ce.passphrase, args...)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fmt.Fprintf(statfp, "ctrlengine: %s\n", line)
+	}
+	return nil
+}
+
+// upkeepCapabilities requests the capabilities of the key server at domain
+// and stores them in the key database (see `mutecrypt caps get`).
+func (ce *CtrlEngine) upkeepCapabilities(
+	c *cli.Context,
+	domain string,
+	statfp io.Writer,
+) error {
+	_, err := ce.mutecryptRun(c, "", ce.passphrase, "caps", "get", "--domain", domain)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(statfp, "ctrlengine: capabilities of key server %s refreshed\n",
+		domain)
+	return nil
+}
+
 func writeConfigFile(homedir, domain string, config []byte) error {
 	configdir := filepath.Join(homedir, "config")
 	if err := os.MkdirAll(configdir, 0700); err != nil {
@@ -136,8 +215,8 @@ func (ce *CtrlEngine) upkeepFetchconf(
 	if err != nil {
 		return err
 	}
-	// apply new configuration
-	if err := def.InitMute(&ce.config); err != nil {
+	// apply new configuration (with local overrides)
+	if err := def.ApplyConfig(homedir, &ce.config); err != nil {
 		return err
 	}
 	// format configuration nicely
@@ -321,6 +400,72 @@ func (ce *CtrlEngine) upkeepUpdate(
 	return errExit
 }
 
+// getAccountRenewals returns the number of consecutive failed renewals of
+// the accounts stored in msgDB (see accountKey).
+func (ce *CtrlEngine) getAccountRenewals() (map[string]int, error) {
+	failures := make(map[string]int)
+	value, err := ce.msgDB.GetValue(msgdb.AccountRenewals)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &failures); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return failures, nil
+}
+
+func (ce *CtrlEngine) setAccountRenewals(failures map[string]int) error {
+	jsn, err := json.Marshal(failures)
+	if err != nil {
+		return log.Error(err)
+	}
+	return ce.msgDB.AddValue(msgdb.AccountRenewals, string(jsn))
+}
+
+// accountKey returns the key of the account of mappedID for contact.
+func accountKey(mappedID, contact string) string {
+	return mappedID + " " + contact
+}
+
+// renewAccount renews the account of mappedID for contact on server and
+// returns its new load time. noToken is set, if no token was available in
+// the wallet to pay for the renewal.
+func (ce *CtrlEngine) renewAccount(
+	mappedID, contact string,
+	privkey *[ed25519.PrivateKeySize]byte,
+	server string,
+) (last int64, noToken bool, err error) {
+	token, err := wallet.GetToken(ce.client, def.AccdUsage, def.AccdOwner)
+	if err != nil {
+		return 0, true, err
+	}
+	_, err = mixclient.PayAccount(privkey, token.Token, server, "",
+		def.CACert)
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return 0, false, log.Error(err)
+	}
+	ce.client.DelToken(token.Hash)
+	last, err = mixclient.AccountStat(privkey, server, def.CACert)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := ce.msgDB.SetAccountTime(mappedID, contact, last); err != nil {
+		return 0, false, err
+	}
+	return last, false, nil
+}
+
+// upkeepAccounts renews the accounts of unmappedID which expire within the
+// renewal window remaining, if the last check is older than period. Empty
+// arguments default to the settings of the config (see def.AccountRenewal).
+// To avoid that all accounts are renewed at once (and can be linked by the
+// account servers), every account is renewed at a random time within the
+// first half of the window. Failed renewals do not abort the renewal of the
+// other accounts, they are retried with the next check. Repeated failures and
+// missing tokens are reported on statfp.
 func (ce *CtrlEngine) upkeepAccounts(
 	unmappedID, period, remaining string,
 	statfp io.Writer,
@@ -329,6 +474,16 @@ func (ce *CtrlEngine) upkeepAccounts(
 	if err != nil {
 		return err
 	}
+	defPeriod, defRemaining, err := def.AccountRenewal()
+	if err != nil {
+		return err
+	}
+	if period == "" {
+		period = defPeriod.String()
+	}
+	if remaining == "" {
+		remaining = defRemaining.String()
+	}
 
 	exec, now, err := checkExecution(mappedID, period,
 		func(mappedID string) (int64, error) {
@@ -352,7 +507,12 @@ func (ce *CtrlEngine) upkeepAccounts(
 	if err != nil {
 		return err
 	}
+	failures, err := ce.getAccountRenewals()
+	if err != nil {
+		return err
+	}
 
+	var renewErr error
 	for _, contact := range contacts {
 		privkey, server, _, _, _, _, err := ce.msgDB.GetAccount(mappedID, contact)
 		if err != nil {
@@ -372,33 +532,172 @@ func (ce *CtrlEngine) upkeepAccounts(
 				return err
 			}
 		}
-		if times.Now()+int64(remain.Seconds()) >= last {
-			token, err := wallet.GetToken(ce.client, def.AccdUsage, def.AccdOwner)
-			if err != nil {
-				return err
-			}
-			_, err = mixclient.PayAccount(privkey, token.Token, server, def.CACert)
-			if err != nil {
-				ce.client.UnlockToken(token.Hash)
-				return log.Error(err)
-			}
-			ce.client.DelToken(token.Hash)
-			last, err = mixclient.AccountStat(privkey, server, def.CACert)
-			if err != nil {
-				return err
-			}
-			err = ce.msgDB.SetAccountTime(mappedID, contact, last)
-			if err != nil {
-				return err
+		// staggered renewal within the first half of the window
+		start := last - int64(remain.Seconds()) +
+			int64(randDuration(remain/2).Seconds())
+		if times.Now() < start {
+			continue
+		}
+		key := accountKey(mappedID, contact)
+		expires := time.Unix(last, 0).UTC().Format(time.RFC3339)
+		_, noToken, err := ce.renewAccount(mappedID, contact, privkey, server)
+		if err != nil {
+			failures[key]++
+			renewErr = err
+			log.Warnf("ctrlengine: renewal of account of %s (contact '%s') "+
+				"on %s failed (%d time(s)): %s", mappedID, contact, server,
+				failures[key], err)
+			if noToken {
+				fmt.Fprintf(statfp, "WARNING: no tokens available to renew "+
+					"account of %s on %s, it expires at %s\n", mappedID,
+					server, expires)
+			} else if failures[key] >= def.AccountRenewalFailures {
+				fmt.Fprintf(statfp, "WARNING: renewal of account of %s on %s "+
+					"failed %d times in a row, it expires at %s: %s\n",
+					mappedID, server, failures[key], expires, err)
 			}
+			continue
 		}
+		delete(failures, key)
+		log.Infof("ctrlengine: account of %s (contact '%s') on %s renewed",
+			mappedID, contact, server)
+	}
+	if err := ce.setAccountRenewals(failures); err != nil {
+		return err
+	}
+	if renewErr != nil {
+		// do not record execution, failed renewals are retried next time
+		return renewErr
 	}
 
 	// record time of execution
 	return ce.msgDB.SetUpkeepAccounts(mappedID, now)
 }
 
-func mutecryptHashchainSync(
+// upkeepMigrateAccount moves the account of unmappedID dedicated to contact
+// to the account server server: a new account is created on server, the
+// remaining messages are fetched from the old account (if the contact has a
+// dedicated one), and the account is replaced in msgDB atomically. From then
+// on the nymaddresses given to contact point to the new account.
+func (ce *CtrlEngine) upkeepMigrateAccount(
+	c *cli.Context,
+	unmappedID, contact, server string,
+	statfp io.Writer,
+) error {
+	if err := ce.checkObserver(); err != nil {
+		return err
+	}
+	mappedID, err := identity.Map(unmappedID)
+	if err != nil {
+		return err
+	}
+	prev, _, err := ce.msgDB.GetNym(mappedID)
+	if err != nil {
+		return err
+	}
+	if prev == "" {
+		return log.Errorf("user ID %s not found", unmappedID)
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	contactUnmapped, _, _, err := ce.msgDB.GetContact(mappedID, contactMapped)
+	if err != nil {
+		return err
+	}
+	if contactUnmapped == "" {
+		return log.Errorf("contact %s not found", contact)
+	}
+
+	// determine old account (the default account, if the contact has no
+	// dedicated one)
+	accounts, err := ce.msgDB.GetAccounts(mappedID)
+	if err != nil {
+		return err
+	}
+	var dedicated bool
+	for _, account := range accounts {
+		if account == contactMapped {
+			dedicated = true
+			break
+		}
+	}
+	var oldContact string
+	if dedicated {
+		oldContact = contactMapped
+	}
+	_, oldServer, _, minDelay, maxDelay, _, err :=
+		ce.msgDB.GetAccount(mappedID, oldContact)
+	if err != nil {
+		return err
+	}
+	if dedicated && oldServer == server {
+		return log.Errorf("ctrlengine: account of %s for %s already on %s",
+			mappedID, contactMapped, server)
+	}
+
+	// get invitation code for account server, if required
+	var invitation string
+	if mixclient.AccountInvitation {
+		invitation, err = ce.invitationCode(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create new account
+	token, err := wallet.GetToken(ce.client, def.AccdUsage, def.AccdOwner)
+	if err != nil {
+		return err
+	}
+	_, sk, err := ed25519.GenerateKey(cipher.RandReader)
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return log.Error(err)
+	}
+	var privkey [ed25519.PrivateKeySize]byte
+	copy(privkey[:], sk)
+	newServer, err := mixclient.PayNewAccount(&privkey, token.Token, server,
+		invitation, def.CACert)
+	if err != nil {
+		ce.client.UnlockToken(token.Hash)
+		return log.Error(err)
+	}
+	ce.client.DelToken(token.Hash)
+	fmt.Fprintf(statfp, "new account created on %s\n", newServer)
+	var secret [64]byte
+	if _, err := io.ReadFull(cipher.RandReader, secret[:]); err != nil {
+		return log.Error(err)
+	}
+
+	// drain old account
+	if dedicated {
+		fmt.Fprintf(statfp, "fetching remaining messages from %s\n", oldServer)
+		limiter := ratelimit.New(def.FetchServerRate, def.FetchServerBurst)
+		a := fetchAccount{nym: mappedID, contact: contactMapped}
+		if err := ce.fetchFromAccount(c, limiter, a); err != nil {
+			return err
+		}
+		if err := ce.procInQueue(c, ""); err != nil {
+			return err
+		}
+	}
+
+	// replace account
+	err = ce.msgDB.ReplaceAccount(mappedID, contactMapped, &privkey,
+		newServer, &secret, minDelay, maxDelay)
+	if err != nil {
+		return err
+	}
+	log.Infof("ctrlengine: account of %s for %s migrated from %s to %s",
+		mappedID, contactMapped, oldServer, newServer)
+	fmt.Fprintf(statfp, "account of %s for %s migrated from %s to %s\n",
+		mappedID, contactMapped, oldServer, newServer)
+	return nil
+}
+
+func (ce *CtrlEngine) mutecryptHashchainSync(
 	c *cli.Context,
 	domain, host string,
 	passphrase []byte,
@@ -408,16 +707,12 @@ func mutecryptHashchainSync(
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 	}
-	if host != "" {
-		args = append(args,
-			"--keyhost", host,
-			"--keyport", ":8080") // TODO: remove keyport hack!
-	}
+	args = append(args, keyServerArgs(c, host)...)
 	args = append(args,
 		"hashchain", "sync",
 		"--domain", domain,
 	)
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -434,7 +729,7 @@ func mutecryptHashchainSync(
 	return nil
 }
 
-func mutecryptHashchainValidate(
+func (ce *CtrlEngine) mutecryptHashchainValidate(
 	c *cli.Context,
 	domain, host string,
 	passphrase []byte,
@@ -444,16 +739,12 @@ func mutecryptHashchainValidate(
 		"--loglevel", c.GlobalString("loglevel"),
 		"--logdir", c.GlobalString("logdir"),
 	}
-	if host != "" {
-		args = append(args,
-			"--keyhost", host,
-			"--keyport", ":8080") // TODO: remove keyport hack!
-	}
+	args = append(args, keyServerArgs(c, host)...)
 	args = append(args,
 		"hashchain", "validate",
 		"--domain", domain,
 	)
-	cmd := exec.Command("mutecrypt", args...)
+	cmd := ce.mutecrypt(c, args...)
 	var errbuf bytes.Buffer
 	cmd.Stderr = &errbuf
 	ppR, ppW, err := os.Pipe()
@@ -475,15 +766,132 @@ func (ce *CtrlEngine) upkeepHashchain(
 	domain, host string,
 ) error {
 	// sync hashchain
-	err := mutecryptHashchainSync(c, domain, host, ce.passphrase)
+	err := ce.mutecryptHashchainSync(c, domain, host, ce.passphrase)
 	if err != nil {
 		return err
 	}
 	// verify hashchain
 	// TODO: we only have to validate the new part, not the whole hashchain!
-	err = mutecryptHashchainValidate(c, domain, host, ce.passphrase)
+	err = ce.mutecryptHashchainValidate(c, domain, host, ce.passphrase)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// confirmCleanup asks for manual confirmation of the cleanup action described
+// by question, unless force is set.
+func confirmCleanup(statfp io.Writer, question string, force bool) (bool, error) {
+	if force {
+		return true, nil
+	}
+	fmt.Fprintf(statfp, "ctrlengine: %s? ", question)
+	var response string
+	if _, err := fmt.Scanln(&response); err != nil {
+		return false, log.Error(err)
+	}
+	return strings.HasPrefix(strings.ToLower(response), "y"), nil
+}
+
+// upkeepCleanup detects accounts of unmappedID which expired (past their load
+// time), contacts whose user IDs have been deleted on the key server
+// (tombstoned), and contacts without any messages exchanged for the inactive
+// duration. Expired accounts and deleted contacts are removed after manual
+// confirmation (or automatically, if force is set), inactive contacts are
+// only reported.
+func (ce *CtrlEngine) upkeepCleanup(
+	c *cli.Context,
+	unmappedID, inactive string,
+	force bool,
+	statfp io.Writer,
+) error {
+	mappedID, err := identity.Map(unmappedID)
+	if err != nil {
+		return err
+	}
+	inactiveDuration, err := time.ParseDuration(inactive)
+	if err != nil {
+		return log.Error(err)
+	}
+	now := times.Now()
+
+	// vacate expired accounts
+	accounts, err := ce.msgDB.GetAccounts(mappedID)
+	if err != nil {
+		return err
+	}
+	for _, contact := range accounts {
+		loadTime, err := ce.msgDB.GetAccountTime(mappedID, contact)
+		if err != nil {
+			return err
+		}
+		if loadTime == 0 || loadTime > now {
+			continue
+		}
+		name := contact
+		if name == "" {
+			name = "default"
+		}
+		ok, err := confirmCleanup(statfp,
+			fmt.Sprintf("delete %s account which expired on %s", name,
+				time.Unix(loadTime, 0).UTC().Format(time.RFC3339)), force)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := ce.msgDB.DelAccount(mappedID, contact); err != nil {
+			return err
+		}
+		log.Infof("ctrlengine: expired %s account of %s deleted", name, mappedID)
+		fmt.Fprintf(statfp, "ctrlengine: expired %s account deleted\n", name)
+	}
+
+	// remove deleted contacts and report inactive ones
+	contacts, err := ce.msgDB.GetContacts(mappedID, false)
+	if err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		out, err := ce.mutecryptRun(c, "", ce.passphrase, "uid", "show",
+			"--id", contact)
+		if err != nil {
+			log.Warnf("ctrlengine: cannot get UID of contact %s: %s", contact,
+				err)
+			continue
+		}
+		msg, err := uid.NewJSON(string(out))
+		if err != nil {
+			return err
+		}
+		if msg.IsTombstone() {
+			ok, err := confirmCleanup(statfp,
+				fmt.Sprintf("remove contact %s (user ID deleted)", contact),
+				force)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := ce.msgDB.RemoveContact(mappedID, contact); err != nil {
+				return err
+			}
+			log.Infof("ctrlengine: deleted contact %s of %s removed", contact,
+				mappedID)
+			fmt.Fprintf(statfp, "ctrlengine: deleted contact %s removed\n",
+				contact)
+			continue
+		}
+		last, err := ce.msgDB.GetLastMessageDate(mappedID, contact)
+		if err != nil {
+			return err
+		}
+		if last != 0 && now-last > int64(inactiveDuration.Seconds()) {
+			fmt.Fprintf(statfp, "ctrlengine: no messages with contact %s since %s\n",
+				contact, time.Unix(last, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ctrlengine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/fingerprint"
+	"github.com/urfave/cli"
+)
+
+// Verification states of a contact (see checkVerified).
+const (
+	verifiedState   = "verified"
+	unverifiedState = "unverified"
+	keyChangedState = "KEY CHANGED"
+)
+
+// sigKeyHash returns the SIGKEYHASH of the most recent UID message of the
+// (mapped) user ID id.
+func (ce *CtrlEngine) sigKeyHash(c *cli.Context, id string) (string, error) {
+	out, err := ce.mutecryptRun(c, "", ce.passphrase, "uid", "sigkeyhash",
+		"--id", id)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// checkVerified returns the verification state of contactID for myID (both
+// mapped). If the key of a verified contact changed, a warning is written to
+// statfp.
+func (ce *CtrlEngine) checkVerified(
+	c *cli.Context,
+	statfp io.Writer,
+	myID, contactID string,
+) (string, error) {
+	verified, err := ce.msgDB.GetContactVerified(myID, contactID)
+	if err != nil {
+		return "", err
+	}
+	if verified == "" {
+		return unverifiedState, nil
+	}
+	current, err := ce.sigKeyHash(c, contactID)
+	if err != nil {
+		return "", err
+	}
+	if current != verified {
+		log.Warnf("ctrlengine: key of verified contact %s changed", contactID)
+		fmt.Fprintf(statfp, "WARNING: key of verified contact %s changed, "+
+			"verify again with 'contact verify'\n", contactID)
+		return keyChangedState, nil
+	}
+	return verifiedState, nil
+}
+
+// contactVerify writes the fingerprints of contact and id, their short
+// authentication string, and the verification URI of id (which can be shown
+// as QR code) to w. With mark (or a matching uri scanned from the contact)
+// the contact is marked as verified, with unmark as unverified.
+func (ce *CtrlEngine) contactVerify(
+	c *cli.Context,
+	w, statfp io.Writer,
+	id, contact, uri string,
+	mark, unmark bool,
+) error {
+	idMapped, err := identity.Map(id)
+	if err != nil {
+		return err
+	}
+	contactMapped, err := identity.Map(contact)
+	if err != nil {
+		return err
+	}
+	unmappedID, _, _, err := ce.msgDB.GetContact(idMapped, contactMapped)
+	if err != nil {
+		return err
+	}
+	if unmappedID == "" {
+		return log.Errorf("ctrlengine: contact %s not found", contact)
+	}
+	ownHash, err := ce.sigKeyHash(c, idMapped)
+	if err != nil {
+		return err
+	}
+	contactHash, err := ce.sigKeyHash(c, contactMapped)
+	if err != nil {
+		return err
+	}
+	// compare URI scanned from contact
+	if uri != "" {
+		uriID, uriHash, err := fingerprint.ParseURI(uri)
+		if err != nil {
+			return err
+		}
+		uriMapped, err := identity.Map(uriID)
+		if err != nil {
+			return err
+		}
+		if uriMapped != contactMapped {
+			return log.Errorf("ctrlengine: verification URI is for %s, not %s",
+				uriID, contact)
+		}
+		if uriHash != contactHash {
+			return log.Errorf("ctrlengine: verification of %s failed: key does "+
+				"not match", contact)
+		}
+		mark = true
+	}
+	if mark {
+		err := ce.msgDB.SetContactVerified(idMapped, contactMapped, contactHash)
+		if err != nil {
+			return err
+		}
+		log.Infof("ctrlengine: contact %s verified", contactMapped)
+	} else if unmark {
+		if err := ce.msgDB.SetContactVerified(idMapped, contactMapped, ""); err != nil {
+			return err
+		}
+		log.Infof("ctrlengine: contact %s unverified", contactMapped)
+	}
+	contactFP, err := fingerprint.New(contactHash)
+	if err != nil {
+		return err
+	}
+	ownFP, err := fingerprint.New(ownHash)
+	if err != nil {
+		return err
+	}
+	sas, err := fingerprint.SAS(ownHash, contactHash)
+	if err != nil {
+		return err
+	}
+	state, err := ce.checkVerified(c, statfp, idMapped, contactMapped)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "CONTACT:\t%s\n", contactMapped)
+	fmt.Fprintf(w, "FINGERPRINT:\t%s\n", contactFP)
+	fmt.Fprintf(w, "OWNID:\t%s\n", idMapped)
+	fmt.Fprintf(w, "OWNFINGERPRINT:\t%s\n", ownFP)
+	fmt.Fprintf(w, "SAS:\t%s\n", sas)
+	fmt.Fprintf(w, "URI:\t%s\n", fingerprint.URI(idMapped, ownHash))
+	fmt.Fprintf(w, "STATUS:\t%s\n", state)
+	return nil
+}
+
+// writeContacts writes the contacts (as returned by msgdb.GetContacts) of
+// myID to w, verified contacts are annotated with their verification state.
+func (ce *CtrlEngine) writeContacts(
+	c *cli.Context,
+	w, statfp io.Writer,
+	myID string,
+	contacts []string,
+) error {
+	verified, err := ce.msgDB.GetVerifiedContacts(myID)
+	if err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		// contacts are formatted as "Full Name <id>" or "id"
+		unmappedID := contact
+		if i := strings.LastIndex(contact, "<"); i >= 0 && strings.HasSuffix(contact, ">") {
+			unmappedID = contact[i+1 : len(contact)-1]
+		}
+		contactID, err := identity.Map(unmappedID)
+		if err != nil {
+			return err
+		}
+		if _, ok := verified[contactID]; !ok {
+			fmt.Fprintln(w, contact)
+			continue
+		}
+		state, err := ce.checkVerified(c, statfp, myID, contactID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t[%s]\n", contact, state)
+	}
+	return nil
+}
@@ -5,11 +5,24 @@
 package ctrlengine
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"time"
 
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msgdb"
+	"github.com/mutecomm/mute/serviceguard/client"
+	"github.com/mutecomm/mute/serviceguard/client/walletrpc"
+	"github.com/mutecomm/mute/serviceguard/common/types"
+	"github.com/mutecomm/mute/util"
+	"github.com/mutecomm/mute/util/times"
+	"github.com/urfave/cli"
 )
 
 func printWalletKey(w io.Writer, privkey string) error {
@@ -29,6 +42,71 @@ func (ce *CtrlEngine) walletPubkey(w io.Writer) error {
 	return printWalletKey(w, privkey)
 }
 
+// cachedPriceList is the price list of the service guard as cached in msgDB.
+type cachedPriceList struct {
+	Fetched   int64            // time the price list was fetched (Unix time)
+	PriceList *types.PriceList // the price list
+}
+
+// getPriceList returns the price list of the service guard operator. The
+// price list is fetched from the wallet server, if the cached copy is older
+// than def.PriceListMaxAge and the wallet is online. If fetching fails, the
+// stale cached copy is used. If no price list is available, nil is returned.
+func (ce *CtrlEngine) getPriceList() (*types.PriceList, error) {
+	var cached cachedPriceList
+	value, err := ce.msgDB.GetValue(msgdb.PriceList)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &cached); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	maxAge := int64(def.PriceListMaxAge / time.Second)
+	if cached.PriceList != nil && times.Now()-cached.Fetched < maxAge {
+		return cached.PriceList, nil
+	}
+	if !ce.client.IsOnline() {
+		return cached.PriceList, nil
+	}
+	priceList, err := ce.client.GetPrices()
+	if err != nil {
+		log.Warnf("ctrlengine: cannot fetch price list: %s", ce.client.LastError)
+		return cached.PriceList, nil
+	}
+	cached.Fetched = times.Now()
+	cached.PriceList = priceList
+	jsn, err := json.Marshal(&cached)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	if err := ce.msgDB.AddValue(msgdb.PriceList, string(jsn)); err != nil {
+		return nil, err
+	}
+	return priceList, nil
+}
+
+// writePriceList writes the given priceList to w.
+func writePriceList(w io.Writer, priceList *types.PriceList) {
+	if priceList == nil {
+		fmt.Fprintln(w, "Prices:  unknown (price list not available)")
+		return
+	}
+	fmt.Fprintf(w, "Prices (issued %s):\n",
+		time.Unix(priceList.Issued, 0).UTC().Format(time.RFC3339))
+	for _, price := range priceList.Prices {
+		fmt.Fprintf(w, "%-8s %8d token(s)", price.Usage+":", price.Tokens)
+		if price.RenewalTokens > 0 {
+			fmt.Fprintf(w, "; renewal: %d token(s)", price.RenewalTokens)
+		}
+		if price.Description != "" {
+			fmt.Fprintf(w, " (%s)", price.Description)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
 func (ce *CtrlEngine) walletBalance(w io.Writer) error {
 	msgSelf := ce.client.GetBalanceOwn("Message")
 	msgNonSelf := ce.client.GetBalance("Message", nil)
@@ -39,5 +117,511 @@ func (ce *CtrlEngine) walletBalance(w io.Writer) error {
 	fmt.Fprintf(w, "Message: self:%8d; non-self:%8d; total=%8d\n", msgSelf, msgNonSelf, msgSelf+msgNonSelf)
 	fmt.Fprintf(w, "UID:     self:%8d; non-self:%8d; total=%8d\n", uidSelf, uidNonSelf, uidSelf+uidNonSelf)
 	fmt.Fprintf(w, "Account: self:%8d; non-self:%8d; total=%8d\n", accSelf, accNonSelf, accSelf+accNonSelf)
+	if err := ce.writeBurnRate(w, map[string]int64{
+		"Message": msgSelf + msgNonSelf,
+		"UID":     uidSelf + uidNonSelf,
+		"Account": accSelf + accNonSelf,
+	}); err != nil {
+		return err
+	}
+	priceList, err := ce.getPriceList()
+	if err != nil {
+		return err
+	}
+	writePriceList(w, priceList)
+	return nil
+}
+
+// msgEstimate writes an estimate of the message tokens required to send all
+// pending messages of user ID id (or all user IDs) to w.
+func (ce *CtrlEngine) msgEstimate(w io.Writer, id string, all bool) error {
+	nyms, err := ce.getNyms(id, all)
+	if err != nil {
+		return err
+	}
+	var toSend, outQueue int64
+	for _, nym := range nyms {
+		ts, oq, err := ce.msgDB.GetPendingCount(nym)
+		if err != nil {
+			return err
+		}
+		toSend += ts
+		outQueue += oq
+	}
+	priceList, err := ce.getPriceList()
+	if err != nil {
+		return err
+	}
+	tokens := uint64(1)
+	if priceList != nil {
+		if price := priceList.Lookup("Message"); price != nil {
+			tokens = price.Tokens
+		}
+	}
+	needed := uint64(toSend+outQueue) * tokens
+	available := ce.client.GetBalanceOwn("Message") +
+		ce.client.GetBalance("Message", nil)
+	fmt.Fprintf(w, "pending messages:  %d (not encrypted yet), %d (encrypted)\n",
+		toSend, outQueue)
+	fmt.Fprintf(w, "tokens needed:     %d (at least, large messages are sent in several chunks)\n",
+		needed)
+	fmt.Fprintf(w, "tokens available:  %d\n", available)
+	if available < 0 || uint64(available) < needed {
+		fmt.Fprintln(w, "Message tokens missing in local wallet will be fetched from the wallet server")
+	}
+	writePriceList(w, priceList)
+	return nil
+}
+
+// burnRateDays is the number of days the burn rate of tokens is averaged over.
+const burnRateDays = 7
+
+// writeBurnRate writes the average number of tokens spent per day over the
+// last burnRateDays days for every usage in balance to w, together with an
+// estimate how long the balance lasts.
+func (ce *CtrlEngine) writeBurnRate(w io.Writer, balance map[string]int64) error {
+	since := client.SpendingDay(times.Now()) - (burnRateDays-1)*86400
+	spending, err := ce.client.GetSpending(since)
+	if err != nil {
+		return log.Error(err)
+	}
+	spent := make(map[string]int64)
+	for _, s := range spending {
+		spent[s.Usage] += s.Tokens
+	}
+	fmt.Fprintf(w, "Spent per day (last %d days):\n", burnRateDays)
+	for _, usage := range []string{"Message", "UID", "Account"} {
+		rate := float64(spent[usage]) / burnRateDays
+		fmt.Fprintf(w, "%-8s %8.1f token(s)", usage+":", rate)
+		if rate > 0 {
+			fmt.Fprintf(w, "; balance lasts ~%.0f day(s)",
+				float64(balance[usage])/rate)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// walletHistory writes the tokens spent per day and usage during the last
+// days many days to w, followed by weekly totals.
+func (ce *CtrlEngine) walletHistory(w io.Writer, days int) error {
+	if days <= 0 {
+		return log.Errorf("ctrlengine: --days must be positive")
+	}
+	today := client.SpendingDay(times.Now())
+	since := today - int64(days-1)*86400
+	spending, err := ce.client.GetSpending(since)
+	if err != nil {
+		return log.Error(err)
+	}
+	if len(spending) == 0 {
+		fmt.Fprintf(w, "no tokens spent during the last %d day(s)\n", days)
+		return nil
+	}
+	weekly := make(map[int64]map[string]int64)
+	totals := make(map[string]int64)
+	for _, s := range spending {
+		fmt.Fprintf(w, "%s\t%-8s %6d\n",
+			time.Unix(s.Day, 0).UTC().Format("2006-01-02"), s.Usage, s.Tokens)
+		week := (today - s.Day) / (7 * 86400)
+		if weekly[week] == nil {
+			weekly[week] = make(map[string]int64)
+		}
+		weekly[week][s.Usage] += s.Tokens
+		totals[s.Usage] += s.Tokens
+	}
+	var weeks []int64
+	for week := range weekly {
+		weeks = append(weeks, week)
+	}
+	sort.Slice(weeks, func(i, j int) bool { return weeks[i] > weeks[j] })
+	fmt.Fprintln(w, "Per week:")
+	for _, week := range weeks {
+		end := today - week*7*86400
+		start := end - 6*86400
+		if start < since {
+			start = since
+		}
+		fmt.Fprintf(w, "%s - %s:", time.Unix(start, 0).UTC().Format("2006-01-02"),
+			time.Unix(end, 0).UTC().Format("2006-01-02"))
+		writeUsageCounts(w, weekly[week])
+	}
+	fmt.Fprintf(w, "Total (%d day(s)):", days)
+	writeUsageCounts(w, totals)
+	return nil
+}
+
+// writeUsageCounts writes the token counts per usage in sorted order to w.
+func writeUsageCounts(w io.Writer, counts map[string]int64) {
+	var usages []string
+	for usage := range counts {
+		usages = append(usages, usage)
+	}
+	sort.Strings(usages)
+	for _, usage := range usages {
+		fmt.Fprintf(w, " %s=%d", usage, counts[usage])
+	}
+	fmt.Fprintln(w)
+}
+
+// prefetchOwners returns the owners tokens for usage have to be prefetched
+// for. If owner is given, it is used. Otherwise, the owners are derived from
+// usage: the mixes for "Message" tokens and the account daemon for account
+// tokens.
+func prefetchOwners(usage, owner string) ([]*[ed25519.PublicKeySize]byte, error) {
+	if owner != "" {
+		o, err := decodeED25519PubKeyBase64(owner)
+		if err != nil {
+			return nil, err
+		}
+		return []*[ed25519.PublicKeySize]byte{o}, nil
+	}
+	switch usage {
+	case "Message":
+		mixKeys, err := util.MixKeys(def.CACert)
+		if err != nil {
+			return nil, err
+		}
+		var owners []*[ed25519.PublicKeySize]byte
+		for _, key := range mixKeys {
+			var o [ed25519.PublicKeySize]byte
+			copy(o[:], key)
+			owners = append(owners, &o)
+		}
+		return owners, nil
+	case def.AccdUsage:
+		return []*[ed25519.PublicKeySize]byte{def.AccdOwner}, nil
+	}
+	return nil, log.Errorf("ctrlengine: option --owner is mandatory for usage '%s'", usage)
+}
+
+// walletPrefetch makes sure that count many tokens for usage are available
+// in the local wallet for every owner (see prefetchOwners), so that they can
+// be spent later without contacting the service guard (e.g., while offline).
+// Prefetched tokens are not locked, they expire like all other tokens.
+func (ce *CtrlEngine) walletPrefetch(
+	w io.Writer,
+	usage, owner string,
+	count int,
+) error {
+	if count <= 0 {
+		return log.Error("ctrlengine: --count must be positive")
+	}
+	owners, err := prefetchOwners(usage, owner)
+	if err != nil {
+		return err
+	}
+	for _, o := range owners {
+		available := ce.client.GetBalance(usage, o)
+		var fetched int
+		var expire int64
+		for available < int64(count) {
+			token, err := ce.client.PrefetchToken(usage, o)
+			if err != nil {
+				return log.Error(ce.client.LastError)
+			}
+			if expire == 0 || token.Expire < expire {
+				expire = token.Expire
+			}
+			available++
+			fetched++
+		}
+		fmt.Fprintf(w, "%s tokens for %s: %d prefetched, %d available",
+			usage, base64.Encode(o[:]), fetched, available)
+		if expire != 0 {
+			fmt.Fprintf(w, " (first expires %s)",
+				time.Unix(expire, 0).UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// getReplenishPolicy returns the low-water marks for automatic wallet
+// replenishment stored in msgDB (maps usage to low-water mark).
+func (ce *CtrlEngine) getReplenishPolicy() (map[string]int64, error) {
+	policy := make(map[string]int64)
+	value, err := ce.msgDB.GetValue(msgdb.ReplenishPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &policy); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return policy, nil
+}
+
+// startReplenish sets the replenishment policy of the wallet and checks the
+// balances. Replenishments are reported on status-fd.
+func (ce *CtrlEngine) startReplenish() error {
+	policy, err := ce.getReplenishPolicy()
+	if err != nil {
+		return err
+	}
+	if len(policy) == 0 {
+		ce.client.SetReplenish(nil, nil)
+		return nil
+	}
+	statfp := ce.fileTable.StatusFP
+	ce.client.SetReplenish(policy, func(ev *client.ReplenishEvent) {
+		switch {
+		case ev.Err == client.ErrOffline:
+			fmt.Fprintf(statfp, "wallet: %s balance %d below low-water mark %d "+
+				"(offline, not replenished)\n", ev.Usage, ev.Balance,
+				ev.LowWaterMark)
+		case ev.Err != nil:
+			log.Warnf("ctrlengine: replenishing %s tokens failed: %s",
+				ev.Usage, ev.Err)
+			fmt.Fprintf(statfp, "wallet: replenishing %s tokens failed "+
+				"(%d fetched, balance %d): %s\n", ev.Usage, ev.Fetched,
+				ev.Balance, ev.Err)
+		default:
+			fmt.Fprintf(statfp, "wallet: replenished %s tokens "+
+				"(%d fetched, balance %d)\n", ev.Usage, ev.Fetched, ev.Balance)
+		}
+	})
+	ce.client.CheckReplenish()
+	return nil
+}
+
+// walletReplenish sets the low-water mark for usage to low (if set is true,
+// 0 disables replenishment) and writes the current low-water marks to w.
+func (ce *CtrlEngine) walletReplenish(
+	w io.Writer,
+	usage string,
+	low int64,
+	set bool,
+) error {
+	policy, err := ce.getReplenishPolicy()
+	if err != nil {
+		return err
+	}
+	if set {
+		if low < 0 {
+			return log.Error("ctrlengine: --low must not be negative")
+		}
+		if low == 0 {
+			delete(policy, usage)
+		} else {
+			policy[usage] = low
+		}
+		jsn, err := json.Marshal(policy)
+		if err != nil {
+			return log.Error(err)
+		}
+		if err := ce.msgDB.AddValue(msgdb.ReplenishPolicy, string(jsn)); err != nil {
+			return err
+		}
+		if err := ce.startReplenish(); err != nil {
+			return err
+		}
+	}
+	if len(policy) == 0 {
+		fmt.Fprintln(w, "automatic replenishment disabled")
+		return nil
+	}
+	var usages []string
+	for u := range policy {
+		usages = append(usages, u)
+	}
+	sort.Strings(usages)
+	for _, u := range usages {
+		fmt.Fprintf(w, "%-8s low-water mark:%8d; self:%8d\n", u+":", policy[u],
+			ce.client.GetBalanceOwn(u))
+	}
+	return nil
+}
+
+// archivedWalletKey is a wallet key replaced by 'wallet rotate'.
+type archivedWalletKey struct {
+	Key     string // base64 encoded private wallet key
+	Rotated int64  // time of rotation (Unix time)
+}
+
+// getArchivedWalletKeys returns the archived wallet keys stored in msgDB.
+func (ce *CtrlEngine) getArchivedWalletKeys() ([]archivedWalletKey, error) {
+	var keys []archivedWalletKey
+	value, err := ce.msgDB.GetValue(msgdb.WalletKeys)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &keys); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return keys, nil
+}
+
+// walletRotate replaces the wallet key with walletKey (a newly generated key,
+// if empty) and writes the new public wallet key to w. The old key is
+// archived in msgDB. Tokens in the local wallet stay usable, every token
+// carries its own owner key (which also allows to finish interrupted
+// reissues). The wallet server protocol does not allow to transfer the
+// balance of the old key, it is reported on statfp (if online), so that it
+// can be transferred by the service guard operator.
+func (ce *CtrlEngine) walletRotate(
+	c *cli.Context,
+	w, statfp io.Writer,
+	walletKey string,
+) error {
+	oldKey, err := ce.msgDB.GetValue(msgdb.WalletKey)
+	if err != nil {
+		return err
+	}
+	if walletKey == "" {
+		_, privateKey, err := ed25519.GenerateKey(cipher.RandReader)
+		if err != nil {
+			return log.Error(err)
+		}
+		walletKey = base64.Encode(privateKey[:])
+	} else {
+		pk, err := base64.Decode(walletKey)
+		if err != nil {
+			return err
+		}
+		if len(pk) != ed25519.PrivateKeySize {
+			return log.Error("ctrlengine: wallet key has wrong length")
+		}
+	}
+	if walletKey == oldKey {
+		return log.Error("ctrlengine: new wallet key equals current one")
+	}
+
+	// report balance of old key on wallet server
+	if !ce.isOffline(c) {
+		privkey, err := decodeWalletKey(oldKey)
+		if err != nil {
+			return err
+		}
+		var pubkey [ed25519.PublicKeySize]byte
+		copy(pubkey[:], privkey[32:])
+		subscription, prepay, _, err :=
+			walletrpc.New(&pubkey, privkey, def.CACert).GetBalance()
+		if err != nil {
+			log.Warnf("ctrlengine: cannot get balance of old wallet key: %s", err)
+			fmt.Fprintf(statfp, "cannot get balance of old wallet key: %s\n",
+				err)
+		} else if subscription > 0 || prepay > 0 {
+			fmt.Fprintf(statfp, "old wallet key has %d subscription and %d "+
+				"prepaid token(s) left on wallet server, ask the operator to "+
+				"transfer them\n", subscription, prepay)
+		}
+	}
+
+	// archive old key and store new one
+	keys, err := ce.getArchivedWalletKeys()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, archivedWalletKey{Key: oldKey, Rotated: times.Now()})
+	jsn, err := json.Marshal(keys)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := ce.msgDB.AddValue(msgdb.WalletKeys, string(jsn)); err != nil {
+		return err
+	}
+	if err := ce.msgDB.AddValue(msgdb.WalletKey, walletKey); err != nil {
+		return err
+	}
+	log.Info("ctrlengine: wallet key rotated")
+
+	// restart wallet with new key
+	ce.client.GoOffline()
+	ce.client, err = startWallet(ce.msgDB, ce.isOffline(c))
+	if err != nil {
+		return err
+	}
+	if err := ce.client.ResetAuthToken(); err != nil {
+		return err
+	}
+	if err := ce.startReplenish(); err != nil {
+		return err
+	}
+	fmt.Fprintf(statfp, "wallet key rotated, old key archived\n")
+	return printWalletKey(w, walletKey)
+}
+
+// walletStoreKey returns the wallet storage key stored in msgDB (nil, if the
+// wallet storage is not encrypted). If no key exists and generate is true, a
+// new one is generated and stored.
+func walletStoreKey(msgDB *msgdb.MsgDB, generate bool) (*[32]byte, error) {
+	value, err := msgDB.GetValue(msgdb.WalletStoreKey)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	if value == "" {
+		if !generate {
+			return nil, nil
+		}
+		if _, err := io.ReadFull(cipher.RandReader, key[:]); err != nil {
+			return nil, log.Error(err)
+		}
+		if err := msgDB.AddValue(msgdb.WalletStoreKey, base64.Encode(key[:])); err != nil {
+			return nil, err
+		}
+		return &key, nil
+	}
+	k, err := base64.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != len(key) {
+		return nil, log.Error("ctrlengine: wallet storage key has wrong length")
+	}
+	copy(key[:], k)
+	return &key, nil
+}
+
+// walletEncrypt enables encryption of the wallet storage and encrypts the
+// existing entries.
+func (ce *CtrlEngine) walletEncrypt(c *cli.Context, statfp io.Writer) error {
+	key, err := walletStoreKey(ce.msgDB, false)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if _, err := walletStoreKey(ce.msgDB, true); err != nil {
+			return err
+		}
+		log.Info("ctrlengine: wallet storage key generated")
+		// restart wallet with key
+		ce.client.GoOffline()
+		ce.client, err = startWallet(ce.msgDB, ce.isOffline(c))
+		if err != nil {
+			return err
+		}
+		if err := ce.startReplenish(); err != nil {
+			return err
+		}
+	}
+	n, err := ce.client.EncryptStore()
+	if err != nil {
+		return log.Error(err)
+	}
+	log.Infof("ctrlengine: %d wallet storage entries encrypted", n)
+	fmt.Fprintf(statfp, "wallet storage encrypted: %d entries converted\n", n)
+	return nil
+}
+
+// walletArchived writes the public keys of all archived wallet keys and the
+// time they were replaced to w.
+func (ce *CtrlEngine) walletArchived(w io.Writer) error {
+	keys, err := ce.getArchivedWalletKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		pk, err := base64.Decode(key.Key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\n", base64.Encode(pk[32:]),
+			time.Unix(key.Rotated, 0).UTC().Format(time.RFC3339))
+	}
 	return nil
 }
@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"time"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// Keys of the account renewal settings in the configuration map.
+const (
+	AccountsPeriodKey    = "accounts.Period"
+	AccountsRemainingKey = "accounts.Remaining"
+)
+
+// AccountRenewal returns the minimum duration between two renewal checks of
+// the accounts and the renewal window (accounts which expire within it are
+// renewed). The settings are taken from the configuration map (which can be
+// changed locally, see ReadOverrides) and default to AccountsPeriod and
+// AccountsRemaining.
+func AccountRenewal() (period, remaining time.Duration, err error) {
+	period, err = configDuration(AccountsPeriodKey, AccountsPeriod)
+	if err != nil {
+		return 0, 0, err
+	}
+	remaining, err = configDuration(AccountsRemainingKey, AccountsRemaining)
+	if err != nil {
+		return 0, 0, err
+	}
+	return
+}
+
+// configDuration returns the positive duration stored under key in the
+// configuration map, or defaultValue if the map contains no such entry.
+func configDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value, ok := ConfigMap[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, log.Errorf("def: cannot parse config.Map[%q]: %s", key, err)
+	}
+	if d <= 0 {
+		return 0, log.Errorf("def: config.Map[%q] must be positive", key)
+	}
+	return d, nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountRenewal(t *testing.T) {
+	defer func(m map[string]string) { ConfigMap = m }(ConfigMap)
+	ConfigMap = nil
+	period, remaining, err := AccountRenewal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period != AccountsPeriod || remaining != AccountsRemaining {
+		t.Error("defaults expected")
+	}
+	ConfigMap = map[string]string{
+		AccountsPeriodKey:    "1h",
+		AccountsRemainingKey: "720h",
+	}
+	period, remaining, err = AccountRenewal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period != time.Hour || remaining != 720*time.Hour {
+		t.Errorf("wrong settings: %s, %s", period, remaining)
+	}
+	for _, value := range []string{"1x", "-1h"} {
+		ConfigMap = map[string]string{AccountsPeriodKey: value}
+		if _, _, err := AccountRenewal(); err == nil {
+			t.Errorf("%s should fail", value)
+		}
+	}
+}
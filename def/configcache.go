@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mutecomm/mute/configclient"
+)
+
+// cache is an in-memory cache of the applied configuration. It allows
+// repeated command invocations (for example, in the interactive loop) to skip
+// redundant initializations.
+type cache struct {
+	mu      sync.Mutex
+	jsn     []byte                              // JSON of applied configuration
+	file    string                              // config file last applied
+	modTime time.Time                           // modification time of file
+	size    int64                               // size of file
+	hooks   []func(config *configclient.Config) // change notification hooks
+}
+
+var configCache cache
+
+// applied returns true, if the configuration encoded as jsn has already been
+// applied.
+func (c *cache) applied(jsn []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.jsn != nil && bytes.Equal(c.jsn, jsn)
+}
+
+// apply records the configuration encoded as jsn as applied and calls the
+// registered change notification hooks.
+func (c *cache) apply(jsn []byte, config *configclient.Config) {
+	c.mu.Lock()
+	c.jsn = jsn
+	hooks := make([]func(*configclient.Config), len(c.hooks))
+	copy(hooks, c.hooks)
+	c.mu.Unlock()
+	// call hooks without holding the lock, they might use the config cache
+	for _, hook := range hooks {
+		hook(config)
+	}
+}
+
+// fileUnchanged returns true, if filename with the file info fi has already
+// been applied and has not been modified since.
+func (c *cache) fileUnchanged(filename string, fi os.FileInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.jsn != nil && c.file == filename &&
+		c.modTime.Equal(fi.ModTime()) && c.size == fi.Size()
+}
+
+// setFile records filename with the file info fi as applied.
+func (c *cache) setFile(filename string, fi os.FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file = filename
+	c.modTime = fi.ModTime()
+	c.size = fi.Size()
+}
+
+// OnConfigChange registers hook to be called whenever a changed configuration
+// has been applied by InitMute or InitMuteFromFile.
+func OnConfigChange(hook func(config *configclient.Config)) {
+	configCache.mu.Lock()
+	defer configCache.mu.Unlock()
+	configCache.hooks = append(configCache.hooks, hook)
+}
+
+// InvalidateConfigCache invalidates the configuration cache, so that the next
+// call to InitMute or InitMuteFromFile applies the configuration again.
+func InvalidateConfigCache() {
+	configCache.mu.Lock()
+	defer configCache.mu.Unlock()
+	configCache.jsn = nil
+	configCache.file = ""
+}
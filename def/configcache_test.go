@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mutecomm/mute/configclient"
+)
+
+func TestConfigCache(t *testing.T) {
+	var c cache
+	var called int
+	c.hooks = append(c.hooks, func(*configclient.Config) { called++ })
+	jsn := []byte(`{"Map":{}}`)
+	if c.applied(jsn) {
+		t.Error("empty cache should not contain configuration")
+	}
+	c.apply(jsn, &configclient.Config{})
+	if !c.applied(jsn) {
+		t.Error("configuration should be cached")
+	}
+	if c.applied([]byte(`{"Map":{"a":"b"}}`)) {
+		t.Error("changed configuration should not be cached")
+	}
+	if called != 1 {
+		t.Errorf("hook called %d times, want 1", called)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "def_configcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	filename := filepath.Join(tmpdir, "config")
+	if err := ioutil.WriteFile(filename, jsn, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.fileUnchanged(filename, fi) {
+		t.Error("file should not be cached")
+	}
+	c.setFile(filename, fi)
+	if !c.fileUnchanged(filename, fi) {
+		t.Error("file should be cached")
+	}
+	// modify file
+	later := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.fileUnchanged(filename, fi) {
+		t.Error("modified file should not be cached")
+	}
+}
+
+func TestInitMuteFromFileMissing(t *testing.T) {
+	if err := InitMuteFromFile("/nonexistent"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"crypto/ed25519"
@@ -28,7 +29,24 @@ import (
 )
 
 // InitMute initializes Mute with the configuration from config.
+// Applying the same configuration again is skipped (see configCache).
 func InitMute(config *configclient.Config) error {
+	jsn, err := json.Marshal(config)
+	if err != nil {
+		return log.Error(err)
+	}
+	if configCache.applied(jsn) {
+		log.Debug("configuration unchanged, skip initialization")
+		return nil
+	}
+	if err := initMute(config); err != nil {
+		return err
+	}
+	configCache.apply(jsn, config)
+	return nil
+}
+
+func initMute(config *configclient.Config) error {
 	log.Info("initialize Mute")
 	var ok bool
 	rpcPort := config.Map["mixclient.RPCPort"]
@@ -41,10 +59,29 @@ func InitMute(config *configclient.Config) error {
 		return log.Error("config.Map[\"mixclient.MixAddress\"] undefined")
 	}
 	util.MixAddress = mixAddress
+	util.MixSigningKeys = nil
+	if sk := config.Map["mixclient.SigningKeys"]; sk != "" {
+		for _, key := range strings.Split(sk, ",") {
+			key = strings.TrimSpace(key)
+			k, err := decodeED25519PubKey(key)
+			if err != nil || len(key) != 2*ed25519.PublicKeySize {
+				return log.Error("cannot parse config.Map[\"mixclient.SigningKeys\"]")
+			}
+			util.MixSigningKeys = append(util.MixSigningKeys, k[:])
+		}
+	}
 	mixclient.DefaultAccountServer, ok = config.Map["mixclient.AccountServer"]
 	if !ok {
 		return log.Error("config.Map[\"mixclient.AccountServer\"] undefined")
 	}
+	mixclient.AccountInvitation = config.Map["mixclient.AccountInvitation"] == "true"
+	if pb := config.Map["mixclient.AccountPoWBits"]; pb != "" {
+		bits, err := strconv.Atoi(pb)
+		if err != nil {
+			return log.Error("cannot parse config.Map[\"mixclient.AccountPoWBits\"]")
+		}
+		mixclient.AccountPoWBits = bits
+	}
 	mixclient.DefaultSender, ok = config.Map["mixclient.Sender"]
 	if !ok {
 		return log.Error("config.Map[\"mixclient.Sender\"] undefined")
@@ -72,16 +109,23 @@ func InitMute(config *configclient.Config) error {
 		return err
 	}
 
-	// set msg.CleanupTime
+	// set mix delay limits and msg.CleanupTime
 	mm, ok := config.Map["mix.MaxDelay"]
 	if !ok {
 		return log.Error("config.Map[\"mix.MaxDelay\"] undefined")
 	}
-	mixMax, err := strconv.ParseUint(mm, 10, 64)
+	MixMaxDelay, err = ParseDelay(mm)
 	if err != nil {
 		return log.Error("cannot parse config.Map[\"mix.MaxDelay\"]")
 	}
-	msg.CleanupTime = 2*msg.SendTime + 2*mixMax
+	msg.CleanupTime = 2*msg.SendTime + 2*uint64(MixMaxDelay)
+	MixMinDelay = 0
+	if md := config.Map["mix.MinDelay"]; md != "" {
+		MixMinDelay, err = ParseDelay(md)
+		if err != nil {
+			return log.Error("cannot parse config.Map[\"mix.MinDelay\"]")
+		}
+	}
 
 	// set CA cert
 	CACert = config.CACert
@@ -89,6 +133,11 @@ func InitMute(config *configclient.Config) error {
 	// set configuration map
 	ConfigMap = config.Map
 
+	// set feature flags
+	if err := initFeatures(config.Map); err != nil {
+		return err
+	}
+
 	// muteaccd owner
 	var owner string
 	owner, ok = config.Map["muteaccd.owner"]
@@ -106,6 +155,12 @@ func InitMute(config *configclient.Config) error {
 		return log.Error("config.Map[\"muteaccd.usage\"] undefined")
 	}
 
+	// wallet backend (optional)
+	WalletBackend = client.DefaultBackend
+	if backend := config.Map["wallet.Backend"]; backend != "" {
+		WalletBackend = backend
+	}
+
 	return nil
 }
 
@@ -131,11 +186,31 @@ func ConfigParams() (netDomain, pubkeyStr, configURL string) {
 }
 
 // InitMuteFromFile initializes Mute with the config file from
-// homedir/config/.
+// homedir/config/, which is verified and layered with the local overrides
+// (see ApplyConfig), and sets the additional service domains from the domains
+// file (see ReadDomainsFile). Without override file, the config file is only read
+// again, if it has been modified since it was applied the last time.
 func InitMuteFromFile(homedir string) error {
 	configdir := filepath.Join(homedir, "config")
 	netDomain, _, _ := ConfigParams()
-	jsn, err := ioutil.ReadFile(filepath.Join(configdir, netDomain))
+	filename := filepath.Join(configdir, netDomain)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return log.Error(err)
+	}
+	// additional service domains
+	domains, err := ReadDomainsFile(homedir)
+	if err != nil {
+		return err
+	}
+	SetDomains(domains)
+	_, err = os.Stat(filename + OverrideSuffix)
+	override := err == nil
+	if !override && configCache.fileUnchanged(filename, fi) {
+		log.Debug("config file unchanged, skip initialization")
+		return nil
+	}
+	jsn, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return log.Error(err)
 	}
@@ -143,7 +218,11 @@ func InitMuteFromFile(homedir string) error {
 	if err := json.Unmarshal(jsn, &config); err != nil {
 		return err
 	}
-	return InitMute(&config)
+	if err := ApplyConfig(homedir, &config); err != nil {
+		return err
+	}
+	configCache.setFile(filename, fi)
+	return nil
 }
 
 const (
@@ -193,6 +272,62 @@ const (
 	// WalletGetTokenMaxDuration defines the maximum duration before the
 	// acquisition of a token from the wallet is aborted.
 	WalletGetTokenMaxDuration = 5 * time.Minute // 5m
+
+	// PriceListMaxAge defines the maximum age of the cached price list of the
+	// service guard before it is fetched again.
+	PriceListMaxAge = 24 * time.Hour // 1d
+
+	// OutQueueRetryMin defines the minimum duration delivery of an outqueue
+	// entry is postponed after a failed delivery attempt. The duration is
+	// doubled with every failed attempt.
+	OutQueueRetryMin = 30 * time.Second // 30s
+
+	// OutQueueRetryMax defines the maximum duration delivery of an outqueue
+	// entry is postponed after a failed delivery attempt.
+	OutQueueRetryMax = time.Hour // 1h
+
+	// KeyInitBuckets defines the default number of buckets KeyInit messages
+	// are kept available for.
+	KeyInitBuckets = 7
+
+	// KeyInitBucketDuration defines the default validity duration of a
+	// KeyInit message.
+	KeyInitBucketDuration = 24 * time.Hour // 1d
+
+	// ExpiryWarning defines the duration before the expiry of UID and
+	// KeyInit messages the user is warned (and they are renewed).
+	ExpiryWarning = 30 * 24 * time.Hour // 30d
+
+	// AccountsPeriod defines the default minimum duration between two
+	// renewal checks of the accounts (see AccountRenewal).
+	AccountsPeriod = 6 * time.Hour // 6h
+
+	// AccountsRemaining defines the default renewal window of accounts:
+	// accounts are renewed if they expire within this duration (see
+	// AccountRenewal).
+	AccountsRemaining = 90 * 24 * time.Hour // 90d
+
+	// AccountRenewalFailures defines the number of consecutive failed
+	// renewals of an account after which the user is warned explicitly.
+	AccountRenewalFailures = 3
+)
+
+const (
+	// FetchWorkers defines the maximum number of accounts new messages are
+	// fetched from concurrently.
+	FetchWorkers = 4
+
+	// FetchServerRate defines the maximum rate of fetch requests per account
+	// server (in requests per second).
+	FetchServerRate = 2
+
+	// FetchServerBurst defines the maximum number of fetch requests per
+	// account server which can be sent in a burst.
+	FetchServerBurst = 4
+
+	// OutQueueLargeSize defines the size (in bytes) above which encrypted
+	// messages in the outqueue are delivered after all smaller ones.
+	OutQueueLargeSize = 64 * 1024
 )
 
 // CACert is the default certificate authority used for Mute.
@@ -207,6 +342,10 @@ var AccdOwner *[ed25519.PublicKeySize]byte
 // AccdUsage is the wallet usage for the Mute account daemon.
 var AccdUsage string
 
+// WalletBackend is the name of the wallet backend used to create the service
+// guard client (see client.RegisterBackend).
+var WalletBackend = client.DefaultBackend
+
 func decodeED25519PubKey(p string) (*[ed25519.PublicKeySize]byte, error) {
 	ret := new([ed25519.PublicKeySize]byte)
 	pd, err := hex.DecodeString(p)
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// MixMinDelay is the minimum delay (in seconds) imposed by the mixes
+// (config.Map["mix.MinDelay"], 0 if undefined).
+var MixMinDelay int32
+
+// MixMaxDelay is the maximum delay (in seconds) imposed by the mixes
+// (config.Map["mix.MaxDelay"], 0 if undefined).
+var MixMaxDelay int32
+
+// ParseDelay parses a mix delay given as duration string with units (e.g.,
+// "90s", "15m", or "2h") or as plain number of seconds and returns it
+// normalized to seconds. The delay must be a positive number of whole
+// seconds.
+func ParseDelay(s string) (int32, error) {
+	var d time.Duration
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if secs <= 0 || secs > math.MaxInt32 {
+			return 0, fmt.Errorf("def: delay out of range: %s", s)
+		}
+		return int32(secs), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("def: cannot parse delay '%s' (use e.g. 90s, 15m, or 2h)", s)
+	}
+	if d%time.Second != 0 {
+		return 0, fmt.Errorf("def: delay must be whole seconds: %s", s)
+	}
+	secs := int64(d / time.Second)
+	if secs <= 0 || secs > math.MaxInt32 {
+		return 0, fmt.Errorf("def: delay out of range: %s", s)
+	}
+	return int32(secs), nil
+}
+
+// FormatDelay formats the delay given in seconds as duration string.
+func FormatDelay(secs int32) string {
+	return (time.Duration(secs) * time.Second).String()
+}
+
+// CheckDelays checks that the mix delays minDelay and maxDelay (in seconds)
+// are within the limits of the client and the mixes, and that minDelay is
+// strictly smaller than maxDelay.
+func CheckDelays(minDelay, maxDelay int32) error {
+	if minDelay < MinMinDelay {
+		return fmt.Errorf("def: minimum delay must be at least %s",
+			FormatDelay(MinMinDelay))
+	}
+	if MixMinDelay > 0 && minDelay < MixMinDelay {
+		return fmt.Errorf("def: minimum delay must be at least %s (mix limit)",
+			FormatDelay(MixMinDelay))
+	}
+	if maxDelay < MinMaxDelay {
+		return fmt.Errorf("def: maximum delay must be at least %s",
+			FormatDelay(MinMaxDelay))
+	}
+	if MixMaxDelay > 0 && maxDelay > MixMaxDelay {
+		return fmt.Errorf("def: maximum delay must be at most %s (mix limit)",
+			FormatDelay(MixMaxDelay))
+	}
+	if minDelay >= maxDelay {
+		return fmt.Errorf("def: minimum delay must be strictly smaller than maximum delay")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"testing"
+)
+
+func TestParseDelay(t *testing.T) {
+	tests := []struct {
+		in   string
+		secs int32
+		ok   bool
+	}{
+		{"120", 120, true},
+		{"90s", 90, true},
+		{"15m", 900, true},
+		{"2h", 7200, true},
+		{"1m30s", 90, true},
+		{"0", 0, false},
+		{"-5m", 0, false},
+		{"1.5s", 0, false},
+		{"500ms", 0, false},
+		{"1000000h", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		secs, err := ParseDelay(test.in)
+		if test.ok && err != nil {
+			t.Errorf("ParseDelay(%q) failed: %s", test.in, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("ParseDelay(%q) should fail", test.in)
+		} else if secs != test.secs {
+			t.Errorf("ParseDelay(%q) = %d, want %d", test.in, secs, test.secs)
+		}
+	}
+	if s := FormatDelay(MinDelay); s != "2m0s" {
+		t.Errorf("FormatDelay(%d) = %s", MinDelay, s)
+	}
+}
+
+func TestCheckDelays(t *testing.T) {
+	defer func() { MixMinDelay, MixMaxDelay = 0, 0 }()
+	if err := CheckDelays(MinDelay, MaxDelay); err != nil {
+		t.Error(err)
+	}
+	if err := CheckDelays(MinMinDelay-1, MaxDelay); err == nil {
+		t.Error("should fail")
+	}
+	if err := CheckDelays(MaxDelay, MinDelay); err == nil {
+		t.Error("should fail")
+	}
+	MixMinDelay, MixMaxDelay = 180, 3600
+	if err := CheckDelays(MinDelay, MaxDelay); err == nil {
+		t.Error("should fail (below mix minimum)")
+	}
+	if err := CheckDelays(180, 7200); err == nil {
+		t.Error("should fail (above mix maximum)")
+	}
+	if err := CheckDelays(180, 3600); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util"
+)
+
+// DomainsFile is the name of the file in homedir/config/ which contains the
+// additional service domains (see Domain), so that all Mute binaries can use
+// them.
+const DomainsFile = "domains"
+
+// Domain contains the service settings of an additional service domain. The
+// services of the default domain are defined by the system config.
+type Domain struct {
+	KeyServer     string // URL of the key server
+	MixAddress    string // mix address
+	AccountServer string // account server (round-robin), optional
+}
+
+var (
+	domainsMutex sync.RWMutex
+	domains      map[string]*Domain
+)
+
+// SetDomains sets the additional service domains (maps the domain names to
+// their settings).
+func SetDomains(d map[string]*Domain) {
+	mixAddresses := make(map[string]string)
+	for name, domain := range d {
+		mixAddresses[name] = domain.MixAddress
+	}
+	domainsMutex.Lock()
+	defer domainsMutex.Unlock()
+	domains = d
+	util.DomainMixAddresses = mixAddresses
+}
+
+// GetDomain returns the settings of the additional service domain, or nil.
+func GetDomain(domain string) *Domain {
+	domainsMutex.RLock()
+	defer domainsMutex.RUnlock()
+	return domains[domain]
+}
+
+// KeyServerURL returns the URL of the key server responsible for domain,
+// either from the additional service domains or from the system config.
+func KeyServerURL(domain string) (string, bool) {
+	if d := GetDomain(domain); d != nil {
+		return d.KeyServer, true
+	}
+	url, ok := ConfigMap["keyserver."+domain]
+	return url, ok
+}
+
+// AccountServer returns the account server for new accounts of UIDs in
+// domain ("" for the default account server).
+func AccountServer(domain string) string {
+	if d := GetDomain(domain); d != nil {
+		return d.AccountServer
+	}
+	return ""
+}
+
+// ReadDomainsFile reads the additional service domains from the domains file
+// in homedir/config/ (nil, if the file does not exist).
+func ReadDomainsFile(homedir string) (map[string]*Domain, error) {
+	filename := filepath.Join(homedir, "config", DomainsFile)
+	jsn, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, log.Error(err)
+	}
+	var d map[string]*Domain
+	if err := json.Unmarshal(jsn, &d); err != nil {
+		return nil, log.Errorf("def: cannot parse domains file '%s': %s",
+			filename, err)
+	}
+	return d, nil
+}
+
+// WriteDomainsFile writes the additional service domains d to the domains
+// file in homedir/config/.
+func WriteDomainsFile(homedir string, d map[string]*Domain) error {
+	jsn, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return log.Error(err)
+	}
+	configdir := filepath.Join(homedir, "config")
+	if err := os.MkdirAll(configdir, 0700); err != nil {
+		return log.Error(err)
+	}
+	filename := filepath.Join(configdir, DomainsFile)
+	tmpfile := filename + ".new"
+	if err := ioutil.WriteFile(tmpfile, jsn, 0600); err != nil {
+		return log.Error(err)
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/util"
+)
+
+func TestDomains(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "def_domains_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	d, err := ReadDomainsFile(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != nil {
+		t.Error("domains should be nil")
+	}
+	d = map[string]*Domain{
+		"example.com": {
+			KeyServer:     "https://keys.example.com/",
+			MixAddress:    "mix@example.com",
+			AccountServer: "accounts@example.com",
+		},
+	}
+	if err := WriteDomainsFile(tmpdir, d); err != nil {
+		t.Fatal(err)
+	}
+	d, err = ReadDomainsFile(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDomains(d)
+	defer SetDomains(nil)
+	url, ok := KeyServerURL("example.com")
+	if !ok || url != "https://keys.example.com/" {
+		t.Errorf("wrong key server: %s", url)
+	}
+	if _, ok := KeyServerURL("unknown.example.com"); ok {
+		t.Error("domain should be unknown")
+	}
+	if AccountServer("example.com") != "accounts@example.com" {
+		t.Error("wrong account server")
+	}
+	if util.DomainMixAddresses["example.com"] != "mix@example.com" {
+		t.Error("wrong mix address")
+	}
+}
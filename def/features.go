@@ -0,0 +1,109 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+)
+
+// FeaturePrefix is the prefix of feature flags in the configuration map.
+// Feature flags are part of the configuration map signed by the server
+// operator and allow staged rollouts of new protocol features.
+const FeaturePrefix = "feature."
+
+// Known feature flags.
+const (
+	// FeatureChunking enables the chunking of large messages.
+	FeatureChunking = "enable-chunking"
+	// FeatureMinProtocolVersion defines the minimum protocol version clients
+	// must support.
+	FeatureMinProtocolVersion = "min-protocol-version"
+)
+
+// Features contains the feature flags from the configuration map (without
+// FeaturePrefix).
+var Features map[string]string
+
+// FeatureEnabled returns true, if the boolean feature flag with the given
+// name is enabled. Unknown features are disabled.
+func FeatureEnabled(name string) bool {
+	enabled, err := strconv.ParseBool(Features[name])
+	if err != nil {
+		return false
+	}
+	return enabled
+}
+
+// initFeatures extracts and checks the feature flags from configMap.
+func initFeatures(configMap map[string]string) error {
+	features := make(map[string]string)
+	for k, v := range configMap {
+		if !strings.HasPrefix(k, FeaturePrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, FeaturePrefix)
+		switch name {
+		case FeatureMinProtocolVersion:
+			cmp, err := compareVersions(uid.ProtocolVersion, v)
+			if err != nil {
+				return err
+			}
+			if cmp < 0 {
+				return log.Errorf("def: protocol version %s required "+
+					"(supported: %s), please update", v, uid.ProtocolVersion)
+			}
+		default:
+			if _, err := strconv.ParseBool(v); err != nil {
+				// unknown non-boolean features might be used by newer clients
+				log.Warnf("def: feature flag %q is not boolean: %s", name, v)
+			}
+		}
+		features[name] = v
+	}
+	Features = features
+	return nil
+}
+
+// compareVersions compares the two version strings a and b of the form
+// "MAJOR.MINOR". The result is 0 if a == b, -1 if a < b, and +1 if a > b.
+func compareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range va {
+		if va[i] < vb[i] {
+			return -1, nil
+		}
+		if va[i] > vb[i] {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseVersion(version string) ([2]uint64, error) {
+	var v [2]uint64
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return v, log.Errorf("def: cannot parse version: %s", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, log.Errorf("def: cannot parse version: %s", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
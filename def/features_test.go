@@ -0,0 +1,64 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	err := initFeatures(map[string]string{
+		"feature." + FeatureChunking:           "true",
+		"feature.enable-future":                "false",
+		"feature." + FeatureMinProtocolVersion: "1.0",
+		"mixclient.MixAddress":                 "mix@mute.one",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !FeatureEnabled(FeatureChunking) {
+		t.Error("chunking should be enabled")
+	}
+	if FeatureEnabled("enable-future") {
+		t.Error("future feature should be disabled")
+	}
+	if FeatureEnabled("unknown") {
+		t.Error("unknown feature should be disabled")
+	}
+	err = initFeatures(map[string]string{
+		"feature." + FeatureMinProtocolVersion: "1.10",
+	})
+	if err == nil {
+		t.Error("should fail")
+	}
+	err = initFeatures(map[string]string{
+		"feature." + FeatureMinProtocolVersion: "1",
+	})
+	if err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"2.0", "1.9", 1},
+	}
+	for _, tc := range testCases {
+		cmp, err := compareVersions(tc.a, tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmp != tc.cmp {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", tc.a, tc.b, cmp,
+				tc.cmp)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mutecomm/mute/configclient"
+	"github.com/mutecomm/mute/log"
+)
+
+// OverrideSuffix is the suffix of the local override file of a configuration
+// in homedir/config/ (e.g., mainnet@mute.one.override).
+const OverrideSuffix = ".override"
+
+// ReadOverrides reads the local configuration overrides for netDomain from
+// homedir/config/NETDOMAIN.override. The file contains a JSON object with
+// entries which replace (or add) the corresponding entries of the signed
+// configuration map, e.g.:
+//
+//	{"keyserver.mute.one": "https://keys.example.com/"}
+//
+// If the file does not exist, nil is returned.
+func ReadOverrides(homedir, netDomain string) (map[string]string, error) {
+	filename := filepath.Join(homedir, "config", netDomain+OverrideSuffix)
+	jsn, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, log.Error(err)
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(jsn, &overrides); err != nil {
+		return nil, log.Errorf("def: cannot parse override file '%s': %s",
+			filename, err)
+	}
+	return overrides, nil
+}
+
+// VerifyConfig verifies the signature of config with the pinned public key
+// of the configuration server (see ConfigParams).
+func VerifyConfig(config *configclient.Config) error {
+	_, pubkeyStr, _ := ConfigParams()
+	publicKey, err := hex.DecodeString(pubkeyStr)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := config.Verify(publicKey); err != nil {
+		return log.Errorf("def: cannot verify config: %s", err)
+	}
+	return nil
+}
+
+// ApplyConfig verifies the signed config, layers the local overrides from
+// homedir on top of it (see ReadOverrides), and initializes Mute with the
+// result (see InitMute). The signed config itself is not modified.
+// Legacy configs stored before configs were signed (without signature) are
+// applied with a warning, until they are replaced by the next fetch.
+func ApplyConfig(homedir string, config *configclient.Config) error {
+	if len(config.Signature) == 0 {
+		log.Warn("def: applying unsigned legacy config, fetch config to replace it")
+	} else if err := VerifyConfig(config); err != nil {
+		return err
+	}
+	netDomain, _, _ := ConfigParams()
+	overrides, err := ReadOverrides(homedir, netDomain)
+	if err != nil {
+		return err
+	}
+	if len(overrides) == 0 {
+		return InitMute(config)
+	}
+	var keys []string
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.Infof("def: config override %s=%s", key, overrides[key])
+	}
+	return InitMute(config.Overlay(overrides))
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/configclient"
+)
+
+func TestReadOverrides(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "def_override_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	overrides, err := ReadOverrides(tmpdir, "mainnet@mute.one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overrides != nil {
+		t.Error("overrides should be nil")
+	}
+	configdir := filepath.Join(tmpdir, "config")
+	if err := os.Mkdir(configdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(configdir, "mainnet@mute.one"+OverrideSuffix)
+	if err := ioutil.WriteFile(filename, []byte(`{"a":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOverrides(tmpdir, "mainnet@mute.one"); err == nil {
+		t.Error("should fail")
+	}
+	err = ioutil.WriteFile(filename, []byte(`{"keyserver.mute.one":"https://a/"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err = ReadOverrides(tmpdir, "mainnet@mute.one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overrides["keyserver.mute.one"] != "https://a/" {
+		t.Errorf("wrong overrides: %v", overrides)
+	}
+}
+
+func TestApplyConfigUnsigned(t *testing.T) {
+	// legacy configs are applied (and fail, because the map is incomplete)
+	config := &configclient.Config{Map: map[string]string{"a": "b"}}
+	err := ApplyConfig("/nonexistent", config)
+	if err == nil || !strings.Contains(err.Error(), "MixAddress") {
+		t.Errorf("unsigned legacy config should be applied: %v", err)
+	}
+	// configs with invalid signature are rejected
+	config.Signature = []byte{1}
+	err = ApplyConfig("/nonexistent", config)
+	if err == nil || !strings.Contains(err.Error(), "cannot verify config") {
+		t.Errorf("config with invalid signature should fail: %v", err)
+	}
+}
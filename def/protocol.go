@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mutecomm/mute/def/version"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/transcript"
+)
+
+// Protocol describes the protocol-visible behavior of this Mute version.
+// It allows interoperating implementations and test harnesses to adapt
+// automatically.
+type Protocol struct {
+	Version             string            // Mute version number
+	MessageVersions     []int             // supported message format versions
+	MessageCiphersuites []string          // supported message ciphersuites
+	UIDVersions         []string          // supported UID protocol versions
+	KeyInitVersions     []string          // supported KeyInit versions
+	UIDCiphersuites     []string          // supported UID ciphersuites
+	TranscriptVersions  []string          // supported transcript versions
+	KnownFeatures       []string          // feature flags known to this version
+	Features            map[string]string // feature flags of the configuration
+}
+
+// DescribeProtocol returns the description of the protocol-visible behavior
+// of this Mute version, including the feature flags of the currently loaded
+// configuration.
+func DescribeProtocol() *Protocol {
+	features := make(map[string]string)
+	for k, v := range Features {
+		features[k] = v
+	}
+	return &Protocol{
+		Version:             version.Number,
+		MessageVersions:     []int{msg.Version},
+		MessageCiphersuites: []string{msg.DefaultCiphersuite},
+		UIDVersions:         []string{uid.ProtocolVersion, uid.MsgSigKeyVersion, uid.SigEscrowVersion, uid.ChainLinkVersion, uid.CiphersuitesVersion},
+		KeyInitVersions:     []string{uid.ProtocolVersion},
+		UIDCiphersuites:     uid.Ciphersuites(),
+		TranscriptVersions:  []string{transcript.Version},
+		KnownFeatures: []string{
+			FeatureChunking,
+			FeatureMinProtocolVersion,
+		},
+		Features: features,
+	}
+}
+
+// WriteProtocol writes the protocol description (see DescribeProtocol) to w,
+// either as JSON or in a human-readable format.
+func WriteProtocol(w io.Writer, asJSON bool) error {
+	p := DescribeProtocol()
+	if asJSON {
+		jsn, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return log.Error(err)
+		}
+		fmt.Fprintln(w, string(jsn))
+		return nil
+	}
+	messageVersions := make([]string, len(p.MessageVersions))
+	for i, v := range p.MessageVersions {
+		messageVersions[i] = fmt.Sprintf("%d", v)
+	}
+	fmt.Fprintf(w, "version:\t\t%s\n", p.Version)
+	fmt.Fprintf(w, "message versions:\t%s\n", strings.Join(messageVersions, ", "))
+	fmt.Fprintf(w, "message ciphersuites:\t%s\n",
+		strings.Join(p.MessageCiphersuites, ", "))
+	fmt.Fprintf(w, "UID versions:\t\t%s\n", strings.Join(p.UIDVersions, ", "))
+	fmt.Fprintf(w, "KeyInit versions:\t%s\n", strings.Join(p.KeyInitVersions, ", "))
+	fmt.Fprintf(w, "UID ciphersuites:\t%s\n", strings.Join(p.UIDCiphersuites, ", "))
+	fmt.Fprintf(w, "transcript versions:\t%s\n",
+		strings.Join(p.TranscriptVersions, ", "))
+	fmt.Fprintf(w, "known features:\t\t%s\n", strings.Join(p.KnownFeatures, ", "))
+	var names []string
+	for name := range p.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "feature %s:\t%s\n", name, p.Features[name])
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package def
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/uid"
+)
+
+func TestWriteProtocol(t *testing.T) {
+	Features = map[string]string{FeatureChunking: "true"}
+	defer func() { Features = nil }()
+	var buf bytes.Buffer
+	if err := WriteProtocol(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	var p Protocol
+	if err := json.Unmarshal(buf.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.UIDVersions) != 5 || p.UIDVersions[0] != uid.ProtocolVersion ||
+		p.UIDVersions[1] != uid.MsgSigKeyVersion ||
+		p.UIDVersions[2] != uid.SigEscrowVersion ||
+		p.UIDVersions[3] != uid.ChainLinkVersion ||
+		p.UIDVersions[4] != uid.CiphersuitesVersion {
+		t.Errorf("wrong UID versions: %v", p.UIDVersions)
+	}
+	if p.Features[FeatureChunking] != "true" {
+		t.Error("feature flag missing")
+	}
+	buf.Reset()
+	if err := WriteProtocol(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "feature "+FeatureChunking) {
+		t.Error("feature flag missing in text output")
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/mutecomm/mute/encode"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+An archive contains backups of one or more encrypted databases (the .db and
+.key files as returned by Snapshot) and a manifest. It is stored as a tar file
+which is encrypted and authenticated with NaCl's secretbox. The secretbox key
+is derived from a passphrase with PBKDF2.
+
+Format of archive file:
+
+  magic number "MUTEBAK1"       (8 bytes)
+  number of iterations for PBKDF2 (8 bytes)
+  salt for PBKDF2               (32 bytes)
+  nonce for secretbox           (24 bytes)
+  secretbox(tar file)
+
+The first file of the tar file is the manifest (see Manifest), all other files
+are database files listed in the manifest.
+*/
+
+// ArchiveVersion is the current version of the archive format.
+const ArchiveVersion = "1.0"
+
+// ManifestName is the name of the manifest file in archives.
+const ManifestName = "MANIFEST"
+
+var archiveMagic = []byte("MUTEBAK1")
+
+// ErrArchiveDecrypt is returned by ReadArchive, if an archive cannot be
+// decrypted (wrong passphrase or corrupted archive).
+var ErrArchiveDecrypt = errors.New("encdb: cannot decrypt archive (wrong passphrase?)")
+
+// ArchiveFile describes a file contained in an archive.
+type ArchiveFile struct {
+	NAME   string // file name
+	SIZE   int64  // file size in bytes
+	SHA256 string // SHA-256 checksum of file (hex encoded)
+}
+
+// Manifest describes the content of an archive.
+type Manifest struct {
+	VERSION   string            // version of the archive format
+	CREATED   int64             // creation time of the archive (Unix time)
+	CREATOR   string            // program (and version) which created the archive
+	DATABASES map[string]string // maps contained database names to their schema version
+	FILES     []ArchiveFile     // contained files (except the manifest)
+}
+
+// Archive is an in-memory archive of encrypted databases.
+type Archive struct {
+	Manifest Manifest
+	files    map[string][]byte
+}
+
+// NewArchive returns a new empty archive created by creator.
+func NewArchive(creator string) *Archive {
+	return &Archive{
+		Manifest: Manifest{
+			VERSION:   ArchiveVersion,
+			CREATED:   time.Now().Unix(),
+			CREATOR:   creator,
+			DATABASES: make(map[string]string),
+		},
+		files: make(map[string][]byte),
+	}
+}
+
+func (a *Archive) addFile(name string, data []byte) {
+	sum := sha256.Sum256(data)
+	a.Manifest.FILES = append(a.Manifest.FILES, ArchiveFile{
+		NAME:   name,
+		SIZE:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+	a.files[name] = data
+}
+
+// AddDatabase adds the files dbData and keyData of the database with the
+// given name and schema version to archive a.
+func (a *Archive) AddDatabase(name, version string, dbData, keyData []byte) error {
+	if _, ok := a.Manifest.DATABASES[name]; ok {
+		return fmt.Errorf("encdb: database '%s' already archived", name)
+	}
+	a.Manifest.DATABASES[name] = version
+	a.addFile(name+DBSuffix, dbData)
+	a.addFile(name+KeySuffix, keyData)
+	return nil
+}
+
+// Databases returns the sorted names of all databases contained in archive a.
+func (a *Archive) Databases() []string {
+	var names []string
+	for name := range a.Manifest.DATABASES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Database returns the schema version and the files of the database with the
+// given name from archive a.
+func (a *Archive) Database(name string) (version string, dbData, keyData []byte, err error) {
+	version, ok := a.Manifest.DATABASES[name]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("encdb: database '%s' not archived", name)
+	}
+	return version, a.files[name+DBSuffix], a.files[name+KeySuffix], nil
+}
+
+func deriveArchiveKey(passphrase, salt []byte, iter int) *[32]byte {
+	var key [32]byte
+	copy(key[:], pbkdf2.Key(passphrase, salt, iter, 32, sha256.New))
+	return &key
+}
+
+// Write writes archive a to w, encrypted with passphrase (processed by PBKDF2
+// with iter many iterations).
+func (a *Archive) Write(w io.Writer, passphrase []byte, iter int) error {
+	if iter <= 0 || iter > 2147483647 {
+		return fmt.Errorf("encdb: invalid iter value")
+	}
+	// create tar file
+	manifest, err := json.MarshalIndent(&a.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	files := []struct {
+		name string
+		data []byte
+	}{{ManifestName, manifest}}
+	for _, file := range a.Manifest.FILES {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{file.NAME, a.files[file.NAME]})
+	}
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: time.Unix(a.Manifest.CREATED, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	// encrypt tar file
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	key := deriveArchiveKey(passphrase, salt, iter)
+	var out bytes.Buffer
+	out.Write(archiveMagic)
+	out.Write(encode.ToByte8(uint64(iter)))
+	out.Write(salt)
+	out.Write(nonce[:])
+	out.Write(secretbox.Seal(nil, tarBuf.Bytes(), &nonce, key))
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// ReadArchive reads an archive encrypted with passphrase from r and verifies
+// it: the archive must be authentic and the contained files must match the
+// manifest (names, sizes, and checksums).
+func ReadArchive(r io.Reader, passphrase []byte) (*Archive, error) {
+	enc, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hdrLen := len(archiveMagic) + 8 + 32 + 24
+	if len(enc) < hdrLen+secretbox.Overhead ||
+		!bytes.Equal(enc[:len(archiveMagic)], archiveMagic) {
+		return nil, fmt.Errorf("encdb: not an archive")
+	}
+	p := enc[len(archiveMagic):]
+	uiter := encode.ToUint64(p[:8])
+	if uiter == 0 || uiter > 2147483647 {
+		return nil, fmt.Errorf("encdb: archive has invalid iter value")
+	}
+	salt := p[8:40]
+	var nonce [24]byte
+	copy(nonce[:], p[40:64])
+	key := deriveArchiveKey(passphrase, salt, int(uiter))
+	plain, ok := secretbox.Open(nil, enc[hdrLen:], &nonce, key)
+	if !ok {
+		return nil, ErrArchiveDecrypt
+	}
+	// parse tar file
+	a := &Archive{files: make(map[string][]byte)}
+	tr := tar.NewReader(bytes.NewReader(plain))
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			if hdr.Name != ManifestName {
+				return nil, fmt.Errorf("encdb: archive manifest missing")
+			}
+			if err := json.Unmarshal(data, &a.Manifest); err != nil {
+				return nil, err
+			}
+			first = false
+			continue
+		}
+		if _, ok := a.files[hdr.Name]; ok {
+			return nil, fmt.Errorf("encdb: archive contains '%s' twice", hdr.Name)
+		}
+		a.files[hdr.Name] = data
+	}
+	if first {
+		return nil, fmt.Errorf("encdb: archive manifest missing")
+	}
+	if a.Manifest.VERSION != ArchiveVersion {
+		return nil, fmt.Errorf("encdb: unsupported archive version %s",
+			a.Manifest.VERSION)
+	}
+	// verify files
+	if len(a.files) != len(a.Manifest.FILES) {
+		return nil, fmt.Errorf("encdb: archive content does not match manifest")
+	}
+	for _, file := range a.Manifest.FILES {
+		data, ok := a.files[file.NAME]
+		if !ok {
+			return nil, fmt.Errorf("encdb: archive file '%s' missing", file.NAME)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != file.SIZE ||
+			hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, fmt.Errorf("encdb: archive file '%s' corrupted", file.NAME)
+		}
+	}
+	for name := range a.Manifest.DATABASES {
+		for _, suffix := range []string{DBSuffix, KeySuffix} {
+			if _, ok := a.files[name+suffix]; !ok {
+				return nil, fmt.Errorf("encdb: archive file '%s' missing",
+					name+suffix)
+			}
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	a := NewArchive("test")
+	if err := a.AddDatabase("msgs", "6", []byte("msgsdb"), []byte("msgskey")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDatabase("keys", "1", []byte("keysdb"), []byte("keyskey")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDatabase("keys", "1", nil, nil); err == nil {
+		t.Error("adding database twice should fail")
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf, passphrase, iter); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+
+	// wrong passphrase
+	if _, err := ReadArchive(bytes.NewReader(enc), []byte("wrong")); err != ErrArchiveDecrypt {
+		t.Errorf("ReadArchive() should fail with ErrArchiveDecrypt: %v", err)
+	}
+	// corrupted archive
+	corrupted := append([]byte{}, enc...)
+	corrupted[len(corrupted)-1] ^= 0x01
+	if _, err := ReadArchive(bytes.NewReader(corrupted), passphrase); err != ErrArchiveDecrypt {
+		t.Errorf("ReadArchive() should fail with ErrArchiveDecrypt: %v", err)
+	}
+	// not an archive
+	if _, err := ReadArchive(bytes.NewReader([]byte("test")), passphrase); err == nil {
+		t.Error("ReadArchive() should fail")
+	}
+
+	b, err := ReadArchive(bytes.NewReader(enc), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := b.Databases()
+	if len(names) != 2 || names[0] != "keys" || names[1] != "msgs" {
+		t.Fatalf("unexpected databases: %v", names)
+	}
+	version, dbData, keyData, err := b.Database("msgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "6" || string(dbData) != "msgsdb" || string(keyData) != "msgskey" {
+		t.Error("database msgs differs")
+	}
+	if b.Manifest.CREATOR != "test" || len(b.Manifest.FILES) != 4 {
+		t.Error("manifest differs")
+	}
+	if _, _, _, err := b.Database("other"); err == nil {
+		t.Error("Database() should fail")
+	}
+}
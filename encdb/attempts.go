@@ -0,0 +1,294 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+)
+
+/*
+Failed unlock attempts are counted in the file dbname.attempts next to the
+database files. After freeFailures consecutive failures every further attempt
+is delayed exponentially (starting with baseDelay, at most maxDelay) and, if a
+maximum number of failures has been configured (see SetMaxFailures), the key
+file is destroyed when it is reached (panic lockout). Afterwards the database
+can only be recovered from a backup.
+
+The attempts file is only read and updated while holding the lock file
+dbname.attempts.lock, so concurrent unlock attempts are all counted.
+
+The counter only slows down brute-force attempts through the Mute binaries,
+an attacker with access to the files can of course attack the key file
+directly. Every unlock attempt is logged by the "audit" logger.
+*/
+
+// AttemptsSuffix defines the suffix for files with failed unlock attempts.
+const AttemptsSuffix = ".attempts"
+
+const (
+	freeFailures = 3           // failures which are not delayed (typos)
+	baseDelay    = time.Second // delay after freeFailures failures
+	maxDelay     = time.Hour   // maximum delay
+)
+
+// ErrWrongPassphrase is returned by Open, if the database cannot be unlocked
+// with the given passphrase.
+var ErrWrongPassphrase = errors.New("encdb: wrong passphrase")
+
+// ErrLockedOut is returned by Open, if the key file has been destroyed after
+// too many failed unlock attempts.
+var ErrLockedOut = errors.New("encdb: database locked out after too many failed unlock attempts (restore from backup)")
+
+// DelayError is returned by Open, if an unlock attempt is made before the
+// delay after previous failed attempts has passed.
+type DelayError struct {
+	Failures int           // number of consecutive failed attempts
+	Wait     time.Duration // time to wait until the next attempt
+}
+
+// Error implements the error interface.
+func (e *DelayError) Error() string {
+	return fmt.Sprintf("encdb: %d failed unlock attempts, try again in %s",
+		e.Failures, e.Wait)
+}
+
+// attempts are the failed unlock attempts of a database.
+type attempts struct {
+	Failures    int   // number of consecutive failed attempts
+	Last        int64 // time of last failed attempt (Unix time)
+	MaxFailures int   // destroy key file after that many failures (0: never)
+	LockedOut   bool  // key file has been destroyed
+}
+
+// now returns the current time (for testing).
+var now = time.Now
+
+// lockAttempts acquires the lock for the attempts file of database dbname.
+func lockAttempts(dbname string) (*fileLock, error) {
+	return lockFile(dbname + AttemptsSuffix + LockSuffix)
+}
+
+// readAttempts reads the failed unlock attempts of database dbname (the
+// caller must hold the lock, see lockAttempts).
+func readAttempts(dbname string) (*attempts, error) {
+	var a attempts
+	buf, err := ioutil.ReadFile(dbname + AttemptsSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &a, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return nil, fmt.Errorf("encdb: cannot parse '%s': %s",
+			dbname+AttemptsSuffix, err)
+	}
+	return &a, nil
+}
+
+// write writes the failed unlock attempts a of database dbname (the caller
+// must hold the lock, see lockAttempts).
+func (a *attempts) write(dbname string) error {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dbname+AttemptsSuffix, buf, 0600)
+}
+
+// delay returns the delay before the next unlock attempt is allowed.
+func (a *attempts) delay() time.Duration {
+	if a.Failures < freeFailures {
+		return 0
+	}
+	d := maxDelay
+	if shift := uint(a.Failures - freeFailures); shift < 32 {
+		d = baseDelay << shift
+		if d > maxDelay {
+			d = maxDelay
+		}
+	}
+	return time.Unix(a.Last, 0).Add(d).Sub(now())
+}
+
+// checkAttempts checks whether an unlock attempt of database dbname is
+// allowed.
+func checkAttempts(dbname string) error {
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	audit := log.Named("audit").With("db", dbname, "failures", a.Failures)
+	if a.LockedOut {
+		audit.Warn("unlock refused (locked out)")
+		return ErrLockedOut
+	}
+	if wait := a.delay(); wait > 0 {
+		wait = (wait + time.Second - 1).Truncate(time.Second)
+		audit.Warnf("unlock refused (delayed for %s)", wait)
+		return &DelayError{Failures: a.Failures, Wait: wait}
+	}
+	return nil
+}
+
+// unlockFailed records a failed unlock attempt of database dbname. If the
+// maximum number of failures has been reached, the key file is destroyed and
+// ErrLockedOut is returned. Otherwise, ErrWrongPassphrase is returned.
+func unlockFailed(dbname string, cause error) error {
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	a.Failures++
+	a.Last = now().Unix()
+	audit := log.Named("audit").With("db", dbname, "failures", a.Failures)
+	audit.Warnf("unlock failed: %s", cause)
+	if a.MaxFailures > 0 && a.Failures >= a.MaxFailures {
+		a.LockedOut = true
+		if err := a.write(dbname); err != nil {
+			return err
+		}
+		audit.Critical("maximum number of failures reached, destroy key file")
+		if err := destroyKeyfile(dbname); err != nil {
+			return err
+		}
+		return ErrLockedOut
+	}
+	if err := a.write(dbname); err != nil {
+		return err
+	}
+	return ErrWrongPassphrase
+}
+
+// unlockSucceeded records a successful unlock attempt of database dbname.
+func unlockSucceeded(dbname string) error {
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	audit := log.Named("audit").With("db", dbname, "failures", a.Failures)
+	if a.Failures == 0 {
+		audit.Info("unlock succeeded")
+		return nil
+	}
+	audit.Warn("unlock succeeded after failed attempts")
+	a.Failures = 0
+	a.Last = 0
+	return a.write(dbname)
+}
+
+// destroyKeyfile overwrites the key file (and a rekey copy of it) of
+// database dbname with random data and removes it.
+func destroyKeyfile(dbname string) error {
+	for _, filename := range []string{
+		dbname + KeySuffix,
+		dbname + KeySuffix + backupSuffix,
+	} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		fp, err := os.OpenFile(filename, os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(fp, rand.Reader, fi.Size())
+		if err == nil {
+			err = fp.Sync()
+		}
+		fp.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetAttempts resets the failed unlock attempts (and a lockout) of the newly
+// written database dbname, the maximum number of failures is kept.
+func resetAttempts(dbname string) error {
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	if a.Failures == 0 && !a.LockedOut {
+		return nil
+	}
+	a.Failures = 0
+	a.Last = 0
+	a.LockedOut = false
+	return a.write(dbname)
+}
+
+// SetMaxFailures sets the maximum number of consecutive failed unlock
+// attempts of database dbname after which its key file is destroyed (panic
+// lockout). A maximum of 0 disables the lockout.
+func SetMaxFailures(dbname string, maxFailures int) error {
+	if maxFailures < 0 {
+		return fmt.Errorf("encdb: maximum number of failures %d is invalid",
+			maxFailures)
+	}
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return err
+	}
+	a.MaxFailures = maxFailures
+	return a.write(dbname)
+}
+
+// Attempts returns the number of consecutive failed unlock attempts and the
+// maximum number of failures (0: no lockout) of database dbname.
+func Attempts(dbname string) (failures, maxFailures int, err error) {
+	l, err := lockAttempts(dbname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer l.unlock()
+	a, err := readAttempts(dbname)
+	if err != nil {
+		return 0, 0, err
+	}
+	return a.Failures, a.MaxFailures, nil
+}
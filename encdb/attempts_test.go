@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mutecomm/go-sqlcipher/v4"
+)
+
+func TestAttempts(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, nil); err != nil {
+		t.Fatal(err)
+	}
+	// free failures
+	for i := 0; i < freeFailures; i++ {
+		if _, err := Open(dbname, []byte("wrong")); err != ErrWrongPassphrase {
+			t.Fatalf("Open() should fail with ErrWrongPassphrase: %v", err)
+		}
+	}
+	// delayed attempt
+	_, err = Open(dbname, passphrase)
+	delayErr, ok := err.(*DelayError)
+	if !ok {
+		t.Fatalf("Open() should fail with DelayError: %v", err)
+	}
+	if delayErr.Failures != freeFailures || delayErr.Wait != baseDelay {
+		t.Errorf("wrong DelayError: %+v", delayErr)
+	}
+	// successful attempt after delay resets failures
+	current = current.Add(baseDelay)
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	failures, maxFailures, err := Attempts(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 || maxFailures != 0 {
+		t.Errorf("Attempts() = %d, %d, expected 0, 0", failures, maxFailures)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMaxFailures(dbname, -1); err == nil {
+		t.Error("negative maximum should fail")
+	}
+	if err := SetMaxFailures(dbname, 5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 5; i++ {
+		if _, err := Open(dbname, []byte("wrong")); err != ErrWrongPassphrase {
+			t.Fatalf("Open() should fail with ErrWrongPassphrase: %v", err)
+		}
+		current = current.Add(maxDelay)
+	}
+	if _, err := Open(dbname, []byte("wrong")); err != ErrLockedOut {
+		t.Fatalf("Open() should fail with ErrLockedOut: %v", err)
+	}
+	if _, err := os.Stat(dbname + KeySuffix); !os.IsNotExist(err) {
+		t.Error("key file should be destroyed")
+	}
+	current = current.Add(maxDelay)
+	if _, err := Open(dbname, passphrase); err != ErrLockedOut {
+		t.Errorf("Open() should fail with ErrLockedOut: %v", err)
+	}
+	// a new database resets the lockout, but keeps the maximum
+	os.Remove(dbname + DBSuffix)
+	if err = Create(dbname, passphrase, iter, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	_, maxFailures, err := Attempts(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxFailures != 5 {
+		t.Errorf("maximum number of failures = %d, expected 5", maxFailures)
+	}
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := unlockFailed(dbname, errors.New("test"))
+			if err != ErrWrongPassphrase {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	failures, _, err := Attempts(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 20 {
+		t.Errorf("failures = %d, expected 20 (increments lost)", failures)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	if !wrongKey(sqlite3.Error{Code: sqlite3.ErrNotADB}) {
+		t.Error("SQLITE_NOTADB should be a wrong key")
+	}
+	for _, err := range []error{
+		sqlite3.Error{Code: sqlite3.ErrBusy},
+		sqlite3.Error{Code: sqlite3.ErrIoErr},
+		sqlite3.Error{Code: sqlite3.ErrLocked},
+		errors.New("file is not a database"),
+	} {
+		if wrongKey(err) {
+			t.Errorf("%v should not be a wrong key", err)
+		}
+	}
+}
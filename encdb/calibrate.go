@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// DefaultUnlockTime is the default time the derivation of the key file key
+// should take on the current machine (see Calibrate).
+const DefaultUnlockTime = time.Second
+
+// maxIterations is the maximum number of KDF iterations a key file can store.
+const maxIterations = 2147483647
+
+// minBenchmarkTime is the minimum duration of the benchmark in Calibrate.
+const minBenchmarkTime = 50 * time.Millisecond
+
+// Calibrate benchmarks the KDF on the current machine and returns the number
+// of iterations which takes approximately unlockTime. The result is never
+// smaller than KDFIterations.
+func Calibrate(unlockTime time.Duration) int {
+	passphrase := []byte("calibrate")
+	salt := make([]byte, 32)
+	iter := 1000
+	var elapsed time.Duration
+	for {
+		start := time.Now()
+		pbkdf2.Key(passphrase, salt, iter, 32, sha256.New)
+		elapsed = time.Since(start)
+		if elapsed >= minBenchmarkTime || iter >= maxIterations/2 {
+			break
+		}
+		iter *= 2
+	}
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	calibrated := float64(iter) * float64(unlockTime) / float64(elapsed)
+	switch {
+	case calibrated < KDFIterations:
+		return KDFIterations
+	case calibrated > maxIterations:
+		return maxIterations
+	default:
+		return int(calibrated)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalibrate(t *testing.T) {
+	short := Calibrate(time.Millisecond)
+	if short != KDFIterations {
+		t.Errorf("Calibrate(1ms) = %d, expected minimum %d", short, KDFIterations)
+	}
+	long := Calibrate(10 * time.Second)
+	if long <= KDFIterations {
+		t.Errorf("Calibrate(10s) = %d, expected more than %d", long, KDFIterations)
+	}
+}
@@ -24,13 +24,17 @@ modified for a rekey operation.
 package encdb
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/mutecomm/go-sqlcipher/v4"
+	"github.com/mutecomm/mute/log"
 )
 
 // DBSuffix defines the suffix for database files.
@@ -114,7 +118,7 @@ func Create(dbname string, passphrase []byte, iter int, createStmts []string) er
 	if !encrypted {
 		return fmt.Errorf("encdb: created dbfile '%s' is not encrypted", dbfile)
 	}
-	return nil
+	return resetAttempts(dbname)
 }
 
 // Open tries to open an encrypted database with the given passphrase.
@@ -124,11 +128,23 @@ func Create(dbname string, passphrase []byte, iter int, createStmts []string) er
 //  dbname.db
 //  dbname.key
 //
+// Interrupted rekey operations are detected and rolled back before the
+// database is opened.
+// Failed unlock attempts are counted, further attempts are delayed (see
+// DelayError) and can lead to a lockout (see SetMaxFailures).
 // In case of error (for example, the database files do not exist or the
 // passphrase is wrong) an error is returned.
 func Open(dbname string, passphrase []byte) (*sql.DB, error) {
 	dbfile := dbname + DBSuffix
 	keyfile := dbname + KeySuffix
+	// roll back interrupted rekey operations
+	if _, err := recoverRekey(dbname); err != nil {
+		return nil, err
+	}
+	// check failed unlock attempts
+	if err := checkAttempts(dbname); err != nil {
+		return nil, err
+	}
 	// make sure files exists
 	if _, err := os.Stat(dbfile); err != nil {
 		return nil, err
@@ -161,11 +177,27 @@ func Open(dbname string, passphrase []byte) (*sql.DB, error) {
 	// test key
 	_, err = db.Exec("SELECT count(*) FROM sqlite_master;")
 	if err != nil {
+		db.Close()
+		if !wrongKey(err) {
+			// other errors (busy, I/O, ...) are no failed unlock attempts
+			return nil, err
+		}
+		return nil, unlockFailed(dbname, err)
+	}
+	if err := unlockSucceeded(dbname); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
 
+// wrongKey reports whether err means that the database file cannot be
+// decrypted with the key ("file is not a database").
+func wrongKey(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB
+}
+
 // Rekey tries to rekey an encrypted database with the given newPassphrase and
 // newIter many KDF iterations. The correct oldPassphrase must be supplied.
 // Thereby, dbname is the prefix of the following two database files (which must
@@ -175,17 +207,15 @@ func Open(dbname string, passphrase []byte) (*sql.DB, error) {
 //  dbname.key
 //
 // Rekey replaces the dbname.key file and leaves the dbname.db file unmodified,
-// allowing for very fast rekey operations. In case of error (for example, the
-// database files do not exist or the oldPassphrase is wrong) an error is
-// returned.
+// allowing for very fast rekey operations. Interrupted rekey operations are
+// rolled back on the next Open (see BeginRekey). In case of error (for
+// example, the database files do not exist or the oldPassphrase is wrong) an
+// error is returned.
 func Rekey(dbname string, oldPassphrase, newPassphrase []byte, newIter int) error {
-	encdb, err := Open(dbname, oldPassphrase)
-	if err != nil {
+	if err := BeginRekey(dbname, oldPassphrase, newPassphrase, newIter); err != nil {
 		return err
 	}
-	defer encdb.Close()
-	keyfile := dbname + KeySuffix
-	return replaceKeyfile(keyfile, oldPassphrase, newPassphrase, newIter)
+	return CommitRekey(dbname)
 }
 
 var autoVacuumModes = []string{
@@ -255,3 +285,142 @@ func Incremental(db *sql.DB, pages int64) error {
 	}
 	return nil
 }
+
+// Schema returns the SQL definitions of all tables, indices, and triggers in
+// db (as stored in sqlite_master).
+func Schema(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT sql FROM sqlite_master " +
+		"WHERE sql NOT NULL ORDER BY type DESC, name;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var schema []string
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return nil, err
+		}
+		schema = append(schema, stmt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// ErrMultipleStatements is returned by QueryReadOnly for queries which
+// contain more than one SQL statement.
+var ErrMultipleStatements = errors.New("encdb: query must consist of a single statement")
+
+// singleStatement reports whether the SQL query consists of a single
+// statement, that is, a semicolon outside of literals, quoted identifiers,
+// and comments can only be followed by whitespace and comments.
+func singleStatement(query string) bool {
+	end := false // statement terminated by semicolon
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			continue
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return !end
+			}
+			i += j + 3
+			continue
+		}
+		if end {
+			return false
+		}
+		switch c {
+		case ';':
+			end = true
+		case '\'', '"', '`', '[':
+			// skip literal or quoted identifier (quotes are escaped by doubling)
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			for i++; i < len(query); i++ {
+				if query[i] == closing {
+					if closing != ']' && i+1 < len(query) && query[i+1] == closing {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		}
+	}
+	return true
+}
+
+// QueryReadOnly executes the SQL query in db on a connection which has been
+// switched to read-only mode (PRAGMA query_only), so that queries cannot
+// modify the database. The query must consist of a single statement,
+// otherwise ErrMultipleStatements is returned. It returns the column names
+// and all result rows converted to strings (NULL values are returned as
+// "NULL").
+func QueryReadOnly(db *sql.DB, query string) ([]string, [][]string, error) {
+	if !singleStatement(query) {
+		return nil, nil, ErrMultipleStatements
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON;"); err != nil {
+		return nil, nil, err
+	}
+	// the connection is returned to the pool, make sure it is writable again
+	defer func() {
+		_, err := conn.ExecContext(ctx, "PRAGMA query_only = OFF;")
+		if err != nil {
+			log.Errorf("encdb: cannot reset query_only: %s", err)
+			// discard the connection instead of returning it to the pool
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			if v.Valid {
+				row[i] = v.String
+			} else {
+				row[i] = "NULL"
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return columns, result, nil
+}
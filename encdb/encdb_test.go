@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var passphrase = []byte("passphrase")
@@ -272,3 +273,272 @@ func TestUpkeep(t *testing.T) {
 	}
 	encdb.Close()
 }
+
+func TestSchemaQueryReadOnly(t *testing.T) {
+	sqls := []string{
+		"CREATE TABLE Test (ID INTEGER PRIMARY KEY, Test TEXT);",
+		"INSERT INTO Test (Test) VALUES ('foo');",
+		"INSERT INTO Test (Test) VALUES (NULL);",
+	}
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, sqls); err != nil {
+		t.Fatal(err)
+	}
+	encdb, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encdb.Close()
+	schema, err := Schema(encdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema) != 1 || schema[0] != "CREATE TABLE Test (ID INTEGER PRIMARY KEY, Test TEXT)" {
+		t.Errorf("unexpected schema: %v", schema)
+	}
+	columns, rows, err := QueryReadOnly(encdb, "SELECT * FROM Test;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 2 || columns[1] != "Test" {
+		t.Errorf("unexpected columns: %v", columns)
+	}
+	if len(rows) != 2 || rows[0][1] != "foo" || rows[1][1] != "NULL" {
+		t.Errorf("unexpected rows: %v", rows)
+	}
+	_, _, err = QueryReadOnly(encdb, "DELETE FROM Test;")
+	if err == nil {
+		t.Error("write query should fail")
+	}
+	_, _, err = QueryReadOnly(encdb, "PRAGMA query_only = OFF; DELETE FROM Test;")
+	if err != ErrMultipleStatements {
+		t.Errorf("multiple statements should fail: %v", err)
+	}
+	_, rows, err = QueryReadOnly(encdb, "SELECT * FROM Test;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("rows should not be deleted: %v", rows)
+	}
+	// make sure database is writable again
+	if _, err := encdb.Exec("DELETE FROM Test;"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSingleStatement(t *testing.T) {
+	single := []string{
+		"SELECT * FROM Test",
+		"SELECT * FROM Test;",
+		"SELECT * FROM Test; -- comment",
+		"SELECT * FROM Test; /* comment */ ",
+		"SELECT ';' FROM Test WHERE Test = 'a'';b';",
+		"SELECT \"a;b\", [c;d], `e;f` FROM Test",
+		"SELECT * FROM Test -- ; DELETE FROM Test\n;",
+	}
+	for _, query := range single {
+		if !singleStatement(query) {
+			t.Errorf("single statement: %q", query)
+		}
+	}
+	multiple := []string{
+		"SELECT * FROM Test; DELETE FROM Test",
+		"SELECT * FROM Test;;",
+		"SELECT 'a;b'; DELETE FROM Test;",
+		"SELECT * FROM Test; -- comment\nDELETE FROM Test",
+		"SELECT * FROM Test; /* ; */ DELETE FROM Test",
+	}
+	for _, query := range multiple {
+		if singleStatement(query) {
+			t.Errorf("multiple statements: %q", query)
+		}
+	}
+}
+
+func TestInterruptedRekey(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, nil); err != nil {
+		t.Fatal(err)
+	}
+	newPassphrase := []byte("newpass")
+	// interrupted rekey is rolled back on open
+	if err := BeginRekey(dbname, passphrase, newPassphrase, iter); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := RekeyPending(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Error("rekey should be pending")
+	}
+	// the pending rekey of this process is not recovered
+	encdb, err := Open(dbname, newPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdb.Close()
+	// simulate a crash, which releases the rekey lock
+	releaseRekey(dbname)
+	if _, err := Open(dbname, newPassphrase); err == nil {
+		t.Error("open with new passphrase should fail")
+	}
+	encdb, err = Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdb.Close()
+	// explicit rollback
+	if err := BeginRekey(dbname, passphrase, newPassphrase, iter); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackRekey(dbname); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackRekey(dbname); err == nil {
+		t.Error("second rollback should fail")
+	}
+	// commit
+	if err := BeginRekey(dbname, passphrase, newPassphrase, iter); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitRekey(dbname); err != nil {
+		t.Fatal(err)
+	}
+	encdb, err = Open(dbname, newPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdb.Close()
+	if _, err := os.Stat(dbname + KeySuffix + backupSuffix); !os.IsNotExist(err) {
+		t.Error("key file copy should be removed")
+	}
+}
+
+func TestInterruptedRekeys(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbnames := []string{
+		filepath.Join(tmpdir, "encdb_test1"),
+		filepath.Join(tmpdir, "encdb_test2"),
+	}
+	for _, dbname := range dbnames {
+		if err = Create(dbname, passphrase, iter, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marker := filepath.Join(tmpdir, "rekey.commit")
+	newPassphrase := []byte("newpass")
+	open := func(pass []byte) {
+		for _, dbname := range dbnames {
+			encdb, err := Open(dbname, pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encdb.Close()
+		}
+	}
+	// simulate a crash, which releases the rekey locks
+	crash := func() {
+		for _, dbname := range dbnames {
+			releaseRekey(dbname)
+		}
+	}
+	// interrupted before commit: all databases are rolled back
+	err = BeginRekeys(marker, dbnames, passphrase, newPassphrase, iter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash()
+	open(passphrase)
+	// interrupted during commit: all databases are completed
+	err = BeginRekeys(marker, dbnames, passphrase, newPassphrase, iter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitRekey(dbnames[0]); err != nil {
+		t.Fatal(err)
+	}
+	crash()
+	open(newPassphrase)
+	// stale marker does not complete the next rekey
+	err = BeginRekeys(marker, dbnames, newPassphrase, passphrase, iter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash()
+	open(newPassphrase)
+	// complete rekey
+	err = BeginRekeys(marker, dbnames, newPassphrase, passphrase, iter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitRekeys(marker, dbnames); err != nil {
+		t.Fatal(err)
+	}
+	open(passphrase)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("commit marker should be removed")
+	}
+}
+
+func TestRekeyLock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, nil); err != nil {
+		t.Fatal(err)
+	}
+	newPassphrase := []byte("newpass")
+	if err := BeginRekey(dbname, passphrase, newPassphrase, iter); err != nil {
+		t.Fatal(err)
+	}
+	if err := BeginRekey(dbname, passphrase, newPassphrase, iter); err == nil {
+		t.Error("second rekey operation should fail")
+	}
+	// another process cannot recover the running rekey operation
+	locked := make(chan struct{})
+	go func() {
+		l, err := lockFile(dbname + JournalSuffix + LockSuffix)
+		if err != nil {
+			t.Error(err)
+		} else {
+			l.unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("rekey lock should be held until commit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := CommitRekey(dbname); err != nil {
+		t.Fatal(err)
+	}
+	<-locked
+	encdb, err := Open(dbname, newPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdb.Close()
+}
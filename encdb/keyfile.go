@@ -90,7 +90,8 @@ func writeKeyfile(filename string, passphrase []byte, iter int, key []byte) erro
 	if _, err := keyfile.Write(encKey); err != nil {
 		return err
 	}
-	return nil
+	// make sure keyfile is written to stable storage
+	return keyfile.Sync()
 }
 
 // generateKeyFile generates a key file with the given filename that contains a
@@ -0,0 +1,24 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"os"
+)
+
+// LockSuffix defines the suffix for lock files. Lock files serialize updates
+// of files next to the database files between processes, they are never
+// removed.
+const LockSuffix = ".lock"
+
+// fileLock is an exclusive lock on a file (see lockFile).
+type fileLock struct {
+	f *os.File
+}
+
+// unlock releases the lock (closing the file releases it).
+func (l *fileLock) unlock() error {
+	return l.f.Close()
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package encdb
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile acquires an exclusive lock on the file filename (which is created,
+// if necessary) by opening it without sharing. It blocks until the lock is
+// available.
+func lockFile(filename string) (*fileLock, error) {
+	name, err := syscall.UTF16PtrFromString(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := syscall.CreateFile(name,
+			syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+			syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			return &fileLock{f: os.NewFile(uintptr(h), filename)}, nil
+		}
+		if err != errorSharingViolation {
+			return nil, &os.PathError{Op: "open", Path: filename, Err: err}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
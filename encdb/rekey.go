@@ -0,0 +1,396 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+A rekey operation is implemented as copy-rekey-swap with a journal marker:
+
+  1. Copy dbname.key to dbname.key.old.
+  2. Create the journal marker dbname.rekey.
+  3. Write the rekeyed key file to dbname.key.new and swap it with dbname.key.
+  4. Remove the journal marker and the copy dbname.key.old.
+
+Steps 1-3 are performed by BeginRekey, step 4 by CommitRekey. If a rekey
+operation is interrupted while the journal marker exists, it is rolled back to
+the intact copy dbname.key.old the next time the database is opened.
+Thereby, callers which have to rekey multiple databases consistently can delay
+CommitRekey until all databases have been rekeyed.
+
+A crash between the commits of multiple databases would still leave them with
+different passphrases. Therefore, BeginRekeys records a common commit marker
+file in the journal markers of all databases, and CommitRekeys creates the
+commit marker before it commits the single databases (and removes it
+afterwards). If a database with a journal marker is opened while the
+referenced commit marker exists, the interrupted rekey is completed instead of
+rolled back.
+
+Rekey operations and their recovery hold the lock file dbname.rekey.lock. A
+process holds it from BeginRekey until CommitRekey or RollbackRekey, so other
+processes cannot roll back a rekey operation which is still running (their
+Open blocks until it is completed). Opens of the rekeying process itself do
+not recover the pending operation.
+*/
+
+// JournalSuffix defines the suffix for rekey journal markers.
+const JournalSuffix = ".rekey"
+
+// backupSuffix defines the suffix for key file copies made during rekey.
+const backupSuffix = ".old"
+
+// rekeyLocks are the rekey locks held by this process for pending rekey
+// operations, indexed by the absolute database name.
+var rekeyLocks = struct {
+	sync.Mutex
+	m map[string]*fileLock
+}{m: make(map[string]*fileLock)}
+
+func rekeyLockKey(dbname string) string {
+	abs, err := filepath.Abs(dbname)
+	if err != nil {
+		return dbname
+	}
+	return abs
+}
+
+// lockRekey acquires the rekey lock of database dbname for a rekey operation
+// of this process, it is held until releaseRekey is called.
+func lockRekey(dbname string) error {
+	key := rekeyLockKey(dbname)
+	rekeyLocks.Lock()
+	defer rekeyLocks.Unlock()
+	if _, ok := rekeyLocks.m[key]; ok {
+		return fmt.Errorf("encdb: rekey operation pending for '%s'", dbname)
+	}
+	l, err := lockFile(dbname + JournalSuffix + LockSuffix)
+	if err != nil {
+		return err
+	}
+	rekeyLocks.m[key] = l
+	return nil
+}
+
+// releaseRekey releases the rekey lock of database dbname, if this process
+// holds it.
+func releaseRekey(dbname string) {
+	key := rekeyLockKey(dbname)
+	rekeyLocks.Lock()
+	defer rekeyLocks.Unlock()
+	if l, ok := rekeyLocks.m[key]; ok {
+		delete(rekeyLocks.m, key)
+		l.unlock()
+	}
+}
+
+// rekeyLocked reports whether this process holds the rekey lock of database
+// dbname.
+func rekeyLocked(dbname string) bool {
+	rekeyLocks.Lock()
+	defer rekeyLocks.Unlock()
+	_, ok := rekeyLocks.m[rekeyLockKey(dbname)]
+	return ok
+}
+
+// syncFile writes the file with the given filename to stable storage.
+func syncFile(filename string) error {
+	fp, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+// syncDir writes the directory entries of dir to stable storage.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+// writeJournal writes the journal marker journal with the commit marker
+// and syncs it.
+func writeJournal(journal, marker string) error {
+	fp, err := os.OpenFile(journal, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.WriteString(marker); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// copyKeyfile copies the key file src to dst and syncs it.
+func copyKeyfile(src, dst string) error {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, buf, 0600); err != nil {
+		return err
+	}
+	return syncFile(dst)
+}
+
+// BeginRekey starts a rekey of the encrypted database dbname with the given
+// newPassphrase and newIter many KDF iterations. The correct oldPassphrase
+// must be supplied. After BeginRekey returned successfully the database can be
+// opened with newPassphrase, but the rekey operation has to be completed with
+// CommitRekey. Otherwise, it is rolled back with RollbackRekey or on the next
+// Open.
+func BeginRekey(dbname string, oldPassphrase, newPassphrase []byte, newIter int) error {
+	return beginRekey(dbname, oldPassphrase, newPassphrase, newIter, "")
+}
+
+// beginRekey implements BeginRekey, the optional commit marker is recorded in
+// the journal marker.
+func beginRekey(
+	dbname string,
+	oldPassphrase, newPassphrase []byte,
+	newIter int,
+	marker string,
+) error {
+	if err := lockRekey(dbname); err != nil {
+		return err
+	}
+	// make sure no other rekey operation is pending
+	if _, err := recoverLockedRekey(dbname); err != nil {
+		releaseRekey(dbname)
+		return err
+	}
+	encdb, err := Open(dbname, oldPassphrase)
+	if err != nil {
+		releaseRekey(dbname)
+		return err
+	}
+	encdb.Close()
+	keyfile := dbname + KeySuffix
+	journal := dbname + JournalSuffix
+	dir := filepath.Dir(dbname)
+	// copy
+	if err := copyKeyfile(keyfile, keyfile+backupSuffix); err != nil {
+		releaseRekey(dbname)
+		return err
+	}
+	if err := writeJournal(journal, marker); err != nil {
+		os.Remove(journal)
+		os.Remove(keyfile + backupSuffix)
+		releaseRekey(dbname)
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		RollbackRekey(dbname)
+		return err
+	}
+	// rekey and swap
+	if err := replaceKeyfile(keyfile, oldPassphrase, newPassphrase, newIter); err != nil {
+		RollbackRekey(dbname)
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		RollbackRekey(dbname)
+		return err
+	}
+	return nil
+}
+
+// CommitRekey completes the rekey operation of the encrypted database dbname
+// started with BeginRekey.
+func CommitRekey(dbname string) error {
+	if rekeyLocked(dbname) {
+		defer releaseRekey(dbname)
+		return commitRekey(dbname)
+	}
+	l, err := lockFile(dbname + JournalSuffix + LockSuffix)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	return commitRekey(dbname)
+}
+
+// commitRekey implements CommitRekey, the caller must hold the rekey lock.
+func commitRekey(dbname string) error {
+	journal := dbname + JournalSuffix
+	exists, err := fileExists(journal)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("encdb: no rekey operation pending for '%s'", dbname)
+	}
+	if err := os.Remove(journal); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dbname)); err != nil {
+		return err
+	}
+	return os.Remove(dbname + KeySuffix + backupSuffix)
+}
+
+// BeginRekeys starts a rekey of all encrypted databases dbnames with the
+// given newPassphrase and newIter many KDF iterations, like BeginRekey. The
+// rekey operations must be completed together with CommitRekeys and the same
+// commit marker file marker. If one database cannot be rekeyed, the already
+// started rekey operations are rolled back.
+func BeginRekeys(
+	marker string,
+	dbnames []string,
+	oldPassphrase, newPassphrase []byte,
+	newIter int,
+) error {
+	marker, err := filepath.Abs(marker)
+	if err != nil {
+		return err
+	}
+	// complete or roll back previous operations before the marker is removed
+	for _, dbname := range dbnames {
+		if _, err := recoverRekey(dbname); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i, dbname := range dbnames {
+		err := beginRekey(dbname, oldPassphrase, newPassphrase, newIter, marker)
+		if err != nil {
+			for _, started := range dbnames[:i] {
+				RollbackRekey(started)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// CommitRekeys completes the rekey operations of the encrypted databases
+// dbnames started with BeginRekeys. After the commit marker has been created,
+// the rekey operations are completed even if CommitRekeys is interrupted.
+func CommitRekeys(marker string, dbnames []string) error {
+	marker, err := filepath.Abs(marker)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(marker)); err != nil {
+		return err
+	}
+	for _, dbname := range dbnames {
+		if err := CommitRekey(dbname); err != nil {
+			return err
+		}
+	}
+	return os.Remove(marker)
+}
+
+// RollbackRekey rolls back the rekey operation of the encrypted database
+// dbname started with BeginRekey. Afterwards, the database can be opened with
+// the old passphrase again.
+func RollbackRekey(dbname string) error {
+	var (
+		rolledBack bool
+		err        error
+	)
+	if rekeyLocked(dbname) {
+		rolledBack, err = recoverLockedRekey(dbname)
+		releaseRekey(dbname)
+	} else {
+		rolledBack, err = recoverRekey(dbname)
+	}
+	if err != nil {
+		return err
+	}
+	if !rolledBack {
+		return fmt.Errorf("encdb: no rekey operation pending for '%s'", dbname)
+	}
+	return nil
+}
+
+// RekeyPending returns true, if an interrupted rekey operation of the
+// encrypted database dbname has been detected (which will be rolled back or,
+// if its commit marker exists, completed on the next Open).
+func RekeyPending(dbname string) (bool, error) {
+	return fileExists(dbname + JournalSuffix)
+}
+
+// recoverRekey detects interrupted rekey operations of the encrypted database
+// dbname and rolls them back to the intact key file copy, if necessary.
+// Interrupted rekey operations whose commit marker exists are completed.
+// It returns true, if a rekey operation has been rolled back. The pending rekey
+// operation of this process (if any) is left alone.
+func recoverRekey(dbname string) (bool, error) {
+	if rekeyLocked(dbname) {
+		return false, nil
+	}
+	l, err := lockFile(dbname + JournalSuffix + LockSuffix)
+	if err != nil {
+		return false, err
+	}
+	defer l.unlock()
+	return recoverLockedRekey(dbname)
+}
+
+// recoverLockedRekey implements recoverRekey, the caller must hold the rekey
+// lock.
+func recoverLockedRekey(dbname string) (bool, error) {
+	keyfile := dbname + KeySuffix
+	backup := keyfile + backupSuffix
+	journal := dbname + JournalSuffix
+	os.Remove(keyfile + ".new") // ignore error
+	exists, err := fileExists(journal)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		// copy without journal marker: either the rekey was interrupted
+		// before the swap or after the commit, the key file is intact
+		os.Remove(backup) // ignore error
+		return false, nil
+	}
+	marker, err := ioutil.ReadFile(journal)
+	if err != nil {
+		return false, err
+	}
+	if len(marker) > 0 {
+		committed, err := fileExists(string(marker))
+		if err != nil {
+			return false, err
+		}
+		if committed {
+			// the rekey of all databases has been committed: complete it
+			return false, commitRekey(dbname)
+		}
+	}
+	// journal marker exists: restore the intact copy
+	if err := os.Rename(backup, keyfile); err != nil {
+		return false, err
+	}
+	if err := syncDir(filepath.Dir(dbname)); err != nil {
+		return false, err
+	}
+	if err := os.Remove(journal); err != nil {
+		return false, err
+	}
+	return true, nil
+}
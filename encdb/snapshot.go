@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Snapshot returns consistent copies of the two files of the open encrypted
+// database db with the given dbname (see Create). While the files are read,
+// a write lock is held on db, so that no other connection can modify the
+// database. The returned files are still encrypted.
+func Snapshot(db *sql.DB, dbname string) (dbData, keyData []byte, err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	// a reserved lock prevents all other writers, readers can continue
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+		return nil, nil, err
+	}
+	defer conn.ExecContext(ctx, "ROLLBACK;")
+	dbData, err = ioutil.ReadFile(dbname + DBSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err = ioutil.ReadFile(dbname + KeySuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dbData, keyData, nil
+}
+
+// WriteFiles writes the two files dbData and keyData of an encrypted database
+// (as returned by Snapshot) for the given dbname. The files must not exist
+// already. Failed unlock attempts of a previous database are reset.
+func WriteFiles(dbname string, dbData, keyData []byte) error {
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{dbname + KeySuffix, keyData},
+		{dbname + DBSuffix, dbData},
+	}
+	for _, file := range files {
+		exists, err := fileExists(file.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("encdb: file '%s' exists already", file.name)
+		}
+	}
+	for _, file := range files {
+		f, err := os.OpenFile(file.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(file.data); err != nil {
+			f.Close()
+			return err
+		}
+		// make sure file is written to stable storage
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return resetAttempts(dbname)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package encdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	sqls := []string{
+		"CREATE TABLE Test (ID INTEGER PRIMARY KEY, Test TEXT);",
+	}
+	tmpdir, err := ioutil.TempDir("", "encdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "encdb_test")
+	if err = Create(dbname, passphrase, iter, sqls); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO Test (Test) VALUES ('test');"); err != nil {
+		t.Fatal(err)
+	}
+	dbData, keyData, err := Snapshot(db, dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// database is still writable
+	if _, err := db.Exec("INSERT INTO Test (Test) VALUES ('test2');"); err != nil {
+		t.Fatal(err)
+	}
+	// existing files are not overwritten
+	if err := WriteFiles(dbname, dbData, keyData); err == nil {
+		t.Error("WriteFiles should fail")
+	}
+	copyname := filepath.Join(tmpdir, "encdb_copy")
+	if err := WriteFiles(copyname, dbData, keyData); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := Open(copyname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	var n int
+	if err := cp.QueryRow("SELECT COUNT(*) FROM Test;").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("snapshot contains %d rows, expected 1", n)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package armor implements the ASCII armor container format for Mute
+// artifacts (exported bundles, detached signatures, token transfers, and
+// transcripts). Armored artifacts survive copy-paste through email and chat.
+//
+// An armored artifact looks like this:
+//
+//	-----BEGIN MUTE TRANSCRIPT-----
+//	Version: 1
+//	Checksum: 5b1a6ad5c1c7e9d0
+//
+//	eyJFeHBvcnRlciI6ImFsaWNlQG11dGUuYmVybGluIiwiQ29udGFjdCI6ImJvYkBtdXRl
+//	...
+//	-----END MUTE TRANSCRIPT-----
+//
+// The checksum is the hex encoded first 8 bytes of the SHA-256 hash of the
+// unarmored data. Text before the BEGIN line and after the END line is
+// ignored, as well as leading and trailing whitespace on every line.
+package armor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mutecomm/mute/encode/base64"
+)
+
+// Version is the current version of the armor format.
+const Version = "1"
+
+// Types of armored artifacts.
+const (
+	TypeContact    = "CONTACT"     // contact bundle
+	TypeSignature  = "SIGNATURE"   // detached signature
+	TypeSync       = "SYNC BUNDLE" // encrypted sync bundle
+	TypeToken      = "TOKEN"       // token transfer
+	TypeTranscript = "TRANSCRIPT"  // signed transcript
+)
+
+const (
+	beginPrefix = "-----BEGIN MUTE "
+	endPrefix   = "-----END MUTE "
+	suffix      = "-----"
+	lineLength  = 64 // length of base64 lines
+)
+
+// ErrNoArmor is returned if no armored artifact could be found.
+var ErrNoArmor = errors.New("armor: no armored artifact found")
+
+// ErrChecksum is returned if the checksum of an armored artifact is invalid.
+var ErrChecksum = errors.New("armor: checksum mismatch")
+
+// checksum returns the checksum of data.
+func checksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:8])
+}
+
+// validType checks that typ consists of uppercase letters and single spaces.
+func validType(typ string) error {
+	if typ == "" || strings.TrimSpace(typ) != typ || strings.Contains(typ, "  ") {
+		return fmt.Errorf("armor: invalid type '%s'", typ)
+	}
+	for _, r := range typ {
+		if (r < 'A' || r > 'Z') && r != ' ' {
+			return fmt.Errorf("armor: invalid type '%s'", typ)
+		}
+	}
+	return nil
+}
+
+// Encode returns data armored as type typ.
+func Encode(typ string, data []byte) ([]byte, error) {
+	if err := validType(typ); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%s%s\n", beginPrefix, typ, suffix)
+	fmt.Fprintf(&b, "Version: %s\n", Version)
+	fmt.Fprintf(&b, "Checksum: %s\n", checksum(data))
+	b.WriteString("\n")
+	enc := base64.Encode(data)
+	for len(enc) > lineLength {
+		b.WriteString(enc[:lineLength])
+		b.WriteString("\n")
+		enc = enc[lineLength:]
+	}
+	if len(enc) > 0 {
+		b.WriteString(enc)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%s%s%s\n", endPrefix, typ, suffix)
+	return b.Bytes(), nil
+}
+
+// IsArmored reports whether data contains an armored artifact.
+func IsArmored(data []byte) bool {
+	return bytes.Contains(data, []byte(beginPrefix))
+}
+
+// Decode returns the type and the data of the first armored artifact
+// contained in armored. The version and the checksum are verified.
+func Decode(armored []byte) (typ string, data []byte, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(armored))
+	scanner.Buffer(make([]byte, 4096), len(armored)+1)
+	// find BEGIN line
+	for {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", nil, err
+			}
+			return "", nil, ErrNoArmor
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, beginPrefix) && strings.HasSuffix(line, suffix) {
+			typ = line[len(beginPrefix) : len(line)-len(suffix)]
+			break
+		}
+	}
+	if err := validType(typ); err != nil {
+		return "", nil, err
+	}
+	// parse headers
+	headers := make(map[string]string)
+	for {
+		if !scanner.Scan() {
+			return "", nil, errors.New("armor: unexpected end of headers")
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("armor: invalid header line '%s'", line)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if headers["Version"] != Version {
+		return "", nil, fmt.Errorf("armor: unsupported version '%s'",
+			headers["Version"])
+	}
+	sum, ok := headers["Checksum"]
+	if !ok {
+		return "", nil, errors.New("armor: checksum missing")
+	}
+	// read body until END line
+	var body bytes.Buffer
+	for {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", nil, err
+			}
+			return "", nil, fmt.Errorf("armor: END line for type '%s' missing",
+				typ)
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, endPrefix) {
+			if line != endPrefix+typ+suffix {
+				return "", nil, fmt.Errorf("armor: END line '%s' does not "+
+					"match type '%s'", line, typ)
+			}
+			break
+		}
+		body.WriteString(line)
+	}
+	data, err = base64.Decode(body.String())
+	if err != nil {
+		return "", nil, fmt.Errorf("armor: cannot decode body: %s", err)
+	}
+	if checksum(data) != sum {
+		return "", nil, ErrChecksum
+	}
+	return typ, data, nil
+}
+
+// DecodeType is like Decode, but additionally verifies that the armored
+// artifact has type typ.
+func DecodeType(typ string, armored []byte) ([]byte, error) {
+	t, data, err := Decode(armored)
+	if err != nil {
+		return nil, err
+	}
+	if t != typ {
+		return nil, fmt.Errorf("armor: wrong type '%s' (expected '%s')", t, typ)
+	}
+	return data, nil
+}
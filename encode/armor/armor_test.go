@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package armor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("ping"),
+		bytes.Repeat([]byte("0123456789"), 100),
+	} {
+		armored, err := Encode(TypeTranscript, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsArmored(armored) {
+			t.Error("IsArmored() should be true")
+		}
+		// surrounding text, indentation, and CRLF line endings are ignored
+		pasted := "Hi Bob,\r\n\r\nhere it is:\r\n" +
+			strings.Replace("  "+string(armored), "\n", "\r\n  ", -1) +
+			"\r\nCheers, Alice\r\n"
+		for _, a := range [][]byte{armored, []byte(pasted)} {
+			typ, dec, err := Decode(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != TypeTranscript {
+				t.Errorf("wrong type: %s", typ)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Error("data differs")
+			}
+		}
+	}
+}
+
+func TestArmorErrors(t *testing.T) {
+	if _, err := Encode("lower case", nil); err == nil {
+		t.Error("Encode() should fail for invalid type")
+	}
+	if _, _, err := Decode([]byte("no armor")); err != ErrNoArmor {
+		t.Errorf("Decode() should fail with ErrNoArmor: %v", err)
+	}
+	armored, err := Encode(TypeContact, []byte("contact bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeType(TypeSync, armored); err == nil {
+		t.Error("DecodeType() should fail for wrong type")
+	}
+	if _, err := DecodeType(TypeContact, armored); err != nil {
+		t.Error(err)
+	}
+	// corrupt body
+	lines := strings.Split(string(armored), "\n")
+	lines[4] = "Y29udGFjdCBidW5kbGf="
+	if _, _, err := Decode([]byte(strings.Join(lines, "\n"))); err != ErrChecksum {
+		t.Errorf("Decode() should fail with ErrChecksum: %v", err)
+	}
+	// unsupported version
+	v := strings.Replace(string(armored), "Version: 1", "Version: 2", 1)
+	if _, _, err := Decode([]byte(v)); err == nil {
+		t.Error("Decode() should fail for unsupported version")
+	}
+	// truncated
+	if _, _, err := Decode(armored[:len(armored)-10]); err == nil {
+		t.Error("Decode() should fail for truncated artifact")
+	}
+}
@@ -12,6 +12,7 @@ require (
 	github.com/go-sql-driver/mysql v1.3.0
 	github.com/gorilla/rpc v1.1.0
 	github.com/jpillora/backoff v0.0.0-20170918002102-8eab2debe79d
+	github.com/lib/pq v1.9.0
 	github.com/lucasb-eyer/go-colorful v0.0.0-20180526135729-345fbb3dbcdb
 	github.com/mattn/go-runewidth v0.0.2
 	github.com/mutecomm/go-sqlcipher/v4 v4.4.0
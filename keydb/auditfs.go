@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+)
+
+// An AuditFinding describes key material retained in keyDB which should have
+// been deleted under the forward-secrecy rules.
+type AuditFinding struct {
+	Table  string // table containing the key material
+	ID     int64  // row ID in table
+	Reason string // why the key material should have been deleted
+}
+
+// auditRule defines a query for retained key material and the statement
+// which purges a single finding. The query is parameterized with now, if
+// expiry is true, and with unusedBefore otherwise.
+type auditRule struct {
+	table  string
+	reason string
+	expiry bool
+	query  string
+	purge  string
+}
+
+var auditRules = []auditRule{
+	{
+		"MessageKeys",
+		"message key of unused or deleted session",
+		false,
+		"SELECT ID FROM MessageKeys WHERE SessionID NOT IN (SELECT SessionID FROM Sessions WHERE LastUsed>=?) ORDER BY ID ASC;",
+		"DELETE FROM MessageKeys WHERE ID=?;",
+	},
+	{
+		"Sessions",
+		"chain key of unused session",
+		false,
+		"SELECT SessionID FROM Sessions WHERE LastUsed<? ORDER BY SessionID ASC;",
+		"DELETE FROM Sessions WHERE SessionID=?;",
+	},
+	{
+		"SessionKeys",
+		"private session key past cleanup time",
+		true,
+		"SELECT ID FROM SessionKeys WHERE IFNULL(PrivKey, '')!='' AND CleanupTime<? ORDER BY ID ASC;",
+		"UPDATE SessionKeys SET PrivKey='' WHERE ID=?;",
+	},
+}
+
+// AuditFS scans keyDB for key material which should have been deleted under
+// the forward-secrecy rules: chain keys of sessions which have not been used
+// since unusedBefore, message keys which do not belong to a used session,
+// private keys of KeyInit messages which expired before now, and private
+// session keys past their cleanup time (all times in Unix time).
+//
+// If purge is true, the found key material is deleted with SQLite's
+// secure_delete enabled, which overwrites the deleted content with zeros.
+func (keyDB *KeyDB) AuditFS(
+	unusedBefore, now int64,
+	purge bool,
+) ([]*AuditFinding, error) {
+	ctx := context.Background()
+	conn, err := keyDB.encDB.Conn(ctx)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer conn.Close()
+	if purge {
+		if _, err := conn.ExecContext(ctx, "PRAGMA secure_delete = ON;"); err != nil {
+			return nil, log.Error(err)
+		}
+		// the connection is returned to the pool, restore the default
+		defer conn.ExecContext(ctx, "PRAGMA secure_delete = OFF;")
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	findings, err := auditFS(tx, unusedBefore, now, purge)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, log.Error(err)
+	}
+	return findings, nil
+}
+
+// queryIDs returns the row IDs returned by the given query.
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, log.Error(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return ids, nil
+}
+
+func auditFS(
+	tx *sql.Tx,
+	unusedBefore, now int64,
+	purge bool,
+) ([]*AuditFinding, error) {
+	var findings []*AuditFinding
+	for _, rule := range auditRules {
+		arg := unusedBefore
+		if rule.expiry {
+			arg = now
+		}
+		ids, err := queryIDs(tx, rule.query, arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			findings = append(findings, &AuditFinding{
+				Table:  rule.table,
+				ID:     id,
+				Reason: rule.reason,
+			})
+			if purge {
+				if _, err := tx.Exec(rule.purge, id); err != nil {
+					return nil, log.Error(err)
+				}
+			}
+		}
+	}
+	// the expiry of KeyInit messages is only contained in their JSON encoding
+	rows, err := tx.Query("SELECT ID, KeyInit FROM PrivateKeyInits WHERE PRIVKEY!='' ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var expired []int64
+	for rows.Next() {
+		var (
+			id   int64
+			json string
+		)
+		if err := rows.Scan(&id, &json); err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		ki, err := uid.NewJSONKeyInit([]byte(json))
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if ki.NotAfter() < uint64(now) {
+			expired = append(expired, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	for _, id := range expired {
+		findings = append(findings, &AuditFinding{
+			Table:  "PrivateKeyInits",
+			ID:     id,
+			Reason: "private KeyInit key past expiry",
+		})
+		if purge {
+			_, err := tx.Exec("DELETE FROM PrivateKeyInits WHERE ID=?;", id)
+			if err != nil {
+				return nil, log.Error(err)
+			}
+		}
+	}
+	return findings, nil
+}
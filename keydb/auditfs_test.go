@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestAuditFS(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	// add session
+	sessionKey := base64.Encode(cipher.SHA512([]byte("key")))
+	rk := base64.Encode(cipher.SHA256([]byte("rootkey")))
+	err = keyDB.AddSession(sessionKey, rk, base64.Encode([]byte("chainkey")),
+		[]string{"send"}, []string{"recv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add expired session key
+	if err := keyDB.AddSessionKey("hash", "json", "privkey", 1); err != nil {
+		t.Fatal(err)
+	}
+	// add expired KeyInit
+	msg, err := uid.Create("keydb@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(times.Now())
+	ki, pubKeyHash, privateKey, err := msg.KeyInit(1, now+times.Day,
+		now-times.Day, false, "mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keyDB.AddPrivateKeyInit(ki, pubKeyHash, msg.SigPubKey(), privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// session is in use, session key expired
+	findings, err := keyDB.AuditFS(int64(now)-3600, int64(now), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Table != "SessionKeys" {
+		t.Errorf("unexpected findings: %v", findings)
+	}
+	// everything retained after a week
+	later := int64(now) + 7*int64(times.Day)
+	findings, err = keyDB.AuditFS(later, later, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 5 {
+		t.Errorf("len(findings) = %d, want 5", len(findings))
+	}
+	if _, err := keyDB.GetMessageKey(sessionKey, true, 0); err != nil {
+		t.Error("audit without purge should not delete message keys")
+	}
+	// purge
+	if _, err := keyDB.AuditFS(later, later, true); err != nil {
+		t.Fatal(err)
+	}
+	findings, err = keyDB.AuditFS(later, later, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("unexpected findings after purge: %v", findings)
+	}
+	if _, _, _, err := keyDB.GetSession(sessionKey); err != sql.ErrNoRows {
+		t.Error("session should be purged")
+	}
+	_, privKey, err := keyDB.GetSessionKey("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privKey != "" {
+		t.Error("private session key should be purged")
+	}
+}
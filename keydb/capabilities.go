@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"encoding/json"
+
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// A CapabilitiesSnapshot is a cached copy of the capabilities of a key
+// server.
+type CapabilitiesSnapshot struct {
+	Capabilities *capabilities.Capabilities // capabilities as replied by the key server
+	Fetched      int64                      // Unix time of the request
+	Expires      int64                      // Unix time after which the snapshot is stale
+}
+
+// Expired reports whether the snapshot is stale at time now (in Unix time).
+func (snap *CapabilitiesSnapshot) Expired(now int64) bool {
+	return now >= snap.Expires
+}
+
+// SetCapabilities stores the capabilities snapshot of the key server at the
+// given domain in keyDB, replacing a previously stored one.
+func (keyDB *KeyDB) SetCapabilities(
+	domain string,
+	snap *CapabilitiesSnapshot,
+) error {
+	jsn, err := json.Marshal(snap)
+	if err != nil {
+		return log.Error(err)
+	}
+	key := capabilitiesPrefix + identity.MapDomain(domain)
+	return keyDB.AddValue(key, string(jsn))
+}
+
+// GetCapabilities returns the capabilities snapshot of the key server at the
+// given domain from keyDB. If no snapshot is stored, nil is returned.
+func (keyDB *KeyDB) GetCapabilities(domain string) (
+	*CapabilitiesSnapshot,
+	error,
+) {
+	value, err := keyDB.GetValue(capabilitiesPrefix + identity.MapDomain(domain))
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, nil
+	}
+	var snap CapabilitiesSnapshot
+	if err := json.Unmarshal([]byte(value), &snap); err != nil {
+		return nil, log.Error(err)
+	}
+	if snap.Capabilities == nil {
+		return nil, log.Errorf("keydb: capabilities snapshot for domain '%s' is empty",
+			domain)
+	}
+	return &snap, nil
+}
+
+// DelCapabilities deletes the capabilities snapshot of the key server at the
+// given domain from keyDB.
+func (keyDB *KeyDB) DelCapabilities(domain string) error {
+	return keyDB.DelValue(capabilitiesPrefix + identity.MapDomain(domain))
+}
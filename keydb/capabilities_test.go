@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/keyserver/capabilities"
+)
+
+func TestCapabilities(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	snap, err := keyDB.GetCapabilities("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap != nil {
+		t.Error("capabilities should not be cached")
+	}
+	caps := &capabilities.Capabilities{
+		METHODS:    []string{"KeyRepository.Capabilities"},
+		DOMAINS:    []string{"mute.berlin"},
+		SIGPUBKEYS: []string{"key"},
+	}
+	err = keyDB.SetCapabilities("mute.berlin", &CapabilitiesSnapshot{
+		Capabilities: caps,
+		Fetched:      100,
+		Expires:      200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err = keyDB.GetCapabilities("Mute.Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap == nil {
+		t.Fatal("capabilities should be cached")
+	}
+	if snap.Fetched != 100 || snap.Expires != 200 ||
+		snap.Capabilities.SIGPUBKEYS[0] != "key" {
+		t.Error("wrong capabilities snapshot")
+	}
+	if snap.Expired(199) {
+		t.Error("snapshot should not be expired")
+	}
+	if !snap.Expired(200) {
+		t.Error("snapshot should be expired")
+	}
+	if err := keyDB.DelCapabilities("mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = keyDB.GetCapabilities("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap != nil {
+		t.Error("capabilities should be deleted")
+	}
+}
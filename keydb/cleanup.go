@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// CleanupReport reports the number of entries deleted by Cleanup (or the
+// number of entries which would be deleted in a dry-run).
+type CleanupReport struct {
+	MessageKeys int64 // message keys of unused or deleted sessions
+	Sessions    int64 // sessions not used since unusedBefore
+	SessionKeys int64 // session keys past their cleanup time
+}
+
+// Cleanup deletes sessions which have not been used since unusedBefore,
+// message keys which do not belong to a remaining session, and session keys
+// whose cleanup time lies before now (all times in Unix time). Used message
+// keys are deleted directly (see DelMessageKey), therefore only the keys of
+// abandoned sessions accumulate. If dryRun is true, nothing is deleted and
+// the report only contains the number of affected entries.
+func (keyDB *KeyDB) Cleanup(
+	unusedBefore, now int64,
+	dryRun bool,
+) (*CleanupReport, error) {
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var report CleanupReport
+	steps := []struct {
+		count *sql.Stmt
+		del   *sql.Stmt
+		arg   int64
+		n     *int64
+	}{
+		// delete message keys first, they depend on the remaining sessions
+		{keyDB.countMessageKeysQuery, keyDB.delMessageKeysQuery, unusedBefore,
+			&report.MessageKeys},
+		{keyDB.countSessionsQuery, keyDB.delSessionsQuery, unusedBefore,
+			&report.Sessions},
+		{keyDB.countSessionKeysQuery, keyDB.delSessionKeysQuery, now,
+			&report.SessionKeys},
+	}
+	for _, step := range steps {
+		err := tx.Stmt(step.count).QueryRow(step.arg).Scan(step.n)
+		if err != nil {
+			tx.Rollback()
+			return nil, log.Error(err)
+		}
+		if dryRun || *step.n == 0 {
+			continue
+		}
+		if _, err := tx.Stmt(step.del).Exec(step.arg); err != nil {
+			tx.Rollback()
+			return nil, log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, log.Error(err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"crypto/sha512"
+	"database/sql"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/msg"
+	"github.com/mutecomm/mute/util/times"
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestCleanup(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	// add session
+	sessionKey := base64.Encode(cipher.SHA512([]byte("key")))
+	rk := base64.Encode(cipher.SHA256([]byte("rootkey")))
+	kdf := hkdf.New(sha512.New, []byte("master"), nil, nil)
+	chainKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, chainKey); err != nil {
+		t.Fatal(err)
+	}
+	send, recv, err := deriveKeys(chainKey, kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keyDB.AddSession(sessionKey, rk, base64.Encode(chainKey), send, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add session key
+	if err := keyDB.AddSessionKey("hash", "json", "privkey", 1); err != nil {
+		t.Fatal(err)
+	}
+	// nothing to clean up in used sessions
+	now := times.Now()
+	report, err := keyDB.Cleanup(now-3600, now-3600, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MessageKeys != 0 || report.Sessions != 0 {
+		t.Errorf("used session should not be cleaned up: %+v", report)
+	}
+	if report.SessionKeys != 1 {
+		t.Errorf("report.SessionKeys = %d, want 1", report.SessionKeys)
+	}
+	if _, _, err := keyDB.GetSessionKey("hash"); err != sql.ErrNoRows {
+		t.Error("session key should be deleted")
+	}
+	// dry-run
+	report, err = keyDB.Cleanup(now+3600, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MessageKeys != 2*msg.NumOfFutureKeys || report.Sessions != 1 {
+		t.Errorf("unexpected dry-run report: %+v", report)
+	}
+	if _, err := keyDB.GetMessageKey(sessionKey, true, 0); err != nil {
+		t.Error("dry-run should not delete message keys")
+	}
+	// clean up unused session
+	report, err = keyDB.Cleanup(now+3600, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MessageKeys != 2*msg.NumOfFutureKeys || report.Sessions != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if _, _, _, err := keyDB.GetSession(sessionKey); err != sql.ErrNoRows {
+		t.Error("session should be deleted")
+	}
+	var n int64
+	err = keyDB.encDB.QueryRow("SELECT COUNT(*) FROM MessageKeys;").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d message keys left", n)
+	}
+}
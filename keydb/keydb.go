@@ -8,21 +8,68 @@ package keydb
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // Version is the current keydb version.
-const Version = "1"
+const Version = "3"
 
 // Entries in KeyValueTable.
 const (
 	DBVersion = "Version" // version string of keydb
 )
 
+// filteredHashChainPrefix is the KeyValueTable prefix for the last position
+// of hash chains which have been synced with a filter.
+const filteredHashChainPrefix = "FilteredHashChainPos."
+
+// validatedHashChainPrefix is the KeyValueTable prefix for the validation
+// checkpoints of hash chains (see SetValidatedHashChainPos).
+const validatedHashChainPrefix = "ValidatedHashChainPos."
+
+// pinnedHashChainPrefix is the KeyValueTable prefix for the pinned heads of
+// hash chains (see SetPinnedHashChainPos).
+const pinnedHashChainPrefix = "PinnedHashChainPos."
+
+// msgSigKeyPrefix is the KeyValueTable prefix for the private message signing
+// keys of identities (see uid.MsgSigKeyVersion). They are stored separately
+// from the UID messages, because they are kept across UID updates.
+const msgSigKeyPrefix = "MsgSigKey."
+
+// sigEscrowPrefix is the KeyValueTable prefix for the private escrow keys of
+// identities (see uid.SigEscrowVersion). They are stored separately from the
+// UID messages, because they can be exported and deleted (see DelSigEscrowKey).
+const sigEscrowPrefix = "SigEscrow."
+
+// chainLinkPrefix is the KeyValueTable prefix for the verified links of
+// identities to foreign key hashchains (see uid.ChainLinkVersion).
+const chainLinkPrefix = "ChainLink."
+
+// sessionResetPrefix is the KeyValueTable prefix for session states which
+// have been reset (see SetSessionReset).
+const sessionResetPrefix = "SessionReset."
+
+// capabilitiesPrefix is the KeyValueTable prefix for the cached capabilities
+// of key servers (see SetCapabilities).
+const capabilitiesPrefix = "Capabilities."
+
+// ChainLink describes the verified link of an identity to a foreign key
+// hashchain.
+type ChainLink struct {
+	Link     *uid.ChainLink // chain link contained in the UID message
+	Position uint64         // hash chain position of the UID message
+	LastSeen bool           // LAST is contained in the local foreign hash chain
+}
+
 const (
 	createQueryKeyValue = `
   CREATE TABLE KeyValueStore (
@@ -38,6 +85,12 @@ CREATE TABLE PrivateUIDs (
   SIGPRIVKEY      TEXT    NOT NULL,
   ENCPRIVKEY      TEXT    NOT NULL,
   UIDMessageReply TEXT
+);`
+	createQueryPrivateEncKeys = `
+CREATE TABLE PrivateEncKeys (
+  ID      INTEGER PRIMARY KEY,
+  HASH    TEXT    NOT NULL UNIQUE,
+  PRIVKEY TEXT    NOT NULL
 );`
 	createQueryPublicUIDs = `
 CREATE TABLE PublicUIDs (
@@ -69,7 +122,8 @@ CREATE TABLE Sessions (
   SessionKey  TEXT    NOT NULL,
   RootKeyHash TEXT    NOT NULL,
   ChainKey    TEXT    NOT NULL,
-  NumOfKeys   INTEGER NOT NULL
+  NumOfKeys   INTEGER NOT NULL,
+  LastUsed    INTEGER NOT NULL DEFAULT 0
 );`
 	createQueryMessageKeys = `
 CREATE TABLE MessageKeys (
@@ -113,27 +167,37 @@ CREATE TABLE SessionKeys (
 	updateValueQuery          = "UPDATE KeyValueStore SET ValueEntry=? WHERE KeyEntry=?;"
 	insertValueQuery          = "INSERT INTO KeyValueStore (KeyEntry, ValueEntry) VALUES (?, ?);"
 	getValueQuery             = "SELECT ValueEntry FROM KeyValueStore WHERE KeyEntry=?;"
+	delValueQuery             = "DELETE FROM KeyValueStore WHERE KeyEntry=?;"
 	addPrivateUIDQuery        = "INSERT INTO PrivateUIDs (IDENTITY, MSGCOUNT, UIDMessage, SIGPRIVKEY, ENCPRIVKEY, UIDMessageReply) VALUES (?, ?, ?, ?, ?, ?);"
 	addPrivateUIDReplyQuery   = "UPDATE PrivateUIDs SET UIDMessageReply=? WHERE UIDMessage=?;"
 	delPrivateUIDQuery        = "DELETE FROM PrivateUIDs WHERE UIDMessage=?;"
 	getPrivateIdentitiesQuery = "SELECT DISTINCT IDENTITY FROM PrivateUIDs;"
-	getPrivateUIDQuery        = "SELECT UIDMessage, SIGPRIVKEY, ENCPRIVKEY, UIDMessageReply FROM PrivateUIDs WHERE IDENTITY=? ORDER BY MSGCOUNT DESC;"
+	getPrivateUIDQuery        = "SELECT UIDMessage, SIGPRIVKEY, ENCPRIVKEY, IFNULL(UIDMessageReply, '') FROM PrivateUIDs WHERE IDENTITY=? ORDER BY MSGCOUNT DESC;"
+	addPrivateEncKeyQuery     = "INSERT OR IGNORE INTO PrivateEncKeys (HASH, PRIVKEY) VALUES (?, ?);"
+	getPrivateEncKeyQuery     = "SELECT PRIVKEY FROM PrivateEncKeys WHERE HASH=?;"
 	addPrivateKeyInitQuery    = "INSERT INTO PrivateKeyInits (SIGKEYHASH, PUBKEYHASH, KeyInit, SigPubKey, PRIVKEY, ServerSignature) VALUES (?, ?, ?, ?, ?, ?);"
 	getPrivateKeyInitQuery    = "SELECT KeyInit, SigPubKey, PRIVKEY FROM PrivateKeyInits WHERE PUBKEYHASH=?;"
 	addPublicKeyInitQuery     = "INSERT INTO PublicKeyInits (SIGKEYHASH, KeyInit) VALUES (?, ?);"
-	getPublicKeyInitQuery     = "SELECT KeyInit FROM PublicKeyInits WHERE SIGKEYHASH=?;"
+	getPublicKeyInitQuery     = "SELECT KeyInit FROM PublicKeyInits WHERE SIGKEYHASH=? ORDER BY ID DESC;"
+	getPrivateKeyInitsQuery   = "SELECT ID, KeyInit FROM PrivateKeyInits WHERE SIGKEYHASH=?;"
+	delPrivateKeyInitQuery    = "DELETE FROM PrivateKeyInits WHERE ID=?;"
+	usePrivateKeyInitQuery    = "UPDATE PrivateKeyInits SET PRIVKEY='' WHERE PUBKEYHASH=?;"
 	addPublicUIDQuery         = "INSERT INTO PublicUIDs (IDENTITY, MSGCOUNT, POSITION, UIDMessage) VALUES (?, ?, ?, ?);"
 	getPublicUIDQuery         = "SELECT UIDMessage, POSITION FROM PublicUIDs WHERE IDENTITY=? and POSITION<=? ORDER BY POSITION DESC;"
+	getPublicUIDsQuery        = "SELECT UIDMessage, POSITION FROM PublicUIDs WHERE IDENTITY=? ORDER BY POSITION ASC;"
+	getPublicIdentitiesQuery  = "SELECT DISTINCT IDENTITY FROM PublicUIDs;"
 	getSessionQuery           = "SELECT RootKeyHash, ChainKey, NumOfKeys FROM Sessions WHERE SessionKey=?;"
 	getSessionIDQuery         = "SELECT SessionID FROM Sessions WHERE SessionKey=?;"
-	updateSessionQuery        = "UPDATE Sessions SET ChainKey=?, NumOfKeys=? WHERE SessionKey=?;"
-	insertSessionQuery        = "INSERT INTO Sessions(SessionKey, RootKeyHash, ChainKey, NumOfKeys) VALUES (?, ?, ?, ?);"
+	updateSessionQuery        = "UPDATE Sessions SET ChainKey=?, NumOfKeys=?, LastUsed=? WHERE SessionKey=?;"
+	insertSessionQuery        = "INSERT INTO Sessions(SessionKey, RootKeyHash, ChainKey, NumOfKeys, LastUsed) VALUES (?, ?, ?, ?, ?);"
+	touchSessionQuery         = "UPDATE Sessions SET LastUsed=? WHERE SessionID=?;"
 	addMessageKeyQuery        = "INSERT INTO MessageKeys(SessionID, Number, Key, Direction) VALUES (?, ?, ?, ?);"
 	delMessageKeyQuery        = "DELETE FROM MessageKeys WHERE SessionID=? AND Number=? AND Direction=?;"
 	getMessageKeyQuery        = "SELECT Key FROM MessageKeys WHERE SessionID=? AND Number=? AND Direction=?;"
 	addHashChainEntryQuery    = "INSERT INTO Hashchains(Domain, Position, Entry) VALUES (?, ?, ?);"
 	getHashChainEntryQuery    = "SELECT Entry FROM Hashchains WHERE Domain=? AND Position=?;"
 	getLastHashChainPosQuery  = "SELECT Position FROM Hashchains WHERE Domain=? ORDER BY Position DESC;"
+	getHashChainPosQuery      = "SELECT Position FROM Hashchains WHERE Domain=? ORDER BY Position ASC;"
 	delHashChainQuery         = "DELETE FROM Hashchains WHERE Domain=?;"
 	updateSessionStateQuery   = "UPDATE SessionStates SET SenderSessionCount=?, SenderMessageCount=?, " +
 		"MaxRecipientCount=?, RecipientTemp=?, SenderSessionPub=?, NextSenderSessionPub=?, " +
@@ -145,45 +209,72 @@ CREATE TABLE SessionKeys (
 	getSessionStateQuery = "SELECT SenderSessionCount, SenderMessageCount, MaxRecipientCount, " +
 		"RecipientTemp, SenderSessionPub, NextSenderSessionPub, NextRecipientSessionPubSeen, " +
 		"NymAddress, KeyInitSession FROM SessionStates WHERE SessionStateKey=?;"
-	updateSessionKeyQuery = "UPDATE SessionKeys SET PrivKey=? WHERE Hash=?;"
-	insertSessionKeyQuery = "INSERT INTO SessionKeys (Hash, Json, PrivKey, CleanupTime) VALUES (?, ?, ?, ?);"
-	getSessionKeyQuery    = "SELECT Json, PrivKey FROM SessionKeys WHERE Hash=?;"
+	getSessionStateKeysQuery = "SELECT SessionStateKey FROM SessionStates ORDER BY ID ASC;"
+	delSessionStateQuery     = "DELETE FROM SessionStates WHERE SessionStateKey=?;"
+	updateSessionKeyQuery    = "UPDATE SessionKeys SET PrivKey=? WHERE Hash=?;"
+	insertSessionKeyQuery    = "INSERT INTO SessionKeys (Hash, Json, PrivKey, CleanupTime) VALUES (?, ?, ?, ?);"
+	getSessionKeyQuery       = "SELECT Json, PrivKey FROM SessionKeys WHERE Hash=?;"
+	countMessageKeysQuery    = "SELECT COUNT(*) FROM MessageKeys WHERE SessionID NOT IN (SELECT SessionID FROM Sessions WHERE LastUsed>=?);"
+	delMessageKeysQuery      = "DELETE FROM MessageKeys WHERE SessionID NOT IN (SELECT SessionID FROM Sessions WHERE LastUsed>=?);"
+	countSessionsQuery       = "SELECT COUNT(*) FROM Sessions WHERE LastUsed<?;"
+	delSessionsQuery         = "DELETE FROM Sessions WHERE LastUsed<?;"
+	countSessionKeysQuery    = "SELECT COUNT(*) FROM SessionKeys WHERE CleanupTime<?;"
+	delSessionKeysQuery      = "DELETE FROM SessionKeys WHERE CleanupTime<?;"
 )
 
 // KeyDB is a handle for an encrypted database used to store mute keys.
 type KeyDB struct {
+	dbname                    string  // prefix of the database files
 	encDB                     *sql.DB // handle for encDB
 	updateValueQuery          *sql.Stmt
 	insertValueQuery          *sql.Stmt
 	getValueQuery             *sql.Stmt
+	delValueQuery             *sql.Stmt
 	addPrivateUIDQuery        *sql.Stmt
 	addPrivateUIDReplyQuery   *sql.Stmt
 	delPrivateUIDQuery        *sql.Stmt
 	getPrivateIdentitiesQuery *sql.Stmt
 	getPrivateUIDQuery        *sql.Stmt
+	addPrivateEncKeyQuery     *sql.Stmt
+	getPrivateEncKeyQuery     *sql.Stmt
 	addPrivateKeyInitQuery    *sql.Stmt
 	getPrivateKeyInitQuery    *sql.Stmt
 	addPublicKeyInitQuery     *sql.Stmt
 	getPublicKeyInitQuery     *sql.Stmt
+	getPrivateKeyInitsQuery   *sql.Stmt
+	delPrivateKeyInitQuery    *sql.Stmt
+	usePrivateKeyInitQuery    *sql.Stmt
 	addPublicUIDQuery         *sql.Stmt
 	getPublicUIDQuery         *sql.Stmt
+	getPublicUIDsQuery        *sql.Stmt
+	getPublicIdentitiesQuery  *sql.Stmt
 	getSessionQuery           *sql.Stmt
 	getSessionIDQuery         *sql.Stmt
 	updateSessionQuery        *sql.Stmt
 	insertSessionQuery        *sql.Stmt
+	touchSessionQuery         *sql.Stmt
 	addMessageKeyQuery        *sql.Stmt
 	delMessageKeyQuery        *sql.Stmt
 	getMessageKeyQuery        *sql.Stmt
 	addHashChainEntryQuery    *sql.Stmt
 	getHashChainEntryQuery    *sql.Stmt
 	getLastHashChainPosQuery  *sql.Stmt
+	getHashChainPosQuery      *sql.Stmt
 	delHashChainQuery         *sql.Stmt
 	updateSessionStateQuery   *sql.Stmt
 	insertSessionStateQuery   *sql.Stmt
 	getSessionStateQuery      *sql.Stmt
+	getSessionStateKeysQuery  *sql.Stmt
+	delSessionStateQuery      *sql.Stmt
 	updateSessionKeyQuery     *sql.Stmt
 	insertSessionKeyQuery     *sql.Stmt
 	getSessionKeyQuery        *sql.Stmt
+	countMessageKeysQuery     *sql.Stmt
+	delMessageKeysQuery       *sql.Stmt
+	countSessionsQuery        *sql.Stmt
+	delSessionsQuery          *sql.Stmt
+	countSessionKeysQuery     *sql.Stmt
+	delSessionKeysQuery       *sql.Stmt
 }
 
 // Create returns a new KEY database with the given dbname.
@@ -192,6 +283,7 @@ func Create(dbname string, passphrase []byte, iter int) error {
 	err := encdb.Create(dbname, passphrase, iter, []string{
 		createQueryKeyValue,
 		createQueryPrivateUIDs,
+		createQueryPrivateEncKeys,
 		createQueryPublicUIDs,
 		createQueryPrivateKeyInits,
 		createQueryPublicKeyInits,
@@ -212,6 +304,97 @@ func Create(dbname string, passphrase []byte, iter int) error {
 	return keyDB.AddValue(DBVersion, Version)
 }
 
+// ErrNewerVersion is returned by Open, if the database has been written by a
+// newer version of keydb.
+var ErrNewerVersion = errors.New("keydb: database written by newer version of Mute, please update")
+
+// ErrDecryptOnly is returned by GetPrivateUID, if the private signature keys
+// of a nym are not available on this device (see SyncDelta.Observer).
+var ErrDecryptOnly = errors.New("keydb: nym is decryption-only on this device (observer)")
+
+// A migration upgrades the schema of keydb from one version to the next.
+type migration struct {
+	from    string
+	to      string
+	queries []string
+}
+
+// migrations contains all registered schema migrations in order.
+var migrations = []migration{
+	// private keys of additional ciphersuites (see uid.CiphersuitesVersion)
+	{"1", "2", []string{createQueryPrivateEncKeys}},
+	// last use of sessions (see Cleanup)
+	{"2", "3", []string{
+		"ALTER TABLE Sessions ADD COLUMN LastUsed INTEGER NOT NULL DEFAULT 0;",
+		"UPDATE Sessions SET LastUsed=CAST(strftime('%s', 'now') AS INTEGER);",
+	}},
+}
+
+// upgrade upgrades the schema of encDB to the current Version. Databases
+// written by a newer version are refused.
+func upgrade(encDB *sql.DB) error {
+	var version string
+	err := encDB.QueryRow(getValueQuery, DBVersion).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		// database is just being created
+		return nil
+	case err != nil:
+		return err
+	}
+	newer, err := isNewerVersion(version, Version)
+	if err != nil {
+		return err
+	}
+	if newer {
+		log.Errorf("keydb: database version %s > %s", version, Version)
+		return ErrNewerVersion
+	}
+	for _, m := range migrations {
+		if version != m.from {
+			continue
+		}
+		log.Infof("keydb: upgrade from version %s to %s", m.from, m.to)
+		tx, err := encDB.Begin()
+		if err != nil {
+			return err
+		}
+		for _, query := range m.queries {
+			if _, err := tx.Exec(query); err != nil {
+				tx.Rollback()
+				return log.Errorf("keydb: upgrade from version %s to %s failed: %s",
+					m.from, m.to, err)
+			}
+		}
+		if _, err := tx.Exec(updateValueQuery, m.to, DBVersion); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version = m.to
+	}
+	if version != Version {
+		return log.Errorf("keydb: no migration from version %s to %s", version,
+			Version)
+	}
+	return nil
+}
+
+// isNewerVersion returns true, if the database version a is newer than b.
+func isNewerVersion(a, b string) (bool, error) {
+	va, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return false, log.Errorf("keydb: cannot parse version: %s", a)
+	}
+	vb, err := strconv.ParseUint(b, 10, 64)
+	if err != nil {
+		return false, log.Errorf("keydb: cannot parse version: %s", b)
+	}
+	return va > vb, nil
+}
+
 // Version returns the current version of keyDB.
 func (keyDB *KeyDB) Version() (string, error) {
 	version, err := keyDB.GetValue(DBVersion)
@@ -221,15 +404,39 @@ func (keyDB *KeyDB) Version() (string, error) {
 	return version, nil
 }
 
+// Snapshot returns consistent copies of the (encrypted) database files of
+// keyDB (see encdb.Snapshot).
+func (keyDB *KeyDB) Snapshot() (dbData, keyData []byte, err error) {
+	dbData, keyData, err = encdb.Snapshot(keyDB.encDB, keyDB.dbname)
+	if err != nil {
+		return nil, nil, log.Error(err)
+	}
+	return dbData, keyData, nil
+}
+
 // Open opens the key database with dbname and passphrase.
 func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 	var keyDB KeyDB
 	var err error
+	keyDB.dbname = dbname
+	// detect interrupted rekey operations (recovered by encdb.Open)
+	pending, err := encdb.RekeyPending(dbname)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		log.Warnf("keydb: recovering interrupted rekey of '%s'", dbname)
+	}
 	// open database
 	keyDB.encDB, err = encdb.Open(dbname, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	// upgrade database, if necessary
+	if err := upgrade(keyDB.encDB); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	// prepare statements
 	if keyDB.updateValueQuery, err = keyDB.encDB.Prepare(updateValueQuery); err != nil {
 		keyDB.encDB.Close()
@@ -243,6 +450,10 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.delValueQuery, err = keyDB.encDB.Prepare(delValueQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addPrivateUIDQuery, err = keyDB.encDB.Prepare(addPrivateUIDQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -263,6 +474,14 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.addPrivateEncKeyQuery, err = keyDB.encDB.Prepare(addPrivateEncKeyQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getPrivateEncKeyQuery, err = keyDB.encDB.Prepare(getPrivateEncKeyQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addPrivateKeyInitQuery, err = keyDB.encDB.Prepare(addPrivateKeyInitQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -279,6 +498,18 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getPrivateKeyInitsQuery, err = keyDB.encDB.Prepare(getPrivateKeyInitsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delPrivateKeyInitQuery, err = keyDB.encDB.Prepare(delPrivateKeyInitQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.usePrivateKeyInitQuery, err = keyDB.encDB.Prepare(usePrivateKeyInitQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addPublicUIDQuery, err = keyDB.encDB.Prepare(addPublicUIDQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -287,6 +518,14 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getPublicUIDsQuery, err = keyDB.encDB.Prepare(getPublicUIDsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.getPublicIdentitiesQuery, err = keyDB.encDB.Prepare(getPublicIdentitiesQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.getSessionQuery, err = keyDB.encDB.Prepare(getSessionQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -303,6 +542,10 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.touchSessionQuery, err = keyDB.encDB.Prepare(touchSessionQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.addMessageKeyQuery, err = keyDB.encDB.Prepare(addMessageKeyQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -327,6 +570,10 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getHashChainPosQuery, err = keyDB.encDB.Prepare(getHashChainPosQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.delHashChainQuery, err = keyDB.encDB.Prepare(delHashChainQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -343,6 +590,14 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.getSessionStateKeysQuery, err = keyDB.encDB.Prepare(getSessionStateKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delSessionStateQuery, err = keyDB.encDB.Prepare(delSessionStateQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	if keyDB.updateSessionKeyQuery, err = keyDB.encDB.Prepare(updateSessionKeyQuery); err != nil {
 		keyDB.encDB.Close()
 		return nil, err
@@ -355,6 +610,30 @@ func Open(dbname string, passphrase []byte) (*KeyDB, error) {
 		keyDB.encDB.Close()
 		return nil, err
 	}
+	if keyDB.countMessageKeysQuery, err = keyDB.encDB.Prepare(countMessageKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delMessageKeysQuery, err = keyDB.encDB.Prepare(delMessageKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.countSessionsQuery, err = keyDB.encDB.Prepare(countSessionsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delSessionsQuery, err = keyDB.encDB.Prepare(delSessionsQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.countSessionKeysQuery, err = keyDB.encDB.Prepare(countSessionKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
+	if keyDB.delSessionKeysQuery, err = keyDB.encDB.Prepare(delSessionKeysQuery); err != nil {
+		keyDB.encDB.Close()
+		return nil, err
+	}
 	return &keyDB, nil
 }
 
@@ -393,6 +672,18 @@ func (keyDB *KeyDB) Incremental(pages int64) error {
 	return encdb.Incremental(keyDB.encDB, pages)
 }
 
+// Schema returns the SQL definitions of all tables, indices, and triggers in
+// keyDB.
+func (keyDB *KeyDB) Schema() ([]string, error) {
+	return encdb.Schema(keyDB.encDB)
+}
+
+// QueryReadOnly executes the SQL query in keyDB without the ability to modify
+// the database and returns the column names and result rows.
+func (keyDB *KeyDB) QueryReadOnly(query string) ([]string, [][]string, error) {
+	return encdb.QueryReadOnly(keyDB.encDB, query)
+}
+
 // AddPrivateUID adds a private uid to keyDB.
 func (keyDB *KeyDB) AddPrivateUID(msg *uid.Message) error {
 	_, err := keyDB.addPrivateUIDQuery.Exec(
@@ -406,9 +697,82 @@ func (keyDB *KeyDB) AddPrivateUID(msg *uid.Message) error {
 	if err != nil {
 		return err
 	}
+	// the private keys of additional ciphersuites are stored separately
+	for i := range msg.UIDContent.PUBKEYS {
+		ke := &msg.UIDContent.PUBKEYS[i]
+		if ke.CIPHERSUITE == uid.DefaultCiphersuite {
+			continue
+		}
+		if _, err := keyDB.addPrivateEncKeyQuery.Exec(ke.HASH, ke.PrivateKey()); err != nil {
+			return err
+		}
+	}
+	if msg.HasMsgSigKey() {
+		err := keyDB.AddValue(msgSigKeyPrefix+msg.UIDContent.IDENTITY,
+			msg.PrivateMsgSigKey())
+		if err != nil {
+			return err
+		}
+	}
+	if escrowKey := msg.PrivateSigEscrowKey(); escrowKey != "" {
+		err := keyDB.AddValue(sigEscrowPrefix+msg.UIDContent.IDENTITY,
+			escrowKey)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// GetSigEscrowKey returns the base64 encoded private escrow key of identity
+// from keyDB. If no escrow key is stored, an empty string is returned.
+func (keyDB *KeyDB) GetSigEscrowKey(identity string) (string, error) {
+	return keyDB.GetValue(sigEscrowPrefix + identity)
+}
+
+// SetSigEscrowKey stores the base64 encoded private escrow key escrowKey of
+// identity in keyDB.
+func (keyDB *KeyDB) SetSigEscrowKey(identity, escrowKey string) error {
+	return keyDB.AddValue(sigEscrowPrefix+identity, escrowKey)
+}
+
+// DelSigEscrowKey deletes the private escrow key of identity from keyDB.
+func (keyDB *KeyDB) DelSigEscrowKey(identity string) error {
+	return keyDB.DelValue(sigEscrowPrefix + identity)
+}
+
+// AddChainLink stores the verified chain link of identity in keyDB, replacing
+// a previously stored one.
+func (keyDB *KeyDB) AddChainLink(identity string, link *ChainLink) error {
+	jsn, err := json.Marshal(link)
+	if err != nil {
+		return log.Error(err)
+	}
+	return keyDB.AddValue(chainLinkPrefix+identity, string(jsn))
+}
+
+// GetChainLink returns the verified chain link of identity from keyDB. If no
+// chain link is stored, nil is returned.
+func (keyDB *KeyDB) GetChainLink(identity string) (*ChainLink, error) {
+	value, err := keyDB.GetValue(chainLinkPrefix + identity)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, nil
+	}
+	var link ChainLink
+	if err := json.Unmarshal([]byte(value), &link); err != nil {
+		return nil, log.Error(err)
+	}
+	return &link, nil
+}
+
+// DelChainLink deletes the chain link of identity from keyDB.
+func (keyDB *KeyDB) DelChainLink(identity string) error {
+	return keyDB.DelValue(chainLinkPrefix + identity)
+}
+
 // AddPrivateUIDReply adds the msgReply to the given UID message.
 func (keyDB *KeyDB) AddPrivateUIDReply(
 	msg *uid.Message,
@@ -471,12 +835,72 @@ func (keyDB *KeyDB) GetPrivateIdentitiesForDomain(domain string) ([]string, erro
 	return identities, nil
 }
 
-// GetPrivateUID gets a private uid for identity from keyDB.
-//
-// TODO: get all UID messages for given identity which are not expired.
+// GetPrivateUID gets a private uid for identity from keyDB. If withPrivkeys
+// is true, the private keys are set and ErrDecryptOnly is returned for nyms
+// without private signature keys.
 func (keyDB *KeyDB) GetPrivateUID(
 	identity string,
 	withPrivkeys bool,
+) (*uid.Message, *uid.MessageReply, error) {
+	return keyDB.getPrivateUID(identity, withPrivkeys, withPrivkeys)
+}
+
+// GetPrivateDecryptionUID gets a private uid for identity from keyDB with the
+// private encryption key set, but without private signature keys. It also
+// works for decryption-only nyms.
+func (keyDB *KeyDB) GetPrivateDecryptionUID(identity string) (*uid.Message, error) {
+	msg, _, err := keyDB.getPrivateUID(identity, false, true)
+	return msg, err
+}
+
+// GetPrivateUIDs gets all private uids for identity from keyDB which are not
+// expired (newest first) with the private encryption keys set, but without
+// private signature keys. The newest uid is always returned, because it is
+// the current one (if it is a tombstone, it is the only one). Messages encrypted to prior uids of identity which are
+// still valid can be decrypted with them.
+func (keyDB *KeyDB) GetPrivateUIDs(identity string) ([]*uid.Message, error) {
+	rows, err := keyDB.getPrivateUIDQuery.Query(identity)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	now := uint64(times.Now())
+	var msgs []*uid.Message
+	for rows.Next() {
+		var (
+			uidJSON    string
+			sigPrivKey string
+			encPrivKey string
+			replyJSON  string
+		)
+		if err := rows.Scan(&uidJSON, &sigPrivKey, &encPrivKey, &replyJSON); err != nil {
+			return nil, log.Error(err)
+		}
+		msg, _, err := keyDB.newPrivateUID(identity, uidJSON, sigPrivKey,
+			encPrivKey, replyJSON, false, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 && msg.UIDContent.NOTAFTER <= now {
+			continue // expired
+		}
+		msgs = append(msgs, msg)
+		if msg.IsTombstone() {
+			break // prior uids of deleted identities are not used anymore
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	if len(msgs) == 0 {
+		return nil, log.Errorf("keydb: no privkey for nym '%s' found", identity)
+	}
+	return msgs, nil
+}
+
+func (keyDB *KeyDB) getPrivateUID(
+	identity string,
+	withSigKeys, withEncKey bool,
 ) (*uid.Message, *uid.MessageReply, error) {
 	var (
 		uidJSON    string
@@ -490,32 +914,96 @@ func (keyDB *KeyDB) GetPrivateUID(
 		return nil, nil, log.Errorf("keydb: no privkey for nym '%s' found", identity)
 	case err != nil:
 		return nil, nil, log.Error(err)
-	default:
-		msg, err := uid.NewJSON(uidJSON)
-		if err != nil {
-			return nil, nil, err
+	}
+	return keyDB.newPrivateUID(identity, uidJSON, sigPrivKey, encPrivKey,
+		replyJSON, withSigKeys, withEncKey)
+}
+
+// newPrivateUID decodes a private uid of identity read from the PrivateUIDs
+// table and sets the requested private keys.
+func (keyDB *KeyDB) newPrivateUID(
+	identity, uidJSON, sigPrivKey, encPrivKey, replyJSON string,
+	withSigKeys, withEncKey bool,
+) (*uid.Message, *uid.MessageReply, error) {
+	msg, err := uid.NewJSON(uidJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := msg.VerifySelfSig(); err != nil {
+		// if this fails something is seriously wrong
+		return nil, nil, log.Error(err)
+	}
+	if withSigKeys {
+		if sigPrivKey == "" {
+			return nil, nil, log.Error(ErrDecryptOnly)
 		}
-		if err := msg.VerifySelfSig(); err != nil {
-			// if this fails something is seriously wrong
-			return nil, nil, log.Error(err)
+		if err := msg.SetPrivateSigKey(sigPrivKey); err != nil {
+			return nil, nil, err
 		}
-		if withPrivkeys {
-			if err := msg.SetPrivateSigKey(sigPrivKey); err != nil {
+		if msg.HasMsgSigKey() {
+			msgSigPrivKey, err := keyDB.GetValue(msgSigKeyPrefix + identity)
+			if err != nil {
 				return nil, nil, err
 			}
-			if err := msg.SetPrivateEncKey(encPrivKey); err != nil {
+			if err := msg.SetPrivateMsgSigKey(msgSigPrivKey); err != nil {
 				return nil, nil, err
 			}
 		}
-		var msgReply *uid.MessageReply
-		if replyJSON != "" {
-			msgReply, err = uid.NewJSONReply(replyJSON)
+		if msg.HasSigEscrow() {
+			escrowKey, err := keyDB.GetValue(sigEscrowPrefix + identity)
 			if err != nil {
 				return nil, nil, err
 			}
+			// the escrow key is not available, if it has been deleted
+			// after the export or belongs to a previous UID message
+			if escrowKey != "" {
+				if err := msg.SetPrivateSigEscrowKey(escrowKey); err != nil &&
+					err != uid.ErrEscrowKeyMismatch {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if withEncKey {
+		if err := msg.SetPrivateEncKey(encPrivKey); err != nil {
+			return nil, nil, err
+		}
+		if err := keyDB.setPrivateEncKeys(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	var msgReply *uid.MessageReply
+	if replyJSON != "" {
+		msgReply, err = uid.NewJSONReply(replyJSON)
+		if err != nil {
+			return nil, nil, err
 		}
-		return msg, msgReply, nil
 	}
+	return msg, msgReply, nil
+}
+
+// setPrivateEncKeys sets the private keys of the additional ciphersuites of
+// msg (see uid.CiphersuitesVersion).
+func (keyDB *KeyDB) setPrivateEncKeys(msg *uid.Message) error {
+	for i := range msg.UIDContent.PUBKEYS {
+		ke := &msg.UIDContent.PUBKEYS[i]
+		if ke.CIPHERSUITE == uid.DefaultCiphersuite {
+			continue
+		}
+		var privKey string
+		err := keyDB.getPrivateEncKeyQuery.QueryRow(ke.HASH).Scan(&privKey)
+		switch {
+		case err == sql.ErrNoRows:
+			return log.Errorf("keydb: no privkey for ciphersuite '%s' of nym '%s' found",
+				ke.CIPHERSUITE, msg.Identity())
+		case err != nil:
+			return log.Error(err)
+		}
+		if err := ke.SetPrivateKey(privKey); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // AddPrivateKeyInit adds a private KeyInit message and the corresponding
@@ -556,6 +1044,16 @@ func (keyDB *KeyDB) GetPrivateKeyInit(
 	}
 }
 
+// UsePrivateKeyInit deletes the private key of the private KeyInit for the
+// given pubKeyHash after its first use. Afterwards GetPrivateKeyInit returns
+// an empty privKey for it, which marks the KeyInit as used.
+func (keyDB *KeyDB) UsePrivateKeyInit(pubKeyHash string) error {
+	if _, err := keyDB.usePrivateKeyInitQuery.Exec(pubKeyHash); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
 // AddPublicKeyInit adds a public KeyInit message to keyDB.
 func (keyDB *KeyDB) AddPublicKeyInit(ki *uid.KeyInit) error {
 	_, err := keyDB.addPublicKeyInitQuery.Exec(ki.SigKeyHash(), ki.JSON())
@@ -566,20 +1064,122 @@ func (keyDB *KeyDB) AddPublicKeyInit(ki *uid.KeyInit) error {
 }
 
 // GetPublicKeyInit gets a public key init from keydb.
+// If multiple KeyInits are stored for sigKeyHash (time-bucketed KeyInits),
+// the most recent one which is valid now is returned. If none of them is
+// valid, the most recent one is returned.
 // If no such KeyInit could be found, sql.ErrNoRows is returned.
 func (keyDB *KeyDB) GetPublicKeyInit(sigKeyHash string) (*uid.KeyInit, error) {
-	var json string
-	err := keyDB.getPublicKeyInitQuery.QueryRow(sigKeyHash).Scan(&json)
-	switch {
-	case err != nil:
+	rows, err := keyDB.getPublicKeyInitQuery.Query(sigKeyHash)
+	if err != nil {
 		return nil, log.Error(err)
-	default:
+	}
+	defer rows.Close()
+	var recent *uid.KeyInit
+	now := uint64(times.Now())
+	for rows.Next() {
+		var json string
+		if err := rows.Scan(&json); err != nil {
+			return nil, log.Error(err)
+		}
 		ki, err := uid.NewJSONKeyInit([]byte(json))
 		if err != nil {
 			return nil, err
 		}
-		return ki, nil
+		if ki.ValidAt(now) {
+			return ki, nil
+		}
+		if recent == nil {
+			recent = ki
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	if recent == nil {
+		return nil, log.Error(sql.ErrNoRows)
+	}
+	return recent, nil
+}
+
+// GetPrivateKeyInitNotAfter returns the latest NOTAFTER of all private
+// KeyInits for the given sigKeyHash (0, if there are none). Fallback KeyInits
+// are only taken into account, if fallback is set.
+func (keyDB *KeyDB) GetPrivateKeyInitNotAfter(
+	sigKeyHash string,
+	fallback bool,
+) (uint64, error) {
+	rows, err := keyDB.getPrivateKeyInitsQuery.Query(sigKeyHash)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	defer rows.Close()
+	var notAfter uint64
+	for rows.Next() {
+		var (
+			id   int64
+			json string
+		)
+		if err := rows.Scan(&id, &json); err != nil {
+			return 0, log.Error(err)
+		}
+		ki, err := uid.NewJSONKeyInit([]byte(json))
+		if err != nil {
+			return 0, err
+		}
+		if ki.Fallback() && !fallback {
+			continue
+		}
+		if ki.NotAfter() > notAfter {
+			notAfter = ki.NotAfter()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, log.Error(err)
 	}
+	return notAfter, nil
+}
+
+// DelExpiredPrivateKeyInits deletes all private KeyInits for the given
+// sigKeyHash which expired before the given time. It returns the number of
+// deleted KeyInits.
+func (keyDB *KeyDB) DelExpiredPrivateKeyInits(
+	sigKeyHash string,
+	before uint64,
+) (int, error) {
+	rows, err := keyDB.getPrivateKeyInitsQuery.Query(sigKeyHash)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	var expired []int64
+	for rows.Next() {
+		var (
+			id   int64
+			json string
+		)
+		if err := rows.Scan(&id, &json); err != nil {
+			rows.Close()
+			return 0, log.Error(err)
+		}
+		ki, err := uid.NewJSONKeyInit([]byte(json))
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if ki.NotAfter() < before {
+			expired = append(expired, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, log.Error(err)
+	}
+	rows.Close()
+	for _, id := range expired {
+		if _, err := keyDB.delPrivateKeyInitQuery.Exec(id); err != nil {
+			return 0, log.Error(err)
+		}
+	}
+	return len(expired), nil
 }
 
 // AddPublicUID adds a public UID message and it's hash chain position to
@@ -620,6 +1220,89 @@ func (keyDB *KeyDB) GetPublicUID(
 	}
 }
 
+// GetPublicUIDs gets all public UID messages for identity from keyDB (and
+// their hash chain positions), ordered by position.
+func (keyDB *KeyDB) GetPublicUIDs(identity string) (
+	msgs []*uid.Message,
+	positions []uint64,
+	err error,
+) {
+	rows, err := keyDB.getPublicUIDsQuery.Query(identity)
+	if err != nil {
+		return nil, nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			uidJSON string
+			pos     uint64
+		)
+		if err := rows.Scan(&uidJSON, &pos); err != nil {
+			return nil, nil, log.Error(err)
+		}
+		msg, err := uid.NewJSON(uidJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, msg)
+		positions = append(positions, pos)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, log.Error(err)
+	}
+	return
+}
+
+// GetPublicIdentities returns all public identities from keyDB.
+func (keyDB *KeyDB) GetPublicIdentities() ([]string, error) {
+	var identities []string
+	rows, err := keyDB.getPublicIdentitiesQuery.Query()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, log.Error(err)
+		}
+		identities = append(identities, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return identities, nil
+}
+
+// GetPublicIdentitiesForDomain returns all public identities for the given
+// domain from keyDB.
+func (keyDB *KeyDB) GetPublicIdentitiesForDomain(domain string) ([]string, error) {
+	var identities []string
+	rows, err := keyDB.getPublicIdentitiesQuery.Query()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	dmn := identity.MapDomain(domain)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, log.Error(err)
+		}
+		_, idDomain, err := identity.Split(id)
+		if err != nil {
+			return nil, err
+		}
+		if idDomain == dmn {
+			identities = append(identities, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return identities, nil
+}
+
 // AddHashChainEntry adds the hash chain entry at position for the given
 // domain to keyDB.
 func (keyDB *KeyDB) AddHashChainEntry(
@@ -635,6 +1318,32 @@ func (keyDB *KeyDB) AddHashChainEntry(
 	return nil
 }
 
+// AddHashChainEntries adds the consecutive hash chain entries starting at
+// position first for the given domain to keyDB. The entries are added in a
+// single transaction, either all of them are added or none.
+func (keyDB *KeyDB) AddHashChainEntries(
+	domain string,
+	first uint64,
+	entries []string,
+) error {
+	dmn := identity.MapDomain(domain)
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	stmt := tx.Stmt(keyDB.addHashChainEntryQuery)
+	for i, entry := range entries {
+		if _, err := stmt.Exec(dmn, first+uint64(i), entry); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
 // GetLastHashChainPos returns the last hash chain position for the given
 // domain from keydb.
 // The return value found indicates if a hash chain entry for domain exists.
@@ -655,6 +1364,31 @@ func (keyDB *KeyDB) GetLastHashChainPos(domain string) (
 	}
 }
 
+// GetHashChainPositions returns all hash chain positions stored for the
+// given domain in keyDB in ascending order. For a completely synced hash
+// chain these are all positions from 0 to the last one, for a filtered hash
+// chain only the positions which matched the filter.
+func (keyDB *KeyDB) GetHashChainPositions(domain string) ([]uint64, error) {
+	var positions []uint64
+	dmn := identity.MapDomain(domain)
+	rows, err := keyDB.getHashChainPosQuery.Query(dmn)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pos uint64
+		if err := rows.Scan(&pos); err != nil {
+			return nil, log.Error(err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return positions, nil
+}
+
 // GetHashChainEntry returns the hash chain entry for the given domain and
 // position from keydb.
 func (keyDB *KeyDB) GetHashChainEntry(domain string, position uint64) (string, error) {
@@ -694,3 +1428,132 @@ func (keyDB *KeyDB) DelHashChain(domain string) error {
 	}
 	return nil
 }
+
+// SetFilteredHashChainPos records that the hash chain for the given domain
+// has been synced with a filter up to (and including) position pos.
+func (keyDB *KeyDB) SetFilteredHashChainPos(domain string, pos uint64) error {
+	key := filteredHashChainPrefix + identity.MapDomain(domain)
+	return keyDB.AddValue(key, strconv.FormatUint(pos, 10))
+}
+
+// GetFilteredHashChainPos returns the last position up to which the hash
+// chain for the given domain has been synced with a filter.
+// The return value filtered indicates if the hash chain is a filtered one.
+func (keyDB *KeyDB) GetFilteredHashChainPos(domain string) (
+	pos uint64,
+	filtered bool,
+	err error,
+) {
+	key := filteredHashChainPrefix + identity.MapDomain(domain)
+	value, err := keyDB.GetValue(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	pos, err = strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, log.Error(err)
+	}
+	return pos, true, nil
+}
+
+// DelFilteredHashChainPos removes the filter marker for the hash chain of
+// the given domain.
+func (keyDB *KeyDB) DelFilteredHashChainPos(domain string) error {
+	return keyDB.DelValue(filteredHashChainPrefix + identity.MapDomain(domain))
+}
+
+// setHashChainMark stores the hash chain position pos together with the
+// hash chain entry at that position under the given key.
+func (keyDB *KeyDB) setHashChainMark(key string, pos uint64, entry string) error {
+	return keyDB.AddValue(key, strconv.FormatUint(pos, 10)+" "+entry)
+}
+
+// getHashChainMark returns the hash chain position and entry stored under
+// the given key (see setHashChainMark).
+func (keyDB *KeyDB) getHashChainMark(key string) (
+	pos uint64,
+	entry string,
+	found bool,
+	err error,
+) {
+	value, err := keyDB.GetValue(key)
+	if err != nil {
+		return 0, "", false, err
+	}
+	if value == "" {
+		return 0, "", false, nil
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return 0, "", false, log.Errorf("keydb: malformed hash chain mark '%s'", key)
+	}
+	pos, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false, log.Error(err)
+	}
+	return pos, parts[1], true, nil
+}
+
+// SetValidatedHashChainPos records that the hash chain for the given domain
+// has been validated up to (and including) position pos, which contains the
+// given entry. Later validations can continue from this checkpoint.
+func (keyDB *KeyDB) SetValidatedHashChainPos(
+	domain string,
+	pos uint64,
+	entry string,
+) error {
+	key := validatedHashChainPrefix + identity.MapDomain(domain)
+	return keyDB.setHashChainMark(key, pos, entry)
+}
+
+// GetValidatedHashChainPos returns the validation checkpoint of the hash
+// chain for the given domain, that is, the last validated position and the
+// entry at that position.
+func (keyDB *KeyDB) GetValidatedHashChainPos(domain string) (
+	pos uint64,
+	entry string,
+	found bool,
+	err error,
+) {
+	key := validatedHashChainPrefix + identity.MapDomain(domain)
+	return keyDB.getHashChainMark(key)
+}
+
+// DelValidatedHashChainPos removes the validation checkpoint of the hash
+// chain for the given domain.
+func (keyDB *KeyDB) DelValidatedHashChainPos(domain string) error {
+	return keyDB.DelValue(validatedHashChainPrefix + identity.MapDomain(domain))
+}
+
+// SetPinnedHashChainPos pins the known-good entry at position pos of the hash
+// chain for the given domain. A key server which later reports a shorter hash
+// chain or a different entry at that position has rolled back its hash chain.
+func (keyDB *KeyDB) SetPinnedHashChainPos(
+	domain string,
+	pos uint64,
+	entry string,
+) error {
+	key := pinnedHashChainPrefix + identity.MapDomain(domain)
+	return keyDB.setHashChainMark(key, pos, entry)
+}
+
+// GetPinnedHashChainPos returns the pinned position and entry of the hash
+// chain for the given domain.
+func (keyDB *KeyDB) GetPinnedHashChainPos(domain string) (
+	pos uint64,
+	entry string,
+	found bool,
+	err error,
+) {
+	key := pinnedHashChainPrefix + identity.MapDomain(domain)
+	return keyDB.getHashChainMark(key)
+}
+
+// DelPinnedHashChainPos removes the pin of the hash chain for the given
+// domain.
+func (keyDB *KeyDB) DelPinnedHashChainPos(domain string) error {
+	return keyDB.DelValue(pinnedHashChainPrefix + identity.MapDomain(domain))
+}
@@ -9,9 +9,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encdb"
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/util"
@@ -35,6 +37,15 @@ func createDB() (tmpdir string, keyDB *KeyDB, err error) {
 	return
 }
 
+// testCiphersuite is an additional ciphersuite for testing.
+const testCiphersuite = "TEST HKDF AES256-CTR SHA512-HMAC ED25519 ECDHE25519"
+
+func init() {
+	if err := uid.RegisterCiphersuite(testCiphersuite, "ECDHE25519"); err != nil {
+		panic(err)
+	}
+}
+
 func TestHelper(t *testing.T) {
 	tmpdir, keyDB, err := createDB()
 	if err != nil {
@@ -51,6 +62,123 @@ func TestHelper(t *testing.T) {
 	}
 }
 
+func TestUpgrade(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "keydb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "keydb")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := Create(dbname, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	setVersion := func(version string) {
+		keyDB, err := Open(dbname, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer keyDB.Close()
+		if err := keyDB.AddValue(DBVersion, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// databases written by newer versions are refused
+	setVersion("1000")
+	if _, err := Open(dbname, passphrase); err != ErrNewerVersion {
+		t.Errorf("Open() should fail with ErrNewerVersion: %v", err)
+	}
+	// unknown old versions cannot be opened
+	err = encdbSetVersion(dbname, passphrase, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbname, passphrase); err == nil {
+		t.Error("Open() should fail without migration")
+	}
+	// registered migrations are run
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = []migration{
+		{"0", Version, []string{"CREATE TABLE Migrated (ID INTEGER PRIMARY KEY);"}},
+	}
+	keyDB, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyDB.Close()
+	version, err := keyDB.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version {
+		t.Errorf("version %s != %s", version, Version)
+	}
+	if _, err := keyDB.encDB.Exec("SELECT * FROM Migrated;"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpgradeV1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "keydb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "keydb")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := Create(dbname, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	// downgrade to version 1
+	db, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"DROP TABLE PrivateEncKeys;",
+		"DROP TABLE Sessions;",
+		"CREATE TABLE Sessions (SessionID INTEGER PRIMARY KEY, SessionKey TEXT NOT NULL, RootKeyHash TEXT NOT NULL, ChainKey TEXT NOT NULL, NumOfKeys INTEGER NOT NULL);",
+		"INSERT INTO Sessions (SessionKey, RootKeyHash, ChainKey, NumOfKeys) VALUES ('key', 'hash', 'chain', 0);",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			db.Close()
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if err := encdbSetVersion(dbname, passphrase, "1"); err != nil {
+		t.Fatal(err)
+	}
+	keyDB, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyDB.Close()
+	if _, err := keyDB.encDB.Exec("SELECT * FROM PrivateEncKeys;"); err != nil {
+		t.Error(err)
+	}
+	var lastUsed int64
+	err = keyDB.encDB.QueryRow("SELECT LastUsed FROM Sessions WHERE SessionKey='key';").Scan(&lastUsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastUsed == 0 {
+		t.Error("LastUsed of migrated session should be set")
+	}
+}
+
+// encdbSetVersion sets the version of the keydb dbname directly (bypassing
+// the version checks of Open).
+func encdbSetVersion(dbname string, passphrase []byte, version string) error {
+	db, err := encdb.Open(dbname, passphrase)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(updateValueQuery, version, DBVersion)
+	return err
+}
+
 func TestRekey(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "keydb_test")
 	if err != nil {
@@ -148,6 +276,25 @@ func TestPrivateUID(t *testing.T) {
 		t.Error("SigPubKeys differ")
 	}
 
+	// dedicated message signing key is stored with the UID
+	up, err := alice.AddMsgSigKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(up); err != nil {
+		t.Fatal(err)
+	}
+	a, _, err = keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrivateMsgSigKey() != up.PrivateMsgSigKey() {
+		t.Error("PrivateMsgSigKeys differ")
+	}
+	if err := keyDB.DelPrivateUID(up); err != nil {
+		t.Fatal(err)
+	}
+
 	key, err := cipher.Ed25519Generate(cipher.RandReader)
 	if err != nil {
 		t.Fatal(err)
@@ -169,6 +316,223 @@ func TestPrivateUID(t *testing.T) {
 	}
 }
 
+func TestPrivateUIDs(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	alice, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	up, err := alice.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(up); err != nil {
+		t.Fatal(err)
+	}
+	// prior uid is still valid
+	msgs, err := keyDB.GetPrivateUIDs("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	if msgs[0].UIDContent.MSGCOUNT != up.UIDContent.MSGCOUNT {
+		t.Error("newest uid should be returned first")
+	}
+	if msgs[1].PrivateEncKey() != alice.PrivateEncKey() {
+		t.Error("private key of prior uid differs")
+	}
+	// prior uids of deleted identities are not returned
+	tombstone, err := up.Tombstone(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(tombstone); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = keyDB.GetPrivateUIDs("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !msgs[0].IsTombstone() {
+		t.Error("only the tombstone should be returned")
+	}
+}
+
+func TestSigEscrowKey(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	alice, err := uid.Create("alice@mute.berlin", true, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	a, _, err := keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrivateSigEscrowKey() != alice.PrivateSigEscrowKey() {
+		t.Error("private escrow keys differ")
+	}
+	escrowKey, err := keyDB.GetSigEscrowKey("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if escrowKey != alice.PrivateSigEscrowKey() {
+		t.Error("exported escrow key differs")
+	}
+	// delete escrow key (after export)
+	if err := keyDB.DelSigEscrowKey("alice@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	a, _, err = keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrivateSigEscrowKey() != "" {
+		t.Error("escrow key not deleted")
+	}
+	// import escrow key
+	if err := keyDB.SetSigEscrowKey("alice@mute.berlin", escrowKey); err != nil {
+		t.Fatal(err)
+	}
+	a, _, err = keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PrivateSigEscrowKey() != escrowKey {
+		t.Error("escrow key not imported")
+	}
+}
+
+func TestChainLink(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	link, err := keyDB.GetChainLink("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != nil {
+		t.Error("chain link should not exist")
+	}
+	l := &ChainLink{
+		Link: &uid.ChainLink{
+			URI:      []string{"mute.one"},
+			LAST:     hashchain.TestEntry,
+			DOMAINS:  []string{"mute.one"},
+			IDENTITY: "alice@mute.one",
+		},
+		Position: 42,
+		LastSeen: true,
+	}
+	if err := keyDB.AddChainLink("alice@mute.berlin", l); err != nil {
+		t.Fatal(err)
+	}
+	link, err = keyDB.GetChainLink("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(link, l) {
+		t.Error("chain links differ")
+	}
+	if err := keyDB.DelChainLink("alice@mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	link, err = keyDB.GetChainLink("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != nil {
+		t.Error("chain link not deleted")
+	}
+}
+
+func TestPrivateEncKeys(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	alice, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = alice.AddCiphersuite(testCiphersuite, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	ke, err := alice.PubKeyFor(testCiphersuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _, err := keyDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := a.PubKeyFor(testCiphersuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PrivateKey() != ke.PrivateKey() {
+		t.Error("private keys differ")
+	}
+	if a.PrivateEncKey() != alice.PrivateEncKey() {
+		t.Error("private keys of default ciphersuite differ")
+	}
+
+	// private keys of additional ciphersuites are synced
+	d, err := keyDB.ExportSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpdir2, keyDB2, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir2)
+	defer keyDB2.Close()
+	if err := keyDB2.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	a, err = keyDB2.GetPrivateDecryptionUID("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = a.PubKeyFor(testCiphersuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PrivateKey() != ke.PrivateKey() {
+		t.Error("synced private keys differ")
+	}
+}
+
 func TestPublicUID(t *testing.T) {
 	tmpdir, keyDB, err := createDB()
 	if err != nil {
@@ -212,6 +576,17 @@ func TestPublicUID(t *testing.T) {
 	if pos != 20 {
 		t.Error("a2 position should be 20")
 	}
+	msgs, positions, err := keyDB.GetPublicUIDs("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || !bytes.Equal(msgs[0].JSON(), a1.JSON()) ||
+		!bytes.Equal(msgs[1].JSON(), a2.JSON()) {
+		t.Error("UID messages differ")
+	}
+	if len(positions) != 2 || positions[0] != 10 || positions[1] != 20 {
+		t.Error("positions differ")
+	}
 }
 
 func TestPrivateKeyInit(t *testing.T) {
@@ -250,6 +625,17 @@ func TestPrivateKeyInit(t *testing.T) {
 	if rPrivKey != privateKey {
 		t.Error("PrivKeys differ")
 	}
+	// use KeyInit
+	if err := keyDB.UsePrivateKeyInit(pubKeyHash); err != nil {
+		t.Fatal(err)
+	}
+	_, _, rPrivKey, err = keyDB.GetPrivateKeyInit(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rPrivKey != "" {
+		t.Error("PrivKey of used KeyInit should be deleted")
+	}
 }
 
 func TestPublicKeyInit(t *testing.T) {
@@ -282,6 +668,89 @@ func TestPublicKeyInit(t *testing.T) {
 	}
 }
 
+func TestTimeBucketedKeyInits(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	msg, err := uid.Create("keydb@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(times.Now())
+	windows := uid.KeyInitWindows(now, 3600, 2)
+	var kis []*uid.KeyInit
+	for _, w := range windows {
+		ki, pubKeyHash, privateKey, err := msg.KeyInit(0, w.NotAfter,
+			w.NotBefore, false, "mute.berlin", "", "", cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = keyDB.AddPrivateKeyInit(ki, pubKeyHash, msg.SigPubKey(),
+			privateKey, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyDB.AddPublicKeyInit(ki); err != nil {
+			t.Fatal(err)
+		}
+		kis = append(kis, ki)
+	}
+	// currently valid public KeyInit is returned (not the most recent one)
+	rKI, err := keyDB.GetPublicKeyInit(kis[0].SigKeyHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rKI.JSON(), kis[0].JSON()) {
+		t.Error("KeyInits differ")
+	}
+	notAfter, err := keyDB.GetPrivateKeyInitNotAfter(kis[0].SigKeyHash(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notAfter != windows[1].NotAfter {
+		t.Errorf("notAfter = %d, want %d", notAfter, windows[1].NotAfter)
+	}
+	// the long-lived fallback KeyInit does not delay the rotation
+	fallbackNotAfter := now + 90*24*3600
+	ki, pubKeyHash, privateKey, err := msg.KeyInit(0, fallbackNotAfter, now,
+		true, "mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keyDB.AddPrivateKeyInit(ki, pubKeyHash, msg.SigPubKey(), privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter, err = keyDB.GetPrivateKeyInitNotAfter(kis[0].SigKeyHash(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notAfter != windows[1].NotAfter {
+		t.Errorf("notAfter = %d, want %d (fallback ignored)", notAfter,
+			windows[1].NotAfter)
+	}
+	notAfter, err = keyDB.GetPrivateKeyInitNotAfter(kis[0].SigKeyHash(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notAfter != fallbackNotAfter {
+		t.Errorf("notAfter = %d, want %d (fallback included)", notAfter,
+			fallbackNotAfter)
+	}
+	n, err := keyDB.DelExpiredPrivateKeyInits(kis[0].SigKeyHash(),
+		windows[0].NotAfter+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("deleted %d KeyInits, want 1", n)
+	}
+}
+
 var testHashchain = []string{
 	"fL50mQtsX4/YSme3gheDTwDrvCYMYhn6A7C0nD101KAC9PP4h6aT9PgvWYD4kNkJI2nV8WThXG11Rd4Lc6uhVMOKDBBeP3140//ovQ0xALyZqlSB3Elfh1drb/CuFPFpxpkiZn12VgsY+da7o8TG0moycB66vBqwNsghTak87La6PY9MX7lPHfcdVSlFZPH3fJyxzh3060dK",
 	"5u+0soN4VL5eozvRFDefcvmnSXgYmqSurB/UNsFf0HMCWdSBJxuuVzGefoKFXhgaae5FBE8lVOyQYc6WQnl1nXTN0MWfWixRloS0kkikyr+MlLdN9WHUWDAxHriJg+NrnpB/s9LGeCO0J+PMhd+pG8dpVW42o0WZJxHjisP+nm26ixzYOmPxe3AhhspfK8IPbIUndhLp7rJy",
@@ -360,3 +829,144 @@ func TestHashchain(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFilteredHashchain(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	_, filtered, err := keyDB.GetFilteredHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered {
+		t.Error("hash chain should not be filtered")
+	}
+	if err := keyDB.AddHashChainEntry("mute.berlin", 1, testHashchain[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddHashChainEntry("mute.berlin", 3, testHashchain[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.SetFilteredHashChainPos("mute.berlin", 5); err != nil {
+		t.Fatal(err)
+	}
+	pos, filtered, err := keyDB.GetFilteredHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filtered {
+		t.Error("hash chain should be filtered")
+	}
+	if pos != 5 {
+		t.Error("filtered pos should be 5")
+	}
+	positions, err := keyDB.GetHashChainPositions("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 2 || positions[0] != 1 || positions[1] != 3 {
+		t.Errorf("wrong hash chain positions: %v", positions)
+	}
+	if err := keyDB.DelFilteredHashChainPos("mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	_, filtered, err = keyDB.GetFilteredHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered {
+		t.Error("hash chain should not be filtered anymore")
+	}
+}
+
+func TestAddHashChainEntries(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	if err := keyDB.AddHashChainEntries("mute.berlin", 0, testHashchain[:2]); err != nil {
+		t.Fatal(err)
+	}
+	pos, found, err := keyDB.GetLastHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 {
+		t.Errorf("last position = %d, expected 1", pos)
+	}
+	if err := keyDB.AddHashChainEntries("mute.berlin", 2, testHashchain[2:4]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		entry, err := keyDB.GetHashChainEntry("mute.berlin", uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != testHashchain[i] {
+			t.Errorf("hash chain entry %d differs", i)
+		}
+	}
+}
+
+func TestHashChainMarks(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	// validation checkpoint
+	_, _, found, err := keyDB.GetValidatedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("validation checkpoint should not exist")
+	}
+	if err := keyDB.SetValidatedHashChainPos("mute.berlin", 3, testHashchain[3]); err != nil {
+		t.Fatal(err)
+	}
+	pos, entry, found, err := keyDB.GetValidatedHashChainPos("Mute.Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 3 || entry != testHashchain[3] {
+		t.Error("wrong validation checkpoint")
+	}
+	if err := keyDB.DelValidatedHashChainPos("mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, found, err = keyDB.GetValidatedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("validation checkpoint should be deleted")
+	}
+	// pin
+	if err := keyDB.SetPinnedHashChainPos("mute.berlin", 1, testHashchain[1]); err != nil {
+		t.Fatal(err)
+	}
+	pos, entry, found, err = keyDB.GetPinnedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || pos != 1 || entry != testHashchain[1] {
+		t.Error("wrong pinned hash chain position")
+	}
+	if err := keyDB.DelPinnedHashChainPos("mute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, found, err = keyDB.GetPinnedHashChainPos("mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("pin should be deleted")
+	}
+}
@@ -51,3 +51,14 @@ func (keyDB *KeyDB) GetValue(key string) (string, error) {
 		return value, nil
 	}
 }
+
+// DelValue deletes the value for the given key from keyDB.
+func (keyDB *KeyDB) DelValue(key string) error {
+	if key == "" {
+		return log.Error("keydb: key must be defined")
+	}
+	if _, err := keyDB.delValueQuery.Exec(key); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
@@ -54,4 +54,15 @@ func TestKeyValueStore(t *testing.T) {
 	if value, err := keyDB.GetValue("bar"); value != "" || err != nil {
 		t.Error("getting undefined key should return empty value")
 	}
+	// delete key
+	if err := keyDB.DelValue("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := keyDB.GetValue("foo"); value != "" || err != nil {
+		t.Error("getting deleted key should return empty value")
+	}
+	// delete empty key
+	if err := keyDB.DelValue(""); err == nil {
+		t.Error("deleting empty key should fail")
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"database/sql"
 
 	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // AddSession adds a session for the given sessionKey. A session
@@ -42,7 +43,7 @@ func (keyDB *KeyDB) AddSession(
 	case err == sql.ErrNoRows:
 		// store new session
 		res, err = tx.Stmt(keyDB.insertSessionQuery).Exec(sessionKey,
-			rootKeyHash, chainKey, len(send))
+			rootKeyHash, chainKey, len(send), times.Now())
 		if err != nil {
 			tx.Rollback()
 			return log.Error(err)
@@ -53,7 +54,7 @@ func (keyDB *KeyDB) AddSession(
 	default:
 		// update session
 		res, err = tx.Stmt(keyDB.updateSessionQuery).Exec(chainKey,
-			offset+uint64(len(send)), sessionKey)
+			offset+uint64(len(send)), times.Now(), sessionKey)
 		if err != nil {
 			tx.Rollback()
 			return log.Error(err)
@@ -153,5 +154,10 @@ func (keyDB *KeyDB) DelMessageKey(
 	if err != nil {
 		return err
 	}
+	// record usage of session (see Cleanup)
+	_, err = keyDB.touchSessionQuery.Exec(times.Now(), sessionID)
+	if err != nil {
+		return err
+	}
 	return nil
 }
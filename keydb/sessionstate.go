@@ -132,3 +132,54 @@ func (keyDB *KeyDB) SetSessionState(
 	}
 	return nil
 }
+
+// GetSessionStateKeys returns the keys of all session states stored in keyDB.
+func (keyDB *KeyDB) GetSessionStateKeys() ([]string, error) {
+	rows, err := keyDB.getSessionStateKeysQuery.Query()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, log.Error(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return keys, nil
+}
+
+// DelSessionState deletes the session state for sessionStateKey from keyDB
+// and marks it as reset (see GetSessionReset).
+func (keyDB *KeyDB) DelSessionState(sessionStateKey string) error {
+	if sessionStateKey == "" {
+		return log.Error("keydb: sessionStateKey must be defined")
+	}
+	if _, err := keyDB.delSessionStateQuery.Exec(sessionStateKey); err != nil {
+		return log.Error(err)
+	}
+	return keyDB.AddValue(sessionResetPrefix+sessionStateKey, "true")
+}
+
+// GetSessionReset returns true, if the session state for sessionStateKey has
+// been reset with DelSessionState and the reset has not been cleared with
+// DelSessionReset yet. The next message of a reset session has to restart it
+// with the peer (see msg.StatusReset).
+func (keyDB *KeyDB) GetSessionReset(sessionStateKey string) (bool, error) {
+	value, err := keyDB.GetValue(sessionResetPrefix + sessionStateKey)
+	if err != nil {
+		return false, err
+	}
+	return value != "", nil
+}
+
+// DelSessionReset clears the reset mark of the session state for
+// sessionStateKey.
+func (keyDB *KeyDB) DelSessionReset(sessionStateKey string) error {
+	return keyDB.DelValue(sessionResetPrefix + sessionStateKey)
+}
@@ -87,4 +87,46 @@ func TestSessionStates(t *testing.T) {
 	if !session.StateEqual(ss2, ss1db) {
 		t.Error("ss2 and ss1db differ")
 	}
+	keys, err := keyDB.GetSessionStateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != sessionStateKey1 || keys[1] != sessionStateKey2 {
+		t.Errorf("wrong session state keys: %v", keys)
+	}
+	// reset session state
+	reset, err := keyDB.GetSessionReset(sessionStateKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset {
+		t.Error("session state should not be reset")
+	}
+	if err := keyDB.DelSessionState(sessionStateKey1); err != nil {
+		t.Fatal(err)
+	}
+	ss1db, err = keyDB.GetSessionState(sessionStateKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss1db != nil {
+		t.Error("session state should be deleted")
+	}
+	reset, err = keyDB.GetSessionReset(sessionStateKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reset {
+		t.Error("session state should be reset")
+	}
+	if err := keyDB.DelSessionReset(sessionStateKey1); err != nil {
+		t.Fatal(err)
+	}
+	reset, err = keyDB.GetSessionReset(sessionStateKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset {
+		t.Error("session reset should be cleared")
+	}
 }
@@ -0,0 +1,453 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/times"
+)
+
+// SyncPrivateUID is a private UID as exchanged between devices.
+type SyncPrivateUID struct {
+	Identity        string
+	MsgCount        int64
+	UIDMessage      string
+	SigPrivKey      string
+	EncPrivKey      string
+	UIDMessageReply string
+	MsgSigKey       string // private message signing key (optional)
+}
+
+// SyncPrivateEncKey is a private key of an additional ciphersuite of a
+// private UID (see uid.CiphersuitesVersion) as exchanged between devices.
+type SyncPrivateEncKey struct {
+	Hash    string
+	PrivKey string
+}
+
+// SyncPrivateKeyInit is a private KeyInit as exchanged between devices.
+type SyncPrivateKeyInit struct {
+	SigKeyHash      string
+	PubKeyHash      string
+	KeyInit         string
+	SigPubKey       string
+	PrivKey         string
+	ServerSignature string
+}
+
+// SyncMessageKey is a message key of a session as exchanged between devices.
+type SyncMessageKey struct {
+	Number    int64
+	Key       string
+	Direction int64
+}
+
+// SyncSession is a session (including its unused message keys) as exchanged
+// between devices.
+type SyncSession struct {
+	SessionKey  string
+	RootKeyHash string
+	ChainKey    string
+	NumOfKeys   int64
+	MessageKeys []*SyncMessageKey
+}
+
+// SyncSessionState is a session state as exchanged between devices.
+type SyncSessionState struct {
+	SessionStateKey             string
+	SenderSessionCount          int64
+	SenderMessageCount          int64
+	MaxRecipientCount           int64
+	RecipientTemp               string
+	SenderSessionPub            string
+	NextSenderSessionPub        sql.NullString
+	NextRecipientSessionPubSeen sql.NullString
+	NymAddress                  string
+	KeyInitSession              int64
+}
+
+// SyncSessionKey is a session key as exchanged between devices.
+type SyncSessionKey struct {
+	Hash        string
+	JSON        string
+	PrivKey     sql.NullString
+	CleanupTime int64
+}
+
+// SyncDelta contains the key material of keyDB which has to be synchronized
+// between devices of the same user (see ExportSync and ImportSync).
+type SyncDelta struct {
+	PrivateUIDs     []*SyncPrivateUID
+	PrivateEncKeys  []*SyncPrivateEncKey
+	PrivateKeyInits []*SyncPrivateKeyInit
+	Sessions        []*SyncSession
+	SessionStates   []*SyncSessionState
+	SessionKeys     []*SyncSessionKey
+}
+
+// Observer returns a copy of d for a decryption-only observer device: the
+// private signature keys of all private UIDs (including message signing keys)
+// are removed, everything required to decrypt messages is kept. An observer
+// can read the messages of the nyms, but cannot sign (and thereby send)
+// messages in their name.
+func (d *SyncDelta) Observer() *SyncDelta {
+	o := *d
+	o.PrivateUIDs = make([]*SyncPrivateUID, len(d.PrivateUIDs))
+	for i, u := range d.PrivateUIDs {
+		pu := *u
+		pu.SigPrivKey = ""
+		pu.MsgSigKey = ""
+		o.PrivateUIDs[i] = &pu
+	}
+	return &o
+}
+
+// ExportSync exports all private UIDs (including the private keys of
+// additional ciphersuites), private KeyInits, sessions, session states, and
+// session keys from keyDB.
+func (keyDB *KeyDB) ExportSync() (*SyncDelta, error) {
+	var d SyncDelta
+	// private UIDs
+	rows, err := keyDB.encDB.Query("SELECT IDENTITY, MSGCOUNT, UIDMessage, SIGPRIVKEY, ENCPRIVKEY, IFNULL(UIDMessageReply, '') FROM PrivateUIDs ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var u SyncPrivateUID
+		err := rows.Scan(&u.Identity, &u.MsgCount, &u.UIDMessage,
+			&u.SigPrivKey, &u.EncPrivKey, &u.UIDMessageReply)
+		if err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.PrivateUIDs = append(d.PrivateUIDs, &u)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	for _, u := range d.PrivateUIDs {
+		u.MsgSigKey, err = keyDB.GetValue(msgSigKeyPrefix + u.Identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// private keys of additional ciphersuites
+	rows, err = keyDB.encDB.Query("SELECT HASH, PRIVKEY FROM PrivateEncKeys ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var k SyncPrivateEncKey
+		if err := rows.Scan(&k.Hash, &k.PrivKey); err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.PrivateEncKeys = append(d.PrivateEncKeys, &k)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// private KeyInits
+	rows, err = keyDB.encDB.Query("SELECT SIGKEYHASH, PUBKEYHASH, KeyInit, SigPubKey, PRIVKEY, ServerSignature FROM PrivateKeyInits ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var ki SyncPrivateKeyInit
+		err := rows.Scan(&ki.SigKeyHash, &ki.PubKeyHash, &ki.KeyInit,
+			&ki.SigPubKey, &ki.PrivKey, &ki.ServerSignature)
+		if err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.PrivateKeyInits = append(d.PrivateKeyInits, &ki)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// sessions
+	rows, err = keyDB.encDB.Query("SELECT SessionID, SessionKey, RootKeyHash, ChainKey, NumOfKeys FROM Sessions ORDER BY SessionID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var sessionIDs []int64
+	for rows.Next() {
+		var (
+			id int64
+			s  SyncSession
+		)
+		err := rows.Scan(&id, &s.SessionKey, &s.RootKeyHash, &s.ChainKey,
+			&s.NumOfKeys)
+		if err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		sessionIDs = append(sessionIDs, id)
+		d.Sessions = append(d.Sessions, &s)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	for i, s := range d.Sessions {
+		rows, err = keyDB.encDB.Query("SELECT Number, Key, Direction FROM MessageKeys WHERE SessionID=? ORDER BY ID ASC;", sessionIDs[i])
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		for rows.Next() {
+			var mk SyncMessageKey
+			if err := rows.Scan(&mk.Number, &mk.Key, &mk.Direction); err != nil {
+				rows.Close()
+				return nil, log.Error(err)
+			}
+			s.MessageKeys = append(s.MessageKeys, &mk)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		rows.Close()
+	}
+	// session states
+	rows, err = keyDB.encDB.Query("SELECT SessionStateKey, SenderSessionCount, SenderMessageCount, MaxRecipientCount, RecipientTemp, SenderSessionPub, NextSenderSessionPub, NextRecipientSessionPubSeen, NymAddress, KeyInitSession FROM SessionStates ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var ss SyncSessionState
+		err := rows.Scan(&ss.SessionStateKey, &ss.SenderSessionCount,
+			&ss.SenderMessageCount, &ss.MaxRecipientCount, &ss.RecipientTemp,
+			&ss.SenderSessionPub, &ss.NextSenderSessionPub,
+			&ss.NextRecipientSessionPubSeen, &ss.NymAddress,
+			&ss.KeyInitSession)
+		if err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.SessionStates = append(d.SessionStates, &ss)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// session keys
+	rows, err = keyDB.encDB.Query("SELECT Hash, Json, PrivKey, CleanupTime FROM SessionKeys ORDER BY ID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sk SyncSessionKey
+		err := rows.Scan(&sk.Hash, &sk.JSON, &sk.PrivKey, &sk.CleanupTime)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		d.SessionKeys = append(d.SessionKeys, &sk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return &d, nil
+}
+
+// exists returns true, if the given query returns at least one row.
+func exists(tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	var n int64
+	if err := tx.QueryRow(query, args...).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// sessionStateAhead returns true, if the session state a is more advanced
+// than the session state b (that is, more sessions or messages have been
+// sent with a).
+func sessionStateAhead(a, b *SyncSessionState) bool {
+	if a.SenderSessionCount != b.SenderSessionCount {
+		return a.SenderSessionCount > b.SenderSessionCount
+	}
+	return a.SenderMessageCount > b.SenderMessageCount
+}
+
+// ImportSync imports the key material d (exported with ExportSync on another
+// device) into keyDB. Entries which already exist are not changed, with one
+// exception: conflicting session states are resolved by keeping the more
+// advanced state (see sessionStateAhead), because reusing an older sender
+// state would reuse message keys. Sessions which already exist keep their
+// local message keys, because keys deleted after use must not be restored.
+func (keyDB *KeyDB) ImportSync(d *SyncDelta) error {
+	tx, err := keyDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := importSync(tx, d); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func importSync(tx *sql.Tx, d *SyncDelta) error {
+	// private UIDs
+	for _, u := range d.PrivateUIDs {
+		found, err := exists(tx, "SELECT COUNT(*) FROM PrivateUIDs WHERE UIDMessage=?;", u.UIDMessage)
+		if err != nil {
+			return err
+		}
+		if !found {
+			var reply interface{}
+			if u.UIDMessageReply != "" {
+				reply = u.UIDMessageReply
+			}
+			_, err := tx.Exec(addPrivateUIDQuery, u.Identity, u.MsgCount,
+				u.UIDMessage, u.SigPrivKey, u.EncPrivKey, reply)
+			if err != nil {
+				return err
+			}
+		} else {
+			if u.UIDMessageReply != "" {
+				_, err := tx.Exec("UPDATE PrivateUIDs SET UIDMessageReply=? WHERE UIDMessage=? AND UIDMessageReply IS NULL;",
+					u.UIDMessageReply, u.UIDMessage)
+				if err != nil {
+					return err
+				}
+			}
+			if u.SigPrivKey != "" {
+				// promote decryption-only UID (see SyncDelta.Observer)
+				_, err := tx.Exec("UPDATE PrivateUIDs SET SIGPRIVKEY=? WHERE UIDMessage=? AND SIGPRIVKEY='';",
+					u.SigPrivKey, u.UIDMessage)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if u.MsgSigKey != "" {
+			key := msgSigKeyPrefix + u.Identity
+			found, err := exists(tx, "SELECT COUNT(*) FROM KeyValueStore WHERE KeyEntry=?;", key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				if _, err := tx.Exec(insertValueQuery, key, u.MsgSigKey); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// private keys of additional ciphersuites
+	for _, k := range d.PrivateEncKeys {
+		if _, err := tx.Exec(addPrivateEncKeyQuery, k.Hash, k.PrivKey); err != nil {
+			return err
+		}
+	}
+	// private KeyInits
+	for _, ki := range d.PrivateKeyInits {
+		found, err := exists(tx, "SELECT COUNT(*) FROM PrivateKeyInits WHERE PUBKEYHASH=?;", ki.PubKeyHash)
+		if err != nil {
+			return err
+		}
+		if found {
+			if ki.PrivKey == "" {
+				// single-use KeyInit has been used on the other device
+				if _, err := tx.Exec(usePrivateKeyInitQuery, ki.PubKeyHash); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		_, err = tx.Exec(addPrivateKeyInitQuery, ki.SigKeyHash, ki.PubKeyHash,
+			ki.KeyInit, ki.SigPubKey, ki.PrivKey, ki.ServerSignature)
+		if err != nil {
+			return err
+		}
+	}
+	// sessions
+	for _, s := range d.Sessions {
+		found, err := exists(tx, "SELECT COUNT(*) FROM Sessions WHERE SessionKey=?;", s.SessionKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		res, err := tx.Exec(insertSessionQuery, s.SessionKey, s.RootKeyHash,
+			s.ChainKey, s.NumOfKeys, times.Now())
+		if err != nil {
+			return err
+		}
+		sessionID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, mk := range s.MessageKeys {
+			_, err := tx.Exec(addMessageKeyQuery, sessionID, mk.Number, mk.Key,
+				mk.Direction)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// session states
+	for _, ss := range d.SessionStates {
+		var local SyncSessionState
+		err := tx.QueryRow("SELECT SenderSessionCount, SenderMessageCount FROM SessionStates WHERE SessionStateKey=?;",
+			ss.SessionStateKey).Scan(&local.SenderSessionCount,
+			&local.SenderMessageCount)
+		query := updateSessionStateQuery
+		switch {
+		case err == sql.ErrNoRows:
+			query = insertSessionStateQuery
+		case err != nil:
+			return err
+		case !sessionStateAhead(ss, &local):
+			continue // keep local state
+		}
+		if query == insertSessionStateQuery {
+			_, err = tx.Exec(query, ss.SessionStateKey, ss.SenderSessionCount,
+				ss.SenderMessageCount, ss.MaxRecipientCount, ss.RecipientTemp,
+				ss.SenderSessionPub, ss.NextSenderSessionPub,
+				ss.NextRecipientSessionPubSeen, ss.NymAddress,
+				ss.KeyInitSession)
+		} else {
+			_, err = tx.Exec(query, ss.SenderSessionCount,
+				ss.SenderMessageCount, ss.MaxRecipientCount, ss.RecipientTemp,
+				ss.SenderSessionPub, ss.NextSenderSessionPub,
+				ss.NextRecipientSessionPubSeen, ss.NymAddress,
+				ss.KeyInitSession, ss.SessionStateKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// session keys
+	for _, sk := range d.SessionKeys {
+		found, err := exists(tx, "SELECT COUNT(*) FROM SessionKeys WHERE Hash=?;", sk.Hash)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		_, err = tx.Exec(insertSessionKeyQuery, sk.Hash, sk.JSON, sk.PrivKey,
+			sk.CleanupTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
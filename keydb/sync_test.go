@@ -0,0 +1,173 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package keydb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/msg/session"
+	"github.com/mutecomm/mute/uid"
+)
+
+func TestSync(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	otherdir, otherDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherdir)
+	defer otherDB.Close()
+	var rt, ssp uid.KeyEntry
+	if err := rt.InitDHKey(cipher.RandReader); err != nil {
+		t.Fatal(err)
+	}
+	if err := ssp.InitDHKey(cipher.RandReader); err != nil {
+		t.Fatal(err)
+	}
+	sessionStateKey := base64.Encode(cipher.SHA512([]byte("key")))
+	ss := &session.State{
+		SenderSessionCount: 1,
+		SenderMessageCount: 5,
+		RecipientTemp:      rt,
+		SenderSessionPub:   ssp,
+		NymAddress:         "NYMADDRESS",
+	}
+	if err := keyDB.SetSessionState(sessionStateKey, ss); err != nil {
+		t.Fatal(err)
+	}
+	sessionKey := base64.Encode(cipher.SHA512([]byte("session")))
+	err = keyDB.AddSession(sessionKey, "ROOTKEYHASH", "CHAINKEY",
+		[]string{"SEND"}, []string{"RECV"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := keyDB.ExportSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.SessionStates) != 1 || len(d.Sessions) != 1 ||
+		len(d.Sessions[0].MessageKeys) != 2 {
+		t.Fatal("unexpected delta")
+	}
+	// import into empty database
+	if err := otherDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	ssdb, err := otherDB.GetSessionState(sessionStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssdb.SenderMessageCount != 5 {
+		t.Errorf("SenderMessageCount = %d, expected 5", ssdb.SenderMessageCount)
+	}
+	// deleted message keys are not restored by a second import
+	if err := otherDB.DelMessageKey(sessionKey, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := otherDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherDB.GetMessageKey(sessionKey, true, 0); err == nil {
+		t.Error("deleted message key restored")
+	}
+	// more advanced session state wins
+	ss.SenderMessageCount = 7
+	if err := otherDB.SetSessionState(sessionStateKey, ss); err != nil {
+		t.Fatal(err)
+	}
+	if err := otherDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	ssdb, err = otherDB.GetSessionState(sessionStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssdb.SenderMessageCount != 7 {
+		t.Errorf("SenderMessageCount = %d, expected 7", ssdb.SenderMessageCount)
+	}
+	d, err = otherDB.ExportSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	ssdb, err = keyDB.GetSessionState(sessionStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssdb.SenderMessageCount != 7 {
+		t.Errorf("SenderMessageCount = %d, expected 7", ssdb.SenderMessageCount)
+	}
+}
+
+func TestSyncObserver(t *testing.T) {
+	tmpdir, keyDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer keyDB.Close()
+	otherdir, otherDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherdir)
+	defer otherDB.Close()
+	alice, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyDB.AddPrivateUID(alice); err != nil {
+		t.Fatal(err)
+	}
+	d, err := keyDB.ExportSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := d.Observer()
+	if o.PrivateUIDs[0].SigPrivKey != "" {
+		t.Error("observer delta contains private signature key")
+	}
+	if d.PrivateUIDs[0].SigPrivKey == "" {
+		t.Error("Observer modified original delta")
+	}
+	// observer can decrypt, but not sign
+	if err := otherDB.ImportSync(o); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := otherDB.GetPrivateDecryptionUID("alice@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.PrivateEncKey() != alice.PrivateEncKey() {
+		t.Error("private encryption keys differ")
+	}
+	_, _, err = otherDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != ErrDecryptOnly {
+		t.Errorf("GetPrivateUID() error = %v, expected ErrDecryptOnly", err)
+	}
+	// full import promotes decryption-only UID
+	if err := otherDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err = otherDB.GetPrivateUID("alice@mute.berlin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.PrivateSigKey() != alice.PrivateSigKey() {
+		t.Error("private signature keys differ")
+	}
+}
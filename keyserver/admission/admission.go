@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package admission implements the optional admission control for
+// registrations on the key server and the account server.
+//
+// Open deployments can throttle bulk registrations of pseudonyms by requiring
+// an invitation code (which can be redeemed only once) and/or a proof-of-work
+// for every registration. The proof-of-work is bound to a challenge (e.g.,
+// the UID message for the key server or the account public key for the
+// account server) and consists of a nonce such that SHA256(challenge|nonce)
+// has at least the required number of leading zero bits.
+package admission
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/mutecomm/mute/cipher"
+)
+
+// MaxPoWBits is the maximum supported proof-of-work difficulty.
+const MaxPoWBits = 32
+
+var (
+	// ErrInvitationRequired is returned if a registration requires an
+	// invitation code, but none was given.
+	ErrInvitationRequired = errors.New("admission: invitation code required")
+	// ErrInvalidInvitation is returned if an invitation code is unknown or
+	// has already been redeemed.
+	ErrInvalidInvitation = errors.New("admission: invalid invitation code")
+	// ErrProofOfWorkRequired is returned if a registration requires a
+	// proof-of-work, but none was given.
+	ErrProofOfWorkRequired = errors.New("admission: proof-of-work required")
+	// ErrInvalidProofOfWork is returned if a proof-of-work does not meet the
+	// required difficulty.
+	ErrInvalidProofOfWork = errors.New("admission: invalid proof-of-work")
+	// ErrDifficulty is returned if a proof-of-work difficulty is out of range.
+	ErrDifficulty = errors.New("admission: proof-of-work difficulty out of range")
+)
+
+// leadingZeros returns the number of leading zero bits of SHA256(challenge|nonce).
+func leadingZeros(challenge []byte, nonce uint64) int {
+	buf := make([]byte, len(challenge)+8)
+	copy(buf, challenge)
+	binary.BigEndian.PutUint64(buf[len(challenge):], nonce)
+	hash := cipher.SHA256(buf)
+	zeros := 0
+	for _, b := range hash {
+		if b == 0 {
+			zeros += 8
+			continue
+		}
+		for b&0x80 == 0 {
+			zeros++
+			b <<= 1
+		}
+		break
+	}
+	return zeros
+}
+
+// ProofOfWork computes a proof-of-work for challenge with the given
+// difficulty bits.
+func ProofOfWork(challenge []byte, bits int) (string, error) {
+	if bits < 0 || bits > MaxPoWBits {
+		return "", ErrDifficulty
+	}
+	var nonce uint64
+	for leadingZeros(challenge, nonce) < bits {
+		nonce++
+	}
+	return strconv.FormatUint(nonce, 10), nil
+}
+
+// VerifyProofOfWork verifies that proof is a valid proof-of-work for
+// challenge with the given difficulty bits.
+func VerifyProofOfWork(challenge []byte, bits int, proof string) error {
+	if bits < 0 || bits > MaxPoWBits {
+		return ErrDifficulty
+	}
+	if bits == 0 {
+		return nil
+	}
+	if proof == "" {
+		return ErrProofOfWorkRequired
+	}
+	nonce, err := strconv.ParseUint(proof, 10, 64)
+	if err != nil {
+		return ErrInvalidProofOfWork
+	}
+	if leadingZeros(challenge, nonce) < bits {
+		return ErrInvalidProofOfWork
+	}
+	return nil
+}
+
+// NewInvitationCode returns a new random invitation code.
+func NewInvitationCode(rand io.Reader) string {
+	return cipher.RandPass(rand)
+}
+
+// Policy is the admission policy of a registration endpoint.
+type Policy struct {
+	Invitation  bool // registration requires an invitation code
+	PoWBits     int  // required proof-of-work difficulty (0 for none)
+	mutex       sync.Mutex
+	invitations map[string]bool
+}
+
+// NewPolicy returns a new admission policy.
+func NewPolicy(invitation bool, powBits int) (*Policy, error) {
+	if powBits < 0 || powBits > MaxPoWBits {
+		return nil, ErrDifficulty
+	}
+	return &Policy{
+		Invitation:  invitation,
+		PoWBits:     powBits,
+		invitations: make(map[string]bool),
+	}, nil
+}
+
+// AddInvitation adds the invitation code to the policy.
+func (p *Policy) AddInvitation(code string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.invitations[code] = true
+}
+
+// Admit checks whether a registration for challenge with the given invitation
+// code and proof-of-work is admitted. A valid invitation code is redeemed,
+// that is, it cannot be used again.
+func (p *Policy) Admit(challenge []byte, invitation, proof string) error {
+	if err := VerifyProofOfWork(challenge, p.PoWBits, proof); err != nil {
+		return err
+	}
+	if !p.Invitation {
+		return nil
+	}
+	if invitation == "" {
+		return ErrInvitationRequired
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.invitations[invitation] {
+		return ErrInvalidInvitation
+	}
+	delete(p.invitations, invitation)
+	return nil
+}
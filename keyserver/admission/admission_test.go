@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package admission
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+)
+
+func TestProofOfWork(t *testing.T) {
+	challenge := []byte("alice@mute.berlin")
+	proof, err := ProofOfWork(challenge, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyProofOfWork(challenge, 12, proof); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyProofOfWork([]byte("bob@mute.berlin"), 12, proof); err == nil {
+		t.Error("proof-of-work should not be valid for other challenge")
+	}
+	if err := VerifyProofOfWork(challenge, 12, ""); err != ErrProofOfWorkRequired {
+		t.Error("should fail with ErrProofOfWorkRequired")
+	}
+	if err := VerifyProofOfWork(challenge, 12, "foo"); err != ErrInvalidProofOfWork {
+		t.Error("should fail with ErrInvalidProofOfWork")
+	}
+	if err := VerifyProofOfWork(challenge, 0, ""); err != nil {
+		t.Error(err)
+	}
+	if _, err := ProofOfWork(challenge, MaxPoWBits+1); err != ErrDifficulty {
+		t.Error("should fail with ErrDifficulty")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	challenge := []byte("alice@mute.berlin")
+	p, err := NewPolicy(true, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := NewInvitationCode(cipher.RandReader)
+	p.AddInvitation(code)
+	proof, err := ProofOfWork(challenge, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Admit(challenge, "", proof); err != ErrInvitationRequired {
+		t.Error("should fail with ErrInvitationRequired")
+	}
+	if err := p.Admit(challenge, "foo", proof); err != ErrInvalidInvitation {
+		t.Error("should fail with ErrInvalidInvitation")
+	}
+	if err := p.Admit(challenge, code, proof); err != nil {
+		t.Error(err)
+	}
+	// invitation codes can only be redeemed once
+	if err := p.Admit(challenge, code, proof); err != ErrInvalidInvitation {
+		t.Error("should fail with ErrInvalidInvitation")
+	}
+	// open policy
+	p, err = NewPolicy(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Admit(challenge, "", ""); err != nil {
+		t.Error(err)
+	}
+}
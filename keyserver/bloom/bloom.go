@@ -0,0 +1,124 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bloom implements the bloom filters used for selective hash chain
+// synchronization with Mute key servers.
+//
+// A client adds the identities it is interested in to a filter and sends
+// the marshalled filter to the key server, which only returns those hash
+// chain entries whose identity matches the filter. The false positive rate
+// of the filter determines how many unrelated entries are returned and
+// therefore how much the key server can learn about the client's contacts.
+package bloom
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+)
+
+// DefaultRate is the default false positive rate for filters. It is
+// deliberately high to hide the actual identities from the key server.
+const DefaultRate = 0.05
+
+// MaxBytes is the maximum size of a filter bit field in bytes.
+const MaxBytes = 65536
+
+// MaxHashes is the maximum number of hash functions of a filter.
+const MaxHashes = 32
+
+// Filter is a bloom filter.
+type Filter struct {
+	bits []byte // bit field
+	k    uint8  // number of hash functions
+}
+
+// New returns a new filter which is able to hold n elements with the false
+// positive rate p.
+func New(n int, p float64) (*Filter, error) {
+	if n < 1 {
+		return nil, log.Error("bloom: number of elements must be positive")
+	}
+	if p <= 0 || p >= 1 {
+		return nil, log.Error("bloom: false positive rate must be in (0, 1)")
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	size := int(math.Ceil(m / 8))
+	if size > MaxBytes {
+		return nil, log.Errorf("bloom: filter too large (%d bytes)", size)
+	}
+	k := int(math.Round(float64(size*8) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > MaxHashes {
+		k = MaxHashes
+	}
+	f := &Filter{
+		bits: make([]byte, size),
+		k:    uint8(k),
+	}
+	return f, nil
+}
+
+// indices returns the bit indices of data in filter f (double hashing).
+func (f *Filter) indices(data []byte) []uint64 {
+	h := cipher.SHA256(data)
+	h1 := binary.BigEndian.Uint64(h[:8])
+	h2 := binary.BigEndian.Uint64(h[8:16])
+	m := uint64(len(f.bits) * 8)
+	idx := make([]uint64, f.k)
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) % m
+	}
+	return idx
+}
+
+// Add adds data to filter f.
+func (f *Filter) Add(data []byte) {
+	for _, i := range f.indices(data) {
+		f.bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Test tests if data is (probably) contained in filter f.
+func (f *Filter) Test(data []byte) bool {
+	for _, i := range f.indices(data) {
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Marshal returns filter f in base64 encoded form.
+func (f *Filter) Marshal() string {
+	buf := make([]byte, 1+len(f.bits))
+	buf[0] = f.k
+	copy(buf[1:], f.bits)
+	return base64.Encode(buf)
+}
+
+// Unmarshal parses the base64 encoded filter and returns it.
+func Unmarshal(filter string) (*Filter, error) {
+	buf, err := base64.Decode(filter)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	if len(buf) < 2 || len(buf) > MaxBytes+1 {
+		return nil, log.Errorf("bloom: filter has invalid length %d", len(buf))
+	}
+	if buf[0] < 1 || buf[0] > MaxHashes {
+		return nil, log.Errorf("bloom: invalid number of hash functions %d",
+			buf[0])
+	}
+	f := &Filter{
+		bits: buf[1:],
+		k:    buf[0],
+	}
+	return f, nil
+}
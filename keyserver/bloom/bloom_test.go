@@ -0,0 +1,73 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := New(100, DefaultRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(fmt.Sprintf("alice%d@mute.berlin", i)))
+	}
+	for i := 0; i < 100; i++ {
+		if !f.Test([]byte(fmt.Sprintf("alice%d@mute.berlin", i))) {
+			t.Errorf("element %d not found", i)
+		}
+	}
+	var positives int
+	for i := 0; i < 10000; i++ {
+		if f.Test([]byte(fmt.Sprintf("bob%d@mute.berlin", i))) {
+			positives++
+		}
+	}
+	if positives > 1000 {
+		t.Errorf("too many false positives: %d", positives)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	f, err := New(10, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Add([]byte("alice@mute.berlin"))
+	g, err := Unmarshal(f.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Test([]byte("alice@mute.berlin")) {
+		t.Error("element not found in unmarshalled filter")
+	}
+	if g.Marshal() != f.Marshal() {
+		t.Error("filters differ")
+	}
+	if _, err := Unmarshal("!"); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := Unmarshal("AA=="); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(0, DefaultRate); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := New(10, 0); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := New(10, 1); err == nil {
+		t.Error("should fail")
+	}
+	if _, err := New(100000000, 0.0001); err == nil {
+		t.Error("should fail")
+	}
+}
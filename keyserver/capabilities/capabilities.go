@@ -16,4 +16,6 @@ type Capabilities struct {
 	KEYHASHCHAINENTRY     string   // last Key Hashchain entry
 	TKNPUBKEY             string   // public wallet key for key server payment tokens
 	SIGPUBKEYS            []string // public signature key(s) of keyserver
+	INVITATION            bool     // registration requires an invitation code
+	POWBITS               int      // proof-of-work difficulty of registrations
 }
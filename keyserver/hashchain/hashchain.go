@@ -7,11 +7,19 @@ package hashchain
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 )
 
+// ErrInvalidLink is returned if a hash chain entry does not link to its
+// predecessor.
+var ErrInvalidLink = errors.New("hashchain: invalid link to previous entry")
+
 // TestEntry is a parseable hashchain entry for tests.
 const TestEntry = "PxIx7lxwcKB3vmPLGzqm3alBCBkHbD89qRBWs7+N8yMB6QEQSe7yf4BrMISdYWeF/Ycm7tKzb6q8LZgdjtTHHAFSkuD/Q3aUITVhT19g5WKwEZ1TlMH0n7ymEEVVhW/PtEDOO/uMoEOKTTvwQp6QA2NE1GYYqhzBtQNHawFtw5NUnupGnDV+QqpJrSUoe/vkXnWZfDiY9Q1W"
 
@@ -50,3 +58,49 @@ func SplitEntry(entry string) (hash, typ, nonce, hashID, crUID, uidIndex []byte,
 	}
 	return
 }
+
+// VerifyLink verifies that the base64 encoded hash chain entry is a valid
+// successor of prevEntry. For the first entry of a hash chain prevEntry must be
+// "".
+func VerifyLink(prevEntry, entry string) error {
+	prevHash := make([]byte, sha256.Size)
+	if prevEntry != "" {
+		hash, _, _, _, _, _, err := SplitEntry(prevEntry)
+		if err != nil {
+			return err
+		}
+		prevHash = hash
+	}
+	hash, typ, nonce, hashID, crUID, uidIndex, err := SplitEntry(entry)
+	if err != nil {
+		return err
+	}
+	e := make([]byte, 0, EntryByteLen)
+	e = append(e, typ...)
+	e = append(e, nonce...)
+	e = append(e, hashID...)
+	e = append(e, crUID...)
+	e = append(e, uidIndex...)
+	e = append(e, prevHash...)
+	if !bytes.Equal(hash, cipher.SHA256(e)) {
+		return log.Error(ErrInvalidLink)
+	}
+	return nil
+}
+
+// TestChain returns a valid hash chain with n entries for tests.
+func TestChain(n int) []string {
+	var chain []string
+	prevHash := make([]byte, sha256.Size)
+	for i := 0; i < n; i++ {
+		// HASH(entry[n]) | TYPE | NONCE | HashID | CrUID | UIDIndex
+		e := make([]byte, EntryByteLen)
+		copy(e[32:], Type)
+		copy(e[33:], encode.ToByte8(uint64(i)))
+		hash := cipher.SHA256(append(append([]byte{}, e[32:]...), prevHash...))
+		copy(e, hash)
+		chain = append(chain, base64.Encode(e))
+		prevHash = hash
+	}
+	return chain
+}
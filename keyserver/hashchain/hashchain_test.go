@@ -18,3 +18,18 @@ func TestSplitEntry(t *testing.T) {
 		t.Error("typ != 0x01")
 	}
 }
+
+func TestVerifyLink(t *testing.T) {
+	chain := TestChain(3)
+	if err := VerifyLink("", chain[0]); err != nil {
+		t.Error(err)
+	}
+	for i := 1; i < len(chain); i++ {
+		if err := VerifyLink(chain[i-1], chain[i]); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := VerifyLink(chain[0], chain[2]); err != ErrInvalidLink {
+		t.Errorf("VerifyLink() = %v, want %v", err, ErrInvalidLink)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package keyservertest implements a fake Mute key server for tests.
+//
+// The fake key server serves the JSON-RPC methods clients need to sync and
+// search the key hash chain (KeyRepository.Capabilities,
+// KeyRepository.FetchUID, KeyHashchain.FetchLastHashChain,
+// KeyHashchain.FetchHashChain, and KeyHashchain.LookupUID) over plain HTTP.
+// Hash chain entries are constructed and signed like the real key server
+// does, so clients can fully verify them. All responses can be scripted with
+// Handle.
+package keyservertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/cipher/aes256"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/uid"
+)
+
+// Methods lists the JSON-RPC methods served by the fake key server.
+var Methods = []string{
+	"KeyRepository.Capabilities",
+	"KeyRepository.FetchUID",
+	"KeyHashchain.FetchLastHashChain",
+	"KeyHashchain.FetchHashChain",
+	"KeyHashchain.LookupUID",
+}
+
+// A Handler replies to a JSON-RPC method call with the given args. It
+// replaces the default behavior of the fake key server for one method.
+type Handler func(args map[string]interface{}) (map[string]interface{}, error)
+
+// Server is a fake Mute key server.
+type Server struct {
+	URL          string       // base URL of the form http://ipaddr:port
+	Domain       string       // the domain served
+	KeyserverUID *uid.Message // UID message of keyserver@Domain (first entry, with escrow key)
+
+	mu        sync.Mutex
+	srv       *httptest.Server
+	sigKey    *cipher.Ed25519Key
+	chain     []string                     // hash chain entries
+	replies   map[string]*uid.MessageReply // maps UIDIndex to reply
+	positions map[string][]uint64          // maps identity to positions
+	handlers  map[string]Handler           // scripted handlers
+	calls     map[string]int               // number of calls per method
+}
+
+// New starts and returns a new fake key server for domain. The hash chain
+// contains the UID message of keyserver@domain as its first entry.
+// The caller should call Close when finished, to shut it down.
+func New(domain string) (*Server, error) {
+	s := &Server{
+		Domain:    domain,
+		replies:   make(map[string]*uid.MessageReply),
+		positions: make(map[string][]uint64),
+		handlers:  make(map[string]Handler),
+		calls:     make(map[string]int),
+	}
+	ksUID, err := uid.Create("keyserver@"+domain, true, "", "", uid.Strict,
+		"", cipher.RandReader)
+	if err != nil {
+		return nil, err
+	}
+	s.sigKey = new(cipher.Ed25519Key)
+	if err := s.sigKey.SetPrivateKey(ksUID.PrivateSigKey64()[:]); err != nil {
+		return nil, err
+	}
+	s.KeyserverUID = ksUID
+	if _, err := s.AddUID(ksUID); err != nil {
+		return nil, err
+	}
+	r := rpc.NewServer()
+	r.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := r.RegisterService(&KeyRepository{s}, ""); err != nil {
+		return nil, err
+	}
+	if err := r.RegisterService(&KeyHashchain{s}, ""); err != nil {
+		return nil, err
+	}
+	s.srv = httptest.NewServer(r)
+	s.URL = s.srv.URL
+	return s, nil
+}
+
+// Close shuts down the fake key server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Handle scripts the replies of the given method with handler h. A nil
+// handler restores the default behavior.
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.handlers, method)
+	} else {
+		s.handlers[method] = h
+	}
+}
+
+// Calls returns the number of calls of the given method so far.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// LastEntry returns the last hash chain entry (to be used as LASTENTRY of
+// new UID messages).
+func (s *Server) LastEntry() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chain[len(s.chain)-1]
+}
+
+// HashChain returns a copy of all hash chain entries.
+func (s *Server) HashChain() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.chain...)
+}
+
+// AddUID registers the UID message msg: a new hash chain entry is appended
+// for it and its signed UIDMessageReply is stored. AddUID returns the hash
+// chain position of the new entry.
+func (s *Server) AddUID(msg *uid.Message) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := msg.Identity()
+	UIDHash, UIDIndex, UIDMessageEncrypted := msg.Encrypt()
+	// NONCE = random 8 bytes, k1, k2 = CKDF(NONCE)
+	nonce := cipher.Nonce(cipher.RandReader)
+	k1, k2 := cipher.CKDF(nonce)
+	// HashID = HASH(k1 | Identity), IDKEY = HASH(k2 | Identity)
+	hashID := cipher.SHA256(append(append([]byte{}, k1...), id...))
+	idKey := cipher.SHA256(append(append([]byte{}, k2...), id...))
+	// CrUID = AES_256_CBC(IDKEY, UIDHash)
+	crUID := aes256.CBCEncrypt(idKey, UIDHash, cipher.RandReader)
+	// entry = TYPE | NONCE | HashID | CrUID | UIDIndex
+	var e bytes.Buffer
+	e.Write(hashchain.Type)
+	e.Write(nonce)
+	e.Write(hashID)
+	e.Write(crUID)
+	e.Write(UIDIndex)
+	// HASH(entry[n]) = HASH(entry | HASH(entry[n-1]))
+	prevHash := make([]byte, sha256.Size)
+	if len(s.chain) > 0 {
+		var err error
+		prevHash, _, _, _, _, _, err = hashchain.SplitEntry(s.chain[len(s.chain)-1])
+		if err != nil {
+			return 0, err
+		}
+	}
+	hash := cipher.SHA256(append(append([]byte{}, e.Bytes()...), prevHash...))
+	entry := base64.Encode(append(hash, e.Bytes()...))
+	if len(entry) != hashchain.EntryBase64Len {
+		return 0, fmt.Errorf("keyservertest: hash chain entry has wrong length %d",
+			len(entry))
+	}
+	pos := uint64(len(s.chain))
+	s.chain = append(s.chain, entry)
+	s.replies[base64.Encode(UIDIndex)] = uid.CreateReply(UIDMessageEncrypted,
+		entry, pos, s.sigKey)
+	s.positions[id] = append(s.positions[id], pos)
+	return pos, nil
+}
+
+// call counts the call of method and runs the scripted handler for it, if
+// any. If no handler is defined, handled is false.
+func (s *Server) call(
+	method string,
+	args map[string]interface{},
+	reply *map[string]interface{},
+) (handled bool, err error) {
+	s.mu.Lock()
+	s.calls[method]++
+	h := s.handlers[method]
+	s.mu.Unlock()
+	if h == nil {
+		return false, nil
+	}
+	*reply, err = h(args)
+	return true, err
+}
+
+// position returns the hash chain position args[key].
+func position(args map[string]interface{}, key string) (uint64, error) {
+	pos, ok := args[key].(float64)
+	if !ok {
+		return 0, fmt.Errorf("keyservertest: %s missing or has wrong type", key)
+	}
+	return uint64(pos), nil
+}
+
+// KeyRepository implements the fake KeyRepository service.
+type KeyRepository struct {
+	s *Server
+}
+
+// Capabilities returns the capabilities of the fake key server.
+func (k *KeyRepository) Capabilities(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	if ok, err := k.s.call("KeyRepository.Capabilities", *args, reply); ok {
+		return err
+	}
+	caps := &capabilities.Capabilities{
+		METHODS:           Methods,
+		DOMAINS:           []string{k.s.Domain},
+		KEYHASHCHAINENTRY: k.s.LastEntry(),
+		SIGPUBKEYS:        []string{k.s.KeyserverUID.UIDContent.SIGKEY.PUBKEY},
+	}
+	*reply = map[string]interface{}{"CAPABILITIES": caps}
+	return nil
+}
+
+// FetchUID returns the UIDMessageReply for args["UIDIndex"].
+func (k *KeyRepository) FetchUID(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	if ok, err := k.s.call("KeyRepository.FetchUID", *args, reply); ok {
+		return err
+	}
+	index, _ := (*args)["UIDIndex"].(string)
+	k.s.mu.Lock()
+	msgReply := k.s.replies[index]
+	k.s.mu.Unlock()
+	if msgReply == nil {
+		return fmt.Errorf("keyservertest: unknown UIDIndex %s", index)
+	}
+	*reply = map[string]interface{}{"UIDMessageReply": msgReply}
+	return nil
+}
+
+// KeyHashchain implements the fake KeyHashchain service.
+type KeyHashchain struct {
+	s *Server
+}
+
+// FetchLastHashChain returns the last hash chain entry and its position.
+func (k *KeyHashchain) FetchLastHashChain(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	if ok, err := k.s.call("KeyHashchain.FetchLastHashChain", *args, reply); ok {
+		return err
+	}
+	k.s.mu.Lock()
+	defer k.s.mu.Unlock()
+	*reply = map[string]interface{}{
+		"HCEntry": k.s.chain[len(k.s.chain)-1],
+		"HCPos":   len(k.s.chain) - 1,
+	}
+	return nil
+}
+
+// FetchHashChain returns the hash chain entries from args["StartPosition"]
+// to args["EndPosition"] (inclusive).
+func (k *KeyHashchain) FetchHashChain(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	if ok, err := k.s.call("KeyHashchain.FetchHashChain", *args, reply); ok {
+		return err
+	}
+	start, err := position(*args, "StartPosition")
+	if err != nil {
+		return err
+	}
+	end, err := position(*args, "EndPosition")
+	if err != nil {
+		return err
+	}
+	k.s.mu.Lock()
+	defer k.s.mu.Unlock()
+	if start > end || end >= uint64(len(k.s.chain)) {
+		return fmt.Errorf("keyservertest: invalid range %d-%d", start, end)
+	}
+	*reply = map[string]interface{}{
+		"HCEntries":  k.s.chain[start : end+1],
+		"HCFirstPos": start,
+	}
+	return nil
+}
+
+// LookupUID returns the hash chain positions of args["Identity"].
+func (k *KeyHashchain) LookupUID(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	if ok, err := k.s.call("KeyHashchain.LookupUID", *args, reply); ok {
+		return err
+	}
+	id, _ := (*args)["Identity"].(string)
+	k.s.mu.Lock()
+	defer k.s.mu.Unlock()
+	positions, ok := k.s.positions[id]
+	if !ok {
+		return fmt.Errorf("keyservertest: unknown identity %s", id)
+	}
+	*reply = map[string]interface{}{"HCPositions": positions}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lookupd implements a relay for key server lookups.
+//
+// The relay is an HTTP CONNECT proxy which only tunnels connections to the
+// configured key servers. The TLS connection to the key server runs end-to-end
+// through the tunnel, so the relay learns neither the query contents nor the
+// replies. Clients which route their lookups through the relay hide their IP
+// address from the key server, the relay only sees which key server a client
+// connects to.
+//
+// Clients use the relay as HTTP proxy, e.g., with http.ProxyURL.
+package lookupd
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+	"github.com/mutecomm/mute/util/metrics"
+)
+
+// Default relay settings.
+const (
+	DialTimeout   = 30 * time.Second // timeout to connect to a key server
+	TunnelTimeout = 10 * time.Minute // maximum lifetime of a tunnel
+)
+
+// Relay is a key server lookup relay. It implements http.Handler.
+type Relay struct {
+	hosts    map[string]string // maps key server host:port to domain
+	dial     func(network, addr string) (net.Conn, error)
+	tunnels  metrics.Counter   // tunnels by domain and status code
+	upstream metrics.Histogram // latencies of key server connects
+}
+
+// New returns a new relay which tunnels connections to the key servers given
+// in upstreams (maps domains to key server URLs).
+func New(upstreams map[string]string) (*Relay, error) {
+	r := &Relay{
+		hosts: make(map[string]string),
+		dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, DialTimeout)
+		},
+	}
+	for domain, URL := range upstreams {
+		host, err := hostPort(URL)
+		if err != nil {
+			return nil, log.Errorf("lookupd: cannot parse key server URL for %s: %s",
+				domain, err)
+		}
+		r.hosts[host] = identity.MapDomain(domain)
+	}
+	r.SetMetrics(metrics.Nop)
+	return r, nil
+}
+
+// hostPort returns the host:port of the key server URL (with the default port
+// of the URL scheme, if none is given).
+func hostPort(URL string) (string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", log.Errorf("lookupd: URL %q has no host", URL)
+	}
+	if u.Port() != "" {
+		return strings.ToLower(u.Host), nil
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
+
+// SetMetrics instruments the relay with m (tunnels by domain and status code
+// and latencies of the key server connects by domain).
+func (relay *Relay) SetMetrics(m metrics.Metrics) {
+	m = metrics.OrNop(m)
+	relay.tunnels = m.Counter("lookupd_tunnels_total",
+		"Number of tunnel requests.", "domain", "code")
+	relay.upstream = m.Histogram("lookupd_upstream_duration_seconds",
+		"Latency of key server connects in seconds.", nil, "domain")
+}
+
+// UpstreamsFromConfig extracts the key server URLs from the configuration
+// map of Mute (entries of the form "keyserver.DOMAIN").
+func UpstreamsFromConfig(configMap map[string]string) map[string]string {
+	upstreams := make(map[string]string)
+	for k, v := range configMap {
+		if strings.HasPrefix(k, "keyserver.") {
+			upstreams[strings.TrimPrefix(k, "keyserver.")] = v
+		}
+	}
+	return upstreams
+}
+
+// ServeHTTP tunnels the CONNECT request r to the requested key server.
+// Requests for other hosts are refused.
+func (relay *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domain, ok := relay.hosts[strings.ToLower(r.Host)]
+	if !ok {
+		relay.tunnels.Inc("unknown", "403")
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnel not supported", http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	upstream, err := relay.dial("tcp", r.Host)
+	metrics.ObserveSince(relay.upstream, start, domain)
+	if err != nil {
+		relay.tunnels.Inc(domain, "502")
+		log.Errorf("lookupd: cannot reach key server for %s: %s", domain, err)
+		http.Error(w, "key server unreachable", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer conn.Close()
+	relay.tunnels.Inc(domain, "200")
+	// reset the deadlines of the server, the tunnel has its own
+	deadline := time.Now().Add(TunnelTimeout)
+	conn.SetDeadline(deadline)
+	upstream.SetDeadline(deadline)
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+	// splice connections (do not log the contents!)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// client data might already be buffered
+		io.Copy(upstream, buf.Reader)
+		if tc, ok := upstream.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	wg.Wait()
+}
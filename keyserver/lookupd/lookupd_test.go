@@ -0,0 +1,159 @@
+// Copyright (c) 2015 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lookupd
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+type FetchArgs struct {
+	StartPosition uint64
+}
+
+type FetchReply struct {
+	HCEntry string
+}
+
+type KeyHashchain struct{}
+
+func (k *KeyHashchain) FetchLastHashChain(
+	r *http.Request,
+	args *FetchArgs,
+	reply *FetchReply,
+) error {
+	reply.HCEntry = "entry"
+	return nil
+}
+
+func (k *KeyHashchain) DeleteHashChain(
+	r *http.Request,
+	args *FetchArgs,
+	reply *FetchReply,
+) error {
+	return nil
+}
+
+// recordConn records the data written to a connection.
+type recordConn struct {
+	net.Conn
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.buf.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestRelay(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(KeyHashchain), "")
+	keyserver := httptest.NewTLSServer(s)
+	defer keyserver.Close()
+	cert := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: keyserver.Certificate().Raw,
+	})
+
+	relay, err := New(map[string]string{"mute.berlin": keyserver.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record what the relay sends to the key server
+	var (
+		mu      sync.Mutex
+		relayed bytes.Buffer
+	)
+	relay.dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &recordConn{Conn: conn, mu: &mu, buf: &relayed}, nil
+	}
+	srv := httptest.NewServer(relay)
+	defer srv.Close()
+
+	pool := jsonclient.NewPool(1, 0, 0)
+	client, err := pool.NewRelayed(keyserver.URL, srv.URL, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["HCEntry"] != "entry" {
+		t.Error("wrong reply")
+	}
+	// the relay only sees the TLS connection
+	mu.Lock()
+	if relayed.Len() == 0 || bytes.Contains(relayed.Bytes(), []byte("FetchLastHashChain")) {
+		t.Error("relay should tunnel encrypted request")
+	}
+	mu.Unlock()
+	// host which is not a configured key server
+	other := httptest.NewTLSServer(s)
+	defer other.Close()
+	client, err = pool.NewRelayed(other.URL, srv.URL, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err == nil {
+		t.Error("should fail")
+	}
+	// plain requests are not relayed
+	resp, err := http.Post(srv.URL+"/mute.berlin", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("wrong status code: %d", resp.StatusCode)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for URL, host := range map[string]string{
+		"https://Key.mute.one/":      "key.mute.one:443",
+		"http://key.mute.one/":       "key.mute.one:80",
+		"https://key.mute.one:8443/": "key.mute.one:8443",
+	} {
+		h, err := hostPort(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != host {
+			t.Errorf("hostPort(%q) = %q, want %q", URL, h, host)
+		}
+	}
+	if _, err := hostPort("key.mute.one"); err == nil {
+		t.Error("URL without host should fail")
+	}
+}
+
+func TestUpstreamsFromConfig(t *testing.T) {
+	upstreams := UpstreamsFromConfig(map[string]string{
+		"keyserver.mute.one":   "https://key.mute.one/",
+		"mixclient.MixAddress": "mix@mute.one",
+	})
+	if len(upstreams) != 1 || upstreams["mute.one"] != "https://key.mute.one/" {
+		t.Errorf("wrong upstreams: %v", upstreams)
+	}
+}
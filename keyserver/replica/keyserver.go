@@ -0,0 +1,317 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replica
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/capabilities"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+// Methods lists the key server JSON-RPC methods served by a promoted node
+// (see NewKeyserverHandler).
+var Methods = []string{
+	"KeyRepository.Capabilities",
+	"KeyHashchain.FetchLastHashChain",
+	"KeyHashchain.FetchHashChain",
+	"KeyHashchain.LookupUID",
+}
+
+// Source feeds the hash chain of the primary key server into the store of the
+// primary replication node, from which it is streamed to the standby nodes
+// (see Streamer). New entries are fetched with the JSON-RPC methods
+// KeyHashchain.FetchLastHashChain and KeyHashchain.FetchHashChain.
+type Source struct {
+	store        Store
+	client       *jsonclient.URLClient
+	PollInterval time.Duration // interval to check key server for new entries
+	Batch        uint64        // maximum number of entries fetched at once
+}
+
+// NewSource returns a new source which appends the hash chain entries of the
+// key server at url (JSON-RPC endpoint) to store. The CA certificate cacert
+// is used to verify the key server, if url uses the https scheme.
+func NewSource(store Store, url string, cacert []byte) (*Source, error) {
+	client, err := jsonclient.New(url, cacert)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return &Source{
+		store:        store,
+		client:       client,
+		PollInterval: time.Second,
+		Batch:        1000,
+	}, nil
+}
+
+// Poll fetches the entries the store is missing from the key server, verifies
+// that they link to the local copy, and appends them. It returns the number
+// of appended entries.
+func (s *Source) Poll() (int, error) {
+	reply, err := s.client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	hcPos, ok := reply["HCPos"].(float64)
+	if !ok {
+		return 0, log.Error("replica: fetch last hash chain position reply has the wrong type")
+	}
+	var appended int
+	for {
+		n, err := next(s.store)
+		if err != nil {
+			return appended, err
+		}
+		if n > uint64(hcPos) {
+			return appended, nil
+		}
+		end := uint64(hcPos)
+		if end-n+1 > s.Batch {
+			end = n + s.Batch - 1
+		}
+		content := map[string]interface{}{
+			"StartPosition": n,
+			"EndPosition":   end,
+		}
+		reply, err := s.client.JSONRPCRequest("KeyHashchain.FetchHashChain", content)
+		if err != nil {
+			return appended, log.Error(err)
+		}
+		hcEntries, ok := reply["HCEntries"].([]interface{})
+		if !ok || uint64(len(hcEntries)) != end-n+1 {
+			return appended, log.Error("replica: fetch hash chain entries reply has the wrong type")
+		}
+		var prevEntry string
+		if n > 0 {
+			prevEntry, err = s.store.Entry(n - 1)
+			if err != nil {
+				return appended, err
+			}
+		}
+		for i, e := range hcEntries {
+			entry, ok := e.(string)
+			if !ok {
+				return appended, log.Error("replica: fetch hash chain entry is not a string")
+			}
+			pos := n + uint64(i)
+			if err := hashchain.VerifyLink(prevEntry, entry); err != nil {
+				log.Errorf("replica: key server entry %d does not link to local copy: %s",
+					pos, err)
+				return appended, log.Error(ErrFork)
+			}
+			if err := s.store.Append(pos, entry); err != nil {
+				return appended, err
+			}
+			prevEntry = entry
+			appended++
+		}
+	}
+}
+
+// Run polls the key server for new entries until stop is closed. It returns
+// on ErrFork and ErrPromoted, because these require operator intervention.
+func (s *Source) Run(stop <-chan struct{}) error {
+	for {
+		promoted, err := s.store.Promoted()
+		if err != nil {
+			return err
+		}
+		if promoted {
+			return log.Error(ErrPromoted)
+		}
+		n, err := s.Poll()
+		if err == ErrFork {
+			return err
+		} else if err != nil {
+			log.Warnf("replica: polling key server failed: %s", err)
+		} else if n > 0 {
+			log.Debugf("replica: appended %d entries from key server", n)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+// NewKeyserverHandler returns a JSON-RPC handler which serves the hash chain
+// in store with the key server methods listed in Methods, so that a promoted
+// node can answer hash chain syncs and lookups of clients for domain.
+// sigPubKeys are the public signature keys of the key server announced in the
+// capabilities. The key repository is not replicated, the handler does not
+// serve UID messages and does not accept registrations.
+func NewKeyserverHandler(
+	store Store,
+	domain string,
+	sigPubKeys []string,
+) (http.Handler, error) {
+	r := rpc.NewServer()
+	r.RegisterCodec(json2.NewCodec(), "application/json")
+	repo := &KeyRepository{store: store, domain: domain, sigPubKeys: sigPubKeys}
+	if err := r.RegisterService(repo, ""); err != nil {
+		return nil, log.Error(err)
+	}
+	if err := r.RegisterService(&KeyHashchain{store: store}, ""); err != nil {
+		return nil, log.Error(err)
+	}
+	return r, nil
+}
+
+// lastEntry returns the last entry in store and its position.
+func lastEntry(store Store) (string, uint64, error) {
+	last, found, err := store.Last()
+	if err != nil {
+		return "", 0, err
+	}
+	if !found {
+		return "", 0, log.Error("replica: hash chain is empty")
+	}
+	entry, err := store.Entry(last)
+	if err != nil {
+		return "", 0, err
+	}
+	return entry, last, nil
+}
+
+// KeyRepository implements the KeyRepository service of a promoted node
+// (capabilities only).
+type KeyRepository struct {
+	store      Store
+	domain     string
+	sigPubKeys []string
+}
+
+// Capabilities returns the capabilities of the promoted node.
+func (k *KeyRepository) Capabilities(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	entry, _, err := lastEntry(k.store)
+	if err != nil {
+		return err
+	}
+	caps := &capabilities.Capabilities{
+		METHODS:           Methods,
+		DOMAINS:           []string{k.domain},
+		KEYHASHCHAINENTRY: entry,
+		SIGPUBKEYS:        k.sigPubKeys,
+	}
+	*reply = map[string]interface{}{"CAPABILITIES": caps}
+	return nil
+}
+
+// KeyHashchain implements the KeyHashchain service of a promoted node.
+type KeyHashchain struct {
+	store Store
+}
+
+// FetchLastHashChain returns the last hash chain entry and its position.
+func (k *KeyHashchain) FetchLastHashChain(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	entry, pos, err := lastEntry(k.store)
+	if err != nil {
+		return err
+	}
+	*reply = map[string]interface{}{
+		"HCEntry": entry,
+		"HCPos":   pos,
+	}
+	return nil
+}
+
+// position returns the hash chain position args[key].
+func position(args map[string]interface{}, key string) (uint64, error) {
+	pos, ok := args[key].(float64)
+	if !ok {
+		return 0, fmt.Errorf("replica: %s missing or has wrong type", key)
+	}
+	return uint64(pos), nil
+}
+
+// FetchHashChain returns the hash chain entries from args["StartPosition"]
+// to args["EndPosition"] (inclusive).
+func (k *KeyHashchain) FetchHashChain(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	start, err := position(*args, "StartPosition")
+	if err != nil {
+		return err
+	}
+	end, err := position(*args, "EndPosition")
+	if err != nil {
+		return err
+	}
+	n, err := next(k.store)
+	if err != nil {
+		return err
+	}
+	if start > end || end >= n {
+		return fmt.Errorf("replica: invalid range %d-%d", start, end)
+	}
+	entries := make([]string, 0, end-start+1)
+	for pos := start; pos <= end; pos++ {
+		entry, err := k.store.Entry(pos)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	*reply = map[string]interface{}{
+		"HCEntries":  entries,
+		"HCFirstPos": start,
+	}
+	return nil
+}
+
+// LookupUID returns the hash chain positions of args["Identity"]. The
+// complete hash chain is searched.
+func (k *KeyHashchain) LookupUID(
+	r *http.Request,
+	args *map[string]interface{},
+	reply *map[string]interface{},
+) error {
+	id, _ := (*args)["Identity"].(string)
+	n, err := next(k.store)
+	if err != nil {
+		return err
+	}
+	var positions []uint64
+	for pos := uint64(0); pos < n; pos++ {
+		entry, err := k.store.Entry(pos)
+		if err != nil {
+			return err
+		}
+		_, _, nonce, hashID, _, _, err := hashchain.SplitEntry(entry)
+		if err != nil {
+			return err
+		}
+		// HashID = HASH(k1 | Identity)
+		k1, _ := cipher.CKDF(nonce)
+		if bytes.Equal(hashID, cipher.SHA256(append(append([]byte{}, k1...), id...))) {
+			positions = append(positions, pos)
+		}
+	}
+	if len(positions) == 0 {
+		return fmt.Errorf("replica: unknown identity %s", id)
+	}
+	*reply = map[string]interface{}{"HCPositions": positions}
+	return nil
+}
@@ -0,0 +1,403 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package replica implements warm standby replication of the key server hash
+// chain.
+//
+// The primary key server streams new hash chain entries to standby nodes
+// (see Streamer). Every entry in the stream is signed with the replication key
+// of the primary. A standby node (see Standby) verifies the signature, the
+// position, and the link of each entry to its predecessor before appending it
+// to its local copy. An entry which conflicts with the local copy stops the
+// replication with ErrFork, the standby never rewrites entries it already
+// has. After the primary has been fenced, a standby node can be promoted (see
+// Promote), which permanently stops the replication on that node.
+//
+// The stream is served at the path /replicate?from=POS and consists of JSON
+// encoded Entry objects, one per line.
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/metrics"
+)
+
+// ErrFork is returned if the primary sends an entry which conflicts with the
+// local copy of the hash chain.
+var ErrFork = errors.New("replica: hash chain fork detected")
+
+// ErrPromoted is returned if a promoted node is asked to replicate.
+var ErrPromoted = errors.New("replica: node has been promoted")
+
+// ErrInvalidSignature is returned if an entry in the stream has an invalid
+// signature.
+var ErrInvalidSignature = errors.New("replica: invalid entry signature")
+
+// Store is a local copy of a hash chain.
+type Store interface {
+	// Last returns the position of the last entry (found is false for an
+	// empty hash chain).
+	Last() (pos uint64, found bool, err error)
+	// Entry returns the entry at position pos.
+	Entry(pos uint64) (string, error)
+	// Append appends the entry at position pos, which must be the position
+	// following the last entry.
+	Append(pos uint64, entry string) error
+	// Promoted returns true, if the store has been promoted to primary.
+	Promoted() (bool, error)
+	// Promote marks the store as promoted to primary (permanently).
+	Promote() error
+}
+
+// Entry is a signed hash chain entry in the replication stream.
+type Entry struct {
+	Position  uint64 // position of the entry in the hash chain
+	HCEntry   string // the base64 encoded hash chain entry
+	Signature string // signature of the primary over position and entry
+}
+
+func signedData(pos uint64, hcEntry string) []byte {
+	return append(encode.ToByte8(pos), []byte(hcEntry)...)
+}
+
+// Sign signs the entry with the given replication key.
+func (e *Entry) Sign(key *cipher.Ed25519Key) {
+	e.Signature = base64.Encode(key.Sign(signedData(e.Position, e.HCEntry)))
+}
+
+// Verify verifies the signature of the entry with the given replication key.
+func (e *Entry) Verify(key *cipher.Ed25519Key) error {
+	sig, err := base64.Decode(e.Signature)
+	if err != nil {
+		return err
+	}
+	if !key.Verify(signedData(e.Position, e.HCEntry), sig) {
+		return log.Error(ErrInvalidSignature)
+	}
+	return nil
+}
+
+// next returns the position following the last entry in store.
+func next(store Store) (uint64, error) {
+	last, found, err := store.Last()
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, nil
+	}
+	return last + 1, nil
+}
+
+// Streamer streams the hash chain entries of a primary key server to standby
+// nodes. It implements http.Handler.
+type Streamer struct {
+	store        Store
+	key          *cipher.Ed25519Key
+	PollInterval time.Duration // interval to check store for new entries
+	streams      metrics.Counter
+	streamed     metrics.Counter
+}
+
+// NewStreamer returns a new streamer for the hash chain in store which signs
+// entries with the replication key privateKey.
+func NewStreamer(store Store, privateKey *[64]byte) (*Streamer, error) {
+	var key cipher.Ed25519Key
+	if err := key.SetPrivateKey(privateKey[:]); err != nil {
+		return nil, err
+	}
+	s := &Streamer{
+		store:        store,
+		key:          &key,
+		PollInterval: time.Second,
+	}
+	s.SetMetrics(metrics.Nop)
+	return s, nil
+}
+
+// SetMetrics instruments the streamer with m (number of streams to standby
+// nodes and streamed entries).
+func (s *Streamer) SetMetrics(m metrics.Metrics) {
+	m = metrics.OrNop(m)
+	s.streams = m.Counter("replica_streams_total",
+		"Number of replication streams to standby nodes.")
+	s.streamed = m.Counter("replica_streamed_entries_total",
+		"Number of hash chain entries streamed to standby nodes.")
+}
+
+// ServeHTTP streams the hash chain entries starting at the position given in
+// the query parameter "from" until the client disconnects.
+func (s *Streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pos, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "cannot parse 'from'", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	s.streams.Inc()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := next(s.store)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for ; pos < n; pos++ {
+			hcEntry, err := s.store.Entry(pos)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			e := &Entry{Position: pos, HCEntry: hcEntry}
+			e.Sign(s.key)
+			if err := enc.Encode(e); err != nil {
+				return // client disconnected
+			}
+			s.streamed.Inc()
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Standby replicates the hash chain of a primary key server into a local
+// store.
+type Standby struct {
+	store  Store
+	url    string
+	key    *cipher.Ed25519Key
+	client *http.Client
+	synced metrics.Counter
+	fails  metrics.Counter
+}
+
+// NewStandby returns a new standby node which replicates the hash chain
+// streamed from url into store. Entries must be signed with the replication
+// key publicKey of the primary.
+func NewStandby(
+	store Store,
+	url string,
+	publicKey *[32]byte,
+	client *http.Client,
+) (*Standby, error) {
+	var key cipher.Ed25519Key
+	if err := key.SetPublicKey(publicKey[:]); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &Standby{
+		store:  store,
+		url:    url,
+		key:    &key,
+		client: client,
+	}
+	s.SetMetrics(metrics.Nop)
+	return s, nil
+}
+
+// SetMetrics instruments the standby node with m (number of replicated
+// entries and failed syncs).
+func (s *Standby) SetMetrics(m metrics.Metrics) {
+	m = metrics.OrNop(m)
+	s.synced = m.Counter("replica_replicated_entries_total",
+		"Number of hash chain entries replicated from the primary.")
+	s.fails = m.Counter("replica_sync_errors_total",
+		"Number of failed syncs with the primary.")
+}
+
+// apply verifies the streamed entry e and appends it to the local store.
+func (s *Standby) apply(e *Entry) error {
+	if err := e.Verify(s.key); err != nil {
+		return err
+	}
+	n, err := next(s.store)
+	if err != nil {
+		return err
+	}
+	if e.Position < n {
+		// we already have this entry, it must not differ
+		local, err := s.store.Entry(e.Position)
+		if err != nil {
+			return err
+		}
+		if local != e.HCEntry {
+			log.Errorf("replica: entry %d differs from local copy", e.Position)
+			return log.Error(ErrFork)
+		}
+		return nil
+	}
+	if e.Position > n {
+		return log.Errorf("replica: entry %d missing (got %d)", n, e.Position)
+	}
+	var prevEntry string
+	if n > 0 {
+		prevEntry, err = s.store.Entry(n - 1)
+		if err != nil {
+			return err
+		}
+	}
+	if err := hashchain.VerifyLink(prevEntry, e.HCEntry); err != nil {
+		log.Errorf("replica: entry %d does not link to local copy: %s",
+			e.Position, err)
+		return log.Error(ErrFork)
+	}
+	if err := s.store.Append(e.Position, e.HCEntry); err != nil {
+		return err
+	}
+	s.synced.Inc()
+	return nil
+}
+
+// Sync connects to the primary and replicates entries until the stream ends,
+// stop is closed, or an error occurs. Entries already in the local store are
+// streamed again (starting at the last local entry) to detect forks.
+func (s *Standby) Sync(stop <-chan struct{}) error {
+	promoted, err := s.store.Promoted()
+	if err != nil {
+		return err
+	}
+	if promoted {
+		return log.Error(ErrPromoted)
+	}
+	last, found, err := s.store.Last()
+	if err != nil {
+		return err
+	}
+	if !found {
+		last = 0
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?from=%d", s.url, last), nil)
+	if err != nil {
+		return log.Error(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return log.Errorf("replica: primary returned %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return log.Error(err)
+		}
+		if err := s.apply(&e); err != nil {
+			return err
+		}
+		log.Debugf("replica: replicated entry %d", e.Position)
+	}
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	if err := scanner.Err(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// Follow replicates the hash chain from the primary until stop is closed,
+// reconnecting after connection errors. It returns on ErrFork, ErrPromoted,
+// and invalid signatures, because these require operator intervention.
+func (s *Standby) Follow(stop <-chan struct{}) error {
+	b := &backoff.Backoff{
+		Min: time.Second,
+		Max: time.Minute,
+	}
+	for {
+		err := s.Sync(stop)
+		switch err {
+		case ErrFork, ErrPromoted, ErrInvalidSignature:
+			return err
+		case nil:
+			b.Reset()
+		default:
+			s.fails.Inc()
+			log.Warnf("replica: sync failed: %s", err)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(b.Duration()):
+		}
+	}
+}
+
+// Promote promotes the standby node with the given store to primary. Before a
+// standby node is promoted the old primary must be fenced (stopped), otherwise
+// the hash chain can fork. After the promotion the store does not accept
+// replicated entries anymore. Promote returns the position of the last entry.
+func Promote(store Store) (uint64, error) {
+	last, found, err := store.Last()
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, log.Error("replica: cannot promote empty hash chain")
+	}
+	// validate complete local copy before promotion
+	var prevEntry string
+	for pos := uint64(0); pos <= last; pos++ {
+		entry, err := store.Entry(pos)
+		if err != nil {
+			return 0, err
+		}
+		if err := hashchain.VerifyLink(prevEntry, entry); err != nil {
+			return 0, log.Errorf("replica: entry %d invalid: %s", pos, err)
+		}
+		prevEntry = entry
+	}
+	if err := store.Promote(); err != nil {
+		return 0, err
+	}
+	log.Infof("replica: promoted to primary at position %d", last)
+	return last, nil
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replica
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/keyserver/keyservertest"
+	"github.com/mutecomm/mute/uid"
+	"github.com/mutecomm/mute/util/jsonclient"
+)
+
+func openStore(t *testing.T, dir string, entries []string) *FileStore {
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if err := fs.Append(uint64(i), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestReplication(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "replica_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	chain := hashchain.TestChain(5)
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// primary
+	primary := openStore(t, filepath.Join(tmpdir, "primary"), chain[:3])
+	streamer, err := NewStreamer(primary, key.PrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer.PollInterval = 10 * time.Millisecond
+	srv := httptest.NewServer(streamer)
+	defer srv.Close()
+
+	// standby
+	store := openStore(t, filepath.Join(tmpdir, "standby"), nil)
+	standby, err := NewStandby(store, srv.URL, key.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- standby.Sync(stop)
+	}()
+	for _, entry := range chain[3:] {
+		last, _, _ := primary.Last()
+		if err := primary.Append(last+1, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if last, _, _ := store.Last(); last == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range chain {
+		e, err := store.Entry(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e != entry {
+			t.Errorf("entry %d differs", i)
+		}
+	}
+
+	// reopen store
+	store = openStore(t, filepath.Join(tmpdir, "standby"), nil)
+	if last, _, _ := store.Last(); last != 4 {
+		t.Errorf("last = %d, want 4", last)
+	}
+
+	// promotion
+	if _, err := Promote(store); err != nil {
+		t.Fatal(err)
+	}
+	standby, err = NewStandby(store, srv.URL, key.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Sync(nil); err != ErrPromoted {
+		t.Errorf("Sync() = %v, want %v", err, ErrPromoted)
+	}
+}
+
+func TestFork(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "replica_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	chain := hashchain.TestChain(3)
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openStore(t, tmpdir, chain[:1])
+	standby, err := NewStandby(store, "", key.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entry which does not link to local copy
+	e := &Entry{Position: 1, HCEntry: chain[2]}
+	e.Sign(key)
+	if err := standby.apply(e); err != ErrFork {
+		t.Errorf("apply() = %v, want %v", err, ErrFork)
+	}
+	// entry which differs from local copy
+	e = &Entry{Position: 0, HCEntry: chain[1]}
+	e.Sign(key)
+	if err := standby.apply(e); err != ErrFork {
+		t.Errorf("apply() = %v, want %v", err, ErrFork)
+	}
+	// invalid signature
+	e = &Entry{Position: 1, HCEntry: chain[1]}
+	e.Sign(key)
+	e.Position = 2
+	if err := standby.apply(e); err != ErrInvalidSignature {
+		t.Errorf("apply() = %v, want %v", err, ErrInvalidSignature)
+	}
+	// valid entry
+	e = &Entry{Position: 1, HCEntry: chain[1]}
+	e.Sign(key)
+	if err := standby.apply(e); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyserverReplication(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "replica_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	const domain = "replica.test"
+	ks, err := keyservertest.New(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// primary: fed from key server, streams to standby
+	primary := openStore(t, filepath.Join(tmpdir, "primary"), nil)
+	source, err := NewSource(primary, ks.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.PollInterval = 10 * time.Millisecond
+	stopSource := make(chan struct{})
+	sourceDone := make(chan error)
+	go func() {
+		sourceDone <- source.Run(stopSource)
+	}()
+	streamer, err := NewStreamer(primary, key.PrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer.PollInterval = 10 * time.Millisecond
+	srv := httptest.NewServer(streamer)
+	defer srv.Close()
+
+	// standby
+	store := openStore(t, filepath.Join(tmpdir, "standby"), nil)
+	standby, err := NewStandby(store, srv.URL, key.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- standby.Sync(stop)
+	}()
+
+	// the key server appends a new entry, which must reach the standby
+	alice, err := uid.Create("alice@"+domain, false, "", "", uid.Strict,
+		ks.LastEntry(), cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := ks.AddUID(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if last, found, _ := store.Last(); found && last == pos {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(stopSource)
+	if err := <-sourceDone; err != nil {
+		t.Fatal(err)
+	}
+	chain := ks.HashChain()
+	for i, entry := range chain {
+		e, err := store.Entry(uint64(i))
+		if err != nil {
+			t.Fatalf("entry %d not replicated: %s", i, err)
+		}
+		if e != entry {
+			t.Errorf("entry %d differs", i)
+		}
+	}
+
+	// promoted standby serves key server methods
+	if _, err := Promote(store); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewKeyserverHandler(store, domain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksrv := httptest.NewServer(handler)
+	defer ksrv.Close()
+	client, err := jsonclient.New(ksrv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.JSONRPCRequest("KeyHashchain.FetchLastHashChain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply["HCEntry"] != chain[len(chain)-1] ||
+		reply["HCPos"] != float64(len(chain)-1) {
+		t.Errorf("FetchLastHashChain returned wrong entry: %v", reply)
+	}
+	reply, err = client.JSONRPCRequest("KeyHashchain.LookupUID",
+		map[string]interface{}{"Identity": "alice@" + domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions, _ := reply["HCPositions"].([]interface{})
+	if len(positions) != 1 || positions[0] != float64(pos) {
+		t.Errorf("LookupUID returned wrong positions: %v", reply)
+	}
+}
+
+func TestFileStoreTail(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "replica_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	chain := hashchain.TestChain(3)
+	store := openStore(t, tmpdir, chain[:1])
+	// another process appends to the hash chain file (last line incomplete)
+	fp, err := os.OpenFile(filepath.Join(tmpdir, hashchainFile),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteString(chain[1] + "\n" + chain[2][:10]); err != nil {
+		t.Fatal(err)
+	}
+	if last, _, err := store.Last(); err != nil || last != 1 {
+		t.Errorf("Last() = %d, %v, want 1", last, err)
+	}
+	if _, err := fp.WriteString(chain[2][10:] + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if e, err := store.Entry(2); err != nil || e != chain[2] {
+		t.Errorf("Entry(2) = %s, %v", e, err)
+	}
+}
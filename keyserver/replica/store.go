@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/log"
+)
+
+const (
+	hashchainFile = "hashchain" // one base64 encoded entry per line
+	promotedFile  = "promoted"  // exists after promotion
+)
+
+// FileStore is a Store which keeps the hash chain in an append-only file in
+// a directory. Entries appended to the file by other processes (e.g., the key
+// server) are picked up by Last and Entry.
+type FileStore struct {
+	mutex   sync.Mutex
+	dir     string
+	entries []string
+	size    int64 // size of the file read so far
+}
+
+// OpenFileStore opens the file store in directory dir (which is created, if
+// necessary).
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, log.Error(err)
+	}
+	fs := &FileStore{dir: dir}
+	filename := filepath.Join(dir, hashchainFile)
+	fp, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return fs, nil
+	} else if err != nil {
+		return nil, log.Error(err)
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		entry := scanner.Text()
+		if len(entry) != hashchain.EntryBase64Len {
+			break
+		}
+		fs.entries = append(fs.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	size := int64(len(fs.entries)) * (hashchain.EntryBase64Len + 1)
+	if fi.Size() != size {
+		// remove incomplete write
+		if fi.Size() < size {
+			fs.entries = fs.entries[:len(fs.entries)-1] // newline missing
+			size -= hashchain.EntryBase64Len + 1
+		}
+		log.Warnf("replica: truncating incomplete entry %d", len(fs.entries))
+		if err := os.Truncate(filename, size); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	fs.size = size
+	return fs, nil
+}
+
+// refresh reads the complete entries which have been appended to the file
+// since it was read the last time. Must be called with fs.mutex held.
+func (fs *FileStore) refresh() error {
+	filename := filepath.Join(fs.dir, hashchainFile)
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return log.Error(err)
+	}
+	if fi.Size() <= fs.size {
+		return nil
+	}
+	fp, err := os.Open(filename)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer fp.Close()
+	buf := make([]byte, fi.Size()-fs.size)
+	if _, err := fp.ReadAt(buf, fs.size); err != nil {
+		return log.Error(err)
+	}
+	// only complete lines, the last one might still be written
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		entry := string(buf[:i])
+		if len(entry) != hashchain.EntryBase64Len {
+			return log.Errorf("replica: entry %d in file has invalid length",
+				len(fs.entries))
+		}
+		fs.entries = append(fs.entries, entry)
+		fs.size += int64(i + 1)
+		buf = buf[i+1:]
+	}
+	return nil
+}
+
+// Last implements Store.
+func (fs *FileStore) Last() (uint64, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if err := fs.refresh(); err != nil {
+		return 0, false, err
+	}
+	if len(fs.entries) == 0 {
+		return 0, false, nil
+	}
+	return uint64(len(fs.entries) - 1), true, nil
+}
+
+// Entry implements Store.
+func (fs *FileStore) Entry(pos uint64) (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if pos >= uint64(len(fs.entries)) {
+		if err := fs.refresh(); err != nil {
+			return "", err
+		}
+	}
+	if pos >= uint64(len(fs.entries)) {
+		return "", log.Errorf("replica: entry %d not found", pos)
+	}
+	return fs.entries[pos], nil
+}
+
+// Append implements Store.
+func (fs *FileStore) Append(pos uint64, entry string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if err := fs.refresh(); err != nil {
+		return err
+	}
+	if pos != uint64(len(fs.entries)) {
+		return log.Errorf("replica: cannot append entry %d (expected %d)", pos,
+			len(fs.entries))
+	}
+	if len(entry) != hashchain.EntryBase64Len {
+		return log.Errorf("replica: entry %d has invalid length", pos)
+	}
+	fp, err := os.OpenFile(filepath.Join(fs.dir, hashchainFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	defer fp.Close()
+	if _, err := fp.WriteString(entry + "\n"); err != nil {
+		return log.Error(err)
+	}
+	if err := fp.Sync(); err != nil {
+		return log.Error(err)
+	}
+	fs.entries = append(fs.entries, entry)
+	fs.size += int64(len(entry) + 1)
+	return nil
+}
+
+// Promoted implements Store.
+func (fs *FileStore) Promoted() (bool, error) {
+	_, err := os.Stat(filepath.Join(fs.dir, promotedFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, log.Error(err)
+	}
+	return true, nil
+}
+
+// Promote implements Store.
+func (fs *FileStore) Promote() error {
+	fp, err := os.OpenFile(filepath.Join(fs.dir, promotedFile),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return log.Error(err)
+	}
+	return fp.Close()
+}
@@ -17,5 +17,16 @@ we might wrap and create errors with log.Warn[f]() instead of log.Error[f](),
 because the server doesn't handle the error himself and passes it on to a
 client. On the client the error is wrapped with log.Error(), because it comes
 from an external source.
+
+Structured log messages carry key-value fields, which are added with
+log.WithFields or log.With. Subsystems can use a named logger (log.Named),
+which prefixes the messages with the subsystem name. With the JSON format (see
+InitFormat) every message is written as one JSON object with the fields as
+keys, so that the logs of daemons can be ingested into log management systems
+like ELK or Loki.
+
+Sensitive values like key material, UID hashes, or message content must be
+wrapped with log.Sensitive, which replaces them by truncated fingerprints in
+the logs (unless unsafe logging has been enabled with SetUnsafe).
 */
 package log
@@ -0,0 +1,311 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// Log output formats (see InitFormat).
+const (
+	FormatText = "text" // one human readable line per message
+	FormatJSON = "json" // one JSON object per message (for ELK, Loki, etc.)
+)
+
+// fieldSep separates the message text from the JSON encoded logger name and
+// fields of structured log messages. It is removed by the formatters.
+const fieldSep = "\x1f"
+
+func init() {
+	seelog.RegisterCustomFormatter("MuteMsg", func(string) seelog.FormatterFunc {
+		return formatText
+	})
+	seelog.RegisterCustomFormatter("MuteJSON", func(cmd string) seelog.FormatterFunc {
+		return func(message string, level seelog.LogLevel, context seelog.LogContextInterface) interface{} {
+			return formatJSON(cmd, message, level, context)
+		}
+	})
+}
+
+// Fields are the key-value pairs of a structured log message.
+type Fields map[string]interface{}
+
+// record is the structured part of a log message.
+type record struct {
+	Name   string `json:"n,omitempty"`
+	Fields Fields `json:"f,omitempty"`
+}
+
+// decode splits message into the text and the structured part (if any).
+func decode(message string) (string, *record) {
+	i := strings.Index(message, fieldSep)
+	if i < 0 {
+		return message, nil
+	}
+	var r record
+	if err := json.Unmarshal([]byte(message[i+len(fieldSep):]), &r); err != nil {
+		return message, nil
+	}
+	return message[:i], &r
+}
+
+// formatValue formats a field value for text output.
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatText formats message as text: "name: message key=value ...".
+func formatText(message string, level seelog.LogLevel, context seelog.LogContextInterface) interface{} {
+	msg, r := decode(message)
+	if r == nil {
+		return msg
+	}
+	if r.Name != "" {
+		msg = r.Name + ": " + msg
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for key := range r.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg += " " + key + "=" + formatValue(r.Fields[key])
+	}
+	return msg
+}
+
+// formatJSON formats message as a JSON object with the keys time, level,
+// cmd, logger (for named loggers), msg, and the fields of the message.
+// Fields which collide with these keys are prefixed with "fields.".
+func formatJSON(
+	cmd, message string,
+	level seelog.LogLevel,
+	context seelog.LogContextInterface,
+) interface{} {
+	obj := make(map[string]interface{})
+	msg, r := decode(message)
+	if r != nil {
+		for key, value := range r.Fields {
+			obj[key] = value
+		}
+	}
+	for _, key := range []string{"time", "level", "cmd", "logger", "msg"} {
+		if value, ok := obj[key]; ok {
+			obj["fields."+key] = value
+			delete(obj, key)
+		}
+	}
+	obj["time"] = context.CallTime().UTC().Format(time.RFC3339Nano)
+	obj["level"] = level.String()
+	if cmd = strings.TrimSpace(cmd); cmd != "" {
+		obj["cmd"] = cmd
+	}
+	if r != nil && r.Name != "" {
+		obj["logger"] = r.Name
+	}
+	obj["msg"] = msg
+	jsn, err := json.Marshal(obj)
+	if err != nil {
+		return strconv.Quote(message)
+	}
+	return string(jsn)
+}
+
+// An Entry is a (named) logger with fields which are added to all messages
+// logged with it. Entries are immutable, WithFields, With, and Named return
+// new entries.
+type Entry struct {
+	name   string
+	fields Fields
+}
+
+// WithFields returns an entry which adds the given fields to all messages.
+func WithFields(fields Fields) *Entry {
+	return new(Entry).WithFields(fields)
+}
+
+// With returns an entry which adds the given key-value pairs to all messages
+// (see Entry.With).
+func With(keyvals ...interface{}) *Entry {
+	return new(Entry).With(keyvals...)
+}
+
+// Named returns a logger for the subsystem with the given name (e.g.,
+// "keyserver"). The name is logged as prefix (text format) or as logger key
+// (JSON format).
+func Named(name string) *Entry {
+	return new(Entry).Named(name)
+}
+
+// WithFields returns a copy of entry e with the given fields added.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	n := &Entry{name: e.name, fields: make(Fields, len(e.fields)+len(fields))}
+	for key, value := range e.fields {
+		n.fields[key] = value
+	}
+	for key, value := range fields {
+		n.fields[key] = value
+	}
+	return n
+}
+
+// With returns a copy of entry e with the given key-value pairs added as
+// fields. Keys which are not strings are formatted with fmt.Sprint, a missing
+// value is logged as "(MISSING)".
+func (e *Entry) With(keyvals ...interface{}) *Entry {
+	fields := make(Fields, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		if i+1 < len(keyvals) {
+			fields[key] = keyvals[i+1]
+		} else {
+			fields[key] = "(MISSING)"
+		}
+	}
+	return e.WithFields(fields)
+}
+
+// Named returns a copy of entry e for the subsystem with the given name.
+// Names of nested subsystems are separated by dots.
+func (e *Entry) Named(name string) *Entry {
+	n := e.WithFields(nil)
+	if e.name != "" {
+		n.name = e.name + "." + name
+	} else {
+		n.name = name
+	}
+	return n
+}
+
+// encode returns msg with the structured part of entry e appended.
+func (e *Entry) encode(msg string) string {
+	fields := make(Fields, len(e.fields))
+	for key, value := range e.fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if _, err := json.Marshal(value); err != nil {
+			value = fmt.Sprint(value)
+		}
+		fields[key] = value
+	}
+	jsn, err := json.Marshal(&record{Name: e.name, Fields: fields})
+	if err != nil {
+		return msg
+	}
+	return msg + fieldSep + string(jsn)
+}
+
+// error returns an error with message msg (prefixed with the name of e).
+func (e *Entry) error(msg string) error {
+	if e.name != "" {
+		msg = e.name + ": " + msg
+	}
+	return errors.New(msg)
+}
+
+// Critical logs the message with log level = Critical (see Critical).
+func (e *Entry) Critical(v ...interface{}) error {
+	if len(v) == 1 {
+		if err, ok := v[0].(error); ok {
+			logger.Critical(e.encode(err.Error()))
+			return err
+		}
+	}
+	msg := fmt.Sprint(v...)
+	logger.Critical(e.encode(msg))
+	return e.error(msg)
+}
+
+// Criticalf logs the message with log level = Critical (see Criticalf).
+func (e *Entry) Criticalf(format string, params ...interface{}) error {
+	msg := fmt.Sprintf(format, params...)
+	logger.Critical(e.encode(msg))
+	return e.error(msg)
+}
+
+// Error logs the message with log level = Error (see Error).
+func (e *Entry) Error(v ...interface{}) error {
+	if len(v) == 1 {
+		if err, ok := v[0].(error); ok {
+			logger.Error(e.encode(err.Error()))
+			return err
+		}
+	}
+	msg := fmt.Sprint(v...)
+	logger.Error(e.encode(msg))
+	return e.error(msg)
+}
+
+// Errorf logs the message with log level = Error (see Errorf).
+func (e *Entry) Errorf(format string, params ...interface{}) error {
+	msg := fmt.Sprintf(format, params...)
+	logger.Error(e.encode(msg))
+	return e.error(msg)
+}
+
+// Warn logs the message with log level = Warn (see Warn).
+func (e *Entry) Warn(v ...interface{}) error {
+	if len(v) == 1 {
+		if err, ok := v[0].(error); ok {
+			logger.Warn(e.encode(err.Error()))
+			return err
+		}
+	}
+	msg := fmt.Sprint(v...)
+	logger.Warn(e.encode(msg))
+	return e.error(msg)
+}
+
+// Warnf logs the message with log level = Warn (see Warnf).
+func (e *Entry) Warnf(format string, params ...interface{}) error {
+	msg := fmt.Sprintf(format, params...)
+	logger.Warn(e.encode(msg))
+	return e.error(msg)
+}
+
+// Info logs the message with log level = Info.
+func (e *Entry) Info(v ...interface{}) {
+	logger.Info(e.encode(fmt.Sprint(v...)))
+}
+
+// Infof logs the message with log level = Info.
+func (e *Entry) Infof(format string, params ...interface{}) {
+	logger.Info(e.encode(fmt.Sprintf(format, params...)))
+}
+
+// Debug logs the message with log level = Debug.
+func (e *Entry) Debug(v ...interface{}) {
+	logger.Debug(e.encode(fmt.Sprint(v...)))
+}
+
+// Debugf logs the message with log level = Debug.
+func (e *Entry) Debugf(format string, params ...interface{}) {
+	logger.Debug(e.encode(fmt.Sprintf(format, params...)))
+}
+
+// Trace logs the message with log level = Trace.
+func (e *Entry) Trace(v ...interface{}) {
+	logger.Trace(e.encode(fmt.Sprint(v...)))
+}
+
+// Tracef logs the message with log level = Trace.
+func (e *Entry) Tracef(format string, params ...interface{}) {
+	logger.Trace(e.encode(fmt.Sprintf(format, params...)))
+}
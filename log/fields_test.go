@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cihub/seelog"
+)
+
+func TestFieldsText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SetLogWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	defer UseLogger(seelog.Disabled)
+	log := Named("keyserver").With("domain", "mute.berlin", "count", 3)
+	log.Infof("registered %s", "alice")
+	err := log.Named("hashchain").WithFields(Fields{"msg": "a b"}).Errorf("sync failed")
+	if err.Error() != "keyserver.hashchain: sync failed" {
+		t.Errorf("wrong error: %s", err)
+	}
+	Info("plain")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of lines: %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "[Info] keyserver: registered alice count=3 domain=mute.berlin") {
+		t.Errorf("wrong line: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `[Error] keyserver.hashchain: sync failed count=3 domain=mute.berlin msg="a b"`) {
+		t.Errorf("wrong line: %s", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "[Info] plain") {
+		t.Errorf("wrong line: %s", lines[2])
+	}
+}
+
+func TestFieldsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := seelog.LoggerFromWriterWithMinLevelAndFormat(&buf,
+		seelog.TraceLvl, "%MuteJSON(keysd)%n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseLogger(logger)
+	defer UseLogger(seelog.Disabled)
+	testErr := errors.New("boom")
+	Named("accd").WithFields(Fields{"level": 1, "err": testErr}).Warn("payment failed")
+	Debugf("100%% plain")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of lines: %q", lines)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &obj); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":        "warn",
+		"cmd":          "keysd",
+		"logger":       "accd",
+		"msg":          "payment failed",
+		"err":          "boom",
+		"fields.level": float64(1),
+	}
+	for key, value := range expected {
+		if obj[key] != value {
+			t.Errorf("%s = %v, expected %v", key, obj[key], value)
+		}
+	}
+	if _, ok := obj["time"]; !ok {
+		t.Error("time missing")
+	}
+	obj = nil
+	if err := json.Unmarshal([]byte(lines[1]), &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj["msg"] != "100% plain" || obj["level"] != "debug" {
+		t.Errorf("wrong object: %v", obj)
+	}
+	if _, ok := obj["logger"]; ok {
+		t.Error("plain message should not have a logger")
+	}
+}
+
+func TestWithMissingValue(t *testing.T) {
+	e := With("a", 1, 2)
+	if e.fields["a"] != 1 || e.fields["2"] != "(MISSING)" {
+		t.Errorf("wrong fields: %v", e.fields)
+	}
+}
+
+func TestInitFormat(t *testing.T) {
+	defer UseLogger(seelog.Disabled)
+	if err := InitFormat("info", "test ", "", false, "xml"); err == nil {
+		t.Error("invalid format should fail")
+	}
+	if err := InitFormat("info", "test ", "", true, FormatJSON); err != nil {
+		t.Error(err)
+	}
+}
@@ -30,25 +30,68 @@ func init() {
 // If the given level is invalid or the initialization fails, an
 // error is returned.
 func Init(logLevel, cmdPrefix, logDir string, logToConsole bool) error {
+	return InitFormat(logLevel, cmdPrefix, logDir, logToConsole, FormatText)
+}
+
+// InitFormat initializes the Mute logging framework like Init, but writes the
+// log messages in the given format (FormatText or FormatJSON).
+func InitFormat(logLevel, cmdPrefix, logDir string, logToConsole bool, format string) error {
 	// check level string
 	_, found := seelog.LogLevelFromString(logLevel)
 	if !found {
 		return fmt.Errorf("log: level '%s' is invalid", logLevel)
 	}
+	// check format
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("log: format '%s' is invalid", format)
+	}
 	// check cmdPrefix
 	if len(cmdPrefix) != 5 {
 		return fmt.Errorf("len(cmdPrefix) must be 5: %q", cmdPrefix)
 	}
 	// create logger
+	s := &settings{
+		level:     logLevel,
+		cmdPrefix: cmdPrefix,
+		logDir:    logDir,
+		console:   logToConsole,
+		format:    format,
+	}
+	mutex.Lock()
+	err := s.apply(rotation)
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	// log info about running binary
+	Infof("%s started (built with %s %s for %s/%s)", os.Args[0], runtime.Compiler, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// newLogger returns a new logger for the settings s and the given log
+// rotation.
+func (s *settings) newLogger(r Rotation) (seelog.LoggerInterface, error) {
+	var msgFormat string
+	if s.format == FormatJSON {
+		msgFormat = fmt.Sprintf("%%MuteJSON(%s)%%n", strings.TrimSpace(s.cmdPrefix))
+	} else {
+		msgFormat = fmt.Sprintf("%%UTCDate %%UTCTime [%s] [%%LEV] %%MuteMsg%%n", s.cmdPrefix)
+	}
 	console := "<console />"
-	if !logToConsole {
+	if !s.console {
 		console = ""
 	}
 	var file string
-	if logDir != "" {
+	if s.logDir != "" {
 		execBase := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
-		file = fmt.Sprintf("<rollingfile type=\"size\" filename=%q maxsize=\"10485760\" maxrolls=\"3\" />",
-			filepath.Join(logDir, execBase+".log"))
+		filename := filepath.Join(s.logDir, execBase+".log")
+		if r.Period == RotateDaily {
+			file = fmt.Sprintf("<rollingfile type=\"date\" filename=%q datepattern=\"2006-01-02\" maxrolls=\"%d\" />",
+				filename, r.MaxRolls)
+		} else {
+			file = fmt.Sprintf("<rollingfile type=\"size\" filename=%q maxsize=\"%d\" maxrolls=\"%d\" />",
+				filename, r.MaxSize, r.MaxRolls)
+		}
 	}
 	config := `
 <seelog type="adaptive" mininterval="2000000" maxinterval="100000000"
@@ -58,20 +101,16 @@ func Init(logLevel, cmdPrefix, logDir string, logToConsole bool) error {
 		%s
 	</outputs>
 	<formats>
-		<format id="all" format="%%UTCDate %%UTCTime [%s] [%%LEV] %%Msg%%n" />
+		<format id="all" format="%s" />
 	</formats>
 </seelog>`
-	config = fmt.Sprintf(config, logLevel, console, file, cmdPrefix)
+	config = fmt.Sprintf(config, s.level, console, file, msgFormat)
 	logger, err := seelog.LoggerFromConfigAsString(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logger.SetAdditionalStackDepth(1)
-	// replace logger
-	UseLogger(logger)
-	// log info about running binary
-	Infof("%s started (built with %s %s for %s/%s)", os.Args[0], runtime.Compiler, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-	return nil
+	return logger, nil
 }
 
 // Flush flushes all the messages in the logger.
@@ -186,7 +225,8 @@ func SetLogWriter(writer io.Writer) error {
 		return errors.New("Nil writer")
 	}
 
-	newLogger, err := seelog.LoggerFromWriterWithMinLevel(writer, seelog.TraceLvl)
+	newLogger, err := seelog.LoggerFromWriterWithMinLevelAndFormat(writer,
+		seelog.TraceLvl, "%Ns [%Level] %MuteMsg%n")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cihub/seelog"
+)
+
+// Log rotation periods.
+const (
+	RotateSize  = "size"  // rotate when the log file exceeds the maximum size
+	RotateDaily = "daily" // rotate once a day
+)
+
+// Rotation defines the rotation of the log file in the log directory.
+type Rotation struct {
+	Period   string // RotateSize or RotateDaily
+	MaxSize  int64  // maximum size of the log file in bytes (for RotateSize)
+	MaxRolls int    // number of rotated log files to keep
+}
+
+// DefaultRotation is the default log rotation: files are rotated after 10MB
+// and three rotated files are kept.
+var DefaultRotation = Rotation{
+	Period:   RotateSize,
+	MaxSize:  10 * 1024 * 1024,
+	MaxRolls: 3,
+}
+
+// settings are the settings of an initialized logging framework.
+type settings struct {
+	level     string
+	cmdPrefix string
+	logDir    string
+	console   bool
+	format    string
+}
+
+var (
+	mutex    sync.Mutex
+	current  *settings // nil, if Init has not been called
+	rotation = DefaultRotation
+)
+
+// apply replaces the logger with a new one for settings s and rotation r.
+// Must be called with mutex held.
+func (s *settings) apply(r Rotation) error {
+	newLogger, err := s.newLogger(r)
+	if err != nil {
+		return err
+	}
+	oldLogger := logger
+	UseLogger(newLogger)
+	oldLogger.Flush()
+	oldLogger.Close()
+	current = s
+	rotation = r
+	return nil
+}
+
+// SetRotation sets the rotation of the log file. If the logging framework has
+// already been initialized, the log file is reopened with the new rotation.
+func SetRotation(r Rotation) error {
+	switch r.Period {
+	case RotateSize:
+		if r.MaxSize <= 0 {
+			return fmt.Errorf("log: maximum size %d is invalid", r.MaxSize)
+		}
+	case RotateDaily:
+	default:
+		return fmt.Errorf("log: rotation period '%s' is invalid", r.Period)
+	}
+	if r.MaxRolls < 1 {
+		return fmt.Errorf("log: number of rotated files %d is invalid", r.MaxRolls)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		rotation = r
+		return nil
+	}
+	return current.apply(r)
+}
+
+// SetLevel changes the logging level of the initialized logging framework at
+// runtime.
+func SetLevel(logLevel string) error {
+	if _, found := seelog.LogLevelFromString(logLevel); !found {
+		return fmt.Errorf("log: level '%s' is invalid", logLevel)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		return fmt.Errorf("log: not initialized")
+	}
+	if current.level == logLevel {
+		return nil
+	}
+	s := *current
+	s.level = logLevel
+	if err := s.apply(rotation); err != nil {
+		return err
+	}
+	logger.Infof("log level set to %s", logLevel)
+	return nil
+}
+
+// Level returns the logging level of the initialized logging framework (or
+// the empty string, if it has not been initialized).
+func Level() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		return ""
+	}
+	return current.level
+}
+
+// Reopen reopens the log file (for example, on SIGHUP after the log file has
+// been moved by an external log rotation).
+func Reopen() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		return nil
+	}
+	return current.apply(rotation)
+}
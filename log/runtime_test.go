@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readLogs(t *testing.T, dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs string
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs += string(buf)
+	}
+	return logs
+}
+
+func TestSetLevel(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "log_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer SetRotation(DefaultRotation)
+	if err := InitFormat("info", "test ", tmpdir, false, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	if level := Level(); level != "info" {
+		t.Errorf("Level() = %s, expected info", level)
+	}
+	Debug("hidden debug message")
+	if err := SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if level := Level(); level != "debug" {
+		t.Errorf("Level() = %s, expected debug", level)
+	}
+	Debug("visible debug message")
+	if err := SetLevel("verbose"); err == nil {
+		t.Error("invalid level should fail")
+	}
+	err = SetRotation(Rotation{Period: RotateDaily, MaxRolls: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Info("rotated daily")
+	if err := Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Flush()
+	logs := readLogs(t, tmpdir)
+	if strings.Contains(logs, "hidden debug message") {
+		t.Error("debug message logged with level info")
+	}
+	for _, msg := range []string{"visible debug message", "rotated daily"} {
+		if !strings.Contains(logs, msg) {
+			t.Errorf("message '%s' missing in logs", msg)
+		}
+	}
+}
+
+func TestSetRotationErrors(t *testing.T) {
+	for _, r := range []Rotation{
+		{Period: "weekly", MaxRolls: 1},
+		{Period: RotateSize, MaxSize: 0, MaxRolls: 1},
+		{Period: RotateDaily, MaxRolls: 0},
+	} {
+		if err := SetRotation(r); err == nil {
+			t.Errorf("SetRotation(%+v) should fail", r)
+		}
+	}
+}
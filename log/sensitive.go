@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+// unsafe is 1, if sensitive values are logged unredacted.
+var unsafe int32
+
+// SetUnsafe enables or disables the logging of unredacted sensitive values
+// (see Sensitive). It should only be enabled for debugging.
+func SetUnsafe(enable bool) {
+	if enable {
+		atomic.StoreInt32(&unsafe, 1)
+	} else {
+		atomic.StoreInt32(&unsafe, 0)
+	}
+}
+
+// Unsafe reports whether sensitive values are logged unredacted.
+func Unsafe() bool {
+	return atomic.LoadInt32(&unsafe) == 1
+}
+
+// sensitive is a value which is redacted when it is formatted.
+type sensitive struct {
+	v interface{}
+}
+
+// Sensitive marks v (like key material, UID hashes, or message content) as
+// sensitive. When formatted, v is replaced by a truncated fingerprint (the
+// first 4 bytes of its SHA-256 hash), which still allows to correlate log
+// messages. With SetUnsafe(true) v is formatted unredacted.
+func Sensitive(v interface{}) fmt.Stringer {
+	return &sensitive{v}
+}
+
+// String implements the fmt.Stringer interface.
+func (s *sensitive) String() string {
+	var buf []byte
+	switch v := s.v.(type) {
+	case []byte:
+		buf = v
+	case string:
+		buf = []byte(v)
+	default:
+		buf = []byte(fmt.Sprint(v))
+	}
+	if Unsafe() {
+		if b, ok := s.v.([]byte); ok {
+			return fmt.Sprintf("%x", b)
+		}
+		return string(buf)
+	}
+	h := sha256.Sum256(buf)
+	return "redacted:" + hex.EncodeToString(h[:4])
+}
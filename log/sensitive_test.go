@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSensitive(t *testing.T) {
+	defer SetUnsafe(false)
+	key := "jhtCbQpD0z0bUOfvk6w2BybEY8E0m5LvJZ2hXGBsdMk="
+	s := fmt.Sprintf("key=%s", Sensitive(key))
+	if strings.Contains(s, key) {
+		t.Errorf("sensitive value not redacted: %s", s)
+	}
+	if !strings.HasPrefix(s, "key=redacted:") || len(s) != len("key=redacted:")+8 {
+		t.Errorf("wrong fingerprint: %s", s)
+	}
+	// fingerprints allow correlation
+	if Sensitive(key).String() != Sensitive(key).String() {
+		t.Error("fingerprints differ")
+	}
+	if Sensitive(key).String() == Sensitive("other").String() {
+		t.Error("fingerprints should differ")
+	}
+	if Sensitive([]byte(key)).String() != Sensitive(key).String() {
+		t.Error("fingerprints of string and []byte differ")
+	}
+	SetUnsafe(true)
+	if !Unsafe() {
+		t.Error("Unsafe() should be true")
+	}
+	if s := Sensitive(key).String(); s != key {
+		t.Errorf("unsafe value = %s, expected %s", s, key)
+	}
+	if s := Sensitive([]byte{0xca, 0xfe}).String(); s != "cafe" {
+		t.Errorf("unsafe value = %s, expected cafe", s)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 
 	"crypto/ed25519"
+	"github.com/mutecomm/mute/keyserver/admission"
 	"github.com/mutecomm/mute/serviceguard/common/walletauth"
 	"github.com/mutecomm/mute/util/times"
 )
@@ -20,8 +21,33 @@ func splitKey(privkey *[ed25519.PrivateKeySize]byte) (pubkey *[ed25519.PublicKey
 }
 
 // PayAccount makes a pay call to server (or selects a new one) to create or
-// extend an account identified by privkey.
-func PayAccount(privkey *[ed25519.PrivateKeySize]byte, paytoken []byte, serverKnown string, cacert []byte) (server string, err error) {
+// extend an account identified by privkey. The invitation code is only
+// required for new accounts, if the account server demands it. If
+// AccountPoWBits is set a proof-of-work is computed for new accounts.
+func PayAccount(privkey *[ed25519.PrivateKeySize]byte, paytoken []byte, serverKnown, invitation string, cacert []byte) (server string, err error) {
+	if serverKnown == "" {
+		return PayNewAccount(privkey, paytoken, "", invitation, cacert)
+	}
+	return payAccountRetry(privkey, paytoken, serverKnown, invitation, "", cacert)
+}
+
+// PayNewAccount makes a pay call to the account server round-robin
+// accountServer (DefaultAccountServer, if empty) to create a new account
+// identified by privkey. This allows to create accounts in other service
+// domains than the default one.
+func PayNewAccount(privkey *[ed25519.PrivateKeySize]byte, paytoken []byte, accountServer, invitation string, cacert []byte) (server string, err error) {
+	var proof string
+	if AccountPoWBits > 0 {
+		pubkey := splitKey(privkey)
+		proof, err = admission.ProofOfWork(pubkey[:], AccountPoWBits)
+		if err != nil {
+			return "", err
+		}
+	}
+	return payAccountRetry(privkey, paytoken, accountServer, invitation, proof, cacert)
+}
+
+func payAccountRetry(privkey *[ed25519.PrivateKeySize]byte, paytoken []byte, serverKnown, invitation, proof string, cacert []byte) (server string, err error) {
 	var authtoken []byte
 	lastcounter := uint64(times.NowNano())
 	pubkey := splitKey(privkey)
@@ -31,7 +57,8 @@ CallLoop:
 		if authtoken == nil {
 			authtoken = walletauth.CreateToken(pubkey, privkey, lastcounter+1)
 		}
-		server, lastcounter, err = payAccount(authtoken, paytoken, serverKnown, cacert)
+		server, lastcounter, err = payAccount(authtoken, paytoken, serverKnown,
+			invitation, proof, cacert)
 		if err == walletauth.ErrReplay {
 			authtoken = nil
 			if i > 0 {
@@ -44,13 +71,13 @@ CallLoop:
 	return server, err
 }
 
-func payAccount(authtoken, paytoken []byte, serverKnown string, cacert []byte) (server string, lastcounter uint64, err error) {
+func payAccount(authtoken, paytoken []byte, serverKnown, invitation, proof string, cacert []byte) (server string, lastcounter uint64, err error) {
 	var ServerT string
 	var ok bool
 	method := "AccountServer.LoadAccount"
 	url := DefaultAccountServer
-	if server != "" {
-		url = server
+	if serverKnown != "" {
+		url = serverKnown
 	}
 	url = "https://" + url + ":" + RPCPort + "/account"
 	client, err := DefaultClientFactory(url, cacert)
@@ -60,11 +87,15 @@ func payAccount(authtoken, paytoken []byte, serverKnown string, cacert []byte) (
 	authtokenEnc := base64.StdEncoding.EncodeToString(authtoken)
 	paytokenEnc := base64.StdEncoding.EncodeToString(paytoken)
 	data, err := client.JSONRPCRequest(method, struct {
-		AuthToken string
-		PayToken  string
+		AuthToken   string
+		PayToken    string
+		Invitation  string `json:",omitempty"`
+		ProofOfWork string `json:",omitempty"`
 	}{
-		AuthToken: authtokenEnc,
-		PayToken:  paytokenEnc,
+		AuthToken:   authtokenEnc,
+		PayToken:    paytokenEnc,
+		Invitation:  invitation,
+		ProofOfWork: proof,
 	})
 	if err != nil {
 		LastCounter, err := walletauth.IsReplay(err)
@@ -10,6 +10,7 @@ import (
 	"github.com/mutecomm/mute/mix/mixcrypt"
 	"github.com/mutecomm/mute/mix/nymaddr"
 	"github.com/mutecomm/mute/mix/smtpclient"
+	sgclient "github.com/mutecomm/mute/serviceguard/client"
 	"github.com/mutecomm/mute/util/jsonclient"
 )
 
@@ -37,6 +38,14 @@ var DefaultClientFactory = jsonclient.New
 // DefaultAccountServer is the URL of the account server round-robin.
 var DefaultAccountServer = "rr.accounts.mute.one"
 
+// AccountInvitation defines whether the account server requires an invitation
+// code for new accounts.
+var AccountInvitation = false
+
+// AccountPoWBits is the proof-of-work difficulty required by the account
+// server for new accounts (0 for none).
+var AccountPoWBits = 0
+
 // DefaultSender is the sender address for client messages.
 var DefaultSender = "client@mute.one"
 
@@ -61,10 +70,14 @@ func init() {
 	registerError(mixcrypt.ErrTooShort)
 	registerError(mixcrypt.ErrSize)
 	registerError(mixcrypt.ErrBadSystem)
+	registerError(mixcrypt.ErrUnknownMix)
+	registerError(mixcrypt.ErrBadSignature)
 
 	registerError(nymaddr.ErrNoMix)
 	registerError(nymaddr.ErrNoKey)
 	registerError(nymaddr.ErrExpired)
 	registerError(nymaddr.ErrHMAC)
 	registerError(nymaddr.ErrBadKey)
+
+	registerError(sgclient.ErrFinal)
 }
@@ -17,6 +17,7 @@ import (
 
 	"github.com/mutecomm/mute/mix/mixaddr"
 	"github.com/mutecomm/mute/mix/smtpclient"
+	"github.com/mutecomm/mute/util/netproxy"
 )
 
 // GetMixAddress is used to get the address of a mix rpc. It should only be
@@ -34,7 +35,7 @@ func getMixAddressReal(mixaddress string) (string, error) {
 }
 
 func getHTTPClient(cacert []byte) *http.Client {
-	tr := &http.Transport{}
+	tr := netproxy.NewTransport()
 	if cacert != nil {
 		tr.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
 		tr.TLSClientConfig.RootCAs.AppendCertsFromPEM(cacert)
@@ -109,12 +109,14 @@ func TestSendReceiveForward(t *testing.T) {
 }
 
 func TestSendReceiveRelay(t *testing.T) {
-	_, privkey, _ := ed25519.GenerateKey(rand.Reader)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	var privkey [ed25519.PrivateKeySize]byte
+	copy(privkey[:], key)
 	mixAddress := "mix01@mute.berlin"
 	recAddress := "mailbox001@001."
 	pseudonym := []byte("Pseudonym001")
 	pseudoHash := sha256.Sum256(pseudonym)
-	kl := mixaddr.New(privkey, mixAddress, 7200, 24*3600, "/tmp/mixkeydir")
+	kl := mixaddr.New(&privkey, mixAddress, 7200, 24*3600, "/tmp/mixkeydir")
 	kl.AddKey()
 	stmt := kl.GetStatement()
 	// AddressTemplate contains parameters for address creation
@@ -180,4 +182,41 @@ func TestSendReceiveRelay(t *testing.T) {
 	if !bytes.Equal(decMessage, testMessage) {
 		t.Error("Message decryption failed")
 	}
+	// unsigned relay messages are passed through
+	mixKeys := [][]byte{stmt.PublicKey}
+	unsigned, signed, err := VerifyRelay(mixKeys, newMessage)
+	if err != nil || signed {
+		t.Errorf("VerifyRelay should accept unsigned message: %v", err)
+	}
+	if !bytes.Equal(unsigned, newMessage) {
+		t.Error("VerifyRelay changed unsigned message")
+	}
+	// signed relay messages
+	signedMessage, _, err := receiveData.SendSigned(&privkey)
+	if err != nil {
+		t.Fatalf("SendSigned: %s", err)
+	}
+	verified, signed, err := VerifyRelay(mixKeys, signedMessage)
+	if err != nil {
+		t.Fatalf("VerifyRelay: %s", err)
+	}
+	if !signed {
+		t.Error("VerifyRelay should detect signed message")
+	}
+	decMessage, _, err = ReceiveFromMix(addressTemplate, []byte(recAddress), verified)
+	if err != nil {
+		t.Fatalf("ReceiveFromMix: %s", err)
+	}
+	if !bytes.Equal(decMessage, testMessage) {
+		t.Error("Message decryption failed")
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if _, _, err := VerifyRelay([][]byte{otherKey[32:]}, signedMessage); err != ErrUnknownMix {
+		t.Errorf("VerifyRelay should fail with ErrUnknownMix: %v", err)
+	}
+	spoofed := append([]byte{}, signedMessage...)
+	spoofed[10] ^= 0x01
+	if _, _, err := VerifyRelay(mixKeys, spoofed); err != ErrBadSignature {
+		t.Errorf("VerifyRelay should fail with ErrBadSignature: %v", err)
+	}
 }
@@ -5,6 +5,7 @@
 package mixcrypt
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
 
@@ -33,6 +34,10 @@ var (
 	ErrSize = errors.New("mixcrypt: message out of bounds")
 	// ErrBadSystem is returned if a message for a wrong system was received
 	ErrBadSystem = errors.New("mixcrypt: bad system")
+	// ErrUnknownMix is returned if a relay message was signed by an unknown mix
+	ErrUnknownMix = errors.New("mixcrypt: relay message signed by unknown mix")
+	// ErrBadSignature is returned if the signature of a relay message is invalid
+	ErrBadSignature = errors.New("mixcrypt: bad relay message signature")
 )
 
 // MuteSystemDomain is the domain of the Mute System.
@@ -47,6 +52,17 @@ var timeNow = func() int64 { return times.Now() }
 // KeySize is the size of a public/private key.
 const KeySize = 32
 
+// RelaySignatureMarker marks signed relay messages. It is appended after the
+// public mix key and the signature and contains the version of the signature
+// format in its last byte, so that clients can distinguish signed from unsigned
+// relay messages (which are still accepted).
+var RelaySignatureMarker = []byte{'M', 'U', 'T', 'E', 'R', 'S', 'I', 1}
+
+// RelaySignatureSize is the size of the public mix key, the signature, and the
+// marker appended to signed relay messages.
+var RelaySignatureSize = ed25519.PublicKeySize + ed25519.SignatureSize +
+	len(RelaySignatureMarker)
+
 const (
 	// MessageTypeForward is a message that is forwarded to another mix
 	MessageTypeForward = 1 + iota
@@ -5,6 +5,8 @@
 package mixcrypt
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/binary"
 
@@ -19,6 +21,58 @@ func (rs ReceiveStruct) Send() ([]byte, string, error) {
 	return rs.Message, string(rs.MixHeader.Address), nil
 }
 
+// SendSigned processes a ReceiveStruct like Send, but relay messages are
+// signed with the private mix key privateKey (see VerifyRelay).
+func (rs ReceiveStruct) SendSigned(privateKey *[ed25519.PrivateKeySize]byte) ([]byte, string, error) {
+	message, address, err := rs.Send()
+	if err != nil || rs.MixHeader.MessageType != MessageTypeRelay {
+		return message, address, err
+	}
+	return signRelay(privateKey, message), address, nil
+}
+
+// signRelay appends the public mix key, a signature over msg, and the
+// RelaySignatureMarker to msg.
+func signRelay(privateKey *[ed25519.PrivateKeySize]byte, msg []byte) []byte {
+	sig := ed25519.Sign(privateKey[:], msg)
+	signed := make([]byte, 0, len(msg)+RelaySignatureSize)
+	signed = append(signed, msg...)
+	signed = append(signed, privateKey[ed25519.PrivateKeySize-ed25519.PublicKeySize:]...)
+	signed = append(signed, sig...)
+	return append(signed, RelaySignatureMarker...)
+}
+
+// VerifyRelay verifies that the relay message msg has been signed by one of
+// the mixes with the given public keys and returns the message without the
+// signature, to be processed by ReceiveFromMix.
+// Relay messages without RelaySignatureMarker are unsigned, they are returned
+// unchanged with signed set to false.
+func VerifyRelay(mixKeys [][]byte, msg []byte) (message []byte, signed bool, err error) {
+	if !bytes.HasSuffix(msg, RelaySignatureMarker) {
+		return msg, false, nil
+	}
+	if len(msg) < RelaySignatureSize+2 {
+		return nil, true, ErrTooShort
+	}
+	message = msg[:len(msg)-RelaySignatureSize]
+	pubKey := msg[len(message) : len(message)+ed25519.PublicKeySize]
+	sig := msg[len(message)+ed25519.PublicKeySize : len(msg)-len(RelaySignatureMarker)]
+	known := false
+	for _, key := range mixKeys {
+		if bytes.Equal(key, pubKey) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return message, true, ErrUnknownMix
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubKey), message, sig) {
+		return message, true, ErrBadSignature
+	}
+	return message, true, nil
+}
+
 // sendRelay treats Receivestruct as input for a relay (mix -> client) message
 func (rs ReceiveStruct) sendRelay() ([]byte, string, error) {
 	headerContent, secret, err := rs.NymAddressPrivate.GetHeader()
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/mutecomm/mute/util/netproxy"
 	"github.com/mutecomm/mute/util/times"
 )
 
@@ -32,11 +33,16 @@ var (
 	ErrRetry = errors.New("smtpclient: retry")
 )
 
-// LookupMX returns the primary MX for a domain
+// LookupMX returns the primary MX for a domain. If connections to domain are
+// routed through a proxy (see netproxy), no MX lookup is performed to avoid
+// DNS leaks and the domain itself is returned (it is resolved by the proxy).
 func LookupMX(domain string) string {
 	if domain == "" {
 		return ""
 	}
+	if netproxy.Proxied(domain) {
+		return domain
+	}
 	mx, err := net.LookupMX(domain)
 	if err != nil {
 		return domain
@@ -119,8 +125,14 @@ func (mc *MailClient) SendMail(to, from string, mail []byte) error {
 		return ErrFinal
 	}
 	address := host + ":" + strconv.Itoa(mc.Port)
-	client, err := smtp.Dial(address)
+	conn, err := netproxy.Dial("tcp", address)
+	if err != nil {
+		mc.parseError(err)
+		return ErrRetry
+	}
+	client, err := smtp.NewClient(conn, host)
 	if err != nil {
+		conn.Close()
 		mc.parseError(err)
 		return ErrRetry
 	}
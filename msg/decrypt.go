@@ -10,6 +10,7 @@ import (
 	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha512"
+	"hash"
 	"io"
 
 	"github.com/mutecomm/mute/cipher"
@@ -37,10 +38,10 @@ func rootKeyAgreementRecipient(
 	senderSessionPub := senderSession.PublicKey32()
 	senderIdentityPub := senderID.PublicKey32()
 
-	log.Debugf("senderIdentityPub:    %s", base64.Encode(senderIdentityPub[:]))
-	log.Debugf("senderSessionPub:     %s", base64.Encode(senderSessionPub[:]))
-	log.Debugf("recipientIdentityPub: %s", base64.Encode(recipientIdentityPub[:]))
-	log.Debugf("recipientKeyInitPub:  %s", base64.Encode(recipientKeyInitPub[:]))
+	log.Debugf("senderIdentityPub:    %s", log.Sensitive(base64.Encode(senderIdentityPub[:])))
+	log.Debugf("senderSessionPub:     %s", log.Sensitive(base64.Encode(senderSessionPub[:])))
+	log.Debugf("recipientIdentityPub: %s", log.Sensitive(base64.Encode(recipientIdentityPub[:])))
+	log.Debugf("recipientKeyInitPub:  %s", log.Sensitive(base64.Encode(recipientKeyInitPub[:])))
 
 	// check keys to prevent reflection attacks and replays
 	err := checkKeys(senderHeaderPub, senderIdentityPub, senderSessionPub,
@@ -99,6 +100,15 @@ type DecryptArgs struct {
 // If the message was signed and the signature could be verified successfully
 // the base64 encoded signature is returned. If the message was signed and the
 // signature could not be verfied an error is returned.
+// Streamed messages (see EncryptArgs.Stream) are decrypted with constant
+// memory, the content is written to args.Writer chunk by chunk and must be
+// discarded if an error is returned.
+// If the message belongs to an unknown session, ErrSessionUnknown is returned
+// together with the senderID. The message cannot be decrypted and the session
+// has to be restarted by encrypting a message to the sender with StatusReset.
+// Single-use KeyInit messages are deleted after the first successful
+// decryption, messages which start another session with them are rejected
+// with ErrKeyInitReused.
 func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 	log.Debug("msg.Decrypt()")
 
@@ -131,25 +141,24 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		return "", "", log.Error(ErrWrongCount)
 	}
 	count++
-	identity, h, err := readHeader(&senderHeaderPub, args.Identities,
+	identity, recipientID, h, err := readHeader(&senderHeaderPub, args.Identities,
 		bytes.NewBuffer(oh.inner))
 	if err != nil {
 		return "", "", err
 	}
 	senderID = h.SenderIdentity
-	recipientID := identity.PubKey()
 
-	log.Debugf("senderID:    %s", h.SenderIdentityPub.HASH)
-	log.Debugf("recipientID: %s", recipientID.HASH)
+	log.Debugf("senderID:    %s", log.Sensitive(h.SenderIdentityPub.HASH))
+	log.Debugf("recipientID: %s", log.Sensitive(recipientID.HASH))
 	log.Debugf("h.SenderSessionCount: %d", h.SenderSessionCount)
 	log.Debugf("h.SenderMessageCount: %d", h.SenderMessageCount)
-	log.Debugf("h.SenderSessionPub:             %s", h.SenderSessionPub.HASH)
+	log.Debugf("h.SenderSessionPub:             %s", log.Sensitive(h.SenderSessionPub.HASH))
 	if h.NextSenderSessionPub != nil {
-		log.Debugf("h.NextSenderSessionPub:         %s", h.NextSenderSessionPub.HASH)
+		log.Debugf("h.NextSenderSessionPub:         %s", log.Sensitive(h.NextSenderSessionPub.HASH))
 	}
 	if h.NextRecipientSessionPubSeen != nil {
 		log.Debugf("h.NextRecipientSessionPubSeen:  %s",
-			h.NextRecipientSessionPubSeen.HASH)
+			log.Sensitive(h.NextRecipientSessionPubSeen.HASH))
 	}
 
 	// proc sender UID in parallel
@@ -169,9 +178,13 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 	sessionKey := session.CalcKey(recipientID.HASH, h.SenderIdentityPub.HASH,
 		h.RecipientTempHash, h.SenderSessionPub.HASH)
 
+	var usedKeyInit string
 	if !args.KeyStore.HasSession(sessionKey) { // session unknown
 		// try to start session from KeyInit message
 		recipientKI, err := args.KeyStore.GetPrivateKeyEntry(h.RecipientTempHash)
+		if err == session.ErrKeyEntryUsed {
+			return "", "", log.Error(ErrKeyInitReused)
+		}
 		if err != nil && err != session.ErrNoKeyEntry {
 			return "", "", err
 		}
@@ -184,11 +197,14 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 				return "", "", err
 			}
 
-			// TODO: delete single-use KeyInit message
+			// delete single-use KeyInit message after successful decryption
+			usedKeyInit = h.RecipientTempHash
 
-			// use the 'smaller' session as the definite one
+			// use the 'smaller' session as the definite one, unless the
+			// sender restarted the session (see ErrSessionUnknown)
 			// TODO: h.SenderSessionPub.HASH < ss.SenderSessionPub.HASH
-			if ss == nil || (ss.KeyInitSession && sender < recipient) {
+			if ss == nil || h.Status == StatusReset ||
+				(ss.KeyInitSession && sender < recipient) {
 				// create next session key
 				var nextSenderSession uid.KeyEntry
 				if err := nextSenderSession.InitDHKey(args.Rand); err != nil {
@@ -232,7 +248,9 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 				}
 			}
 		} else { // no KeyInit message found
-			// TODO: ???
+			// the caller has to keep the message and restart the session by
+			// sending a StatusReset message to the sender
+			return senderID, "", log.Error(ErrSessionUnknown)
 		}
 	} else { // session known
 		log.Debug("session known")
@@ -373,8 +391,10 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 			recipientPub = ss.SenderSessionPub.PublicKey32()
 		} else {
 			log.Debug("different session")
+			// the public key of used single-use KeyInits is still available
 			recipientKI, err := args.KeyStore.GetPrivateKeyEntry(h.RecipientTempHash)
-			if err != nil && err != session.ErrNoKeyEntry {
+			if err != nil && err != session.ErrNoKeyEntry &&
+				err != session.ErrKeyEntryUsed {
 				return "", "", err
 			}
 			if err != session.ErrNoKeyEntry {
@@ -433,41 +453,60 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		return "", "", err
 	}
 
-	// actual decryption
-	oh, err = readOuterHeader(args.Reader)
-	if err != nil {
-		return "", "", err
-	}
-	if oh.Type != encryptedPacket {
-		return "", "", log.Error(ErrNotEncryptedPacket)
-	}
-	if oh.PacketCount != count {
-		return "", "", log.Error(ErrWrongCount)
-	}
-	count++
-	ciphertext := oh.inner
-	plaintext := make([]byte, len(ciphertext))
-	stream := aes256.CTRStream(cryptoKey, iv)
-	stream.XORKeyStream(plaintext, ciphertext)
-	ih, err := readInnerHeader(bytes.NewBuffer(plaintext))
-	if err != nil {
-		return "", "", err
-	}
-	if ih.Type&dataType == 0 {
-		return "", "", log.Error(ErrNotData)
+	// actual decryption (streamed messages contain multiple data packets)
+	var (
+		stream  = aes256.CTRStream(cryptoKey, iv)
+		sigHash hash.Hash
+		first   = true
+		more    = true
+	)
+	for more {
+		oh, err = readOuterHeader(args.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		if oh.Type != encryptedPacket {
+			return "", "", log.Error(ErrNotEncryptedPacket)
+		}
+		if oh.PacketCount != count {
+			return "", "", log.Error(ErrWrongCount)
+		}
+		count++
+		plaintext := make([]byte, len(oh.inner))
+		stream.XORKeyStream(plaintext, oh.inner)
+		ih, err := readInnerHeader(bytes.NewBuffer(plaintext))
+		if err != nil {
+			return "", "", err
+		}
+		if ih.Type&dataType == 0 {
+			return "", "", log.Error(ErrNotData)
+		}
+		if first {
+			if ih.Type&signType != 0 {
+				// create signature hash
+				sigHash = sha512.New()
+			}
+			first = false
+		} else if (sigHash != nil) != (ih.Type&signType != 0) {
+			// all data packets must be of the same type
+			return "", "", log.Error(ErrNotData)
+		}
+		if sigHash != nil {
+			sigHash.Write(ih.content)
+		}
+		if _, err := args.Writer.Write(ih.content); err != nil {
+			return "", "", log.Error(err)
+		}
+		more = ih.More != 0
+
+		// continue HMAC calculation
+		if err := oh.write(mac, true); err != nil {
+			return "", "", err
+		}
 	}
 	var contentHash []byte
-	if ih.Type&signType != 0 {
-		// create signature hash
-		contentHash = cipher.SHA512(ih.content)
-	}
-	if _, err := args.Writer.Write(ih.content); err != nil {
-		return "", "", log.Error(err)
-	}
-
-	// continue HMAC calculation
-	if err := oh.write(mac, true); err != nil {
-		return "", "", err
+	if sigHash != nil {
+		contentHash = sigHash.Sum(nil)
 	}
 
 	// verify signature
@@ -490,10 +529,9 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 			return "", "", err
 		}
 
-		ciphertext = oh.inner
-		plaintext = make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, ciphertext)
-		ih, err = readInnerHeader(bytes.NewBuffer(plaintext))
+		plaintext := make([]byte, len(oh.inner))
+		stream.XORKeyStream(plaintext, oh.inner)
+		ih, err := readInnerHeader(bytes.NewBuffer(plaintext))
 		if err != nil {
 			return "", "", err
 		}
@@ -524,10 +562,9 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 			return "", "", err
 		}
 
-		ciphertext = oh.inner
-		plaintext = make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, ciphertext)
-		ih, err = readInnerHeader(bytes.NewBuffer(plaintext))
+		plaintext := make([]byte, len(oh.inner))
+		stream.XORKeyStream(plaintext, oh.inner)
+		ih, err := readInnerHeader(bytes.NewBuffer(plaintext))
 		if err != nil {
 			return "", "", err
 		}
@@ -543,8 +580,8 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 
 	// verify signature, if necessary
 	if contentHash != nil {
-		if !ed25519.Verify(uidRes.msg.PublicSigKey32()[:], contentHash, sigBuf[:]) {
-			return "", "", log.Error(ErrInvalidSignature)
+		if err := verifySignature(uidRes.msg, contentHash, sigBuf[:]); err != nil {
+			return "", "", err
 		}
 		// encode signature to base64 as return value
 		sig = base64.Encode(sigBuf[:])
@@ -566,7 +603,7 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		return "", "", err
 	}
 	sum := mac.Sum(nil)
-	log.Debugf("HMAC:       %s", base64.Encode(sum))
+	log.Debugf("HMAC:       %s", log.Sensitive(base64.Encode(sum)))
 
 	if !hmac.Equal(sum, oh.inner) {
 		return "", "", log.Error(ErrHMACsDiffer)
@@ -578,5 +615,12 @@ func Decrypt(args *DecryptArgs) (senderID, sig string, err error) {
 		return "", "", err
 	}
 
+	// delete single-use KeyInit message
+	if usedKeyInit != "" {
+		if err := args.KeyStore.DelPrivateKeyEntry(usedKeyInit); err != nil {
+			return "", "", err
+		}
+	}
+
 	return
 }
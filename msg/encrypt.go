@@ -7,10 +7,12 @@ package msg
 import (
 	"bytes"
 	"crypto/aes"
+	cryptocipher "crypto/cipher"
 	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha512"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math/big"
@@ -39,10 +41,10 @@ func rootKeyAgreementSender(
 	recipientIdentityPub := recipientID.PublicKey32()
 	recipientKeyInitPub := recipientKI.PublicKey32()
 
-	log.Debugf("senderIdentityPub:    %s", base64.Encode(senderIdentityPub[:]))
-	log.Debugf("senderSessionPub:     %s", base64.Encode(senderSessionPub[:]))
-	log.Debugf("recipientIdentityPub: %s", base64.Encode(recipientIdentityPub[:]))
-	log.Debugf("recipientKeyInitPub:  %s", base64.Encode(recipientKeyInitPub[:]))
+	log.Debugf("senderIdentityPub:    %s", log.Sensitive(base64.Encode(senderIdentityPub[:])))
+	log.Debugf("senderSessionPub:     %s", log.Sensitive(base64.Encode(senderSessionPub[:])))
+	log.Debugf("recipientIdentityPub: %s", log.Sensitive(base64.Encode(recipientIdentityPub[:])))
+	log.Debugf("recipientKeyInitPub:  %s", log.Sensitive(base64.Encode(recipientKeyInitPub[:])))
 
 	// check keys to prevent reflection attacks and replays
 	err := checkKeys(senderHeaderPub, senderIdentityPub, senderSessionPub,
@@ -93,16 +95,23 @@ type EncryptArgs struct {
 	NymAddress             string        // address to receive future messages at
 	SenderLastKeychainHash string        // last hash chain entry known to the sender
 	PrivateSigKey          *[64]byte     // if this is s not nil the message is signed with the key
-	Reader                 io.Reader     // data to encrypt is read here (only for StatusCode == StatusOK)
+	Reader                 io.Reader     // data to encrypt is read here (not for StatusCode == StatusError)
 	NumOfKeys              uint64        // number of generated sessions keys (default: NumOfFutureKeys)
 	AvgSessionSize         uint          // average session size (default: AverageSessionSize)
 	Rand                   io.Reader     // random source
 	KeyStore               session.Store // for managing session keys
 	StatusCode             StatusCode    // status code of the encrypted message
+	SmallPadding           bool          // pad to smallest fitting size in EncodedMsgSizes
+	Stream                 bool          // stream content of arbitrary length in chunks (see StreamChunkSize)
 }
 
 // Encrypt encrypts a message with the argument given in args and returns the
 // nymAddress the message should be delivered to.
+//
+// If args.Stream is set, the content is read from args.Reader and written to
+// args.Writer in chunks of StreamChunkSize with constant memory and the
+// message is padded to a multiple of EncodedMsgSize (args.SmallPadding is
+// ignored). Otherwise the content is limited to MaxContentLength.
 func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	log.Debugf("msg.Encrypt(): %s -> %s", args.From.Identity(), args.To.Identity())
 
@@ -114,6 +123,20 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		args.AvgSessionSize = AverageSessionSize
 	}
 
+	// negotiate ciphersuite and get the corresponding identity keys
+	ciphersuite, err := uid.Negotiate(args.From, args.To)
+	if err != nil {
+		return "", err
+	}
+	senderID, err := args.From.PubKeyFor(ciphersuite)
+	if err != nil {
+		return "", err
+	}
+	recipientID, err := args.To.PubKeyFor(ciphersuite)
+	if err != nil {
+		return "", err
+	}
+
 	// create sender key
 	senderHeaderKey, err := cipher.Curve25519Generate(cipher.RandReader)
 	if err != nil {
@@ -124,8 +147,15 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	ph := newPreHeader(senderHeaderKey.PublicKey()[:])
 
 	// create base64 encoder
-	var out bytes.Buffer
-	wc := base64.NewEncoder(&out)
+	var (
+		out bytes.Buffer
+		wc  io.WriteCloser
+	)
+	if args.Stream {
+		wc = base64.NewEncoder(args.Writer)
+	} else {
+		wc = base64.NewEncoder(&out)
+	}
 
 	// write pre-header
 	var buf bytes.Buffer
@@ -142,8 +172,8 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	// get session state
 	sender := args.From.Identity()
 	recipient := args.To.Identity()
-	sessionStateKey := session.CalcStateKey(args.From.PubKey().PublicKey32(),
-		args.To.PubKey().PublicKey32())
+	sessionStateKey := session.CalcStateKey(senderID.PublicKey32(),
+		recipientID.PublicKey32())
 	var ss *session.State
 	if args.StatusCode != StatusReset {
 		ss, err = args.KeyStore.GetSessionState(sessionStateKey)
@@ -171,7 +201,7 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		// root key agreement
 		err = rootKeyAgreementSender(senderHeaderKey.PublicKey(),
 			args.From.Identity(), args.To.Identity(), &senderSession,
-			args.From.PubKey(), recipientTemp, args.To.PubKey(), nil,
+			senderID, recipientTemp, recipientID, nil,
 			args.NumOfKeys, args.KeyStore)
 		if err != nil {
 			return "", err
@@ -188,14 +218,14 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 			NymAddress:                  nymAddress,
 			KeyInitSession:              true,
 		}
-		log.Debugf("set session: %s", ss.SenderSessionPub.HASH)
+		log.Debugf("set session: %s", log.Sensitive(ss.SenderSessionPub.HASH))
 		err = args.KeyStore.SetSessionState(sessionStateKey, ss)
 		if err != nil {
 			return "", err
 		}
 	} else if args.StatusCode != StatusError { // do not update sessions for StatusError messages
 		log.Debug("session found")
-		log.Debugf("got session: %s", ss.SenderSessionPub.HASH)
+		log.Debugf("got session: %s", log.Sensitive(ss.SenderSessionPub.HASH))
 		nymAddress = ss.NymAddress
 		if ss.NextSenderSessionPub == nil {
 			// start new session in randomized fashion
@@ -214,12 +244,14 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	}
 
 	// create header
-	log.Debugf("senderID:    %s", args.From.UIDContent.PUBKEYS[0].HASH)
-	log.Debugf("recipientID: %s", args.To.UIDContent.PUBKEYS[0].HASH)
+	log.Debugf("ciphersuite: %s", ciphersuite)
+	log.Debugf("senderID:    %s", log.Sensitive(senderID.HASH))
+	log.Debugf("recipientID: %s", log.Sensitive(recipientID.HASH))
 	log.Debugf("ss.SenderSessionCount: %d", ss.SenderSessionCount)
 	log.Debugf("ss.SenderMessageCount: %d", ss.SenderMessageCount)
-	log.Debugf("ss.RecipientTempHash:  %s", ss.RecipientTemp.HASH)
-	h, err := newHeader(args.From, args.To, ss.RecipientTemp.HASH,
+	log.Debugf("ss.RecipientTempHash:  %s", log.Sensitive(ss.RecipientTemp.HASH))
+	h, err := newHeader(args.From, args.To, ciphersuite, senderID, recipientID,
+		ss.RecipientTemp.HASH,
 		&ss.SenderSessionPub, ss.NextSenderSessionPub,
 		ss.NextRecipientSessionPubSeen, args.NymAddress, ss.SenderSessionCount,
 		ss.SenderMessageCount, args.SenderLastKeychainHash, args.Rand,
@@ -227,22 +259,17 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	if err != nil {
 		return "", err
 	}
-	log.Debugf("h.SenderSessionPub:             %s", h.SenderSessionPub.HASH)
+	log.Debugf("h.SenderSessionPub:             %s", log.Sensitive(h.SenderSessionPub.HASH))
 	if h.NextSenderSessionPub != nil {
-		log.Debugf("h.NextSenderSessionPub:         %s", h.NextSenderSessionPub.HASH)
+		log.Debugf("h.NextSenderSessionPub:         %s", log.Sensitive(h.NextSenderSessionPub.HASH))
 	}
 	if h.NextRecipientSessionPubSeen != nil {
 		log.Debugf("h.NextRecipientSessionPubSeen:  %s",
-			h.NextRecipientSessionPubSeen.HASH)
+			log.Sensitive(h.NextRecipientSessionPubSeen.HASH))
 	}
 
 	// create (encrypted) header packet
-	recipientIdentityPub, err := args.To.PublicKey()
-	if err != nil {
-		return "", err
-	}
-
-	hp, err := newHeaderPacket(h, recipientIdentityPub,
+	hp, err := newHeaderPacket(h, recipientID.PublicKey32(),
 		senderHeaderKey.PrivateKey(), args.Rand)
 	if err != nil {
 		return "", err
@@ -259,8 +286,8 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	}
 	count++
 
-	sessionKey := session.CalcKey(args.From.PubKey().HASH,
-		args.To.PubKey().HASH, ss.SenderSessionPub.HASH, ss.RecipientTemp.HASH)
+	sessionKey := session.CalcKey(senderID.HASH, recipientID.HASH,
+		ss.SenderSessionPub.HASH, ss.RecipientTemp.HASH)
 
 	// make sure we got enough message keys
 	n, err := args.KeyStore.NumMessageKeys(sessionKey)
@@ -276,8 +303,8 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 			return "", err
 		}
 
-		err = generateMessageKeys(sender, recipient, args.From.PubKey().HASH,
-			args.To.PubKey().HASH, chainKey, false,
+		err = generateMessageKeys(sender, recipient, senderID.HASH,
+			recipientID.HASH, chainKey, false,
 			ss.SenderSessionPub.PublicKey32(), ss.RecipientTemp.PublicKey32(),
 			args.NumOfKeys, args.KeyStore)
 		if err != nil {
@@ -317,18 +344,85 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 	}
 
 	// actual encryption
-	var content []byte
-	if args.StatusCode == StatusOK { // StatusReset and StatusError messages are empty
-		content, err = ioutil.ReadAll(args.Reader)
+	if args.Stream {
+		err = encryptStream(args, wc, mac, aes256.CTRStream(cryptoKey, iv), count)
+		if err != nil {
+			return "", err
+		}
+		if err := wc.Close(); err != nil {
+			return "", log.Error(err)
+		}
+	} else {
+		msgSize, err := encryptPadded(args, wc, mac,
+			aes256.CTRStream(cryptoKey, iv), count)
 		if err != nil {
+			return "", err
+		}
+		// write output
+		wc.Close()
+		if out.Len() != msgSize {
+			return "", log.Errorf("out.Len() = %d != %d = msgSize)",
+				out.Len(), msgSize)
+		}
+		if _, err := io.Copy(args.Writer, &out); err != nil {
 			return "", log.Error(err)
 		}
 	}
+
+	// delete message key
+	err = args.KeyStore.DelMessageKey(sessionKey, true, ss.SenderMessageCount)
+	if err != nil {
+		return "", err
+	}
+	// increase SenderMessageCount
+	ss.SenderMessageCount++
+	err = args.KeyStore.SetSessionState(sessionStateKey, ss)
+	if err != nil {
+		return "", err
+	}
+
+	return
+}
+
+// encryptPadded writes the content read from args.Reader as a single
+// encrypted packet, followed by the signature and padding packet and the HMAC
+// packet, to wc. The message is padded to EncodedMsgSize (or the smallest
+// fitting size in EncodedMsgSizes, if args.SmallPadding is set), the chosen
+// size is returned.
+func encryptPadded(
+	args *EncryptArgs,
+	wc io.Writer,
+	mac hash.Hash,
+	stream cryptocipher.Stream,
+	count uint32,
+) (int, error) {
+	var (
+		buf     bytes.Buffer
+		content []byte
+		err     error
+	)
+	if args.StatusCode != StatusError { // StatusError messages are empty
+		content, err = ioutil.ReadAll(args.Reader)
+		if err != nil {
+			return 0, log.Error(err)
+		}
+	}
 	// enforce maximum content length
 	if len(content) > MaxContentLength {
-		return "", log.Errorf("len(content) = %d > %d = MaxContentLength)",
+		return 0, log.Errorf("len(content) = %d > %d = MaxContentLength)",
 			len(content), MaxContentLength)
 	}
+	// determine message size
+	msgSize := EncodedMsgSize
+	if args.SmallPadding {
+		for _, size := range EncodedMsgSizes {
+			if len(content) <= maxContentLength(size) {
+				msgSize = size
+				break
+			}
+		}
+	}
+	maxContentLen := maxContentLength(msgSize)
 
 	// encrypted packet
 	var contentHash []byte
@@ -340,102 +434,184 @@ func Encrypt(args *EncryptArgs) (nymAddress string, err error) {
 		innerType = dataType
 	}
 	ih := newInnerHeader(innerType, false, content)
-	buf.Reset()
 	if err := ih.write(&buf); err != nil {
-		return "", err
+		return 0, err
 	}
-	stream := aes256.CTRStream(cryptoKey, iv)
 	stream.XORKeyStream(buf.Bytes(), buf.Bytes())
-	oh = newOuterHeader(encryptedPacket, count, buf.Bytes())
+	oh := newOuterHeader(encryptedPacket, count, buf.Bytes())
 	if err := oh.write(wc, true); err != nil {
-		return "", err
+		return 0, err
 	}
 	count++
 
 	// continue HMAC calculation
 	if err := oh.write(mac, true); err != nil {
-		return "", err
+		return 0, err
 	}
 
 	// signature header & padding
-	buf.Reset()
+	padLen := maxContentLen - len(content)
+	if args.PrivateSigKey == nil {
+		padLen += signatureSize - encryptedPacketSize + innerHeaderSize
+	}
+	err = writeFinalPacket(args, wc, mac, stream, count, contentHash, padLen)
+	if err != nil {
+		return 0, err
+	}
+	count++
+
+	// create HMAC header
+	if err := writeHMACPacket(wc, mac, count); err != nil {
+		return 0, err
+	}
+	return msgSize, nil
+}
+
+// encryptStream writes the content read from args.Reader in encrypted packets
+// of at most StreamChunkSize content bytes to wc, followed by the signature
+// and padding packet and the HMAC packet. Only two chunks are held in memory
+// at any time. The HMAC and the signature hash are computed incrementally. The
+// message is padded to a multiple of UnencodedMsgSize.
+func encryptStream(
+	args *EncryptArgs,
+	wc io.Writer,
+	mac hash.Hash,
+	stream cryptocipher.Stream,
+	count uint32,
+) error {
+	var (
+		buf     bytes.Buffer
+		sigHash hash.Hash
+		written = uint64(preHeaderSize + encryptedHeaderSize + cryptoSetupSize)
+	)
+	innerType := uint8(dataType)
 	if args.PrivateSigKey != nil {
-		sig := ed25519.Sign(args.PrivateSigKey[:], contentHash)
-		// signature
-		ih = newInnerHeader(signatureType, true, sig[:])
-		if err := ih.write(&buf); err != nil {
-			return "", err
-		}
-		// padding
-		padLen := MaxContentLength - len(content)
-		pad, err := padding.Generate(padLen, cipher.RandReader)
+		sigHash = sha512.New()
+		innerType |= signType
+	}
+	r := args.Reader
+	if args.StatusCode == StatusError { // StatusError messages are empty
+		r = &bytes.Buffer{}
+	}
+	// read ahead one chunk to be able to set the More flag
+	chunk := make([]byte, StreamChunkSize)
+	next := make([]byte, StreamChunkSize)
+	n, err := readChunk(r, chunk)
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := readChunk(r, next)
 		if err != nil {
-			return "", err
+			return err
+		}
+		more := m > 0
+		if sigHash != nil {
+			sigHash.Write(chunk[:n])
 		}
-		ih = newInnerHeader(paddingType, false, pad)
+		ih := newInnerHeader(innerType, more, chunk[:n])
+		buf.Reset()
 		if err := ih.write(&buf); err != nil {
-			return "", err
+			return err
 		}
-	} else {
-		// just padding
-		padLen := MaxContentLength + signatureSize - encryptedPacketSize +
-			innerHeaderSize - len(content)
-		pad, err := padding.Generate(padLen, cipher.RandReader)
-		if err != nil {
-			return "", err
+		stream.XORKeyStream(buf.Bytes(), buf.Bytes())
+		oh := newOuterHeader(encryptedPacket, count, buf.Bytes())
+		if err := oh.write(wc, true); err != nil {
+			return err
 		}
-		ih = newInnerHeader(paddingType, false, pad)
+		count++
+		written += uint64(oh.size())
+
+		// continue HMAC calculation
+		if err := oh.write(mac, true); err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+		chunk, next = next, chunk
+		n = m
+	}
+
+	// signature header & padding
+	var contentHash []byte
+	final := encryptedPacketSize + hmacSize
+	if sigHash != nil {
+		contentHash = sigHash.Sum(nil)
+		final += signatureSize - encryptedPacketSize + innerHeaderSize
+	}
+	padLen := (UnencodedMsgSize - int((written+uint64(final))%UnencodedMsgSize)) %
+		UnencodedMsgSize
+	err = writeFinalPacket(args, wc, mac, stream, count, contentHash, padLen)
+	if err != nil {
+		return err
+	}
+	count++
+
+	// create HMAC header
+	return writeHMACPacket(wc, mac, count)
+}
+
+// readChunk fills chunk from r as far as possible and returns the number of
+// bytes read. At the end of r a short (or empty) chunk is returned.
+func readChunk(r io.Reader, chunk []byte) (int, error) {
+	n, err := io.ReadFull(r, chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, log.Error(err)
+	}
+	return n, nil
+}
+
+// writeFinalPacket writes the encrypted packet which contains the signature
+// of contentHash (if args.PrivateSigKey is set) and padLen bytes of padding to
+// wc and continues the HMAC calculation.
+func writeFinalPacket(
+	args *EncryptArgs,
+	wc io.Writer,
+	mac hash.Hash,
+	stream cryptocipher.Stream,
+	count uint32,
+	contentHash []byte,
+	padLen int,
+) error {
+	var buf bytes.Buffer
+	if args.PrivateSigKey != nil {
+		sig := ed25519.Sign(args.PrivateSigKey[:], contentHash)
+		// signature
+		ih := newInnerHeader(signatureType, true, sig[:])
 		if err := ih.write(&buf); err != nil {
-			return "", err
+			return err
 		}
 	}
+	// padding
+	pad, err := padding.Generate(padLen, cipher.RandReader)
+	if err != nil {
+		return err
+	}
+	ih := newInnerHeader(paddingType, false, pad)
+	if err := ih.write(&buf); err != nil {
+		return err
+	}
 	// encrypt inner header
 	stream.XORKeyStream(buf.Bytes(), buf.Bytes())
-	oh = newOuterHeader(encryptedPacket, count, buf.Bytes())
+	oh := newOuterHeader(encryptedPacket, count, buf.Bytes())
 	if err := oh.write(wc, true); err != nil {
-		return "", err
+		return err
 	}
-	count++
 
 	// continue HMAC calculation
-	if err := oh.write(mac, true); err != nil {
-		return "", err
-	}
+	return oh.write(mac, true)
+}
 
-	// create HMAC header
-	oh = newOuterHeader(hmacPacket, count, nil)
+// writeHMACPacket finishes the HMAC calculation and writes the HMAC packet to
+// wc.
+func writeHMACPacket(wc io.Writer, mac hash.Hash, count uint32) error {
+	oh := newOuterHeader(hmacPacket, count, nil)
 	oh.PLen = sha512.Size
 	if err := oh.write(mac, false); err != nil {
-		return "", err
+		return err
 	}
 	oh.inner = mac.Sum(oh.inner)
-	log.Debugf("HMAC:       %s", base64.Encode(oh.inner))
-	if err := oh.write(wc, true); err != nil {
-		return "", err
-	}
-	count++
-
-	// write output
-	wc.Close()
-	if out.Len() != EncodedMsgSize {
-		return "", log.Errorf("out.Len() = %d != %d = EncodedMsgSize)",
-			out.Len(), EncodedMsgSize)
-	}
-	if _, err := io.Copy(args.Writer, &out); err != nil {
-		return "", log.Error(err)
-	}
-
-	// delete message key
-	err = args.KeyStore.DelMessageKey(sessionKey, true, ss.SenderMessageCount)
-	if err != nil {
-		return "", err
-	}
-	// increase SenderMessageCount
-	ss.SenderMessageCount++
-	err = args.KeyStore.SetSessionState(sessionStateKey, ss)
-	if err != nil {
-		return "", err
-	}
-
-	return
+	log.Debugf("HMAC:       %s", log.Sensitive(base64.Encode(oh.inner)))
+	return oh.write(wc, true)
 }
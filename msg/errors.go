@@ -56,5 +56,14 @@ var ErrNotData = errors.New("msg: expected inner data header")
 // ErrReflection is raised when a possible reflection attack has been detected.
 var ErrReflection = errors.New("msg: reflection attack detected")
 
+// ErrSessionUnknown is raised when a message belongs to an unknown session
+// and the KeyInit message it might have been started with is unknown, too.
+// The session has to be restarted by the recipient (see StatusReset).
+var ErrSessionUnknown = errors.New("msg: session unknown (no KeyInit message found)")
+
+// ErrKeyInitReused is raised when a message starts a new session with a
+// single-use KeyInit message which has already been used for another session.
+var ErrKeyInitReused = errors.New("msg: single-use KeyInit message reused")
+
 // ErrStatusError is raised when a decryption operation lead to a StatusCode StatusError.
 var ErrStatusError = errors.New("msg: StatusCode == StatusError")
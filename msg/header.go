@@ -67,6 +67,8 @@ type headerPacket struct {
 
 func newHeader(
 	sender, recipient *uid.Message,
+	ciphersuite string,
+	senderID, recipientID *uid.KeyEntry,
 	recipientTempHash string,
 	senderSessionPub, nextSenderSessionPub,
 	nextRecipientSessionPubSeen *uid.KeyEntry,
@@ -81,13 +83,13 @@ func newHeader(
 			senderLastKeychainHash, hashchain.EntryBase64Len, len(senderLastKeychainHash))
 	}
 	h := &header{
-		Ciphersuite:                 uid.DefaultCiphersuite, // at the moment we only support one ciphersuite
-		RecipientPubHash:            recipient.PubHash(),
+		Ciphersuite:                 ciphersuite,
+		RecipientPubHash:            recipientID.HASH,
 		RecipientTempHash:           recipientTempHash,
 		SenderIdentity:              sender.Identity(),
 		SenderSessionPub:            *senderSessionPub,
-		SenderIdentityPubHash:       sender.PubHash(),
-		SenderIdentityPub:           *sender.PubKey(),
+		SenderIdentityPubHash:       senderID.HASH,
+		SenderIdentityPub:           *senderID,
 		NextSenderSessionPub:        nextSenderSessionPub,
 		NextRecipientSessionPubSeen: nextRecipientSessionPubSeen,
 		NymAddress:                  nymAddress,
@@ -157,7 +159,7 @@ func newHeaderPacket(
 	if _, err := io.ReadFull(rand, hp.Nonce[:]); err != nil {
 		return nil, log.Error(err)
 	}
-	log.Debugf("recvPub=%s\n", base64.Encode(recipientIdentityPub[:]))
+	log.Debugf("recvPub=%s\n", log.Sensitive(base64.Encode(recipientIdentityPub[:])))
 	hp.EncryptedHeader = box.Seal(hp.EncryptedHeader, jsn, &hp.Nonce,
 		recipientIdentityPub, senderHeaderPriv)
 	hp.LengthEncryptedHeader = uint16(len(hp.EncryptedHeader))
@@ -184,59 +186,77 @@ func (hp *headerPacket) write(w io.Writer) error {
 	return nil
 }
 
+// readHeader reads and decrypts the header with the first matching key of the
+// given identities and returns the identity, the key (which depends on the
+// ciphersuite), and the header.
 func readHeader(
 	senderHeaderPub *[32]byte,
 	identities []*uid.Message,
 	r io.Reader,
-) (*uid.Message, *header, error) {
+) (*uid.Message, *uid.KeyEntry, *header, error) {
 	var hp headerPacket
 	// read nonce
 	if _, err := io.ReadFull(r, hp.Nonce[:]); err != nil {
-		return nil, nil, log.Error(err)
+		return nil, nil, nil, log.Error(err)
 	}
 	//log.Debugf("hp.Nonce: %s", base64.Encode(hp.Nonce[:]))
 	// read length of encrypted header
 	if err := binary.Read(r, binary.BigEndian, &hp.LengthEncryptedHeader); err != nil {
-		return nil, nil, log.Error(err)
+		return nil, nil, nil, log.Error(err)
 	}
 	//log.Debugf("hp.LengthEncryptedHeader: %d", hp.LengthEncryptedHeader)
 	// read encrypted header
 	hp.EncryptedHeader = make([]byte, hp.LengthEncryptedHeader)
 	if _, err := io.ReadFull(r, hp.EncryptedHeader); err != nil {
-		return nil, nil, log.Error(err)
+		return nil, nil, nil, log.Error(err)
 	}
 	// try to decrypt header
 	var jsn []byte
 	var suc bool
 	var identity *uid.Message
+	var recipientID *uid.KeyEntry
+search:
 	for _, uidMsg := range identities {
 		log.Debugf("try identity %s (#%d)", uidMsg.Identity(),
 			uidMsg.UIDContent.MSGCOUNT)
-		log.Debugf("recvPub=%s\n",
-			base64.Encode(uidMsg.PubKey().PublicKey32()[:]))
-		jsn, suc = box.Open(jsn, hp.EncryptedHeader, &hp.Nonce,
-			senderHeaderPub, uidMsg.PubKey().PrivateKey32())
-		if suc {
-			identity = uidMsg
-			break
+		for i := range uidMsg.UIDContent.PUBKEYS {
+			ke := &uidMsg.UIDContent.PUBKEYS[i]
+			log.Debugf("recvPub=%s\n", log.Sensitive(base64.Encode(ke.PublicKey32()[:])))
+			jsn, suc = box.Open(jsn, hp.EncryptedHeader, &hp.Nonce,
+				senderHeaderPub, ke.PrivateKey32())
+			if suc {
+				identity = uidMsg
+				recipientID = ke
+				break search
+			}
 		}
 	}
 	if !suc {
-		return nil, nil, log.Error(ErrNoPreHeaderKey)
+		return nil, nil, nil, log.Error(ErrNoPreHeaderKey)
 	}
 	var h header
 	if err := json.Unmarshal(jsn, &h); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	// verify header
 	if err := h.verify(); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	return identity, &h, nil
+	// the header must have been encrypted for the key of the ciphersuite
+	if h.Ciphersuite != recipientID.CIPHERSUITE ||
+		h.RecipientPubHash != recipientID.HASH {
+		return nil, nil, nil, log.Errorf("msg: header does not match recipient key of ciphersuite '%s'",
+			h.Ciphersuite)
+	}
+	return identity, recipientID, &h, nil
 }
 
 // Verify KeyEntry messages in header.
 func (h *header) verify() error {
+	// check h.Ciphersuite
+	if !uid.IsSupportedCiphersuite(h.Ciphersuite) {
+		return log.Errorf("msg: %s: %s", uid.ErrUnknownCiphersuite, h.Ciphersuite)
+	}
 	// check h.SenderSessionPub
 	if err := h.SenderSessionPub.Verify(); err != nil {
 		return err
@@ -253,6 +273,10 @@ func (h *header) verify() error {
 		return log.Errorf("msg: wrong uid.SenderIdentityPub.FUNCTION: %s",
 			h.SenderIdentityPub.FUNCTION)
 	}
+	if h.SenderIdentityPub.CIPHERSUITE != h.Ciphersuite {
+		return log.Errorf("msg: wrong uid.SenderIdentityPub.CIPHERSUITE: %s",
+			h.SenderIdentityPub.CIPHERSUITE)
+	}
 	// check h.NextSenderSessionPub
 	if h.NextSenderSessionPub != nil {
 		if err := h.NextSenderSessionPub.Verify(); err != nil {
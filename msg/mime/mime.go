@@ -12,11 +12,13 @@ import (
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
 	"net/textproto"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
@@ -157,6 +159,32 @@ func New(
 	return nil
 }
 
+// Export writes msg as a standard mail (e.g., for mailbox exports) with the
+// given delivery date to w. In contrast to New the subject line is not
+// repeated in the message body.
+func Export(
+	w io.Writer,
+	header Header,
+	date time.Time,
+	msg string,
+	attachments []*Attachment,
+) error {
+	fmt.Fprintf(w, "Date: %s\r\n", date.UTC().Format(time.RFC1123Z))
+	writer := multipart.NewWriter(w)
+	subject, message := SplitMessage(msg)
+	err := mailHeader(w, header, subject, writer.Boundary())
+	if err != nil {
+		return err
+	}
+	if err := multipartMIME(writer, message, attachments); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
 // EncodeChunks splits a MIME encoded message msg into multiple chunks of
 // given size many bytes.
 func EncodeChunks(
@@ -204,6 +232,24 @@ func EncodeChunks(
 	return
 }
 
+// IsChunk returns true, if msg is a chunk created by EncodeChunks.
+func IsChunk(msg string) bool {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		return false
+	}
+	p, err := multipart.NewReader(m.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return false
+	}
+	mediaType, _, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+	return err == nil && mediaType == "chunked"
+}
+
 // DecodeChunk decodes the given chunk.
 func DecodeChunk(chunk string) (
 	header *Header,
@@ -275,6 +321,85 @@ func DecodeChunk(chunk string) (
 	return
 }
 
+// NewReceipt writes a MIME encoded receipt with the given status (e.g.,
+// "delivered" or "read") to w. The header.InReplyTo field must contain the
+// message ID of the acknowledged message.
+func NewReceipt(w io.Writer, header Header, status string) error {
+	if header.InReplyTo == "" {
+		return log.Error("mime: receipt without acknowledged message ID")
+	}
+	writer := multipart.NewWriter(w)
+	if err := mailHeader(w, header, "", writer.Boundary()); err != nil {
+		return err
+	}
+	mh := make(textproto.MIMEHeader)
+	mh.Add("Content-Type", fmt.Sprintf("receipt; status=%s; ackid=%q", status,
+		header.InReplyTo))
+	if _, err := writer.CreatePart(mh); err != nil {
+		return log.Error(err)
+	}
+	if err := writer.Close(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// IsReceipt returns true, if msg is a receipt created by NewReceipt.
+func IsReceipt(msg string) bool {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		return false
+	}
+	p, err := multipart.NewReader(m.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return false
+	}
+	mediaType, _, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+	return err == nil && mediaType == "receipt"
+}
+
+// DecodeReceipt decodes the given receipt. The message ID of the acknowledged
+// message is returned in header.InReplyTo.
+func DecodeReceipt(receipt string) (header *Header, status string, err error) {
+	var h Header
+	msg, err := mail.ReadMessage(strings.NewReader(receipt))
+	if err != nil {
+		return nil, "", log.Error(err)
+	}
+	h.From = msg.Header.Get("From")
+	h.To = msg.Header.Get("To")
+	h.MessageID = msg.Header.Get("Message-ID")
+	h.InReplyTo = msg.Header.Get("In-Reply-To")
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", log.Error(err)
+	}
+	if mediaType != "multipart/mixed" {
+		return nil, "", log.Errorf("mime: unexpected mediaType: %s", mediaType)
+	}
+	p, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return nil, "", log.Error(err)
+	}
+	mediaType, params, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", log.Error(err)
+	}
+	if mediaType != "receipt" {
+		return nil, "", log.Errorf("mime: unexpected mediaType: %s", mediaType)
+	}
+	if params["ackid"] != h.InReplyTo {
+		return nil, "", log.Errorf("mime: ackID differs from In-Reply-To")
+	}
+	header = &h
+	status = params["status"]
+	return
+}
+
 // Parse parses a MIME encoded message.
 func Parse(r io.Reader) (
 	header *Header,
@@ -309,13 +434,9 @@ func Parse(r io.Reader) (
 			h.Cc = append(h.Cc, address.Address)
 		}
 	}
-	// parse subject
-	subj := msg.Header.Get("Subject")
-	if subj == "" {
-		return nil, "", "", nil, log.Error("mime: 'Subject' not defined")
-	}
+	// parse optional subject (omitted by New for empty subject lines)
 	dec := new(mime.WordDecoder)
-	subject, err = dec.DecodeHeader(subj)
+	subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
 	if err != nil {
 		return nil, "", "", nil, log.Error(err)
 	}
@@ -422,3 +543,186 @@ func Parse(r io.Reader) (
 	header = &h
 	return
 }
+
+// stripAngles removes the angle brackets from the (first) message ID in s.
+func stripAngles(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+}
+
+// mailParser collects the message text and the attachments of a mail.
+type mailParser struct {
+	message     string
+	hasMessage  bool
+	attachments []*Attachment
+}
+
+// decodeText decodes the text content with the given charset to UTF-8 and
+// converts CRLF line endings to LF. Unknown charsets are left as is.
+func decodeText(content []byte, charset string) string {
+	if strings.EqualFold(charset, "iso-8859-1") ||
+		strings.EqualFold(charset, "latin1") {
+		runes := make([]rune, len(content))
+		for i, b := range content {
+			runes[i] = rune(b)
+		}
+		content = []byte(string(runes))
+	}
+	return strings.Replace(string(content), "\r\n", "\n", -1)
+}
+
+// part parses the MIME part with the given header and body (recursively for
+// multipart parts). The first inline text/plain part is the message text, all
+// other parts are attachments.
+func (p *mailParser) part(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain" // default (RFC 2045)
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.part(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+	// quoted-printable is already decoded by multipart.Reader for parts
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if mediaType == "text/plain" && disposition != "attachment" && !p.hasMessage {
+		p.message = decodeText(content, params["charset"])
+		p.hasMessage = true
+		return nil
+	}
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("attachment%d", len(p.attachments)+1)
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			filename += exts[0]
+		}
+	}
+	p.attachments = append(p.attachments, &Attachment{
+		Filename:    filepath.Base(filename),
+		Reader:      bytes.NewBuffer(content),
+		ContentType: mediaType,
+		Inline:      disposition == "inline",
+	})
+	return nil
+}
+
+// ParseMail parses an arbitrary mail from r, like the ones written by Export
+// or by other mail clients. In contrast to Parse it accepts single part and
+// nested multipart messages with the usual transfer encodings and only 'From'
+// is mandatory. The returned header contains bare addresses ('To' is a comma
+// separated list) and message IDs without angle brackets. The date is zero, if
+// the mail has no valid 'Date' header.
+func ParseMail(r io.Reader) (
+	header *Header,
+	date time.Time,
+	subject string,
+	message string,
+	attachments []*Attachment,
+	err error,
+) {
+	var h Header
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, time.Time{}, "", "", nil, log.Error(err)
+	}
+	// parse addresses
+	from, err := msg.Header.AddressList("From")
+	if err != nil {
+		return nil, time.Time{}, "", "", nil,
+			log.Errorf("mime: cannot parse 'From': %s", err)
+	}
+	h.From = from[0].Address
+	for _, field := range []string{"To", "Cc"} {
+		addressList, err := msg.Header.AddressList(field)
+		if err == mail.ErrHeaderNotPresent {
+			continue
+		} else if err != nil {
+			return nil, time.Time{}, "", "", nil,
+				log.Errorf("mime: cannot parse '%s': %s", field, err)
+		}
+		var addresses []string
+		for _, address := range addressList {
+			addresses = append(addresses, address.Address)
+		}
+		if field == "To" {
+			h.To = strings.Join(addresses, ", ")
+		} else {
+			h.Cc = addresses
+		}
+	}
+	h.MessageID = stripAngles(msg.Header.Get("Message-ID"))
+	h.InReplyTo = stripAngles(msg.Header.Get("In-Reply-To"))
+	date, _ = msg.Header.Date()
+	dec := new(mime.WordDecoder)
+	subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, time.Time{}, "", "", nil, log.Error(err)
+	}
+	// parse body
+	var p mailParser
+	if err := p.part(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, time.Time{}, "", "", nil, log.Error(err)
+	}
+	header = &h
+	return header, date, subject, p.message, p.attachments, nil
+}
+
+// executableExtensions are filename extensions of executable files.
+var executableExtensions = map[string]bool{
+	".app": true, ".apk": true, ".bat": true, ".cmd": true, ".com": true,
+	".cpl": true, ".dll": true, ".dmg": true, ".exe": true, ".hta": true,
+	".jar": true, ".js": true, ".jse": true, ".lnk": true, ".msi": true,
+	".pif": true, ".ps1": true, ".scr": true, ".sh": true, ".vbe": true,
+	".vbs": true, ".wsf": true,
+}
+
+// executableContentTypes are Content-Types of executable files.
+var executableContentTypes = map[string]bool{
+	"application/java-archive":                      true,
+	"application/vnd.android.package-archive":       true,
+	"application/vnd.microsoft.portable-executable": true,
+	"application/x-executable":                      true,
+	"application/x-msdos-program":                   true,
+	"application/x-msdownload":                      true,
+	"application/x-sh":                              true,
+}
+
+// IsExecutable returns true, if the given attachment is an executable file
+// (judged by its filename and Content-Type).
+func (a *Attachment) IsExecutable() bool {
+	if executableExtensions[strings.ToLower(filepath.Ext(a.Filename))] {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		return false
+	}
+	return executableContentTypes[mediaType]
+}
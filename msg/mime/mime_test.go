@@ -11,7 +11,9 @@ import (
 	"mime/multipart"
 	"net/mail"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/msg/msgid"
@@ -180,6 +182,135 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestExport(t *testing.T) {
+	date := time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+	header := Header{
+		From:      "alice@mute.berlin",
+		To:        "bob@mute.berlin",
+		MessageID: "<1@mute.berlin>",
+	}
+	var email bytes.Buffer
+	err := Export(&email, header, date, "subject\nline 1\nline 2\n",
+		[]*Attachment{
+			{
+				Filename: "message.txt",
+				Reader:   bytes.NewBufferString(msgs.Message2),
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(email.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgDate, err := msg.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msgDate.Equal(date) {
+		t.Errorf("wrong date: %s", msgDate)
+	}
+	_, subject, message, attachments, err := Parse(bytes.NewReader(email.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "subject" {
+		t.Errorf("wrong subject: %s", subject)
+	}
+	if message != "line 1\nline 2\n" {
+		t.Errorf("wrong message: %q", message)
+	}
+	if len(attachments) != 1 || attachments[0].Filename != "message.txt" {
+		t.Errorf("wrong attachments: %v", attachments)
+	}
+}
+
+func TestParseMail(t *testing.T) {
+	// mail written by Export
+	date := time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+	var email bytes.Buffer
+	err := Export(&email, Header{
+		From:      "alice@mute.berlin",
+		To:        "bob@mute.berlin, carol@mute.berlin",
+		Cc:        []string{"dave@mute.berlin"},
+		MessageID: "<1@mute.berlin>",
+		InReplyTo: "<0@mute.berlin>",
+	}, date, "subject\nline 1\n", []*Attachment{
+		{
+			Filename: "message.txt",
+			Reader:   bytes.NewBufferString(msgs.Message2),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, msgDate, subject, message, attachments, err := ParseMail(&email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.From != "alice@mute.berlin" ||
+		header.To != "bob@mute.berlin, carol@mute.berlin" ||
+		len(header.Cc) != 1 || header.Cc[0] != "dave@mute.berlin" ||
+		header.MessageID != "1@mute.berlin" || header.InReplyTo != "0@mute.berlin" {
+		t.Errorf("wrong header: %+v", header)
+	}
+	if !msgDate.Equal(date) {
+		t.Errorf("wrong date: %s", msgDate)
+	}
+	if subject != "subject" || message != "line 1\n" {
+		t.Errorf("wrong message: %q %q", subject, message)
+	}
+	if len(attachments) != 1 || attachments[0].Filename != "message.txt" {
+		t.Fatalf("wrong attachments: %v", attachments)
+	}
+	content, err := ioutil.ReadAll(attachments[0].Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != msgs.Message2 {
+		t.Error("wrong attachment content")
+	}
+	// mail written by other mail client
+	other := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@mute.berlin\r\n" +
+		"Subject: =?utf-8?q?gr=C3=BC=C3=9Fe?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"sch=F6n\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>sch&ouml;n</p>\r\n" +
+		"--b--\r\n"
+	header, msgDate, subject, message, attachments, err =
+		ParseMail(strings.NewReader(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.From != "alice@example.com" || header.MessageID != "" {
+		t.Errorf("wrong header: %+v", header)
+	}
+	if !msgDate.IsZero() {
+		t.Errorf("date should be zero: %s", msgDate)
+	}
+	if subject != "grüße" || message != "schön" {
+		t.Errorf("wrong message: %q %q", subject, message)
+	}
+	if len(attachments) != 1 || attachments[0].ContentType != "text/html" {
+		t.Errorf("wrong attachments: %v", attachments)
+	}
+	// 'From' is mandatory
+	if _, _, _, _, _, err := ParseMail(strings.NewReader("To: bob@mute.berlin\r\n\r\n")); err == nil {
+		t.Error("mail without 'From' should fail")
+	}
+}
+
 func TestChunks(t *testing.T) {
 	from := "alice@mute.berlin"
 	to := "bob@mute.berlin"
@@ -220,8 +351,14 @@ func TestChunks(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if IsChunk(msg.String()) {
+		t.Error("message is not a chunk")
+	}
 	var res bytes.Buffer
 	for i, chunk := range chunks {
+		if !IsChunk(chunk) {
+			t.Error("chunk not detected")
+		}
 		h, part, piece, count, err := DecodeChunk(chunk)
 		if err != nil {
 			t.Fatal(err)
@@ -295,3 +432,72 @@ func TestChunks(t *testing.T) {
 		t.Error("att2 should not be inline")
 	}
 }
+
+func TestReceipt(t *testing.T) {
+	from := "alice@mute.berlin"
+	to := "bob@mute.berlin"
+	messageID, err := msgid.Generate(from, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ackID, err := msgid.Generate(to, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := Header{
+		From:      from,
+		To:        to,
+		MessageID: messageID,
+	}
+	var receipt bytes.Buffer
+	if err := NewReceipt(&receipt, header, "read"); err == nil {
+		t.Error("NewReceipt() should fail without acknowledged message ID")
+	}
+	header.InReplyTo = ackID
+	receipt.Reset()
+	if err := NewReceipt(&receipt, header, "read"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsReceipt(receipt.String()) {
+		t.Error("receipt not detected")
+	}
+	if IsChunk(receipt.String()) {
+		t.Error("receipt is not a chunk")
+	}
+	var msg bytes.Buffer
+	if err := New(&msg, header, testMessage, nil); err != nil {
+		t.Fatal(err)
+	}
+	if IsReceipt(msg.String()) {
+		t.Error("message is not a receipt")
+	}
+	h, status, err := DecodeReceipt(receipt.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, &header) {
+		t.Error("h != header")
+	}
+	if status != "read" {
+		t.Error("status != \"read\"")
+	}
+}
+
+func TestIsExecutable(t *testing.T) {
+	tests := []struct {
+		attachment Attachment
+		executable bool
+	}{
+		{Attachment{Filename: "message.txt"}, false},
+		{Attachment{Filename: "setup.EXE"}, true},
+		{Attachment{Filename: "run.sh"}, true},
+		{Attachment{Filename: "data", ContentType: "application/x-msdownload"}, true},
+		{Attachment{Filename: "doc.pdf", ContentType: "application/pdf"}, false},
+	}
+	for _, test := range tests {
+		if test.attachment.IsExecutable() != test.executable {
+			t.Errorf("%s: IsExecutable() != %v", test.attachment.Filename,
+				test.executable)
+		}
+	}
+}
@@ -33,6 +33,21 @@ const MaxContentLength = UnencodedMsgSize - preHeaderSize - encryptedHeaderSize
 	cryptoSetupSize - encryptedPacketSize - signatureSize - innerHeaderSize -
 	hmacSize // 41691
 
+// StreamChunkSize is the maximum content length of a single encrypted packet
+// in messages encrypted with EncryptArgs.Stream set.
+const StreamChunkSize = MaxContentLength
+
+// EncodedMsgSizes are the possible sizes (padding buckets) of base64 encoded
+// encrypted messages. Messages are padded to EncodedMsgSize, unless
+// EncryptArgs.SmallPadding is set.
+var EncodedMsgSizes = []int{16384, 32768, EncodedMsgSize}
+
+// maxContentLength returns the maximum length the content of a message with
+// the given encoded size can have.
+func maxContentLength(encodedMsgSize int) int {
+	return encodedMsgSize/4*3 - (UnencodedMsgSize - MaxContentLength)
+}
+
 // SendTime defines how long key material can be used for sending.
 const SendTime = 172800 // 48h
 
@@ -6,16 +6,17 @@ package msg
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"io"
 	"testing"
 
-	"crypto/ed25519"
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/keyserver/hashchain"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/msg/padding"
+	"github.com/mutecomm/mute/msg/session"
 	"github.com/mutecomm/mute/msg/session/memstore"
 	"github.com/mutecomm/mute/uid"
 	"github.com/mutecomm/mute/util/fuzzer"
@@ -118,19 +119,9 @@ func decrypt(sender, recipient *uid.Message, r io.Reader, recipientTemp *uid.Key
 		return errors.New("messages differ")
 	}
 	if sign {
-		contentHash := cipher.SHA512(res.Bytes())
-		decSig, err := base64.Decode(sig)
-		if err != nil {
+		if err := VerifySignature(sender, bytes.NewReader(res.Bytes()), sig); err != nil {
 			return err
 		}
-		if len(decSig) != ed25519.SignatureSize {
-			return errors.New("signature has wrong length")
-		}
-		var sigBuf [ed25519.SignatureSize]byte
-		copy(sigBuf[:], decSig)
-		if !ed25519.Verify(sender.PublicSigKey32(), contentHash, &sigBuf) {
-			return errors.New("signature verification failed")
-		}
 	}
 	return nil
 }
@@ -347,3 +338,339 @@ func TestReflection(t *testing.T) {
 		t.Error("should fail with ErrReflection")
 	}
 }
+
+// newTestUID creates a new user ID for id.
+func newTestUID(t *testing.T, id string) *uid.Message {
+	msg, err := uid.Create(id, false, "", "", uid.Strict, hashchain.TestEntry,
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// newTestKeyEntry creates a new KeyInit of user ID msg and returns its key
+// entry (with private key).
+func newTestKeyEntry(t *testing.T, msg *uid.Message) *uid.KeyEntry {
+	now := uint64(times.Now())
+	ki, _, privateKey, err := msg.KeyInit(1, now+times.Day, now-times.Day,
+		false, "mute.berlin", "", "", cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ke, err := ki.KeyEntryECDHE25519(msg.SigPubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ke.SetPrivateKey(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	return ke
+}
+
+// newTestSession creates the user IDs of Alice and Bob and a KeyInit of Bob.
+// The key store of Alice contains the public KeyInit key of Bob and the key
+// store of Bob the private one.
+func newTestSession(t *testing.T) (
+	aliceUID, bobUID *uid.Message,
+	bobKE *uid.KeyEntry,
+	aliceKeyStore, bobKeyStore *memstore.MemStore,
+) {
+	aliceUID = newTestUID(t, "alice@mute.berlin")
+	bobUID = newTestUID(t, "bob@mute.berlin")
+	bobKE = newTestKeyEntry(t, bobUID)
+	aliceKeyStore = memstore.New()
+	aliceKeyStore.AddPublicKeyEntry(bobUID.Identity(), bobKE)
+	bobKeyStore = memstore.New()
+	bobKeyStore.AddPrivateKeyEntry(bobKE)
+	return
+}
+
+func TestSmallPadding(t *testing.T) {
+	t.Parallel()
+	aliceUID, bobUID, _, aliceKeyStore, bobKeyStore := newTestSession(t)
+	for i, size := range EncodedMsgSizes {
+		// create message which just fits
+		message, err := padding.Generate(maxContentLength(size), cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var privateSigKey *[64]byte
+		if i%2 == 0 {
+			privateSigKey = aliceUID.PrivateSigKey64()
+		}
+		// encrypt message from Alice to Bob
+		var encMsg bytes.Buffer
+		encryptArgs := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   aliceUID,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			PrivateSigKey:          privateSigKey,
+			Reader:                 bytes.NewBuffer(message),
+			Rand:                   cipher.RandReader,
+			KeyStore:               aliceKeyStore,
+			SmallPadding:           true,
+		}
+		if _, err = Encrypt(encryptArgs); err != nil {
+			t.Fatal(err)
+		}
+		if encMsg.Len() != size {
+			t.Errorf("encMsg.Len() = %d != %d", encMsg.Len(), size)
+		}
+		// decrypt message from Alice to Bob
+		var res bytes.Buffer
+		input := base64.NewDecoder(&encMsg)
+		_, preHeader, err := ReadFirstOuterHeader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptArgs := &DecryptArgs{
+			Writer:     &res,
+			Identities: []*uid.Message{bobUID},
+			PreHeader:  preHeader,
+			Reader:     input,
+			Rand:       cipher.RandReader,
+			KeyStore:   bobKeyStore,
+		}
+		if _, _, err = Decrypt(decryptArgs); err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != string(message) {
+			t.Fatal("messages differ")
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+	aliceUID, bobUID, _, aliceKeyStore, bobKeyStore := newTestSession(t)
+	sizes := []int{0, 1, StreamChunkSize, 3*StreamChunkSize + 17,
+		10 * StreamChunkSize}
+	for i, size := range sizes {
+		message, err := padding.Generate(size, cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var privateSigKey *[64]byte
+		if i%2 == 0 {
+			privateSigKey = aliceUID.PrivateSigKey64()
+		}
+		// encrypt message from Alice to Bob
+		var encMsg bytes.Buffer
+		encryptArgs := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   aliceUID,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			PrivateSigKey:          privateSigKey,
+			Reader:                 bytes.NewBuffer(message),
+			Rand:                   cipher.RandReader,
+			KeyStore:               aliceKeyStore,
+			Stream:                 true,
+		}
+		if _, err = Encrypt(encryptArgs); err != nil {
+			t.Fatal(err)
+		}
+		if encMsg.Len()%EncodedMsgSize != 0 {
+			t.Errorf("encMsg.Len() = %d is not a multiple of %d", encMsg.Len(),
+				EncodedMsgSize)
+		}
+		// decrypt message from Alice to Bob
+		var res bytes.Buffer
+		input := base64.NewDecoder(&encMsg)
+		_, preHeader, err := ReadFirstOuterHeader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptArgs := &DecryptArgs{
+			Writer:     &res,
+			Identities: []*uid.Message{bobUID},
+			PreHeader:  preHeader,
+			Reader:     input,
+			Rand:       cipher.RandReader,
+			KeyStore:   bobKeyStore,
+		}
+		_, sig, err := Decrypt(decryptArgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res.Bytes(), message) {
+			t.Fatal("messages differ")
+		}
+		if (privateSigKey != nil) != (sig != "") {
+			t.Error("signature mismatch")
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	t.Parallel()
+	sender, err := uid.Create("alice@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := uid.Create("bob@mute.berlin", false, "", "", uid.Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(msgs.Message1)
+	sig := base64.Encode(ed25519.Sign(sender.PrivateMsgSigKey64()[:],
+		cipher.SHA512(content)))
+	if err := VerifySignature(sender, bytes.NewReader(content), sig); err != nil {
+		t.Error(err)
+	}
+	err = VerifySignature(other, bytes.NewReader(content), sig)
+	if err != ErrInvalidSignature {
+		t.Errorf("should fail with ErrInvalidSignature: %v", err)
+	}
+	err = VerifySignature(sender, bytes.NewBufferString(msgs.Message2), sig)
+	if err != ErrInvalidSignature {
+		t.Errorf("should fail with ErrInvalidSignature: %v", err)
+	}
+	err = VerifySignature(sender, bytes.NewReader(content), base64.Encode(content[:10]))
+	if err != ErrWrongSignatureLength {
+		t.Errorf("should fail with ErrWrongSignatureLength: %v", err)
+	}
+}
+
+func TestSessionRestart(t *testing.T) {
+	t.Parallel()
+	aliceUID, bobUID, _, aliceKeyStore, _ := newTestSession(t)
+	alice := aliceUID.Identity()
+	aliceKE := newTestKeyEntry(t, aliceUID)
+	aliceKeyStore.AddPrivateKeyEntry(aliceKE)
+	// Bob lost his session and KeyInit keys
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddPublicKeyEntry(alice, aliceKE)
+
+	send := func(from, to *uid.Message, ks *memstore.MemStore, status StatusCode,
+		content string) *bytes.Buffer {
+		var encMsg bytes.Buffer
+		encryptArgs := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   from,
+			To:                     to,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			Reader:                 bytes.NewBufferString(content),
+			Rand:                   cipher.RandReader,
+			KeyStore:               ks,
+			StatusCode:             status,
+		}
+		if _, err := Encrypt(encryptArgs); err != nil {
+			t.Fatal(err)
+		}
+		return &encMsg
+	}
+	receive := func(to *uid.Message, ks *memstore.MemStore, encMsg io.Reader) (
+		string, string, error) {
+		var res bytes.Buffer
+		input := base64.NewDecoder(encMsg)
+		_, preHeader, err := ReadFirstOuterHeader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptArgs := &DecryptArgs{
+			Writer:     &res,
+			Identities: []*uid.Message{to},
+			PreHeader:  preHeader,
+			Reader:     input,
+			Rand:       cipher.RandReader,
+			KeyStore:   ks,
+		}
+		senderID, _, err := Decrypt(decryptArgs)
+		return senderID, res.String(), err
+	}
+
+	// Bob cannot decrypt the message from Alice
+	encMsg := send(aliceUID, bobUID, aliceKeyStore, StatusOK, msgs.Message1)
+	senderID, _, err := receive(bobUID, bobKeyStore, encMsg)
+	if err != ErrSessionUnknown {
+		t.Fatalf("should fail with ErrSessionUnknown: %v", err)
+	}
+	if senderID != alice {
+		t.Errorf("senderID = %s != %s", senderID, alice)
+	}
+	// Bob restarts the session
+	encMsg = send(bobUID, aliceUID, bobKeyStore, StatusReset, msgs.Message2)
+	_, res, err := receive(aliceUID, aliceKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != msgs.Message2 {
+		t.Error("messages differ")
+	}
+	// Alice uses the restarted session
+	encMsg = send(aliceUID, bobUID, aliceKeyStore, StatusOK, msgs.Message1)
+	_, res, err = receive(bobUID, bobKeyStore, encMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != msgs.Message1 {
+		t.Error("messages differ")
+	}
+}
+
+func TestSingleUseKeyInit(t *testing.T) {
+	t.Parallel()
+	aliceUID, bobUID, bobKE, aliceKeyStore, _ := newTestSession(t)
+	carolUID := newTestUID(t, "carol@mute.berlin")
+	bobKeyStore := memstore.New()
+	bobKeyStore.AddSingleUsePrivateKeyEntry(bobKE)
+	// Alice and Carol got the same single-use KeyInit message of Bob
+	carolKeyStore := memstore.New()
+	carolKeyStore.AddPublicKeyEntry(bobUID.Identity(), bobKE)
+
+	send := func(from *uid.Message, ks *memstore.MemStore) *bytes.Buffer {
+		var encMsg bytes.Buffer
+		encryptArgs := &EncryptArgs{
+			Writer:                 &encMsg,
+			From:                   from,
+			To:                     bobUID,
+			SenderLastKeychainHash: hashchain.TestEntry,
+			Reader:                 bytes.NewBufferString(msgs.Message1),
+			Rand:                   cipher.RandReader,
+			KeyStore:               ks,
+		}
+		if _, err := Encrypt(encryptArgs); err != nil {
+			t.Fatal(err)
+		}
+		return &encMsg
+	}
+	receive := func(encMsg io.Reader) error {
+		var res bytes.Buffer
+		input := base64.NewDecoder(encMsg)
+		_, preHeader, err := ReadFirstOuterHeader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptArgs := &DecryptArgs{
+			Writer:     &res,
+			Identities: []*uid.Message{bobUID},
+			PreHeader:  preHeader,
+			Reader:     input,
+			Rand:       cipher.RandReader,
+			KeyStore:   bobKeyStore,
+		}
+		_, _, err = Decrypt(decryptArgs)
+		return err
+	}
+
+	// first use deletes the KeyInit
+	if err := receive(send(aliceUID, aliceKeyStore)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bobKeyStore.GetPrivateKeyEntry(bobKE.HASH); err != session.ErrKeyEntryUsed {
+		t.Errorf("KeyInit should be used: %v", err)
+	}
+	// the session started with it can still be used
+	if err := receive(send(aliceUID, aliceKeyStore)); err != nil {
+		t.Fatal(err)
+	}
+	// another session cannot be started with it
+	if err := receive(send(carolUID, carolKeyStore)); err != ErrKeyInitReused {
+		t.Errorf("should fail with ErrKeyInitReused: %v", err)
+	}
+}
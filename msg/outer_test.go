@@ -70,7 +70,8 @@ func TestEncrypteHeaderSizeAndPadding(t *testing.T) {
 	}
 
 	// create unencrypted header
-	h, err := newHeader(aliceUID, bobUID, bobKE.HASH, aliceKE, nil, nil, "", 0, 0,
+	h, err := newHeader(aliceUID, bobUID, uid.DefaultCiphersuite,
+		aliceUID.PubKey(), bobUID.PubKey(), bobKE.HASH, aliceKE, nil, nil, "", 0, 0,
 		hashchain.TestEntry, cipher.RandReader, StatusOK)
 	if err != nil {
 		t.Fatal(err)
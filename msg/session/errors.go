@@ -13,3 +13,7 @@ var ErrMessageKeyUsed = errors.New("msg: message key has already been used")
 
 // ErrNoKeyEntry is raised when no KeyEntry message could be found.
 var ErrNoKeyEntry = errors.New("msg: no KeyEntry found")
+
+// ErrKeyEntryUsed is raised when the private key of a single-use KeyEntry
+// has already been deleted after its first use.
+var ErrKeyEntryUsed = errors.New("msg: single-use KeyEntry has already been used")
@@ -28,6 +28,8 @@ type sessionKey struct {
 // MemStore implements the KeyStore interface in memory.
 type MemStore struct {
 	privateKeyEntryMap map[string]*uid.KeyEntry
+	singleUseMap       map[string]bool
+	usedKeyEntryMap    map[string]*uid.KeyEntry
 	publicKeyEntryMap  map[string]*uid.KeyEntry
 	sessionStates      map[string]*session.State
 	sessions           map[string]*memSession
@@ -39,6 +41,8 @@ type MemStore struct {
 func New() *MemStore {
 	return &MemStore{
 		privateKeyEntryMap: make(map[string]*uid.KeyEntry),
+		singleUseMap:       make(map[string]bool),
+		usedKeyEntryMap:    make(map[string]*uid.KeyEntry),
 		publicKeyEntryMap:  make(map[string]*uid.KeyEntry),
 		sessionStates:      make(map[string]*session.State),
 		sessions:           make(map[string]*memSession),
@@ -56,6 +60,13 @@ func (ms *MemStore) AddPrivateKeyEntry(ke *uid.KeyEntry) {
 	ms.privateKeyEntryMap[ke.HASH] = ke
 }
 
+// AddSingleUsePrivateKeyEntry adds private KeyEntry of a single-use KeyInit
+// message to memory store.
+func (ms *MemStore) AddSingleUsePrivateKeyEntry(ke *uid.KeyEntry) {
+	ms.privateKeyEntryMap[ke.HASH] = ke
+	ms.singleUseMap[ke.HASH] = true
+}
+
 // AddPublicKeyEntry adds public KeyEntry from identity to memory store.
 func (ms *MemStore) AddPublicKeyEntry(identity string, ke *uid.KeyEntry) {
 	ms.publicKeyEntryMap[identity] = ke
@@ -86,7 +97,7 @@ func (ms *MemStore) StoreSession(
 	if len(send) != len(recv) {
 		return log.Error("memstore: len(send) != len(recv)")
 	}
-	log.Debugf("memstore.StoreSession(): %s", sessionKey)
+	log.Debugf("memstore.StoreSession(): %s", log.Sensitive(sessionKey))
 	s, ok := ms.sessions[sessionKey]
 	if !ok {
 		ms.sessions[sessionKey] = &memSession{
@@ -114,6 +125,9 @@ func (ms *MemStore) HasSession(sessionKey string) bool {
 
 // GetPrivateKeyEntry implemented in memory.
 func (ms *MemStore) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error) {
+	if ke, ok := ms.usedKeyEntryMap[pubKeyHash]; ok {
+		return ke, log.Error(session.ErrKeyEntryUsed)
+	}
 	ke, ok := ms.privateKeyEntryMap[pubKeyHash]
 	if !ok {
 		return nil, log.Error(session.ErrNoKeyEntry)
@@ -121,6 +135,22 @@ func (ms *MemStore) GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error)
 	return ke, nil
 }
 
+// DelPrivateKeyEntry implemented in memory.
+func (ms *MemStore) DelPrivateKeyEntry(pubKeyHash string) error {
+	ke, ok := ms.privateKeyEntryMap[pubKeyHash]
+	if !ok || !ms.singleUseMap[pubKeyHash] {
+		return nil
+	}
+	// keep public KeyEntry
+	pub, err := uid.NewJSONKeyEntry(ke.JSON())
+	if err != nil {
+		return err
+	}
+	ms.usedKeyEntryMap[pubKeyHash] = pub
+	delete(ms.privateKeyEntryMap, pubKeyHash)
+	return nil
+}
+
 // GetPublicKeyEntry implemented in memory.
 func (ms *MemStore) GetPublicKeyEntry(uidMsg *uid.Message) (*uid.KeyEntry, string, error) {
 	ke, ok := ms.publicKeyEntryMap[uidMsg.Identity()]
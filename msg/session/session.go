@@ -79,7 +79,13 @@ type Store interface {
 	// GetPublicKeyInit returns the private KeyEntry contained in the KeyInit
 	// message with the given pubKeyHash.
 	// If no such KeyEntry is available, ErrNoKeyEntry is returned.
+	// If the private key has been deleted with DelPrivateKeyEntry, the public
+	// KeyEntry is returned together with ErrKeyEntryUsed.
 	GetPrivateKeyEntry(pubKeyHash string) (*uid.KeyEntry, error)
+	// DelPrivateKeyEntry deletes the private key of the KeyEntry with the
+	// given pubKeyHash, if it is contained in a single-use KeyInit message.
+	// Private keys of fallback KeyInit messages are kept.
+	DelPrivateKeyEntry(pubKeyHash string) error
 	// GetPrivateKeyInit returns a public KeyEntry and NYMADDRESS contained in
 	// the KeyInit message for the given uidMsg.
 	// If no such KeyEntry is available, ErrNoKeyEntry is returned.
@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msg
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"io"
+
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid"
+)
+
+// VerifySignature verifies the base64 encoded signature sig (as returned by
+// Decrypt) of the decrypted message content read from r. The signature must
+// have been made with the message signing key of the sender UID message (see
+// uid.Message.MsgSigPubKey32). The content is hashed incrementally, so large
+// messages can be verified with constant memory.
+func VerifySignature(sender *uid.Message, r io.Reader, sig string) error {
+	sigBuf, err := base64.Decode(sig)
+	if err != nil {
+		return err
+	}
+	if len(sigBuf) != ed25519.SignatureSize {
+		return log.Error(ErrWrongSignatureLength)
+	}
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return log.Error(err)
+	}
+	return verifySignature(sender, h.Sum(nil), sigBuf)
+}
+
+// verifySignature verifies the signature sig of contentHash with the message
+// signing key of the sender UID message.
+func verifySignature(sender *uid.Message, contentHash, sig []byte) error {
+	if !ed25519.Verify(sender.MsgSigPubKey32()[:], contentHash, sig) {
+		return log.Error(ErrInvalidSignature)
+	}
+	return nil
+}
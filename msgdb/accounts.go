@@ -256,3 +256,89 @@ func (msgDB *MsgDB) GetAccountTime(
 	}
 	return loadTime, nil
 }
+
+// DelAccount deletes the account for the given myID and contactID
+// combination.
+func (msgDB *MsgDB) DelAccount(myID, contactID string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if contactID != "" {
+		if err := identity.IsMapped(contactID); err != nil {
+			return log.Error(err)
+		}
+	}
+	// get MyID
+	var mID int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return log.Error(err)
+	}
+	// get ContactID
+	var cID int
+	if contactID != "" {
+		err := msgDB.getContactUIDQuery.QueryRow(mID, contactID).Scan(&cID)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	// delete account
+	if _, err := msgDB.delAccountQuery.Exec(mID, cID); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// ReplaceAccount atomically replaces the account for the given myID and
+// contactID combination (contactID can be nil) with the account with given
+// privkey on server. An existing account is deleted, otherwise the account is
+// added.
+func (msgDB *MsgDB) ReplaceAccount(
+	myID, contactID string,
+	privkey *[ed25519.PrivateKeySize]byte,
+	server string,
+	secret *[64]byte,
+	minDelay, maxDelay int32,
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if contactID != "" {
+		if err := identity.IsMapped(contactID); err != nil {
+			return log.Error(err)
+		}
+	}
+	// get MyID
+	var mID int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return log.Error(err)
+	}
+	// get ContactID
+	var cID int
+	if contactID != "" {
+		err := msgDB.getContactUIDQuery.QueryRow(mID, contactID).Scan(&cID)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	// replace account
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(msgDB.delAccountQuery).Exec(mID, cID); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(msgDB.addAccountQuery).Exec(mID, cID,
+		base64.Encode(privkey[:]), server, base64.Encode(secret[:]), minDelay,
+		maxDelay, 0, 0)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
@@ -50,7 +50,9 @@ func TestAccount(t *testing.T) {
 	if _, err := io.ReadFull(cipher.RandReader, secret2[:]); err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddAccount(a, "", privkey1, server1, &secret1,
+	var key1 [ed25519.PrivateKeySize]byte
+	copy(key1[:], privkey1)
+	err = msgDB.AddAccount(a, "", &key1, server1, &secret1,
 		def.MinMinDelay, def.MinMaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -66,7 +68,9 @@ func TestAccount(t *testing.T) {
 			t.Error("contacts[0] != \"\"")
 		}
 	}
-	err = msgDB.AddAccount(a, b, privkey2, server2, &secret2,
+	var key2 [ed25519.PrivateKeySize]byte
+	copy(key2[:], privkey2)
+	err = msgDB.AddAccount(a, b, &key2, server2, &secret2,
 		def.MinMinDelay, def.MinMaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -154,3 +158,95 @@ func TestAccount(t *testing.T) {
 		t.Error("t2 != d365")
 	}
 }
+
+func TestDelAccount(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	if err := msgDB.AddNym(a, a, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	_, privkey, err := ed25519.GenerateKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk [ed25519.PrivateKeySize]byte
+	copy(pk[:], privkey)
+	var secret [64]byte
+	if _, err := io.ReadFull(cipher.RandReader, secret[:]); err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.AddAccount(a, "", &pk, "accounts001.mute.berlin", &secret,
+		def.MinMinDelay, def.MinMaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.DelAccount(a, ""); err != nil {
+		t.Fatal(err)
+	}
+	contacts, err := msgDB.GetAccounts(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 0 {
+		t.Error("account not deleted")
+	}
+}
+
+func TestReplaceAccount(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	var pk [ed25519.PrivateKeySize]byte
+	var secret [64]byte
+	if _, err := io.ReadFull(cipher.RandReader, secret[:]); err != nil {
+		t.Fatal(err)
+	}
+	// add account
+	err = msgDB.ReplaceAccount(a, b, &pk, "accounts001.mute.berlin", &secret,
+		def.MinMinDelay, def.MinMaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetAccountLastMsg(a, b, 10); err != nil {
+		t.Fatal(err)
+	}
+	// replace account
+	err = msgDB.ReplaceAccount(a, b, &pk, "accounts002.mute.berlin", &secret,
+		def.MinMinDelay, def.MinMaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts, err := msgDB.GetAccounts(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0] != b {
+		t.Errorf("wrong accounts: %v", contacts)
+	}
+	_, server, _, _, _, lastMessageTime, err := msgDB.GetAccount(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "accounts002.mute.berlin" {
+		t.Errorf("wrong server: %s", server)
+	}
+	if lastMessageTime != 0 {
+		t.Error("last message time not reset")
+	}
+}
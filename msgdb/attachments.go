@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	AttachID int64  // the attachment ID
+	Filename string // original filename of attachment
+	Data     []byte // the actual attachment data (nil, if deleted)
+	Deleted  bool   // the attachment has been deleted
+}
+
+// addAttachments adds the given attachments to the message msgNum of the nym
+// with UID self within transaction tx.
+func (msgDB *MsgDB) addAttachments(
+	tx *sql.Tx,
+	self, msgNum int64,
+	attachments []*Attachment,
+) error {
+	for _, attachment := range attachments {
+		_, err := tx.Stmt(msgDB.addAttachmentQuery).Exec(self, msgNum,
+			attachment.Filename, attachment.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAttachments returns all attachments of the message msgNum of user myID.
+func (msgDB *MsgDB) GetAttachments(
+	myID string,
+	msgNum int64,
+) ([]*Attachment, error) {
+	self, err := msgDB.getMessageSelf(myID, msgNum)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := msgDB.getAttachmentsQuery.Query(self, msgNum)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var attachments []*Attachment
+	for rows.Next() {
+		var (
+			a Attachment
+			d int64
+		)
+		if err := rows.Scan(&a.AttachID, &a.Filename, &a.Data, &d); err != nil {
+			return nil, log.Error(err)
+		}
+		if d > 0 {
+			a.Deleted = true
+		}
+		attachments = append(attachments, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return attachments, nil
+}
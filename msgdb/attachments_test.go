@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestAttachments(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddNym(b, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	attachments := []*Attachment{
+		{Filename: "a.txt", Data: []byte("hello")},
+		{Filename: "b.bin", Data: []byte{0, 1, 2}},
+	}
+	now := times.Now()
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", attachments, false,
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := msgDB.GetAttachments(a, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("len(res) != 2 == %d", len(res))
+	}
+	for i, attachment := range res {
+		if attachment.Filename != attachments[i].Filename {
+			t.Errorf("wrong filename: %s", attachment.Filename)
+		}
+		if !bytes.Equal(attachment.Data, attachments[i].Data) {
+			t.Errorf("wrong data for %s", attachment.Filename)
+		}
+		if attachment.Deleted {
+			t.Error("attachment should not be deleted")
+		}
+	}
+	if _, err := msgDB.GetAttachments(b, 1); err == nil {
+		t.Error("should fail")
+	}
+	// deleting the message also deletes the attachments
+	if err := msgDB.DelMessage(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgDB.GetAttachments(a, 1); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// getChunks returns the parts of the message with messageID of the nym with
+// UID self in order, if all count many chunks have been received. Otherwise
+// nil is returned.
+func getChunks(
+	tx *sql.Tx,
+	stmt *sql.Stmt,
+	self int64,
+	messageID string,
+) ([]string, error) {
+	rows, err := tx.Stmt(stmt).Query(self, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []string
+	var total uint64
+	for rows.Next() {
+		var (
+			piece uint64
+			count uint64
+			data  string
+		)
+		if err := rows.Scan(&piece, &count, &data); err != nil {
+			return nil, err
+		}
+		if piece != uint64(len(parts))+1 {
+			return nil, nil // missing or duplicate piece
+		}
+		parts = append(parts, data)
+		total = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if total == 0 || uint64(len(parts)) != total {
+		return nil, nil
+	}
+	return parts, nil
+}
+
+// AddChunk adds the piece of count many chunks of the message with
+// messageID contained in the inqueue entry with index iqIdx. If the message
+// is complete afterwards, the parts of the message are returned in order
+// and the inqueue entry is kept (to be replaced by the reassembled message
+// with RemoveInQueue). Otherwise the inqueue entry is removed and nil is
+// returned. Chunks which have already been received are ignored. If the piece
+// is out of range or count differs from the chunks received before,
+// ErrInvalidChunk is returned and the inqueue entry is kept.
+func (msgDB *MsgDB) AddChunk(
+	iqIdx int64,
+	messageID string,
+	piece, count uint64,
+	chunk string,
+) ([]string, error) {
+	if messageID == "" {
+		return nil, log.Error(ErrNilMessageID)
+	}
+	if piece < 1 || piece > count {
+		log.Errorf("msgdb: invalid chunk %d of %d", piece, count)
+		return nil, ErrInvalidChunk
+	}
+	var mID int64
+	var cID int64
+	var date int64
+	err := msgDB.getInQueueIDsQuery.QueryRow(iqIdx).Scan(&mID, &cID, &date)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	// ignore duplicate chunks
+	rows, err := tx.Stmt(msgDB.getChunksQuery).Query(mID, messageID)
+	if err != nil {
+		tx.Rollback()
+		return nil, log.Error(err)
+	}
+	var known bool
+	for rows.Next() {
+		var (
+			p    uint64
+			c    uint64
+			data string
+		)
+		if err := rows.Scan(&p, &c, &data); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, log.Error(err)
+		}
+		if c != count {
+			rows.Close()
+			tx.Rollback()
+			log.Errorf("msgdb: chunk count %d of message %s differs from %d",
+				count, messageID, c)
+			return nil, ErrInvalidChunk
+		}
+		if p == piece {
+			known = true
+		}
+	}
+	rows.Close()
+	if !known {
+		_, err = tx.Stmt(msgDB.addChunkQuery).Exec(mID, messageID, piece, count,
+			date, chunk)
+		if err != nil {
+			tx.Rollback()
+			return nil, log.Error(err)
+		}
+	}
+	parts, err := getChunks(tx, msgDB.getChunksQuery, mID, messageID)
+	if err != nil {
+		tx.Rollback()
+		return nil, log.Error(err)
+	}
+	if parts == nil {
+		if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
+			tx.Rollback()
+			return nil, log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, log.Error(err)
+	}
+	return parts, nil
+}
+
+// ExpireChunks deletes all chunks received before the given time (incomplete
+// messages which will never be completed). It returns the number of deleted
+// chunks.
+func (msgDB *MsgDB) ExpireChunks(before int64) (int64, error) {
+	res, err := msgDB.expireChunksQuery.Exec(before)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	return n, nil
+}
+
+// DelChunks deletes all chunks of the message with messageID for user myID.
+func (msgDB *MsgDB) DelChunks(myID, messageID string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	if _, err := msgDB.delChunksQuery.Exec(self, messageID); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestChunks(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	for i := 0; i < 3; i++ {
+		if err := msgDB.AddInQueue(a, b, now, "envelope"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messageID := "id@mute.berlin"
+	// invalid chunk
+	if _, err := msgDB.AddChunk(3, messageID, 3, 2, "c"); err != ErrInvalidChunk {
+		t.Errorf("AddChunk() = %v, want %v", err, ErrInvalidChunk)
+	}
+	// second chunk first
+	parts, err := msgDB.AddChunk(3, messageID, 2, 2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts != nil {
+		t.Error("parts != nil")
+	}
+	// duplicate chunk
+	parts, err = msgDB.AddChunk(2, messageID, 2, 2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts != nil {
+		t.Error("parts != nil")
+	}
+	// message complete
+	parts, err = msgDB.AddChunk(1, messageID, 1, 2, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parts, []string{"a", "b"}) {
+		t.Errorf("parts = %v, want [a b]", parts)
+	}
+	// only the inqueue entry of the last chunk remains
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iqIdx != 1 {
+		t.Errorf("iqIdx = %d, want 1", iqIdx)
+	}
+	if err := msgDB.SetInQueue(iqIdx, "encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.RemoveInQueue(iqIdx, "ab", messageID, "", b, SigStatusUnsigned, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chunks have been removed with the inqueue entry
+	if err := msgDB.AddInQueue(a, b, now, "envelope"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err = msgDB.AddChunk(iqIdx, messageID, 1, 2, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts != nil {
+		t.Error("parts != nil")
+	}
+	// chunk count differs from first chunk
+	if err := msgDB.AddInQueue(a, b, now, "envelope"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err = msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgDB.AddChunk(iqIdx, messageID, 2, 3, "b"); err != ErrInvalidChunk {
+		t.Errorf("AddChunk() = %v, want %v", err, ErrInvalidChunk)
+	}
+	// expire incomplete message
+	n, err := msgDB.ExpireChunks(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("ExpireChunks() = %d, want 0", n)
+	}
+	n, err = msgDB.ExpireChunks(now + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("ExpireChunks() = %d, want 1", n)
+	}
+	if err := msgDB.DelChunks(a, messageID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -150,6 +150,164 @@ func (msgDB *MsgDB) GetContacts(myID string, blocked bool) ([]string, error) {
 	return contacts, nil
 }
 
+// GetFavorites retrieves all favorite contacts (white listed only) for the
+// given myID user ID.
+func (msgDB *MsgDB) GetFavorites(myID string) ([]string, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return nil, log.Error(err)
+	}
+	// get favorites
+	rows, err := msgDB.getFavoritesQuery.Query(uid)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var contacts []string
+	defer rows.Close()
+	for rows.Next() {
+		var unmappedID, fullName string
+		if err := rows.Scan(&unmappedID, &fullName); err != nil {
+			return nil, log.Error(err)
+		}
+		if fullName == "" {
+			contacts = append(contacts, unmappedID)
+		} else {
+			contacts = append(contacts, fullName+" <"+unmappedID+">")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return contacts, nil
+}
+
+// IsFavorite returns true, if contactID is a favorite contact of myID.
+func (msgDB *MsgDB) IsFavorite(myID, contactID string) (bool, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return false, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return false, log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return false, log.Error(err)
+	}
+	var favorite int64
+	err := msgDB.getFavoriteQuery.QueryRow(uid, contactID).Scan(&favorite)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, log.Error(err)
+	}
+	return favorite > 0, nil
+}
+
+// SetFavorite marks the contact contactID of myID as favorite (or as normal
+// contact, if favorite is false).
+func (msgDB *MsgDB) SetFavorite(myID, contactID string, favorite bool) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return log.Error(err)
+	}
+	var f int64
+	if favorite {
+		f = 1
+	}
+	res, err := msgDB.setFavoriteQuery.Exec(f, uid, contactID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown contact %s for user ID %s",
+			contactID, myID)
+	}
+	return nil
+}
+
+// GetContactDelays returns the delay bounds configured for the contact
+// contactID of myID. If no delay bounds are configured (or the contact is
+// unknown), 0 is returned for both and the account defaults apply.
+func (msgDB *MsgDB) GetContactDelays(myID, contactID string) (
+	minDelay, maxDelay int32,
+	err error,
+) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	err = msgDB.getContactDelaysQuery.QueryRow(uid, contactID).Scan(&minDelay,
+		&maxDelay)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, 0, nil
+	case err != nil:
+		return 0, 0, log.Error(err)
+	}
+	return minDelay, maxDelay, nil
+}
+
+// SetContactDelays sets the delay bounds for the contact contactID of myID.
+// Setting both to 0 resets the delay bounds to the account defaults.
+func (msgDB *MsgDB) SetContactDelays(
+	myID, contactID string,
+	minDelay, maxDelay int32,
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	if minDelay < 0 || maxDelay < 0 || (minDelay == 0) != (maxDelay == 0) {
+		return log.Errorf("msgdb: invalid delay bounds %d, %d", minDelay,
+			maxDelay)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.setContactDelaysQuery.Exec(minDelay, maxDelay, uid,
+		contactID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown contact %s for user ID %s",
+			contactID, myID)
+	}
+	return nil
+}
+
 // RemoveContact removes a contact between myID and contactID (normal or
 // blocked) from the msgDB.
 func (msgDB *MsgDB) RemoveContact(myID, contactID string) error {
@@ -180,3 +338,87 @@ func (msgDB *MsgDB) numberOfContacts() (int64, error) {
 	}
 	return num, nil
 }
+
+// GetContactVerified returns the SIGKEYHASH of the contact contactID of myID
+// which has been verified out-of-band, or "" if the contact is unverified.
+func (msgDB *MsgDB) GetContactVerified(myID, contactID string) (string, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return "", log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return "", log.Error(err)
+	}
+	var sigKeyHash string
+	err := msgDB.getContactVerifiedQuery.QueryRow(uid, contactID).Scan(&sigKeyHash)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", log.Error(err)
+	}
+	return sigKeyHash, nil
+}
+
+// SetContactVerified marks the contact contactID of myID as verified for the
+// given sigKeyHash (or as unverified, if sigKeyHash is "").
+func (msgDB *MsgDB) SetContactVerified(myID, contactID, sigKeyHash string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.setContactVerifiedQuery.Exec(sigKeyHash, uid, contactID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown contact %s for user ID %s",
+			contactID, myID)
+	}
+	return nil
+}
+
+// GetVerifiedContacts returns all verified contacts of myID as a map from
+// mapped contact IDs to the verified SIGKEYHASH.
+func (msgDB *MsgDB) GetVerifiedContacts(myID string) (map[string]string, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getVerifiedContactsQuery.Query(uid)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	verified := make(map[string]string)
+	for rows.Next() {
+		var contactID, sigKeyHash string
+		if err := rows.Scan(&contactID, &sigKeyHash); err != nil {
+			return nil, log.Error(err)
+		}
+		verified[contactID] = sigKeyHash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return verified, nil
+}
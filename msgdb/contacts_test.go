@@ -173,6 +173,34 @@ func TestContactList(t *testing.T) {
 	if contacts[0] != a {
 		t.Error("contacts[0] != a")
 	}
+	// mark alice as favorite
+	favorite, err := msgDB.IsFavorite(b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if favorite {
+		t.Error("alice should not be a favorite")
+	}
+	if err := msgDB.SetFavorite(b, a, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetFavorite(b, e, true); err == nil {
+		t.Error("should fail")
+	}
+	favorite, err = msgDB.IsFavorite(b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !favorite {
+		t.Error("alice should be a favorite")
+	}
+	contacts, err = msgDB.GetFavorites(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0] != a {
+		t.Error("alice should be the only favorite")
+	}
 	// block eve for bob
 	if err := msgDB.AddContact(b, e, e, "", BlackList); err != nil {
 		t.Fatal(err)
@@ -224,3 +252,124 @@ func TestContactList(t *testing.T) {
 		t.Error("contacts[0] != a")
 	}
 }
+
+func TestContactDelays(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	// no delay bounds configured
+	minDelay, maxDelay, err := msgDB.GetContactDelays(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minDelay != 0 || maxDelay != 0 {
+		t.Errorf("wrong default delays: %d, %d", minDelay, maxDelay)
+	}
+	// configure delay bounds
+	if err := msgDB.SetContactDelays(a, b, 600, 3600); err != nil {
+		t.Fatal(err)
+	}
+	minDelay, maxDelay, err = msgDB.GetContactDelays(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minDelay != 600 || maxDelay != 3600 {
+		t.Errorf("wrong delays: %d, %d", minDelay, maxDelay)
+	}
+	// editing the contact keeps the delay bounds
+	if err := msgDB.AddContact(a, b, b, "Bobby", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	minDelay, _, err = msgDB.GetContactDelays(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minDelay != 600 {
+		t.Error("delay bounds lost")
+	}
+	// invalid delay bounds and unknown contacts
+	if err := msgDB.SetContactDelays(a, b, 600, 0); err == nil {
+		t.Error("SetContactDelays() should fail for incomplete bounds")
+	}
+	if err := msgDB.SetContactDelays(a, "eve@mute.berlin", 600, 3600); err == nil {
+		t.Error("SetContactDelays() should fail for unknown contact")
+	}
+	// reset
+	if err := msgDB.SetContactDelays(a, b, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	minDelay, maxDelay, err = msgDB.GetContactDelays(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minDelay != 0 || maxDelay != 0 {
+		t.Errorf("delays not reset: %d, %d", minDelay, maxDelay)
+	}
+}
+
+func TestContactVerified(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	// contacts are unverified by default
+	sigKeyHash, err := msgDB.GetContactVerified(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigKeyHash != "" {
+		t.Error("contact should be unverified")
+	}
+	if err := msgDB.SetContactVerified(a, b, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	sigKeyHash, err = msgDB.GetContactVerified(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigKeyHash != "hash" {
+		t.Errorf("wrong verified hash: %s", sigKeyHash)
+	}
+	verified, err := msgDB.GetVerifiedContacts(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verified) != 1 || verified[b] != "hash" {
+		t.Errorf("wrong verified contacts: %v", verified)
+	}
+	if err := msgDB.SetContactVerified(a, "eve@mute.berlin", "hash"); err == nil {
+		t.Error("SetContactVerified() should fail for unknown contact")
+	}
+	// unverify
+	if err := msgDB.SetContactVerified(a, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	verified, err = msgDB.GetVerifiedContacts(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verified) != 0 {
+		t.Errorf("wrong verified contacts: %v", verified)
+	}
+}
@@ -10,3 +10,11 @@ import (
 
 // ErrNilMessageID is returned if the messageID argument is nil.
 var ErrNilMessageID = errors.New("msgdb: messageID nil")
+
+// ErrNewerVersion is returned by Open, if the database has been written by a
+// newer version of msgdb.
+var ErrNewerVersion = errors.New("msgdb: database written by newer version of Mute, please update")
+
+// ErrInvalidChunk is returned by AddChunk, if the chunk does not fit to the
+// chunks of the same message received before (or its piece is out of range).
+var ErrInvalidChunk = errors.New("msgdb: invalid chunk")
@@ -82,9 +82,14 @@ func (msgDB *MsgDB) SetInQueue(iqIdx int64, msg string) error {
 }
 
 // RemoveInQueue remove the entry with index iqIdx from inqueue and adds the
-// descrypted message plainMsg to msgDB (if drop is not true).
+// descrypted message plainMsg to msgDB (if drop is not true). The messageID
+// and inReplyTo are stored for threading (they can be empty), together with
+// the optional attachments and the result of the signature verification
+// sigStatus (SigStatusValid or SigStatusUnsigned). Chunks of the message (see
+// AddChunk) are removed.
 func (msgDB *MsgDB) RemoveInQueue(
-	iqIdx int64, plainMsg, fromID string,
+	iqIdx int64, plainMsg, messageID, inReplyTo, fromID, sigStatus string,
+	attachments []*Attachment,
 	drop bool,
 ) error {
 	if err := identity.IsMapped(fromID); err != nil {
@@ -110,17 +115,48 @@ func (msgDB *MsgDB) RemoveInQueue(
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// TODO: handle signatures
 	parts := strings.SplitN(plainMsg, "\n", 2)
 	subject := parts[0]
 	if !drop {
-		_, err = tx.Stmt(msgDB.addMsgQuery).Exec(mID, cID, 0, 0, 0, fromID,
-			to, date, subject, plainMsg, 0, 0, 0)
+		res, err := tx.Stmt(msgDB.addMsgQuery).Exec(mID, cID, 0, 0, 0, fromID,
+			to, date, subject, plainMsg, 0, 0, 0, messageID, inReplyTo)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		msgNum, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		_, err = tx.Stmt(msgDB.setMsgSigStatusQuery).Exec(sigStatus, msgNum)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		if err := msgDB.addAttachments(tx, mID, msgNum, attachments); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		err = indexMessage(tx, mID, msgNum, date, fromID, subject)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		// queue delivery receipt (only for contacts which opted in)
+		_, err = tx.Stmt(msgDB.queueReceiptQuery).Exec(ReceiptDelivered,
+			msgNum, mID)
 		if err != nil {
 			tx.Rollback()
 			return log.Error(err)
 		}
 	}
+	if messageID != "" {
+		if _, err := tx.Stmt(msgDB.delChunksQuery).Exec(mID, messageID); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
 	if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
 		tx.Rollback()
 		return log.Error(err)
@@ -139,3 +175,45 @@ func (msgDB *MsgDB) DelInQueue(iqIdx int64) error {
 	}
 	return nil
 }
+
+// InQueueInfo describes an entry in the inqueue (see ListInQueue).
+type InQueueInfo struct {
+	IQIdx     int64  // index of entry
+	ContactID string // optional mapped contact ID of the account
+	Date      int64  // time when the message was received from muteaccd
+	Envelope  bool   // entry still contains the envelope (from mix)
+	Size      int64  // size of encrypted message (in bytes)
+}
+
+// ListInQueue returns all entries in the inqueue for myID.
+func (msgDB *MsgDB) ListInQueue(myID string) ([]*InQueueInfo, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.listInQueueQuery.Query(mID)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var entries []*InQueueInfo
+	for rows.Next() {
+		var (
+			e   InQueueInfo
+			env int64
+		)
+		err := rows.Scan(&e.IQIdx, &e.ContactID, &e.Date, &env, &e.Size)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		e.Envelope = env > 0
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
@@ -55,7 +55,7 @@ func TestInQueue(t *testing.T) {
 	if err := msgDB.SetInQueue(iqIdx, "encrypted1"); err != nil {
 		t.Fatal(err)
 	}
-	if err := msgDB.RemoveInQueue(iqIdx, "plaintext1", b, false); err != nil {
+	if err := msgDB.RemoveInQueue(iqIdx, "plaintext1", "", "", b, SigStatusValid, nil, false); err != nil {
 		t.Fatal(err)
 	}
 	iqIdx, myID, contactID, msg2, env, err := msgDB.GetInQueue()
@@ -55,3 +55,69 @@ func TestKeyValueStore(t *testing.T) {
 		t.Error("getting undefined key should return empty value")
 	}
 }
+
+func TestNetworkProfile(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	profile, err := msgDB.GetNetworkProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile != ProfileNormal {
+		t.Errorf("profile = %q, want %q", profile, ProfileNormal)
+	}
+	if err := msgDB.SetNetworkProfile(ProfileConstrained); err != nil {
+		t.Fatal(err)
+	}
+	profile, err = msgDB.GetNetworkProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile != ProfileConstrained {
+		t.Errorf("profile = %q, want %q", profile, ProfileConstrained)
+	}
+	if err := msgDB.SetNetworkProfile("foo"); err == nil {
+		t.Error("setting unknown profile should fail")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	proxyURL, domainProxies, err := msgDB.GetProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL != "" || domainProxies != "" {
+		t.Error("proxy should not be configured")
+	}
+	err = msgDB.SetProxy("socks5://127.0.0.1:9050", "mute.berlin=direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, domainProxies, err = msgDB.GetProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL != "socks5://127.0.0.1:9050" || domainProxies != "mute.berlin=direct" {
+		t.Errorf("wrong proxy configuration: %s %s", proxyURL, domainProxies)
+	}
+	if err := msgDB.SetProxy("", ""); err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, _, err = msgDB.GetProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL != "" {
+		t.Error("proxy should be removed")
+	}
+}
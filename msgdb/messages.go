@@ -6,6 +6,7 @@ package msgdb
 
 import (
 	"database/sql"
+	"sort"
 	"strings"
 
 	"github.com/mutecomm/mute/log"
@@ -14,11 +15,15 @@ import (
 
 // AddMessage adds message between selfID and peerID to msgDB. If sent is
 // true, it is a sent message. Otherwise a received message.
+// The messageID and the optional inReplyTo are used for threading (see
+// GetThread). The optional attachments are stored with the message.
 func (msgDB *MsgDB) AddMessage(
 	selfID, peerID string,
 	date int64,
 	sent bool,
 	message string,
+	messageID, inReplyTo string,
+	attachments []*Attachment,
 	sign bool,
 	minDelay, maxDelay int32,
 ) error {
@@ -59,14 +64,334 @@ func (msgDB *MsgDB) AddMessage(
 	}
 	parts := strings.SplitN(message, "\n", 2)
 	subject := parts[0]
-	_, err = msgDB.addMsgQuery.Exec(self, peer, d, d, 0, from, to, date,
-		subject, message, s, minDelay, maxDelay)
+	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
+	res, err := tx.Stmt(msgDB.addMsgQuery).Exec(self, peer, d, d, 0, from, to,
+		date, subject, message, s, minDelay, maxDelay, messageID, inReplyTo)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	msgNum, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := msgDB.addAttachments(tx, self, msgNum, attachments); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := indexMessage(tx, self, msgNum, date, from, subject); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// AddMultiMessage adds a message from selfID to the recipients to and cc
+// (mapped IDs, 'To:' and 'Cc:' recipients) to msgDB. Every recipient gets its
+// own copy of the message with the same messageID, which is encrypted and
+// delivered separately and tracks the delivery status for that recipient (see
+// GetRecipientStatus). All copies record the complete recipient lists.
+// If sendAfter is set, the message is not sent before that time (see
+// GetUndeliveredMessage).
+func (msgDB *MsgDB) AddMultiMessage(
+	selfID string,
+	to, cc []string,
+	date int64,
+	message string,
+	messageID, inReplyTo string,
+	attachments []*Attachment,
+	sign bool,
+	minDelay, maxDelay int32,
+	sendAfter int64,
+) error {
+	if err := identity.IsMapped(selfID); err != nil {
+		return log.Error(err)
+	}
+	if len(to) == 0 {
+		return log.Error("msgdb: no 'To:' recipient")
+	}
+	if messageID == "" {
+		return log.Error(ErrNilMessageID)
+	}
+	recipients := append(append([]string(nil), to...), cc...)
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		if err := identity.IsMapped(recipient); err != nil {
+			return log.Error(err)
+		}
+		if seen[recipient] {
+			return log.Errorf("msgdb: duplicate recipient %s", recipient)
+		}
+		seen[recipient] = true
+	}
+	// get self
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(selfID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	// get peers
+	peers := make([]int64, len(recipients))
+	for i, recipient := range recipients {
+		err := msgDB.getContactUIDQuery.QueryRow(self, recipient).Scan(&peers[i])
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	var s int64
+	if sign {
+		s = 1
+	}
+	parts := strings.SplitN(message, "\n", 2)
+	subject := parts[0]
+	toList := strings.Join(to, ",")
+	ccList := strings.Join(cc, ",")
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	for _, peer := range peers {
+		res, err := tx.Stmt(msgDB.addMultiMsgQuery).Exec(self, peer, selfID,
+			toList, ccList, date, subject, message, s, minDelay, maxDelay,
+			messageID, inReplyTo, sendAfter)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		msgNum, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		if err := msgDB.addAttachments(tx, self, msgNum, attachments); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+		if err := indexMessage(tx, self, msgNum, date, selfID, subject); err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
 	return nil
 }
 
+// ImportMessage adds the imported message between selfID and peerID to msgDB.
+// If sent is true, it is a sent message. Otherwise a received message. The
+// recipient lists to and cc are optional (defaults to the recipient). In
+// contrast to AddMessage sent messages are not queued for delivery and the
+// read and star flags can be set.
+func (msgDB *MsgDB) ImportMessage(
+	selfID, peerID string,
+	to, cc []string,
+	date int64,
+	sent bool,
+	message string,
+	messageID, inReplyTo string,
+	attachments []*Attachment,
+	read, star bool,
+) error {
+	if err := identity.IsMapped(selfID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(peerID); err != nil {
+		return log.Error(err)
+	}
+	// get self
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(selfID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	// get peer
+	var peer int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, peerID).Scan(&peer)
+	if err != nil {
+		return log.Error(err)
+	}
+	var d, r, s int64
+	if sent {
+		d = 1
+	}
+	if read {
+		r = 1
+	}
+	if star {
+		s = 1
+	}
+	from := peerID
+	toList := selfID
+	if sent {
+		from = selfID
+		toList = peerID
+	}
+	if len(to) > 0 {
+		toList = strings.Join(to, ",")
+	}
+	subject := strings.SplitN(message, "\n", 2)[0]
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.importMsgQuery).Exec(self, peer, d, d, from,
+		toList, strings.Join(cc, ","), date, subject, message, r, s, messageID,
+		inReplyTo)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	msgNum, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := msgDB.addAttachments(tx, self, msgNum, attachments); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := indexMessage(tx, self, msgNum, date, from, subject); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// HasMessageID returns true, if user myID has a message with the given
+// messageID (used to deduplicate imports).
+func (msgDB *MsgDB) HasMessageID(myID, messageID string) (bool, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return false, log.Error(err)
+	}
+	if messageID == "" {
+		return false, log.Error(ErrNilMessageID)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return false, log.Error(err)
+	}
+	var exists int64
+	err := msgDB.hasMessageIDQuery.QueryRow(self, messageID).Scan(&exists)
+	if err != nil {
+		return false, log.Error(err)
+	}
+	return exists > 0, nil
+}
+
+// GetMessageRecipients returns the 'To:' and 'Cc:' recipients (mapped IDs)
+// of the message from user myID with the given msgNum.
+func (msgDB *MsgDB) GetMessageRecipients(
+	myID string,
+	msgNum int64,
+) (to, cc []string, err error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, nil, log.Error(err)
+	}
+	var toList, ccList string
+	err = msgDB.getMsgRecipientsQuery.QueryRow(msgNum, self).Scan(&toList,
+		&ccList)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil, log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	case err != nil:
+		return nil, nil, log.Error(err)
+	}
+	if toList != "" {
+		to = strings.Split(toList, ",")
+	}
+	if ccList != "" {
+		cc = strings.Split(ccList, ",")
+	}
+	return
+}
+
+// Delivery states of a recipient (see RecipientStatus).
+const (
+	RecipientPending   = "pending"   // message still has to be encrypted
+	RecipientQueued    = "queued"    // encrypted message is in outqueue
+	RecipientSent      = "sent"      // message has been delivered to the mix
+	RecipientCancelled = "cancelled" // message has been dropped from outqueue
+)
+
+// RecipientStatus is the delivery status of a sent message for a single
+// recipient (see GetRecipientStatus).
+type RecipientStatus struct {
+	MsgNum    int64  // message number of the recipient's copy
+	Recipient string // mapped ID of the recipient
+	Status    string // delivery state (RecipientPending, RecipientQueued, ...)
+}
+
+// GetRecipientStatus returns the delivery status of every recipient of the
+// sent message from user myID with the given msgNum (which can be the
+// message number of any of the copies, see AddMultiMessage).
+func (msgDB *MsgDB) GetRecipientStatus(
+	myID string,
+	msgNum int64,
+) ([]*RecipientStatus, error) {
+	messageID, _, err := msgDB.GetMessageHeader(myID, msgNum)
+	if err != nil {
+		return nil, err
+	}
+	if messageID == "" {
+		return nil, log.Errorf("msgdb: message %d has no message ID", msgNum)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getRecipientStatusQuery.Query(self, messageID)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var status []*RecipientStatus
+	for rows.Next() {
+		var (
+			rs                    RecipientStatus
+			toSend, sent, inQueue int64
+		)
+		err := rows.Scan(&rs.MsgNum, &rs.Recipient, &toSend, &sent, &inQueue)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		switch {
+		case sent > 0:
+			rs.Status = RecipientSent
+		case toSend > 0:
+			rs.Status = RecipientPending
+		case inQueue > 0:
+			rs.Status = RecipientQueued
+		default:
+			rs.Status = RecipientCancelled
+		}
+		status = append(status, &rs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	if len(status) == 0 {
+		return nil, log.Errorf("msgdb: message %d is not a sent message", msgNum)
+	}
+	return status, nil
+}
+
 // GetMessage returns the message from user myID with the given msgNum.
 func (msgDB *MsgDB) GetMessage(
 	myID string,
@@ -141,6 +466,51 @@ func (msgDB *MsgDB) GetMessage(
 	return
 }
 
+// Signature states of messages (see GetMessageSigStatus).
+const (
+	SigStatusValid      = "valid"      // received message: signature verified successfully
+	SigStatusUnsigned   = "unsigned"   // message was not signed by the sender
+	SigStatusSigned     = "signed"     // sent message: signed by us
+	SigStatusUnverified = "unverified" // received message stored before signatures were recorded
+)
+
+// GetMessageSigStatus returns the signature state of the message from user
+// myID with the given msgNum. For received messages it is the result of the
+// signature verification recorded by RemoveInQueue.
+func (msgDB *MsgDB) GetMessageSigStatus(myID string, msgNum int64) (string, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", log.Error(err)
+	}
+	var (
+		self      int64
+		direction int64
+		sign      int64
+		sigStatus string
+	)
+	err := msgDB.getMsgSigQuery.QueryRow(msgNum).Scan(&self, &direction, &sign,
+		&sigStatus)
+	if err != nil {
+		return "", log.Error(err)
+	}
+	var selfID string
+	if err := msgDB.getNymMappedQuery.QueryRow(self).Scan(&selfID); err != nil {
+		return "", log.Error(err)
+	}
+	if myID != selfID {
+		return "", log.Error("msgdb: unknown message")
+	}
+	if direction == 1 {
+		if sign != 0 {
+			return SigStatusSigned, nil
+		}
+		return SigStatusUnsigned, nil
+	}
+	if sigStatus == "" {
+		return SigStatusUnverified, nil
+	}
+	return sigStatus, nil
+}
+
 // ReadMessage sets the message with the given msgNum as read.
 func (msgDB *MsgDB) ReadMessage(msgNum int64) error {
 	if _, err := msgDB.readMsgQuery.Exec(msgNum); err != nil {
@@ -149,6 +519,64 @@ func (msgDB *MsgDB) ReadMessage(msgNum int64) error {
 	return nil
 }
 
+// StarMessage sets the star of the message from user myID with the given
+// msgNum (or removes it, if star is false).
+func (msgDB *MsgDB) StarMessage(myID string, msgNum int64, star bool) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	var st int64
+	if star {
+		st = 1
+	}
+	res, err := msgDB.starMsgQuery.Exec(st, msgNum, self)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	}
+	return nil
+}
+
+// ArchiveMessage archives the message from user myID with the given msgNum
+// (or moves it back from the archive, if archive is false).
+func (msgDB *MsgDB) ArchiveMessage(myID string, msgNum int64, archive bool) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	var a int64
+	if archive {
+		a = 1
+	}
+	res, err := msgDB.archiveMsgQuery.Exec(a, msgNum, self)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	}
+	return nil
+}
+
 // DelMessage deletes the message from user myID with the given msgNum.
 func (msgDB *MsgDB) DelMessage(myID string, msgNum int64) error {
 	if err := identity.IsMapped(myID); err != nil {
@@ -158,31 +586,126 @@ func (msgDB *MsgDB) DelMessage(myID string, msgNum int64) error {
 	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
 		return log.Error(err)
 	}
-	res, err := msgDB.delMsgQuery.Exec(msgNum, self)
+	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
+	_, err = tx.Stmt(msgDB.delAttachmentsQuery).Exec(msgNum, self)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.delMsgQuery).Exec(msgNum, self)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
 	n, err := res.RowsAffected()
 	if err != nil {
 		return log.Error(err)
 	}
 	if n < 1 {
+		tx.Rollback()
 		return log.Errorf("msgdb: unknown msgnum %d for user ID %s",
 			msgNum, myID)
 	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
 	return nil
 }
 
+// GetMessageHeader returns the message ID and the optional message ID of the
+// message it replies to for the message from user myID with the given
+// msgNum. Messages stored before threading was supported have an empty
+// messageID.
+func (msgDB *MsgDB) GetMessageHeader(
+	myID string,
+	msgNum int64,
+) (messageID, inReplyTo string, err error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", "", log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return "", "", log.Error(err)
+	}
+	err = msgDB.getMsgHeaderQuery.QueryRow(msgNum, self).Scan(&messageID,
+		&inReplyTo)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", "", log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	case err != nil:
+		return "", "", log.Error(err)
+	}
+	return
+}
+
 // MsgID is the info type that is returned by GetMsgIDs.
 type MsgID struct {
-	MsgID    int64  // the message ID
-	From     string // sender
-	To       string // recipient
-	Incoming bool   // an incoming message, outgoing otherwise
-	Sent     bool   // outgoing message has been sent
-	Date     int64
-	Subject  string
-	Read     bool
+	MsgID     int64  // the message ID
+	From      string // sender
+	To        string // recipient
+	Incoming  bool   // an incoming message, outgoing otherwise
+	Sent      bool   // outgoing message has been sent
+	Date      int64
+	Subject   string
+	Read      bool
+	Star      bool   // message is starred
+	MessageID string // unique message ID ("" for old messages)
+	InReplyTo string // message ID of the message this message replies to
+	Receipt   string // receipt status (see ReceiptDelivered and ReceiptRead)
+	Archive   bool   // message is archived
+	SendAfter int64  // outgoing message is not sent before this time (0: unset)
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMsgID scans a MsgID from a row selected by getMsgsQuery (or a query
+// with the same columns).
+func scanMsgID(row rowScanner) (*MsgID, error) {
+	var (
+		id        int64
+		from      string
+		to        string
+		d         int64
+		s         int64
+		date      int64
+		subject   string
+		r         int64
+		st        int64
+		messageID string
+		inReplyTo string
+		receipt   string
+		a         int64
+		sendAfter int64
+	)
+	err := row.Scan(&id, &from, &to, &d, &s, &date, &subject, &r,
+		&st, &messageID, &inReplyTo, &receipt, &a, &sendAfter)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return &MsgID{
+		MsgID:     id,
+		From:      from,
+		To:        to,
+		Incoming:  d == 0,
+		Sent:      s > 0,
+		Date:      date,
+		Subject:   subject,
+		Read:      r > 0,
+		Star:      st > 0,
+		MessageID: messageID,
+		InReplyTo: inReplyTo,
+		Receipt:   receipt,
+		Archive:   a > 0,
+		SendAfter: sendAfter,
+	}, nil
 }
 
 // GetMsgIDs returns all message IDs (sqlite row IDs) for the user ID myID.
@@ -201,44 +724,11 @@ func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
 	var msgIDs []*MsgID
 	defer rows.Close()
 	for rows.Next() {
-		var (
-			id      int64
-			from    string
-			to      string
-			d       int64
-			s       int64
-			date    int64
-			subject string
-			r       int64
-		)
-		err = rows.Scan(&id, &from, &to, &d, &s, &date, &subject, &r)
+		msgID, err := scanMsgID(rows)
 		if err != nil {
-			return nil, log.Error(err)
+			return nil, err
 		}
-		var (
-			incoming bool
-			sent     bool
-			read     bool
-		)
-		if d == 0 {
-			incoming = true
-		}
-		if s > 0 {
-			sent = true
-		}
-		if r > 0 {
-			read = true
-		}
-		msgIDs = append(msgIDs, &MsgID{
-			MsgID:    id,
-			From:     from,
-			To:       to,
-			Incoming: incoming,
-			Sent:     sent,
-			Date:     date,
-			Subject:  subject,
-			Read:     read,
-		})
+		msgIDs = append(msgIDs, msgID)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, log.Error(err)
@@ -246,9 +736,73 @@ func (msgDB *MsgDB) GetMsgIDs(myID string) ([]*MsgID, error) {
 	return msgIDs, nil
 }
 
+// GetThread returns the conversation the message with the given msgNum of
+// user ID myID belongs to, ordered by date. The thread is determined by
+// following the In-Reply-To references up to the first message and
+// collecting all replies from there. Messages without a message ID form a
+// thread of their own.
+func (msgDB *MsgDB) GetThread(myID string, msgNum int64) ([]*MsgID, error) {
+	msgIDs, err := msgDB.GetMsgIDs(myID)
+	if err != nil {
+		return nil, err
+	}
+	var msg *MsgID
+	byMessageID := make(map[string]*MsgID)
+	replies := make(map[string][]*MsgID)
+	for _, m := range msgIDs {
+		if m.MsgID == msgNum {
+			msg = m
+		}
+		if m.MessageID != "" {
+			byMessageID[m.MessageID] = m
+		}
+		if m.InReplyTo != "" {
+			replies[m.InReplyTo] = append(replies[m.InReplyTo], m)
+		}
+	}
+	if msg == nil {
+		return nil, log.Errorf("msgdb: unknown msgnum %d for user ID %s",
+			msgNum, myID)
+	}
+	if msg.MessageID == "" {
+		return []*MsgID{msg}, nil
+	}
+	// find first message of thread (guard against reference loops)
+	root := msg
+	seen := map[string]bool{root.MessageID: true}
+	for {
+		parent, ok := byMessageID[root.InReplyTo]
+		if !ok || seen[parent.MessageID] {
+			break
+		}
+		seen[parent.MessageID] = true
+		root = parent
+	}
+	// collect all replies
+	thread := []*MsgID{root}
+	added := map[string]bool{root.MessageID: true}
+	for i := 0; i < len(thread); i++ {
+		for _, reply := range replies[thread[i].MessageID] {
+			if reply.MessageID == "" || added[reply.MessageID] {
+				continue
+			}
+			added[reply.MessageID] = true
+			thread = append(thread, reply)
+		}
+	}
+	sort.SliceStable(thread, func(i, j int) bool {
+		if thread[i].Date != thread[j].Date {
+			return thread[i].Date < thread[j].Date
+		}
+		return thread[i].MsgID < thread[j].MsgID
+	})
+	return thread, nil
+}
+
 // GetUndeliveredMessage returns the oldest undelivered message for myID from
-// msgDB.
-func (msgDB *MsgDB) GetUndeliveredMessage(myID string) (
+// msgDB which is due at time now. Messages which must not be sent before a
+// later time (see AddMultiMessage) are ignored.
+func (msgDB *MsgDB) GetUndeliveredMessage(myID string, now int64) (
 	msgNum int64,
 	contactID string,
 	msg []byte,
@@ -265,7 +819,7 @@ func (msgDB *MsgDB) GetUndeliveredMessage(myID string) (
 	}
 	var cID int64
 	var s int64
-	err = msgDB.getUndeliveredMsgQuery.QueryRow(mID).Scan(&msgNum, &cID, &msg,
+	err = msgDB.getUndeliveredMsgQuery.QueryRow(mID, now).Scan(&msgNum, &cID, &msg,
 		&s, &minDelay, &maxDelay)
 	switch {
 	case err == sql.ErrNoRows:
@@ -283,6 +837,31 @@ func (msgDB *MsgDB) GetUndeliveredMessage(myID string) (
 	return
 }
 
+// GetLastMessageDate returns the date of the last message exchanged between
+// myID and contactID. If no message has been exchanged, 0 is returned.
+func (msgDB *MsgDB) GetLastMessageDate(myID, contactID string) (int64, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return 0, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return 0, log.Error(err)
+	}
+	var peer int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, contactID).Scan(&peer)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	var date int64
+	if err := msgDB.getLastMsgDateQuery.QueryRow(self, peer).Scan(&date); err != nil {
+		return 0, log.Error(err)
+	}
+	return date, nil
+}
+
 // numberOfMessages returns the number of messages in msgDB.
 func (msgDB *MsgDB) numberOfMessages() (int64, error) {
 	var num int64
@@ -6,6 +6,7 @@ package msgdb
 
 import (
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/mutecomm/mute/def"
@@ -39,12 +40,12 @@ func TestMessages(t *testing.T) {
 		t.Errorf("num != 0 == %d", num)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddMessage(a, b, now, false, "pong", false,
+	err = msgDB.AddMessage(a, b, now, false, "pong", "", "", nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -56,6 +57,13 @@ func TestMessages(t *testing.T) {
 	if num != 2 {
 		t.Errorf("num != 2 == %d", num)
 	}
+	last, err := msgDB.GetLastMessageDate(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != now {
+		t.Errorf("last != now == %d", last)
+	}
 	ids, err := msgDB.GetMsgIDs(a)
 	if err != nil {
 		t.Fatal(err)
@@ -107,6 +115,42 @@ func TestMessages(t *testing.T) {
 	if err := msgDB.ReadMessage(2); err != nil {
 		t.Error(err)
 	}
+	if err := msgDB.StarMessage(a, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.StarMessage(tr, 2, true); err == nil {
+		t.Error("should fail")
+	}
+	ids, err = msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0].Star || !ids[1].Star {
+		t.Error("only message 2 should be starred")
+	}
+	if err := msgDB.StarMessage(a, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[1].Star {
+		t.Error("message 2 should not be starred")
+	}
+	if err := msgDB.ArchiveMessage(a, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.ArchiveMessage(tr, 1, true); err == nil {
+		t.Error("should fail")
+	}
+	ids, err = msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ids[0].Archive || ids[1].Archive {
+		t.Error("only message 1 should be archived")
+	}
 	if err := msgDB.DelMessage(tr, 1); err == nil {
 		t.Fatal("should fail")
 	}
@@ -120,3 +164,273 @@ func TestMessages(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+func TestThread(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	msgs := []struct {
+		sent      bool
+		date      int64
+		message   string
+		messageID string
+		inReplyTo string
+	}{
+		{true, now, "ping", "id1", ""},
+		{false, now + 2, "pong", "id2", "id1"},
+		{true, now + 3, "other", "id3", ""},
+		{false, now + 1, "ping?", "id4", "id1"},
+		{true, now + 4, "pong!", "id5", "id2"},
+		{true, now + 5, "old", "", ""},
+	}
+	for _, m := range msgs {
+		err := msgDB.AddMessage(a, b, m.date, m.sent, m.message, m.messageID,
+			m.inReplyTo, nil, false, def.MinDelay, def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messageID, inReplyTo, err := msgDB.GetMessageHeader(a, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageID != "id2" || inReplyTo != "id1" {
+		t.Errorf("wrong message header: %s, %s", messageID, inReplyTo)
+	}
+	if _, _, err := msgDB.GetMessageHeader(a, 7); err == nil {
+		t.Error("should fail")
+	}
+	thread, err := msgDB.GetThread(a, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nums []int64
+	for _, m := range thread {
+		nums = append(nums, m.MsgID)
+	}
+	if !reflect.DeepEqual(nums, []int64{1, 4, 2, 5}) {
+		t.Errorf("wrong thread: %v", nums)
+	}
+	thread, err = msgDB.GetThread(a, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 1 || thread[0].MsgID != 6 {
+		t.Error("message without message ID should form its own thread")
+	}
+	if _, err := msgDB.GetThread(a, 7); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestMultiMessage(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, c, c, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMultiMessage(a, []string{b}, []string{b}, now, "hello",
+		"id@mute.berlin", "", nil, false, def.MinDelay, def.MaxDelay, 0)
+	if err == nil {
+		t.Error("AddMultiMessage() should fail for duplicate recipient")
+	}
+	err = msgDB.AddMultiMessage(a, []string{b}, []string{c}, now, "hello",
+		"id@mute.berlin", "", nil, false, def.MinDelay, def.MaxDelay, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, cc, err := msgDB.GetMessageRecipients(a, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(to, []string{b}) || !reflect.DeepEqual(cc, []string{c}) {
+		t.Errorf("wrong recipients: to=%v, cc=%v", to, cc)
+	}
+	// every recipient has its own undelivered copy
+	msgID, peer, _, _, _, _, err := msgDB.GetUndeliveredMessage(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgID != 1 || peer != b {
+		t.Errorf("wrong undelivered message: %d, %s", msgID, peer)
+	}
+	err = msgDB.AddOutQueue(a, 1, "encrypted", "nymaddress", def.MinDelay,
+		def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := msgDB.GetRecipientStatus(a, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 {
+		t.Fatalf("wrong number of recipients: %d", len(status))
+	}
+	if status[0].Recipient != b || status[0].Status != RecipientQueued {
+		t.Errorf("wrong status for %s: %v", b, status[0])
+	}
+	if status[1].Recipient != c || status[1].Status != RecipientPending {
+		t.Errorf("wrong status for %s: %v", c, status[1])
+	}
+	if err := msgDB.RemoveOutQueue(1, now); err != nil {
+		t.Fatal(err)
+	}
+	status, err = msgDB.GetRecipientStatus(a, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[0].Status != RecipientSent {
+		t.Errorf("wrong status for %s: %v", b, status[0])
+	}
+}
+
+func TestImportMessage(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.ImportMessage(a, b, []string{b}, []string{c}, now, true,
+		"sent\nbody", "1@mute.berlin", "", nil, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.ImportMessage(a, b, nil, nil, now, false, "received",
+		"2@mute.berlin", "1@mute.berlin",
+		[]*Attachment{{Filename: "a.txt", Data: []byte("a")}}, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// imported messages are not sent
+	msgID, _, _, _, _, _, err := msgDB.GetUndeliveredMessage(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgID != 0 {
+		t.Errorf("imported message %d should not be delivered", msgID)
+	}
+	ids, err := msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("wrong number of messages: %d", len(ids))
+	}
+	if ids[0].Incoming || !ids[0].Sent || !ids[0].Read || ids[0].Star {
+		t.Errorf("wrong sent message: %+v", ids[0])
+	}
+	if !ids[1].Incoming || ids[1].Read || !ids[1].Star || ids[1].From != b {
+		t.Errorf("wrong received message: %+v", ids[1])
+	}
+	to, cc, err := msgDB.GetMessageRecipients(a, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(to, []string{b}) || !reflect.DeepEqual(cc, []string{c}) {
+		t.Errorf("wrong recipients: to=%v, cc=%v", to, cc)
+	}
+	attachments, err := msgDB.GetAttachments(a, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 {
+		t.Error("attachment missing")
+	}
+	// deduplication
+	has, err := msgDB.HasMessageID(a, "2@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Error("message ID should exist")
+	}
+	has, err = msgDB.HasMessageID(a, "3@mute.berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Error("message ID should not exist")
+	}
+}
+
+func TestSendAfter(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMultiMessage(a, []string{b}, nil, now, "later",
+		"id@mute.berlin", "", nil, false, def.MinDelay, def.MaxDelay, now+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].SendAfter != now+3600 {
+		t.Error("wrong send after time")
+	}
+	// message is not due yet
+	_, peer, _, _, _, _, err := msgDB.GetUndeliveredMessage(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != "" {
+		t.Error("message should not be due")
+	}
+	msgID, peer, _, _, _, _, err := msgDB.GetUndeliveredMessage(a, now+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgID != 1 || peer != b {
+		t.Errorf("wrong undelivered message: %d, %s", msgID, peer)
+	}
+}
@@ -7,18 +7,41 @@ package msgdb
 
 import (
 	"database/sql"
+	"strconv"
 
 	"github.com/mutecomm/mute/encdb"
+	"github.com/mutecomm/mute/log"
 )
 
 // Version is the current msgdb version.
-const Version = "1"
+const Version = "17"
 
 // Entries in KeyValueTable.
 const (
-	DBVersion = "Version"   // version string of msgdb
-	WalletKey = "WalletKey" // 64-byte private Ed25519 wallet key, base64 encoded
-	ActiveUID = "ActiveUID" // the active UID
+	DBVersion     = "Version"       // version string of msgdb
+	WalletKey     = "WalletKey"     // 64-byte private Ed25519 wallet key, base64 encoded
+	ActiveUID     = "ActiveUID"     // the active UID
+	KDFIterations = "KDFIterations" // number of KDF iterations chosen on creation
+
+	// receive policies (see ReceivePolicy)
+	RecvMaxMsgSize        = "RecvMaxMsgSize"        // max. size of received messages (in bytes)
+	RecvMaxAttachments    = "RecvMaxAttachments"    // max. number of attachments of received messages
+	RecvRejectExecutables = "RecvRejectExecutables" // "true": reject messages with executable attachments
+
+	NetworkProfile  = "NetworkProfile"  // the network profile (see SetNetworkProfile)
+	PriceList       = "PriceList"       // cached price list of the service guard (JSON)
+	SyncKey         = "SyncKey"         // 32-byte key shared between devices for 'sync', base64 encoded
+	ReplenishPolicy = "ReplenishPolicy" // low-water marks for wallet replenishment per usage (JSON)
+	ObserverMode    = "ObserverMode"    // "true": decryption-only observer device (see 'sync export --observer')
+	Proxy           = "Proxy"           // SOCKS5 proxy URL (see SetProxy)
+	ProxyDomains    = "ProxyDomains"    // per-domain proxy overrides (see SetProxy)
+	Aliases         = "Aliases"         // command aliases of the interactive mode (JSON)
+	Domains         = "Domains"         // additional service domains (JSON, see def.Domain)
+	AccountRenewals = "AccountRenewals" // consecutive failed account renewals (JSON)
+	WalletKeys      = "WalletKeys"      // archived wallet keys (JSON, see 'wallet rotate')
+	WalletStoreKey  = "WalletStoreKey"  // 32-byte key to encrypt the wallet storage, base64 encoded (see 'wallet encrypt')
+
+	UnverifiedEnvelopes = "UnverifiedEnvelopes" // number of signed envelopes which failed verification
 )
 
 const (
@@ -34,13 +57,9 @@ CREATE TABLE Nyms (
   UnmappedID     TEXT    NOT NULL UNIQUE,
   UpkeepAll      INTEGER NOT NULL DEFAULT 0, -- the last execution of 'upkeep all'
   UpkeepAccounts INTEGER NOT NULL DEFAULT 0, -- the last execution of 'upkeep accounts'
-  FullName       TEXT
+  FullName       TEXT,
+  Signature      TEXT    NOT NULL DEFAULT '' -- signature appended to new messages
 );`
-	/*
-	   TODO: add
-
-	   Favorite   INTEGER NOT NULL, -- 0: normal contact, 1: favorite contact
-	*/
 	createQueryContacts = `
 CREATE TABLE Contacts (
   UID        INTEGER PRIMARY KEY,
@@ -49,6 +68,11 @@ CREATE TABLE Contacts (
   UnmappedID TEXT NOT NULL,
   FullName   TEXT,
   Blocked    INTEGER,          -- 0: white list, 1: gray list, 2: black list
+  Favorite   INTEGER NOT NULL DEFAULT 0, -- 0: normal contact, 1: favorite contact
+  MinDelay   INTEGER NOT NULL DEFAULT 0, -- minimum delay for contact (0: account default)
+  MaxDelay   INTEGER NOT NULL DEFAULT 0, -- maximum delay for contact (0: account default)
+  Receipts   INTEGER NOT NULL DEFAULT 0, -- 1: exchange delivery/read receipts with contact (opt-in)
+  Verified   TEXT    NOT NULL DEFAULT '', -- SIGKEYHASH verified out-of-band ('': unverified)
   UNIQUE     (MyID, MappedID), -- the combination of nym and contact must be unique
   FOREIGN KEY(MyID) REFERENCES Nyms(UID) ON DELETE CASCADE
 );`
@@ -70,9 +94,6 @@ CREATE TABLE Accounts (
 	/*
 	   TODO: add
 
-	   Message-ID  TEXT    NOT NULL, -- a unique message ID for sender (must start with 'nym-')
-	   In-Reply-To TEXT,             -- message ID of the message this message is a reply to, if any
-	   Archive     INTEGER NOT NULL, -- 1: message is archived
 	   Trash       INTEGER NOT NULL, -- 1: message is deleted
 	*/
 	createQueryMessages = `
@@ -84,8 +105,7 @@ CREATE TABLE Messages (
   ToSend      INTEGER NOT NULL, -- 1: message still has to be encrypted and added to out queue
   Sent        INTEGER NOT NULL, -- 0: message pending or received message, 1: message has been sent
   "From"      TEXT    NOT NULL, -- sender nym
-  "To"        TEXT    NOT NULL, -- comma separated list of recipient nyms (first
-                                -- one is 'To:', the optional following ones 'Cc:')
+  "To"        TEXT    NOT NULL, -- comma separated list of 'To:' recipient nyms
   Date        INTEGER NOT NULL, -- date of the message (not transferred!)
                                 -- for sent messages: delivery time to mix + minDelay
                                 -- for received messages: time muteaccd received the message
@@ -95,7 +115,19 @@ CREATE TABLE Messages (
   MinDelay    INTEGER NOT NULL, -- minimum delay of message
   MaxDelay    INTEGER NOT NULL, -- maximum delay of message
   Read        INTEGER NOT NULL, -- 0: message is new, 1: message read
-  Star        INTEGER NOT NULL,
+  Star        INTEGER NOT NULL, -- 0: normal message, 1: starred message
+  MessageID   TEXT    NOT NULL DEFAULT '', -- unique message ID (see msg/msgid), '' for old messages
+  InReplyTo   TEXT    NOT NULL DEFAULT '', -- message ID of the message this message is a reply to, if any
+  Cc          TEXT    NOT NULL DEFAULT '', -- comma separated list of 'Cc:' recipient nyms
+                                           -- (sent messages have one row per recipient,
+                                           -- see AddMultiMessage)
+  Receipt       TEXT NOT NULL DEFAULT '', -- sent messages: receipt status received from peer,
+                                          -- received messages: receipt status sent to peer
+  ReceiptToSend TEXT NOT NULL DEFAULT '', -- received messages: receipt status still to send
+  Archive     INTEGER NOT NULL DEFAULT 0, -- 1: message is archived
+  SendAfter   INTEGER NOT NULL DEFAULT 0, -- outgoing messages: do not send before this time
+  SigStatus   TEXT    NOT NULL DEFAULT '', -- received messages: result of signature verification
+                                           -- (see SigStatusValid), '' for old messages
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
   FOREIGN KEY(Peer) REFERENCES Contacts(UID)
 );`
@@ -118,6 +150,7 @@ CREATE TABLE Chunks (
   Piece     INTEGER NOT NULL, -- piece m of n chunks
   Count     INTEGER NOT NULL, -- total number of chunks (n)
   Date      INTEGER NOT NULL, -- time when the chunk was received from muteaccd
+  Data      TEXT    NOT NULL DEFAULT '', -- the content of the chunk
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
 );`
 	createQueryOutQueue = ` 
@@ -131,6 +164,9 @@ CREATE TABLE Chunks (
   MaxDelay   INTEGER NOT NULL, -- maximum delay of message
   Envelope   INTEGER NOT NULL, -- 0: basic encrypted message, 1: with envelope and ready to send
   Resend     INTEGER NOT NULL, -- 0: process message normally, 1: message needs resend
+  Attempts    INTEGER NOT NULL DEFAULT 0, -- number of failed delivery attempts
+  NextAttempt INTEGER NOT NULL DEFAULT 0, -- time before which delivery is postponed
+  Receipt     TEXT    NOT NULL DEFAULT '', -- receipt status, if entry is a receipt for received message MsgID
   FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
   FOREIGN KEY(MsgID) REFERENCES Messages(MsgID) ON DELETE CASCADE
 );`
@@ -152,9 +188,71 @@ CREATE TABLE MessageIDCache(
   MessageID TEXT    NOT NULL, -- server messageID (from muteaccd)
   FOREIGN KEY(MyID) REFERENCES Nyms(UID) ON DELETE CASCADE
 );`
+	createQueryNotes = `
+CREATE TABLE Notes (
+  NoteID  INTEGER PRIMARY KEY,
+  Self    INTEGER NOT NULL, -- foreign key to Nyms table
+  Contact INTEGER,          -- foreign key to Contacts table (NULL for message notes)
+  Msg     INTEGER,          -- foreign key to Messages table (NULL for contact notes)
+  Date    INTEGER NOT NULL, -- time when the note was added
+  Note    TEXT    NOT NULL, -- the note itself (never transmitted)
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Contact) REFERENCES Contacts(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Msg) REFERENCES Messages(MsgID) ON DELETE CASCADE
+);`
+	createQueryQuarantine = `
+CREATE TABLE Quarantine (
+  QID     INTEGER PRIMARY KEY,
+  Self    INTEGER NOT NULL, -- foreign key to Nyms table
+  "From"  TEXT    NOT NULL, -- mapped sender ID
+  Date    INTEGER NOT NULL, -- time when the message was received from muteaccd
+  Reason  TEXT    NOT NULL, -- reason why the message has been quarantined
+  Message TEXT    NOT NULL, -- the decrypted message
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+);`
+	createQueryPending = `
+CREATE TABLE Pending (
+  PID     INTEGER PRIMARY KEY,
+  Self    INTEGER NOT NULL, -- foreign key to Nyms table
+  "From"  TEXT    NOT NULL, -- mapped sender ID
+  Date    INTEGER NOT NULL, -- time when the message was received from muteaccd
+  Restart INTEGER NOT NULL, -- 1: session restart has to be sent to sender
+  Msg     TEXT    NOT NULL, -- encrypted message of unknown session
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE
+);`
+	createQuerySearchIndex = `
+CREATE TABLE SearchIndex (
+  Self   INTEGER NOT NULL, -- foreign key to Nyms table
+  Msg    INTEGER NOT NULL, -- foreign key to Messages table
+  Bucket INTEGER NOT NULL, -- date bucket of the message (days since epoch)
+  Term   TEXT    NOT NULL, -- search term (see searchTerms)
+  UNIQUE (Msg, Term),
+  FOREIGN KEY(Self) REFERENCES Nyms(UID) ON DELETE CASCADE,
+  FOREIGN KEY(Msg) REFERENCES Messages(MsgID) ON DELETE CASCADE
+);`
+	createQuerySearchIndexTerms = "CREATE INDEX SearchIndexTerms ON SearchIndex (Self, Term, Bucket);"
+	upgradeQueryMessageID       = "ALTER TABLE Messages ADD COLUMN MessageID TEXT NOT NULL DEFAULT '';"
+	upgradeQueryInReplyTo       = "ALTER TABLE Messages ADD COLUMN InReplyTo TEXT NOT NULL DEFAULT '';"
+	upgradeQueryChunks          = "ALTER TABLE Chunks ADD COLUMN Data TEXT NOT NULL DEFAULT '';"
+	upgradeQueryFavorite        = "ALTER TABLE Contacts ADD COLUMN Favorite INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryAttempts        = "ALTER TABLE OutQueue ADD COLUMN Attempts INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryNextAttempt     = "ALTER TABLE OutQueue ADD COLUMN NextAttempt INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryContactMinDelay = "ALTER TABLE Contacts ADD COLUMN MinDelay INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryContactMaxDelay = "ALTER TABLE Contacts ADD COLUMN MaxDelay INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryMessageCc       = "ALTER TABLE Messages ADD COLUMN Cc TEXT NOT NULL DEFAULT '';"
+	upgradeQueryReceipts        = "ALTER TABLE Contacts ADD COLUMN Receipts INTEGER NOT NULL DEFAULT 0;"
+	upgradeQueryMsgReceipt      = "ALTER TABLE Messages ADD COLUMN Receipt TEXT NOT NULL DEFAULT '';"
+	upgradeQueryReceiptToSend   = "ALTER TABLE Messages ADD COLUMN ReceiptToSend TEXT NOT NULL DEFAULT '';"
+	upgradeQueryOutQueueReceipt = "ALTER TABLE OutQueue ADD COLUMN Receipt TEXT NOT NULL DEFAULT '';"
+	upgradeQueryVerified        = "ALTER TABLE Contacts ADD COLUMN Verified TEXT NOT NULL DEFAULT '';"
+	upgradeQueryArchive         = "ALTER TABLE Messages ADD COLUMN Archive INTEGER NOT NULL DEFAULT 0;"
+	upgradeQuerySendAfter       = "ALTER TABLE Messages ADD COLUMN SendAfter INTEGER NOT NULL DEFAULT 0;"
+	upgradeQuerySignature       = "ALTER TABLE Nyms ADD COLUMN Signature TEXT NOT NULL DEFAULT '';"
+	upgradeQuerySigStatus       = "ALTER TABLE Messages ADD COLUMN SigStatus TEXT NOT NULL DEFAULT '';"
 	updateValueQuery            = "UPDATE KeyValueStore SET ValueEntry=? WHERE KeyEntry=?;"
 	insertValueQuery            = "INSERT INTO KeyValueStore (KeyEntry, ValueEntry) VALUES (?, ?);"
 	getValueQuery               = "SELECT ValueEntry FROM KeyValueStore WHERE KeyEntry=?;"
+	delValueQuery               = "DELETE FROM KeyValueStore WHERE KeyEntry=?;"
 	updateNymQuery              = "UPDATE Nyms SET UnmappedID=?, FullName=? WHERE MappedID=?;"
 	insertNymQuery              = "INSERT INTO Nyms (MappedID, UnmappedID, FullName) VALUES (?, ?, ?);"
 	getNymQuery                 = "SELECT UnmappedID, FullName from Nyms WHERE MappedID=?;"
@@ -166,6 +264,11 @@ CREATE TABLE MessageIDCache(
 	getContactMappedQuery       = "SELECT MappedID FROM Contacts WHERE MyID=? AND UID=?;"
 	getContactUIDQuery          = "SELECT UID FROM Contacts WHERE MyID=? AND MappedID=?;"
 	getContactsQuery            = "SELECT UnmappedID, FullName FROM Contacts WHERE MyID=? AND Blocked=?;"
+	getFavoritesQuery           = "SELECT UnmappedID, FullName FROM Contacts WHERE MyID=? AND Blocked=0 AND Favorite=1;"
+	getFavoriteQuery            = "SELECT Favorite FROM Contacts WHERE MyID=? AND MappedID=?;"
+	setFavoriteQuery            = "UPDATE Contacts SET Favorite=? WHERE MyID=? AND MappedID=?;"
+	getContactDelaysQuery       = "SELECT MinDelay, MaxDelay FROM Contacts WHERE MyID=? AND MappedID=?;"
+	setContactDelaysQuery       = "UPDATE Contacts SET MinDelay=?, MaxDelay=? WHERE MyID=? AND MappedID=?;"
 	updateContactQuery          = "UPDATE Contacts SET UnmappedID=?, FullName=?, Blocked=? WHERE MyID=? AND MappedID=?;"
 	insertContactQuery          = "INSERT INTO Contacts (MyID, MappedID, UnmappedID, FullName, Blocked) VALUES (?, ?, ?, ?, ?);"
 	delContactQuery             = "UPDATE Contacts SET Blocked=1 WHERE MyID=? AND MappedID=?;"
@@ -175,42 +278,105 @@ CREATE TABLE MessageIDCache(
 	getAccountQuery             = "SELECT PrivKey, Server, Secret, MinDelay, MaxDelay, LastMsgTime FROM Accounts WHERE MyID=? AND ContactID=?;"
 	getAccountsQuery            = "SELECT ContactID FROM Accounts WHERE MyID=?;"
 	getAccountTimeQuery         = "SELECT LoadTime FROM Accounts WHERE MyID=? AND ContactID=?;"
-	addMsgQuery                 = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0);"
+	delAccountQuery             = "DELETE FROM Accounts WHERE MyID=? AND ContactID=?;"
+	getLastMsgDateQuery         = "SELECT IFNULL(MAX(Date), 0) FROM Messages WHERE Self=? AND Peer=?;"
+	addMsgQuery                 = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star, MessageID, InReplyTo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?);"
 	delMsgQuery                 = "DELETE FROM Messages WHERE MsgID=? AND Self=?;"
+	addAttachmentQuery          = "INSERT INTO Attachments (Self, Msg, Filename, Data, Deleted) VALUES (?, ?, ?, ?, 0);"
+	getAttachmentsQuery         = "SELECT AttachID, Filename, Data, Deleted FROM Attachments WHERE Self=? AND Msg=? ORDER BY AttachID ASC;"
+	delAttachmentsQuery         = "DELETE FROM Attachments WHERE Msg=? AND Self=?;"
 	getMsgQuery                 = "SELECT Self, Peer, Direction, Date, Message FROM Messages WHERE MsgID=?;"
+	getMsgSigQuery              = "SELECT Self, Direction, Sign, SigStatus FROM Messages WHERE MsgID=?;"
+	setMsgSigStatusQuery        = "UPDATE Messages SET SigStatus=? WHERE MsgID=?;"
 	readMsgQuery                = "UPDATE Messages SET Read=1 WHERE MsgID=?;"
-	getMsgsQuery                = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read FROM Messages WHERE Self=?;"
-	getUndeliveredMsgQuery      = "SELECT MsgID, Peer, Message, Sign, MinDelay, MaxDelay FROM Messages WHERE Self=? AND ToSend=1 ORDER BY MsgID ASC LIMIT 1;"
+	starMsgQuery                = "UPDATE Messages SET Star=? WHERE MsgID=? AND Self=?;"
+	archiveMsgQuery             = "UPDATE Messages SET Archive=? WHERE MsgID=? AND Self=?;"
+	getMsgsQuery                = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read, Star, MessageID, InReplyTo, Receipt, Archive, SendAfter FROM Messages WHERE Self=?;"
+	getMsgIDQuery               = "SELECT MsgID, \"From\", \"To\", Direction, Sent, Date, Subject, Read, Star, MessageID, InReplyTo, Receipt, Archive, SendAfter FROM Messages WHERE MsgID=? AND Self=?;"
+	getMsgHeaderQuery           = "SELECT MessageID, InReplyTo FROM Messages WHERE MsgID=? AND Self=?;"
+	importMsgQuery              = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Cc, Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star, MessageID, InReplyTo) VALUES (?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0, ?, ?, ?, ?);"
+	hasMessageIDQuery           = "SELECT EXISTS (SELECT 1 FROM Messages WHERE Self=? AND MessageID=?);"
+	addMultiMsgQuery            = "INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Cc, Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star, MessageID, InReplyTo, SendAfter) VALUES (?, ?, 1, 1, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?, ?);"
+	getMsgRecipientsQuery       = "SELECT \"To\", Cc FROM Messages WHERE MsgID=? AND Self=?;"
+	getRecipientStatusQuery     = "SELECT Messages.MsgID, Contacts.MappedID, Messages.ToSend, Messages.Sent, EXISTS (SELECT 1 FROM OutQueue WHERE OutQueue.MsgID=Messages.MsgID) FROM Messages JOIN Contacts ON Messages.Peer=Contacts.UID WHERE Messages.Self=? AND Messages.Direction=1 AND Messages.MessageID=? ORDER BY Messages.MsgID ASC;"
+	countToSendMsgsQuery        = "SELECT COUNT(*) FROM Messages WHERE Self=? AND ToSend=1;"
+	getUndeliveredMsgQuery      = "SELECT MsgID, Peer, Message, Sign, MinDelay, MaxDelay FROM Messages WHERE Self=? AND ToSend=1 AND SendAfter<=? ORDER BY MsgID ASC LIMIT 1;"
 	updateDeliveryMsgQuery      = "UPDATE Messages SET ToSend=? WHERE MsgID=?;"
 	updateMsgDateQuery          = "UPDATE Messages SET Date=?, Sent=1 WHERE MsgID=?;"
 	getUpkeepAllQuery           = "SELECT UpkeepAll FROM Nyms WHERE MappedID=?;"
 	setUpkeepAllQuery           = "UPDATE Nyms SET UpkeepAll=? WHERE MappedID=?;"
 	getUpkeepAccountsQuery      = "SELECT UpkeepAccounts FROM Nyms WHERE MappedID=?;"
 	setUpkeepAccountsQuery      = "UPDATE Nyms SET UpkeepAccounts=? WHERE MappedID=?;"
+	getSignatureQuery           = "SELECT Signature FROM Nyms WHERE MappedID=?;"
+	setSignatureQuery           = "UPDATE Nyms SET Signature=? WHERE MappedID=?;"
 	addOutQueueQuery            = "INSERT INTO OutQueue (Self, MsgID, Msg, NymAddress, MinDelay, MaxDelay, Envelope, Resend) VALUES (?, ?, ?, ?, ?, ?, 0, 0);"
 	getOutQueueQuery            = "SELECT OQIdx, Msg, NymAddress, MinDelay, MaxDelay, Envelope FROM OutQueue WHERE Self=? AND Resend=0 ORDER BY OQIdx ASC LIMIT 1;"
-	getOutQueueMsgIDQuery       = "SELECT MsgID FROM OutQueue WHERE OQIdx=?;"
+	getOutQueueEntryQuery       = "SELECT OQIdx, NymAddress, MinDelay, MaxDelay, Envelope, LENGTH(Msg), Attempts FROM OutQueue WHERE Self=? AND Resend=0 AND NextAttempt<=? ORDER BY LENGTH(Msg)>? ASC, OQIdx ASC LIMIT 1;"
+	getOutQueueMsgQuery         = "SELECT Msg FROM OutQueue WHERE OQIdx=?;"
+	getOutQueuePieceQuery       = "SELECT substr(Msg, ?, ?) FROM OutQueue WHERE OQIdx=?;"
+	getOutQueueMsgIDQuery       = "SELECT MsgID, Receipt FROM OutQueue WHERE OQIdx=?;"
+	countOutQueueQuery          = "SELECT COUNT(*) FROM OutQueue WHERE Self=? AND Envelope=0;"
 	setOutQueueQuery            = "UPDATE OutQueue SET Msg=?, Envelope=1 WHERE OQIdx=?;"
 	removeOutQueueQuery         = "DELETE FROM OutQueue WHERE OQIdx=?;"
 	setResendOutQueueQuery      = "UPDATE OutQueue SET Resend=1 WHERE OQIdx=?;"
 	clearResendOutQueueQuery    = "UPDATE OutQueue SET Resend=0 WHERE Self=? AND Resend=1;"
+	postponeOutQueueQuery       = "UPDATE OutQueue SET Attempts=Attempts+1, NextAttempt=? WHERE OQIdx=?;"
+	listOutQueueQuery           = "SELECT OutQueue.OQIdx, OutQueue.MsgID, Contacts.MappedID, OutQueue.MinDelay, OutQueue.MaxDelay, OutQueue.Envelope, OutQueue.Resend, OutQueue.Attempts, OutQueue.NextAttempt, length(OutQueue.Msg) FROM OutQueue JOIN Messages ON OutQueue.MsgID=Messages.MsgID JOIN Contacts ON Messages.Peer=Contacts.UID WHERE OutQueue.Self=? ORDER BY OutQueue.OQIdx ASC;"
+	retryOutQueueQuery          = "UPDATE OutQueue SET Resend=0, NextAttempt=0 WHERE Self=? AND (MsgID=? OR ?=0);"
+	dropOutQueueQuery           = "DELETE FROM OutQueue WHERE Self=? AND MsgID=?;"
+	cancelMsgQuery              = "UPDATE Messages SET ToSend=0 WHERE Self=? AND MsgID=? AND Direction=1 AND ToSend=1;"
 	addInQueueQuery             = "INSERT INTO InQueue (MyID, ContactID, Date, Msg, Envelope) VALUES (?, ?, ?, ?, 1);"
 	getInQueueQuery             = "SELECT IQIdx, MyID, ContactID, Msg, Envelope FROM InQueue ORDER BY IQIdx ASC LIMIT 1;"
 	getInQueueIDsQuery          = "SELECT MyID, ContactID, Date FROM InQueue WHERE IQIdx=?;"
 	setInQueueQuery             = "UPDATE InQueue SET Msg=?, Envelope=0 WHERE IQIdx=?;"
 	removeInQueueQuery          = "DELETE FROM InQueue WHERE IQIdx=?;"
+	listInQueueQuery            = "SELECT InQueue.IQIdx, ifnull(Contacts.MappedID, ''), InQueue.Date, InQueue.Envelope, length(InQueue.Msg) FROM InQueue LEFT JOIN Contacts ON InQueue.ContactID=Contacts.UID WHERE InQueue.MyID=? ORDER BY InQueue.IQIdx ASC;"
 	addMessageIDCacheQuery      = "INSERT INTO MessageIDCache (MyID, ContactID, MessageID) VALUES (?, ?, ?);"
 	getMessageIDCacheQuery      = "SELECT MessageID FROM MessageIDCache WHERE MyID=? AND ContactID=?;"
 	getMessageIDCacheEntryQuery = "SELECT Entry FROM MessageIDCache WHERE MyID=? AND ContactID=? AND MessageID=?;"
 	removeMessageIDCacheQuery   = "DELETE FROM MessageIDCache WHERE MyID=? AND ContactID=? AND Entry<?;"
+	addContactNoteQuery         = "INSERT INTO Notes (Self, Contact, Date, Note) VALUES (?, ?, ?, ?);"
+	addMsgNoteQuery             = "INSERT INTO Notes (Self, Msg, Date, Note) VALUES (?, ?, ?, ?);"
+	getContactNotesQuery        = "SELECT NoteID, Date, Note FROM Notes WHERE Self=? AND Contact=? ORDER BY NoteID ASC;"
+	getMsgNotesQuery            = "SELECT NoteID, Date, Note FROM Notes WHERE Self=? AND Msg=? ORDER BY NoteID ASC;"
+	searchNotesQuery            = "SELECT Notes.NoteID, Contacts.MappedID, Notes.Msg, Notes.Date, Notes.Note FROM Notes LEFT JOIN Contacts ON Notes.Contact=Contacts.UID WHERE Notes.Self=? AND Notes.Note LIKE ? ESCAPE '\\' ORDER BY Notes.NoteID ASC;"
+	addChunkQuery               = "INSERT INTO Chunks (Self, MessageID, Piece, Count, Date, Data) VALUES (?, ?, ?, ?, ?, ?);"
+	getChunksQuery              = "SELECT Piece, Count, Data FROM Chunks WHERE Self=? AND MessageID=? ORDER BY Piece ASC;"
+	delChunksQuery              = "DELETE FROM Chunks WHERE Self=? AND MessageID=?;"
+	expireChunksQuery           = "DELETE FROM Chunks WHERE Date<?;"
+	addQuarantineQuery          = "INSERT INTO Quarantine (Self, \"From\", Date, Reason, Message) VALUES (?, ?, ?, ?, ?);"
+	getQuarantineQuery          = "SELECT QID, \"From\", Date, Reason, length(Message) FROM Quarantine WHERE Self=? ORDER BY QID ASC;"
+	delQuarantineQuery          = "DELETE FROM Quarantine WHERE QID=? AND Self=?;"
+	addPendingQuery             = "INSERT INTO Pending (Self, \"From\", Date, Restart, Msg) SELECT MyID, ?, Date, 0, Msg FROM InQueue WHERE IQIdx=?;"
+	getPendingQuery             = "SELECT PID, \"From\", Date, Restart, length(Msg) FROM Pending WHERE Self=? ORDER BY PID ASC;"
+	delPendingQuery             = "DELETE FROM Pending WHERE PID=? AND Self=?;"
+	getRestartQuery             = "SELECT count(*) FROM Pending WHERE Self=? AND \"From\"=? AND Restart=1;"
+	clearRestartQuery           = "UPDATE Pending SET Restart=0 WHERE Self=? AND \"From\"=?;"
+	requestRestartQuery         = "UPDATE Pending SET Restart=1 WHERE Self=? AND \"From\"=?;"
+	retryPendingQuery           = "INSERT INTO InQueue (MyID, ContactID, Date, Msg, Envelope) SELECT Self, 0, Date, Msg, 0 FROM Pending WHERE Self=? AND \"From\"=? ORDER BY PID ASC;"
+	delPendingFromQuery         = "DELETE FROM Pending WHERE Self=? AND \"From\"=?;"
+	getContactReceiptsQuery     = "SELECT Receipts FROM Contacts WHERE MyID=? AND MappedID=?;"
+	setContactReceiptsQuery     = "UPDATE Contacts SET Receipts=? WHERE MyID=? AND MappedID=?;"
+	queueReceiptQuery           = "UPDATE Messages SET ReceiptToSend=? WHERE MsgID=? AND Self=? AND Direction=0 AND MessageID!='' AND Receipt!='read' AND MsgID NOT IN (SELECT MsgID FROM OutQueue WHERE Receipt='read') AND Peer IN (SELECT UID FROM Contacts WHERE Receipts=1);"
+	getPendingReceiptQuery      = "SELECT Messages.MsgID, Contacts.MappedID, Messages.MessageID, Messages.ReceiptToSend FROM Messages JOIN Contacts ON Messages.Peer=Contacts.UID WHERE Messages.Self=? AND Messages.ReceiptToSend!='' ORDER BY Messages.MsgID ASC LIMIT 1;"
+	clearReceiptToSendQuery     = "UPDATE Messages SET ReceiptToSend='' WHERE MsgID=?;"
+	addOutQueueReceiptQuery     = "INSERT INTO OutQueue (Self, MsgID, Msg, NymAddress, MinDelay, MaxDelay, Envelope, Resend, Receipt) VALUES (?, ?, ?, ?, ?, ?, 0, 0, ?);"
+	requeueReceiptQuery         = "UPDATE Messages SET ReceiptToSend=? WHERE MsgID=? AND ReceiptToSend='';"
+	setReceiptSentQuery         = "UPDATE Messages SET Receipt=? WHERE MsgID=? AND Receipt!='read';"
+	getContactVerifiedQuery     = "SELECT Verified FROM Contacts WHERE MyID=? AND MappedID=?;"
+	setContactVerifiedQuery     = "UPDATE Contacts SET Verified=? WHERE MyID=? AND MappedID=?;"
+	getVerifiedContactsQuery    = "SELECT MappedID, Verified FROM Contacts WHERE MyID=? AND Verified!='';"
+	setMsgReceiptQuery          = "UPDATE Messages SET Receipt=? WHERE Self=? AND Peer=? AND MessageID=? AND Direction=1 AND Receipt!='read';"
 )
 
 // MsgDB is a handle for an encrypted database to store messsages and tokens.
 type MsgDB struct {
+	dbname                      string // prefix of the database files
 	encDB                       *sql.DB
 	updateValueQuery            *sql.Stmt
 	insertValueQuery            *sql.Stmt
 	getValueQuery               *sql.Stmt
+	delValueQuery               *sql.Stmt
 	updateNymQuery              *sql.Stmt
 	insertNymQuery              *sql.Stmt
 	getNymQuery                 *sql.Stmt
@@ -222,6 +388,11 @@ type MsgDB struct {
 	getContactMappedQuery       *sql.Stmt
 	getContactUIDQuery          *sql.Stmt
 	getContactsQuery            *sql.Stmt
+	getFavoritesQuery           *sql.Stmt
+	getFavoriteQuery            *sql.Stmt
+	setFavoriteQuery            *sql.Stmt
+	getContactDelaysQuery       *sql.Stmt
+	setContactDelaysQuery       *sql.Stmt
 	updateContactQuery          *sql.Stmt
 	insertContactQuery          *sql.Stmt
 	delContactQuery             *sql.Stmt
@@ -231,11 +402,28 @@ type MsgDB struct {
 	getAccountQuery             *sql.Stmt
 	getAccountsQuery            *sql.Stmt
 	getAccountTimeQuery         *sql.Stmt
+	delAccountQuery             *sql.Stmt
+	getLastMsgDateQuery         *sql.Stmt
 	addMsgQuery                 *sql.Stmt
 	delMsgQuery                 *sql.Stmt
+	addAttachmentQuery          *sql.Stmt
+	getAttachmentsQuery         *sql.Stmt
+	delAttachmentsQuery         *sql.Stmt
 	getMsgQuery                 *sql.Stmt
+	getMsgSigQuery              *sql.Stmt
+	setMsgSigStatusQuery        *sql.Stmt
 	readMsgQuery                *sql.Stmt
+	starMsgQuery                *sql.Stmt
+	archiveMsgQuery             *sql.Stmt
 	getMsgsQuery                *sql.Stmt
+	getMsgIDQuery               *sql.Stmt
+	getMsgHeaderQuery           *sql.Stmt
+	importMsgQuery              *sql.Stmt
+	hasMessageIDQuery           *sql.Stmt
+	addMultiMsgQuery            *sql.Stmt
+	getMsgRecipientsQuery       *sql.Stmt
+	getRecipientStatusQuery     *sql.Stmt
+	countToSendMsgsQuery        *sql.Stmt
 	getUndeliveredMsgQuery      *sql.Stmt
 	updateDeliveryMsgQuery      *sql.Stmt
 	updateMsgDateQuery          *sql.Stmt
@@ -243,22 +431,65 @@ type MsgDB struct {
 	setUpkeepAllQuery           *sql.Stmt
 	getUpkeepAccountsQuery      *sql.Stmt
 	setUpkeepAccountsQuery      *sql.Stmt
+	getSignatureQuery           *sql.Stmt
+	setSignatureQuery           *sql.Stmt
 	addOutQueueQuery            *sql.Stmt
 	getOutQueueQuery            *sql.Stmt
+	getOutQueueEntryQuery       *sql.Stmt
+	getOutQueueMsgQuery         *sql.Stmt
+	getOutQueuePieceQuery       *sql.Stmt
 	getOutQueueMsgIDQuery       *sql.Stmt
+	countOutQueueQuery          *sql.Stmt
 	setOutQueueQuery            *sql.Stmt
 	removeOutQueueQuery         *sql.Stmt
 	setResendOutQueueQuery      *sql.Stmt
 	clearResendOutQueueQuery    *sql.Stmt
+	postponeOutQueueQuery       *sql.Stmt
+	listOutQueueQuery           *sql.Stmt
+	retryOutQueueQuery          *sql.Stmt
+	dropOutQueueQuery           *sql.Stmt
+	cancelMsgQuery              *sql.Stmt
 	addInQueueQuery             *sql.Stmt
 	getInQueueQuery             *sql.Stmt
 	getInQueueIDsQuery          *sql.Stmt
 	setInQueueQuery             *sql.Stmt
 	removeInQueueQuery          *sql.Stmt
+	listInQueueQuery            *sql.Stmt
 	addMessageIDCacheQuery      *sql.Stmt
 	getMessageIDCacheQuery      *sql.Stmt
 	getMessageIDCacheEntryQuery *sql.Stmt
 	removeMessageIDCacheQuery   *sql.Stmt
+	addContactNoteQuery         *sql.Stmt
+	addMsgNoteQuery             *sql.Stmt
+	getContactNotesQuery        *sql.Stmt
+	getMsgNotesQuery            *sql.Stmt
+	searchNotesQuery            *sql.Stmt
+	addChunkQuery               *sql.Stmt
+	getChunksQuery              *sql.Stmt
+	delChunksQuery              *sql.Stmt
+	expireChunksQuery           *sql.Stmt
+	addQuarantineQuery          *sql.Stmt
+	getQuarantineQuery          *sql.Stmt
+	delQuarantineQuery          *sql.Stmt
+	addPendingQuery             *sql.Stmt
+	getPendingQuery             *sql.Stmt
+	delPendingQuery             *sql.Stmt
+	getRestartQuery             *sql.Stmt
+	clearRestartQuery           *sql.Stmt
+	requestRestartQuery         *sql.Stmt
+	retryPendingQuery           *sql.Stmt
+	delPendingFromQuery         *sql.Stmt
+	getContactReceiptsQuery     *sql.Stmt
+	setContactReceiptsQuery     *sql.Stmt
+	queueReceiptQuery           *sql.Stmt
+	getPendingReceiptQuery      *sql.Stmt
+	clearReceiptToSendQuery     *sql.Stmt
+	addOutQueueReceiptQuery     *sql.Stmt
+	setReceiptSentQuery         *sql.Stmt
+	setMsgReceiptQuery          *sql.Stmt
+	getContactVerifiedQuery     *sql.Stmt
+	setContactVerifiedQuery     *sql.Stmt
+	getVerifiedContactsQuery    *sql.Stmt
 }
 
 // Create returns a new message database with the given dbname.
@@ -275,6 +506,11 @@ func Create(dbname string, passphrase []byte, iter int) error {
 		createQueryOutQueue,
 		createQueryInQueue,
 		createMessageIDCache,
+		createQueryNotes,
+		createQueryQuarantine,
+		createQueryPending,
+		createQuerySearchIndex,
+		createQuerySearchIndexTerms,
 	})
 	if err != nil {
 		return err
@@ -296,15 +532,123 @@ func (msgDB *MsgDB) Version() (string, error) {
 	return version, nil
 }
 
+// Snapshot returns consistent copies of the (encrypted) database files of
+// msgDB (see encdb.Snapshot).
+func (msgDB *MsgDB) Snapshot() (dbData, keyData []byte, err error) {
+	dbData, keyData, err = encdb.Snapshot(msgDB.encDB, msgDB.dbname)
+	if err != nil {
+		return nil, nil, log.Error(err)
+	}
+	return dbData, keyData, nil
+}
+
+// upgrade upgrades the schema of encDB to the current Version.
+func upgrade(encDB *sql.DB) error {
+	var version string
+	err := encDB.QueryRow(getValueQuery, DBVersion).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		// database is just being created
+		return nil
+	case err != nil:
+		return err
+	}
+	// refuse databases written by newer versions
+	current, err := strconv.ParseUint(Version, 10, 64)
+	if err != nil {
+		return log.Error(err)
+	}
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return log.Errorf("msgdb: cannot parse version: %s", version)
+	}
+	if v > current {
+		log.Errorf("msgdb: database version %s > %s", version, Version)
+		return ErrNewerVersion
+	}
+	// upgrade steps: version -> schema changes
+	steps := []struct {
+		from    string
+		to      string
+		queries []string
+		post    func(tx *sql.Tx) error // optional data migration
+	}{
+		{"1", "2", []string{createQueryNotes}, nil},
+		{"2", "3", []string{createQueryQuarantine}, nil},
+		{"3", "4", []string{upgradeQueryMessageID, upgradeQueryInReplyTo}, nil},
+		{"4", "5", []string{upgradeQueryChunks}, nil},
+		{"5", "6", []string{upgradeQueryFavorite}, nil},
+		{"6", "7", []string{createQuerySearchIndex, createQuerySearchIndexTerms},
+			reindexMessages},
+		{"7", "8", []string{upgradeQueryAttempts, upgradeQueryNextAttempt}, nil},
+		{"8", "9", []string{upgradeQueryContactMinDelay,
+			upgradeQueryContactMaxDelay}, nil},
+		{"9", "10", []string{upgradeQueryMessageCc}, nil},
+		{"10", "11", []string{upgradeQueryReceipts, upgradeQueryMsgReceipt,
+			upgradeQueryReceiptToSend, upgradeQueryOutQueueReceipt}, nil},
+		{"11", "12", []string{upgradeQueryVerified}, nil},
+		{"12", "13", []string{createQueryPending}, nil},
+		{"13", "14", []string{upgradeQueryArchive}, nil},
+		{"14", "15", []string{upgradeQuerySendAfter}, nil},
+		{"15", "16", []string{upgradeQuerySignature}, nil},
+		{"16", "17", []string{upgradeQuerySigStatus}, nil},
+	}
+	for _, step := range steps {
+		if version != step.from {
+			continue
+		}
+		log.Infof("msgdb: upgrade from version %s to %s", step.from, step.to)
+		tx, err := encDB.Begin()
+		if err != nil {
+			return err
+		}
+		for _, query := range step.queries {
+			if _, err := tx.Exec(query); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if step.post != nil {
+			if err := step.post(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(updateValueQuery, step.to, DBVersion); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version = step.to
+	}
+	return nil
+}
+
 // Open opens the message database with dbname and passphrase.
 func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 	var msgDB MsgDB
 	var err error
+	msgDB.dbname = dbname
+	// detect interrupted rekey operations (recovered by encdb.Open)
+	pending, err := encdb.RekeyPending(dbname)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		log.Warnf("msgdb: recovering interrupted rekey of '%s'", dbname)
+	}
 	// open database
 	msgDB.encDB, err = encdb.Open(dbname, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	// upgrade database, if necessary
+	if err := upgrade(msgDB.encDB); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	// prepare statements
 	if msgDB.updateValueQuery, err = msgDB.encDB.Prepare(updateValueQuery); err != nil {
 		msgDB.encDB.Close()
@@ -318,6 +662,10 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.delValueQuery, err = msgDB.encDB.Prepare(delValueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.updateNymQuery, err = msgDB.encDB.Prepare(updateNymQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -362,6 +710,26 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getFavoritesQuery, err = msgDB.encDB.Prepare(getFavoritesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getFavoriteQuery, err = msgDB.encDB.Prepare(getFavoriteQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setFavoriteQuery, err = msgDB.encDB.Prepare(setFavoriteQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getContactDelaysQuery, err = msgDB.encDB.Prepare(getContactDelaysQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setContactDelaysQuery, err = msgDB.encDB.Prepare(setContactDelaysQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.updateContactQuery, err = msgDB.encDB.Prepare(updateContactQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -398,6 +766,14 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.delAccountQuery, err = msgDB.encDB.Prepare(delAccountQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getLastMsgDateQuery, err = msgDB.encDB.Prepare(getLastMsgDateQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.addMsgQuery, err = msgDB.encDB.Prepare(addMsgQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -406,18 +782,78 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.addAttachmentQuery, err = msgDB.encDB.Prepare(addAttachmentQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getAttachmentsQuery, err = msgDB.encDB.Prepare(getAttachmentsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delAttachmentsQuery, err = msgDB.encDB.Prepare(delAttachmentsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getMsgQuery, err = msgDB.encDB.Prepare(getMsgQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getMsgSigQuery, err = msgDB.encDB.Prepare(getMsgSigQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setMsgSigStatusQuery, err = msgDB.encDB.Prepare(setMsgSigStatusQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.readMsgQuery, err = msgDB.encDB.Prepare(readMsgQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.starMsgQuery, err = msgDB.encDB.Prepare(starMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.archiveMsgQuery, err = msgDB.encDB.Prepare(archiveMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getMsgsQuery, err = msgDB.encDB.Prepare(getMsgsQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getMsgIDQuery, err = msgDB.encDB.Prepare(getMsgIDQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getMsgHeaderQuery, err = msgDB.encDB.Prepare(getMsgHeaderQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.importMsgQuery, err = msgDB.encDB.Prepare(importMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.hasMessageIDQuery, err = msgDB.encDB.Prepare(hasMessageIDQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addMultiMsgQuery, err = msgDB.encDB.Prepare(addMultiMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getMsgRecipientsQuery, err = msgDB.encDB.Prepare(getMsgRecipientsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getRecipientStatusQuery, err = msgDB.encDB.Prepare(getRecipientStatusQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.countToSendMsgsQuery, err = msgDB.encDB.Prepare(countToSendMsgsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getUndeliveredMsgQuery, err = msgDB.encDB.Prepare(getUndeliveredMsgQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -446,6 +882,14 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getSignatureQuery, err = msgDB.encDB.Prepare(getSignatureQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setSignatureQuery, err = msgDB.encDB.Prepare(setSignatureQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.addOutQueueQuery, err = msgDB.encDB.Prepare(addOutQueueQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -454,10 +898,26 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.getOutQueueEntryQuery, err = msgDB.encDB.Prepare(getOutQueueEntryQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getOutQueueMsgQuery, err = msgDB.encDB.Prepare(getOutQueueMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getOutQueuePieceQuery, err = msgDB.encDB.Prepare(getOutQueuePieceQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.getOutQueueMsgIDQuery, err = msgDB.encDB.Prepare(getOutQueueMsgIDQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.countOutQueueQuery, err = msgDB.encDB.Prepare(countOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.setOutQueueQuery, err = msgDB.encDB.Prepare(setOutQueueQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -474,6 +934,26 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.postponeOutQueueQuery, err = msgDB.encDB.Prepare(postponeOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.listOutQueueQuery, err = msgDB.encDB.Prepare(listOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.retryOutQueueQuery, err = msgDB.encDB.Prepare(retryOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.dropOutQueueQuery, err = msgDB.encDB.Prepare(dropOutQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.cancelMsgQuery, err = msgDB.encDB.Prepare(cancelMsgQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.addInQueueQuery, err = msgDB.encDB.Prepare(addInQueueQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -494,6 +974,10 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.listInQueueQuery, err = msgDB.encDB.Prepare(listInQueueQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	if msgDB.addMessageIDCacheQuery, err = msgDB.encDB.Prepare(addMessageIDCacheQuery); err != nil {
 		msgDB.encDB.Close()
 		return nil, err
@@ -510,6 +994,130 @@ func Open(dbname string, passphrase []byte) (*MsgDB, error) {
 		msgDB.encDB.Close()
 		return nil, err
 	}
+	if msgDB.addContactNoteQuery, err = msgDB.encDB.Prepare(addContactNoteQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addMsgNoteQuery, err = msgDB.encDB.Prepare(addMsgNoteQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getContactNotesQuery, err = msgDB.encDB.Prepare(getContactNotesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getMsgNotesQuery, err = msgDB.encDB.Prepare(getMsgNotesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.searchNotesQuery, err = msgDB.encDB.Prepare(searchNotesQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addChunkQuery, err = msgDB.encDB.Prepare(addChunkQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getChunksQuery, err = msgDB.encDB.Prepare(getChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delChunksQuery, err = msgDB.encDB.Prepare(delChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.expireChunksQuery, err = msgDB.encDB.Prepare(expireChunksQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addQuarantineQuery, err = msgDB.encDB.Prepare(addQuarantineQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getQuarantineQuery, err = msgDB.encDB.Prepare(getQuarantineQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delQuarantineQuery, err = msgDB.encDB.Prepare(delQuarantineQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getContactReceiptsQuery, err = msgDB.encDB.Prepare(getContactReceiptsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setContactReceiptsQuery, err = msgDB.encDB.Prepare(setContactReceiptsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.queueReceiptQuery, err = msgDB.encDB.Prepare(queueReceiptQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getPendingReceiptQuery, err = msgDB.encDB.Prepare(getPendingReceiptQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.clearReceiptToSendQuery, err = msgDB.encDB.Prepare(clearReceiptToSendQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addOutQueueReceiptQuery, err = msgDB.encDB.Prepare(addOutQueueReceiptQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setReceiptSentQuery, err = msgDB.encDB.Prepare(setReceiptSentQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setMsgReceiptQuery, err = msgDB.encDB.Prepare(setMsgReceiptQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getContactVerifiedQuery, err = msgDB.encDB.Prepare(getContactVerifiedQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.setContactVerifiedQuery, err = msgDB.encDB.Prepare(setContactVerifiedQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getVerifiedContactsQuery, err = msgDB.encDB.Prepare(getVerifiedContactsQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.addPendingQuery, err = msgDB.encDB.Prepare(addPendingQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getPendingQuery, err = msgDB.encDB.Prepare(getPendingQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delPendingQuery, err = msgDB.encDB.Prepare(delPendingQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.getRestartQuery, err = msgDB.encDB.Prepare(getRestartQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.clearRestartQuery, err = msgDB.encDB.Prepare(clearRestartQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.requestRestartQuery, err = msgDB.encDB.Prepare(requestRestartQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.retryPendingQuery, err = msgDB.encDB.Prepare(retryPendingQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
+	if msgDB.delPendingFromQuery, err = msgDB.encDB.Prepare(delPendingFromQuery); err != nil {
+		msgDB.encDB.Close()
+		return nil, err
+	}
 	return &msgDB, nil
 }
 
@@ -553,3 +1161,15 @@ func (msgDB *MsgDB) Vacuum(autoVacuumMode string) error {
 func (msgDB *MsgDB) Incremental(pages int64) error {
 	return encdb.Incremental(msgDB.encDB, pages)
 }
+
+// Schema returns the SQL definitions of all tables, indices, and triggers in
+// msgDB.
+func (msgDB *MsgDB) Schema() ([]string, error) {
+	return encdb.Schema(msgDB.encDB)
+}
+
+// QueryReadOnly executes the SQL query in msgDB without the ability to modify
+// the database and returns the column names and result rows.
+func (msgDB *MsgDB) QueryReadOnly(query string) ([]string, [][]string, error) {
+	return encdb.QueryReadOnly(msgDB.encDB, query)
+}
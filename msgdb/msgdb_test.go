@@ -77,3 +77,27 @@ func TestRekey(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNewerVersion(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "msgdb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dbname := filepath.Join(tmpdir, "msgdb")
+	passphrase := []byte(cipher.RandPass(cipher.RandReader))
+	if err := Create(dbname, passphrase, 64000); err != nil {
+		t.Fatal(err)
+	}
+	msgDB, err := Open(dbname, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddValue(DBVersion, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	msgDB.Close()
+	if _, err := Open(dbname, passphrase); err != ErrNewerVersion {
+		t.Errorf("Open() should fail with ErrNewerVersion: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// Note is a private note attached to a contact or message. Notes are only
+// stored locally and never transmitted.
+type Note struct {
+	NoteID  int64  // the note ID
+	Contact string // contact the note is attached to ("" for message notes)
+	MsgID   int64  // message the note is attached to (0 for contact notes)
+	Date    int64  // time when the note was added
+	Note    string // the note itself
+}
+
+// AddContactNote adds the given note to the contact contactID of user myID.
+func (msgDB *MsgDB) AddContactNote(
+	myID, contactID string,
+	date int64,
+	note string,
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	var contact int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, contactID).Scan(&contact)
+	if err != nil {
+		return log.Error(err)
+	}
+	_, err = msgDB.addContactNoteQuery.Exec(self, contact, date, note)
+	if err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// AddMessageNote adds the given note to the message msgNum of user myID.
+func (msgDB *MsgDB) AddMessageNote(
+	myID string,
+	msgNum int64,
+	date int64,
+	note string,
+) error {
+	self, err := msgDB.getMessageSelf(myID, msgNum)
+	if err != nil {
+		return err
+	}
+	if _, err := msgDB.addMsgNoteQuery.Exec(self, msgNum, date, note); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// GetContactNotes returns all notes attached to the contact contactID of user
+// myID.
+func (msgDB *MsgDB) GetContactNotes(myID, contactID string) ([]*Note, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	var contact int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, contactID).Scan(&contact)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getContactNotesQuery.Query(self, contact)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var notes []*Note
+	for rows.Next() {
+		n := &Note{Contact: contactID}
+		if err := rows.Scan(&n.NoteID, &n.Date, &n.Note); err != nil {
+			return nil, log.Error(err)
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return notes, nil
+}
+
+// GetMessageNotes returns all notes attached to the message msgNum of user
+// myID.
+func (msgDB *MsgDB) GetMessageNotes(myID string, msgNum int64) ([]*Note, error) {
+	self, err := msgDB.getMessageSelf(myID, msgNum)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := msgDB.getMsgNotesQuery.Query(self, msgNum)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var notes []*Note
+	for rows.Next() {
+		n := &Note{MsgID: msgNum}
+		if err := rows.Scan(&n.NoteID, &n.Date, &n.Note); err != nil {
+			return nil, log.Error(err)
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return notes, nil
+}
+
+// SearchNotes returns all notes of user myID which contain the given search
+// string (case-insensitive for ASCII characters).
+func (msgDB *MsgDB) SearchNotes(myID, search string) ([]*Note, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	// escape LIKE wildcards
+	search = strings.Replace(search, `\`, `\\`, -1)
+	search = strings.Replace(search, "%", `\%`, -1)
+	search = strings.Replace(search, "_", `\_`, -1)
+	rows, err := msgDB.searchNotesQuery.Query(self, "%"+search+"%")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var notes []*Note
+	for rows.Next() {
+		var (
+			n       Note
+			contact sql.NullString
+			msg     sql.NullInt64
+		)
+		err := rows.Scan(&n.NoteID, &contact, &msg, &n.Date, &n.Note)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		n.Contact = contact.String
+		n.MsgID = msg.Int64
+		notes = append(notes, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return notes, nil
+}
+
+// getMessageSelf returns the nym UID of user myID, if the message msgNum
+// belongs to myID.
+func (msgDB *MsgDB) getMessageSelf(myID string, msgNum int64) (int64, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, log.Error(err)
+	}
+	var (
+		self      int64
+		peer      int64
+		direction int64
+		date      int64
+		msg       string
+	)
+	err := msgDB.getMsgQuery.QueryRow(msgNum).Scan(&self, &peer, &direction,
+		&date, &msg)
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	var selfID string
+	if err := msgDB.getNymMappedQuery.QueryRow(self).Scan(&selfID); err != nil {
+		return 0, log.Error(err)
+	}
+	if myID != selfID {
+		return 0, log.Error("msgdb: unknown message")
+	}
+	return self, nil
+}
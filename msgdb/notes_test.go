@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestNotes(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContactNote(a, b, now, "met at 50% off sale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddMessageNote(a, 1, now, "follow up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddMessageNote(a, 2, now, "unknown"); err == nil {
+		t.Error("should fail")
+	}
+	notes, err := msgDB.GetContactNotes(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Note != "met at 50% off sale" {
+		t.Error("unexpected contact notes")
+	}
+	notes, err = msgDB.GetMessageNotes(a, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Note != "follow up" {
+		t.Error("unexpected message notes")
+	}
+	notes, err = msgDB.SearchNotes(a, "50%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Contact != b {
+		t.Error("unexpected search result")
+	}
+	notes, err = msgDB.SearchNotes(a, "UP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].MsgID != 1 {
+		t.Error("unexpected search result")
+	}
+	notes, err = msgDB.SearchNotes(a, "%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 {
+		t.Error("wildcards should be escaped")
+	}
+}
@@ -163,3 +163,35 @@ func (msgDB *MsgDB) SetUpkeepAccounts(myID string, t int64) error {
 	}
 	return nil
 }
+
+// GetSignature returns the signature of myID which is appended to new
+// messages ("" if none is set).
+func (msgDB *MsgDB) GetSignature(myID string) (string, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return "", log.Error(err)
+	}
+	var signature string
+	if err := msgDB.getSignatureQuery.QueryRow(myID).Scan(&signature); err != nil {
+		return "", log.Error(err)
+	}
+	return signature, nil
+}
+
+// SetSignature sets the signature of myID to signature ("" removes it).
+func (msgDB *MsgDB) SetSignature(myID, signature string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.setSignatureQuery.Exec(signature, myID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown user ID %s", myID)
+	}
+	return nil
+}
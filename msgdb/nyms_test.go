@@ -126,12 +126,12 @@ func TestDeleteNym(t *testing.T) {
 		t.Fatal(err)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddMessage(a, b, now, false, "pong", false,
+	err = msgDB.AddMessage(a, b, now, false, "pong", "", "", nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -240,7 +240,9 @@ func TestNymUpdate(t *testing.T) {
 	if _, err := io.ReadFull(cipher.RandReader, secret[:]); err != nil {
 		t.Fatal(err)
 	}
-	err = msgDB.AddAccount(a, "", privkey, server, &secret,
+	var key [ed25519.PrivateKeySize]byte
+	copy(key[:], privkey)
+	err = msgDB.AddAccount(a, "", &key, server, &secret,
 		def.MinMinDelay, def.MinMaxDelay)
 	if err != nil {
 		t.Fatal(err)
@@ -288,3 +290,36 @@ func TestNymUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestSignature(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	if err := msgDB.AddNym(a, a, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := msgDB.GetSignature(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != "" {
+		t.Error("signature should be empty")
+	}
+	if err := msgDB.SetSignature(a, "Alice\nmute.berlin"); err != nil {
+		t.Fatal(err)
+	}
+	signature, err = msgDB.GetSignature(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != "Alice\nmute.berlin" {
+		t.Errorf("wrong signature: %q", signature)
+	}
+	if err := msgDB.SetSignature("bob@mute.berlin", "Bob"); err == nil {
+		t.Error("should fail")
+	}
+}
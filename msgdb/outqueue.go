@@ -6,6 +6,7 @@ package msgdb
 
 import (
 	"database/sql"
+	"io"
 
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/uid/identity"
@@ -18,6 +19,19 @@ func (msgDB *MsgDB) AddOutQueue(
 	msgID int64,
 	encMsg, nymaddress string,
 	minDelay, maxDelay int32,
+) error {
+	return msgDB.AddOutQueueChunks(myID, msgID, []string{encMsg}, nymaddress,
+		minDelay, maxDelay)
+}
+
+// AddOutQueueChunks adds the encrypted chunks encMsgs corresponding to the
+// the plain text message with msgID to the outqueue (all or none).
+func (msgDB *MsgDB) AddOutQueueChunks(
+	myID string,
+	msgID int64,
+	encMsgs []string,
+	nymaddress string,
+	minDelay, maxDelay int32,
 ) error {
 	if err := identity.IsMapped(myID); err != nil {
 		return log.Error(err)
@@ -34,11 +48,13 @@ func (msgDB *MsgDB) AddOutQueue(
 		tx.Rollback()
 		return log.Error(err)
 	}
-	_, err = tx.Stmt(msgDB.addOutQueueQuery).Exec(mID, msgID, encMsg,
-		nymaddress, minDelay, maxDelay)
-	if err != nil {
-		tx.Rollback()
-		return log.Error(err)
+	for _, encMsg := range encMsgs {
+		_, err = tx.Stmt(msgDB.addOutQueueQuery).Exec(mID, msgID, encMsg,
+			nymaddress, minDelay, maxDelay)
+		if err != nil {
+			tx.Rollback()
+			return log.Error(err)
+		}
 	}
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
@@ -78,6 +94,27 @@ func (msgDB *MsgDB) GetOutQueue(myID string) (
 	return
 }
 
+// GetPendingCount returns the number of messages of myID which still have to
+// be encrypted (toSend) and the number of encrypted messages in the outqueue
+// which still need an envelope (outQueue). Every such message (or chunk)
+// requires a token to be sent.
+func (msgDB *MsgDB) GetPendingCount(myID string) (toSend, outQueue int64, err error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	if err := msgDB.countToSendMsgsQuery.QueryRow(mID).Scan(&toSend); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	if err := msgDB.countOutQueueQuery.QueryRow(mID).Scan(&outQueue); err != nil {
+		return 0, 0, log.Error(err)
+	}
+	return
+}
+
 // SetOutQueue replaces the encrypted message corresponding to oqIdx with the
 // envelope message envMsg.
 func (msgDB *MsgDB) SetOutQueue(oqIdx int64, envMsg string) error {
@@ -89,20 +126,28 @@ func (msgDB *MsgDB) SetOutQueue(oqIdx int64, envMsg string) error {
 
 // RemoveOutQueue remove the message corresponding to oqIdx from the outqueue
 // and sets the send time of the corresponding message to date.
+// If the entry is a receipt, the receipt status of the received message is
+// recorded instead.
 func (msgDB *MsgDB) RemoveOutQueue(oqIdx, date int64) error {
 	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
 	var msgID int64
+	var receipt string
 	// get corresponding msgID
-	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID)
+	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID, &receipt)
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// set date for message
-	_, err = tx.Stmt(msgDB.updateMsgDateQuery).Exec(date, msgID)
+	if receipt != "" {
+		// record sent receipt
+		_, err = tx.Stmt(msgDB.setReceiptSentQuery).Exec(receipt, msgID)
+	} else {
+		// set date for message
+		_, err = tx.Stmt(msgDB.updateMsgDateQuery).Exec(date, msgID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
@@ -120,21 +165,27 @@ func (msgDB *MsgDB) RemoveOutQueue(oqIdx, date int64) error {
 }
 
 // RetractOutQueue retract the message corresponding to oqIdx from the outqueue
-// and sets the corresponding message to 'ToSend' again.
+// and sets the corresponding message to 'ToSend' again (receipts are queued
+// again).
 func (msgDB *MsgDB) RetractOutQueue(oqIdx int64) error {
 	tx, err := msgDB.encDB.Begin()
 	if err != nil {
 		return log.Error(err)
 	}
 	var msgID int64
+	var receipt string
 	// get corresponding msgID
-	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID)
+	err = tx.Stmt(msgDB.getOutQueueMsgIDQuery).QueryRow(oqIdx).Scan(&msgID, &receipt)
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
 	}
-	// set date for message
-	_, err = tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(1, msgID)
+	if receipt != "" {
+		_, err = tx.Exec(requeueReceiptQuery, receipt, msgID)
+	} else {
+		// set date for message
+		_, err = tx.Stmt(msgDB.updateDeliveryMsgQuery).Exec(1, msgID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return log.Error(err)
@@ -173,3 +224,236 @@ func (msgDB *MsgDB) ClearResendOutQueue(myID string) error {
 	}
 	return nil
 }
+
+// outQueuePieceSize defines the size of the pieces encrypted messages are
+// read from the outqueue with (see OutQueueReader).
+const outQueuePieceSize = 32 * 1024
+
+// OutQueueEntry describes an entry in the outqueue (without the encrypted
+// message itself, see GetOutQueueMsg and OutQueueReader).
+type OutQueueEntry struct {
+	OQIdx      int64  // index of entry
+	NymAddress string // nymaddress to send message to
+	MinDelay   int32  // minimum delay of message
+	MaxDelay   int32  // maximum delay of message
+	Envelope   bool   // entry contains envelope and is ready to send
+	Size       int64  // size of encrypted message (in bytes)
+	Attempts   int64  // number of failed delivery attempts
+}
+
+// GetOutQueueEntry returns the next entry in the outqueue for myID which is
+// due at time now (or nil, if there is none). Entries with encrypted messages
+// of at most largeSize bytes are returned first, so that small messages are
+// not stuck behind large ones. Entries which need to be resend or whose
+// delivery has been postponed beyond now are ignored.
+func (msgDB *MsgDB) GetOutQueueEntry(myID string, now, largeSize int64) (*OutQueueEntry, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return nil, log.Error(err)
+	}
+	var (
+		entry OutQueueEntry
+		e     int64
+	)
+	err := msgDB.getOutQueueEntryQuery.QueryRow(mID, now, largeSize).Scan(
+		&entry.OQIdx, &entry.NymAddress, &entry.MinDelay, &entry.MaxDelay, &e,
+		&entry.Size, &entry.Attempts)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, log.Error(err)
+	}
+	if e > 0 {
+		entry.Envelope = true
+	}
+	return &entry, nil
+}
+
+// GetOutQueueMsg returns the encrypted message of the outqueue entry oqIdx.
+func (msgDB *MsgDB) GetOutQueueMsg(oqIdx int64) (string, error) {
+	var msg string
+	if err := msgDB.getOutQueueMsgQuery.QueryRow(oqIdx).Scan(&msg); err != nil {
+		return "", log.Error(err)
+	}
+	return msg, nil
+}
+
+// outQueueReader reads the encrypted message of an outqueue entry piece by
+// piece.
+type outQueueReader struct {
+	msgDB  *MsgDB
+	oqIdx  int64
+	offset int64  // offset of next piece in message
+	buf    []byte // unread part of current piece
+	eof    bool   // last piece has been read
+}
+
+// OutQueueReader returns a reader for the encrypted message of the outqueue
+// entry oqIdx. The message is read from the database in pieces, it is never
+// held in memory as a whole. Encrypted messages are stored base64 encoded,
+// therefore the offsets of the pieces are byte offsets.
+func (msgDB *MsgDB) OutQueueReader(oqIdx int64) io.Reader {
+	return &outQueueReader{msgDB: msgDB, oqIdx: oqIdx}
+}
+
+// Read implements the io.Reader interface.
+func (r *outQueueReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		// SQL substr() offsets start at 1
+		var piece string
+		err := r.msgDB.getOutQueuePieceQuery.QueryRow(r.offset+1,
+			outQueuePieceSize, r.oqIdx).Scan(&piece)
+		if err != nil {
+			return 0, log.Error(err)
+		}
+		if len(piece) < outQueuePieceSize {
+			r.eof = true
+		}
+		if len(piece) == 0 {
+			return 0, io.EOF
+		}
+		r.offset += int64(len(piece))
+		r.buf = []byte(piece)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// PostponeOutQueue records a failed delivery attempt for the outqueue entry
+// oqIdx and postpones the next attempt until time next.
+func (msgDB *MsgDB) PostponeOutQueue(oqIdx, next int64) error {
+	if _, err := msgDB.postponeOutQueueQuery.Exec(next, oqIdx); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// OutQueueInfo describes an entry in the outqueue (see ListOutQueue).
+type OutQueueInfo struct {
+	OQIdx       int64  // index of entry
+	MsgID       int64  // message ID of the corresponding plain text message
+	Peer        string // mapped ID of the recipient
+	MinDelay    int32  // minimum delay of message
+	MaxDelay    int32  // maximum delay of message
+	Envelope    bool   // entry contains envelope and is ready to send
+	Resend      bool   // entry needs resend
+	Attempts    int64  // number of failed delivery attempts
+	NextAttempt int64  // time before which delivery is postponed
+	Size        int64  // size of encrypted message (in bytes)
+}
+
+// ListOutQueue returns all entries in the outqueue for myID.
+func (msgDB *MsgDB) ListOutQueue(myID string) ([]*OutQueueInfo, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.listOutQueueQuery.Query(mID)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var entries []*OutQueueInfo
+	for rows.Next() {
+		var (
+			e      OutQueueInfo
+			env    int64
+			resend int64
+		)
+		err := rows.Scan(&e.OQIdx, &e.MsgID, &e.Peer, &e.MinDelay, &e.MaxDelay,
+			&env, &resend, &e.Attempts, &e.NextAttempt, &e.Size)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		e.Envelope = env > 0
+		e.Resend = resend > 0
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
+
+// RetryOutQueue clears the resend status and postponed deliveries of the
+// outqueue entries of message msgID of myID (of all messages, if msgID is 0),
+// so that they are delivered with the next call of procOutQueue.
+func (msgDB *MsgDB) RetryOutQueue(myID string, msgID int64) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.retryOutQueueQuery.Exec(mID, msgID, msgID)
+	if err != nil {
+		return log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if msgID != 0 && nRows == 0 {
+		return log.Errorf("msgdb: message %d not in outqueue", msgID)
+	}
+	return nil
+}
+
+// DropOutQueue cancels the delivery of the sent message msgID of myID: all
+// corresponding outqueue entries are removed and the message is not
+// encrypted for sending anymore. The message itself is kept and remains
+// unsent.
+func (msgDB *MsgDB) DropOutQueue(myID string, msgID int64) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var mID int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&mID); err != nil {
+		return log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.dropOutQueueQuery).Exec(mID, msgID)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	dropped, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	res, err = tx.Stmt(msgDB.cancelMsgQuery).Exec(mID, msgID)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	cancelled, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if dropped == 0 && cancelled == 0 {
+		tx.Rollback()
+		return log.Errorf("msgdb: message %d not queued", msgID)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
@@ -5,7 +5,9 @@
 package msgdb
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/mutecomm/mute/def"
@@ -28,12 +30,19 @@ func TestOutQueue(t *testing.T) {
 		t.Fatal(err)
 	}
 	now := times.Now()
-	err = msgDB.AddMessage(a, b, now, true, "ping", false,
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
 		def.MinDelay, def.MaxDelay)
 	if err != nil {
 		t.Fatal(err)
 	}
-	msgID, peer, msg, sign, minDelay, maxDelay, err := msgDB.GetUndeliveredMessage(a)
+	toSend, outQueue, err := msgDB.GetPendingCount(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toSend != 1 || outQueue != 0 {
+		t.Errorf("wrong pending count: %d, %d", toSend, outQueue)
+	}
+	msgID, peer, msg, sign, minDelay, maxDelay, err := msgDB.GetUndeliveredMessage(a, now)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,8 +64,15 @@ func TestOutQueue(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	toSend, outQueue, err = msgDB.GetPendingCount(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toSend != 0 || outQueue != 1 {
+		t.Errorf("wrong pending count: %d, %d", toSend, outQueue)
+	}
 	// afterwards there should be no undelivered message
-	_, peer, _, _, _, _, err = msgDB.GetUndeliveredMessage(a)
+	_, peer, _, _, _, _, err = msgDB.GetUndeliveredMessage(a, now)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +107,7 @@ func TestOutQueue(t *testing.T) {
 		t.Fatal(err)
 	}
 	// message should be back
-	_, peer, _, _, _, _, err = msgDB.GetUndeliveredMessage(a)
+	_, peer, _, _, _, _, err = msgDB.GetUndeliveredMessage(a, now)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +121,7 @@ func TestOutQueue(t *testing.T) {
 		t.Fatal(err)
 	}
 	// afterwards there should be no undelivered message
-	_, _, _, _, _, _, err = msgDB.GetUndeliveredMessage(a)
+	_, _, _, _, _, _, err = msgDB.GetUndeliveredMessage(a, now)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,3 +180,182 @@ func TestOutQueue(t *testing.T) {
 		t.Error("envelope should be empty")
 	}
 }
+
+func TestOutQueueEntry(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add large message before small one
+	large := strings.Repeat("x", 2*outQueuePieceSize+1)
+	err = msgDB.AddOutQueueChunks(a, 1, []string{large, "small"}, "nymaddress",
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// small message comes first
+	entry, err := msgDB.GetOutQueueEntry(a, now, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.OQIdx != 2 || entry.Size != 5 {
+		t.Fatalf("wrong first entry: %v", entry)
+	}
+	if err := msgDB.PostponeOutQueue(entry.OQIdx, now+60); err != nil {
+		t.Fatal(err)
+	}
+	// postponed small message is skipped
+	entry, err = msgDB.GetOutQueueEntry(a, now, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.OQIdx != 1 || entry.Size != int64(len(large)) {
+		t.Fatalf("wrong second entry: %v", entry)
+	}
+	// stream large message
+	msg, err := ioutil.ReadAll(msgDB.OutQueueReader(entry.OQIdx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != large {
+		t.Error("streamed message differs")
+	}
+	// postponed small message is due again later
+	if err := msgDB.RemoveOutQueue(entry.OQIdx, now); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = msgDB.GetOutQueueEntry(a, now, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Errorf("entry should be postponed: %v", entry)
+	}
+	entry, err = msgDB.GetOutQueueEntry(a, now+60, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Attempts != 1 {
+		t.Fatalf("wrong postponed entry: %v", entry)
+	}
+	small, err := msgDB.GetOutQueueMsg(entry.OQIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small != "small" {
+		t.Errorf("wrong message: %s", small)
+	}
+}
+
+func TestQueueManagement(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	err = msgDB.AddMessage(a, b, now, true, "ping", "", "", nil, false,
+		def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.AddOutQueue(a, 1, "encrypted", "nymaddress", def.MinDelay,
+		def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.PostponeOutQueue(1, now+60); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetResendOutQueue(1); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := msgDB.ListOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("wrong number of outqueue entries: %d", len(entries))
+	}
+	e := entries[0]
+	if e.MsgID != 1 || e.Peer != b || e.MinDelay != def.MinDelay ||
+		e.MaxDelay != def.MaxDelay || !e.Resend || e.Attempts != 1 ||
+		e.NextAttempt != now+60 || e.Size != int64(len("encrypted")) {
+		t.Errorf("wrong outqueue entry: %v", e)
+	}
+	// retry
+	if err := msgDB.RetryOutQueue(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := msgDB.GetOutQueueEntry(a, now, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.OQIdx != 1 {
+		t.Fatalf("retried entry not due: %v", entry)
+	}
+	if err := msgDB.RetryOutQueue(a, 2); err == nil {
+		t.Error("RetryOutQueue() should fail for unknown message")
+	}
+	// drop
+	if err := msgDB.DropOutQueue(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = msgDB.ListOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("outqueue should be empty: %d", len(entries))
+	}
+	_, peer, _, _, _, _, err := msgDB.GetUndeliveredMessage(a, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != "" {
+		t.Error("dropped message should not be sent")
+	}
+	if err := msgDB.DropOutQueue(a, 1); err == nil {
+		t.Error("DropOutQueue() should fail for dropped message")
+	}
+	// inqueue
+	if err := msgDB.AddInQueue(a, "", now, "envelope"); err != nil {
+		t.Fatal(err)
+	}
+	inEntries, err := msgDB.ListInQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inEntries) != 1 {
+		t.Fatalf("wrong number of inqueue entries: %d", len(inEntries))
+	}
+	if inEntries[0].ContactID != "" || inEntries[0].Date != now ||
+		!inEntries[0].Envelope || inEntries[0].Size != int64(len("envelope")) {
+		t.Errorf("wrong inqueue entry: %v", inEntries[0])
+	}
+}
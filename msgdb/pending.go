@@ -0,0 +1,219 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// PendingEntry is a received message which could not be decrypted, because
+// it belongs to an unknown session (see msg.ErrSessionUnknown).
+type PendingEntry struct {
+	PID     int64  // the pending ID
+	From    string // mapped sender ID claimed in the (unauthenticated) header
+	Date    int64  // time when the message was received from muteaccd
+	Restart bool   // requested session restart has not been sent to sender yet
+	Size    int64  // size of the encrypted message
+}
+
+// PendInQueue moves the encrypted message with index iqIdx from inqueue to
+// the pending messages, recording fromID as sender. Since the sender of a
+// message of an unknown session cannot be authenticated, no session restart
+// is requested automatically (see RequestRestart).
+func (msgDB *MsgDB) PendInQueue(iqIdx int64, fromID string) error {
+	if err := identity.IsMapped(fromID); err != nil {
+		return log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.addPendingQuery).Exec(fromID, iqIdx)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if nRows == 0 {
+		tx.Rollback()
+		return log.Errorf("msgdb: unknown inqueue entry %d", iqIdx)
+	}
+	if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// GetPending returns all pending messages of user myID.
+func (msgDB *MsgDB) GetPending(myID string) ([]*PendingEntry, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getPendingQuery.Query(self)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var entries []*PendingEntry
+	for rows.Next() {
+		var e PendingEntry
+		var restart int64
+		err := rows.Scan(&e.PID, &e.From, &e.Date, &restart, &e.Size)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		e.Restart = restart > 0
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
+
+// DelPending deletes the pending message pid of user myID.
+func (msgDB *MsgDB) DelPending(myID string, pid int64) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.delPendingQuery.Exec(pid, self)
+	if err != nil {
+		return log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if nRows == 0 {
+		return log.Errorf("msgdb: unknown pending message %d", pid)
+	}
+	return nil
+}
+
+// RequestRestart requests a session restart between myID and contactID for
+// the pending messages from contactID (see RestartRequested). It returns an
+// error, if no messages from contactID are pending.
+func (msgDB *MsgDB) RequestRestart(myID, contactID string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.requestRestartQuery.Exec(self, contactID)
+	if err != nil {
+		return log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if nRows == 0 {
+		return log.Errorf("msgdb: no pending messages from %s", contactID)
+	}
+	return nil
+}
+
+// RetryPending moves all pending messages of user myID from contactID back
+// to the inqueue, so that their decryption is retried. It should be called
+// after a message from contactID has been decrypted (that is, the session
+// with contactID is known again). It returns the number of moved messages.
+func (msgDB *MsgDB) RetryPending(myID, contactID string) (int64, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return 0, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return 0, log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return 0, log.Error(err)
+	}
+	res, err := tx.Stmt(msgDB.retryPendingQuery).Exec(self, contactID)
+	if err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	if _, err := tx.Stmt(msgDB.delPendingFromQuery).Exec(self, contactID); err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, log.Error(err)
+	}
+	return nRows, nil
+}
+
+// RestartRequested returns true, if the session between myID and contactID
+// has to be restarted, because a message from contactID is pending.
+func (msgDB *MsgDB) RestartRequested(myID, contactID string) (bool, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return false, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return false, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return false, log.Error(err)
+	}
+	var n int64
+	err := msgDB.getRestartQuery.QueryRow(self, contactID).Scan(&n)
+	if err != nil {
+		return false, log.Error(err)
+	}
+	return n > 0, nil
+}
+
+// ClearRestart records that the session between myID and contactID has been
+// restarted.
+func (msgDB *MsgDB) ClearRestart(myID, contactID string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	if _, err := msgDB.clearRestartQuery.Exec(self, contactID); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestPending(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	if err := msgDB.AddInQueue(a, "", now, "encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetInQueue(iqIdx, "decrypted envelope"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.PendInQueue(iqIdx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.PendInQueue(iqIdx, b); err == nil {
+		t.Error("should fail for unknown inqueue entry")
+	}
+	_, myID, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myID != "" {
+		t.Error("inqueue should be empty")
+	}
+	entries, err := msgDB.GetPending(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d != 1", len(entries))
+	}
+	e := entries[0]
+	if e.From != b || e.Date != now || e.Restart ||
+		e.Size != int64(len("decrypted envelope")) {
+		t.Errorf("wrong pending entry: %+v", e)
+	}
+	restart, err := msgDB.RestartRequested(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restart {
+		t.Error("restart should not be requested automatically")
+	}
+	if err := msgDB.RequestRestart(a, a); err == nil {
+		t.Error("should fail without pending messages")
+	}
+	if err := msgDB.RequestRestart(a, b); err != nil {
+		t.Fatal(err)
+	}
+	restart, err = msgDB.RestartRequested(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restart {
+		t.Error("restart should be requested")
+	}
+	if err := msgDB.ClearRestart(a, b); err != nil {
+		t.Fatal(err)
+	}
+	restart, err = msgDB.RestartRequested(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restart {
+		t.Error("restart should be cleared")
+	}
+	if err := msgDB.DelPending(a, e.PID); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.DelPending(a, e.PID); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestRetryPending(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	for _, from := range []string{b, c} {
+		if err := msgDB.AddInQueue(a, "", now, "encrypted"); err != nil {
+			t.Fatal(err)
+		}
+		iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msgDB.SetInQueue(iqIdx, "message from "+from); err != nil {
+			t.Fatal(err)
+		}
+		if err := msgDB.PendInQueue(iqIdx, from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := msgDB.RetryPending(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("RetryPending() = %d != 1", n)
+	}
+	_, myID, _, msg, envelope, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myID != a || msg != "message from "+b || envelope {
+		t.Errorf("wrong inqueue entry: %s %s %v", myID, msg, envelope)
+	}
+	entries, err := msgDB.GetPending(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].From != c {
+		t.Error("only pending message from carol should be left")
+	}
+	n, err = msgDB.RetryPending(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("RetryPending() = %d != 0", n)
+	}
+}
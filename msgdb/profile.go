@@ -0,0 +1,36 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"github.com/mutecomm/mute/log"
+)
+
+// Network profiles.
+const (
+	ProfileNormal      = "normal"      // default profile
+	ProfileConstrained = "constrained" // for satellite or metered connections
+)
+
+// GetNetworkProfile returns the network profile stored in msgDB (the default
+// is ProfileNormal).
+func (msgDB *MsgDB) GetNetworkProfile() (string, error) {
+	profile, err := msgDB.GetValue(NetworkProfile)
+	if err != nil {
+		return "", err
+	}
+	if profile == "" {
+		return ProfileNormal, nil
+	}
+	return profile, nil
+}
+
+// SetNetworkProfile stores the given network profile in msgDB.
+func (msgDB *MsgDB) SetNetworkProfile(profile string) error {
+	if profile != ProfileNormal && profile != ProfileConstrained {
+		return log.Errorf("msgdb: unknown network profile '%s'", profile)
+	}
+	return msgDB.AddValue(NetworkProfile, profile)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+// GetProxy returns the SOCKS5 proxy URL and the per-domain proxy overrides
+// stored in msgDB (empty, if no proxy is configured).
+func (msgDB *MsgDB) GetProxy() (proxyURL, domainProxies string, err error) {
+	proxyURL, err = msgDB.GetValue(Proxy)
+	if err != nil {
+		return "", "", err
+	}
+	domainProxies, err = msgDB.GetValue(ProxyDomains)
+	if err != nil {
+		return "", "", err
+	}
+	return proxyURL, domainProxies, nil
+}
+
+// setOrDelValue sets key to value in msgDB or deletes it, if value is empty.
+func (msgDB *MsgDB) setOrDelValue(key, value string) error {
+	if value == "" {
+		return msgDB.DelValue(key)
+	}
+	return msgDB.AddValue(key, value)
+}
+
+// SetProxy stores the SOCKS5 proxy URL and the per-domain proxy overrides
+// (see netproxy.ParseOverrides) in msgDB. Empty values remove the proxy
+// configuration.
+func (msgDB *MsgDB) SetProxy(proxyURL, domainProxies string) error {
+	if err := msgDB.setOrDelValue(Proxy, proxyURL); err != nil {
+		return err
+	}
+	return msgDB.setOrDelValue(ProxyDomains, domainProxies)
+}
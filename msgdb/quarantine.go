@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"strconv"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/msg/mime"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+// ReceivePolicy defines which received messages are accepted. Messages
+// violating the policy are quarantined instead of being stored.
+type ReceivePolicy struct {
+	MaxMsgSize        int  // maximum size of a decrypted message (0: unlimited)
+	MaxAttachments    int  // maximum number of attachments (-1: unlimited)
+	RejectExecutables bool // reject messages with executable attachments
+}
+
+// DefaultReceivePolicy is the receive policy used for unset values.
+// The default maximum message size is the largest message which can be sent
+// (in chunks), so that reassembled messages are accepted.
+var DefaultReceivePolicy = ReceivePolicy{
+	MaxMsgSize:        mime.MaxMsgSize,
+	MaxAttachments:    10,
+	RejectExecutables: true,
+}
+
+// GetReceivePolicy returns the receive policy stored in msgDB (unset values
+// are taken from DefaultReceivePolicy).
+func (msgDB *MsgDB) GetReceivePolicy() (*ReceivePolicy, error) {
+	policy := DefaultReceivePolicy
+	value, err := msgDB.GetValue(RecvMaxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		policy.MaxMsgSize, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	value, err = msgDB.GetValue(RecvMaxAttachments)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		policy.MaxAttachments, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	value, err = msgDB.GetValue(RecvRejectExecutables)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		policy.RejectExecutables, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return &policy, nil
+}
+
+// SetReceivePolicy stores the given receive policy in msgDB.
+func (msgDB *MsgDB) SetReceivePolicy(policy *ReceivePolicy) error {
+	if policy.MaxMsgSize < 0 {
+		return log.Error("msgdb: maximum message size must not be negative")
+	}
+	if policy.MaxAttachments < -1 {
+		return log.Error("msgdb: maximum number of attachments must be >= -1")
+	}
+	err := msgDB.AddValue(RecvMaxMsgSize, strconv.Itoa(policy.MaxMsgSize))
+	if err != nil {
+		return err
+	}
+	err = msgDB.AddValue(RecvMaxAttachments, strconv.Itoa(policy.MaxAttachments))
+	if err != nil {
+		return err
+	}
+	return msgDB.AddValue(RecvRejectExecutables,
+		strconv.FormatBool(policy.RejectExecutables))
+}
+
+// QuarantineEntry is a received message which violated the receive policy.
+type QuarantineEntry struct {
+	QID    int64  // the quarantine ID
+	From   string // mapped sender ID
+	Date   int64  // time when the message was received from muteaccd
+	Reason string // why the message has been quarantined
+	Size   int64  // size of the quarantined message
+}
+
+// QuarantineInQueue moves the decrypted message plainMsg with index iqIdx from
+// inqueue into quarantine, recording fromID as sender and the given reason.
+func (msgDB *MsgDB) QuarantineInQueue(
+	iqIdx int64,
+	plainMsg, fromID, reason string,
+) error {
+	if err := identity.IsMapped(fromID); err != nil {
+		return log.Error(err)
+	}
+	var mID int64
+	var cID int64
+	var date int64
+	err := msgDB.getInQueueIDsQuery.QueryRow(iqIdx).Scan(&mID, &cID, &date)
+	if err != nil {
+		return log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(msgDB.addQuarantineQuery).Exec(mID, fromID, date, reason,
+		plainMsg)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(msgDB.removeInQueueQuery).Exec(iqIdx); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// GetQuarantine returns all quarantined messages of user myID.
+func (msgDB *MsgDB) GetQuarantine(myID string) ([]*QuarantineEntry, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	rows, err := msgDB.getQuarantineQuery.Query(self)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	var entries []*QuarantineEntry
+	for rows.Next() {
+		var e QuarantineEntry
+		if err := rows.Scan(&e.QID, &e.From, &e.Date, &e.Reason, &e.Size); err != nil {
+			return nil, log.Error(err)
+		}
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return entries, nil
+}
+
+// DelQuarantine deletes the quarantined message qid of user myID.
+func (msgDB *MsgDB) DelQuarantine(myID string, qid int64) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.delQuarantineQuery.Exec(qid, self)
+	if err != nil {
+		return log.Error(err)
+	}
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if nRows == 0 {
+		return log.Errorf("msgdb: unknown quarantined message %d", qid)
+	}
+	return nil
+}
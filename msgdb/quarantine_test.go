@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestReceivePolicy(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	policy, err := msgDB.GetReceivePolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *policy != DefaultReceivePolicy {
+		t.Error("policy should be default policy")
+	}
+	policy = &ReceivePolicy{
+		MaxMsgSize:        100,
+		MaxAttachments:    -1,
+		RejectExecutables: false,
+	}
+	if err := msgDB.SetReceivePolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	p, err := msgDB.GetReceivePolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *p != *policy {
+		t.Error("policies differ")
+	}
+	if err := msgDB.SetReceivePolicy(&ReceivePolicy{MaxMsgSize: -1}); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	if err := msgDB.AddInQueue(a, "", now, "encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.QuarantineInQueue(iqIdx, "plaintext", b, "too large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, myID, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myID != "" {
+		t.Error("inqueue should be empty")
+	}
+	entries, err := msgDB.GetQuarantine(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.From != b || e.Date != now || e.Reason != "too large" ||
+		e.Size != int64(len("plaintext")) {
+		t.Error("unexpected quarantine entry")
+	}
+	if err := msgDB.DelQuarantine(a, e.QID); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.DelQuarantine(a, e.QID); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+/*
+Receipts are strictly opt-in per contact (see SetContactReceipts). For a
+received message the pending receipt is stored in Messages.ReceiptToSend until
+it is encrypted and added to the outqueue (see AddOutQueueReceipt), the sent
+receipt in Messages.Receipt. For a sent message Messages.Receipt stores the
+receipt status received from the peer (see SetMessageReceipt).
+
+A 'read' receipt supersedes a 'delivered' receipt, the status is never
+downgraded.
+*/
+
+// Receipt states of a message.
+const (
+	ReceiptDelivered = "delivered" // message has been delivered to peer
+	ReceiptRead      = "read"      // message has been read by peer
+)
+
+// checkReceipt checks that status is a valid receipt status.
+func checkReceipt(status string) error {
+	if status != ReceiptDelivered && status != ReceiptRead {
+		return log.Errorf("msgdb: invalid receipt status '%s'", status)
+	}
+	return nil
+}
+
+// GetContactReceipts returns true, if receipts are exchanged with the contact
+// contactID of myID.
+func (msgDB *MsgDB) GetContactReceipts(myID, contactID string) (bool, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return false, log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return false, log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return false, log.Error(err)
+	}
+	var receipts int64
+	err := msgDB.getContactReceiptsQuery.QueryRow(uid, contactID).Scan(&receipts)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, log.Error(err)
+	}
+	return receipts > 0, nil
+}
+
+// SetContactReceipts enables (or disables, if receipts is false) the exchange
+// of delivery and read receipts with the contact contactID of myID.
+func (msgDB *MsgDB) SetContactReceipts(myID, contactID string, receipts bool) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	// get MyID
+	var uid int
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&uid); err != nil {
+		return log.Error(err)
+	}
+	var r int64
+	if receipts {
+		r = 1
+	}
+	res, err := msgDB.setContactReceiptsQuery.Exec(r, uid, contactID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		return log.Errorf("msgdb: unknown contact %s for user ID %s",
+			contactID, myID)
+	}
+	return nil
+}
+
+// QueueReceipt queues a receipt with status for the received message msgNum
+// of myID. Nothing is queued, if the sender did not opt in to receipts, if the
+// message has no message ID, or if a 'read' receipt has been sent already.
+func (msgDB *MsgDB) QueueReceipt(myID string, msgNum int64, status string) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := checkReceipt(status); err != nil {
+		return err
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	if _, err := msgDB.queueReceiptQuery.Exec(status, msgNum, self); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// GetPendingReceipt returns the first receipt of myID which still has to be
+// encrypted and added to the outqueue: the receipt status for the received
+// message msgNum with messageID from contactID. If no receipt is pending,
+// msgNum is 0.
+func (msgDB *MsgDB) GetPendingReceipt(myID string) (
+	msgNum int64,
+	contactID, messageID, status string,
+	err error,
+) {
+	if err := identity.IsMapped(myID); err != nil {
+		return 0, "", "", "", log.Error(err)
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return 0, "", "", "", log.Error(err)
+	}
+	err = msgDB.getPendingReceiptQuery.QueryRow(self).Scan(&msgNum, &contactID,
+		&messageID, &status)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, "", "", "", nil
+	case err != nil:
+		return 0, "", "", "", log.Error(err)
+	}
+	return
+}
+
+// AddOutQueueReceipt adds the encrypted receipt encMsg with status for the
+// received message msgNum to the outqueue of myID and marks the receipt as
+// no longer pending.
+func (msgDB *MsgDB) AddOutQueueReceipt(
+	myID string,
+	msgNum int64,
+	encMsg, nymaddress string,
+	minDelay, maxDelay int32,
+	status string,
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := checkReceipt(status); err != nil {
+		return err
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	_, err = tx.Stmt(msgDB.addOutQueueReceiptQuery).Exec(self, msgNum, encMsg,
+		nymaddress, minDelay, maxDelay, status)
+	if err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if _, err := tx.Stmt(msgDB.clearReceiptToSendQuery).Exec(msgNum); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	return nil
+}
+
+// SetMessageReceipt records the receipt status received from contactID for
+// the message with messageID which myID sent to contactID. Receipts for
+// unknown messages are ignored.
+func (msgDB *MsgDB) SetMessageReceipt(
+	myID, contactID, messageID, status string,
+) error {
+	if err := identity.IsMapped(myID); err != nil {
+		return log.Error(err)
+	}
+	if err := identity.IsMapped(contactID); err != nil {
+		return log.Error(err)
+	}
+	if err := checkReceipt(status); err != nil {
+		return err
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return log.Error(err)
+	}
+	var peer int64
+	err := msgDB.getContactUIDQuery.QueryRow(self, contactID).Scan(&peer)
+	if err != nil {
+		return log.Error(err)
+	}
+	res, err := msgDB.setMsgReceiptQuery.Exec(status, self, peer, messageID)
+	if err != nil {
+		return log.Error(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.Error(err)
+	}
+	if n < 1 {
+		log.Infof("msgdb: ignored '%s' receipt for message %s from %s",
+			status, messageID, contactID)
+	}
+	return nil
+}
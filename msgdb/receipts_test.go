@@ -0,0 +1,146 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+	"github.com/mutecomm/mute/util/times"
+)
+
+func TestReceipts(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	now := times.Now()
+	// receipts are opt-in
+	if err := msgDB.AddInQueue(a, b, now, "envelope1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.RemoveInQueue(1, "msg1", "id1@mute.berlin", "", b, SigStatusUnsigned, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	msgNum, _, _, _, err := msgDB.GetPendingReceipt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgNum != 0 {
+		t.Error("receipt pending without opt-in")
+	}
+	receipts, err := msgDB.GetContactReceipts(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipts {
+		t.Error("receipts should be disabled by default")
+	}
+	if err := msgDB.SetContactReceipts(a, b, true); err != nil {
+		t.Fatal(err)
+	}
+	// received message
+	if err := msgDB.AddInQueue(a, b, now, "envelope2"); err != nil {
+		t.Fatal(err)
+	}
+	iqIdx, _, _, _, _, err := msgDB.GetInQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.RemoveInQueue(iqIdx, "msg2", "id2@mute.berlin", "", b, SigStatusUnsigned, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	msgNum, contactID, messageID, status, err := msgDB.GetPendingReceipt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgNum != 2 || contactID != b || messageID != "id2@mute.berlin" ||
+		status != ReceiptDelivered {
+		t.Errorf("wrong pending receipt: %d, %s, %s, %s", msgNum, contactID,
+			messageID, status)
+	}
+	// reading the message supersedes the delivery receipt
+	if err := msgDB.QueueReceipt(a, 2, ReceiptRead); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, status, err = msgDB.GetPendingReceipt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != ReceiptRead {
+		t.Errorf("status != %s", ReceiptRead)
+	}
+	err = msgDB.AddOutQueueReceipt(a, 2, "encrypted", "nymaddress",
+		def.MinDelay, def.MaxDelay, ReceiptRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgNum, _, _, _, err = msgDB.GetPendingReceipt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgNum != 0 {
+		t.Error("receipt still pending")
+	}
+	oqIdx, _, _, _, _, _, err := msgDB.GetOutQueue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.RemoveOutQueue(oqIdx, now); err != nil {
+		t.Fatal(err)
+	}
+	// 'read' receipts are sent only once
+	if err := msgDB.QueueReceipt(a, 2, ReceiptRead); err != nil {
+		t.Fatal(err)
+	}
+	msgNum, _, _, _, err = msgDB.GetPendingReceipt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgNum != 0 {
+		t.Error("'read' receipt queued twice")
+	}
+	// sent message
+	err = msgDB.AddMessage(a, b, now, true, "msg3", "id3@mute.berlin", "",
+		nil, false, def.MinDelay, def.MaxDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetMessageReceipt(a, b, "id3@mute.berlin", ReceiptRead); err != nil {
+		t.Fatal(err)
+	}
+	// receipt status is never downgraded
+	if err := msgDB.SetMessageReceipt(a, b, "id3@mute.berlin", ReceiptDelivered); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetMessageReceipt(a, b, "id3@mute.berlin", "unknown"); err == nil {
+		t.Error("SetMessageReceipt() should fail for invalid status")
+	}
+	msgIDs, err := msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgIDs) != 3 {
+		t.Fatalf("len(msgIDs) != 3")
+	}
+	if msgIDs[1].Receipt != ReceiptRead {
+		t.Errorf("wrong receipt status of received message: %s",
+			msgIDs[1].Receipt)
+	}
+	if msgIDs[2].Receipt != ReceiptRead {
+		t.Errorf("wrong receipt status of sent message: %s", msgIDs[2].Receipt)
+	}
+}
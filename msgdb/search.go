@@ -0,0 +1,208 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/uid/identity"
+)
+
+/*
+The search index allows to filter messages by sender, date, and subject
+without scanning all messages. It is stored in the (encrypted) SearchIndex
+table and maintained incrementally whenever a message is added.
+
+Every message is indexed with the following terms:
+
+  "f:" + mapped sender ID
+  "s:" + trigram of the lowercased subject line (for every trigram)
+
+The date of a message is indexed as a bucket (days since epoch). Index lookups
+only return candidates, the exact filter is applied to the candidates
+afterwards.
+*/
+
+const (
+	addSearchTermQuery    = "INSERT OR IGNORE INTO SearchIndex (Self, Msg, Bucket, Term) VALUES (?, ?, ?, ?);"
+	searchAllQuery        = "SELECT DISTINCT Msg FROM SearchIndex WHERE Self=? AND Bucket>=? ORDER BY Msg ASC;"
+	searchTermsQuery      = "SELECT Msg FROM SearchIndex WHERE Self=? AND Bucket>=? AND Term IN (%s) GROUP BY Msg HAVING COUNT(*)=? ORDER BY Msg ASC;"
+	getMsgsToIndexQuery   = "SELECT MsgID, Self, \"From\", Date, Subject FROM Messages;"
+	searchBucketSize      = 24 * 60 * 60 // size of date buckets (in seconds)
+	searchSenderPrefix    = "f:"
+	searchSubjectPrefix   = "s:"
+	searchSubjectGramSize = 3
+)
+
+// SearchFilter defines the filter used by SearchMsgIDs. Empty fields match
+// all messages.
+type SearchFilter struct {
+	From    string // mapped ID of the sender
+	Since   int64  // minimum date of the message (Unix time)
+	Subject string // substring of the subject line (case-insensitive)
+}
+
+// subjectGrams returns the distinct trigrams of the lowercased subject.
+func subjectGrams(subject string) []string {
+	runes := []rune(strings.ToLower(subject))
+	seen := make(map[string]bool)
+	var grams []string
+	for i := 0; i+searchSubjectGramSize <= len(runes); i++ {
+		gram := string(runes[i : i+searchSubjectGramSize])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// searchTerms returns the search terms of a message with sender from and the
+// given subject.
+func searchTerms(from, subject string) []string {
+	terms := []string{searchSenderPrefix + from}
+	for _, gram := range subjectGrams(subject) {
+		terms = append(terms, searchSubjectPrefix+gram)
+	}
+	return terms
+}
+
+// indexMessage adds the message msgNum of self to the search index.
+func indexMessage(
+	tx *sql.Tx,
+	self, msgNum, date int64,
+	from, subject string,
+) error {
+	bucket := date / searchBucketSize
+	for _, term := range searchTerms(from, subject) {
+		_, err := tx.Exec(addSearchTermQuery, self, msgNum, bucket, term)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexMessages adds all messages to the search index.
+func reindexMessages(tx *sql.Tx) error {
+	rows, err := tx.Query(getMsgsToIndexQuery)
+	if err != nil {
+		return err
+	}
+	type msg struct {
+		msgNum  int64
+		self    int64
+		from    string
+		date    int64
+		subject sql.NullString
+	}
+	var msgs []msg
+	for rows.Next() {
+		var m msg
+		err := rows.Scan(&m.msgNum, &m.self, &m.from, &m.date, &m.subject)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+	for _, m := range msgs {
+		err := indexMessage(tx, m.self, m.msgNum, m.date, m.from,
+			m.subject.String)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchMsgIDs returns the message IDs of user ID myID which match filter,
+// ordered by message number.
+func (msgDB *MsgDB) SearchMsgIDs(myID string, filter *SearchFilter) ([]*MsgID, error) {
+	if err := identity.IsMapped(myID); err != nil {
+		return nil, log.Error(err)
+	}
+	if filter.From != "" {
+		if err := identity.IsMapped(filter.From); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	var self int64
+	if err := msgDB.getNymUIDQuery.QueryRow(myID).Scan(&self); err != nil {
+		return nil, log.Error(err)
+	}
+	// look up candidates in search index
+	var terms []string
+	if filter.From != "" {
+		terms = append(terms, searchSenderPrefix+filter.From)
+	}
+	for _, gram := range subjectGrams(filter.Subject) {
+		terms = append(terms, searchSubjectPrefix+gram)
+	}
+	var bucket int64
+	if filter.Since > 0 {
+		bucket = filter.Since / searchBucketSize
+	}
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if len(terms) == 0 {
+		rows, err = msgDB.encDB.Query(searchAllQuery, self, bucket)
+	} else {
+		args := []interface{}{self, bucket}
+		for _, term := range terms {
+			args = append(args, term)
+		}
+		args = append(args, len(terms))
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(terms)), ", ")
+		rows, err = msgDB.encDB.Query(strings.Replace(searchTermsQuery, "%s",
+			placeholders, 1), args...)
+	}
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	var candidates []int64
+	for rows.Next() {
+		var msgNum int64
+		if err := rows.Scan(&msgNum); err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		candidates = append(candidates, msgNum)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// apply exact filter to candidates
+	subject := strings.ToLower(filter.Subject)
+	var msgIDs []*MsgID
+	for _, msgNum := range candidates {
+		msgID, err := scanMsgID(msgDB.getMsgIDQuery.QueryRow(msgNum, self))
+		if err != nil {
+			return nil, err
+		}
+		if filter.From != "" && msgID.From != filter.From {
+			continue
+		}
+		if msgID.Date < filter.Since {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(msgID.Subject), subject) {
+			continue
+		}
+		msgIDs = append(msgIDs, msgID)
+	}
+	return msgIDs, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mutecomm/mute/def"
+)
+
+func TestSearchMsgIDs(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	c := "carol@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, c, c, "", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	day := int64(searchBucketSize)
+	msgs := []struct {
+		peer    string
+		date    int64
+		message string
+	}{
+		{b, 10 * day, "Meeting on Monday\nbody"},
+		{c, 11 * day, "Re: meeting on Monday\nbody"},
+		{b, 12*day + 100, "Lunch\nbody"},
+		{b, 13 * day, "Hi\nbody"},
+	}
+	for _, m := range msgs {
+		err := msgDB.AddMessage(a, m.peer, m.date, false, m.message, "", "",
+			nil, false, def.MinDelay, def.MaxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		filter SearchFilter
+		msgIDs []int64
+	}{
+		{SearchFilter{}, []int64{1, 2, 3, 4}},
+		{SearchFilter{From: b}, []int64{1, 3, 4}},
+		{SearchFilter{Subject: "MEETING"}, []int64{1, 2}},
+		{SearchFilter{From: c, Subject: "meeting"}, []int64{2}},
+		{SearchFilter{Since: 12*day + 50}, []int64{3, 4}},
+		{SearchFilter{Subject: "hi"}, []int64{4}},
+		{SearchFilter{Subject: "dinner"}, nil},
+	}
+	for i, test := range tests {
+		ids, err := msgDB.SearchMsgIDs(a, &test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != len(test.msgIDs) {
+			t.Errorf("test %d: len(ids) = %d, expected %d", i, len(ids),
+				len(test.msgIDs))
+			continue
+		}
+		for j, id := range ids {
+			if id.MsgID != test.msgIDs[j] {
+				t.Errorf("test %d: ids[%d].MsgID = %d, expected %d", i, j,
+					id.MsgID, test.msgIDs[j])
+			}
+		}
+	}
+	// deleted messages are removed from the index
+	if err := msgDB.DelMessage(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := msgDB.SearchMsgIDs(a, &SearchFilter{Subject: "meeting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].MsgID != 2 {
+		t.Error("deleted message still found")
+	}
+}
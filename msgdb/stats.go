@@ -0,0 +1,41 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"github.com/mutecomm/mute/log"
+)
+
+// QueueStats contains statistics about the message queues of a msgDB.
+type QueueStats struct {
+	OutQueue         int64 // number of messages in out queue
+	OutQueueEnvelope int64 // number of messages in out queue ready to send
+	OutQueueResend   int64 // number of messages in out queue marked for resend
+	InQueue          int64 // number of messages in in queue
+	InQueueEnvelope  int64 // number of messages in in queue with envelope
+	Undelivered      int64 // number of messages still to be encrypted
+}
+
+// QueueStats returns statistics about the message queues of msgDB.
+func (msgDB *MsgDB) QueueStats() (*QueueStats, error) {
+	var stats QueueStats
+	queries := []struct {
+		query string
+		num   *int64
+	}{
+		{"SELECT COUNT(*) FROM OutQueue;", &stats.OutQueue},
+		{"SELECT COUNT(*) FROM OutQueue WHERE Envelope=1;", &stats.OutQueueEnvelope},
+		{"SELECT COUNT(*) FROM OutQueue WHERE Resend=1;", &stats.OutQueueResend},
+		{"SELECT COUNT(*) FROM InQueue;", &stats.InQueue},
+		{"SELECT COUNT(*) FROM InQueue WHERE Envelope=1;", &stats.InQueueEnvelope},
+		{"SELECT COUNT(*) FROM Messages WHERE ToSend=1;", &stats.Undelivered},
+	}
+	for _, q := range queries {
+		if err := msgDB.encDB.QueryRow(q.query).Scan(q.num); err != nil {
+			return nil, log.Error(err)
+		}
+	}
+	return &stats, nil
+}
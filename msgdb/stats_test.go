@@ -0,0 +1,36 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestQueueStats(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	a := "alice@mute.berlin"
+	if err := msgDB.AddNym(a, a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddInQueue(a, "", 0, "msg"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := msgDB.QueueStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.InQueue != 1 || stats.InQueueEnvelope != 1 {
+		t.Errorf("unexpected in queue stats: %+v", stats)
+	}
+	if stats.OutQueue != 0 || stats.Undelivered != 0 {
+		t.Errorf("unexpected out queue stats: %+v", stats)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"database/sql"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// SyncNym is a nym as exchanged between devices.
+type SyncNym struct {
+	MappedID   string
+	UnmappedID string
+	FullName   string
+}
+
+// SyncContact is a contact as exchanged between devices.
+type SyncContact struct {
+	MyID       string // mapped ID of the nym the contact belongs to
+	MappedID   string
+	UnmappedID string
+	FullName   string
+	Blocked    int64
+	Favorite   int64
+}
+
+// SyncMessage is a message as exchanged between devices.
+type SyncMessage struct {
+	Self      string // mapped ID of the nym the message belongs to
+	Peer      string // mapped ID of the contact the message belongs to
+	Direction int64
+	Sent      int64
+	From      string
+	To        string
+	Cc        string
+	Date      int64
+	Subject   string
+	Message   string
+	Sign      int64
+	MinDelay  int64
+	MaxDelay  int64
+	Read      int64
+	Star      int64
+	MessageID string
+	InReplyTo string
+}
+
+// SyncDelta contains the state of msgDB which has to be synchronized between
+// devices of the same user (see ExportSync and ImportSync). Accounts, queues,
+// and attachments are not synchronized.
+type SyncDelta struct {
+	Nyms     []*SyncNym
+	Contacts []*SyncContact
+	Messages []*SyncMessage
+}
+
+// ExportSync exports all nyms and contacts and all messages with a date of
+// at least since from msgDB. Messages which still have to be encrypted are
+// not exported, they are sent by the device they were written on.
+func (msgDB *MsgDB) ExportSync(since int64) (*SyncDelta, error) {
+	var d SyncDelta
+	// nyms
+	rows, err := msgDB.encDB.Query("SELECT MappedID, UnmappedID, IFNULL(FullName, '') FROM Nyms ORDER BY UID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var n SyncNym
+		if err := rows.Scan(&n.MappedID, &n.UnmappedID, &n.FullName); err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.Nyms = append(d.Nyms, &n)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// contacts
+	rows, err = msgDB.encDB.Query("SELECT Nyms.MappedID, Contacts.MappedID, Contacts.UnmappedID, IFNULL(Contacts.FullName, ''), IFNULL(Contacts.Blocked, 0), Contacts.Favorite FROM Contacts INNER JOIN Nyms ON Contacts.MyID = Nyms.UID ORDER BY Contacts.UID ASC;")
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	for rows.Next() {
+		var c SyncContact
+		err := rows.Scan(&c.MyID, &c.MappedID, &c.UnmappedID, &c.FullName,
+			&c.Blocked, &c.Favorite)
+		if err != nil {
+			rows.Close()
+			return nil, log.Error(err)
+		}
+		d.Contacts = append(d.Contacts, &c)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, log.Error(err)
+	}
+	rows.Close()
+	// messages
+	rows, err = msgDB.encDB.Query("SELECT Nyms.MappedID, Contacts.MappedID, Messages.Direction, Messages.Sent, Messages.\"From\", Messages.\"To\", Messages.Cc, Messages.Date, IFNULL(Messages.Subject, ''), IFNULL(Messages.Message, ''), Messages.Sign, Messages.MinDelay, Messages.MaxDelay, Messages.Read, Messages.Star, Messages.MessageID, Messages.InReplyTo FROM Messages INNER JOIN Nyms ON Messages.Self = Nyms.UID INNER JOIN Contacts ON Messages.Peer = Contacts.UID WHERE Messages.ToSend=0 AND Messages.Date>=? ORDER BY Messages.MsgID ASC;", since)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m SyncMessage
+		err := rows.Scan(&m.Self, &m.Peer, &m.Direction, &m.Sent, &m.From,
+			&m.To, &m.Cc, &m.Date, &m.Subject, &m.Message, &m.Sign, &m.MinDelay,
+			&m.MaxDelay, &m.Read, &m.Star, &m.MessageID, &m.InReplyTo)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		d.Messages = append(d.Messages, &m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, log.Error(err)
+	}
+	return &d, nil
+}
+
+// ImportSync imports the state d (exported with ExportSync on another device)
+// into msgDB. Nyms and contacts which already exist keep their local
+// settings. Messages are identified by their message ID (or, for old messages
+// without one, by date and content) and imported only once. The read and star
+// flags of existing messages are merged (set on either device means set).
+func (msgDB *MsgDB) ImportSync(d *SyncDelta) error {
+	tx, err := msgDB.encDB.Begin()
+	if err != nil {
+		return log.Error(err)
+	}
+	if err := msgDB.importSync(tx, d); err != nil {
+		tx.Rollback()
+		return log.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+func (msgDB *MsgDB) importSync(tx *sql.Tx, d *SyncDelta) error {
+	// nyms
+	for _, n := range d.Nyms {
+		var uid int64
+		err := tx.Stmt(msgDB.getNymUIDQuery).QueryRow(n.MappedID).Scan(&uid)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err := tx.Stmt(msgDB.insertNymQuery).Exec(n.MappedID,
+				n.UnmappedID, n.FullName)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+	// contacts
+	for _, c := range d.Contacts {
+		var self int64
+		err := tx.Stmt(msgDB.getNymUIDQuery).QueryRow(c.MyID).Scan(&self)
+		if err != nil {
+			return err
+		}
+		var uid int64
+		err = tx.Stmt(msgDB.getContactUIDQuery).QueryRow(self, c.MappedID).Scan(&uid)
+		switch {
+		case err == sql.ErrNoRows:
+			res, err := tx.Stmt(msgDB.insertContactQuery).Exec(self,
+				c.MappedID, c.UnmappedID, c.FullName, c.Blocked)
+			if err != nil {
+				return err
+			}
+			if c.Favorite != 0 {
+				uid, err := res.LastInsertId()
+				if err != nil {
+					return err
+				}
+				_, err = tx.Exec("UPDATE Contacts SET Favorite=? WHERE UID=?;",
+					c.Favorite, uid)
+				if err != nil {
+					return err
+				}
+			}
+		case err != nil:
+			return err
+		}
+	}
+	// messages
+	for _, m := range d.Messages {
+		var self, peer int64
+		err := tx.Stmt(msgDB.getNymUIDQuery).QueryRow(m.Self).Scan(&self)
+		if err != nil {
+			return err
+		}
+		err = tx.Stmt(msgDB.getContactUIDQuery).QueryRow(self, m.Peer).Scan(&peer)
+		if err != nil {
+			return err
+		}
+		var msgNum int64
+		if m.MessageID != "" {
+			// sent messages have one copy per recipient (same message ID)
+			err = tx.QueryRow("SELECT MsgID FROM Messages WHERE Self=? AND Peer=? AND MessageID=?;",
+				self, peer, m.MessageID).Scan(&msgNum)
+		} else {
+			err = tx.QueryRow("SELECT MsgID FROM Messages WHERE Self=? AND Peer=? AND Date=? AND Message=?;",
+				self, peer, m.Date, m.Message).Scan(&msgNum)
+		}
+		switch {
+		case err == sql.ErrNoRows:
+			res, err := tx.Exec("INSERT INTO Messages (Self, Peer, Direction, ToSend, Sent, \"From\", \"To\", Cc, Date, Subject, Message, Sign, MinDelay, MaxDelay, Read, Star, MessageID, InReplyTo) VALUES (?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+				self, peer, m.Direction, m.Sent, m.From, m.To, m.Cc, m.Date,
+				m.Subject, m.Message, m.Sign, m.MinDelay, m.MaxDelay, m.Read,
+				m.Star, m.MessageID, m.InReplyTo)
+			if err != nil {
+				return err
+			}
+			msgNum, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			err = indexMessage(tx, self, msgNum, m.Date, m.From, m.Subject)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			_, err := tx.Exec("UPDATE Messages SET Read=MAX(Read, ?), Star=MAX(Star, ?), Sent=MAX(Sent, ?) WHERE MsgID=?;",
+				m.Read, m.Star, m.Sent, msgNum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
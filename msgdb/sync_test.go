@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	tmpdir, msgDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer msgDB.Close()
+	otherdir, otherDB, err := createDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherdir)
+	defer otherDB.Close()
+	a := "alice@mute.berlin"
+	b := "bob@mute.berlin"
+	if err := msgDB.AddNym(a, a, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.AddContact(a, b, b, "Bob", WhiteList); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.SetFavorite(a, b, true); err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.AddMessage(a, b, 10, false, "old", "id1", "", nil, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msgDB.AddMessage(a, b, 20, false, "new", "id2", "", nil, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := msgDB.ExportSync(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Nyms) != 1 || len(d.Contacts) != 1 || len(d.Messages) != 1 {
+		t.Fatalf("unexpected delta: %d nyms, %d contacts, %d messages",
+			len(d.Nyms), len(d.Contacts), len(d.Messages))
+	}
+	// import twice, the second import must not duplicate anything
+	for i := 0; i < 2; i++ {
+		if err := otherDB.ImportSync(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	favorite, err := otherDB.IsFavorite(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !favorite {
+		t.Error("contact should be a favorite")
+	}
+	msgIDs, err := otherDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgIDs) != 1 {
+		t.Fatalf("len(msgIDs) = %d, expected 1", len(msgIDs))
+	}
+	if msgIDs[0].MessageID != "id2" || msgIDs[0].Read {
+		t.Error("unexpected imported message")
+	}
+	// read flag is merged
+	if err := otherDB.ReadMessage(msgIDs[0].MsgID); err != nil {
+		t.Fatal(err)
+	}
+	d, err = otherDB.ExportSync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgDB.ImportSync(d); err != nil {
+		t.Fatal(err)
+	}
+	msgIDs, err = msgDB.GetMsgIDs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgIDs) != 2 {
+		t.Fatalf("len(msgIDs) = %d, expected 2", len(msgIDs))
+	}
+	if msgIDs[0].Read || !msgIDs[1].Read {
+		t.Error("read flags not merged correctly")
+	}
+}
@@ -14,27 +14,24 @@ import (
 	"github.com/mutecomm/mute/mix/client"
 )
 
-func (pe *ProtoEngine) create(
-	w io.Writer,
+// Create creates an envelope message for the base64 encoded encrypted
+// message msg and returns it base64 encoded. It is the in-process equivalent
+// of `muteproto create`.
+func Create(
 	minDelay, maxDelay int32,
-	tokenString, nymaddress string,
-	r io.Reader,
-) error {
-	msg, err := ioutil.ReadAll(r)
+	tokenString, nymaddress, msg string,
+) (string, error) {
+	message, err := base64.Decode(msg)
 	if err != nil {
-		return log.Error(err)
-	}
-	message, err := base64.Decode(string(msg))
-	if err != nil {
-		return log.Error(err)
+		return "", log.Error(err)
 	}
 	token, err := base64.Decode(tokenString)
 	if err != nil {
-		return log.Error(err)
+		return "", log.Error(err)
 	}
 	na, err := base64.Decode(nymaddress)
 	if err != nil {
-		return log.Error(err)
+		return "", log.Error(err)
 	}
 	mo := client.MessageInput{
 		SenderMinDelay: minDelay,
@@ -47,10 +44,27 @@ func (pe *ProtoEngine) create(
 		CACert: def.CACert,
 	}.Create()
 	if mo.Error != nil {
-		return log.Error(mo.Error)
+		return "", log.Error(mo.Error)
+	}
+	return base64.Encode(mo.Marshal()), nil
+}
+
+func (pe *ProtoEngine) create(
+	w io.Writer,
+	minDelay, maxDelay int32,
+	tokenString, nymaddress string,
+	r io.Reader,
+) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return log.Error(err)
+	}
+	envelope, err := Create(minDelay, maxDelay, tokenString, nymaddress,
+		string(msg))
+	if err != nil {
+		return err
 	}
-	envelope := mo.Marshal()
-	if _, err := io.WriteString(w, base64.Encode(envelope)); err != nil {
+	if _, err := io.WriteString(w, envelope); err != nil {
 		return log.Error(err)
 	}
 	return nil
@@ -8,30 +8,49 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/mix/client"
 )
 
-func (pe *ProtoEngine) deliver(statusfp io.Writer, r io.Reader) error {
-	enc, err := ioutil.ReadAll(r)
-	if err != nil {
-		return log.Error(err)
-	}
+// Deliver delivers the base64 encoded envelope message to the corresponding
+// mix. It is the in-process equivalent of `muteproto deliver`. If resend is
+// true, the delivery failed temporarily with err and has to be repeated
+// later.
+func Deliver(envelope string) (resend bool, err error) {
+	return DeliverFrom(strings.NewReader(envelope))
+}
+
+// DeliverFrom is like Deliver, but reads the base64 encoded envelope message
+// from r. The envelope is decoded while it is read, which avoids holding the
+// encoded and the decoded envelope in memory at the same time.
+func DeliverFrom(r io.Reader) (resend bool, err error) {
 	var mm client.MessageMarshalled
-	mm, err = base64.Decode(string(enc))
+	mm, err = ioutil.ReadAll(base64.NewDecoder(r))
 	if err != nil {
-		return log.Error(err)
+		return false, log.Error(err)
 	}
 	messageOut, err := mm.Unmarshal().Deliver()
 	if err != nil {
 		if messageOut.Resend {
+			return true, err
+		}
+		return false, log.Error(err)
+	}
+	return false, nil
+}
+
+func (pe *ProtoEngine) deliver(statusfp io.Writer, r io.Reader) error {
+	resend, err := DeliverFrom(r)
+	if err != nil {
+		if resend {
 			log.Info("write: RESEND:\t%s", err.Error())
 			fmt.Fprintf(statusfp, "RESEND:\t%s\n", err.Error())
 			return nil
 		}
-		return log.Error(err)
+		return err
 	}
 	return nil
 }
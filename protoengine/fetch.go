@@ -18,6 +18,41 @@ import (
 	"github.com/mutecomm/mute/util"
 )
 
+// ListMessages lists the messages received after lastMessageTime for the
+// account with the given privkey on server. It is the in-process equivalent
+// of the first step of `muteproto fetch`.
+func ListMessages(
+	privkey *[ed25519.PrivateKeySize]byte,
+	server string,
+	lastMessageTime int64,
+) ([]client.MessageMeta, error) {
+	messages, err := client.ListMessages(privkey, lastMessageTime, server,
+		def.CACert)
+	if err != nil {
+		// TODO: handle this better
+		if err.Error() == "accountdb: Nothing found" {
+			// no messages found
+			return nil, nil
+		}
+		return nil, log.Error(err)
+	}
+	return messages, nil
+}
+
+// FetchMessage fetches the message with the given messageID for the account
+// with the given privkey from server and returns it base64 encoded.
+func FetchMessage(
+	privkey *[ed25519.PrivateKeySize]byte,
+	messageID []byte,
+	server string,
+) (string, error) {
+	msg, err := client.FetchMessage(privkey, messageID, server, def.CACert)
+	if err != nil {
+		return "", log.Error(err)
+	}
+	return base64.Encode(msg), nil
+}
+
 func (pe *ProtoEngine) fetch(
 	output io.Writer,
 	status io.Writer,
@@ -39,17 +74,9 @@ func (pe *ProtoEngine) fetch(
 	var privkey [ed25519.PrivateKeySize]byte
 	copy(privkey[:], pk)
 	log.Debugf("lastMessageTime=%d", lastMessageTime)
-	messages, err := client.ListMessages(&privkey, lastMessageTime, server,
-		def.CACert)
+	messages, err := ListMessages(&privkey, server, lastMessageTime)
 	if err != nil {
-		// TODO: handle this better
-		if err.Error() == "accountdb: Nothing found" {
-			// no messages found
-			log.Info("write: NONE")
-			fmt.Fprintln(status, "NONE")
-			return nil
-		}
-		return log.Error(err)
+		return err
 	}
 	/*
 		for _, message := range messages {
@@ -60,10 +87,9 @@ func (pe *ProtoEngine) fetch(
 	*/
 	scanner := bufio.NewScanner(command)
 	for _, message := range messages {
-		msg, err := client.FetchMessage(&privkey, message.MessageID, server,
-			def.CACert)
+		enc, err := FetchMessage(&privkey, message.MessageID, server)
 		if err != nil {
-			return log.Error(err)
+			return err
 		}
 		messageID := base64.Encode(message.MessageID)
 		log.Debugf("write: MESSAGEID:\t%s", messageID)
@@ -79,7 +105,6 @@ func (pe *ProtoEngine) fetch(
 		}
 		if command == "NEXT" {
 			log.Debug("read: NEXT")
-			enc := base64.Encode(msg)
 			if _, err := io.WriteString(output, enc); err != nil {
 				return log.Error(err)
 			}
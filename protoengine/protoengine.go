@@ -10,12 +10,12 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/frankbraun/codechain/util/home"
 	"github.com/mutecomm/mute/def"
 	"github.com/mutecomm/mute/def/version"
 	"github.com/mutecomm/mute/log"
 	"github.com/mutecomm/mute/util"
 	"github.com/mutecomm/mute/util/descriptors"
+	"github.com/mutecomm/mute/util/home"
 	"github.com/urfave/cli"
 )
 
@@ -77,10 +77,12 @@ func New() *ProtoEngine {
 	pe.app.Version = version.Number
 	pe.app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "homedir",
-			Value: defaultHomeDir,
-			Usage: "set home directory",
+			Name:   "homedir",
+			Value:  defaultHomeDir,
+			Usage:  "set home directory",
+			EnvVar: home.HomeDirEnv,
 		},
+		home.PortableFlag,
 		cli.StringFlag{
 			Name:  "acchost",
 			Usage: "alternative hostname for account server",
@@ -96,9 +98,10 @@ func New() *ProtoEngine {
 			Usage: "logging level {trace, debug, info, warn, error, critical}",
 		},
 		cli.StringFlag{
-			Name:  "logdir",
-			Value: defaultLogDir,
-			Usage: "directory to log output",
+			Name:   "logdir",
+			Value:  defaultLogDir,
+			Usage:  "directory to log output",
+			EnvVar: home.LogDirEnv,
 		},
 		cli.BoolFlag{
 			Name:  "logconsole",
@@ -106,6 +109,9 @@ func New() *ProtoEngine {
 		},
 	}
 	pe.app.Before = func(c *cli.Context) error {
+		if err := home.ApplyDirs(c, ""); err != nil {
+			return err
+		}
 		return pe.prepare(c)
 	}
 	pe.app.Commands = []cli.Command{
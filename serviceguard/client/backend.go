@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultBackend is the name of the wallet backend used if none is
+// configured.
+const DefaultBackend = "trivial"
+
+// A Backend creates a client for a wallet. database is the database handle
+// (or URL) of the wallet store, walletKey is the private key of the client
+// wallet, and cacert is the SSLCACert of the servers.
+type Backend func(
+	database interface{},
+	walletKey *[ed25519.PrivateKeySize]byte,
+	cacert []byte,
+) (*Client, error)
+
+var (
+	backendsLock = new(sync.Mutex)
+	backends     = make(map[string]Backend)
+)
+
+// RegisterBackend makes a wallet backend available under the given name.
+// Backends usually register themselves in the init function of their
+// package. If RegisterBackend is called twice with the same name or if
+// backend is nil, it panics.
+func RegisterBackend(name string, backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if backend == nil {
+		panic("client: RegisterBackend backend is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("client: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = backend
+}
+
+// Backends returns the sorted names of all registered wallet backends.
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates a new client with the wallet backend registered under
+// name (see RegisterBackend). The arguments are passed to the backend.
+func NewBackend(
+	name string,
+	database interface{},
+	walletKey *[ed25519.PrivateKeySize]byte,
+	cacert []byte,
+) (*Client, error) {
+	backendsLock.Lock()
+	backend, ok := backends[name]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("client: unknown wallet backend '%s' "+
+			"(forgotten import?)", name)
+	}
+	return backend(database, walletKey, cacert)
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/mutecomm/mute/serviceguard/client/walletrpc"
 	"github.com/mutecomm/mute/serviceguard/common/constants"
 	"github.com/mutecomm/mute/serviceguard/common/types"
+	"github.com/mutecomm/mute/util/times"
 )
 
 // AuthTokenRetry defines how often an AuthToken should be retried on
@@ -59,6 +60,10 @@ type Client struct {
 	runnerRunning bool
 	target        map[[ed25519.PublicKeySize]byte]Target
 	stopChan      chan bool
+
+	lowWaterMarks   map[string]int64      // auto-replenishment policy
+	replenishNotify func(*ReplenishEvent) // reports replenishments
+	replenishing    map[string]bool       // usages currently replenished
 }
 
 // New returns a new client. In most cases, use mute/serviceguard/client/trivial instead
@@ -201,9 +206,22 @@ func (c *Client) GetToken(usage string, owner *[ed25519.PublicKeySize]byte) (*To
 	return retToken, nil
 }
 
-// DelToken deletes a token.
+// DelToken deletes a token. DelToken must be called after a token has been
+// used, the token is recorded in the spending history.
 func (c *Client) DelToken(tokenHash []byte) {
+	token, err := c.walletStore.GetToken(tokenHash, -1)
+	if err == nil && token != nil {
+		if err := c.walletStore.AddSpending(token.Usage, times.Now()); err != nil {
+			c.LastError = err
+		}
+	}
 	c.walletStore.DelToken(tokenHash)
+	c.CheckReplenish()
+}
+
+// GetSpending returns the tokens spent per day and usage since date.
+func (c *Client) GetSpending(since int64) ([]Spending, error) {
+	return c.walletStore.GetSpending(since)
 }
 
 // GetBalanceOwn returns the number of renewable tokens for usage.
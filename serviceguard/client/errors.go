@@ -75,6 +75,8 @@ var (
 	ErrTokenKnown = errors.New("client: token is already known")
 	// ErrNoToken is returned if no token could be fetched from wallet storage
 	ErrNoToken = errors.New("client: no token in wallet")
+	// ErrNoStoreEncryption is returned if the wallet storage does not support encryption
+	ErrNoStoreEncryption = errors.New("client: wallet storage does not support encryption")
 )
 
 var (
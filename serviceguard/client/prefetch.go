@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/ed25519"
+)
+
+// PrefetchToken acquires a token for usage owned by owner ahead of time and
+// returns it. The token is stored unlocked in the wallet store, a later
+// GetToken for the same usage and owner returns it without contacting the
+// service guard. The client must be online.
+//
+// Like GetToken, PrefetchToken prefers reissuing a token owned by self over
+// fetching a new token from the wallet server.
+func (c *Client) PrefetchToken(usage string, owner *[ed25519.PublicKeySize]byte) (*TokenEntry, error) {
+	if !c.IsOnline() {
+		c.LastError = ErrOffline
+		return nil, ErrOffline
+	}
+	var tokenHash []byte
+	tokenReissue, err := c.walletStore.FindToken(usage)
+	if err != nil {
+		tokenHash, err = c.WalletToken(usage, owner)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tokenHash, err = c.ReissueToken(tokenReissue.Hash, owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token, err := c.walletStore.GetToken(tokenHash, -1)
+	if err != nil {
+		c.LastError = err
+		return nil, ErrFatal
+	}
+	return token, nil
+}
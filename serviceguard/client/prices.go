@@ -0,0 +1,36 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"github.com/mutecomm/mute/serviceguard/client/walletrpc"
+	"github.com/mutecomm/mute/serviceguard/common/types"
+)
+
+// GetPrices fetches the price list of the service guard operator from the
+// wallet server. The client must be online.
+func (c *Client) GetPrices() (*types.PriceList, error) {
+	if !c.IsOnline() {
+		c.LastError = ErrOffline
+		return nil, ErrOffline
+	}
+	onlineGroup.Add(1)
+	defer onlineGroup.Done()
+	if c.walletRPC == nil {
+		pubkey, privkey := splitKey(c.walletKey)
+		c.walletRPC = walletrpc.New(pubkey, privkey, c.cacert)
+	}
+	priceList, err := c.walletRPC.GetPrices()
+	if err != nil {
+		c.LastError = err
+		_, fatal, err := lookupError(err)
+		if fatal {
+			c.LastError = err
+			return nil, ErrFinal
+		}
+		return nil, ErrRetry
+	}
+	return priceList, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"sync"
+)
+
+// ReplenishEvent reports the result of an automatic replenishment of the
+// wallet (see SetReplenish).
+type ReplenishEvent struct {
+	Usage        string // usage of the replenished tokens
+	LowWaterMark int64  // low-water mark of usage
+	Balance      int64  // balance of own tokens for usage after replenishment
+	Fetched      int    // number of tokens fetched from the wallet server
+	Err          error  // the error which stopped the replenishment, if any
+}
+
+// replenishLock synchronizes replenishment state
+var replenishLock = new(sync.Mutex)
+
+// SetReplenish sets the auto-replenishment policy of the wallet. The map
+// lowWaterMarks contains the low-water mark for every usage. If the balance
+// of own tokens for a usage drops below its low-water mark (see
+// CheckReplenish), tokens are fetched from the wallet server in the
+// background until the low-water mark is reached again. The result of every
+// replenishment is reported to notify (which can be nil).
+func (c *Client) SetReplenish(lowWaterMarks map[string]int64, notify func(*ReplenishEvent)) {
+	replenishLock.Lock()
+	defer replenishLock.Unlock()
+	c.lowWaterMarks = lowWaterMarks
+	c.replenishNotify = notify
+	if c.replenishing == nil {
+		c.replenishing = make(map[string]bool)
+	}
+}
+
+// CheckReplenish starts the replenishment in the background for all usages
+// for which the balance of own tokens is below the low-water mark. It does
+// not block. While the client is offline, nothing is fetched and ErrOffline
+// is reported.
+func (c *Client) CheckReplenish() {
+	replenishLock.Lock()
+	defer replenishLock.Unlock()
+	for usage, lowWaterMark := range c.lowWaterMarks {
+		if c.replenishing[usage] {
+			continue // already running
+		}
+		balance := c.GetBalanceOwn(usage)
+		if balance >= lowWaterMark {
+			continue
+		}
+		if !c.IsOnline() {
+			c.notifyReplenish(&ReplenishEvent{
+				Usage:        usage,
+				LowWaterMark: lowWaterMark,
+				Balance:      balance,
+				Err:          ErrOffline,
+			})
+			continue
+		}
+		c.replenishing[usage] = true
+		onlineGroup.Add(1)
+		go c.replenish(usage, lowWaterMark)
+	}
+}
+
+// replenish fetches tokens for usage until the low-water mark is reached.
+func (c *Client) replenish(usage string, lowWaterMark int64) {
+	defer onlineGroup.Done()
+	ev := &ReplenishEvent{
+		Usage:        usage,
+		LowWaterMark: lowWaterMark,
+	}
+	for {
+		ev.Balance = c.GetBalanceOwn(usage)
+		if ev.Balance >= lowWaterMark {
+			break
+		}
+		if !c.IsOnline() {
+			ev.Err = ErrOffline
+			break
+		}
+		if _, err := c.WalletToken(usage, nil); err != nil {
+			ev.Err = c.LastError
+			if ev.Err == nil {
+				ev.Err = err
+			}
+			break
+		}
+		ev.Fetched++
+	}
+	replenishLock.Lock()
+	defer replenishLock.Unlock()
+	c.replenishing[usage] = false
+	c.notifyReplenish(ev)
+}
+
+// notifyReplenish reports ev. Must be called with replenishLock held.
+func (c *Client) notifyReplenish(ev *ReplenishEvent) {
+	if c.replenishNotify != nil {
+		c.replenishNotify(ev)
+	}
+}
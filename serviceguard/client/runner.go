@@ -62,6 +62,8 @@ func (c *Client) runner() {
 		if c.meetTarget() {
 			actionCount++
 		}
+		// Replenish own tokens below low-water mark
+		c.CheckReplenish()
 		onlineGroup.Done()
 		if actionCount == 0 {
 			time.Sleep(time.Second * 3)
@@ -2,7 +2,9 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package trivial implements a trivial wrapper for mute/serviceguard/client
+// Package trivial implements a trivial wrapper for mute/serviceguard/client.
+// It registers itself as the default wallet backend (see
+// client.RegisterBackend).
 package trivial
 
 import (
@@ -12,6 +14,10 @@ import (
 	"github.com/mutecomm/mute/serviceguard/common/types"
 )
 
+func init() {
+	client.RegisterBackend(client.DefaultBackend, New)
+}
+
 // New takes a database handler or URL and creates the key backend and the
 // walletstore from it. walletKey is the private key for the client wallet.
 // cacert is the SSLCACert of the server.
@@ -7,10 +7,12 @@ package walletrpc
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 
 	"crypto/ed25519"
 	"github.com/mutecomm/mute/serviceguard/common/constants"
+	"github.com/mutecomm/mute/serviceguard/common/types"
 	"github.com/mutecomm/mute/serviceguard/common/walletauth"
 	"github.com/mutecomm/mute/util/jsonclient"
 )
@@ -177,3 +179,31 @@ func (wc WalletClient) getToken(usage string, authtoken []byte) (token, params,
 
 	return token, params, pubKeyUsed, 0, nil
 }
+
+// GetPrices requests the price list of the service guard operator from the
+// wallet service. It does not require authentication.
+func (wc *WalletClient) GetPrices() (*types.PriceList, error) {
+	method := "WalletServer.GetPrices"
+	client, err := wc.ClientFactory(ServiceURL, wc.ServiceGuardCA)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.JSONRPCRequest(method, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := data["PriceList"].(map[string]interface{}); !ok {
+		return nil, ErrParams
+	}
+	// marshal the unstructured reply into a JSON byte array and back into a
+	// price list
+	jsn, err := json.Marshal(data["PriceList"])
+	if err != nil {
+		return nil, err
+	}
+	var priceList types.PriceList
+	if err := json.Unmarshal(jsn, &priceList); err != nil {
+		return nil, ErrParams
+	}
+	return &priceList, nil
+}
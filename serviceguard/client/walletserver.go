@@ -120,3 +120,10 @@ func (c *Client) getTokenFromWallet(usage string) (token, params, pubkeyUsed []b
 	c.walletStore.SetAuthToken(nil, 0)
 	return newToken, params, pubkeyUsed, nil
 }
+
+// ResetAuthToken discards the cached authentication token for the wallet
+// server. It must be called after the wallet key has been changed, because
+// the cached token was created with the old key.
+func (c *Client) ResetAuthToken() error {
+	return c.walletStore.SetAuthToken(nil, 0)
+}
@@ -26,6 +26,49 @@ type WalletStore interface {
 	GetBalanceOwn(usage string) int64                                                      // Get the number of tokens for usage owned by self
 	GetBalance(usage string, owner *[ed25519.PublicKeySize]byte) int64                     // Get the number of tokens for usage owner by owner, or by anybody but myself if owner==nil
 	ExpireUnusable() bool                                                                  // Expire unusable tokens, returns true if it should be called again
+	AddSpending(usage string, date int64) error                                            // Record that a token for usage was spent at date
+	GetSpending(since int64) ([]Spending, error)                                           // Get the tokens spent per day and usage since date
+}
+
+// EncryptingWalletStore is implemented by a WalletStore which can encrypt
+// token data and private keys at rest (see walletstore.Storage).
+type EncryptingWalletStore interface {
+	SetEncryptionKey(key *[32]byte) // Enable encryption with key
+	EncryptExisting() (int, error)  // Encrypt cleartext entries, returns the number of converted entries
+}
+
+// SetStoreKey enables encryption of the wallet storage with key. It must be
+// called before the client is used. If the storage does not support
+// encryption, ErrNoStoreEncryption is returned.
+func (c *Client) SetStoreKey(key *[32]byte) error {
+	store, ok := c.walletStore.(EncryptingWalletStore)
+	if !ok {
+		return ErrNoStoreEncryption
+	}
+	store.SetEncryptionKey(key)
+	return nil
+}
+
+// EncryptStore encrypts the cleartext entries of the wallet storage with the
+// key set by SetStoreKey and returns the number of converted entries.
+func (c *Client) EncryptStore() (int, error) {
+	store, ok := c.walletStore.(EncryptingWalletStore)
+	if !ok {
+		return 0, ErrNoStoreEncryption
+	}
+	return store.EncryptExisting()
+}
+
+// Spending contains the number of tokens spent for a usage on a day.
+type Spending struct {
+	Day    int64  // The start of the day (Unix time, UTC)
+	Usage  string // Usage of the spent tokens
+	Tokens int64  // The number of spent tokens
+}
+
+// SpendingDay returns the start of the day (UTC) of date.
+func SpendingDay(date int64) int64 {
+	return date - date%86400
 }
 
 // TokenEntry is an entry in the token database.
@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walletstore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+/*
+Column encryption protects the Token and OwnerPrivKey columns of walletTokens
+and the State column of walletState when an encryption key has been set with
+SetEncryptionKey. Each value is sealed separately with NaCl's secretbox and
+stored as:
+
+  encPrefix base64(nonce (24 bytes) | secretbox(Hash | "\n" | cleartext column value))
+
+The Hash of the row is sealed together with the value, which binds the
+ciphertext to its row: a value copied into another row does not decrypt.
+
+Values without encPrefix are cleartext (written before encryption was
+enabled). Since the cleartext values are base64 encoded they can never contain
+the prefix. Cleartext values are only returned if no encryption key is set,
+otherwise they are rejected with ErrCleartext (a cleartext value written into
+the database must not replace an encrypted one). Existing cleartext rows must
+therefore be converted with EncryptExisting after the key has been set.
+*/
+
+// encPrefix marks encrypted column values.
+const encPrefix = "enc1:"
+
+const (
+	selectTokenCryptQuery = `SELECT Hash, Token, OwnerPrivKey FROM walletTokens;`
+	updateTokenCryptQuery = `UPDATE walletTokens SET Token=?, OwnerPrivKey=? WHERE Hash=?;`
+	selectStateCryptQuery = `SELECT Hash, State FROM walletState;`
+)
+
+// ErrDecrypt is returned if an encrypted column value cannot be decrypted
+// (wrong key, corrupted value, or value of another row).
+var ErrDecrypt = errors.New("walletstore: cannot decrypt column (wrong key?)")
+
+// ErrNoKey is returned if an encrypted column value is read or a migration is
+// requested without an encryption key set.
+var ErrNoKey = errors.New("walletstore: no encryption key set")
+
+// ErrCleartext is returned if a cleartext column value is read while an
+// encryption key is set (see EncryptExisting).
+var ErrCleartext = errors.New("walletstore: cleartext column with encryption enabled (run migration)")
+
+// SetEncryptionKey enables encryption of token data, private keys, and state
+// with the given key. Encrypted values are decrypted transparently on read,
+// cleartext values written before have to be converted with EncryptExisting.
+// SetEncryptionKey must be called before the Storage is used.
+func (ws *Storage) SetEncryptionKey(key *[32]byte) {
+	ws.key = key
+	// cache has to be read again with the new key
+	ws.cacheMutex.Lock()
+	ws.cache = nil
+	ws.cacheMutex.Unlock()
+}
+
+// encryptColumn encrypts the column value s of the row with the given hash,
+// if an encryption key is set. Empty values are not encrypted.
+func (ws *Storage) encryptColumn(hash, s string) (string, error) {
+	if ws.key == nil || !isCleartext(s) {
+		return s, nil
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+	enc := secretbox.Seal(nonce[:], []byte(hash+"\n"+s), &nonce, ws.key)
+	return encPrefix + base64.StdEncoding.EncodeToString(enc), nil
+}
+
+// isCleartext returns true, if the column value s is non-empty and not
+// encrypted.
+func isCleartext(s string) bool {
+	return s != "" && !strings.HasPrefix(s, encPrefix)
+}
+
+// decryptColumn decrypts the column value s of the row with the given hash.
+func (ws *Storage) decryptColumn(hash, s string) (string, error) {
+	if !strings.HasPrefix(s, encPrefix) {
+		if ws.key != nil && s != "" {
+			return "", ErrCleartext
+		}
+		return s, nil
+	}
+	if ws.key == nil {
+		return "", ErrNoKey
+	}
+	enc, err := base64.StdEncoding.DecodeString(s[len(encPrefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(enc) < 24 {
+		return "", ErrDecrypt
+	}
+	var nonce [24]byte
+	copy(nonce[:], enc[:24])
+	dec, ok := secretbox.Open(nil, enc[24:], &nonce, ws.key)
+	if !ok || !strings.HasPrefix(string(dec), hash+"\n") {
+		return "", ErrDecrypt
+	}
+	return string(dec[len(hash)+1:]), nil
+}
+
+// EncryptExisting encrypts all cleartext column values already contained in
+// the database with the key set by SetEncryptionKey. It returns the number of
+// rows which have been converted. Already encrypted rows are left untouched,
+// therefore EncryptExisting can be called repeatedly.
+func (ws *Storage) EncryptExisting() (int, error) {
+	if ws.key == nil {
+		return 0, ErrNoKey
+	}
+	type row struct {
+		hash, token, privKey string
+	}
+	// read all rows first, open result sets would block the updates
+	var tokens []row
+	rows, err := ws.DB.Query(ws.dialect.rebind(selectTokenCryptQuery))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.hash, &r.token, &r.privKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if isCleartext(r.token) || isCleartext(r.privKey) {
+			tokens = append(tokens, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+	var states []row
+	rows, err = ws.DB.Query(ws.dialect.rebind(selectStateCryptQuery))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var r row
+		var state sql.NullString
+		if err := rows.Scan(&r.hash, &state); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		r.token = state.String
+		if isCleartext(r.token) {
+			states = append(states, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	var converted int
+	for _, r := range tokens {
+		token, err := ws.encryptColumn(r.hash, r.token)
+		if err != nil {
+			return converted, err
+		}
+		privKey, err := ws.encryptColumn(r.hash, r.privKey)
+		if err != nil {
+			return converted, err
+		}
+		_, err = ws.DB.Exec(ws.dialect.rebind(updateTokenCryptQuery), token,
+			privKey, r.hash)
+		if err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	for _, r := range states {
+		state, err := ws.encryptColumn(r.hash, r.token)
+		if err != nil {
+			return converted, err
+		}
+		if _, err := ws.setStateUpdateQuery.Exec(state, r.hash); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	// the cache might have been converted
+	ws.cacheMutex.Lock()
+	ws.cache = nil
+	ws.cacheMutex.Unlock()
+	return converted, nil
+}
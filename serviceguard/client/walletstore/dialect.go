@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walletstore
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Supported database drivers (as registered with database/sql).
+// The driver packages are not imported by walletstore, the application has to
+// import the driver for the database it uses (for example
+// github.com/lib/pq for PostgreSQL).
+const (
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+const (
+	createQueryTokensPostgres = `
+CREATE TABLE IF NOT EXISTS walletTokens (
+  LockTime BIGINT NOT NULL,
+  LockID BIGINT NOT NULL,
+  Hash CHAR(64) NOT NULL,
+  Token TEXT NOT NULL,
+  OwnerPubKey VARCHAR(255) NOT NULL,
+  OwnerPrivKey VARCHAR(255) NOT NULL,
+  Renewable BOOLEAN NOT NULL,
+  CanReissue BOOLEAN NOT NULL,
+  UsageStr VARCHAR(255) NOT NULL,
+  Expire BIGINT NOT NULL,
+  OwnedSelf BOOLEAN NOT NULL,
+  HasParams BOOLEAN NOT NULL,
+  HasState BOOLEAN NOT NULL,
+  CONSTRAINT walletTokensHash UNIQUE (Hash)
+);`
+	createQueryStatePostgres = `
+CREATE TABLE IF NOT EXISTS walletState (
+  Hash CHAR(64),
+  State TEXT,
+  CONSTRAINT walletStateHash UNIQUE (Hash)
+);`
+	createQuerySpendingPostgres = `
+CREATE TABLE IF NOT EXISTS walletSpending (
+  Day BIGINT NOT NULL,
+  UsageStr VARCHAR(255) NOT NULL,
+  Tokens INT NOT NULL,
+  CONSTRAINT walletSpendingDayUsage UNIQUE (Day, UsageStr)
+);`
+)
+
+// dialect contains the database specific DDL and query rewriting.
+type dialect struct {
+	driver        string                    // database/sql driver name
+	createQueries []string                  // table creation
+	rebind        func(query string) string // converts a generic query
+}
+
+var dialects = map[string]*dialect{
+	DriverMySQL: {
+		driver:        DriverMySQL,
+		createQueries: []string{createQueryTokens, createQueryState, createQuerySpending},
+		rebind:        func(query string) string { return query },
+	},
+	DriverSQLite: {
+		driver:        DriverSQLite,
+		createQueries: []string{createQueryTokens, createQueryState, createQuerySpending},
+		rebind:        func(query string) string { return query },
+	},
+	DriverPostgres: {
+		driver: DriverPostgres,
+		createQueries: []string{createQueryTokensPostgres, createQueryStatePostgres,
+			createQuerySpendingPostgres},
+		rebind: rebindPostgres,
+	},
+}
+
+// getDialect returns the dialect for the given driver name.
+func getDialect(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("walletstore: unsupported database driver %q", driver)
+	}
+	return d, nil
+}
+
+// parseURL returns the driver name and the data source name for dburl.
+// URLs with a postgres:// or postgresql:// scheme select PostgreSQL and are
+// passed on unchanged, a mysql:// scheme is stripped. Everything else is
+// treated as a MySQL DSN.
+func parseURL(dburl string) (driver, dsn string) {
+	switch {
+	case strings.HasPrefix(dburl, "postgres://"), strings.HasPrefix(dburl, "postgresql://"):
+		return DriverPostgres, dburl
+	case strings.HasPrefix(dburl, "mysql://"):
+		return DriverMySQL, strings.TrimPrefix(dburl, "mysql://")
+	default:
+		return DriverMySQL, dburl
+	}
+}
+
+// boolColumnRegexp matches comparisons of boolean columns with 0 or 1.
+var boolColumnRegexp = regexp.MustCompile(`\b(Renewable|CanReissue|OwnedSelf|HasParams|HasState)=([01])\b`)
+
+// rebindPostgres converts a generic query to PostgreSQL: placeholders are
+// numbered ($1, $2, ...) and boolean columns are compared with TRUE/FALSE
+// instead of 1/0.
+func rebindPostgres(query string) string {
+	query = boolColumnRegexp.ReplaceAllStringFunc(query, func(s string) string {
+		if strings.HasSuffix(s, "1") {
+			return s[:len(s)-1] + "TRUE"
+		}
+		return s[:len(s)-1] + "FALSE"
+	})
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -102,3 +102,13 @@ func (ns *NilStore) GetBalance(usage string, owner *[ed25519.PublicKeySize]byte)
 func (ns *NilStore) ExpireUnusable() bool {
 	return false
 }
+
+// AddSpending without function.
+func (ns *NilStore) AddSpending(usage string, date int64) error {
+	return nil
+}
+
+// GetSpending without function.
+func (ns *NilStore) GetSpending(since int64) ([]client.Spending, error) {
+	return nil, nil
+}
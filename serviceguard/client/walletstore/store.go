@@ -42,6 +42,13 @@ CREATE TABLE IF NOT EXISTS walletState (
   Hash CHAR(64),
   State TEXT,
   CONSTRAINT Hash UNIQUE (Hash)
+);`
+	createQuerySpending = `
+CREATE TABLE IF NOT EXISTS walletSpending (
+  Day INT NOT NULL,
+  UsageStr VARCHAR(255) NOT NULL,
+  Tokens INT NOT NULL,
+  CONSTRAINT DayUsage UNIQUE (Day, UsageStr)
 );`
 	setTokenQuery = `INSERT INTO walletTokens (LockTime, LockID, Hash, Token, OwnerPubKey, OwnerPrivKey, Renewable, CanReissue,
 						 UsageStr, Expire, OwnedSelf, HasParams, HasState) VALUES (0,0,?,?,?,?,?,?,?,?,?,?,?);`
@@ -68,6 +75,9 @@ CREATE TABLE IF NOT EXISTS walletState (
 	countOwnerQuery     = `SELECT COUNT(*) FROM walletTokens WHERE LockID=0 AND HasState=0 AND OwnedSelf=0 AND UsageStr=? AND OwnerPubKey=?;`
 	countAnyQuery       = `SELECT COUNT(*) FROM walletTokens WHERE LockID=0 AND HasState=0 AND OwnedSelf=0 AND UsageStr=?;`
 	finalExpireQuery    = `SELECT Hash FROM walletTokens WHERE Expire<? LIMIT 10;`
+	addSpendingQuery    = `INSERT INTO walletSpending (Day, UsageStr, Tokens) VALUES (?,?,1);`
+	incSpendingQuery    = `UPDATE walletSpending SET Tokens=Tokens+1 WHERE Day=? AND UsageStr=?;`
+	getSpendingQuery    = `SELECT Day, UsageStr, Tokens FROM walletSpending WHERE Day>=? ORDER BY Day ASC, UsageStr ASC;`
 )
 
 // MaxLockAge is the maximum time a lock may persist
@@ -99,8 +109,13 @@ type Storage struct {
 	countOwnerQuery     *sql.Stmt
 	countAnyQuery       *sql.Stmt
 	finalExpireQuery    *sql.Stmt
+	addSpendingQuery    *sql.Stmt
+	incSpendingQuery    *sql.Stmt
+	getSpendingQuery    *sql.Stmt
 	cacheMutex          *sync.RWMutex
 	cache               *CacheData
+	key                 *[32]byte // column encryption key, see SetEncryptionKey
+	dialect             *dialect
 }
 
 // New returns a new Storage, takes existing DB connection or URL as parameter
@@ -111,25 +126,22 @@ func New(db interface{}) (*Storage, error) {
 	return NewFromURL(db.(string))
 }
 
-// NewFromDB returns a storage for an existing database connection
+// NewFromDB returns a storage for an existing MySQL or SQLite database
+// connection. Use NewFromDBDriver for other databases.
 func NewFromDB(db *sql.DB) (*Storage, error) {
-	ws := new(Storage)
-	ws.DB = db
-	err := ws.initDB()
-	if err != nil {
-		return nil, err
-	}
-	return ws, nil
+	return NewFromDBDriver(db, DriverMySQL)
 }
 
-// NewFromURL returns a Storage from a URL
-func NewFromURL(dburl string) (*Storage, error) {
-	db, err := sql.Open("mysql", dburl)
+// NewFromDBDriver returns a storage for an existing database connection
+// opened with the given driver (DriverMySQL, DriverSQLite, or DriverPostgres)
+func NewFromDBDriver(db *sql.DB, driver string) (*Storage, error) {
+	d, err := getDialect(driver)
 	if err != nil {
 		return nil, err
 	}
 	ws := new(Storage)
 	ws.DB = db
+	ws.dialect = d
 	err = ws.initDB()
 	if err != nil {
 		return nil, err
@@ -137,74 +149,103 @@ func NewFromURL(dburl string) (*Storage, error) {
 	return ws, nil
 }
 
+// NewFromURL returns a Storage from a URL. URLs with a postgres:// or
+// postgresql:// scheme open a PostgreSQL database (the driver must be
+// imported by the application), everything else is a MySQL DSN
+func NewFromURL(dburl string) (*Storage, error) {
+	driver, dsn := parseURL(dburl)
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromDBDriver(db, driver)
+}
+
 func (ws *Storage) initDB() (err error) {
 	ws.cacheMutex = new(sync.RWMutex)
-	ws.DB.Exec(createQueryTokens)
-	ws.DB.Exec(createQueryState)
-	if ws.setTokenQuery, err = ws.DB.Prepare(setTokenQuery); err != nil {
+	for _, query := range ws.dialect.createQueries {
+		if _, err := ws.DB.Exec(query); err != nil {
+			return err
+		}
+	}
+	if ws.setTokenQuery, err = ws.prepare(setTokenQuery); err != nil {
+		return err
+	}
+	if ws.setTokenUpdateQuery, err = ws.prepare(setTokenUpdateQuery); err != nil {
+		return err
+	}
+	if ws.setStateQuery, err = ws.prepare(setStateQuery); err != nil {
 		return err
 	}
-	if ws.setTokenUpdateQuery, err = ws.DB.Prepare(setTokenUpdateQuery); err != nil {
+	if ws.setStateUpdateQuery, err = ws.prepare(setStateUpdateQuery); err != nil {
 		return err
 	}
-	if ws.setStateQuery, err = ws.DB.Prepare(setStateQuery); err != nil {
+	if ws.lockQuery, err = ws.prepare(lockQuery); err != nil {
 		return err
 	}
-	if ws.setStateUpdateQuery, err = ws.DB.Prepare(setStateUpdateQuery); err != nil {
+	if ws.cleanLocksQuery, err = ws.prepare(cleanLocksQuery); err != nil {
 		return err
 	}
-	if ws.lockQuery, err = ws.DB.Prepare(lockQuery); err != nil {
+	if ws.unlockQuery, err = ws.prepare(unlockQuery); err != nil {
 		return err
 	}
-	if ws.cleanLocksQuery, err = ws.DB.Prepare(cleanLocksQuery); err != nil {
+	if ws.deleteTokenQuery, err = ws.prepare(deleteTokenQuery); err != nil {
 		return err
 	}
-	if ws.unlockQuery, err = ws.DB.Prepare(unlockQuery); err != nil {
+	if ws.deleteStateQuery, err = ws.prepare(deleteStateQuery); err != nil {
 		return err
 	}
-	if ws.deleteTokenQuery, err = ws.DB.Prepare(deleteTokenQuery); err != nil {
+	if ws.getTokenQuery, err = ws.prepare(getTokenQuery); err != nil {
 		return err
 	}
-	if ws.deleteStateQuery, err = ws.DB.Prepare(deleteStateQuery); err != nil {
+	if ws.getStateQuery, err = ws.prepare(getStateQuery); err != nil {
 		return err
 	}
-	if ws.getTokenQuery, err = ws.DB.Prepare(getTokenQuery); err != nil {
+	if ws.findTokenSelfQuery, err = ws.prepare(findTokenSelfQuery); err != nil {
 		return err
 	}
-	if ws.getStateQuery, err = ws.DB.Prepare(getStateQuery); err != nil {
+	if ws.findTokenOwnerQuery, err = ws.prepare(findTokenOwnerQuery); err != nil {
 		return err
 	}
-	if ws.findTokenSelfQuery, err = ws.DB.Prepare(findTokenSelfQuery); err != nil {
+	if ws.findTokenAnyQuery, err = ws.prepare(findTokenAnyQuery); err != nil {
 		return err
 	}
-	if ws.findTokenOwnerQuery, err = ws.DB.Prepare(findTokenOwnerQuery); err != nil {
+	if ws.getExpireQuery, err = ws.prepare(getExpireQuery); err != nil {
 		return err
 	}
-	if ws.findTokenAnyQuery, err = ws.DB.Prepare(findTokenAnyQuery); err != nil {
+	if ws.getReissueQuery, err = ws.prepare(getReissueQuery); err != nil {
 		return err
 	}
-	if ws.getExpireQuery, err = ws.DB.Prepare(getExpireQuery); err != nil {
+	if ws.countOwnQuery, err = ws.prepare(countOwnQuery); err != nil {
 		return err
 	}
-	if ws.getReissueQuery, err = ws.DB.Prepare(getReissueQuery); err != nil {
+	if ws.countOwnerQuery, err = ws.prepare(countOwnerQuery); err != nil {
 		return err
 	}
-	if ws.countOwnQuery, err = ws.DB.Prepare(countOwnQuery); err != nil {
+	if ws.countAnyQuery, err = ws.prepare(countAnyQuery); err != nil {
 		return err
 	}
-	if ws.countOwnerQuery, err = ws.DB.Prepare(countOwnerQuery); err != nil {
+	if ws.finalExpireQuery, err = ws.prepare(finalExpireQuery); err != nil {
 		return err
 	}
-	if ws.countAnyQuery, err = ws.DB.Prepare(countAnyQuery); err != nil {
+	if ws.addSpendingQuery, err = ws.prepare(addSpendingQuery); err != nil {
 		return err
 	}
-	if ws.finalExpireQuery, err = ws.DB.Prepare(finalExpireQuery); err != nil {
+	if ws.incSpendingQuery, err = ws.prepare(incSpendingQuery); err != nil {
+		return err
+	}
+	if ws.getSpendingQuery, err = ws.prepare(getSpendingQuery); err != nil {
 		return err
 	}
 	ws.CleanLocks(false)
 	return nil
 }
 
+// prepare prepares the generic query for the database dialect
+func (ws *Storage) prepare(query string) (*sql.Stmt, error) {
+	return ws.DB.Prepare(ws.dialect.rebind(query))
+}
+
 // CleanLocks cleans all locks. If force is true all locks are removed, not only expired locks
 func (ws *Storage) CleanLocks(force bool) {
 	locktime := times.Now() + MaxLockAge
@@ -217,7 +258,17 @@ func (ws *Storage) CleanLocks(force bool) {
 // SetToken writes a token to the walletstore. repeated calls update the entry of tokenEntry.Hash is the same
 func (ws *Storage) SetToken(tokenEntry client.TokenEntry) error {
 	global, state := encodeToken(&tokenEntry)
-	_, err := ws.setTokenQuery.Exec(global.Hash, global.Token, global.OwnerPubKey,
+	var err error
+	if global.Token, err = ws.encryptColumn(global.Hash, global.Token); err != nil {
+		return err
+	}
+	if global.OwnerPrivKey, err = ws.encryptColumn(global.Hash, global.OwnerPrivKey); err != nil {
+		return err
+	}
+	if state, err = ws.encryptColumn(global.Hash, state); err != nil {
+		return err
+	}
+	_, err = ws.setTokenQuery.Exec(global.Hash, global.Token, global.OwnerPubKey,
 		global.OwnerPrivKey, global.Renewable, global.CanReissue,
 		global.Usage, global.Expire, global.OwnedSelf,
 		global.HasParams, global.HasState)
@@ -265,6 +316,15 @@ func (ws *Storage) GetToken(tokenHash []byte, lockID int64) (tokenEntry *client.
 		if err != nil {
 			return nil, err
 		}
+		if state, err = ws.decryptColumn(tokenHashS, state); err != nil {
+			return nil, err
+		}
+	}
+	if tokenDB.Token, err = ws.decryptColumn(tokenHashS, tokenDB.Token); err != nil {
+		return nil, err
+	}
+	if tokenDB.OwnerPrivKey, err = ws.decryptColumn(tokenHashS, tokenDB.OwnerPrivKey); err != nil {
+		return nil, err
 	}
 	return decodeToken(&tokenDB, state)
 }
@@ -304,12 +364,14 @@ func (ws *Storage) UnlockToken(tokenHash []byte) {
 	ws.unlockQuery.Exec(tokenHashS)
 }
 
-// writeCache writes the cache to database
+// writeCache writes the cache to database, must be called with cacheMutex
+// locked
 func (ws *Storage) writeCache() error {
-	ws.cacheMutex.Lock()
-	defer ws.cacheMutex.Unlock()
-	data := ws.cache.Marshal()
-	_, err := ws.setStateQuery.Exec("CONFIGCACHE", data)
+	data, err := ws.encryptColumn("CONFIGCACHE", ws.cache.Marshal())
+	if err != nil {
+		return err
+	}
+	_, err = ws.setStateQuery.Exec("CONFIGCACHE", data)
 	if err != nil {
 		_, err = ws.setStateUpdateQuery.Exec(data, "CONFIGCACHE")
 		if err != nil {
@@ -319,73 +381,71 @@ func (ws *Storage) writeCache() error {
 	return nil
 }
 
-// readCache reads the cache from the database
-func (ws *Storage) readCache() {
-	var data string
-	ws.cacheMutex.Lock()
-	defer ws.cacheMutex.Unlock()
-	err := ws.getStateQuery.QueryRow("CONFIGCACHE").Scan(&data)
+// readCache reads the cache from the database, if it has not been read
+// already. It must be called with cacheMutex locked. A cache which cannot be
+// read is not replaced, to not overwrite it by accident.
+func (ws *Storage) readCache() error {
+	if ws.cache != nil {
+		return nil
+	}
+	var hash, data string
+	err := ws.getStateQuery.QueryRow("CONFIGCACHE").Scan(&hash, &data)
+	if err == sql.ErrNoRows {
+		ws.cache = new(CacheData)
+		return nil
+	}
 	if err != nil {
-		return
+		return err
 	}
-	dataU, err := new(CacheData).Unmarshal(data)
+	data, err = ws.decryptColumn("CONFIGCACHE", data)
 	if err != nil {
-		return
+		return err
 	}
-	ws.cache = dataU
+	ws.cache, err = new(CacheData).Unmarshal(data)
+	return err
 }
 
 // SetVerifyKeys saves verification keys
 func (ws *Storage) SetVerifyKeys(verifyKeys [][ed25519.PublicKeySize]byte) {
 	ws.cacheMutex.Lock()
-	if ws.cache == nil {
-		ws.cache = new(CacheData)
+	defer ws.cacheMutex.Unlock()
+	if err := ws.readCache(); err != nil {
+		return
 	}
 	ws.cache.VerifyKeys = verifyKeys
-	ws.cacheMutex.Unlock()
 	ws.writeCache()
 }
 
 // GetVerifyKeys loads verification keys
 func (ws *Storage) GetVerifyKeys() [][ed25519.PublicKeySize]byte {
-	ws.cacheMutex.RLock()
-	if ws.cache == nil {
-		ws.cacheMutex.RUnlock()
-		ws.readCache()
-		ws.cacheMutex.RLock()
-	}
-	if ws.cache == nil {
-		ws.cache = new(CacheData)
+	ws.cacheMutex.Lock()
+	defer ws.cacheMutex.Unlock()
+	if err := ws.readCache(); err != nil {
+		return make([][ed25519.PublicKeySize]byte, 0)
 	}
 	if ws.cache.VerifyKeys == nil {
 		ws.cache.VerifyKeys = make([][ed25519.PublicKeySize]byte, 0)
 	}
-	defer ws.cacheMutex.RUnlock()
 	return ws.cache.VerifyKeys
 }
 
 // SetAuthToken stores an authtoken and tries
 func (ws *Storage) SetAuthToken(authToken []byte, tries int) error {
 	ws.cacheMutex.Lock()
-	if ws.cache == nil {
-		ws.cache = new(CacheData)
+	defer ws.cacheMutex.Unlock()
+	if err := ws.readCache(); err != nil {
+		return err
 	}
 	ws.cache.AuthToken = authToken
 	ws.cache.AuthTries = tries
-	ws.cacheMutex.Unlock()
 	return ws.writeCache()
 }
 
 // GetAuthToken gets authtoken from store
 func (ws *Storage) GetAuthToken() (authToken []byte, tries int) {
-	ws.cacheMutex.RLock()
-	if ws.cache == nil {
-		ws.cacheMutex.RUnlock()
-		ws.readCache()
-		ws.cacheMutex.RLock()
-	}
-	defer ws.cacheMutex.RUnlock()
-	if ws.cache == nil {
+	ws.cacheMutex.Lock()
+	defer ws.cacheMutex.Unlock()
+	if err := ws.readCache(); err != nil {
 		return nil, 0
 	}
 	return ws.cache.AuthToken, ws.cache.AuthTries
@@ -528,3 +588,38 @@ func (ws *Storage) ExpireUnusable() bool {
 	}
 	return false
 }
+
+// AddSpending records that a token for usage was spent at date
+func (ws *Storage) AddSpending(usage string, date int64) error {
+	day := client.SpendingDay(date)
+	res, err := ws.incSpendingQuery.Exec(day, usage)
+	if err != nil {
+		return err
+	}
+	if num, _ := res.RowsAffected(); num > 0 {
+		return nil
+	}
+	_, err = ws.addSpendingQuery.Exec(day, usage)
+	return err
+}
+
+// GetSpending returns the tokens spent per day and usage since date
+func (ws *Storage) GetSpending(since int64) ([]client.Spending, error) {
+	rows, err := ws.getSpendingQuery.Query(client.SpendingDay(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var spending []client.Spending
+	for rows.Next() {
+		var s client.Spending
+		if err := rows.Scan(&s.Day, &s.Usage, &s.Tokens); err != nil {
+			return nil, err
+		}
+		spending = append(spending, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return spending, nil
+}
@@ -11,6 +11,7 @@ import (
 
 	"crypto/ed25519"
 	"github.com/mutecomm/mute/serviceguard/common/signkeys"
+	"github.com/mutecomm/mute/util/metrics"
 	"github.com/mutecomm/mute/util/times"
 )
 
@@ -50,6 +51,9 @@ type KeyPool struct {
 	currentKey    *signkeys.KeyPair                                // contains our current key
 	previousKey   *signkeys.KeyPair                                // the previous currentKey, for param rollover
 	mapMutex      *sync.RWMutex                                    // Mutex for key generation. Only one key is generated at a time
+	lookups       metrics.Counter                                  // key lookups (token verification)
+	issues        metrics.Counter                                  // current key requests (token issuing)
+	generated     metrics.Counter                                  // generated keys
 
 	// FetchKeyCallBack callback function to read keys from storage.
 	// Argument is the keyid, return is the marshalled key or error
@@ -69,9 +73,35 @@ func New(generator *signkeys.KeyGenerator) *KeyPool {
 	kp.keys = make(map[[signkeys.KeyIDSize]byte]*signkeys.PublicKey)
 	kp.VerifyPubKeys = make(map[[ed25519.PublicKeySize]byte]bool)
 	kp.mapMutex = new(sync.RWMutex)
+	kp.SetMetrics(metrics.Nop)
 	return kp
 }
 
+// SetMetrics instruments the keypool with m: key lookups for token
+// verification, current key requests for token issuing, and key generations.
+func (kp *KeyPool) SetMetrics(m metrics.Metrics) {
+	m = metrics.OrNop(m)
+	kp.lookups = m.Counter("keypool_lookups_total",
+		"Number of key lookups (token verification).", "result")
+	kp.issues = m.Counter("keypool_current_total",
+		"Number of current key requests (token issuing).", "result")
+	kp.generated = m.Counter("keypool_generated_keys_total",
+		"Number of generated signature keys.")
+}
+
+// result returns the label value for err.
+func result(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case ErrNotFound:
+		return "not_found"
+	case ErrExpired:
+		return "expired"
+	}
+	return "error"
+}
+
 // AddVerifyKey adds key to the list of verification keys.
 func (kp *KeyPool) AddVerifyKey(key *[ed25519.PublicKeySize]byte) {
 	kp.mapMutex.Lock()
@@ -101,10 +131,11 @@ func (kp *KeyPool) HasVerifyKey(key *[ed25519.PublicKeySize]byte, nolock bool) b
 }
 
 // Lookup a public key from keypool.
-func (kp *KeyPool) Lookup(keyid [signkeys.KeyIDSize]byte) (*signkeys.PublicKey, error) {
+func (kp *KeyPool) Lookup(keyid [signkeys.KeyIDSize]byte) (key *signkeys.PublicKey, err error) {
+	defer func() { kp.lookups.Inc(result(err)) }()
 	kp.mapMutex.RLock()
 	defer kp.mapMutex.RUnlock()
-	key, err := kp.lookup(keyid)
+	key, err = kp.lookup(keyid)
 	if err == ErrNotFound && kp.FetchKeyCallBack != nil {
 		// Use fetchkey callback
 		fetchedKeyMarshalled, err := kp.FetchKeyCallBack(keyid[:])
@@ -154,7 +185,8 @@ func (kp KeyPool) SaveKeyUnsafe(keyid [signkeys.KeyIDSize]byte) error {
 }
 
 // Current returns the current key and the previous key.
-func (kp *KeyPool) Current() (*signkeys.KeyPair, *signkeys.KeyPair, error) {
+func (kp *KeyPool) Current() (current *signkeys.KeyPair, previous *signkeys.KeyPair, err error) {
+	defer func() { kp.issues.Inc(result(err)) }()
 	if kp.Generator.PrivateKey == nil {
 		return nil, nil, ErrNoGenerator
 	}
@@ -178,6 +210,7 @@ func (kp *KeyPool) Current() (*signkeys.KeyPair, *signkeys.KeyPair, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+		kp.generated.Inc()
 		if kp.currentKey != nil {
 			kp.previousKey = kp.currentKey
 		}
@@ -10,10 +10,12 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql" //
 	"github.com/mutecomm/mute/serviceguard/common/keypool"
 	"github.com/mutecomm/mute/serviceguard/common/signkeys"
+	"github.com/mutecomm/mute/util/metrics"
 )
 
 var (
@@ -41,6 +43,7 @@ type KeyDB struct {
 	insertQuery *sql.Stmt
 	loadQuery   *sql.Stmt
 	mayClose    bool
+	queries     metrics.Histogram // query durations
 }
 
 // New returns a new spendbook. Takes an existing database handle or URL
@@ -90,8 +93,15 @@ func (kd *KeyDB) Close() {
 	kd.DB = nil
 }
 
+// SetMetrics instruments the KeyDB with m (durations of DB queries).
+func (kd *KeyDB) SetMetrics(m metrics.Metrics) {
+	kd.queries = metrics.OrNop(m).Histogram("keypool_db_query_duration_seconds",
+		"Duration of keypool DB queries in seconds.", nil, "query")
+}
+
 func (kd *KeyDB) initDB() error {
 	var err error
+	kd.SetMetrics(metrics.Nop)
 	kd.DB.Exec(createQuery)
 	kd.insertQuery, err = kd.DB.Prepare(insertQuery)
 	if err != nil {
@@ -129,6 +139,7 @@ func (kd *KeyDB) writeFunc() keypool.WriteKeyCallbackFunc {
 	return func(keyid []byte, usage string, marshalledKey []byte) error {
 		id := hex.EncodeToString(keyid)
 		marshalled := base64.StdEncoding.EncodeToString(marshalledKey)
+		defer metrics.ObserveSince(kd.queries, time.Now(), "insert")
 		_, err := kd.insertQuery.Exec(id, usage, marshalled)
 		if err == nil {
 			return err
@@ -141,7 +152,9 @@ func (kd *KeyDB) writeFunc() keypool.WriteKeyCallbackFunc {
 func (kd *KeyDB) Fetch(keyid []byte) (marshalledKey []byte, err error) {
 	var encodedKey string
 	id := hex.EncodeToString(keyid)
+	start := time.Now()
 	err = kd.selectQuery.QueryRow(id).Scan(&encodedKey)
+	metrics.ObserveSince(kd.queries, start, "select")
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, keypool.ErrNotFound
@@ -163,6 +176,7 @@ func (kd *KeyDB) fetchFunc() keypool.FetchKeyCallBackFunc {
 // loadFunc returns a callback that loads keys from storage
 func (kd *KeyDB) loadFunc() keypool.LoadKeysCallbackFunc {
 	return func(keypool *keypool.KeyPool) error {
+		defer metrics.ObserveSince(kd.queries, time.Now(), "load")
 		rows, err := kd.loadQuery.Query()
 		if err != nil {
 			return err
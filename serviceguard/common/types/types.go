@@ -226,3 +226,28 @@ func (s *SpendPacket) Unmarshal(d []byte) (*SpendPacket, error) {
 	}
 	return s, nil
 }
+
+// Price is the price of an operation of a given usage class.
+type Price struct {
+	Usage         string // usage class of tokens ("Message", "UID", "Account", ...)
+	Tokens        uint64 // number of tokens consumed per operation
+	RenewalTokens uint64 // number of tokens consumed per renewal (0: not renewable)
+	Description   string // human-readable description of the operation
+}
+
+// PriceList is the price list published by a service guard operator.
+type PriceList struct {
+	Issued int64   // time the price list was issued (Unix time)
+	Prices []Price // prices per usage class
+}
+
+// Lookup returns the price for the given usage class from the price list, or
+// nil if the usage class is not listed.
+func (p *PriceList) Lookup(usage string) *Price {
+	for i := range p.Prices {
+		if p.Prices[i].Usage == usage {
+			return &p.Prices[i]
+		}
+	}
+	return nil
+}
@@ -33,14 +33,47 @@ var ErrMsgMismatch = errors.New("uid: UIDMessageReply from key server doesn't ma
 var ErrInvalidSrvSig = errors.New("uid: server-signature invalid (keyserver keys up-to-date?)")
 
 // ErrInvalidTimes is raised when NOTAFTER and NOTBEFORE are invalid.
-var ErrInvalidTimes = errors.New("uid: key init NOTBEFORE must be smaller than NOTAFTER")
+var ErrInvalidTimes = errors.New("uid: NOTBEFORE must be smaller than NOTAFTER")
 
 // ErrExpired is raised when NOTAFTER has expired.
 var ErrExpired = errors.New("uid: NOTAFTER has expired")
 
+// ErrNotYetValid is raised when NOTBEFORE lies in the future.
+var ErrNotYetValid = errors.New("uid: NOTBEFORE lies in the future")
+
+// ErrShortValidity is raised when the validity period of a new UID message
+// is shorter than MinValidity.
+var ErrShortValidity = errors.New("uid: validity period too short")
+
 // ErrFuture is raised when NOTAFTER is too far in the future.
 var ErrFuture = errors.New("uid: NOTAFTER is too far in the future")
 
+// ErrInvalidEscrowSig is raised when the escrow-signature of an UID message
+// is invalid.
+var ErrInvalidEscrowSig = errors.New("uid: escrow-signature invalid")
+
+// ErrNoSigEscrow is raised when a UID message contains no escrow signature
+// key.
+var ErrNoSigEscrow = errors.New("uid: UID message contains no escrow key")
+
+// ErrEscrowKeyMismatch is raised when a private escrow key does not belong to
+// the escrow signature key of a UID message.
+var ErrEscrowKeyMismatch = errors.New("uid: private escrow key does not match UID message")
+
+// ErrInvalidLinkAuthority is raised when the LINKAUTHORITY of an UID message
+// with an authoritative chain link is invalid.
+var ErrInvalidLinkAuthority = errors.New("uid: link authority invalid")
+
+// ErrUnknownCiphersuite is raised when a ciphersuite is not supported.
+var ErrUnknownCiphersuite = errors.New("uid: unknown ciphersuite")
+
+// ErrNoCommonCiphersuite is raised when the sender and the recipient of a
+// message do not support a common ciphersuite.
+var ErrNoCommonCiphersuite = errors.New("uid: no common ciphersuite")
+
+// ErrTombstone is raised when a UID message marks a deleted user ID.
+var ErrTombstone = errors.New("uid: user ID has been deleted")
+
 // ErrRepoURI is raised when a KeyInit message has an invalid repo URI.
 var ErrRepoURI = errors.New("uid: KeyInit has invalid repoURI")
 
@@ -9,6 +9,7 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"io"
+	"sort"
 
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
@@ -25,6 +26,48 @@ import (
 // All valid ciphersuite strings are predefined and contain only upper-case letters.
 const DefaultCiphersuite string = "NACL HKDF AES256-CTR SHA512-HMAC ED25519 ECDHE25519"
 
+// ciphersuites maps all supported ciphersuites to the FUNCTION of their static
+// key agreement keys (UIDContent.PUBKEYS). New ciphersuites (e.g., a
+// post-quantum hybrid) are registered with RegisterCiphersuite, new key
+// functions have to be added to initDHKey.
+var ciphersuites = map[string]string{
+	DefaultCiphersuite: "ECDHE25519",
+}
+
+// RegisterCiphersuite registers the ciphersuite whose static key agreement
+// keys have the given function. Registered ciphersuites can be added to UID
+// messages with AddCiphersuite and are used for messages, if negotiated (see
+// Negotiate).
+func RegisterCiphersuite(ciphersuite, function string) error {
+	if function != "ECDHE25519" {
+		return log.Errorf("uid: unknown key function: %s", function)
+	}
+	if _, ok := ciphersuites[ciphersuite]; ok {
+		return log.Errorf("uid: ciphersuite already registered: %s", ciphersuite)
+	}
+	ciphersuites[ciphersuite] = function
+	return nil
+}
+
+// Ciphersuites returns all supported ciphersuites, the DefaultCiphersuite
+// first.
+func Ciphersuites() []string {
+	var suites []string
+	for cs := range ciphersuites {
+		if cs != DefaultCiphersuite {
+			suites = append(suites, cs)
+		}
+	}
+	sort.Strings(suites)
+	return append([]string{DefaultCiphersuite}, suites...)
+}
+
+// IsSupportedCiphersuite returns true, if ciphersuite is supported.
+func IsSupportedCiphersuite(ciphersuite string) bool {
+	_, ok := ciphersuites[ciphersuite]
+	return ok
+}
+
 // A KeyEntry describes a key in Mute.
 type KeyEntry struct {
 	CIPHERSUITE   string // ciphersuite for which the key may be used. Example: "NACL HKDF AES-CTR256 SHA512-HMAC ED25519 ECDHE25519"
@@ -61,7 +104,7 @@ func KeyEntryEqual(a, b *KeyEntry) bool {
 // Verify that the content of KeyEntry is consistent and parseable.
 func (ke *KeyEntry) Verify() error {
 	// verify CIPHERSUITE
-	if ke.CIPHERSUITE != DefaultCiphersuite {
+	if !IsSupportedCiphersuite(ke.CIPHERSUITE) {
 		return log.Errorf("uid: unknown ke.CIPHERSUITE: %s", ke.CIPHERSUITE)
 	}
 	// verify FUNCTION
@@ -96,9 +139,22 @@ func (ke *KeyEntry) Verify() error {
 // TODO: InitDHKey has to be separated, should only end up in mutecrypt and
 // not in mutekeyd.
 func (ke *KeyEntry) InitDHKey(rand io.Reader) error {
+	return ke.initDHKey(DefaultCiphersuite, rand)
+}
+
+// initDHKey initializes the KeyEntry with a static key agreement key for the
+// given ciphersuite.
+func (ke *KeyEntry) initDHKey(ciphersuite string, rand io.Reader) error {
 	var err error
-	ke.CIPHERSUITE = DefaultCiphersuite
-	ke.FUNCTION = "ECDHE25519"
+	function, ok := ciphersuites[ciphersuite]
+	if !ok {
+		return log.Errorf("%s: %s", ErrUnknownCiphersuite, ciphersuite)
+	}
+	if function != "ECDHE25519" {
+		return log.Errorf("uid: unknown key function: %s", function)
+	}
+	ke.CIPHERSUITE = ciphersuite
+	ke.FUNCTION = function
 	// generate Curve25519 key
 	if ke.curve25519Key, err = cipher.Curve25519Generate(rand); err != nil {
 		return err
@@ -237,6 +293,37 @@ func (ke *KeyEntry) setPrivateKey(key []byte) error {
 	return err
 }
 
+// privateEscrowKey returns a copy of the escrow signature key ke with the
+// base64 encoded private key privkey set. It returns ErrEscrowKeyMismatch, if
+// privkey does not belong to the public key of ke.
+func (ke *KeyEntry) privateEscrowKey(privkey string) (*KeyEntry, error) {
+	escrow := &KeyEntry{
+		CIPHERSUITE: ke.CIPHERSUITE,
+		FUNCTION:    ke.FUNCTION,
+		HASH:        ke.HASH,
+		PUBKEY:      ke.PUBKEY,
+	}
+	if escrow.FUNCTION != "ED25519" {
+		return nil, log.Error("uid: escrow key must be an ED25519 key")
+	}
+	if err := escrow.SetPrivateKey(privkey); err != nil {
+		return nil, err
+	}
+	pubKey, err := base64.Decode(escrow.PUBKEY)
+	if err != nil {
+		return nil, err
+	}
+	if err := escrow.ed25519Key.SetPublicKey(pubKey); err != nil {
+		return nil, err
+	}
+	escrow.publicKeySet = true
+	// make sure the private key belongs to the public key
+	if !escrow.ed25519Key.Verify(pubKey, escrow.ed25519Key.Sign(pubKey)) {
+		return nil, log.Error(ErrEscrowKeyMismatch)
+	}
+	return escrow, nil
+}
+
 // SetPrivateKey sets the private key to the given base64 encoded privkey
 // string.
 func (ke *KeyEntry) SetPrivateKey(privkey string) error {
@@ -45,6 +45,32 @@ type KeyInit struct {
 // message can be in the future.
 const MaxNotAfter = uint64(90 * 24 * 60 * 60) // 90 days
 
+// A KeyInitWindow defines the validity window of a time-bucketed KeyInit
+// message.
+type KeyInitWindow struct {
+	NotBefore uint64 // start of validity window (inclusive)
+	NotAfter  uint64 // end of validity window (exclusive)
+}
+
+// KeyInitWindows returns count many consecutive validity windows of the given
+// duration (in seconds) for time-bucketed KeyInit messages. The windows are
+// aligned to multiples of duration and the first window contains start.
+// Time-bucketed KeyInit messages limit how long a stolen KeyInit private key
+// is useful.
+func KeyInitWindows(start, duration uint64, count int) []KeyInitWindow {
+	if duration == 0 {
+		return nil
+	}
+	windows := make([]KeyInitWindow, count)
+	notBefore := start - start%duration
+	for i := range windows {
+		windows[i].NotBefore = notBefore
+		windows[i].NotAfter = notBefore + duration
+		notBefore += duration
+	}
+	return windows
+}
+
 // NewJSONKeyInit returns a new KeyInit message initialized with the parameters
 // given in the JSON byte array.
 func NewJSONKeyInit(keyInit []byte) (*KeyInit, error) {
@@ -105,6 +131,25 @@ func (ki *KeyInit) MsgCount() uint64 {
 	return ki.Contents.MSGCOUNT
 }
 
+// NotAfter returns the time after which the KeyInit message should not be
+// used anymore.
+func (ki *KeyInit) NotAfter() uint64 {
+	return ki.Contents.NOTAFTER
+}
+
+// ValidAt returns true, if the KeyInit message is valid at time t (that is,
+// NOTBEFORE <= t < NOTAFTER).
+func (ki *KeyInit) ValidAt(t uint64) bool {
+	return ki.Contents.NOTBEFORE <= t && t < ki.Contents.NOTAFTER
+}
+
+// Fallback returns true, if the KeyInit message may serve as a fallback key
+// (that is, it may be used for multiple sessions). Other KeyInit messages are
+// single-use and their private key is deleted after the first use.
+func (ki *KeyInit) Fallback() bool {
+	return ki.Contents.FALLBACK
+}
+
 // SigKeyHash returns the signature key hash of the KeyInit message.
 func (ki *KeyInit) SigKeyHash() string {
 	return ki.Contents.SIGKEYHASH
@@ -189,6 +234,11 @@ func (ki *KeyInit) Verify(keyInitRepositoryURIs []string, sigPubKey string) erro
 		log.Error(ErrExpired)
 		return ErrExpired
 	}
+	// already valid
+	if ki.Contents.NOTBEFORE > uint64(times.Now()) {
+		log.Error(ErrNotYetValid)
+		return ErrNotYetValid
+	}
 
 	// SIGNATURE was made with UIDMessage.UIDContent.SIGKEY over Contents
 	var ed25519Key cipher.Ed25519Key
@@ -252,3 +252,53 @@ func TestSessionAnchor(t *testing.T) {
 		t.Fatal("private keys differ")
 	}
 }
+
+func TestKeyInitWindows(t *testing.T) {
+	windows := KeyInitWindows(100, 60, 3)
+	if len(windows) != 3 {
+		t.Fatalf("len(windows) = %d, want 3", len(windows))
+	}
+	if windows[0].NotBefore != 60 || windows[0].NotAfter != 120 {
+		t.Errorf("unexpected first window: %+v", windows[0])
+	}
+	if windows[2].NotBefore != 180 || windows[2].NotAfter != 240 {
+		t.Errorf("unexpected last window: %+v", windows[2])
+	}
+	if KeyInitWindows(100, 0, 3) != nil {
+		t.Error("zero duration should return nil")
+	}
+}
+
+func TestKeyInitTimeBucket(t *testing.T) {
+	msg, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(times.Now())
+	windows := KeyInitWindows(now, 3600, 2)
+	uris := []string{"mute.berlin"}
+	for i, w := range windows {
+		ki, _, _, err := msg.KeyInit(0, w.NotAfter, w.NotBefore, false,
+			"mute.berlin", "", "", cipher.RandReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ki.Verify(uris, msg.UIDContent.SIGKEY.PUBKEY)
+		if i == 0 {
+			if !ki.ValidAt(now) {
+				t.Error("first KeyInit should be valid now")
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		} else {
+			if ki.ValidAt(now) {
+				t.Error("second KeyInit should not be valid yet")
+			}
+			if err != ErrNotYetValid {
+				t.Error("should fail with ErrNotYetValid")
+			}
+		}
+	}
+}
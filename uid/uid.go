@@ -41,6 +41,44 @@ import (
 //
 const ProtocolVersion = "1.0"
 
+// MsgSigKeyVersion defines the protocol version of UID messages which contain
+// a dedicated long-term message signing key. Version 1.1 has the same
+// peculiarities as version 1.0 (see ProtocolVersion), except that
+// UIDContent.MSGSIGKEY must contain an ED25519 key for the default
+// ciphersuite. In version 1.0 UIDContent.MSGSIGKEY must be absent and
+// messages are signed with UIDContent.SIGKEY.
+const MsgSigKeyVersion = "1.1"
+
+// SigEscrowVersion defines the protocol version of UID messages which contain
+// an escrow signature key. Version 1.2 has the same peculiarities as version
+// 1.0 (see ProtocolVersion), except that UIDContent.SIGESCROW must contain an
+// ED25519 key for the default ciphersuite and UIDContent.MSGSIGKEY is optional
+// (see MsgSigKeyVersion). The successor of such a UID message can be signed
+// with the escrow key instead of the signature key, if the latter has been
+// lost (see Recover).
+const SigEscrowVersion = "1.2"
+
+// ChainLinkVersion defines the protocol version of UID messages which link
+// the identity to a foreign key hashchain. Version 1.3 has the same
+// peculiarities as version 1.0 (see ProtocolVersion), except that
+// UIDContent.CHAINLINK must be set (see Link) and UIDContent.MSGSIGKEY and
+// UIDContent.SIGESCROW are optional (see MsgSigKeyVersion and
+// SigEscrowVersion). LINKAUTHORITY must be set, if and only if the link is
+// authoritative (see SignLinkAuthority), which is verified by the clients and
+// not by Check.
+const ChainLinkVersion = "1.3"
+
+// CiphersuitesVersion defines the protocol version of UID messages which
+// contain static key agreement keys for multiple ciphersuites. Version 1.4 has
+// the same peculiarities as version 1.0 (see ProtocolVersion), except that
+// UIDContent.PUBKEYS contains exactly one key for every supported ciphersuite
+// in UIDContent.PREFERENCES.CIPHERSUITES, which must include the
+// DefaultCiphersuite (see AddCiphersuite). UIDContent.MSGSIGKEY,
+// UIDContent.SIGESCROW, and UIDContent.CHAINLINK are optional (see
+// MsgSigKeyVersion, SigEscrowVersion, and ChainLinkVersion). The ciphersuite
+// used for a message is negotiated with Negotiate.
+const CiphersuitesVersion = "1.4"
+
 // PFSPreference represents a perfect forward secrecy (PFS) preference.
 type PFSPreference int
 
@@ -69,10 +107,12 @@ type preferences struct {
 	CIPHERSUITES []string // list of ciphersuites, ordered from most preferred to least preferred.
 }
 
-type chainlink struct {
+// ChainLink links a UID message to a foreign key hashchain in which the same
+// user has an identity (see ChainLinkVersion).
+type ChainLink struct {
 	URI           []string // URI(s) of the foreign key hashchain
 	LAST          string   // last entry of the foreign key hashchain
-	AUTHORITATIVE bool
+	AUTHORITATIVE bool     // link is confirmed by the key server (LINKAUTHORITY)
 	DOMAINS       []string // list of domains that are served currently
 	IDENTITY      string   // own Identity in the foreign key hashchain
 }
@@ -88,10 +128,11 @@ type uidContent struct {
 	SIGKEY      KeyEntry    // used to sign UIDContent and to authenticate future UIDMessages
 	PUBKEYS     []KeyEntry  // for static key content confidentiality
 	SIGESCROW   *KeyEntry   // used to optionally authenticate future UIDMessage
+	MSGSIGKEY   *KeyEntry   `structs:",omitempty"` // long-term key to sign messages (version 1.1)
 	LASTENTRY   string      // last known key hashchain entry
 	REPOURIS    []string    // URIs of KeyInit Repositories to publish KeyInit messages
 	PREFERENCES preferences // PFS preference
-	CHAINLINK   *chainlink  // used only for "linking chains and key repositories"
+	CHAINLINK   *ChainLink  // used only for "linking chains and key repositories"
 }
 
 // Message is a UIDMessage to be sent from user to key server.
@@ -123,9 +164,18 @@ type MessageReply struct {
 	SERVERSIGNATURE string // signature over Entry by keyserver's signature key
 }
 
+// MinValidity defines the minimum number of seconds a newly created UID
+// message must be valid.
+const MinValidity = uint64(24 * 60 * 60) // 1 day
+
+// MaxValidity defines the maximum number of seconds the NOTAFTER field of a
+// newly created UID message can be in the future.
+const MaxValidity = uint64(2 * 365 * 24 * 60 * 60) // 2 years
+
 // Create creates a new UID message for the given userID and self-signs it.
 // It automatically creates all necessary keys. If sigescrow is true,  an
-// escrow key is included in the created UID message.
+// escrow key is included in the created UID message (see SigEscrowVersion).
+// The UID message is valid for one year and renewed with every update.
 // Necessary randomness is read from rand.
 func Create(
 	userID string,
@@ -134,6 +184,26 @@ func Create(
 	pfsPreference PFSPreference,
 	lastEntry string,
 	rand io.Reader,
+) (*Message, error) {
+	return CreateWithValidity(userID, sigescrow, mixaddress, nymaddress,
+		pfsPreference, lastEntry, uint64(times.OneYearLater()), 0, rand)
+}
+
+// CreateWithValidity creates a new UID message like Create, but with the
+// given validity period.
+// notafter is the unixtime after which the keys should not be used anymore.
+// notbefore is the unixtime before which the keys should not be used yet.
+// The UID message must be valid for at least MinValidity seconds. If
+// notbefore is not 0, the validity period is fixed and not renewed by
+// updates (see Renewable), which allows to create short-lived user IDs.
+func CreateWithValidity(
+	userID string,
+	sigescrow bool,
+	mixaddress, nymaddress string,
+	pfsPreference PFSPreference,
+	lastEntry string,
+	notafter, notbefore uint64,
+	rand io.Reader,
 ) (*Message, error) {
 	var msg Message
 	var err error
@@ -141,10 +211,24 @@ func Create(
 	if err := identity.IsMapped(userID); err != nil {
 		return nil, log.Error(err)
 	}
+	// time checks
+	if notbefore >= notafter {
+		return nil, log.Error(ErrInvalidTimes)
+	}
+	start := uint64(times.Now())
+	if notbefore > start {
+		start = notbefore
+	}
+	if notafter < start+MinValidity {
+		return nil, log.Error(ErrShortValidity)
+	}
+	if notafter > uint64(times.Now())+MaxValidity {
+		return nil, log.Error(ErrFuture)
+	}
 	msg.UIDContent.VERSION = ProtocolVersion
-	msg.UIDContent.MSGCOUNT = 0                            // this is the first UIDMessage
-	msg.UIDContent.NOTAFTER = uint64(times.OneYearLater()) // TODO: make this settable!
-	msg.UIDContent.NOTBEFORE = 0                           // TODO: make this settable
+	msg.UIDContent.MSGCOUNT = 0 // this is the first UIDMessage
+	msg.UIDContent.NOTAFTER = notafter
+	msg.UIDContent.NOTBEFORE = notbefore
 	if pfsPreference == Optional {
 		msg.UIDContent.MIXADDRESS = mixaddress
 		msg.UIDContent.NYMADDRESS = nymaddress
@@ -161,6 +245,7 @@ func Create(
 		return nil, err
 	}
 	if sigescrow {
+		msg.UIDContent.VERSION = SigEscrowVersion
 		msg.UIDContent.SIGESCROW = new(KeyEntry)
 		if err = msg.UIDContent.SIGESCROW.initSigKey(rand); err != nil {
 			return nil, err
@@ -184,8 +269,6 @@ func Create(
 	msg.UIDContent.PREFERENCES.FORWARDSEC = pfsPreference.String()
 	msg.UIDContent.PREFERENCES.CIPHERSUITES = []string{DefaultCiphersuite}
 
-	// TODO: CHAINLINK (later protocol version)
-
 	// theses signatures are always empty for messages the first UIDMessage
 	msg.ESCROWSIGNATURE = ""
 	msg.USERSIGNATURE = ""
@@ -193,8 +276,6 @@ func Create(
 	selfsig := msg.UIDContent.SIGKEY.ed25519Key.Sign(msg.UIDContent.JSON())
 	msg.SELFSIGNATURE = base64.Encode(selfsig)
 
-	// TODO: LINKAUTHORITY
-
 	return &msg, nil
 }
 
@@ -205,18 +286,24 @@ func (msg *Message) checkV1_0() error {
 		return log.Errorf("uid: FORWARDSEC must be %q", strict)
 	}
 	// UIDContent.PUBKEYS contains exactly one ECDHE25519 key for the default
-	// ciphersuite
-	if len(msg.UIDContent.PUBKEYS) != 1 {
-		return log.Error("uid: UIDContent.PUBKEYS must contain exactly one key")
-	}
-	if msg.UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite {
-		return log.Error("uid: UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite")
-	}
-	if msg.UIDContent.PUBKEYS[0].FUNCTION != "ECDHE25519" {
-		return log.Error("uid: UIDContent.PUBKEYS[0].FUNCTION != \"ECDHE25519\"")
+	// ciphersuite (except in version 1.4)
+	if msg.UIDContent.VERSION != CiphersuitesVersion {
+		if len(msg.UIDContent.PUBKEYS) != 1 {
+			return log.Error("uid: UIDContent.PUBKEYS must contain exactly one key")
+		}
+		if msg.UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite {
+			return log.Error("uid: UIDContent.PUBKEYS[0].CIPHERSUITE != DefaultCiphersuite")
+		}
+		if msg.UIDContent.PUBKEYS[0].FUNCTION != "ECDHE25519" {
+			return log.Error("uid: UIDContent.PUBKEYS[0].FUNCTION != \"ECDHE25519\"")
+		}
 	}
-	// UIDContent.SIGESCROW must be zero-value.
-	if msg.UIDContent.SIGESCROW != nil {
+	// UIDContent.SIGESCROW must be zero-value (except in version 1.2, 1.3,
+	// and 1.4)
+	if msg.UIDContent.VERSION != SigEscrowVersion &&
+		msg.UIDContent.VERSION != ChainLinkVersion &&
+		msg.UIDContent.VERSION != CiphersuitesVersion &&
+		msg.UIDContent.SIGESCROW != nil {
 		if msg.UIDContent.SIGESCROW.CIPHERSUITE != "" ||
 			msg.UIDContent.SIGESCROW.FUNCTION != "" ||
 			msg.UIDContent.SIGESCROW.HASH != "" ||
@@ -232,19 +319,161 @@ func (msg *Message) checkV1_0() error {
 		return log.Error("uid: UIDContent.REPOURIS must contain one entry (domain of identity)")
 	}
 
-	// UIDContent.CHAINLINK must be zero-value
-	if msg.UIDContent.CHAINLINK != nil {
-		if !reflect.DeepEqual(msg.UIDContent.CHAINLINK, chainlink{}) {
+	// UIDContent.CHAINLINK must be zero-value (except in version 1.3 and 1.4)
+	if !msg.HasChainLink() && msg.UIDContent.CHAINLINK != nil {
+		if !reflect.DeepEqual(*msg.UIDContent.CHAINLINK, ChainLink{}) {
 			return log.Error("uid: UIDContent.CHAINLINK must be zero-value")
 		}
 	}
+	// LINKAUTHORITY must be zero unless an authoritative link entry
+	if msg.LINKAUTHORITY != "" && (msg.UIDContent.CHAINLINK == nil ||
+		!msg.UIDContent.CHAINLINK.AUTHORITATIVE) {
+		return log.Error("uid: LINKAUTHORITY must be zero unless an authoritative link entry")
+	}
+	// UIDContent.MSGSIGKEY must be absent in version 1.0
+	if msg.UIDContent.VERSION == ProtocolVersion &&
+		msg.UIDContent.MSGSIGKEY != nil {
+		return log.Error("uid: UIDContent.MSGSIGKEY must be absent in version 1.0")
+	}
 	return nil
 }
 
+func (msg *Message) checkV1_1() error {
+	// UIDContent.MSGSIGKEY contains an ED25519 key for the default ciphersuite
+	if msg.UIDContent.MSGSIGKEY == nil {
+		return log.Error("uid: UIDContent.MSGSIGKEY must be set in version 1.1")
+	}
+	if msg.UIDContent.MSGSIGKEY.CIPHERSUITE != DefaultCiphersuite {
+		return log.Error("uid: UIDContent.MSGSIGKEY.CIPHERSUITE != DefaultCiphersuite")
+	}
+	if msg.UIDContent.MSGSIGKEY.FUNCTION != "ED25519" {
+		return log.Error("uid: UIDContent.MSGSIGKEY.FUNCTION != \"ED25519\"")
+	}
+	// all other version 1.0 peculiarities apply
+	return msg.checkV1_0()
+}
+
+func (msg *Message) checkV1_2() error {
+	// UIDContent.SIGESCROW contains an ED25519 key for the default ciphersuite
+	if msg.UIDContent.SIGESCROW == nil {
+		return log.Error("uid: UIDContent.SIGESCROW must be set in version 1.2")
+	}
+	if msg.UIDContent.SIGESCROW.CIPHERSUITE != DefaultCiphersuite {
+		return log.Error("uid: UIDContent.SIGESCROW.CIPHERSUITE != DefaultCiphersuite")
+	}
+	if msg.UIDContent.SIGESCROW.FUNCTION != "ED25519" {
+		return log.Error("uid: UIDContent.SIGESCROW.FUNCTION != \"ED25519\"")
+	}
+	// UIDContent.MSGSIGKEY is optional
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return msg.checkV1_1()
+	}
+	// all other version 1.0 peculiarities apply
+	return msg.checkV1_0()
+}
+
+// check checks that the chain link is complete and well-formed.
+func (link *ChainLink) check() error {
+	if len(link.URI) == 0 {
+		return log.Error("uid: UIDContent.CHAINLINK.URI must contain at least one entry")
+	}
+	if _, _, _, _, _, _, err := hashchain.SplitEntry(link.LAST); err != nil {
+		return err
+	}
+	if err := identity.IsMapped(link.IDENTITY); err != nil {
+		return log.Error(err)
+	}
+	if len(link.DOMAINS) == 0 {
+		return log.Error("uid: UIDContent.CHAINLINK.DOMAINS must contain at least one entry")
+	}
+	for _, domain := range link.DOMAINS {
+		if domain != identity.MapDomain(domain) {
+			return log.Errorf("uid: UIDContent.CHAINLINK.DOMAINS entry not mapped: %s",
+				domain)
+		}
+	}
+	return nil
+}
+
+func (msg *Message) checkV1_3() error {
+	// UIDContent.CHAINLINK contains a valid chain link
+	if msg.UIDContent.CHAINLINK == nil {
+		return log.Error("uid: UIDContent.CHAINLINK must be set in version 1.3")
+	}
+	if err := msg.UIDContent.CHAINLINK.check(); err != nil {
+		return err
+	}
+	// UIDContent.SIGESCROW is optional
+	if msg.UIDContent.SIGESCROW != nil {
+		return msg.checkV1_2()
+	}
+	// UIDContent.MSGSIGKEY is optional
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return msg.checkV1_1()
+	}
+	// all other version 1.0 peculiarities apply
+	return msg.checkV1_0()
+}
+
+func (msg *Message) checkV1_4() error {
+	// UIDContent.PUBKEYS contains exactly one key for every ciphersuite in
+	// UIDContent.PREFERENCES.CIPHERSUITES, including the DefaultCiphersuite
+	suites := msg.UIDContent.PREFERENCES.CIPHERSUITES
+	if len(msg.UIDContent.PUBKEYS) != len(suites) {
+		return log.Error("uid: UIDContent.PUBKEYS must contain one key per ciphersuite")
+	}
+	var hasDefault bool
+	for _, cs := range suites {
+		if !IsSupportedCiphersuite(cs) {
+			return log.Errorf("%s: %s", ErrUnknownCiphersuite, cs)
+		}
+		if cs == DefaultCiphersuite {
+			hasDefault = true
+		}
+		var n int
+		for _, ke := range msg.UIDContent.PUBKEYS {
+			if ke.CIPHERSUITE == cs {
+				if ke.FUNCTION != ciphersuites[cs] {
+					return log.Errorf("uid: UIDContent.PUBKEYS entry has wrong FUNCTION: %s",
+						ke.FUNCTION)
+				}
+				n++
+			}
+		}
+		if n != 1 {
+			return log.Errorf("uid: UIDContent.PUBKEYS must contain exactly one key for ciphersuite: %s",
+				cs)
+		}
+	}
+	if !hasDefault {
+		return log.Error("uid: UIDContent.PREFERENCES.CIPHERSUITES must contain DefaultCiphersuite")
+	}
+	// UIDContent.CHAINLINK is optional
+	if msg.UIDContent.CHAINLINK != nil {
+		if err := msg.UIDContent.CHAINLINK.check(); err != nil {
+			return err
+		}
+	}
+	// UIDContent.SIGESCROW is optional
+	if msg.UIDContent.SIGESCROW != nil {
+		return msg.checkV1_2()
+	}
+	// UIDContent.MSGSIGKEY is optional
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return msg.checkV1_1()
+	}
+	// all other version 1.0 peculiarities apply
+	return msg.checkV1_0()
+}
+
 // Check that the content of the UID message is consistent with it's version.
 func (msg *Message) Check() error {
-	// we only support version 1.0 at this stage
-	if msg.UIDContent.VERSION != "1.0" {
+	// we only support version 1.0, 1.1, 1.2, 1.3, and 1.4 at this stage
+	if msg.UIDContent.VERSION != ProtocolVersion &&
+		msg.UIDContent.VERSION != MsgSigKeyVersion &&
+		msg.UIDContent.VERSION != SigEscrowVersion &&
+		msg.UIDContent.VERSION != ChainLinkVersion &&
+		msg.UIDContent.VERSION != CiphersuitesVersion {
 		return log.Errorf("uid: unknown UIDContent.VERSION: %s",
 			msg.UIDContent.VERSION)
 	}
@@ -285,7 +514,17 @@ func (msg *Message) Check() error {
 		return log.Error("uid: USERSIGNATURE and ESCROWSIGNATURE cannot be set at the same time")
 	}
 
-	// version 1.0 specific checks
+	// version specific checks
+	switch msg.UIDContent.VERSION {
+	case MsgSigKeyVersion:
+		return msg.checkV1_1()
+	case SigEscrowVersion:
+		return msg.checkV1_2()
+	case ChainLinkVersion:
+		return msg.checkV1_3()
+	case CiphersuitesVersion:
+		return msg.checkV1_4()
+	}
 	return msg.checkV1_0()
 }
 
@@ -321,20 +560,57 @@ func (msg *Message) SigPubKey() string {
 	return msg.UIDContent.SIGKEY.PUBKEY
 }
 
-// PubHash returns the public key hash which corresponds to the given UID message.
+// PubHash returns the public key hash which corresponds to the given UID
+// message (for the DefaultCiphersuite).
 func (msg *Message) PubHash() string {
-	// at the moment we only support one ciphersuite, therefore the index is hard-coded
-	// TODO: check function
-	return msg.UIDContent.PUBKEYS[0].HASH
+	return msg.PubKey().HASH
 }
 
-// PubKey returns the public key for the given UID message.
+// PubKey returns the public key for the given UID message (for the
+// DefaultCiphersuite, see PubKeyFor).
 func (msg *Message) PubKey() *KeyEntry {
-	// at the moment we only support one ciphersuite, therefore the index is hard-coded
-	// TODO: check function
+	if i := msg.pubKeyIndex(DefaultCiphersuite); i >= 0 {
+		return &msg.UIDContent.PUBKEYS[i]
+	}
 	return &msg.UIDContent.PUBKEYS[0]
 }
 
+// pubKeyIndex returns the index of the key for ciphersuite in
+// UIDContent.PUBKEYS or -1, if there is none.
+func (msg *Message) pubKeyIndex(ciphersuite string) int {
+	for i, ke := range msg.UIDContent.PUBKEYS {
+		if ke.CIPHERSUITE == ciphersuite {
+			return i
+		}
+	}
+	return -1
+}
+
+// PubKeyFor returns the public key for the given ciphersuite of the UID
+// message. It returns ErrKeyEntryNotFound, if the UID message contains no key
+// for ciphersuite.
+func (msg *Message) PubKeyFor(ciphersuite string) (*KeyEntry, error) {
+	i := msg.pubKeyIndex(ciphersuite)
+	if i < 0 {
+		return nil, log.Error(ErrKeyEntryNotFound)
+	}
+	return &msg.UIDContent.PUBKEYS[i], nil
+}
+
+// Negotiate returns the most preferred ciphersuite of the recipient UID
+// message (see UIDContent.PREFERENCES.CIPHERSUITES) which is supported and for
+// which both UID messages contain a key. It returns ErrNoCommonCiphersuite, if
+// there is no such ciphersuite.
+func Negotiate(sender, recipient *Message) (string, error) {
+	for _, cs := range recipient.UIDContent.PREFERENCES.CIPHERSUITES {
+		if IsSupportedCiphersuite(cs) && sender.pubKeyIndex(cs) >= 0 &&
+			recipient.pubKeyIndex(cs) >= 0 {
+			return cs, nil
+		}
+	}
+	return "", log.Error(ErrNoCommonCiphersuite)
+}
+
 // PublicKey decodes the 32-byte public key from the given UID message and
 // returns it.
 func (msg *Message) PublicKey() (*[32]byte, error) {
@@ -490,6 +766,39 @@ func (msg *Message) VerifyUserSig(preMsg *Message) error {
 	return nil
 }
 
+// VerifyEscrowSig verifies that the escrow-signature of UIDMessage (made with
+// the escrow key of preMsg, see Recover) is valid.
+func (msg *Message) VerifyEscrowSig(preMsg *Message) error {
+	var ed25519Key cipher.Ed25519Key
+	// check message counter
+	if preMsg.UIDContent.MSGCOUNT+1 != msg.UIDContent.MSGCOUNT {
+		return log.Error(ErrIncrement)
+	}
+	if !preMsg.HasSigEscrow() {
+		return log.Error(ErrNoSigEscrow)
+	}
+	// get content
+	content := msg.UIDContent.JSON()
+	// get escrow-signature
+	escrowsig, err := base64.Decode(msg.ESCROWSIGNATURE)
+	if err != nil {
+		return err
+	}
+	// create ed25519 key
+	pubKey, err := base64.Decode(preMsg.UIDContent.SIGESCROW.PUBKEY)
+	if err != nil {
+		return err
+	}
+	if err := ed25519Key.SetPublicKey(pubKey); err != nil {
+		return err
+	}
+	// verify escrow-signature
+	if !ed25519Key.Verify(content, escrowsig) {
+		return log.Error(ErrInvalidEscrowSig)
+	}
+	return nil
+}
+
 // PrivateSigKey returns the base64 encoded private signature key of the UID
 // message.
 func (msg *Message) PrivateSigKey() string {
@@ -518,22 +827,94 @@ func (msg *Message) SetPrivateSigKey(privkey string) error {
 	return msg.UIDContent.SIGKEY.setPrivateKey(key)
 }
 
+// HasMsgSigKey returns true, if the UID message contains a dedicated message
+// signing key (see MsgSigKeyVersion).
+func (msg *Message) HasMsgSigKey() bool {
+	return msg.UIDContent.MSGSIGKEY != nil
+}
+
+// MsgSigPubKey32 returns the 32-byte public key used to verify messages
+// signed by the owner of the given UID message. This is the dedicated message
+// signing key, if the UID message contains one, and the public signature key
+// otherwise.
+func (msg *Message) MsgSigPubKey32() *[32]byte {
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return msg.UIDContent.MSGSIGKEY.PublicKey32()
+	}
+	return msg.UIDContent.SIGKEY.PublicKey32()
+}
+
+// PrivateMsgSigKey64 returns the 64-byte private key used to sign messages
+// with the given UID message (see MsgSigPubKey32).
+func (msg *Message) PrivateMsgSigKey64() *[64]byte {
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return msg.UIDContent.MSGSIGKEY.PrivateKey64()
+	}
+	return msg.UIDContent.SIGKEY.PrivateKey64()
+}
+
+// PrivateMsgSigKey returns the base64 encoded private key of the dedicated
+// message signing key of the UID message.
+func (msg *Message) PrivateMsgSigKey() string {
+	return msg.UIDContent.MSGSIGKEY.PrivateKey()
+}
+
+// SetPrivateMsgSigKey sets the private key of the dedicated message signing
+// key to the given base64 encoded privkey string.
+func (msg *Message) SetPrivateMsgSigKey(privkey string) error {
+	if msg.UIDContent.MSGSIGKEY == nil {
+		return log.Error(ErrKeyEntryNotFound)
+	}
+	return msg.UIDContent.MSGSIGKEY.SetPrivateKey(privkey)
+}
+
+// HasSigEscrow returns true, if the UID message contains an escrow signature
+// key (see SigEscrowVersion).
+func (msg *Message) HasSigEscrow() bool {
+	return msg.UIDContent.SIGESCROW != nil &&
+		msg.UIDContent.SIGESCROW.PUBKEY != ""
+}
+
+// PrivateSigEscrowKey returns the base64 encoded private escrow signature key
+// of the UID message, if it is set. Otherwise an empty string is returned.
+func (msg *Message) PrivateSigEscrowKey() string {
+	if !msg.HasSigEscrow() || !msg.UIDContent.SIGESCROW.privateKeySet {
+		return ""
+	}
+	return msg.UIDContent.SIGESCROW.PrivateKey()
+}
+
+// SetPrivateSigEscrowKey sets the private escrow signature key to the given
+// base64 encoded privkey string. It returns ErrEscrowKeyMismatch, if privkey
+// does not belong to the escrow signature key of the UID message.
+func (msg *Message) SetPrivateSigEscrowKey(privkey string) error {
+	if !msg.HasSigEscrow() {
+		return log.Error(ErrNoSigEscrow)
+	}
+	escrow, err := msg.UIDContent.SIGESCROW.privateEscrowKey(privkey)
+	if err != nil {
+		return err
+	}
+	msg.UIDContent.SIGESCROW = escrow
+	return nil
+}
+
 // PrivateEncKey returns the base64 encoded private encryption key of the
 // given UID message.
 func (msg *Message) PrivateEncKey() string {
-	return base64.Encode(msg.UIDContent.PUBKEYS[0].PrivateKey32()[:])
+	return base64.Encode(msg.PubKey().PrivateKey32()[:])
 }
 
 // PublicEncKey32 decodes the 32-byte public encryption key of the given UID
 // message and returns it.
 func (msg *Message) PublicEncKey32() *[32]byte {
-	return msg.UIDContent.PUBKEYS[0].PublicKey32()
+	return msg.PubKey().PublicKey32()
 }
 
 // PrivateEncKey32 decodes the 32-byte private encryption key of the given UID
 // message and returns it.
 func (msg *Message) PrivateEncKey32() *[32]byte {
-	return msg.UIDContent.PUBKEYS[0].PrivateKey32()
+	return msg.PubKey().PrivateKey32()
 }
 
 // SetPrivateEncKey sets the private encryption key to the given base64 encoded
@@ -543,7 +924,7 @@ func (msg *Message) SetPrivateEncKey(privkey string) error {
 	if err != nil {
 		return err
 	}
-	return msg.UIDContent.PUBKEYS[0].setPrivateKey(key)
+	return msg.PubKey().setPrivateKey(key)
 }
 
 // Localpart returns the localpart of the uid identity.
@@ -567,20 +948,256 @@ func (msg *Message) Domain() string {
 }
 
 // Update generates an updated version of the given UID message, signs it with
-// the private signature key, and returns it.
+// the private signature key, and returns it. The validity of the keys is
+// renewed, if the UID message is renewable (NOTAFTER is set to one year
+// later, if it expires earlier).
 func (msg *Message) Update(rand io.Reader) (*Message, error) {
+	return msg.update(rand, false, nil, nil, nil)
+}
+
+// Tombstone generates the final update of the given UID message which marks
+// the user ID as deleted, signs it with the private signature key, and
+// returns it. The keys of a tombstone are not valid at any time
+// (NOTBEFORE == NOTAFTER == time of deletion) and it cannot be updated
+// anymore.
+func (msg *Message) Tombstone(rand io.Reader) (*Message, error) {
+	return msg.update(rand, true, nil, nil, nil)
+}
+
+// IsTombstone returns true, if the UID message marks a deleted user ID (see
+// Tombstone).
+func (msg *Message) IsTombstone() bool {
+	return msg.UIDContent.NOTAFTER != 0 &&
+		msg.UIDContent.NOTAFTER <= msg.UIDContent.NOTBEFORE
+}
+
+// Renewable returns true, if the validity of the UID message is renewed by
+// updates. UID messages created with a fixed validity period (see
+// CreateWithValidity) and tombstones are not renewable.
+func (msg *Message) Renewable() bool {
+	return msg.UIDContent.NOTBEFORE == 0
+}
+
+// AddMsgSigKey generates an updated version of the given UID message which
+// contains a newly generated dedicated message signing key (see
+// MsgSigKeyVersion), signs it with the private signature key, and returns it.
+// Contrary to the signature key the message signing key is not rotated with
+// every update, so that signatures of old messages stay verifiable.
+func (msg *Message) AddMsgSigKey(rand io.Reader) (*Message, error) {
+	if msg.IsTombstone() {
+		return nil, log.Error(ErrTombstone)
+	}
+	if msg.UIDContent.MSGSIGKEY != nil {
+		return nil, log.Error("uid: UID message already contains a message signing key")
+	}
+	var msgSigKey KeyEntry
+	if err := msgSigKey.initSigKey(rand); err != nil {
+		return nil, err
+	}
+	return msg.update(rand, false, &msgSigKey, nil, nil)
+}
+
+// Recover generates the successor of the given (public) UID message after its
+// private signature key has been lost, signs it with the base64 encoded
+// private escrow key escrowKey (ESCROWSIGNATURE instead of USERSIGNATURE),
+// and returns it. All keys of the successor are newly generated, including
+// the escrow key (which has to be exported again).
+// Necessary randomness is read from rand.
+func (msg *Message) Recover(escrowKey string, rand io.Reader) (*Message, error) {
+	if msg.IsTombstone() {
+		return nil, log.Error(ErrTombstone)
+	}
+	if !msg.HasSigEscrow() {
+		return nil, log.Error(ErrNoSigEscrow)
+	}
+	escrow, err := msg.UIDContent.SIGESCROW.privateEscrowKey(escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	var up Message
+	up.UIDContent = msg.UIDContent
+	// increase counter
+	up.UIDContent.MSGCOUNT++
+	// generate new keys
+	if err := up.UIDContent.SIGKEY.initSigKey(rand); err != nil {
+		return nil, err
+	}
+	up.UIDContent.PUBKEYS = make([]KeyEntry, len(msg.UIDContent.PUBKEYS))
+	for i, ke := range msg.UIDContent.PUBKEYS {
+		if err := up.UIDContent.PUBKEYS[i].initDHKey(ke.CIPHERSUITE, rand); err != nil {
+			return nil, err
+		}
+	}
+	up.UIDContent.SIGESCROW = new(KeyEntry)
+	if err := up.UIDContent.SIGESCROW.initSigKey(rand); err != nil {
+		return nil, err
+	}
+	if msg.UIDContent.MSGSIGKEY != nil {
+		up.UIDContent.MSGSIGKEY = new(KeyEntry)
+		if err := up.UIDContent.MSGSIGKEY.initSigKey(rand); err != nil {
+			return nil, err
+		}
+	}
+	if notAfter := uint64(times.OneYearLater()); msg.Renewable() &&
+		up.UIDContent.NOTAFTER < notAfter {
+		// renew validity (see Create)
+		up.UIDContent.NOTAFTER = notAfter
+	}
+	// self-signature
+	selfsig := up.UIDContent.SIGKEY.ed25519Key.Sign(up.UIDContent.JSON())
+	up.SELFSIGNATURE = base64.Encode(selfsig)
+	// sign with previous escrow key
+	escrowsig := escrow.ed25519Key.Sign(up.UIDContent.JSON())
+	up.ESCROWSIGNATURE = base64.Encode(escrowsig)
+	return &up, nil
+}
+
+// Link generates an updated version of the given UID message which links the
+// identity to the foreign key hashchain described by link (see
+// ChainLinkVersion), signs it with the private signature key, and returns it.
+// If link is authoritative, the key server has to sign the returned UID
+// message with SignLinkAuthority before it is registered. This also applies
+// to all later updates, because LINKAUTHORITY only covers one UIDContent.
+func (msg *Message) Link(link *ChainLink, rand io.Reader) (*Message, error) {
+	if err := link.check(); err != nil {
+		return nil, err
+	}
+	return msg.update(rand, false, nil, link, nil)
+}
+
+// AddCiphersuite generates an updated version of the given UID message which
+// contains a newly generated static key agreement key for ciphersuite (see
+// CiphersuitesVersion), signs it with the private signature key, and returns
+// it. The new ciphersuite becomes the most preferred one.
+func (msg *Message) AddCiphersuite(ciphersuite string, rand io.Reader) (*Message, error) {
+	if msg.IsTombstone() {
+		return nil, log.Error(ErrTombstone)
+	}
+	if msg.pubKeyIndex(ciphersuite) >= 0 {
+		return nil, log.Errorf("uid: UID message already contains a key for ciphersuite: %s",
+			ciphersuite)
+	}
+	var pubKey KeyEntry
+	if err := pubKey.initDHKey(ciphersuite, rand); err != nil {
+		return nil, err
+	}
+	return msg.update(rand, false, nil, nil, &pubKey)
+}
+
+// HasChainLink returns true, if the UID message links the identity to a
+// foreign key hashchain (see ChainLinkVersion).
+func (msg *Message) HasChainLink() bool {
+	return (msg.UIDContent.VERSION == ChainLinkVersion ||
+		msg.UIDContent.VERSION == CiphersuitesVersion) &&
+		msg.UIDContent.CHAINLINK != nil
+}
+
+// SignLinkAuthority signs the UID message msg with an authoritative chain link
+// with the private escrow key of the key server UID message srvMsg and sets
+// LINKAUTHORITY accordingly.
+func (msg *Message) SignLinkAuthority(srvMsg *Message) error {
+	if !msg.HasChainLink() || !msg.UIDContent.CHAINLINK.AUTHORITATIVE {
+		return log.Error("uid: UID message contains no authoritative chain link")
+	}
+	if srvMsg.PrivateSigEscrowKey() == "" {
+		return log.Error(ErrNoSigEscrow)
+	}
+	sig := srvMsg.UIDContent.SIGESCROW.ed25519Key.Sign(msg.UIDContent.JSON())
+	msg.LINKAUTHORITY = base64.Encode(sig)
+	return nil
+}
+
+// VerifyLinkAuthority verifies that LINKAUTHORITY of the UID message is a
+// valid signature by the escrow key of the key server UID message srvMsg.
+func (msg *Message) VerifyLinkAuthority(srvMsg *Message) error {
+	var ed25519Key cipher.Ed25519Key
+	if !srvMsg.HasSigEscrow() {
+		return log.Error(ErrNoSigEscrow)
+	}
+	// get content
+	content := msg.UIDContent.JSON()
+	// get link authority signature
+	sig, err := base64.Decode(msg.LINKAUTHORITY)
+	if err != nil {
+		return err
+	}
+	// create ed25519 key
+	pubKey, err := base64.Decode(srvMsg.UIDContent.SIGESCROW.PUBKEY)
+	if err != nil {
+		return err
+	}
+	if err := ed25519Key.SetPublicKey(pubKey); err != nil {
+		return err
+	}
+	// verify link authority signature
+	if !ed25519Key.Verify(content, sig) {
+		return log.Error(ErrInvalidLinkAuthority)
+	}
+	return nil
+}
+
+func (msg *Message) update(
+	rand io.Reader,
+	tombstone bool,
+	msgSigKey *KeyEntry,
+	link *ChainLink,
+	pubKey *KeyEntry,
+) (*Message, error) {
+	if msg.IsTombstone() {
+		return nil, log.Error(ErrTombstone)
+	}
 	var up Message
 	// copy
 	up = *msg
 	// increase counter
 	up.UIDContent.MSGCOUNT++
+	// the link authority only covers the previous UIDContent
+	up.LINKAUTHORITY = ""
+	// set message signing key (only contained in version 1.1, 1.2, and 1.3)
+	if msgSigKey != nil {
+		if up.UIDContent.VERSION == ProtocolVersion {
+			up.UIDContent.VERSION = MsgSigKeyVersion
+		}
+		up.UIDContent.MSGSIGKEY = msgSigKey
+	}
+	// set chain link (only contained in version 1.3 and 1.4)
+	if link != nil {
+		if up.UIDContent.VERSION != CiphersuitesVersion {
+			up.UIDContent.VERSION = ChainLinkVersion
+		}
+		l := *link
+		up.UIDContent.CHAINLINK = &l
+	}
 	// update signature key
 	if err := up.UIDContent.SIGKEY.initSigKey(rand); err != nil {
 		return nil, err
 	}
-	err := up.UIDContent.PUBKEYS[0].setPrivateKey(msg.UIDContent.PUBKEYS[0].PrivateKey32()[:])
-	if err != nil {
-		return nil, err
+	up.UIDContent.PUBKEYS = make([]KeyEntry, len(msg.UIDContent.PUBKEYS))
+	for i := range msg.UIDContent.PUBKEYS {
+		up.UIDContent.PUBKEYS[i] = msg.UIDContent.PUBKEYS[i]
+		err := up.UIDContent.PUBKEYS[i].setPrivateKey(msg.UIDContent.PUBKEYS[i].PrivateKey32()[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// add key for new ciphersuite (only contained in version 1.4)
+	if pubKey != nil {
+		up.UIDContent.VERSION = CiphersuitesVersion
+		up.UIDContent.PUBKEYS = append([]KeyEntry{*pubKey},
+			up.UIDContent.PUBKEYS...)
+		up.UIDContent.PREFERENCES.CIPHERSUITES = append(
+			[]string{pubKey.CIPHERSUITE}, msg.UIDContent.PREFERENCES.CIPHERSUITES...)
+	}
+	if tombstone {
+		now := uint64(times.Now())
+		up.UIDContent.NOTBEFORE = now
+		up.UIDContent.NOTAFTER = now
+		up.UIDContent.MIXADDRESS = ""
+		up.UIDContent.NYMADDRESS = ""
+	} else if notAfter := uint64(times.OneYearLater()); msg.Renewable() &&
+		up.UIDContent.NOTAFTER < notAfter {
+		// renew validity (see Create)
+		up.UIDContent.NOTAFTER = notAfter
 	}
 	// self-signature
 	selfsig := up.UIDContent.SIGKEY.ed25519Key.Sign(up.UIDContent.JSON())
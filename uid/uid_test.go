@@ -12,6 +12,7 @@ import (
 	"github.com/mutecomm/mute/cipher"
 	"github.com/mutecomm/mute/encode/base64"
 	"github.com/mutecomm/mute/keyserver/hashchain"
+	"github.com/mutecomm/mute/util/times"
 )
 
 func TestUIDMessage(t *testing.T) {
@@ -87,6 +88,461 @@ func TestIncrementCheck(t *testing.T) {
 	}
 }
 
+func TestUpdateRenews(t *testing.T) {
+	uid, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UID message which expires soon
+	uid.UIDContent.NOTAFTER = uint64(times.Now()) + 60
+	up, err := uid.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.NOTAFTER < uint64(times.OneYearLater())-60 {
+		t.Error("update did not renew NOTAFTER")
+	}
+	if err := up.VerifyUserSig(uid); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateWithValidity(t *testing.T) {
+	now := uint64(times.Now())
+	_, err := CreateWithValidity("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, now, now, cipher.RandReader)
+	if err != ErrInvalidTimes {
+		t.Error("should fail with ErrInvalidTimes")
+	}
+	_, err = CreateWithValidity("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, now+MinValidity-60, now, cipher.RandReader)
+	if err != ErrShortValidity {
+		t.Error("should fail with ErrShortValidity")
+	}
+	_, err = CreateWithValidity("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, now+MaxValidity+60, now, cipher.RandReader)
+	if err != ErrFuture {
+		t.Error("should fail with ErrFuture")
+	}
+	// short-lived user ID
+	uid, err := CreateWithValidity("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, now+MinValidity, now, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := uid.VerifySelfSig(); err != nil {
+		t.Fatal(err)
+	}
+	if uid.Renewable() {
+		t.Error("UID message with fixed validity should not be renewable")
+	}
+	up, err := uid.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.NOTAFTER != now+MinValidity ||
+		up.UIDContent.NOTBEFORE != now {
+		t.Error("update changed fixed validity")
+	}
+}
+
+func TestSigEscrow(t *testing.T) {
+	msg, err := Create("test@mute.berlin", true, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.UIDContent.VERSION != SigEscrowVersion {
+		t.Errorf("wrong version: %s", msg.UIDContent.VERSION)
+	}
+	if err := msg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	escrowKey := msg.PrivateSigEscrowKey()
+	if escrowKey == "" {
+		t.Fatal("private escrow key not set")
+	}
+	// updates keep the escrow key
+	up, err := msg.AddMsgSigKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.VERSION != SigEscrowVersion {
+		t.Errorf("wrong version after update: %s", up.UIDContent.VERSION)
+	}
+	if err := up.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// recover from public UID message
+	pub, err := NewJSON(string(up.JSON()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Create("other@mute.berlin", true, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pub.Recover(other.PrivateSigEscrowKey(), cipher.RandReader); err != ErrEscrowKeyMismatch {
+		t.Error("should fail with ErrEscrowKeyMismatch")
+	}
+	rec, err := pub.Recover(escrowKey, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := rec.VerifyEscrowSig(pub); err != nil {
+		t.Error(err)
+	}
+	if rec.USERSIGNATURE != "" {
+		t.Error("USERSIGNATURE should not be set")
+	}
+	if rec.UIDContent.SIGKEY.PUBKEY == pub.UIDContent.SIGKEY.PUBKEY ||
+		rec.UIDContent.SIGESCROW.PUBKEY == pub.UIDContent.SIGESCROW.PUBKEY ||
+		rec.UIDContent.MSGSIGKEY.PUBKEY == pub.UIDContent.MSGSIGKEY.PUBKEY {
+		t.Error("keys not renewed")
+	}
+	if rec.PrivateSigEscrowKey() == "" {
+		t.Error("new private escrow key not set")
+	}
+	// previous escrow key cannot authorize successor of recovered message
+	if err := rec.SetPrivateSigEscrowKey(escrowKey); err != ErrEscrowKeyMismatch {
+		t.Error("should fail with ErrEscrowKeyMismatch")
+	}
+	// UID messages without escrow key cannot be recovered
+	plain, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Recover(escrowKey, cipher.RandReader); err != ErrNoSigEscrow {
+		t.Error("should fail with ErrNoSigEscrow")
+	}
+	if err := rec.VerifyEscrowSig(plain); err != ErrIncrement {
+		t.Error("should fail with ErrIncrement")
+	}
+}
+
+func TestChainLink(t *testing.T) {
+	msg, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &ChainLink{
+		URI:      []string{"mute.one"},
+		LAST:     hashchain.TestEntry,
+		DOMAINS:  []string{"mute.one"},
+		IDENTITY: "test@mute.one",
+	}
+	if _, err := msg.Link(&ChainLink{}, cipher.RandReader); err == nil {
+		t.Error("should fail with incomplete chain link")
+	}
+	up, err := msg.Link(link, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.VERSION != ChainLinkVersion || !up.HasChainLink() {
+		t.Errorf("wrong version: %s", up.UIDContent.VERSION)
+	}
+	if err := up.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.VerifyUserSig(msg); err != nil {
+		t.Error(err)
+	}
+	// chain link is kept across updates
+	up2, err := up.AddMsgSigKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up2.UIDContent.VERSION != ChainLinkVersion || !up2.HasChainLink() {
+		t.Error("chain link not kept")
+	}
+	if err := up2.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// LINKAUTHORITY must be zero for non-authoritative links
+	up2.LINKAUTHORITY = up2.SELFSIGNATURE
+	if err := up2.Check(); err == nil {
+		t.Error("should fail with LINKAUTHORITY set")
+	}
+	// CHAINLINK must be zero-value in other versions
+	msg.UIDContent.CHAINLINK = link
+	if err := msg.Check(); err == nil {
+		t.Error("should fail with CHAINLINK set in version 1.0")
+	}
+}
+
+func TestLinkAuthority(t *testing.T) {
+	srv, err := Create("keyserver@mute.berlin", true, "", "", Strict, "",
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := msg.Link(&ChainLink{
+		URI:           []string{"mute.one"},
+		LAST:          hashchain.TestEntry,
+		AUTHORITATIVE: true,
+		DOMAINS:       []string{"mute.one"},
+		IDENTITY:      "test@mute.one",
+	}, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.SignLinkAuthority(srv); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.VerifyLinkAuthority(srv); err != nil {
+		t.Error(err)
+	}
+	// verification only works with the escrow key of the key server
+	other, err := Create("keyserver@mute.one", true, "", "", Strict, "",
+		cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.VerifyLinkAuthority(other); err != ErrInvalidLinkAuthority {
+		t.Error("should fail with ErrInvalidLinkAuthority")
+	}
+	// updates have to be signed again
+	up2, err := up.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up2.LINKAUTHORITY != "" {
+		t.Error("LINKAUTHORITY should be reset by updates")
+	}
+	// only authoritative links can be signed
+	if err := msg.SignLinkAuthority(srv); err == nil {
+		t.Error("should fail without chain link")
+	}
+}
+
+func TestCiphersuites(t *testing.T) {
+	// register additional ciphersuite for testing
+	const testCiphersuite = "TEST HKDF AES256-CTR SHA512-HMAC ED25519 ECDHE25519"
+	if err := RegisterCiphersuite(testCiphersuite, "ECDHE25519"); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(ciphersuites, testCiphersuite)
+	if err := RegisterCiphersuite(testCiphersuite, "ECDHE25519"); err == nil {
+		t.Error("should fail with registered ciphersuite")
+	}
+	if cs := Ciphersuites(); len(cs) != 2 || cs[0] != DefaultCiphersuite {
+		t.Errorf("wrong ciphersuites: %v", cs)
+	}
+
+	alice, err := Create("alice@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Create("bob@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.AddCiphersuite("UNKNOWN", cipher.RandReader); err == nil {
+		t.Error("should fail with unknown ciphersuite")
+	}
+	if _, err := bob.AddCiphersuite(DefaultCiphersuite, cipher.RandReader); err == nil {
+		t.Error("should fail with existing ciphersuite")
+	}
+	bob2, err := bob.AddCiphersuite(testCiphersuite, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob2.UIDContent.VERSION != CiphersuitesVersion {
+		t.Errorf("wrong version: %s", bob2.UIDContent.VERSION)
+	}
+	if err := bob2.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob2.VerifyUserSig(bob); err != nil {
+		t.Error(err)
+	}
+	if len(bob2.UIDContent.PUBKEYS) != 2 ||
+		bob2.UIDContent.PREFERENCES.CIPHERSUITES[0] != testCiphersuite {
+		t.Error("new ciphersuite should be most preferred")
+	}
+	// the default key is kept
+	if bob2.PubHash() != bob.PubHash() {
+		t.Error("default key changed")
+	}
+	ke, err := bob2.PubKeyFor(testCiphersuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ke.HASH == bob2.PubHash() {
+		t.Error("keys for different ciphersuites must differ")
+	}
+	// negotiation
+	cs, err := Negotiate(alice, bob2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs != DefaultCiphersuite {
+		t.Errorf("wrong ciphersuite negotiated: %s", cs)
+	}
+	alice2, err := alice.AddCiphersuite(testCiphersuite, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err = Negotiate(alice2, bob2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs != testCiphersuite {
+		t.Errorf("wrong ciphersuite negotiated: %s", cs)
+	}
+	// all keys are kept across updates
+	bob3, err := bob2.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob3.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !KeyEntryEqual(&bob3.UIDContent.PUBKEYS[0], &bob2.UIDContent.PUBKEYS[0]) {
+		t.Error("keys not kept")
+	}
+	// unsupported ciphersuites are rejected
+	delete(ciphersuites, testCiphersuite)
+	if err := bob3.Check(); err == nil {
+		t.Error("should fail with unsupported ciphersuite")
+	}
+	if _, err := Negotiate(alice2, bob2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	uid, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid.IsTombstone() {
+		t.Error("new UID should not be a tombstone")
+	}
+	ts, err := uid.Tombstone(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.IsTombstone() {
+		t.Error("tombstone not detected")
+	}
+	if err := ts.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := ts.VerifyUserSig(uid); err != nil {
+		t.Error(err)
+	}
+	if _, err := ts.Update(cipher.RandReader); err != ErrTombstone {
+		t.Error("updating a tombstone should fail")
+	}
+}
+
+func TestMsgSigKey(t *testing.T) {
+	uid, err := Create("test@mute.berlin", false, "", "", Strict,
+		hashchain.TestEntry, cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid.HasMsgSigKey() {
+		t.Error("version 1.0 UID should not have a message signing key")
+	}
+	if *uid.MsgSigPubKey32() != *uid.PublicSigKey32() {
+		t.Error("message signing key should default to signature key")
+	}
+	up, err := uid.AddMsgSigKey(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UIDContent.VERSION != MsgSigKeyVersion {
+		t.Errorf("wrong version: %s", up.UIDContent.VERSION)
+	}
+	if err := up.Check(); err != nil {
+		t.Error(err)
+	}
+	if err := up.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := up.VerifyUserSig(uid); err != nil {
+		t.Error(err)
+	}
+	if _, err := up.AddMsgSigKey(cipher.RandReader); err == nil {
+		t.Error("should fail")
+	}
+	msgSigPubKey := *up.MsgSigPubKey32()
+	if msgSigPubKey == *up.PublicSigKey32() {
+		t.Error("message signing key should differ from signature key")
+	}
+	privkey := up.PrivateMsgSigKey()
+	// JSON round trip
+	jsnUID, err := NewJSON(string(up.JSON()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(up.JSON(), jsnUID.JSON()) {
+		t.Error("UIDs differ")
+	}
+	if err := jsnUID.VerifySelfSig(); err != nil {
+		t.Error(err)
+	}
+	if err := jsnUID.SetPrivateMsgSigKey(privkey); err != nil {
+		t.Fatal(err)
+	}
+	if *jsnUID.PrivateMsgSigKey64() != *up.PrivateMsgSigKey64() {
+		t.Error("private message signing keys differ")
+	}
+	// message signing key is kept across updates
+	up2, err := up.Update(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up2.Check(); err != nil {
+		t.Error(err)
+	}
+	if *up2.MsgSigPubKey32() != msgSigPubKey {
+		t.Error("message signing key changed with update")
+	}
+	if *up2.PublicSigKey32() == *up.PublicSigKey32() {
+		t.Error("signature key not rotated with update")
+	}
+	// version 1.0 must not contain message signing key
+	up2.UIDContent.VERSION = ProtocolVersion
+	if err := up2.Check(); err == nil {
+		t.Error("should fail")
+	}
+	// version 1.1 must contain message signing key
+	uid.UIDContent.VERSION = MsgSigKeyVersion
+	if err := uid.Check(); err == nil {
+		t.Error("should fail")
+	}
+	if err := uid.SetPrivateMsgSigKey(privkey); err == nil {
+		t.Error("should fail")
+	}
+}
+
 func TestSelfSig(t *testing.T) {
 	uid, err := Create("test@mute.berlin", false, "", "", Strict,
 		hashchain.TestEntry, cipher.RandReader)
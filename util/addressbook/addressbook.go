@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package addressbook reads address books exported by other applications in
+// vCard or CSV format.
+package addressbook
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Address book formats.
+const (
+	FormatVCard = "vcard"
+	FormatCSV   = "csv"
+)
+
+// Entry is an address book entry.
+type Entry struct {
+	Name      string   // full name (can be empty)
+	Addresses []string // email addresses
+}
+
+// Read reads all entries from the address book r with the given format.
+func Read(format string, r io.Reader) ([]*Entry, error) {
+	switch format {
+	case FormatVCard:
+		return ReadVCard(r)
+	case FormatCSV:
+		return ReadCSV(r)
+	default:
+		return nil, fmt.Errorf("addressbook: unknown format '%s'", format)
+	}
+}
+
+// unfold reads the content lines from r and unfolds them (RFC 6350).
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 &&
+			(strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// unescape unescapes a vCard text value.
+var unescape = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ",
+	`\\`, `\`)
+
+// ReadVCard reads all entries from the vCard file r (versions 2.1, 3.0, and
+// 4.0). Only the properties FN (or N) and EMAIL are used.
+func ReadVCard(r io.Reader) ([]*Entry, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entries []*Entry
+		entry   *Entry
+		n       string
+	)
+	for i, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("addressbook: line %d: no ':'", i+1)
+		}
+		// remove group and parameters
+		name := strings.SplitN(parts[0], ";", 2)[0]
+		if j := strings.LastIndex(name, "."); j >= 0 {
+			name = name[j+1:]
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if entry != nil {
+				return nil, fmt.Errorf("addressbook: line %d: nested vCard", i+1)
+			}
+			entry = new(Entry)
+			n = ""
+		case "END":
+			if entry == nil {
+				return nil, fmt.Errorf("addressbook: line %d: END without BEGIN", i+1)
+			}
+			if entry.Name == "" {
+				entry.Name = n
+			}
+			entries = append(entries, entry)
+			entry = nil
+		case "FN":
+			if entry != nil {
+				entry.Name = unescape.Replace(value)
+			}
+		case "N":
+			// family;given;additional;prefixes;suffixes
+			if entry != nil {
+				f := strings.Split(value, ";")
+				if len(f) > 1 {
+					n = strings.TrimSpace(unescape.Replace(f[1]) + " " +
+						unescape.Replace(f[0]))
+				}
+			}
+		case "EMAIL":
+			if entry != nil && value != "" {
+				entry.Addresses = append(entry.Addresses, value)
+			}
+		}
+	}
+	if entry != nil {
+		return nil, fmt.Errorf("addressbook: vCard without END")
+	}
+	return entries, nil
+}
+
+// csvColumn returns the index of the first column in header which contains
+// one of the given names (case-insensitive) or -1.
+func csvColumn(header []string, names ...string) int {
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		for _, name := range names {
+			if strings.Contains(column, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ReadCSV reads all entries from the CSV file r. The first line must be a
+// header which names the columns. Columns containing "mail" are email
+// addresses, the name is taken from the first column containing "name"
+// (or from the columns containing "first" and "last").
+func ReadCSV(r io.Reader) ([]*Entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var addrColumns []int
+	for i, column := range header {
+		if strings.Contains(strings.ToLower(column), "mail") {
+			addrColumns = append(addrColumns, i)
+		}
+	}
+	if len(addrColumns) == 0 {
+		return nil, fmt.Errorf("addressbook: CSV header has no email column")
+	}
+	nameColumn := csvColumn(header, "full name", "display name", "name")
+	firstColumn := csvColumn(header, "first", "given")
+	lastColumn := csvColumn(header, "last", "family")
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	var entries []*Entry
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var entry Entry
+		for _, i := range addrColumns {
+			if addr := field(record, i); addr != "" {
+				entry.Addresses = append(entry.Addresses, addr)
+			}
+		}
+		if len(entry.Addresses) == 0 {
+			continue
+		}
+		if firstColumn >= 0 || lastColumn >= 0 {
+			entry.Name = strings.TrimSpace(field(record, firstColumn) + " " +
+				field(record, lastColumn))
+		}
+		if name := field(record, nameColumn); name != "" && nameColumn != firstColumn &&
+			nameColumn != lastColumn {
+			entry.Name = name
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package addressbook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testVCard = `BEGIN:VCARD
+VERSION:3.0
+N:Doe;Alice;;;
+FN:Alice Doe
+EMAIL;TYPE=INTERNET:alice@mute.berlin
+item1.EMAIL;TYPE=INTERNET:alice@example.com
+END:VCARD
+BEGIN:VCARD
+VERSION:4.0
+N:Builder;Bob;;;
+EMAIL:bob@mute.
+ berlin
+END:VCARD
+BEGIN:VCARD
+VERSION:2.1
+FN:Nobody
+END:VCARD
+`
+
+func TestReadVCard(t *testing.T) {
+	entries, err := Read(FormatVCard, strings.NewReader(testVCard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Entry{
+		{
+			Name:      "Alice Doe",
+			Addresses: []string{"alice@mute.berlin", "alice@example.com"},
+		},
+		{
+			Name:      "Bob Builder",
+			Addresses: []string{"bob@mute.berlin"},
+		},
+		{
+			Name: "Nobody",
+		},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("wrong entries: %v", entries)
+	}
+	for _, vcard := range []string{
+		"BEGIN:VCARD\nFN:Alice\n",
+		"END:VCARD\n",
+		"BEGIN:VCARD\nBEGIN:VCARD\n",
+		"BEGIN:VCARD\nFN Alice\nEND:VCARD\n",
+	} {
+		if _, err := ReadVCard(strings.NewReader(vcard)); err == nil {
+			t.Errorf("%q should fail", vcard)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	csv := "First Name,Last Name,E-mail Address,Home Address\n" +
+		"Alice,Doe,alice@mute.berlin,Berlin\n" +
+		"Carol,,,Hamburg\n" +
+		"Bob,,bob@mute.berlin,\n"
+	entries, err := Read(FormatCSV, strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Entry{
+		{Name: "Alice Doe", Addresses: []string{"alice@mute.berlin"}},
+		{Name: "Bob", Addresses: []string{"bob@mute.berlin"}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("wrong entries: %v", entries)
+	}
+	entries, err = ReadCSV(strings.NewReader("Name,Email\n\"Doe, Alice\",alice@mute.berlin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "Doe, Alice" {
+		t.Errorf("wrong entries: %v", entries)
+	}
+	if _, err := ReadCSV(strings.NewReader("Name,Phone\n")); err == nil {
+		t.Error("CSV without email column should fail")
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := Read("ldif", strings.NewReader("")); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
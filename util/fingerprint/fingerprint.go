@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fingerprint implements human readable fingerprints of the signature
+// key hash (SIGKEYHASH) of a UID message and short authentication strings for
+// pairs of them, suitable for out-of-band comparison (e.g., over the phone or
+// by scanning a QR code of the verification URI).
+package fingerprint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+)
+
+// Size is the number of bytes of the SIGKEYHASH shown in a fingerprint.
+const Size = 20
+
+// SASGroups is the number of five digit groups of a short authentication
+// string.
+const SASGroups = 6
+
+// URIScheme is the scheme of verification URIs.
+const URIScheme = "mute"
+
+func decode(sigKeyHash string) ([]byte, error) {
+	hash, err := base64.Decode(sigKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) < Size {
+		return nil, log.Errorf("fingerprint: hash too short (%d bytes)", len(hash))
+	}
+	return hash, nil
+}
+
+// New returns the fingerprint of sigKeyHash: the first Size bytes as
+// uppercase hex digits in groups of four, e.g. "A1B2 C3D4 ...".
+func New(sigKeyHash string) (string, error) {
+	hash, err := decode(sigKeyHash)
+	if err != nil {
+		return "", err
+	}
+	groups := make([]string, 0, Size/2)
+	for i := 0; i < Size; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02X%02X", hash[i], hash[i+1]))
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// SAS returns the short authentication string of the two signature key
+// hashes a and b: SASGroups groups of five decimal digits. The result does
+// not depend on the order of a and b, both parties compute the same string.
+func SAS(a, b string) (string, error) {
+	hashA, err := decode(a)
+	if err != nil {
+		return "", err
+	}
+	hashB, err := decode(b)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Compare(hashA, hashB) > 0 {
+		hashA, hashB = hashB, hashA
+	}
+	sum := cipher.SHA512(append(append([]byte{}, hashA...), hashB...))
+	groups := make([]string, 0, SASGroups)
+	for i := 0; i < SASGroups; i++ {
+		n := binary.BigEndian.Uint32(sum[i*4:])
+		groups = append(groups, fmt.Sprintf("%05d", n%100000))
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// URI returns the verification URI of identity with sigKeyHash. It contains
+// only characters which can be encoded in a QR code.
+func URI(identity, sigKeyHash string) string {
+	v := url.Values{}
+	v.Set("id", identity)
+	v.Set("sigkeyhash", sigKeyHash)
+	return URIScheme + ":verify?" + v.Encode()
+}
+
+// ParseURI parses a verification URI created by URI.
+func ParseURI(uri string) (identity, sigKeyHash string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", log.Error(err)
+	}
+	if u.Scheme != URIScheme || u.Opaque != "verify" {
+		return "", "", log.Errorf("fingerprint: not a verification URI: %s", uri)
+	}
+	v := u.Query()
+	identity = v.Get("id")
+	sigKeyHash = v.Get("sigkeyhash")
+	if identity == "" || sigKeyHash == "" {
+		return "", "", log.Errorf("fingerprint: incomplete verification URI: %s", uri)
+	}
+	if _, err := decode(sigKeyHash); err != nil {
+		return "", "", err
+	}
+	return identity, sigKeyHash, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fingerprint
+
+import (
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+)
+
+func TestFingerprint(t *testing.T) {
+	a := base64.Encode(cipher.SHA512([]byte("alice@mute.berlin")))
+	b := base64.Encode(cipher.SHA512([]byte("bob@mute.berlin")))
+	fa, err := New(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fa) != Size*2+Size/2-1 {
+		t.Errorf("wrong fingerprint length: %s", fa)
+	}
+	fb, err := New(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fa == fb {
+		t.Error("fingerprints equal for different hashes")
+	}
+	if _, err := New(base64.Encode([]byte("short"))); err == nil {
+		t.Error("New() should fail for short hash")
+	}
+}
+
+func TestSAS(t *testing.T) {
+	a := base64.Encode(cipher.SHA512([]byte("alice@mute.berlin")))
+	b := base64.Encode(cipher.SHA512([]byte("bob@mute.berlin")))
+	c := base64.Encode(cipher.SHA512([]byte("carol@mute.berlin")))
+	ab, err := SAS(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := SAS(b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab != ba {
+		t.Error("SAS depends on order")
+	}
+	if len(ab) != SASGroups*6-1 {
+		t.Errorf("wrong SAS length: %s", ab)
+	}
+	ac, err := SAS(a, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab == ac {
+		t.Error("SAS equal for different hashes")
+	}
+}
+
+func TestURI(t *testing.T) {
+	a := base64.Encode(cipher.SHA512([]byte("alice@mute.berlin")))
+	uri := URI("alice@mute.berlin", a)
+	id, sigKeyHash, err := ParseURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "alice@mute.berlin" || sigKeyHash != a {
+		t.Errorf("wrong URI roundtrip: %s, %s", id, sigKeyHash)
+	}
+	if _, _, err := ParseURI("https://mute.berlin"); err == nil {
+		t.Error("ParseURI() should fail for other schemes")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package home determines the home directories used by all Mute binaries.
+//
+// The home directory is chosen in the following order:
+//
+//  1. the --homedir option;
+//  2. the environment variable MUTEHOME;
+//  3. the directory next to the binary in portable mode (option --portable
+//     or environment variable MUTEPORTABLE);
+//  4. the platform default (see AppDataDir).
+//
+// The log directory is chosen analogously (option --logdir, environment
+// variable MUTELOGDIR), it defaults to the subdirectory "log" of the home
+// directory (see ApplyDirs).
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	cchome "github.com/frankbraun/codechain/util/home"
+	"github.com/mutecomm/mute/log"
+	"github.com/urfave/cli"
+)
+
+// Environment variables honored by all Mute binaries.
+const (
+	HomeDirEnv    = "MUTEHOME"       // overrides the home directory
+	LogDirEnv     = "MUTELOGDIR"     // overrides the log directory
+	PortableEnv   = "MUTEPORTABLE"   // enables portable mode
+	LogRotateEnv  = "MUTELOGROTATE"  // sets the log rotation period
+	LogMaxSizeEnv = "MUTELOGMAXSIZE" // sets the maximum log file size in MB
+	LogRetainEnv  = "MUTELOGRETAIN"  // sets the number of rotated log files
+	LogUnsafeEnv  = "MUTELOGUNSAFE"  // disables the redaction of sensitive values
+)
+
+// PortableDirName is the name of the directory next to the binary which is
+// used as home directory in portable mode.
+const PortableDirName = "mutedata"
+
+// PortableFlag defines the standard --portable flag.
+var PortableFlag = cli.BoolFlag{
+	Name:   "portable",
+	Usage:  "store all data next to the binary (portable mode)",
+	EnvVar: PortableEnv,
+}
+
+// LogRotateFlag defines the standard --logrotate flag.
+var LogRotateFlag = cli.StringFlag{
+	Name:   "logrotate",
+	Value:  log.DefaultRotation.Period,
+	Usage:  "rotate log file by {size, daily}",
+	EnvVar: LogRotateEnv,
+}
+
+// LogMaxSizeFlag defines the standard --logmaxsize flag.
+var LogMaxSizeFlag = cli.IntFlag{
+	Name:   "logmaxsize",
+	Value:  int(log.DefaultRotation.MaxSize / (1024 * 1024)),
+	Usage:  "maximum log file size in MB (rotation by size)",
+	EnvVar: LogMaxSizeEnv,
+}
+
+// LogRetainFlag defines the standard --logretain flag.
+var LogRetainFlag = cli.IntFlag{
+	Name:   "logretain",
+	Value:  log.DefaultRotation.MaxRolls,
+	Usage:  "number of rotated log files to keep",
+	EnvVar: LogRetainEnv,
+}
+
+// LogUnsafeFlag defines the standard --log-unsafe flag.
+var LogUnsafeFlag = cli.BoolFlag{
+	Name:   "log-unsafe",
+	Usage:  "log sensitive values (keys, hashes) unredacted, only for debugging!",
+	EnvVar: LogUnsafeEnv,
+}
+
+// SetLogOptions sets the log rotation defined by the global flags
+// --logrotate, --logmaxsize, and --logretain and the redaction of sensitive
+// values (--log-unsafe) and exports them to the environment of subprocesses.
+func SetLogOptions(c *cli.Context) error {
+	r := log.Rotation{
+		Period:   c.GlobalString("logrotate"),
+		MaxSize:  int64(c.GlobalInt("logmaxsize")) * 1024 * 1024,
+		MaxRolls: c.GlobalInt("logretain"),
+	}
+	if err := log.SetRotation(r); err != nil {
+		return err
+	}
+	log.SetUnsafe(c.GlobalBool("log-unsafe"))
+	env := map[string]string{
+		LogRotateEnv:  r.Period,
+		LogMaxSizeEnv: strconv.Itoa(c.GlobalInt("logmaxsize")),
+		LogRetainEnv:  strconv.Itoa(r.MaxRolls),
+		LogUnsafeEnv:  strconv.FormatBool(c.GlobalBool("log-unsafe")),
+	}
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appDataDir returns the default home directory for appName on the operating
+// system goos. On Linux and other Unix systems (except Darwin) the XDG base
+// directory $XDG_CONFIG_HOME/appName is used, if XDG_CONFIG_HOME is set to an
+// absolute path and the directory ~/.config/appName of earlier versions does
+// not exist. All other cases use the default of codechain's home package
+// (~/.config/appName on Unix, %LOCALAPPDATA% or %APPDATA% on Windows, and
+// ~/Library/Application Support/AppName on Darwin).
+func appDataDir(goos, appName string, roaming bool) string {
+	legacy := cchome.AppDataDir(appName, roaming)
+	switch goos {
+	case "windows", "darwin", "plan9":
+		return legacy
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" || !filepath.IsAbs(configHome) {
+		return legacy
+	}
+	dir := filepath.Join(configHome, appName)
+	if dir != legacy {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if _, err := os.Stat(legacy); err == nil {
+				return legacy
+			}
+		}
+	}
+	return dir
+}
+
+// AppDataDir returns the default home directory for appName on the current
+// operating system. The roaming parameter is only used on Windows, where it
+// selects %APPDATA% instead of %LOCALAPPDATA%.
+func AppDataDir(appName string, roaming bool) string {
+	return appDataDir(runtime.GOOS, appName, roaming)
+}
+
+// PortableDir returns the home directory used in portable mode, the
+// directory PortableDirName next to the running binary.
+func PortableDir() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", log.Error(err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", log.Error(err)
+	}
+	return filepath.Join(filepath.Dir(exe), PortableDirName), nil
+}
+
+// ApplyDirs resolves the global directory options of c. If the home
+// directory has been set explicitly (option --homedir or environment variable
+// MUTEHOME), or portable mode is enabled, the options logdir and datadir
+// default to the subdirectories "log" and dataSubdir of that home directory.
+// In portable mode homedir defaults to PortableDir. Options which have been
+// set explicitly are left untouched and undefined options are ignored.
+func ApplyDirs(c *cli.Context, dataSubdir string) error {
+	var (
+		dir     string
+		homedir bool
+	)
+	flags := c.GlobalFlagNames()
+	for _, name := range flags {
+		if name == "homedir" {
+			homedir = true
+		}
+	}
+	if homedir && c.GlobalIsSet("homedir") {
+		dir = c.GlobalString("homedir")
+	} else if c.GlobalBool(PortableFlag.Name) {
+		var err error
+		dir, err = PortableDir()
+		if err != nil {
+			return err
+		}
+	} else {
+		dir = os.Getenv(HomeDirEnv)
+	}
+	if dir == "" {
+		return nil
+	}
+	dirs := map[string]string{
+		"homedir": dir,
+		"logdir":  filepath.Join(dir, "log"),
+		"datadir": filepath.Join(dir, dataSubdir),
+	}
+	for _, name := range flags {
+		value, ok := dirs[name]
+		if !ok || c.GlobalIsSet(name) {
+			continue
+		}
+		if err := c.GlobalSet(name, value); err != nil {
+			return log.Error(err)
+		}
+	}
+	return nil
+}
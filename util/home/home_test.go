@@ -0,0 +1,160 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cchome "github.com/frankbraun/codechain/util/home"
+	"github.com/urfave/cli"
+)
+
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestAppDataDirXDG(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "home_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	defer setenv("XDG_CONFIG_HOME", "")()
+	legacy := cchome.AppDataDir("mute", false)
+
+	// XDG_CONFIG_HOME not set
+	dir := appDataDir("linux", "mute", false)
+	if dir != legacy {
+		t.Errorf("appDataDir() = %s, expected %s", dir, legacy)
+	}
+
+	// relative XDG_CONFIG_HOME is ignored
+	defer setenv("XDG_CONFIG_HOME", "config")()
+	dir = appDataDir("linux", "mute", false)
+	if dir != legacy {
+		t.Errorf("appDataDir() = %s, expected %s", dir, legacy)
+	}
+
+	// XDG_CONFIG_HOME set
+	defer setenv("XDG_CONFIG_HOME", tmpdir)()
+	dir = appDataDir("linux", "mute", false)
+	if _, err := os.Stat(legacy); err == nil {
+		// legacy directory exists and is preferred
+		if dir != legacy {
+			t.Errorf("appDataDir() = %s, expected %s", dir, legacy)
+		}
+	} else {
+		exp := filepath.Join(tmpdir, "mute")
+		if dir != exp {
+			t.Errorf("appDataDir() = %s, expected %s", dir, exp)
+		}
+	}
+
+	// existing XDG directory is always used
+	if err := os.Mkdir(filepath.Join(tmpdir, "mute"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dir = appDataDir("linux", "mute", false)
+	exp := filepath.Join(tmpdir, "mute")
+	if dir != exp {
+		t.Errorf("appDataDir() = %s, expected %s", dir, exp)
+	}
+
+	// other operating systems are not affected
+	dir = appDataDir("windows", "mute", false)
+	if dir != legacy {
+		t.Errorf("appDataDir() = %s, expected %s", dir, legacy)
+	}
+}
+
+func TestApplyDirs(t *testing.T) {
+	defer setenv(PortableEnv, "")()
+	defer setenv(HomeDirEnv, "")()
+	portable, err := PortableDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var homedir, logdir string
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "homedir",
+			Value:  "default",
+			EnvVar: HomeDirEnv,
+		},
+		cli.StringFlag{
+			Name:  "logdir",
+			Value: "default",
+		},
+		PortableFlag,
+	}
+	app.Before = func(c *cli.Context) error {
+		return ApplyDirs(c, "")
+	}
+	app.Action = func(c *cli.Context) {
+		homedir = c.GlobalString("homedir")
+		logdir = c.GlobalString("logdir")
+	}
+
+	// portable mode disabled
+	if err := app.Run([]string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+	if homedir != "default" || logdir != "default" {
+		t.Errorf("unexpected directories: %s, %s", homedir, logdir)
+	}
+
+	// portable mode enabled
+	if err := app.Run([]string{"test", "--portable"}); err != nil {
+		t.Fatal(err)
+	}
+	if homedir != portable {
+		t.Errorf("homedir = %s, expected %s", homedir, portable)
+	}
+	if logdir != filepath.Join(portable, "log") {
+		t.Errorf("logdir = %s, expected %s", logdir,
+			filepath.Join(portable, "log"))
+	}
+
+	// explicit options take precedence
+	if err := app.Run([]string{"test", "--portable", "--logdir", "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if homedir != portable || logdir != "x" {
+		t.Errorf("unexpected directories: %s, %s", homedir, logdir)
+	}
+
+	// logdir follows explicit homedir
+	if err := app.Run([]string{"test", "--homedir", "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if homedir != "x" || logdir != filepath.Join("x", "log") {
+		t.Errorf("unexpected directories: %s, %s", homedir, logdir)
+	}
+
+	// environment variables take precedence over portable mode
+	defer setenv(HomeDirEnv, "env")()
+	if err := app.Run([]string{"test", "--portable"}); err != nil {
+		t.Fatal(err)
+	}
+	if homedir != "env" || logdir != filepath.Join("env", "log") {
+		t.Errorf("unexpected directories: %s, %s", homedir, logdir)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package identicon implements deterministic identicons which are derived
+// from the signature key hash (SIGKEYHASH) of a UID message. They give every
+// frontend a consistent visual representation of a key fingerprint.
+//
+// An identicon of the default generator encodes only 39 bits of the hash (24
+// bits color and 15 bits cells), similar identicons can be found for other
+// keys with moderate effort. Identicons are therefore a visual aid only and
+// must always be shown together with the full hash (see Identicon.Hash),
+// which has to be compared to verify a key.
+package identicon
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+)
+
+// GridSize is the number of cells per row and column of an identicon.
+const GridSize = 5
+
+// HashSize is the minimum size of the hash an identicon is generated from.
+const HashSize = 8
+
+// Identicon is a horizontally symmetric grid of cells drawn in a single
+// foreground color on a white background.
+type Identicon struct {
+	Cells [GridSize][GridSize]bool // Cells[y][x] is set, if the cell is drawn
+	Color color.RGBA               // foreground color
+	Hash  string                   // base64 encoded hash (set by New)
+}
+
+// Generator generates identicons from hashes. Frontends can plug in their own
+// generator by setting DefaultGenerator.
+type Generator interface {
+	// Generate returns the identicon for the given hash, which is at least
+	// HashSize bytes long.
+	Generate(hash []byte) *Identicon
+}
+
+// DefaultGenerator is the generator used by New.
+var DefaultGenerator Generator = GridGenerator{}
+
+// GridGenerator is the default identicon generator. The first three bytes of
+// the hash determine the color, the following bits the (mirrored) cells.
+type GridGenerator struct{}
+
+// Generate implements Generator.
+func (GridGenerator) Generate(hash []byte) *Identicon {
+	var ic Identicon
+	ic.Color = hslToRGB(float64(uint16(hash[0])<<8|uint16(hash[1]))/65536,
+		0.45+float64(hash[2]%32)/100, 0.45)
+	bits := hash[3:]
+	half := (GridSize + 1) / 2
+	for i := 0; i < GridSize*half; i++ {
+		y := i / half
+		x := i % half
+		set := bits[i/8]&(1<<uint(i%8)) != 0
+		ic.Cells[y][x] = set
+		ic.Cells[y][GridSize-1-x] = set
+	}
+	return &ic
+}
+
+// hslToRGB converts the color given by hue h, saturation s, and lightness l
+// (all in the range [0,1)) to RGB.
+func hslToRGB(h, s, l float64) color.RGBA {
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		} else if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+	return color.RGBA{R: hue(h + 1.0/3), G: hue(h), B: hue(h - 1.0/3), A: 0xff}
+}
+
+// New returns the identicon for the base64 encoded sigKeyHash, generated
+// with DefaultGenerator.
+func New(sigKeyHash string) (*Identicon, error) {
+	hash, err := base64.Decode(sigKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) < HashSize {
+		return nil, log.Errorf("identicon: hash too short (%d bytes)", len(hash))
+	}
+	ic := DefaultGenerator.Generate(hash)
+	ic.Hash = sigKeyHash
+	return ic, nil
+}
+
+// layout returns the cell size and margin for an identicon of the given size
+// (in pixels). The margin is half a cell.
+func layout(size int) (cell, margin int, err error) {
+	cell = size / (GridSize + 1)
+	if cell < 1 {
+		return 0, 0, log.Errorf("identicon: size %d too small", size)
+	}
+	margin = (size - cell*GridSize) / 2
+	return cell, margin, nil
+}
+
+// Image returns the identicon as a square image of the given size (in
+// pixels).
+func (ic *Identicon) Image(size int) (image.Image, error) {
+	cell, margin, err := layout(size)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			img.SetRGBA(px, py, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+		}
+	}
+	for y := 0; y < GridSize; y++ {
+		for x := 0; x < GridSize; x++ {
+			if !ic.Cells[y][x] {
+				continue
+			}
+			for py := margin + y*cell; py < margin+(y+1)*cell; py++ {
+				for px := margin + x*cell; px < margin+(x+1)*cell; px++ {
+					img.SetRGBA(px, py, ic.Color)
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+// PNG writes the identicon as PNG image of the given size (in pixels) to w.
+func (ic *Identicon) PNG(w io.Writer, size int) error {
+	img, err := ic.Image(size)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(w, img); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// SVG writes the identicon as SVG image of the given size (in pixels) to w.
+// The full hash is contained as title of the image.
+func (ic *Identicon) SVG(w io.Writer, size int) error {
+	cell, margin, err := layout(size)
+	if err != nil {
+		return err
+	}
+	fill := fmt.Sprintf("#%02x%02x%02x", ic.Color.R, ic.Color.G, ic.Color.B)
+	_, err = fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" "+
+		"width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		size, size, size, size)
+	if err != nil {
+		return log.Error(err)
+	}
+	if ic.Hash != "" {
+		// base64 does not contain characters which have to be escaped
+		_, err := fmt.Fprintf(w, "<title>SIGKEYHASH %s</title>\n", ic.Hash)
+		if err != nil {
+			return log.Error(err)
+		}
+	}
+	_, err = fmt.Fprintf(w, "<rect width=\"%d\" height=\"%d\" fill=\"#ffffff\"/>\n",
+		size, size)
+	if err != nil {
+		return log.Error(err)
+	}
+	for y := 0; y < GridSize; y++ {
+		for x := 0; x < GridSize; x++ {
+			if !ic.Cells[y][x] {
+				continue
+			}
+			_, err := fmt.Fprintf(w,
+				"<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n",
+				margin+x*cell, margin+y*cell, cell, cell, fill)
+			if err != nil {
+				return log.Error(err)
+			}
+		}
+	}
+	if _, err := io.WriteString(w, "</svg>\n"); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
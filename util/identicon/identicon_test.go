@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identicon
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+)
+
+func TestIdenticon(t *testing.T) {
+	hash := base64.Encode(cipher.SHA512([]byte("alice@mute.berlin")))
+	ic, err := New(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deterministic
+	ic2, err := New(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ic != *ic2 {
+		t.Error("identicons differ for the same hash")
+	}
+	// different hash
+	ic3, err := New(base64.Encode(cipher.SHA512([]byte("bob@mute.berlin"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ic == *ic3 {
+		t.Error("identicons equal for different hashes")
+	}
+	// symmetric
+	for y := 0; y < GridSize; y++ {
+		for x := 0; x < GridSize; x++ {
+			if ic.Cells[y][x] != ic.Cells[y][GridSize-1-x] {
+				t.Fatalf("cell (%d,%d) not mirrored", x, y)
+			}
+		}
+	}
+	// PNG
+	var buf bytes.Buffer
+	if err := ic.PNG(&buf, 60); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 60 {
+		t.Errorf("wrong PNG size: %v", img.Bounds())
+	}
+	// SVG
+	buf.Reset()
+	if err := ic.SVG(&buf, 60); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "<svg") {
+		t.Error("SVG output does not start with <svg")
+	}
+	if !strings.Contains(buf.String(), hash) {
+		t.Error("SVG output does not contain the full hash")
+	}
+	// errors
+	if err := ic.PNG(&buf, 5); err == nil {
+		t.Error("should fail for too small size")
+	}
+	if _, err := New(base64.Encode([]byte("short"))); err == nil {
+		t.Error("should fail for short hash")
+	}
+}
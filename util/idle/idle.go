@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package idle implements an idle timeout which locks resources (like
+// unlocked databases) after a period of inactivity.
+package idle
+
+import (
+	"sync"
+	"time"
+)
+
+// Timer calls a lock function after a period of inactivity. Activities are
+// enclosed in Begin and End calls, the lock function is never called during
+// an activity.
+type Timer struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	expires time.Time // time of the last End plus timeout
+	lock    func()
+}
+
+// New returns a new Timer which calls lock after timeout without activity.
+// A timeout of 0 disables the timer. The timer starts inactive.
+func New(timeout time.Duration, lock func()) *Timer {
+	t := &Timer{timeout: timeout, expires: time.Now().Add(timeout), lock: lock}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, t.fire)
+	}
+	return t
+}
+
+func (t *Timer) fire() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// ignore timer which fired while an activity was running
+	if t.timer == nil || time.Now().Before(t.expires) {
+		return
+	}
+	t.lock()
+}
+
+// Begin begins an activity. It waits for a running lock function to return.
+func (t *Timer) Begin() {
+	t.mutex.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// End ends the activity begun with Begin and restarts the timer.
+func (t *Timer) End() {
+	if t.timer != nil {
+		t.expires = time.Now().Add(t.timeout)
+		t.timer.Reset(t.timeout)
+	}
+	t.mutex.Unlock()
+}
+
+// Stop stops the timer, the lock function is not called anymore.
+func (t *Timer) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
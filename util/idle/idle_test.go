@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package idle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimer(t *testing.T) {
+	var locks int32
+	timer := New(20*time.Millisecond, func() { atomic.AddInt32(&locks, 1) })
+	defer timer.Stop()
+	// activities longer than the timeout do not lock
+	timer.Begin()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&locks); n != 0 {
+		t.Fatalf("locked %d times during activity", n)
+	}
+	timer.End()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&locks); n != 1 {
+		t.Fatalf("locked %d times after inactivity, expected once", n)
+	}
+	timer.Stop()
+	timer.Begin()
+	timer.End()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&locks); n != 1 {
+		t.Errorf("locked %d times after Stop, expected once", n)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	timer := New(0, func() { t.Error("disabled timer should not lock") })
+	timer.Begin()
+	timer.End()
+	timer.Stop()
+}
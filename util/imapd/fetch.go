@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package imapd
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// toCRLF converts the line endings of data to CRLF.
+func toCRLF(data []byte) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// splitMessage splits the message data into header (including the empty
+// line) and body.
+func splitMessage(data []byte) (header, body []byte) {
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		return data, nil
+	}
+	return data[:i+4], data[i+4:]
+}
+
+// headerFields returns the fields of header (including the empty line) whose
+// names are in names (or not in names, if not is set).
+func headerFields(header []byte, names []string, not bool) []byte {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = true
+	}
+	var out bytes.Buffer
+	include := false
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "\r\n" || line == "" {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := strings.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			include = wanted[strings.ToLower(strings.TrimSpace(name))] != not
+		}
+		if include {
+			out.WriteString(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// section returns the content of the body section spec (the part between
+// the brackets of BODY[...]) of the message data, like "HEADER", "1.2", or
+// "2.MIME".
+func section(data []byte, spec string) ([]byte, error) {
+	// parse part path
+	var path []int
+	rest := spec
+	for rest != "" {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			i = len(rest)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			break
+		}
+		if n < 1 {
+			return nil, errSyntax
+		}
+		path = append(path, n)
+		rest = strings.TrimPrefix(rest[i:], ".")
+	}
+	if len(path) > 0 {
+		p, err := parseMIME(data).find(path)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(rest) {
+		case "":
+			return p.body, nil
+		case "MIME":
+			return p.header, nil
+		}
+		if p.mediaType != "message/rfc822" {
+			return nil, fmt.Errorf("unsupported body section '%s'", spec)
+		}
+		data = p.body
+	}
+	header, body := splitMessage(data)
+	switch upper := strings.ToUpper(rest); {
+	case upper == "":
+		return data, nil
+	case upper == "HEADER":
+		return header, nil
+	case upper == "TEXT":
+		return body, nil
+	case strings.HasPrefix(upper, "HEADER.FIELDS"):
+		not := strings.HasPrefix(upper, "HEADER.FIELDS.NOT")
+		i := strings.IndexByte(rest, '(')
+		j := strings.LastIndexByte(rest, ')')
+		if i < 0 || j < i {
+			return nil, errSyntax
+		}
+		return headerFields(header, strings.Fields(rest[i+1:j]), not), nil
+	default:
+		return nil, fmt.Errorf("unsupported body section '%s'", spec)
+	}
+}
+
+// partial applies the partial specification "<start.count>" to data.
+func partial(data []byte, spec string) ([]byte, string, error) {
+	if spec == "" {
+		return data, "", nil
+	}
+	parts := strings.SplitN(strings.Trim(spec, "<>"), ".", 2)
+	start, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, "", errSyntax
+	}
+	count := uint64(len(data))
+	if len(parts) == 2 {
+		if count, err = strconv.ParseUint(parts[1], 10, 32); err != nil {
+			return nil, "", errSyntax
+		}
+	}
+	if start > uint64(len(data)) {
+		start = uint64(len(data))
+	}
+	end := start + count
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	return data[start:end], fmt.Sprintf("<%d>", start), nil
+}
+
+// addressList formats the addresses of header field as IMAP address list.
+func addressList(h mail.Header, field string) string {
+	addrs, err := h.AddressList(field)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var list []string
+	for _, addr := range addrs {
+		mailbox, host := addr.Address, ""
+		if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+			mailbox, host = addr.Address[:i], addr.Address[i+1:]
+		}
+		list = append(list, fmt.Sprintf("(%s NIL %s %s)", nstring(addr.Name),
+			nstring(mailbox), nstring(host)))
+	}
+	return "(" + strings.Join(list, "") + ")"
+}
+
+// envelope returns the IMAP envelope structure of the message data.
+func envelope(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)"
+	}
+	h := msg.Header
+	from := addressList(h, "From")
+	sender := addressList(h, "Sender")
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(h, "Reply-To")
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nstring(h.Get("Date")), nstring(h.Get("Subject")), from, sender,
+		replyTo, addressList(h, "To"), addressList(h, "Cc"),
+		addressList(h, "Bcc"), nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-ID")))
+}
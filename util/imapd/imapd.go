@@ -0,0 +1,1154 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package imapd implements a minimal IMAP4rev1 server (RFC 3501) which allows
+// local mail clients to read messages. It supports neither TLS nor the
+// creation of mailboxes and should only listen on the loopback interface.
+package imapd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the default timeout for idle connections.
+const DefaultTimeout = 30 * time.Minute
+
+// Flags supported by the server.
+const (
+	FlagSeen    = `\Seen`
+	FlagFlagged = `\Flagged`
+)
+
+// dateTimeLayout is the layout of IMAP date-time values.
+const dateTimeLayout = "02-Jan-2006 15:04:05 -0700"
+
+// ErrAuth is returned by a Backend for failed logins.
+var ErrAuth = errors.New("authentication failed")
+
+// Backend authenticates users.
+type Backend interface {
+	// Login returns the user with the given username and password.
+	Login(username, password string) (User, error)
+}
+
+// User gives access to the mailboxes of a logged in user.
+// Messages are identified by their UIDs, which must be unique over all
+// mailboxes of a user and must not be reused.
+type User interface {
+	// Mailboxes returns the mailboxes of the user (including INBOX).
+	Mailboxes() ([]*MailboxInfo, error)
+	// Messages returns the messages in mailbox, ordered by UID.
+	Messages(mailbox string) ([]*Message, error)
+	// Data returns the message data.
+	Data(mailbox string, uid uint32) ([]byte, error)
+	// SetFlags sets the flags of a message.
+	SetFlags(mailbox string, uid uint32, flags []string) error
+	// Move moves a message to the mailbox dest.
+	Move(mailbox string, uid uint32, dest string) error
+	// Append appends the message data to mailbox.
+	Append(mailbox string, flags []string, date time.Time, data []byte) error
+}
+
+// MailboxInfo describes a mailbox.
+type MailboxInfo struct {
+	Name       string   // mailbox name
+	Attributes []string // like `\Sent` or `\Archive` (RFC 6154)
+}
+
+// Message describes a message in a mailbox.
+type Message struct {
+	UID   uint32    // unique identifier
+	Date  time.Time // internal date
+	Flags []string  // flags, like FlagSeen
+}
+
+// HasFlag reports whether m has flag.
+func (m *Message) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server is an IMAP server.
+type Server struct {
+	Timeout time.Duration // idle timeout (default: DefaultTimeout)
+	Backend Backend       // authenticates users
+}
+
+// Serve accepts connections on l and serves every connection in its own
+// goroutine, until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// session is the state of an IMAP session.
+type session struct {
+	s        *Server
+	conn     net.Conn
+	w        *bufio.Writer
+	cr       *commandReader
+	user     User
+	mailbox  string     // selected mailbox ("" if none is selected)
+	readOnly bool       // mailbox was selected with EXAMINE
+	msgs     []*Message // messages of the selected mailbox
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sess := &session{s: s, conn: conn, w: bufio.NewWriter(conn)}
+	sess.cr = &commandReader{r: bufio.NewReader(conn), w: sess}
+	sess.untagged("OK [CAPABILITY %s] ready", capabilities)
+	for {
+		sess.w.Flush()
+		sess.deadline()
+		tokens, err := sess.cr.readCommand()
+		if err == errSyntax {
+			sess.untagged("BAD syntax error")
+			continue
+		} else if err != nil {
+			return
+		}
+		if len(tokens) < 2 {
+			sess.untagged("BAD missing command")
+			continue
+		}
+		tag, ok1 := tokens[0].(string)
+		cmd, ok2 := tokens[1].(string)
+		if !ok1 || !ok2 {
+			sess.untagged("BAD syntax error")
+			continue
+		}
+		if sess.handle(tag, strings.ToUpper(cmd), tokens[2:]) {
+			sess.w.Flush()
+			return
+		}
+	}
+}
+
+// Write implements io.Writer (for continuation requests of the command
+// reader, which must be sent immediately).
+func (sess *session) Write(p []byte) (int, error) {
+	n, err := sess.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, sess.w.Flush()
+}
+
+func (sess *session) deadline() {
+	timeout := sess.s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	sess.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (sess *session) untagged(format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, "* "+format+"\r\n", args...)
+}
+
+func (sess *session) reply(tag, status, format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, "%s %s %s\r\n", tag, status, fmt.Sprintf(format, args...))
+}
+
+// capabilities are the capabilities of the server.
+const capabilities = "IMAP4rev1 MOVE UNSELECT SPECIAL-USE AUTH=PLAIN"
+
+// handle handles the command cmd with the given tag and args and returns true,
+// if the session should be closed.
+func (sess *session) handle(tag, cmd string, args []interface{}) bool {
+	uid := false
+	if cmd == "UID" {
+		if len(args) == 0 {
+			sess.reply(tag, "BAD", "missing UID command")
+			return false
+		}
+		c, ok := args[0].(string)
+		if !ok {
+			sess.reply(tag, "BAD", "syntax error")
+			return false
+		}
+		uid = true
+		cmd, args = strings.ToUpper(c), args[1:]
+	}
+	// commands valid in any state
+	switch cmd {
+	case "CAPABILITY":
+		sess.untagged("CAPABILITY %s", capabilities)
+		sess.reply(tag, "OK", "CAPABILITY completed")
+		return false
+	case "NOOP", "CHECK":
+		if sess.mailbox != "" {
+			if err := sess.refresh(); err != nil {
+				sess.reply(tag, "NO", "%s", err)
+				return false
+			}
+		}
+		sess.reply(tag, "OK", "%s completed", cmd)
+		return false
+	case "LOGOUT":
+		sess.untagged("BYE logging out")
+		sess.reply(tag, "OK", "LOGOUT completed")
+		return true
+	case "LOGIN", "AUTHENTICATE":
+		if sess.user != nil {
+			sess.reply(tag, "BAD", "already authenticated")
+			return false
+		}
+		var username, password string
+		var err error
+		if cmd == "LOGIN" {
+			username, password, err = loginArgs(args)
+		} else {
+			username, password, err = sess.authenticatePlain(args)
+		}
+		if err != nil {
+			sess.reply(tag, "BAD", "%s", err)
+			return false
+		}
+		user, err := sess.s.Backend.Login(username, password)
+		if err != nil {
+			sess.reply(tag, "NO", "[AUTHENTICATIONFAILED] %s", err)
+			return false
+		}
+		sess.user = user
+		sess.reply(tag, "OK", "[CAPABILITY %s] %s completed", capabilities, cmd)
+		return false
+	}
+	if sess.user == nil {
+		sess.reply(tag, "BAD", "%s: not authenticated", cmd)
+		return false
+	}
+	// commands valid in the authenticated state
+	var err error
+	switch cmd {
+	case "LIST", "LSUB":
+		err = sess.list(cmd, args)
+	case "SELECT", "EXAMINE":
+		err = sess.selectMailbox(tag, cmd, args)
+		if err == nil {
+			return false
+		}
+	case "STATUS":
+		err = sess.status(args)
+	case "APPEND":
+		err = sess.append(args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// all mailboxes are subscribed
+	case "CREATE", "DELETE", "RENAME":
+		sess.reply(tag, "NO", "[CANNOT] %s not supported", cmd)
+		return false
+	default:
+		if sess.mailbox == "" {
+			sess.reply(tag, "BAD", "%s: unknown command or no mailbox selected", cmd)
+			return false
+		}
+		// commands valid in the selected state
+		switch cmd {
+		case "CLOSE", "UNSELECT":
+			sess.mailbox = ""
+			sess.msgs = nil
+		case "EXPUNGE":
+			// messages cannot be deleted
+		case "FETCH":
+			err = sess.fetch(uid, args)
+		case "STORE":
+			err = sess.store(uid, args)
+		case "SEARCH":
+			err = sess.search(uid, args)
+		case "MOVE":
+			err = sess.move(uid, args)
+		case "COPY":
+			sess.reply(tag, "NO", "[CANNOT] COPY not supported")
+			return false
+		default:
+			sess.reply(tag, "BAD", "unknown command %s", cmd)
+			return false
+		}
+	}
+	if err == errSyntax {
+		sess.reply(tag, "BAD", "%s: syntax error", cmd)
+	} else if err != nil {
+		sess.reply(tag, "NO", "%s: %s", cmd, err)
+	} else {
+		if uid {
+			cmd = "UID " + cmd
+		}
+		sess.reply(tag, "OK", "%s completed", cmd)
+	}
+	return false
+}
+
+// stringArgs returns args as strings and checks that there are n of them.
+func stringArgs(args []interface{}, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, errSyntax
+	}
+	strs := make([]string, n)
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, errSyntax
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func loginArgs(args []interface{}) (username, password string, err error) {
+	strs, err := stringArgs(args, 2)
+	if err != nil {
+		return "", "", err
+	}
+	return strs[0], strs[1], nil
+}
+
+// authenticatePlain handles the SASL mechanism PLAIN (RFC 4616).
+func (sess *session) authenticatePlain(args []interface{}) (username, password string, err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", "", errSyntax
+	}
+	mechanism, ok := args[0].(string)
+	if !ok || !strings.EqualFold(mechanism, "PLAIN") {
+		return "", "", errors.New("unsupported authentication mechanism")
+	}
+	var response string
+	if len(args) == 2 {
+		if response, ok = args[1].(string); !ok {
+			return "", "", errSyntax
+		}
+	} else {
+		io.WriteString(sess, "+ \r\n")
+		if err := sess.cr.readLine(); err != nil {
+			return "", "", err
+		}
+		response = sess.cr.line
+	}
+	if response == "*" {
+		return "", "", errors.New("authentication canceled")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", errSyntax
+	}
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		return "", "", errSyntax
+	}
+	return parts[1], parts[2], nil
+}
+
+// findMailbox returns the mailbox with the given name (INBOX is case
+// insensitive).
+func (sess *session) findMailbox(name string) (*MailboxInfo, error) {
+	mailboxes, err := sess.user.Mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	for _, mbox := range mailboxes {
+		if mbox.Name == name ||
+			strings.EqualFold(name, "INBOX") && strings.EqualFold(mbox.Name, "INBOX") {
+			return mbox, nil
+		}
+	}
+	return nil, fmt.Errorf("[NONEXISTENT] unknown mailbox '%s'", name)
+}
+
+// matchPattern matches name against the LIST pattern (with wildcards '*'
+// and '%').
+func matchPattern(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if matchPattern(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+				return false
+			}
+		}
+		return false
+	default:
+		return name != "" && pattern[0] == name[0] &&
+			matchPattern(pattern[1:], name[1:])
+	}
+}
+
+func (sess *session) list(cmd string, args []interface{}) error {
+	strs, err := stringArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	pattern := strs[0] + strs[1]
+	if strs[1] == "" {
+		// request for the hierarchy delimiter
+		sess.untagged(`%s (\Noselect) "/" ""`, cmd)
+		return nil
+	}
+	mailboxes, err := sess.user.Mailboxes()
+	if err != nil {
+		return err
+	}
+	for _, mbox := range mailboxes {
+		name := mbox.Name
+		if strings.EqualFold(name, "INBOX") &&
+			matchPattern(strings.ToUpper(pattern), "INBOX") ||
+			matchPattern(pattern, name) {
+			sess.untagged(`%s (%s) "/" %s`, cmd,
+				strings.Join(mbox.Attributes, " "), quote(name))
+		}
+	}
+	return nil
+}
+
+// uidNext returns the next UID of the messages msgs.
+func uidNext(msgs []*Message) uint32 {
+	if len(msgs) == 0 {
+		return 1
+	}
+	return msgs[len(msgs)-1].UID + 1
+}
+
+func (sess *session) selectMailbox(tag, cmd string, args []interface{}) error {
+	strs, err := stringArgs(args, 1)
+	if err != nil {
+		return err
+	}
+	sess.mailbox = ""
+	sess.msgs = nil
+	mbox, err := sess.findMailbox(strs[0])
+	if err != nil {
+		return err
+	}
+	msgs, err := sess.user.Messages(mbox.Name)
+	if err != nil {
+		return err
+	}
+	sess.mailbox = mbox.Name
+	sess.readOnly = cmd == "EXAMINE"
+	sess.msgs = msgs
+	sess.untagged(`FLAGS (%s %s)`, FlagSeen, FlagFlagged)
+	if sess.readOnly {
+		sess.untagged("OK [PERMANENTFLAGS ()] read-only")
+	} else {
+		sess.untagged(`OK [PERMANENTFLAGS (%s %s)] flags permitted`, FlagSeen,
+			FlagFlagged)
+	}
+	sess.untagged("%d EXISTS", len(msgs))
+	sess.untagged("0 RECENT")
+	for i, m := range msgs {
+		if !m.HasFlag(FlagSeen) {
+			sess.untagged("OK [UNSEEN %d] first unseen", i+1)
+			break
+		}
+	}
+	sess.untagged("OK [UIDVALIDITY 1] UIDs valid")
+	sess.untagged("OK [UIDNEXT %d] predicted next UID", uidNext(msgs))
+	if sess.readOnly {
+		sess.reply(tag, "OK", "[READ-ONLY] %s completed", cmd)
+	} else {
+		sess.reply(tag, "OK", "[READ-WRITE] %s completed", cmd)
+	}
+	return nil
+}
+
+func (sess *session) status(args []interface{}) error {
+	if len(args) != 2 {
+		return errSyntax
+	}
+	name, ok := args[0].(string)
+	items, ok2 := args[1].([]interface{})
+	if !ok || !ok2 {
+		return errSyntax
+	}
+	mbox, err := sess.findMailbox(name)
+	if err != nil {
+		return err
+	}
+	msgs, err := sess.user.Messages(mbox.Name)
+	if err != nil {
+		return err
+	}
+	var unseen int
+	for _, m := range msgs {
+		if !m.HasFlag(FlagSeen) {
+			unseen++
+		}
+	}
+	var values []string
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return errSyntax
+		}
+		s = strings.ToUpper(s)
+		switch s {
+		case "MESSAGES":
+			values = append(values, s, strconv.Itoa(len(msgs)))
+		case "RECENT":
+			values = append(values, s, "0")
+		case "UIDNEXT":
+			values = append(values, s, strconv.FormatUint(uint64(uidNext(msgs)), 10))
+		case "UIDVALIDITY":
+			values = append(values, s, "1")
+		case "UNSEEN":
+			values = append(values, s, strconv.Itoa(unseen))
+		default:
+			return errSyntax
+		}
+	}
+	sess.untagged("STATUS %s (%s)", quote(mbox.Name), strings.Join(values, " "))
+	return nil
+}
+
+func (sess *session) append(args []interface{}) error {
+	if len(args) < 2 {
+		return errSyntax
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return errSyntax
+	}
+	var flags []string
+	if list, ok := args[1].([]interface{}); ok {
+		for _, flag := range list {
+			s, ok := flag.(string)
+			if !ok {
+				return errSyntax
+			}
+			flags = append(flags, s)
+		}
+		args = args[1:]
+	}
+	date := time.Now()
+	if len(args) == 3 {
+		s, ok := args[1].(string)
+		if !ok {
+			return errSyntax
+		}
+		d, err := time.Parse(dateTimeLayout, strings.TrimLeft(s, " "))
+		if err != nil {
+			return errSyntax
+		}
+		date = d
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return errSyntax
+	}
+	data, ok := args[1].(string)
+	if !ok {
+		return errSyntax
+	}
+	mbox, err := sess.findMailbox(name)
+	if err != nil {
+		return fmt.Errorf("[TRYCREATE] %s", err)
+	}
+	return sess.user.Append(mbox.Name, flags, date, []byte(data))
+}
+
+// refresh reloads the messages of the selected mailbox and reports the
+// changes (expunged and new messages, changed flags) to the client.
+func (sess *session) refresh() error {
+	msgs, err := sess.user.Messages(sess.mailbox)
+	if err != nil {
+		return err
+	}
+	current := make(map[uint32]*Message)
+	for _, m := range msgs {
+		current[m.UID] = m
+	}
+	// expunged messages (from the highest sequence number downwards)
+	for i := len(sess.msgs) - 1; i >= 0; i-- {
+		if current[sess.msgs[i].UID] == nil {
+			sess.untagged("%d EXPUNGE", i+1)
+			sess.msgs = append(sess.msgs[:i], sess.msgs[i+1:]...)
+		}
+	}
+	// changed flags
+	known := make(map[uint32]bool)
+	for i, m := range sess.msgs {
+		known[m.UID] = true
+		n := current[m.UID]
+		if flagList(n.Flags) != flagList(m.Flags) {
+			sess.untagged("%d FETCH (UID %d FLAGS %s)", i+1, m.UID,
+				flagList(n.Flags))
+		}
+		sess.msgs[i] = n
+	}
+	// new messages (UIDs are ascending and not reused)
+	added := false
+	for _, m := range msgs {
+		if !known[m.UID] && m.UID >= uidNext(sess.msgs) {
+			sess.msgs = append(sess.msgs, m)
+			added = true
+		}
+	}
+	if added {
+		sess.untagged("%d EXISTS", len(sess.msgs))
+	}
+	return nil
+}
+
+// flagList formats flags as IMAP flag list.
+func flagList(flags []string) string {
+	sorted := append([]string(nil), flags...)
+	sort.Strings(sorted)
+	return "(" + strings.Join(sorted, " ") + ")"
+}
+
+// selected returns the sequence numbers of the messages in the selected
+// mailbox which are contained in the sequence set (or UID set, if uid is
+// set) arg.
+func (sess *session) selected(uid bool, arg interface{}) ([]int, error) {
+	s, ok := arg.(string)
+	if !ok {
+		return nil, errSyntax
+	}
+	set, err := parseSeqSet(s)
+	if err != nil {
+		return nil, errSyntax
+	}
+	var seqs []int
+	for i, m := range sess.msgs {
+		if uid && set.contains(m.UID, uidNext(sess.msgs)-1) ||
+			!uid && set.contains(uint32(i+1), uint32(len(sess.msgs))) {
+			seqs = append(seqs, i+1)
+		}
+	}
+	if !uid && len(seqs) == 0 && len(sess.msgs) > 0 {
+		return nil, errors.New("invalid sequence set")
+	}
+	return seqs, nil
+}
+
+// setFlags sets the flags of message with sequence number seq.
+func (sess *session) setFlags(seq int, flags []string) error {
+	m := sess.msgs[seq-1]
+	if err := sess.user.SetFlags(sess.mailbox, m.UID, flags); err != nil {
+		return err
+	}
+	sess.msgs[seq-1] = &Message{UID: m.UID, Date: m.Date, Flags: flags}
+	return nil
+}
+
+// fetchItems expands the fetch items arg (with macros).
+func fetchItems(arg interface{}) ([]string, error) {
+	var items []string
+	switch a := arg.(type) {
+	case string:
+		switch strings.ToUpper(a) {
+		case "ALL":
+			return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}, nil
+		case "FAST":
+			return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}, nil
+		case "FULL":
+			return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE",
+				"BODY"}, nil
+		}
+		items = append(items, a)
+	case []interface{}:
+		for _, item := range a {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errSyntax
+			}
+			items = append(items, s)
+		}
+	}
+	return items, nil
+}
+
+func (sess *session) fetch(uid bool, args []interface{}) error {
+	if len(args) != 2 {
+		return errSyntax
+	}
+	seqs, err := sess.selected(uid, args[0])
+	if err != nil {
+		return err
+	}
+	items, err := fetchItems(args[1])
+	if err != nil {
+		return err
+	}
+	if uid {
+		items = append([]string{"UID"}, items...)
+	}
+	for _, seq := range seqs {
+		if err := sess.fetchMessage(seq, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *session) fetchMessage(seq int, items []string) error {
+	m := sess.msgs[seq-1]
+	var data []byte
+	getData := func() error {
+		if data != nil {
+			return nil
+		}
+		var err error
+		data, err = sess.data(m.UID)
+		return err
+	}
+	var values []string
+	hasUID, seen := false, false
+	for _, item := range items {
+		upper := strings.ToUpper(item)
+		switch upper {
+		case "UID":
+			if hasUID {
+				continue
+			}
+			hasUID = true
+			values = append(values, fmt.Sprintf("UID %d", m.UID))
+			continue
+		case "FLAGS":
+			values = append(values, "FLAGS "+flagList(m.Flags))
+			continue
+		case "INTERNALDATE":
+			values = append(values, fmt.Sprintf(`INTERNALDATE "%s"`,
+				m.Date.Format(dateTimeLayout)))
+			continue
+		}
+		if err := getData(); err != nil {
+			return err
+		}
+		switch upper {
+		case "RFC822.SIZE":
+			values = append(values, fmt.Sprintf("RFC822.SIZE %d", len(data)))
+		case "ENVELOPE":
+			values = append(values, "ENVELOPE "+envelope(data))
+		case "BODY", "BODYSTRUCTURE":
+			values = append(values, upper+" "+
+				parseMIME(data).bodyStructure(upper == "BODYSTRUCTURE"))
+		case "RFC822":
+			values = append(values, "RFC822 "+literal(data))
+			seen = true
+		case "RFC822.HEADER":
+			header, _ := splitMessage(data)
+			values = append(values, "RFC822.HEADER "+literal(header))
+		case "RFC822.TEXT":
+			_, body := splitMessage(data)
+			values = append(values, "RFC822.TEXT "+literal(body))
+			seen = true
+		default:
+			// BODY[section]<partial> or BODY.PEEK[section]<partial>
+			peek := strings.HasPrefix(upper, "BODY.PEEK[")
+			if !peek && !strings.HasPrefix(upper, "BODY[") {
+				return errSyntax
+			}
+			start := strings.IndexByte(item, '[')
+			end := strings.LastIndexByte(item, ']')
+			if end < start {
+				return errSyntax
+			}
+			spec := item[start+1 : end]
+			content, err := section(data, spec)
+			if err != nil {
+				return err
+			}
+			content, origin, err := partial(content, item[end+1:])
+			if err != nil {
+				return err
+			}
+			values = append(values, fmt.Sprintf("BODY[%s]%s %s", spec, origin,
+				literal(content)))
+			if !peek {
+				seen = true
+			}
+		}
+	}
+	if seen && !sess.readOnly && !m.HasFlag(FlagSeen) {
+		flags := append(append([]string(nil), m.Flags...), FlagSeen)
+		if err := sess.setFlags(seq, flags); err != nil {
+			return err
+		}
+		values = append(values, "FLAGS "+flagList(flags))
+	}
+	sess.untagged("%d FETCH (%s)", seq, strings.Join(values, " "))
+	return nil
+}
+
+// data returns the data of the message with the given uid in the selected
+// mailbox (with CRLF line endings).
+func (sess *session) data(uid uint32) ([]byte, error) {
+	data, err := sess.user.Data(sess.mailbox, uid)
+	if err != nil {
+		return nil, err
+	}
+	return toCRLF(data), nil
+}
+
+// literal returns data as IMAP literal.
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// supportedFlags filters the flags supported by the server (other flags are
+// ignored).
+func supportedFlags(list []interface{}) ([]string, error) {
+	var flags []string
+	for _, flag := range list {
+		s, ok := flag.(string)
+		if !ok {
+			return nil, errSyntax
+		}
+		switch {
+		case strings.EqualFold(s, FlagSeen):
+			flags = append(flags, FlagSeen)
+		case strings.EqualFold(s, FlagFlagged):
+			flags = append(flags, FlagFlagged)
+		}
+	}
+	return flags, nil
+}
+
+func (sess *session) store(uid bool, args []interface{}) error {
+	if len(args) != 3 {
+		return errSyntax
+	}
+	if sess.readOnly {
+		return errors.New("[READ-ONLY] mailbox selected with EXAMINE")
+	}
+	seqs, err := sess.selected(uid, args[0])
+	if err != nil {
+		return err
+	}
+	item, ok := args[1].(string)
+	if !ok {
+		return errSyntax
+	}
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	list, ok := args[2].([]interface{})
+	if !ok {
+		list = []interface{}{args[2]}
+	}
+	flags, err := supportedFlags(list)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		m := sess.msgs[seq-1]
+		set := make(map[string]bool)
+		if item != "FLAGS" {
+			for _, flag := range m.Flags {
+				set[flag] = true
+			}
+		}
+		for _, flag := range flags {
+			switch item {
+			case "FLAGS", "+FLAGS":
+				set[flag] = true
+			case "-FLAGS":
+				delete(set, flag)
+			default:
+				return errSyntax
+			}
+		}
+		var newFlags []string
+		for flag := range set {
+			newFlags = append(newFlags, flag)
+		}
+		if flagList(newFlags) != flagList(m.Flags) {
+			if err := sess.setFlags(seq, newFlags); err != nil {
+				return err
+			}
+		}
+		if !silent {
+			if uid {
+				sess.untagged("%d FETCH (UID %d FLAGS %s)", seq, m.UID,
+					flagList(sess.msgs[seq-1].Flags))
+			} else {
+				sess.untagged("%d FETCH (FLAGS %s)", seq,
+					flagList(sess.msgs[seq-1].Flags))
+			}
+		}
+	}
+	return nil
+}
+
+// criterion is a search criterion for the message with sequence number seq.
+type criterion func(seq int) (bool, error)
+
+// searchKey parses the next search key from args and returns the criterion
+// and the remaining args.
+func (sess *session) searchKey(args []interface{}) (criterion, []interface{}, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		c, err := sess.searchKeys(list)
+		return c, args[1:], err
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return nil, nil, errSyntax
+	}
+	key = strings.ToUpper(key)
+	args = args[1:]
+	flag := func(flag string, set bool) criterion {
+		return func(seq int) (bool, error) {
+			return sess.msgs[seq-1].HasFlag(flag) == set, nil
+		}
+	}
+	constant := func(b bool) criterion {
+		return func(seq int) (bool, error) { return b, nil }
+	}
+	switch key {
+	case "ALL", "OLD", "UNDELETED", "UNANSWERED", "UNDRAFT":
+		return constant(true), args, nil
+	case "NEW", "RECENT", "DELETED", "ANSWERED", "DRAFT":
+		return constant(false), args, nil
+	case "SEEN":
+		return flag(FlagSeen, true), args, nil
+	case "UNSEEN":
+		return flag(FlagSeen, false), args, nil
+	case "FLAGGED":
+		return flag(FlagFlagged, true), args, nil
+	case "UNFLAGGED":
+		return flag(FlagFlagged, false), args, nil
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, errSyntax
+		}
+		c, rest, err := sess.searchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(seq int) (bool, error) {
+			match, err := c(seq)
+			return !match, err
+		}, rest, nil
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, errSyntax
+		}
+		c1, rest, err := sess.searchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, errSyntax
+		}
+		c2, rest, err := sess.searchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(seq int) (bool, error) {
+			match, err := c1(seq)
+			if err != nil || match {
+				return match, err
+			}
+			return c2(seq)
+		}, rest, nil
+	}
+	// keys with an argument
+	if key != "UID" && !isSearchKeyWithArg(key) {
+		// sequence set
+		seqs, err := sess.selected(false, key)
+		if err != nil {
+			return nil, nil, errSyntax
+		}
+		return inSeqs(seqs), args, nil
+	}
+	if len(args) == 0 {
+		return nil, nil, errSyntax
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return nil, nil, errSyntax
+	}
+	args = args[1:]
+	switch key {
+	case "UID":
+		seqs, err := sess.selected(true, arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return inSeqs(seqs), args, nil
+	case "BEFORE", "ON", "SINCE":
+		d, err := time.Parse("2-Jan-2006", arg)
+		if err != nil {
+			return nil, nil, errSyntax
+		}
+		return func(seq int) (bool, error) {
+			t := sess.msgs[seq-1].Date
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			switch key {
+			case "BEFORE":
+				return day.Before(d), nil
+			case "ON":
+				return day.Equal(d), nil
+			default:
+				return !day.Before(d), nil
+			}
+		}, args, nil
+	default: // text search
+		field, value := key, arg
+		switch key {
+		case "HEADER":
+			if len(args) == 0 {
+				return nil, nil, errSyntax
+			}
+			field = arg
+			if value, ok = args[0].(string); !ok {
+				return nil, nil, errSyntax
+			}
+			args = args[1:]
+		case "BODY", "TEXT":
+			field = ""
+		}
+		value = strings.ToLower(value)
+		return func(seq int) (bool, error) {
+			data, err := sess.data(sess.msgs[seq-1].UID)
+			if err != nil {
+				return false, err
+			}
+			header, body := splitMessage(data)
+			switch {
+			case key == "BODY":
+				data = body
+			case field != "":
+				data = headerFields(header, []string{field}, false)
+			}
+			return strings.Contains(strings.ToLower(string(data)), value), nil
+		}, args, nil
+	}
+}
+
+func isSearchKeyWithArg(key string) bool {
+	switch key {
+	case "BEFORE", "ON", "SINCE", "BODY", "TEXT", "HEADER", "SUBJECT", "FROM",
+		"TO", "CC", "BCC":
+		return true
+	}
+	return false
+}
+
+func inSeqs(seqs []int) criterion {
+	return func(seq int) (bool, error) {
+		for _, s := range seqs {
+			if s == seq {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// searchKeys parses all search keys of args (which are combined with AND).
+func (sess *session) searchKeys(args []interface{}) (criterion, error) {
+	var criteria []criterion
+	for len(args) > 0 {
+		if s, ok := args[0].(string); ok && strings.EqualFold(s, "CHARSET") {
+			if len(args) < 2 {
+				return nil, errSyntax
+			}
+			args = args[2:]
+			continue
+		}
+		c, rest, err := sess.searchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		criteria = append(criteria, c)
+		args = rest
+	}
+	return func(seq int) (bool, error) {
+		for _, c := range criteria {
+			match, err := c(seq)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+func (sess *session) search(uid bool, args []interface{}) error {
+	if len(args) == 0 {
+		return errSyntax
+	}
+	c, err := sess.searchKeys(args)
+	if err != nil {
+		return err
+	}
+	var results []string
+	for i, m := range sess.msgs {
+		match, err := c(i + 1)
+		if err != nil {
+			return err
+		}
+		if match {
+			if uid {
+				results = append(results, strconv.FormatUint(uint64(m.UID), 10))
+			} else {
+				results = append(results, strconv.Itoa(i+1))
+			}
+		}
+	}
+	if len(results) == 0 {
+		sess.untagged("SEARCH")
+	} else {
+		sess.untagged("SEARCH %s", strings.Join(results, " "))
+	}
+	return nil
+}
+
+func (sess *session) move(uid bool, args []interface{}) error {
+	if len(args) != 2 {
+		return errSyntax
+	}
+	if sess.readOnly {
+		return errors.New("[READ-ONLY] mailbox selected with EXAMINE")
+	}
+	seqs, err := sess.selected(uid, args[0])
+	if err != nil {
+		return err
+	}
+	name, ok := args[1].(string)
+	if !ok {
+		return errSyntax
+	}
+	mbox, err := sess.findMailbox(name)
+	if err != nil {
+		return fmt.Errorf("[TRYCREATE] %s", err)
+	}
+	if mbox.Name == sess.mailbox {
+		return errors.New("[CANNOT] cannot move to selected mailbox")
+	}
+	// expunge moved messages from the highest sequence number downwards
+	for i := len(seqs) - 1; i >= 0; i-- {
+		seq := seqs[i]
+		if err := sess.user.Move(sess.mailbox, sess.msgs[seq-1].UID, mbox.Name); err != nil {
+			return err
+		}
+		sess.untagged("%d EXPUNGE", seq)
+		sess.msgs = append(sess.msgs[:seq-1], sess.msgs[seq:]...)
+	}
+	return nil
+}
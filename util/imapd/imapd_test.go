@@ -0,0 +1,259 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package imapd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	mailboxes map[string][]*Message
+	data      map[uint32][]byte
+}
+
+func (u *testUser) Login(username, password string) (User, error) {
+	if username != "alice@mute.berlin" {
+		return nil, ErrAuth
+	}
+	return u, nil
+}
+
+func (u *testUser) Mailboxes() ([]*MailboxInfo, error) {
+	return []*MailboxInfo{
+		{Name: "INBOX"},
+		{Name: "Archive", Attributes: []string{`\Archive`}},
+	}, nil
+}
+
+func (u *testUser) Messages(mailbox string) ([]*Message, error) {
+	return u.mailboxes[mailbox], nil
+}
+
+func (u *testUser) find(mailbox string, uid uint32) (int, error) {
+	for i, m := range u.mailboxes[mailbox] {
+		if m.UID == uid {
+			return i, nil
+		}
+	}
+	return 0, errors.New("unknown message")
+}
+
+func (u *testUser) Data(mailbox string, uid uint32) ([]byte, error) {
+	return u.data[uid], nil
+}
+
+func (u *testUser) SetFlags(mailbox string, uid uint32, flags []string) error {
+	i, err := u.find(mailbox, uid)
+	if err != nil {
+		return err
+	}
+	m := u.mailboxes[mailbox][i]
+	u.mailboxes[mailbox][i] = &Message{UID: m.UID, Date: m.Date, Flags: flags}
+	return nil
+}
+
+func (u *testUser) Move(mailbox string, uid uint32, dest string) error {
+	i, err := u.find(mailbox, uid)
+	if err != nil {
+		return err
+	}
+	m := u.mailboxes[mailbox][i]
+	u.mailboxes[mailbox] = append(u.mailboxes[mailbox][:i],
+		u.mailboxes[mailbox][i+1:]...)
+	u.mailboxes[dest] = append(u.mailboxes[dest], m)
+	return nil
+}
+
+func (u *testUser) Append(mailbox string, flags []string, date time.Time, data []byte) error {
+	return errors.New("not supported")
+}
+
+const testMsg = "From: Bob <bob@mute.berlin>\r\n" +
+	"To: alice@mute.berlin\r\n" +
+	"Subject: hello\r\n" +
+	"Message-ID: <1@mute.berlin>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"hello world\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=a.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--b--\r\n"
+
+type testClient struct {
+	t *testing.T
+	r *bufio.Reader
+	c net.Conn
+	n int
+}
+
+// cmd sends the command and returns the response (without the tagged status
+// line) and the status line.
+func (tc *testClient) cmd(format string, args ...interface{}) (string, string) {
+	tc.n++
+	tag := fmt.Sprintf("a%d", tc.n)
+	fmt.Fprintf(tc.c, "%s %s\r\n", tag, fmt.Sprintf(format, args...))
+	var resp []string
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return strings.Join(resp, ""), strings.TrimSpace(line[len(tag)+1:])
+		}
+		resp = append(resp, line)
+	}
+}
+
+func (tc *testClient) ok(format string, args ...interface{}) string {
+	resp, status := tc.cmd(format, args...)
+	if !strings.HasPrefix(status, "OK") {
+		tc.t.Fatalf("%s: %s", fmt.Sprintf(format, args...), status)
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	date := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	u := &testUser{
+		mailboxes: map[string][]*Message{
+			"INBOX": {
+				{UID: 3, Date: date},
+				{UID: 5, Date: date, Flags: []string{FlagSeen}},
+			},
+		},
+		data: map[uint32][]byte{
+			3: []byte(testMsg),
+			5: []byte("Subject: second\r\n\r\nbody\r\n"),
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &Server{Backend: u}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := &testClient{t: t, r: bufio.NewReader(conn), c: conn}
+	if line, _ := tc.r.ReadString('\n'); !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("wrong greeting: %s", line)
+	}
+	// authentication
+	if _, status := tc.cmd("SELECT INBOX"); !strings.HasPrefix(status, "BAD") {
+		t.Errorf("SELECT before LOGIN: %s", status)
+	}
+	if _, status := tc.cmd("LOGIN bob@mute.berlin x"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("LOGIN of unknown user: %s", status)
+	}
+	tc.ok(`LOGIN "alice@mute.berlin" "x"`)
+	// mailboxes
+	resp := tc.ok(`LIST "" "*"`)
+	if !strings.Contains(resp, `* LIST () "/" "INBOX"`) ||
+		!strings.Contains(resp, `* LIST (\Archive) "/" "Archive"`) {
+		t.Errorf("wrong LIST response: %s", resp)
+	}
+	resp = tc.ok("STATUS inbox (MESSAGES UNSEEN UIDNEXT)")
+	if !strings.Contains(resp, `* STATUS "INBOX" (MESSAGES 2 UNSEEN 1 UIDNEXT 6)`) {
+		t.Errorf("wrong STATUS response: %s", resp)
+	}
+	resp = tc.ok("SELECT INBOX")
+	if !strings.Contains(resp, "* 2 EXISTS") ||
+		!strings.Contains(resp, "[UNSEEN 1]") ||
+		!strings.Contains(resp, "[UIDNEXT 6]") {
+		t.Errorf("wrong SELECT response: %s", resp)
+	}
+	// fetch
+	resp = tc.ok("UID FETCH 1:* (FLAGS RFC822.SIZE)")
+	if !strings.Contains(resp, "* 1 FETCH (UID 3 FLAGS () RFC822.SIZE") ||
+		!strings.Contains(resp, `* 2 FETCH (UID 5 FLAGS (\Seen)`) {
+		t.Errorf("wrong FETCH response: %s", resp)
+	}
+	resp = tc.ok("FETCH 1 (BODY.PEEK[HEADER.FIELDS (Subject)] ENVELOPE)")
+	if !strings.Contains(resp, "BODY[HEADER.FIELDS (Subject)] {18}\r\nSubject: hello\r\n\r\n") ||
+		!strings.Contains(resp, `("Bob" NIL "bob" "mute.berlin")`) {
+		t.Errorf("wrong FETCH response: %s", resp)
+	}
+	resp = tc.ok("FETCH 1 BODYSTRUCTURE")
+	if !strings.Contains(resp, `("text" "plain" ("charset" "utf-8") NIL NIL "7bit" 11 1`) ||
+		!strings.Contains(resp, `("attachment" ("filename" "a.bin"))`) ||
+		!strings.Contains(resp, ` "mixed" ("boundary" "b")`) {
+		t.Errorf("wrong BODYSTRUCTURE: %s", resp)
+	}
+	resp = tc.ok("FETCH 1 (BODY[2]<1.2>)")
+	if !strings.Contains(resp, "BODY[2]<1> {2}\r\nAE") ||
+		!strings.Contains(resp, `FLAGS (\Seen)`) {
+		t.Errorf("wrong FETCH response: %s", resp)
+	}
+	if len(u.mailboxes["INBOX"][0].Flags) != 1 {
+		t.Error("message not marked as seen")
+	}
+	// store and search
+	resp = tc.ok(`STORE 1 FLAGS (\Flagged \Deleted)`)
+	if !strings.Contains(resp, `* 1 FETCH (FLAGS (\Flagged))`) {
+		t.Errorf("wrong STORE response: %s", resp)
+	}
+	tc.ok(`UID STORE 5 +FLAGS.SILENT (\Flagged)`)
+	resp = tc.ok("SEARCH FLAGGED UNSEEN")
+	if !strings.Contains(resp, "* SEARCH 1\r\n") {
+		t.Errorf("wrong SEARCH response: %s", resp)
+	}
+	resp = tc.ok("UID SEARCH OR SUBJECT second BODY world")
+	if !strings.Contains(resp, "* SEARCH 3 5\r\n") {
+		t.Errorf("wrong SEARCH response: %s", resp)
+	}
+	// move
+	resp = tc.ok("UID MOVE 3 Archive")
+	if !strings.Contains(resp, "* 1 EXPUNGE") || len(u.mailboxes["Archive"]) != 1 {
+		t.Errorf("wrong MOVE response: %s", resp)
+	}
+	if _, status := tc.cmd("COPY 1 Archive"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("COPY: %s", status)
+	}
+	// refresh
+	u.mailboxes["INBOX"] = append(u.mailboxes["INBOX"], &Message{UID: 7, Date: date})
+	resp = tc.ok("NOOP")
+	if !strings.Contains(resp, "* 2 EXISTS") {
+		t.Errorf("wrong NOOP response: %s", resp)
+	}
+	tc.ok("LOGOUT")
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "Archive", true},
+		{"%", "Archive", true},
+		{"A*", "Archive", true},
+		{"Sent", "Archive", false},
+		{"%", "a/b", false},
+		{"*", "a/b", true},
+	}
+	for _, test := range tests {
+		if matchPattern(test.pattern, test.name) != test.match {
+			t.Errorf("matchPattern(%q, %q) != %v", test.pattern, test.name,
+				test.match)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mimePart is a (raw) MIME part of a message.
+type mimePart struct {
+	header    []byte // raw header (including the empty line)
+	body      []byte // raw (encoded) body
+	mediaType string // lower case media type, like "text/plain"
+	params    map[string]string
+	mh        textproto.MIMEHeader
+	children  []*mimePart // parts of multipart bodies
+}
+
+// parseMIME parses the MIME structure of the message (or part) data.
+func parseMIME(data []byte) *mimePart {
+	header, body := splitMessage(data)
+	p := &mimePart{header: header, body: body}
+	mh, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil {
+		mh = make(textproto.MIMEHeader)
+	}
+	p.mh = mh
+	p.mediaType, p.params, err = mime.ParseMediaType(mh.Get("Content-Type"))
+	if err != nil {
+		p.mediaType = "text/plain"
+		p.params = map[string]string{"charset": "us-ascii"}
+	}
+	if strings.HasPrefix(p.mediaType, "multipart/") && p.params["boundary"] != "" {
+		for _, child := range splitMultipart(body, p.params["boundary"]) {
+			p.children = append(p.children, parseMIME(child))
+		}
+	}
+	return p
+}
+
+// splitMultipart splits the raw multipart body into its raw parts.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	var parts [][]byte
+	b := append([]byte("\r\n"), body...)
+	chunks := bytes.Split(b, []byte("\r\n--"+boundary))
+	for _, chunk := range chunks[1:] {
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			break // close delimiter
+		}
+		i := bytes.Index(chunk, []byte("\r\n"))
+		if i < 0 {
+			continue
+		}
+		parts = append(parts, chunk[i+2:])
+	}
+	return parts
+}
+
+// find returns the part with the given part path (like [1 2] for "1.2").
+func (p *mimePart) find(path []int) (*mimePart, error) {
+	for _, n := range path {
+		switch {
+		case len(p.children) >= n:
+			p = p.children[n-1]
+		case len(p.children) == 0 && n == 1:
+			// non-multipart message: part 1 is the body
+		default:
+			return nil, fmt.Errorf("unknown body part %d", n)
+		}
+	}
+	return p, nil
+}
+
+// paramList formats params as IMAP parameter list.
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var list []string
+	for _, key := range keys {
+		list = append(list, quote(key), quote(params[key]))
+	}
+	return "(" + strings.Join(list, " ") + ")"
+}
+
+// bodyStructure returns the IMAP body structure of p (with extension data,
+// if ext is set).
+func (p *mimePart) bodyStructure(ext bool) string {
+	typ, subtype := p.mediaType, ""
+	if i := strings.IndexByte(typ, '/'); i >= 0 {
+		typ, subtype = typ[:i], typ[i+1:]
+	}
+	if len(p.children) > 0 {
+		var b bytes.Buffer
+		b.WriteString("(")
+		for _, child := range p.children {
+			b.WriteString(child.bodyStructure(ext))
+		}
+		b.WriteString(" " + quote(subtype))
+		if ext {
+			b.WriteString(" " + paramList(p.params) + " NIL NIL")
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+	encoding := p.mh.Get("Content-Transfer-Encoding")
+	if encoding == "" {
+		encoding = "7bit"
+	}
+	s := fmt.Sprintf("(%s %s %s %s %s %s %d", quote(typ), quote(subtype),
+		paramList(p.params), nstring(p.mh.Get("Content-ID")),
+		nstring(p.mh.Get("Content-Description")), quote(encoding), len(p.body))
+	n := bytes.Count(p.body, []byte("\n"))
+	if len(p.body) > 0 && p.body[len(p.body)-1] != '\n' {
+		n++ // last line without line ending
+	}
+	lines := strconv.Itoa(n)
+	switch {
+	case p.mediaType == "message/rfc822":
+		s += " " + envelope(p.body) + " " + parseMIME(p.body).bodyStructure(ext) +
+			" " + lines
+	case typ == "text":
+		s += " " + lines
+	}
+	if ext {
+		disposition := "NIL"
+		if d, params, err := mime.ParseMediaType(p.mh.Get("Content-Disposition")); err == nil {
+			disposition = "(" + quote(d) + " " + paramList(params) + ")"
+		}
+		s += " NIL " + disposition
+	}
+	return s + ")"
+}
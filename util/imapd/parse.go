@@ -0,0 +1,255 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLiteral is the maximum size of a literal sent by a client.
+const maxLiteral = 64 * 1024 * 1024
+
+// errSyntax is returned for syntax errors in commands.
+var errSyntax = errors.New("syntax error")
+
+// A token of a command is either a string (atom, quoted string, or literal)
+// or a list of tokens ([]interface{}).
+
+// commandReader reads commands from a client. Literals are requested with a
+// continuation request written to w.
+type commandReader struct {
+	r    *bufio.Reader
+	w    io.Writer
+	line string
+	pos  int
+}
+
+// readLine reads the next line (without CRLF).
+func (cr *commandReader) readLine() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	cr.line = strings.TrimRight(line, "\r\n")
+	cr.pos = 0
+	return nil
+}
+
+// readCommand reads a complete command and returns its tokens.
+func (cr *commandReader) readCommand() ([]interface{}, error) {
+	if err := cr.readLine(); err != nil {
+		return nil, err
+	}
+	return cr.readList(0)
+}
+
+func (cr *commandReader) skipSpaces() {
+	for cr.pos < len(cr.line) && cr.line[cr.pos] == ' ' {
+		cr.pos++
+	}
+}
+
+// readList reads tokens until the end of the line (end == 0) or the closing
+// character end.
+func (cr *commandReader) readList(end byte) ([]interface{}, error) {
+	var tokens []interface{}
+	for {
+		cr.skipSpaces()
+		if cr.pos >= len(cr.line) {
+			if end != 0 {
+				return nil, errSyntax
+			}
+			return tokens, nil
+		}
+		c := cr.line[cr.pos]
+		switch {
+		case c == end:
+			cr.pos++
+			return tokens, nil
+		case c == '(':
+			cr.pos++
+			list, err := cr.readList(')')
+			if err != nil {
+				return nil, err
+			}
+			if list == nil {
+				list = []interface{}{}
+			}
+			tokens = append(tokens, list)
+		case c == ')':
+			return nil, errSyntax
+		case c == '"':
+			s, err := cr.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, s)
+		case c == '{':
+			s, err := cr.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, s)
+		default:
+			tokens = append(tokens, cr.readAtom())
+		}
+	}
+}
+
+func (cr *commandReader) readQuoted() (string, error) {
+	var b bytes.Buffer
+	for cr.pos++; cr.pos < len(cr.line); cr.pos++ {
+		c := cr.line[cr.pos]
+		switch c {
+		case '\\':
+			cr.pos++
+			if cr.pos >= len(cr.line) {
+				return "", errSyntax
+			}
+			b.WriteByte(cr.line[cr.pos])
+		case '"':
+			cr.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSyntax
+}
+
+// readLiteral reads a literal {n} (or non-synchronizing {n+}) which must be
+// at the end of the line. Afterwards parsing continues with the next line.
+func (cr *commandReader) readLiteral() (string, error) {
+	rest := cr.line[cr.pos:]
+	if !strings.HasSuffix(rest, "}") {
+		return "", errSyntax
+	}
+	spec := rest[1 : len(rest)-1]
+	sync := true
+	if strings.HasSuffix(spec, "+") {
+		spec = spec[:len(spec)-1]
+		sync = false
+	}
+	n, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil || n < 0 || n > maxLiteral {
+		return "", errSyntax
+	}
+	if sync {
+		if _, err := io.WriteString(cr.w, "+ Ready for literal data\r\n"); err != nil {
+			return "", err
+		}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return "", err
+	}
+	if err := cr.readLine(); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readAtom reads an atom. Brackets (like in fetch items such as
+// "BODY[HEADER.FIELDS (From)]") are read completely, including spaces.
+func (cr *commandReader) readAtom() string {
+	start := cr.pos
+	depth := 0
+	for ; cr.pos < len(cr.line); cr.pos++ {
+		c := cr.line[cr.pos]
+		switch {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth == 0 && (c == ' ' || c == '(' || c == ')'):
+			return cr.line[start:cr.pos]
+		}
+	}
+	return cr.line[start:]
+}
+
+// seqRange is a range of a sequence set (0 stands for '*').
+type seqRange struct {
+	start, stop uint32
+}
+
+// seqSet is a sequence set (of sequence numbers or UIDs).
+type seqSet []seqRange
+
+func parseSeqNum(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number '%s'", s)
+	}
+	return uint32(n), nil
+}
+
+// parseSeqSet parses a sequence set like "1:3,5,7:*".
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		start, err := parseSeqNum(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = parseSeqNum(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start, stop})
+	}
+	return set, nil
+}
+
+// contains reports whether set contains n, where '*' is max.
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start <= n && n <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+// quote returns s as IMAP string (a quoted string or a literal, if s contains
+// characters which cannot be quoted).
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c >= 0x80 || c == 0 {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring returns s as IMAP nstring (NIL for the empty string).
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
@@ -8,6 +8,7 @@ package interrupt
 import (
 	"os"
 	"os/signal"
+	"sync/atomic"
 
 	"github.com/mutecomm/mute/log"
 )
@@ -22,6 +23,18 @@ var interruptChannel chan os.Signal
 // to be invoked on SIGINT (Ctrl+C) signals.
 var addHandlerChannel = make(chan func())
 
+// suspended counts the callers which currently handle SIGINT themselves (see
+// Suspend).
+var suspended int32
+
+// Suspend suspends the invocation of the interrupt handlers until the returned
+// resume function is called. It is used by long-running loops which handle
+// SIGINT themselves and must be stopped before the registered handlers run.
+func Suspend() (resume func()) {
+	atomic.AddInt32(&suspended, 1)
+	return func() { atomic.AddInt32(&suspended, -1) }
+}
+
 // mainInterruptHandler listens for SIGINT (Ctrl+C) signals on the
 // interruptChannel and invokes the registered interruptCallbacks accordingly.
 // It also listens for callback registration.  It must be run as a goroutine.
@@ -33,6 +46,10 @@ func mainInterruptHandler() {
 	for {
 		select {
 		case <-interruptChannel:
+			if atomic.LoadInt32(&suspended) > 0 {
+				log.Infof("received SIGINT (Ctrl+C), handled by caller")
+				continue
+			}
 			log.Infof("received SIGINT (Ctrl+C). Shutting down...")
 			for _, callback := range interruptCallbacks {
 				callback()
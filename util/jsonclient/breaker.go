@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// ErrCircuitOpen is returned by JSONRPCRequest if the circuit breaker of the
+// client is open, that is, the server failed too often recently and is not
+// contacted until the cool-down period is over.
+var ErrCircuitOpen = errors.New("jsonclient: circuit open, server unavailable")
+
+// Default circuit breaker settings.
+const (
+	DefaultFailureThreshold = 3               // consecutive failures before the circuit opens
+	DefaultCoolDown         = 5 * time.Minute // time the circuit stays open
+)
+
+// Circuit breaker states.
+const (
+	StateClosed   = "closed"    // requests are passed through
+	StateOpen     = "open"      // requests fail with ErrCircuitOpen
+	StateHalfOpen = "half-open" // cool-down is over, next request is a probe
+)
+
+// A Breaker is a circuit breaker for JSON-RPC clients. After threshold many
+// consecutive failures it stops passing requests to the server for the
+// cool-down period. Afterwards a single probe request is allowed, which
+// either closes the circuit again (on success) or restarts the cool-down
+// period (on failure).
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	failures  int
+	openUntil time.Time
+	lastErr   error
+	now       func() time.Time // for testing
+}
+
+// NewBreaker returns a new circuit breaker which opens after threshold many
+// consecutive failures for the given coolDown period.
+func NewBreaker(threshold int, coolDown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+		now:       time.Now,
+	}
+}
+
+// state returns the current state. Must be called with b.mu held.
+func (b *Breaker) state() string {
+	switch {
+	case b.failures < b.threshold:
+		return StateClosed
+	case b.now().Before(b.openUntil):
+		return StateOpen
+	default:
+		return StateHalfOpen
+	}
+}
+
+// Allow returns ErrCircuitOpen, if no request should be made at the moment.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state() == StateOpen {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Success records a successful request.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		log.Info("jsonclient: circuit closed")
+	}
+	b.failures = 0
+	b.lastErr = nil
+}
+
+// Failure records a failed request with the given error.
+func (b *Breaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastErr = err
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.coolDown)
+		log.Warnf("jsonclient: circuit open until %s after %d failures: %s",
+			b.openUntil.Format(time.RFC3339), b.failures, err)
+	}
+}
+
+// Status returns the current state of the breaker, the number of consecutive
+// failures, the time until the circuit stays open, and the last error.
+func (b *Breaker) Status() (
+	state string,
+	failures int,
+	openUntil time.Time,
+	lastErr error,
+) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state(), b.failures, b.openUntil, b.lastErr
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	errFail := errors.New("fail")
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Failure(errFail)
+	if state, failures, _, _ := b.Status(); state != StateClosed || failures != 1 {
+		t.Errorf("wrong status: %s, %d", state, failures)
+	}
+	b.Failure(errFail)
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Error("circuit should be open")
+	}
+	state, _, openUntil, lastErr := b.Status()
+	if state != StateOpen || !openUntil.Equal(now.Add(time.Minute)) ||
+		lastErr != errFail {
+		t.Errorf("wrong status: %s, %s, %v", state, openUntil, lastErr)
+	}
+	// after cool-down a probe is allowed
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _, _, _ := b.Status(); state != StateHalfOpen {
+		t.Errorf("state != %s == %s", StateHalfOpen, state)
+	}
+	// failed probe restarts cool-down
+	b.Failure(errFail)
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Error("circuit should be open")
+	}
+	// successful probe closes circuit
+	now = now.Add(time.Minute)
+	b.Success()
+	if state, failures, _, _ := b.Status(); state != StateClosed || failures != 0 {
+		t.Errorf("wrong status: %s, %d", state, failures)
+	}
+}
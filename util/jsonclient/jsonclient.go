@@ -10,10 +10,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 
 	"github.com/gorilla/rpc/v2/json2"
+	"github.com/mutecomm/mute/util/netproxy"
 )
 
 var (
@@ -25,14 +29,17 @@ var (
 type URLClient struct {
 	transport *http.Transport
 	curl      string
+	breaker   *Breaker
+	pool      *Pool // nil for clients not created by a Pool
 }
 
 // New creates a new JSON-RPC over HTTPS client which uses the given
 // certificate file to communicate with the server if the scheme of the URL is
-// https.
+// https. Clients which should share connections have to be created with a
+// Pool instead.
 func New(URL string, cert []byte) (*URLClient, error) {
 	var pool *x509.CertPool
-	transport := new(http.Transport)
+	transport := netproxy.NewTransport()
 	urlparsed, err := url.Parse(URL)
 	if err != nil {
 		return nil, err
@@ -47,9 +54,52 @@ func New(URL string, cert []byte) (*URLClient, error) {
 	return &URLClient{transport: transport, curl: URL}, nil
 }
 
+// SetBreaker sets the circuit breaker used for requests of client c. Several
+// clients for the same server can share a breaker.
+func (c *URLClient) SetBreaker(breaker *Breaker) {
+	c.breaker = breaker
+}
+
 // JSONRPCRequest calls the given method via JSON-RPC over HTTPS.
 // It supplies the given JSON args to the called method.
+// If the client has a circuit breaker, ErrCircuitOpen is returned while the
+// server is considered unavailable. Errors reported by the JSON-RPC server
+// itself do not count as failures. Clients created by a Pool retry requests
+// after transient errors (a failed request including its retries counts as a
+// single failure).
 func (c *URLClient) JSONRPCRequest(method string, args interface{}) (map[string]interface{}, error) {
+	if c.breaker == nil {
+		return c.do(method, args)
+	}
+	if err := c.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	reply, err := c.do(method, args)
+	if err != nil {
+		if _, ok := err.(*json2.Error); !ok {
+			c.breaker.Failure(err)
+			return nil, err
+		}
+	}
+	c.breaker.Success()
+	return reply, err
+}
+
+// do makes the request, with retries for clients created by a Pool.
+func (c *URLClient) do(method string, args interface{}) (map[string]interface{}, error) {
+	if c.pool != nil {
+		return c.requestWithRetry(method, args)
+	}
+	return c.request(method, args, false)
+}
+
+// request makes a single JSON-RPC request. retry signals a repeated request
+// (for the pool metrics).
+func (c *URLClient) request(
+	method string,
+	args interface{},
+	retry bool,
+) (map[string]interface{}, error) {
 	if args == nil {
 		// a nil argument would trigger an error, send empty object instead
 		args = struct{}{}
@@ -68,15 +118,30 @@ func (c *URLClient) JSONRPCRequest(method string, args interface{}) (map[string]
 	}
 	defer request.Body.Close()
 	request.Header.Set("Content-Type", "application/json")
+	if c.pool != nil {
+		var reused bool
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+		defer func() { c.pool.record(reused, retry) }()
+	}
 	resp, err := client.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	// the body must be read completely to reuse the connection
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return nil, &statusError{resp.StatusCode}
+	}
 	reply := make(map[string]interface{})
 	err = json2.DecodeClientResponse(resp.Body, &reply)
 	if err != nil {
 		return nil, err
 	}
-	resp.Body.Close()
 	return reply, nil
 }
@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+	"github.com/mutecomm/mute/util/netproxy"
+)
+
+// Default connection pool settings.
+const (
+	DefaultMaxConnsPerHost = 4                      // concurrent connections per host
+	DefaultIdleTimeout     = 90 * time.Second       // idle keep-alive connections are closed afterwards
+	DefaultRetries         = 2                      // retries after transient errors
+	DefaultBackoff         = 500 * time.Millisecond // doubled after every retry
+)
+
+// statusError is returned for HTTP replies with a status code which signals
+// a transient server error (overload or gateway errors).
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("jsonclient: HTTP status %d", e.code)
+}
+
+// isTransient reports whether err is a transient error, that is, the request
+// might succeed if it is repeated.
+func isTransient(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// connection closed by server (e.g., reused idle connection)
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// Stats are the metrics of a connection pool.
+type Stats struct {
+	Requests uint64 // number of HTTP requests
+	Reused   uint64 // number of requests sent over a reused connection
+	Retries  uint64 // number of requests repeated after transient errors
+}
+
+// ReuseRate returns the fraction of requests sent over reused connections.
+func (s Stats) ReuseRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Reused) / float64(s.Requests)
+}
+
+// A Pool shares keep-alive connections between the JSON-RPC clients it
+// creates. Clients for the same server and certificate use the same HTTP
+// transport, so creating new clients does not cause new TLS handshakes.
+// Requests of pooled clients are retried with exponential backoff after
+// transient errors.
+type Pool struct {
+	mu              sync.Mutex
+	transports      map[string]*http.Transport // maps server and certificate to transport
+	maxConnsPerHost int
+	retries         int
+	backoff         time.Duration
+	stats           Stats
+	sleep           func(time.Duration) // for testing
+}
+
+// NewPool returns a new connection pool which allows at most maxConnsPerHost
+// concurrent connections per host and retries requests after transient
+// errors up to retries times. The first retry is made after backoff, which
+// is doubled for every further retry.
+func NewPool(maxConnsPerHost, retries int, backoff time.Duration) *Pool {
+	return &Pool{
+		transports:      make(map[string]*http.Transport),
+		maxConnsPerHost: maxConnsPerHost,
+		retries:         retries,
+		backoff:         backoff,
+		sleep:           time.Sleep,
+	}
+}
+
+// New creates a new JSON-RPC over HTTPS client for URL which uses the
+// connections of pool p (see New for the cert parameter).
+func (p *Pool) New(URL string, cert []byte) (*URLClient, error) {
+	return p.NewRelayed(URL, "", cert)
+}
+
+// NewRelayed creates a new JSON-RPC over HTTPS client for URL like New, but
+// the connections are tunneled through the HTTP CONNECT relay at relayURL
+// (see mutelookupd). The TLS connection to the server runs end-to-end through
+// the tunnel. An empty relayURL disables the relay.
+func (p *Pool) NewRelayed(URL, relayURL string, cert []byte) (*URLClient, error) {
+	urlparsed, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+	key := urlparsed.Scheme + "://" + urlparsed.Host
+	if relayURL != "" {
+		key += "\nrelay " + relayURL
+	}
+	if urlparsed.Scheme == "https" {
+		key += "\n" + string(cert)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	transport := p.transports[key]
+	if transport == nil {
+		transport = netproxy.NewTransport()
+		transport.MaxConnsPerHost = p.maxConnsPerHost
+		transport.MaxIdleConnsPerHost = p.maxConnsPerHost
+		transport.IdleConnTimeout = DefaultIdleTimeout
+		if urlparsed.Scheme == "https" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(cert) {
+				return nil, ErrCertLoad
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+		if relayURL != "" {
+			if err := setRelay(transport, relayURL); err != nil {
+				return nil, err
+			}
+		}
+		p.transports[key] = transport
+	}
+	return &URLClient{transport: transport, curl: URL, pool: p}, nil
+}
+
+// setRelay tunnels the connections of transport through the HTTP CONNECT
+// relay at relayURL. The TLS connection to a https relay is verified with the
+// system root certificates, the TLS configuration of transport is only used
+// for the tunneled connections.
+func setRelay(transport *http.Transport, relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("jsonclient: relay URL must have scheme http or https: %s",
+			relayURL)
+	case u.Port() == "" && u.Scheme == "https":
+		host = net.JoinHostPort(u.Hostname(), "443")
+	case u.Port() == "":
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: host})
+	if u.Scheme == "https" {
+		// the transport would use its own TLS configuration for the relay
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netproxy.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+	return nil
+}
+
+// record records a request in the metrics of pool p.
+func (p *Pool) record(reused, retry bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Requests++
+	if reused {
+		p.stats.Reused++
+	}
+	if retry {
+		p.stats.Retries++
+	}
+}
+
+// Stats returns the current metrics of pool p.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// CloseIdleConnections closes all idle keep-alive connections of pool p.
+func (p *Pool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// requestWithRetry makes the request for client c and repeats it after
+// transient errors as configured for the pool of c.
+func (c *URLClient) requestWithRetry(method string, args interface{}) (map[string]interface{}, error) {
+	backoff := c.pool.backoff
+	for attempt := 0; ; attempt++ {
+		reply, err := c.request(method, args, attempt > 0)
+		if err == nil || attempt >= c.pool.retries || !isTransient(err) {
+			return reply, err
+		}
+		log.Warnf("jsonclient: %s failed, retry in %s: %s", method, backoff, err)
+		c.pool.sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jsonclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+type FailService struct{}
+
+func (f *FailService) Fail(r *http.Request, args *HelloArgs, reply *HelloReply) error {
+	return errors.New("failed")
+}
+
+// newPoolTestServer returns a JSON-RPC test server which replies with
+// http.StatusServiceUnavailable to the first unavailable requests.
+func newPoolTestServer(unavailable int32) (*httptest.Server, *int32) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(HelloService), "")
+	s.RegisterService(new(FailService), "")
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	return srv, &calls
+}
+
+func TestPoolReuse(t *testing.T) {
+	srv, _ := newPoolTestServer(0)
+	defer srv.Close()
+	pool := NewPool(DefaultMaxConnsPerHost, DefaultRetries, DefaultBackoff)
+	defer pool.CloseIdleConnections()
+	for i := 0; i < 4; i++ {
+		// new clients share the connection
+		client, err := pool.New(srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.JSONRPCRequest("HelloService.Say", HelloArgs{Who: "pool"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := pool.Stats()
+	if stats.Requests != 4 || stats.Reused != 3 || stats.Retries != 0 {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+	if rate := stats.ReuseRate(); rate != 0.75 {
+		t.Errorf("ReuseRate() = %f, expected 0.75", rate)
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	srv, calls := newPoolTestServer(2)
+	defer srv.Close()
+	pool := NewPool(DefaultMaxConnsPerHost, DefaultRetries, time.Second)
+	var slept []time.Duration
+	pool.sleep = func(d time.Duration) { slept = append(slept, d) }
+	client, err := pool.New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := NewBreaker(1, time.Minute)
+	client.SetBreaker(breaker)
+	_, err = client.JSONRPCRequest("HelloService.Say", HelloArgs{Who: "retry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slept) != 2 || slept[0] != time.Second || slept[1] != 2*time.Second {
+		t.Errorf("wrong backoff: %v", slept)
+	}
+	if stats := pool.Stats(); stats.Requests != 3 || stats.Retries != 2 {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+	if state, _, _, _ := breaker.Status(); state != StateClosed {
+		t.Errorf("breaker should be closed, is %s", state)
+	}
+	// JSON-RPC errors are not retried
+	before := atomic.LoadInt32(calls)
+	_, err = client.JSONRPCRequest("FailService.Fail", HelloArgs{})
+	if _, ok := err.(*json2.Error); !ok {
+		t.Errorf("expected JSON-RPC error, got %v", err)
+	}
+	if n := atomic.LoadInt32(calls) - before; n != 1 {
+		t.Errorf("JSON-RPC error was retried (%d calls)", n)
+	}
+}
+
+func TestPoolRetriesExhausted(t *testing.T) {
+	srv, calls := newPoolTestServer(10)
+	defer srv.Close()
+	pool := NewPool(DefaultMaxConnsPerHost, DefaultRetries, DefaultBackoff)
+	pool.sleep = func(time.Duration) {}
+	client, err := pool.New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.JSONRPCRequest("HelloService.Say", HelloArgs{Who: "retry"})
+	if _, ok := err.(*statusError); !ok {
+		t.Errorf("expected status error, got %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != DefaultRetries+1 {
+		t.Errorf("%d calls, expected %d", n, DefaultRetries+1)
+	}
+}
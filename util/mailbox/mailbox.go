@@ -0,0 +1,353 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mailbox implements the standard mailbox formats mbox (mboxrd
+// variant) and Maildir (and the reading of single message files), which are
+// used to exchange messages with traditional mail clients.
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mailbox formats.
+const (
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+// Message is a message in a mailbox.
+type Message struct {
+	From    string    // sender address (for the mbox separator line)
+	Date    time.Time // delivery date
+	Data    []byte    // RFC 5322 message (header and body)
+	Seen    bool      // message has been read
+	Flagged bool      // message has been flagged (starred)
+}
+
+// Writer writes messages to a mailbox.
+type Writer interface {
+	Write(msg *Message) error
+	Close() error
+}
+
+// Create creates a new mailbox with the given format and path. Existing
+// mailboxes are not overwritten.
+func Create(format, path string) (Writer, error) {
+	switch format {
+	case FormatMbox:
+		return CreateMbox(path)
+	case FormatMaildir:
+		return CreateMaildir(path)
+	default:
+		return nil, fmt.Errorf("mailbox: unknown format '%s'", format)
+	}
+}
+
+// toLF converts CRLF line endings to LF.
+func toLF(data []byte) []byte {
+	return bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+}
+
+// Mbox is a mailbox in mboxrd format.
+type Mbox struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// CreateMbox creates a new mbox file filename.
+func CreateMbox(filename string) (*Mbox, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Mbox{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Write appends msg to the mbox file. Lines of the message which start with
+// "From " (preceded by any number of '>') are quoted with '>'.
+func (m *Mbox) Write(msg *Message) error {
+	from := msg.From
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	_, err := fmt.Fprintf(m.w, "From %s %s\n", from,
+		msg.Date.UTC().Format(time.ANSIC))
+	if err != nil {
+		return err
+	}
+	data := toLF(msg.Data)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		if _, err := io.WriteString(m.w, line); err != nil {
+			return err
+		}
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		if _, err := io.WriteString(m.w, "\n"); err != nil {
+			return err
+		}
+	}
+	// empty line between messages
+	_, err = io.WriteString(m.w, "\n")
+	return err
+}
+
+// Close flushes and closes the mbox file.
+func (m *Mbox) Close() error {
+	if err := m.w.Flush(); err != nil {
+		m.f.Close()
+		return err
+	}
+	if err := m.f.Sync(); err != nil {
+		m.f.Close()
+		return err
+	}
+	return m.f.Close()
+}
+
+// Maildir is a mailbox in Maildir format.
+type Maildir struct {
+	dir      string
+	hostname string
+}
+
+// deliveries counts the deliveries of this process (for unique filenames).
+var deliveries uint64
+
+// CreateMaildir creates a new Maildir dir (with the subdirectories tmp, new,
+// and cur).
+func CreateMaildir(dir string) (*Maildir, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("mailbox: '%s' exists already", dir)
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in Maildir filenames
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	return &Maildir{dir: dir, hostname: hostname}, nil
+}
+
+// Write delivers msg to the Maildir: the message is written to tmp and then
+// moved to new (unseen messages) or cur (seen messages, with flags).
+func (m *Maildir) Write(msg *Message) error {
+	n := atomic.AddUint64(&deliveries, 1)
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", msg.Date.Unix(),
+		time.Now().UnixNano()/1000, os.Getpid(), n, m.hostname)
+	tmp := filepath.Join(m.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(toLF(msg.Data)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	var dst string
+	if msg.Seen || msg.Flagged {
+		flags := ""
+		if msg.Flagged {
+			flags += "F"
+		}
+		if msg.Seen {
+			flags += "S"
+		}
+		dst = filepath.Join(m.dir, "cur", name+":2,"+flags)
+	} else {
+		dst = filepath.Join(m.dir, "new", name)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// set modification time to delivery date
+	return os.Chtimes(dst, msg.Date, msg.Date)
+}
+
+// Close closes the Maildir.
+func (m *Maildir) Close() error {
+	return nil
+}
+
+// FormatEML is the format of single messages in RFC 5322 files (usually with
+// the extension .eml). It can only be read.
+const FormatEML = "eml"
+
+// Read reads all messages from the mailbox with the given format and path.
+// For FormatEML path can be a single message file or a directory, in which
+// case all *.eml files in it are read.
+func Read(format, path string) ([]*Message, error) {
+	switch format {
+	case FormatMbox:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ReadMbox(f)
+	case FormatMaildir:
+		return ReadMaildir(path)
+	case FormatEML:
+		return ReadEML(path)
+	default:
+		return nil, fmt.Errorf("mailbox: unknown format '%s'", format)
+	}
+}
+
+// isSeparator reports whether line is an mbox separator line.
+func isSeparator(line string) bool {
+	if !strings.HasPrefix(line, "From ") {
+		return false
+	}
+	return len(strings.Fields(line)) >= 3
+}
+
+// parseSeparator parses the sender and the delivery date from the mbox
+// separator line (the date is zero, if it cannot be parsed).
+func parseSeparator(line string) (from string, date time.Time) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	from = fields[1]
+	if from == "MAILER-DAEMON" {
+		from = ""
+	}
+	date, _ = time.Parse(time.ANSIC, strings.TrimSpace(fields[2]))
+	return
+}
+
+// ReadMbox reads all messages from the mbox file r. Quoted "From " lines
+// (mboxrd) are unquoted.
+func ReadMbox(r io.Reader) ([]*Message, error) {
+	var (
+		msgs []*Message
+		msg  *Message
+		buf  bytes.Buffer
+		prev = "\n"
+	)
+	flush := func() {
+		if msg != nil {
+			// remove empty line between messages
+			data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+			msg.Data = append([]byte(nil), data...)
+			msgs = append(msgs, msg)
+		}
+		buf.Reset()
+	}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\n"
+			switch {
+			case prev == "\n" && isSeparator(line):
+				flush()
+				msg = new(Message)
+				msg.From, msg.Date = parseSeparator(line)
+			case msg == nil:
+				return nil, errors.New("mailbox: mbox does not start with 'From ' line")
+			default:
+				if strings.HasPrefix(line, ">") &&
+					strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+					line = line[1:]
+				}
+				buf.WriteString(line)
+			}
+			prev = line
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	flush()
+	return msgs, nil
+}
+
+// ReadMaildir reads all messages from the Maildir dir (in the subdirectories
+// new and cur). The flags of messages in cur are parsed.
+func ReadMaildir(dir string) ([]*Message, error) {
+	var msgs []*Message
+	for _, sub := range []string{"new", "cur"} {
+		fis, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, sub, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			msg := &Message{Date: fi.ModTime(), Data: data}
+			if i := strings.LastIndex(fi.Name(), ":2,"); i >= 0 {
+				flags := fi.Name()[i+3:]
+				msg.Seen = strings.ContainsRune(flags, 'S')
+				msg.Flagged = strings.ContainsRune(flags, 'F')
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// ReadEML reads the message file path or, if path is a directory, all *.eml
+// files in it (in lexical order).
+func ReadEML(path string) ([]*Message, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	filenames := []string{path}
+	if fi.IsDir() {
+		filenames, err = filepath.Glob(filepath.Join(path, "*.eml"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var msgs []*Message
+	for _, filename := range filenames {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &Message{Date: fi.ModTime(), Data: data, Seen: true})
+	}
+	return msgs, nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mailbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDate = time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+
+var testMessages = []*Message{
+	{
+		From: "alice@mute.one",
+		Date: testDate,
+		Data: []byte("From: alice@mute.one\r\nSubject: hi\r\n\r\nFrom now on\r\n>From here\r\n"),
+		Seen: true,
+	},
+	{
+		From:    "bob@mute.one",
+		Date:    testDate.Add(time.Hour),
+		Data:    []byte("From: bob@mute.one\r\n\r\nno newline"),
+		Flagged: true,
+	},
+	{
+		From: "carol@mute.one",
+		Date: testDate.Add(2 * time.Hour),
+		Data: []byte("From: carol@mute.one\r\n\r\nunread\r\n"),
+	},
+}
+
+func TestMbox(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mailbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	filename := filepath.Join(tmpdir, "test.mbox")
+	w, err := Create(FormatMbox, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range testMessages[:2] {
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateMbox(filename); err == nil {
+		t.Error("existing mbox should not be overwritten")
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "From alice@mute.one Tue Mar  1 12:30:00 2016\n" +
+		"From: alice@mute.one\nSubject: hi\n\n>From now on\n>>From here\n\n" +
+		"From bob@mute.one Tue Mar  1 13:30:00 2016\n" +
+		"From: bob@mute.one\n\nno newline\n\n"
+	if string(buf) != expected {
+		t.Errorf("wrong mbox:\n%s\nexpected:\n%s", buf, expected)
+	}
+	// read back
+	msgs, err := Read(FormatMbox, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("wrong number of messages: %d", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.From != testMessages[i].From || !msg.Date.Equal(testMessages[i].Date) {
+			t.Errorf("wrong separator: %s %s", msg.From, msg.Date)
+		}
+	}
+	data := "From: alice@mute.one\nSubject: hi\n\nFrom now on\n>From here\n"
+	if string(msgs[0].Data) != data {
+		t.Errorf("wrong message: %q", msgs[0].Data)
+	}
+	if string(msgs[1].Data) != "From: bob@mute.one\n\nno newline\n" {
+		t.Errorf("wrong message: %q", msgs[1].Data)
+	}
+	if _, err := ReadMbox(strings.NewReader("Subject: no mbox\n")); err == nil {
+		t.Error("mbox without separator line should fail")
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mailbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dir := filepath.Join(tmpdir, "Maildir")
+	w, err := Create(FormatMaildir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range testMessages {
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateMaildir(dir); err == nil {
+		t.Error("existing Maildir should not be overwritten")
+	}
+	cur, err := filepath.Glob(filepath.Join(dir, "cur", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cur) != 2 {
+		t.Fatalf("wrong number of messages in cur: %d", len(cur))
+	}
+	var flags []string
+	for _, filename := range cur {
+		flags = append(flags, filename[strings.LastIndex(filename, ":2,")+3:])
+	}
+	if !(flags[0] == "S" && flags[1] == "F" || flags[0] == "F" && flags[1] == "S") {
+		t.Errorf("wrong flags: %v", flags)
+	}
+	newMsgs, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newMsgs) != 1 {
+		t.Fatalf("wrong number of messages in new: %d", len(newMsgs))
+	}
+	buf, err := ioutil.ReadFile(newMsgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "From: carol@mute.one\n\nunread\n" {
+		t.Errorf("wrong message: %q", buf)
+	}
+	fi, err := os.Stat(newMsgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(testMessages[2].Date) {
+		t.Errorf("wrong modification time: %s", fi.ModTime())
+	}
+	// read back
+	msgs, err := Read(FormatMaildir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("wrong number of messages: %d", len(msgs))
+	}
+	var seen, flagged int
+	for _, msg := range msgs {
+		if msg.Seen {
+			seen++
+		}
+		if msg.Flagged {
+			flagged++
+		}
+	}
+	if seen != 1 || flagged != 1 {
+		t.Errorf("wrong flags: %d seen, %d flagged", seen, flagged)
+	}
+}
+
+func TestReadEML(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mailbox_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	for i, msg := range testMessages {
+		filename := filepath.Join(tmpdir, fmt.Sprintf("%d.eml", i))
+		if err := ioutil.WriteFile(filename, msg.Data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := Read(FormatEML, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != len(testMessages) {
+		t.Fatalf("wrong number of messages: %d", len(msgs))
+	}
+	msgs, err = Read(FormatEML, filepath.Join(tmpdir, "1.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Data) != string(testMessages[1].Data) {
+		t.Error("wrong message")
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := Create("mh", "mailbox"); err == nil {
+		t.Error("unknown format should fail")
+	}
+	if _, err := Read("mh", "mailbox"); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxMethodPeek is the maximum request size read to determine the JSON-RPC
+// method.
+const maxMethodPeek = 1 << 20 // 1 MB
+
+// statusWriter records the status code written to a http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, if the underlying writer does.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// rpcMethod returns the JSON-RPC method of the request r and restores its body
+// ("unknown", if the method cannot be determined).
+func rpcMethod(r *http.Request) string {
+	if r.Body == nil {
+		return "unknown"
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMethodPeek))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return "unknown"
+	}
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Method == "" {
+		return "unknown"
+	}
+	return req.Method
+}
+
+// JSONRPC instruments the JSON-RPC handler h with m. It counts the requests
+// (by method and HTTP status code) in the counter
+// NAMESPACE_jsonrpc_requests_total and records their latencies in the
+// histogram NAMESPACE_jsonrpc_request_duration_seconds. If m is nil, h is
+// returned unchanged.
+func JSONRPC(m Metrics, namespace string, h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	requests := m.Counter(namespace+"_jsonrpc_requests_total",
+		"Number of JSON-RPC requests.", "method", "code")
+	latency := m.Histogram(namespace+"_jsonrpc_request_duration_seconds",
+		"Latency of JSON-RPC requests in seconds.", nil, "method")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		method := "unknown"
+		if r.Method == "POST" {
+			method = rpcMethod(r)
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		requests.Inc(method, strconv.Itoa(sw.status))
+		ObserveSince(latency, start, method)
+	})
+}
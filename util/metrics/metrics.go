@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics implements optional metrics for the Mute server daemons.
+//
+// Components are instrumented with counters and histograms obtained from a
+// Metrics implementation. Metrics are disabled by default (see Nop). A
+// Registry collects the metrics and exposes them in the Prometheus text
+// format over HTTP (see Registry.ServeHTTP).
+package metrics
+
+import (
+	"time"
+)
+
+// DefBuckets are the default histogram buckets for latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Counter is a monotonically increasing metric.
+type Counter interface {
+	// Inc increments the counter with the given label values by one.
+	Inc(labelValues ...string)
+	// Add adds v (which must not be negative) to the counter with the given
+	// label values.
+	Add(v float64, labelValues ...string)
+}
+
+// Histogram counts observations (like latencies) in buckets.
+type Histogram interface {
+	// Observe adds the observation v to the histogram with the given label
+	// values.
+	Observe(v float64, labelValues ...string)
+}
+
+// Metrics creates the counters and histograms of instrumented components.
+// The label values passed to the returned metrics must correspond to the
+// given label names.
+type Metrics interface {
+	// Counter returns the counter with the given name.
+	Counter(name, help string, labelNames ...string) Counter
+	// Histogram returns the histogram with the given name and the upper
+	// bounds of its buckets (DefBuckets, if nil).
+	Histogram(name, help string, buckets []float64, labelNames ...string) Histogram
+}
+
+// Nop is a Metrics implementation which discards all metrics.
+var Nop Metrics = nop{}
+
+type nop struct{}
+
+func (nop) Counter(name, help string, labelNames ...string) Counter {
+	return nop{}
+}
+
+func (nop) Histogram(
+	name, help string,
+	buckets []float64,
+	labelNames ...string,
+) Histogram {
+	return nop{}
+}
+
+func (nop) Inc(labelValues ...string)                {}
+func (nop) Add(v float64, labelValues ...string)     {}
+func (nop) Observe(v float64, labelValues ...string) {}
+
+// OrNop returns m, or Nop if m is nil.
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop
+	}
+	return m
+}
+
+// ObserveSince adds the seconds elapsed since start to histogram h. It is
+// meant to be deferred:
+//
+//	defer metrics.ObserveSince(h, time.Now(), "select")
+func ObserveSince(h Histogram, start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
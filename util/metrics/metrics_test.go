@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNop(t *testing.T) {
+	m := OrNop(nil)
+	m.Counter("c", "counter", "l").Inc("v")
+	m.Histogram("h", "histogram", nil).Observe(1)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_requests_total", "Number of requests.", "method")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`b"`)
+	h := r.Histogram("test_duration_seconds", "Duration.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	// same metric again
+	r.Counter("test_requests_total", "Number of requests.", "method").Inc("a")
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exp := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{method="a"} 4
+test_requests_total{method="b\""} 1
+`
+	if buf.String() != exp {
+		t.Errorf("output:\n%s\nexpected:\n%s", buf.String(), exp)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "counter", "l")
+	for _, f := range []func(){
+		func() { c.Inc() },
+		func() { c.Add(-1, "v") },
+		func() { r.Histogram("c", "histogram", nil, "l") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("should panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	r := NewRegistry()
+	h := JSONRPC(r, "test", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), "Fail") {
+			http.Error(w, "failed", http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	for _, method := range []string{"Test.Echo", "Test.Echo", "Test.Fail"} {
+		body := `{"method":"` + method + `"}`
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if method == "Test.Echo" && string(reply) != body {
+			t.Errorf("body not restored: %s", reply)
+		}
+	}
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	for _, line := range []string{
+		`test_jsonrpc_requests_total{method="Test.Echo",code="200"} 2`,
+		`test_jsonrpc_requests_total{method="Test.Fail",code="400"} 1`,
+		`test_jsonrpc_request_duration_seconds_count{method="Test.Echo"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("line missing: %s", line)
+		}
+	}
+	// metrics handler
+	msrv := httptest.NewServer(r)
+	defer msrv.Close()
+	resp, err := http.Get(msrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("metrics handler returned %s", resp.Status)
+	}
+}
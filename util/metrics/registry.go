@@ -0,0 +1,250 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mutecomm/mute/log"
+)
+
+// Metric types.
+const (
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+)
+
+// series is a single time series of a metric family (with fixed label
+// values).
+type series struct {
+	labelValues []string
+	value       float64  // counter value or sum of observations
+	counts      []uint64 // histogram bucket counts (not cumulative)
+	count       uint64   // number of observations
+}
+
+// family is a metric with all its time series.
+type family struct {
+	r          *Registry
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+// Registry is a Metrics implementation which collects all metrics in memory.
+// It implements http.Handler to expose them in the Prometheus text format.
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns a new registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family returns the family with the given name, which is created if it
+// does not exist.
+func (r *Registry) family(
+	name, help, typ string,
+	buckets []float64,
+	labelNames []string,
+) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || len(f.labelNames) != len(labelNames) {
+			panic(log.Criticalf("metrics: metric %s redefined", name))
+		}
+		return f
+	}
+	f := &family{
+		r:          r,
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// Counter implements Metrics.
+func (r *Registry) Counter(name, help string, labelNames ...string) Counter {
+	return r.family(name, help, typeCounter, nil, labelNames)
+}
+
+// Histogram implements Metrics.
+func (r *Registry) Histogram(
+	name, help string,
+	buckets []float64,
+	labelNames ...string,
+) Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return r.family(name, help, typeHistogram, buckets, labelNames)
+}
+
+// get returns the series for labelValues. Must be called with f.r.mutex
+// held.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(log.Criticalf("metrics: metric %s has %d label(s), got %d",
+			f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Inc implements Counter.
+func (f *family) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+// Add implements Counter.
+func (f *family) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(log.Criticalf("metrics: counter %s decreased", f.name))
+	}
+	f.r.mutex.Lock()
+	defer f.r.mutex.Unlock()
+	f.get(labelValues).value += v
+}
+
+// Observe implements Histogram.
+func (f *family) Observe(v float64, labelValues ...string) {
+	f.r.mutex.Lock()
+	defer f.r.mutex.Unlock()
+	s := f.get(labelValues)
+	if i := sort.SearchFloat64s(f.buckets, v); i < len(f.buckets) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats the given label names and values (plus the optional extra
+// label) as a label set.
+func labels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name,
+			labelValueReplacer.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes all metrics in the Prometheus text format to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	r.mutex.Lock()
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name,
+			strings.Replace(f.help, "\n", " ", -1))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.typ)
+		var keys []string
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ == typeCounter {
+				fmt.Fprintf(&buf, "%s%s %s\n", f.name,
+					labels(f.labelNames, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", f.name,
+					labels(f.labelNames, s.labelValues, "le", formatFloat(bound)),
+					cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", f.name,
+				labels(f.labelNames, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", f.name,
+				labels(f.labelNames, s.labelValues), formatFloat(s.value))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", f.name,
+				labels(f.labelNames, s.labelValues), s.count)
+		}
+	}
+	r.mutex.Unlock()
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := r.WriteTo(w); err != nil {
+		log.Error(err)
+	}
+}
+
+// ListenAndServe serves the metrics of r at the path /metrics on the address
+// addr (plain HTTP, metrics should only be exposed on internal networks).
+func (r *Registry) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        mux,
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+		MaxHeaderBytes: 1 << 20, // 1 MB
+	}
+	log.Infof("metrics: serve metrics on %s", addr)
+	return log.Error(srv.ListenAndServe())
+}
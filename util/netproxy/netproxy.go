@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netproxy routes the network connections of Mute through a SOCKS5
+// proxy (like Tor), with optional per-domain overrides.
+//
+// Host names are passed to the proxy unresolved, so no DNS requests leak
+// past the proxy. Code which has to perform other DNS lookups (like MX
+// lookups) must check Proxied first.
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+	"golang.org/x/net/proxy"
+)
+
+// Direct is the override which connects to a domain without proxy.
+const Direct = "direct"
+
+// Environment variables of the proxy options. They are also used to pass the
+// proxy configuration on to subprocesses (see Apply).
+const (
+	ProxyEnv        = "MUTEPROXY"
+	ProxyDomainsEnv = "MUTEPROXYDOMAINS"
+)
+
+// ProxyFlag defines the standard --proxy flag.
+var ProxyFlag = cli.StringFlag{
+	Name:   "proxy",
+	Usage:  "route network connections through SOCKS5 proxy (e.g., socks5://127.0.0.1:9050 for Tor)",
+	EnvVar: ProxyEnv,
+}
+
+// ProxyDomainsFlag defines the standard --proxy-domains flag.
+var ProxyDomainsFlag = cli.StringFlag{
+	Name:   "proxy-domains",
+	Usage:  "per-domain proxy overrides (domain=URL|direct,...)",
+	EnvVar: ProxyDomainsEnv,
+}
+
+// ErrScheme is returned for proxy URLs with an unsupported scheme.
+var ErrScheme = errors.New("netproxy: proxy URL must have scheme socks5 or socks5h")
+
+// contextDialer is implemented by the SOCKS5 dialers of the proxy package.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// override is a per-domain proxy setting.
+type override struct {
+	domain string
+	dialer proxy.Dialer // nil for Direct
+}
+
+var (
+	mutex     sync.RWMutex
+	dialer    proxy.Dialer // default proxy (nil for direct connections)
+	overrides []override   // sorted by descending domain length
+)
+
+// newDialer returns the dialer for proxyURL (nil for Direct).
+func newDialer(proxyURL string) (proxy.Dialer, error) {
+	if proxyURL == Direct {
+		return nil, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, ErrScheme
+	}
+	return proxy.FromURL(u, proxy.Direct)
+}
+
+// Configure routes all connections through the SOCKS5 proxy at proxyURL
+// (e.g., socks5://127.0.0.1:9050 for Tor). An empty proxyURL disables the
+// proxy. The map domainProxies overrides the proxy for domains (and their
+// subdomains) with other proxy URLs or Direct.
+func Configure(proxyURL string, domainProxies map[string]string) error {
+	var d proxy.Dialer
+	if proxyURL != "" {
+		var err error
+		if d, err = newDialer(proxyURL); err != nil {
+			return err
+		}
+	}
+	var o []override
+	for domain, p := range domainProxies {
+		od, err := newDialer(p)
+		if err != nil {
+			return err
+		}
+		o = append(o, override{strings.ToLower(domain), od})
+	}
+	// the most specific domain takes precedence
+	sort.Slice(o, func(i, j int) bool {
+		return len(o[i].domain) > len(o[j].domain)
+	})
+	mutex.Lock()
+	defer mutex.Unlock()
+	dialer = d
+	overrides = o
+	return nil
+}
+
+// Apply configures the proxy with proxyURL and the per-domain overrides
+// given as string (see ParseOverrides) and exports the configuration to the
+// environment of subprocesses.
+func Apply(proxyURL, domainProxies string) error {
+	overrides, err := ParseOverrides(domainProxies)
+	if err != nil {
+		return err
+	}
+	if err := Configure(proxyURL, overrides); err != nil {
+		return err
+	}
+	if err := os.Setenv(ProxyEnv, proxyURL); err != nil {
+		return err
+	}
+	return os.Setenv(ProxyDomainsEnv, domainProxies)
+}
+
+// ParseOverrides parses per-domain proxy overrides of the form
+// "domain=URL,domain=direct" (see Configure).
+func ParseOverrides(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("netproxy: cannot parse proxy override: " + part)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// dialerFor returns the dialer for the given host (nil for Direct).
+func dialerFor(host string) proxy.Dialer {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, o := range overrides {
+		if host == o.domain || strings.HasSuffix(host, "."+o.domain) {
+			return o.dialer
+		}
+	}
+	return dialer
+}
+
+// Proxied reports whether connections to host are routed through a proxy.
+func Proxied(host string) bool {
+	return dialerFor(host) != nil
+}
+
+// Dial connects to addr on the given network, through the proxy for the host
+// of addr, if any.
+func Dial(network, addr string) (net.Conn, error) {
+	return DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr on the given network using the provided
+// context, through the proxy for the host of addr, if any.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := dialerFor(host)
+	if d == nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, addr)
+	}
+	if cd, ok := d.(contextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// NewTransport returns a new HTTP transport which connects through the
+// configured proxy.
+func NewTransport() *http.Transport {
+	return &http.Transport{DialContext: DialContext}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// socks5Server is a minimal SOCKS5 server (no authentication, CONNECT only)
+// which records the requested target addresses and does not connect them.
+func socks5Server(t *testing.T) (addr string, targets chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets = make(chan string, 10)
+	go func() {
+		defer l.Close()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 262)
+				// greeting
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{5, 0})
+				// request
+				if _, err := io.ReadFull(c, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1: // IPv4
+					io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3: // domain name
+					io.ReadFull(c, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(c, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				io.ReadFull(c, buf[:2])
+				port := binary.BigEndian.Uint16(buf[:2])
+				targets <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+				c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+			}(c)
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func TestProxy(t *testing.T) {
+	defer Configure("", nil)
+	addr, targets := socks5Server(t)
+	err := Configure("socks5://"+addr, map[string]string{
+		"direct.example": Direct,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Proxied("mute.berlin") {
+		t.Error("mute.berlin should be proxied")
+	}
+	if Proxied("direct.example") || Proxied("sub.direct.example") {
+		t.Error("direct.example should not be proxied")
+	}
+	c, err := Dial("tcp", "keyserver.mute.berlin:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// host name must not be resolved locally
+	if target := <-targets; target != "keyserver.mute.berlin:443" {
+		t.Errorf("proxy target = %s, expected keyserver.mute.berlin:443", target)
+	}
+
+	// disabled
+	if err := Configure("", nil); err != nil {
+		t.Fatal(err)
+	}
+	if Proxied("mute.berlin") {
+		t.Error("mute.berlin should not be proxied")
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	defer Configure("", nil)
+	if err := Configure("http://127.0.0.1:8080", nil); err != ErrScheme {
+		t.Errorf("Configure() = %v, expected ErrScheme", err)
+	}
+	err := Configure("", map[string]string{"mute.berlin": "ftp://localhost"})
+	if err != ErrScheme {
+		t.Errorf("Configure() = %v, expected ErrScheme", err)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	m, err := ParseOverrides("mute.berlin=socks5://127.0.0.1:9050, example.com=direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["mute.berlin"] != "socks5://127.0.0.1:9050" ||
+		m["example.com"] != Direct {
+		t.Errorf("wrong overrides: %v", m)
+	}
+	if _, err := ParseOverrides("mute.berlin"); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -5,6 +5,7 @@
 package util
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
 
@@ -17,11 +18,25 @@ import (
 	"github.com/mutecomm/mute/uid/identity"
 )
 
-// MixAddress defines the mix address.
-//
-// TODO: Allow multiple domains.
+// MixAddress defines the mix address (of the default domain).
 var MixAddress string
 
+// DomainMixAddresses maps service domains to their mix addresses. Domains
+// without entry use MixAddress.
+var DomainMixAddresses = make(map[string]string)
+
+// MixSigningKeys contains the public keys of the mixes which sign relay
+// messages (see mixcrypt.VerifyRelay). It is set from the local configuration.
+var MixSigningKeys [][]byte
+
+// domainMixAddress returns the mix address for the given domain.
+func domainMixAddress(domain string) string {
+	if mixAddress, ok := DomainMixAddresses[domain]; ok {
+		return mixAddress
+	}
+	return MixAddress
+}
+
 // MailboxAddress returns the mailbox address for the given pubkey and server.
 func MailboxAddress(pubkey *[ed25519.PublicKeySize]byte, server string) []byte {
 	return []byte(hex.EncodeToString(pubkey[:]) + "@" +
@@ -43,10 +58,11 @@ func NewNymAddress(
 	if err := identity.IsMapped(id); err != nil {
 		return "", "", log.Error(err)
 	}
-	if MixAddress == "" {
+	mixAddress := domainMixAddress(domain)
+	if mixAddress == "" {
 		return "", "", log.Error("util: MixAddress undefined")
 	}
-	mixAddresses, err := client.GetMixKeys(MixAddress, caCert)
+	mixAddresses, err := client.GetMixKeys(mixAddress, caCert)
 	if err != nil {
 		return "", "", log.Error(err)
 	}
@@ -70,3 +86,36 @@ func NewNymAddress(
 	}
 	return string(addr.MixAddress), base64.Encode(nymAddress), nil
 }
+
+// MixKeys returns the public keys of the mixes listed in the mix directories
+// of MixAddress and of the mix addresses of all other domains (see
+// DomainMixAddresses), including the token keys of the mixes.
+// The keys are fetched over the network.
+func MixKeys(caCert []byte) ([][]byte, error) {
+	if MixAddress == "" {
+		return nil, log.Error("util: MixAddress undefined")
+	}
+	mixAddresses := []string{MixAddress}
+	for _, mixAddress := range DomainMixAddresses {
+		if mixAddress != MixAddress {
+			mixAddresses = append(mixAddresses, mixAddress)
+		}
+	}
+	var keys [][]byte
+	for _, mixAddress := range mixAddresses {
+		stmt, err := client.GetMixKeys(mixAddress, caCert)
+		if err != nil {
+			return nil, log.Error(err)
+		}
+		if !stmt.Verify() {
+			return nil, log.Error("util: mix key statement has invalid signature")
+		}
+		keys = append(keys, stmt.PublicKey)
+		for _, address := range stmt.Addresses {
+			if !bytes.Equal(address.TokenKey, stmt.PublicKey) {
+				keys = append(keys, address.TokenKey)
+			}
+		}
+	}
+	return keys, nil
+}
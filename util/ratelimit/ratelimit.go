@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ratelimit implements per-caller token-bucket rate limiting and
+// concurrency caps for Mute engines.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a per-caller token-bucket rate limiter. Every caller gets its
+// own bucket with a capacity of burst tokens which is refilled with rate
+// tokens per second.
+type Limiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time    // for testing
+	sleep   func(time.Duration) // for testing
+}
+
+// New returns a new Limiter which allows rate calls per second and caller
+// with bursts of up to burst calls.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// take tries to take a token from the bucket of caller. If no token is
+// available, the duration until the next token becomes available is
+// returned. Must be called with l.mutex held.
+func (l *Limiter) take(caller string) (bool, time.Duration) {
+	now := l.now()
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[caller] = b
+	}
+	// refill bucket
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Allow returns true, if caller is allowed to make another call. Otherwise,
+// the call must be rejected.
+func (l *Limiter) Allow(caller string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ok, _ := l.take(caller)
+	return ok
+}
+
+// Wait blocks until caller is allowed to make another call. The rate of l
+// must be positive.
+func (l *Limiter) Wait(caller string) {
+	for {
+		l.mutex.Lock()
+		ok, wait := l.take(caller)
+		l.mutex.Unlock()
+		if ok {
+			return
+		}
+		l.sleep(wait)
+	}
+}
+
+// Cleanup removes the buckets of all callers which have been idle long enough
+// to have a full bucket again.
+func (l *Limiter) Cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	for caller, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, caller)
+		}
+	}
+}
+
+// Cap caps the number of concurrently executed calls.
+type Cap struct {
+	slots chan struct{}
+}
+
+// NewCap returns a new Cap which allows up to max concurrent calls.
+func NewCap(max int) *Cap {
+	return &Cap{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire tries to acquire a slot for a call and returns true, if
+// successful. Acquired slots must be released with Release.
+func (c *Cap) TryAcquire() bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release releases a slot acquired with TryAcquire.
+func (c *Cap) Release() {
+	<-c.slots
+}
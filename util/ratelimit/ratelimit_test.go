@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := New(1, 2)
+	l.now = func() time.Time { return now }
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Error("burst should be allowed")
+	}
+	if l.Allow("a") {
+		t.Error("call should be rejected")
+	}
+	if !l.Allow("b") {
+		t.Error("other caller should be allowed")
+	}
+	now = now.Add(time.Second)
+	if !l.Allow("a") {
+		t.Error("refilled call should be allowed")
+	}
+	if l.Allow("a") {
+		t.Error("call should be rejected")
+	}
+	now = now.Add(time.Minute)
+	l.Cleanup()
+	if len(l.buckets) != 0 {
+		t.Errorf("len(l.buckets) = %d, want 0", len(l.buckets))
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	now := time.Now()
+	l := New(2, 1)
+	l.now = func() time.Time { return now }
+	var slept time.Duration
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	l.Wait("a")
+	if slept != 0 {
+		t.Errorf("first call should not wait (slept %s)", slept)
+	}
+	l.Wait("a")
+	if slept != 500*time.Millisecond {
+		t.Errorf("second call should wait 500ms (slept %s)", slept)
+	}
+	l.Wait("b")
+	if slept != 500*time.Millisecond {
+		t.Error("other caller should not wait")
+	}
+}
+
+func TestCap(t *testing.T) {
+	c := NewCap(1)
+	if !c.TryAcquire() {
+		t.Fatal("first call should be allowed")
+	}
+	if c.TryAcquire() {
+		t.Error("second concurrent call should be rejected")
+	}
+	c.Release()
+	if !c.TryAcquire() {
+		t.Error("call after release should be allowed")
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smtpd implements a minimal SMTP server (RFC 5321) for message
+// submission by local mail clients. It does not support TLS, but can require
+// authentication with AUTH PLAIN or AUTH LOGIN (RFC 4954). It should only
+// listen on the loopback interface.
+package smtpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// DefaultMaxSize is the default maximum size of a message in bytes.
+const DefaultMaxSize = 10485760
+
+// DefaultTimeout is the default timeout for commands and data transfers.
+const DefaultTimeout = 5 * time.Minute
+
+// Handler handles the transactions of an SMTP session.
+type Handler interface {
+	// Mail is called for the MAIL command with the reverse-path from. user is
+	// the authenticated username (empty, if authentication is not required).
+	Mail(user, from string) error
+	// Rcpt is called for every RCPT command with the forward-path to.
+	Rcpt(from, to string) error
+	// Data is called with the received message data.
+	Data(from string, to []string, data []byte) error
+}
+
+// Error is an SMTP error reply which can be returned by a Handler.
+// Other errors are replied with code 554.
+type Error struct {
+	Code int    // reply code
+	Msg  string // reply text
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Msg)
+}
+
+// Server is an SMTP server.
+type Server struct {
+	Hostname string        // hostname used in greeting
+	MaxSize  int64         // maximum message size (default: DefaultMaxSize)
+	Timeout  time.Duration // command timeout (default: DefaultTimeout)
+	Handler  Handler       // handles the transactions
+
+	// Auth checks the credentials given with the AUTH command. If set,
+	// clients must authenticate before a mail transaction.
+	Auth func(username, password string) error
+}
+
+// IsLoopback reports whether the listen address addr (host:port) is on the
+// loopback interface.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve accepts connections on l and serves every connection in its own
+// goroutine, until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// session is the state of an SMTP session.
+type session struct {
+	s    *Server
+	conn net.Conn
+	tc   *textproto.Conn
+	helo bool
+	user *string // authenticated username
+	from *string
+	to   []string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{s: s, conn: conn, tc: textproto.NewConn(conn)}
+	defer sess.tc.Close()
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	sess.reply(220, "%s ESMTP ready", hostname)
+	for {
+		sess.deadline()
+		line, err := sess.tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess.reset()
+			sess.helo = true
+			sess.reply(250, "%s", hostname)
+		case "EHLO":
+			sess.reset()
+			sess.helo = true
+			sess.tc.PrintfLine("250-%s", hostname)
+			sess.tc.PrintfLine("250-8BITMIME")
+			sess.tc.PrintfLine("250-PIPELINING")
+			if s.Auth != nil {
+				sess.tc.PrintfLine("250-AUTH PLAIN LOGIN")
+			}
+			sess.tc.PrintfLine("250 SIZE %d", s.maxSize())
+		case "AUTH":
+			sess.auth(arg)
+		case "MAIL":
+			sess.mail(arg)
+		case "RCPT":
+			sess.rcpt(arg)
+		case "DATA":
+			sess.data()
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "OK")
+		case "NOOP":
+			sess.reply(250, "OK")
+		case "VRFY":
+			sess.reply(252, "cannot verify user")
+		case "QUIT":
+			sess.reply(221, "bye")
+			return
+		default:
+			sess.reply(502, "command not implemented")
+		}
+	}
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (sess *session) deadline() {
+	timeout := sess.s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	sess.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	sess.tc.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// replyError replies with err (see Error) or with defaultCode.
+func (sess *session) replyError(err error, defaultCode int) {
+	if e, ok := err.(*Error); ok {
+		sess.reply(e.Code, "%s", e.Msg)
+		return
+	}
+	sess.reply(defaultCode, "%s", err)
+}
+
+func (sess *session) reset() {
+	sess.from = nil
+	sess.to = nil
+}
+
+// parsePath parses the path of a MAIL or RCPT command argument with the given
+// prefix (like "FROM:<addr> SIZE=123"), parameters are ignored.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (sess *session) mail(arg string) {
+	if !sess.helo {
+		sess.reply(503, "send HELO/EHLO first")
+		return
+	}
+	if sess.s.Auth != nil && sess.user == nil {
+		sess.reply(530, "authentication required")
+		return
+	}
+	if sess.from != nil {
+		sess.reply(503, "nested MAIL command")
+		return
+	}
+	from, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "syntax: MAIL FROM:<address>")
+		return
+	}
+	var user string
+	if sess.user != nil {
+		user = *sess.user
+	}
+	if err := sess.s.Handler.Mail(user, from); err != nil {
+		sess.replyError(err, 550)
+		return
+	}
+	sess.from = &from
+	sess.reply(250, "OK")
+}
+
+// authResponse returns the decoded response of an AUTH exchange. If the
+// initial response is empty, the challenge is sent and the response read.
+func (sess *session) authResponse(initial, challenge string) (string, bool) {
+	resp := initial
+	if resp == "" {
+		sess.reply(334, "%s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, err := sess.tc.ReadLine()
+		if err != nil {
+			return "", false
+		}
+		resp = line
+	}
+	switch resp {
+	case "*":
+		sess.reply(501, "authentication canceled")
+		return "", false
+	case "=":
+		return "", true // empty initial response
+	}
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		sess.reply(501, "cannot decode response")
+		return "", false
+	}
+	return string(dec), true
+}
+
+func (sess *session) auth(arg string) {
+	if sess.s.Auth == nil {
+		sess.reply(502, "command not implemented")
+		return
+	}
+	if !sess.helo {
+		sess.reply(503, "send EHLO first")
+		return
+	}
+	if sess.user != nil {
+		sess.reply(503, "already authenticated")
+		return
+	}
+	if sess.from != nil {
+		sess.reply(503, "AUTH not permitted during mail transaction")
+		return
+	}
+	mechanism, initial := arg, ""
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		mechanism, initial = arg[:i], strings.TrimSpace(arg[i+1:])
+	}
+	var username, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		resp, ok := sess.authResponse(initial, "")
+		if !ok {
+			return
+		}
+		// authorization identity, authentication identity, and password
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+			sess.reply(501, "invalid PLAIN response")
+			return
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		var ok bool
+		username, ok = sess.authResponse(initial, "Username:")
+		if !ok {
+			return
+		}
+		password, ok = sess.authResponse("", "Password:")
+		if !ok {
+			return
+		}
+	default:
+		sess.reply(504, "unrecognized authentication type")
+		return
+	}
+	if err := sess.s.Auth(username, password); err != nil {
+		sess.reply(535, "authentication credentials invalid")
+		return
+	}
+	sess.user = &username
+	sess.reply(235, "authentication successful")
+}
+
+func (sess *session) rcpt(arg string) {
+	if sess.from == nil {
+		sess.reply(503, "need MAIL command")
+		return
+	}
+	to, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		sess.reply(501, "syntax: RCPT TO:<address>")
+		return
+	}
+	if err := sess.s.Handler.Rcpt(*sess.from, to); err != nil {
+		sess.replyError(err, 550)
+		return
+	}
+	sess.to = append(sess.to, to)
+	sess.reply(250, "OK")
+}
+
+func (sess *session) data() {
+	if sess.from == nil || len(sess.to) == 0 {
+		sess.reply(503, "need RCPT command")
+		return
+	}
+	sess.reply(354, "end data with <CR><LF>.<CR><LF>")
+	sess.deadline()
+	r := sess.tc.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(r, sess.s.maxSize()+1))
+	if err != nil {
+		sess.reset()
+		sess.reply(451, "error reading data: %s", err)
+		return
+	}
+	if int64(len(data)) > sess.s.maxSize() {
+		io.Copy(ioutil.Discard, r)
+		sess.reset()
+		sess.reply(552, "message exceeds maximum size %d", sess.s.maxSize())
+		return
+	}
+	err = sess.s.Handler.Data(*sess.from, sess.to, data)
+	sess.reset()
+	if err != nil {
+		sess.replyError(err, 554)
+		return
+	}
+	sess.reply(250, "OK: message accepted")
+}
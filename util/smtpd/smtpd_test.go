@@ -0,0 +1,221 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type testHandler struct {
+	from string
+	to   []string
+	data string
+}
+
+func (h *testHandler) Mail(user, from string) error {
+	if from != "alice@mute.berlin" {
+		return &Error{Code: 553, Msg: "unknown sender"}
+	}
+	if user != "" && user != from {
+		return &Error{Code: 553, Msg: "sender is not the authenticated user"}
+	}
+	return nil
+}
+
+func (h *testHandler) Rcpt(from, to string) error {
+	if to == "unknown@mute.berlin" {
+		return errors.New("unknown recipient")
+	}
+	return nil
+}
+
+func (h *testHandler) Data(from string, to []string, data []byte) error {
+	h.from = from
+	h.to = to
+	h.data = string(data)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var h testHandler
+	s := &Server{Hostname: "test", MaxSize: 1024, Handler: &h}
+	go s.Serve(l)
+	msg := "Subject: test\r\n\r\n.leading dot\r\nbody\r\n"
+	err = smtp.SendMail(l.Addr().String(), nil, "alice@mute.berlin",
+		[]string{"bob@mute.berlin", "carol@mute.berlin"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.from != "alice@mute.berlin" || len(h.to) != 2 {
+		t.Errorf("wrong envelope: %s %v", h.from, h.to)
+	}
+	if h.data != "Subject: test\n\n.leading dot\nbody\n" {
+		t.Errorf("wrong data: %q", h.data)
+	}
+	// handler errors
+	err = smtp.SendMail(l.Addr().String(), nil, "mallory@mute.berlin",
+		[]string{"bob@mute.berlin"}, []byte(msg))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 553 {
+		t.Errorf("unknown sender should fail with 553: %v", err)
+	}
+	err = smtp.SendMail(l.Addr().String(), nil, "alice@mute.berlin",
+		[]string{"unknown@mute.berlin"}, []byte(msg))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Errorf("unknown recipient should fail with 550: %v", err)
+	}
+	// maximum size
+	err = smtp.SendMail(l.Addr().String(), nil, "alice@mute.berlin",
+		[]string{"bob@mute.berlin"}, []byte(strings.Repeat("x", 2048)))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 {
+		t.Errorf("large message should fail with 552: %v", err)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := &Server{Handler: &testHandler{}}
+	go s.serveConn(server)
+	tc := textproto.NewConn(client)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"MAIL FROM:<alice@mute.berlin>", 503},
+		{"HELO test", 250},
+		{"RCPT TO:<bob@mute.berlin>", 503},
+		{"MAIL FROM:alice@mute.berlin", 501},
+		{"MAIL FROM:<alice@mute.berlin> SIZE=10", 250},
+		{"MAIL FROM:<alice@mute.berlin>", 503},
+		{"DATA", 503},
+		{"RSET", 250},
+		{"EXPN list", 502},
+		{"QUIT", 221},
+	} {
+		if err := tc.PrintfLine("%s", cmd.line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tc.ReadResponse(cmd.code); err != nil {
+			t.Errorf("%s: %s", cmd.line, err)
+		}
+	}
+}
+
+func testAuth(username, password string) error {
+	if password != "secret" {
+		return errors.New("wrong password")
+	}
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var h testHandler
+	s := &Server{Handler: &h, Auth: testAuth}
+	go s.Serve(l)
+	host, _, _ := net.SplitHostPort(l.Addr().String())
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	// without authentication
+	err = smtp.SendMail(l.Addr().String(), nil, "alice@mute.berlin",
+		[]string{"bob@mute.berlin"}, msg)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 530 {
+		t.Errorf("unauthenticated MAIL should fail with 530: %v", err)
+	}
+	// wrong password
+	auth := smtp.PlainAuth("", "alice@mute.berlin", "wrong", host)
+	err = smtp.SendMail(l.Addr().String(), auth, "alice@mute.berlin",
+		[]string{"bob@mute.berlin"}, msg)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 535 {
+		t.Errorf("wrong password should fail with 535: %v", err)
+	}
+	// sender must be the authenticated user
+	auth = smtp.PlainAuth("", "bob@mute.berlin", "secret", host)
+	err = smtp.SendMail(l.Addr().String(), auth, "alice@mute.berlin",
+		[]string{"bob@mute.berlin"}, msg)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 553 {
+		t.Errorf("foreign sender should fail with 553: %v", err)
+	}
+	auth = smtp.PlainAuth("", "alice@mute.berlin", "secret", host)
+	err = smtp.SendMail(l.Addr().String(), auth, "alice@mute.berlin",
+		[]string{"bob@mute.berlin"}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.from != "alice@mute.berlin" {
+		t.Errorf("wrong sender: %s", h.from)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := &Server{Handler: &testHandler{}, Auth: testAuth}
+	go s.serveConn(server)
+	tc := textproto.NewConn(client)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.StdEncoding.EncodeToString
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"AUTH LOGIN", 503},
+		{"HELO test", 250},
+		{"AUTH CRAM-MD5", 504},
+		{"AUTH LOGIN " + enc([]byte("alice@mute.berlin")), 334},
+		{enc([]byte("wrong")), 535},
+		{"MAIL FROM:<alice@mute.berlin>", 530},
+		{"AUTH LOGIN", 334},
+		{"*", 501},
+		{"AUTH LOGIN", 334},
+		{enc([]byte("alice@mute.berlin")), 334},
+		{enc([]byte("secret")), 235},
+		{"AUTH LOGIN", 503},
+		{"MAIL FROM:<alice@mute.berlin>", 250},
+		{"QUIT", 221},
+	} {
+		if err := tc.PrintfLine("%s", cmd.line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tc.ReadResponse(cmd.code); err != nil {
+			t.Errorf("%s: %s", cmd.line, err)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, loopback := range map[string]bool{
+		"127.0.0.1:2525": true,
+		"[::1]:2525":     true,
+		"localhost:2525": true,
+		":2525":          false,
+		"0.0.0.0:2525":   false,
+		"10.0.0.1:2525":  false,
+		"127.0.0.1":      false,
+	} {
+		if IsLoopback(addr) != loopback {
+			t.Errorf("IsLoopback(%s) != %v", addr, loopback)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package strength estimates the strength of passphrases.
+//
+// The estimation follows the approach of zxcvbn: the passphrase is split into
+// patterns an attacker would try first (common passphrases and words,
+// keyboard walks, sequences, repeats, years, and user inputs like the user
+// ID), each pattern is rated by the number of guesses it takes, and the
+// remaining characters are rated as brute force. The sum of the guesses (in
+// bits) is mapped to a score from 0 (too guessable) to 4 (very unguessable).
+package strength
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// MinScore is the minimum score a passphrase should have. Passphrases of
+// encrypted databases are exposed to offline attacks, therefore the highest
+// score is required.
+const MinScore = 4
+
+// Score thresholds in bits (log2 of the number of guesses), as in zxcvbn
+// (10^3, 10^6, 10^8, and 10^10 guesses).
+var thresholds = []float64{
+	3 * math.Log2(10),
+	6 * math.Log2(10),
+	8 * math.Log2(10),
+	10 * math.Log2(10),
+}
+
+// Warnings for the detected patterns.
+const (
+	WarnShort    = "passphrase is too short"
+	WarnCommon   = "passphrase contains a common passphrase or word"
+	WarnKeyboard = "keyboard patterns like qwerty are easy to guess"
+	WarnSequence = "sequences like abc or 6543 are easy to guess"
+	WarnRepeat   = "repeats like aaa or abcabc are easy to guess"
+	WarnYear     = "years are easy to guess"
+	WarnUser     = "passphrase contains the user ID or a part of it"
+)
+
+// A Result is the estimated strength of a passphrase.
+type Result struct {
+	Bits    float64 // log2 of the estimated number of guesses
+	Score   int     // 0 (too guessable) to 4 (very unguessable)
+	Warning string  // the most relevant weakness (empty, if none found)
+}
+
+// Weak reports whether the score of r is below MinScore.
+func (r *Result) Weak() bool {
+	return r.Score < MinScore
+}
+
+// common are common passphrases and words, ordered by frequency.
+var common = []string{
+	"password", "123456", "12345678", "qwerty", "abc123", "monkey",
+	"letmein", "dragon", "111111", "baseball", "iloveyou", "trustno1",
+	"1234567", "sunshine", "master", "123123", "welcome", "shadow",
+	"ashley", "football", "jesus", "michael", "ninja", "mustang",
+	"password1", "passw0rd", "secret", "love", "admin", "login",
+	"princess", "starwars", "whatever", "freedom", "hello", "charlie",
+	"superman", "batman", "computer", "internet", "summer", "winter",
+	"spring", "autumn", "flower", "orange", "banana", "cookie",
+	"soccer", "hockey", "killer", "pepper", "ginger", "hunter",
+	"mute", "muteapp", "passphrase", "geheim", "hallo", "passwort",
+	"test", "guest", "root", "changeme", "default", "pass",
+}
+
+// keyboard rows for keyboard walks (QWERTY and QWERTZ).
+var keyboards = []string{
+	"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm",
+	"qwertzuiop", "yxcvbnm",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+// match is a pattern found in the passphrase.
+type match struct {
+	length  int
+	bits    float64
+	warning string
+}
+
+// cardinality returns the size of the character set used in p.
+func cardinality(p []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range p {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 128:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	var c float64
+	if lower {
+		c += 26
+	}
+	if upper {
+		c += 26
+	}
+	if digit {
+		c += 10
+	}
+	if symbol {
+		c += 33
+	}
+	if other {
+		c += 100
+	}
+	return c
+}
+
+// caseBits returns the extra bits for the capitalization of word.
+func caseBits(word []rune) float64 {
+	var upper int
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0 || upper == len(word):
+		return 0
+	case upper == 1 && unicode.IsUpper(word[0]):
+		return 1
+	default:
+		return math.Log2(float64(len(word)))
+	}
+}
+
+// matchDictionary finds the longest word of dict (ranked by position) which
+// starts at p[i:].
+func matchDictionary(p []rune, i int, dict []string, warning string) *match {
+	lower := strings.ToLower(string(p[i:]))
+	var best *match
+	for rank, word := range dict {
+		if len(word) < 3 || !strings.HasPrefix(lower, word) {
+			continue
+		}
+		n := len([]rune(word))
+		if best == nil || n > best.length {
+			best = &match{
+				length:  n,
+				bits:    math.Log2(float64(rank+2)) + caseBits(p[i:i+n]),
+				warning: warning,
+			}
+		}
+	}
+	return best
+}
+
+// matchKeyboard finds a keyboard walk of at least 4 characters at p[i:].
+func matchKeyboard(p []rune, i int) *match {
+	var best *match
+	for _, row := range keyboards {
+		for _, dir := range []string{row, reverse(row)} {
+			n := 0
+			lower := strings.ToLower(string(p[i:]))
+			for start := 0; start < len(dir); start++ {
+				l := 0
+				for l < len(lower) && start+l < len(dir) && lower[l] == dir[start+l] {
+					l++
+				}
+				if l > n {
+					n = l
+				}
+			}
+			if n >= 4 && (best == nil || n > best.length) {
+				best = &match{
+					length:  n,
+					bits:    math.Log2(float64(len(keyboards)*2*len(dir))) + math.Log2(float64(n)),
+					warning: WarnKeyboard,
+				}
+			}
+		}
+	}
+	return best
+}
+
+// matchSequence finds a sequence (like abcd or 9876) of at least 3
+// characters at p[i:].
+func matchSequence(p []rune, i int) *match {
+	if i+2 >= len(p) {
+		return nil
+	}
+	delta := p[i+1] - p[i]
+	if delta != 1 && delta != -1 {
+		return nil
+	}
+	n := 2
+	for i+n < len(p) && p[i+n]-p[i+n-1] == delta {
+		n++
+	}
+	if n < 3 {
+		return nil
+	}
+	return &match{
+		length:  n,
+		bits:    math.Log2(26*2) + math.Log2(float64(n)),
+		warning: WarnSequence,
+	}
+}
+
+// matchRepeat finds a repeated character or substring at p[i:].
+func matchRepeat(p []rune, i int) *match {
+	var best *match
+	for unit := 1; unit <= (len(p)-i)/2; unit++ {
+		n := unit
+		for i+n+unit <= len(p) && string(p[i+n:i+n+unit]) == string(p[i:i+unit]) {
+			n += unit
+		}
+		if n == unit || (unit == 1 && n < 3) {
+			continue
+		}
+		if best == nil || n > best.length {
+			unitBits := math.Log2(cardinality(p[i:i+unit])) * float64(unit)
+			best = &match{
+				length:  n,
+				bits:    unitBits + math.Log2(float64(n/unit)),
+				warning: WarnRepeat,
+			}
+		}
+	}
+	return best
+}
+
+// matchYear finds a year between 1900 and 2099 at p[i:].
+func matchYear(p []rune, i int) *match {
+	if i+4 > len(p) {
+		return nil
+	}
+	y := string(p[i : i+4])
+	if (strings.HasPrefix(y, "19") || strings.HasPrefix(y, "20")) &&
+		strings.IndexFunc(y, func(r rune) bool { return r < '0' || r > '9' }) < 0 {
+		return &match{length: 4, bits: math.Log2(200), warning: WarnYear}
+	}
+	return nil
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// userWords splits the user inputs (like user IDs) into words.
+func userWords(userInputs []string) []string {
+	var words []string
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		words = append(words, input)
+		words = append(words, strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	return words
+}
+
+// Estimate estimates the strength of passphrase. userInputs (like the user
+// ID) are considered to be known by the attacker.
+func Estimate(passphrase []byte, userInputs ...string) *Result {
+	p := []rune(string(passphrase))
+	bruteBits := math.Log2(math.Max(cardinality(p), 1))
+	user := userWords(userInputs)
+	// minimum bits for p[i:] (dynamic programming from the end)
+	bits := make([]float64, len(p)+1)
+	warnings := make([]string, len(p)+1)
+	for i := len(p) - 1; i >= 0; i-- {
+		// brute force a single character
+		bits[i] = bruteBits + bits[i+1]
+		warnings[i] = warnings[i+1]
+		matches := []*match{
+			matchDictionary(p, i, user, WarnUser),
+			matchDictionary(p, i, common, WarnCommon),
+			matchKeyboard(p, i),
+			matchSequence(p, i),
+			matchRepeat(p, i),
+			matchYear(p, i),
+		}
+		for _, m := range matches {
+			if m == nil {
+				continue
+			}
+			// each pattern costs at least one bit
+			b := math.Max(m.bits, 1) + bits[i+m.length]
+			if b < bits[i] {
+				bits[i] = b
+				warnings[i] = m.warning
+			}
+		}
+	}
+	r := &Result{Bits: bits[0], Warning: warnings[0]}
+	for _, t := range thresholds {
+		if r.Bits >= t {
+			r.Score++
+		}
+	}
+	if r.Warning == "" && r.Score < MinScore {
+		r.Warning = WarnShort
+	}
+	return r
+}
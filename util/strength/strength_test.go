@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package strength
+
+import (
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		passphrase string
+		userInputs []string
+		weak       bool
+		warning    string
+	}{
+		{"", nil, true, WarnShort},
+		{"password", nil, true, WarnCommon},
+		{"Password1", nil, true, WarnCommon},
+		{"qwertyuiop", nil, true, WarnKeyboard},
+		{"abcdefghijkl", nil, true, WarnSequence},
+		{"aaaaaaaaaaaaaaaa", nil, true, WarnRepeat},
+		{"1987", nil, true, WarnYear},
+		{"alice@mute.berlin", []string{"alice@mute.berlin"}, true, WarnUser},
+		{"x7#Kp", nil, true, WarnShort},
+		{"correct horse battery staple", nil, false, ""},
+		{"Tr0ub4dor&3-zebra-Quux", nil, false, ""},
+	}
+	for _, test := range tests {
+		r := Estimate([]byte(test.passphrase), test.userInputs...)
+		if r.Weak() != test.weak {
+			t.Errorf("%q: weak = %v (%.1f bits, score %d), expected %v",
+				test.passphrase, r.Weak(), r.Bits, r.Score, test.weak)
+		}
+		if test.weak && r.Warning != test.warning {
+			t.Errorf("%q: warning = %q, expected %q", test.passphrase,
+				r.Warning, test.warning)
+		}
+	}
+	// patterns are weaker than random characters of the same length
+	if Estimate([]byte("abcdefgh")).Bits >= Estimate([]byte("q8vz1mrk")).Bits {
+		t.Error("sequence should be weaker than random characters")
+	}
+}
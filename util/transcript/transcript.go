@@ -0,0 +1,171 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package transcript implements signed, timestamped transcripts of Mute
+// conversations which can be verified offline.
+package transcript
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+	"github.com/mutecomm/mute/log"
+)
+
+// Version is the current transcript format version.
+const Version = "1.0"
+
+// ErrInvalidSignature is returned if the transcript signature is invalid.
+var ErrInvalidSignature = errors.New("transcript: invalid signature")
+
+// ErrKeyNotAnchored is returned if an entry of the key history of a transcript
+// cannot be found in the key server hash chain.
+var ErrKeyNotAnchored = errors.New("transcript: key history not anchored in hash chain")
+
+// ErrUnknownSigKey is returned if the transcript was not signed with a key
+// contained in the key history of the exporter.
+var ErrUnknownSigKey = errors.New("transcript: signature key not in key history of exporter")
+
+// Message is a single message contained in a transcript.
+type Message struct {
+	MsgNum    int64  // message number in the exporter's database
+	Incoming  bool   // an incoming message, outgoing otherwise
+	From      string // sender
+	To        string // recipient
+	Date      int64  // date of the message
+	Message   string // message body (with subject line)
+	Signature string // result of the signature verification of the message
+}
+
+// Key is an entry in the key history of a transcript.
+type Key struct {
+	Identity  string // the identity the key belongs to
+	MsgCount  uint64 // message counter of the UID message
+	Position  uint64 // hash chain position of the UID message
+	SigPubKey string // public signature key of UID message
+	UIDHash   string // hash of the UID message
+}
+
+// Transcript is a signed transcript of the conversation between Exporter and
+// Contact.
+type Transcript struct {
+	Version    string     // transcript format version
+	Exporter   string     // identity which exported (and signed) the transcript
+	Contact    string     // the contact the conversation was held with
+	Created    int64      // time when the transcript was signed (as claimed by Exporter)
+	Messages   []*Message // the messages of the conversation
+	KeyHistory []*Key     // UID keys of Exporter and Contact
+	SigPubKey  string     // public key used to sign the transcript
+	Signature  string     // signature over all other fields
+}
+
+// digest returns the data which is signed.
+func (t *Transcript) digest() ([]byte, error) {
+	c := *t
+	c.Signature = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	return cipher.SHA512(data), nil
+}
+
+// Sign signs the transcript with the given private Ed25519 key.
+func (t *Transcript) Sign(sigPubKey string, privateKey *[64]byte) error {
+	var ed25519Key cipher.Ed25519Key
+	if err := ed25519Key.SetPrivateKey(privateKey[:]); err != nil {
+		return err
+	}
+	t.Version = Version
+	t.SigPubKey = sigPubKey
+	digest, err := t.digest()
+	if err != nil {
+		return err
+	}
+	t.Signature = base64.Encode(ed25519Key.Sign(digest))
+	return nil
+}
+
+// Verify verifies the signature of the transcript and makes sure that it
+// was made by a key from the key history of the exporter. The key history is
+// supplied by the exporter itself, a transcript is only valid if it also
+// passes VerifyKeyHistory.
+func (t *Transcript) Verify() error {
+	if t.Version != Version {
+		return log.Errorf("transcript: unknown version %s", t.Version)
+	}
+	var known bool
+	for _, key := range t.KeyHistory {
+		if key.Identity == t.Exporter && key.SigPubKey == t.SigPubKey {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return log.Error(ErrUnknownSigKey)
+	}
+	pubKey, err := base64.Decode(t.SigPubKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.Decode(t.Signature)
+	if err != nil {
+		return err
+	}
+	var ed25519Key cipher.Ed25519Key
+	if err := ed25519Key.SetPublicKey(pubKey); err != nil {
+		return err
+	}
+	digest, err := t.digest()
+	if err != nil {
+		return err
+	}
+	if !ed25519Key.Verify(digest, sig) {
+		return log.Error(ErrInvalidSignature)
+	}
+	return nil
+}
+
+// VerifyKeyHistory checks every entry of the key history with check, which
+// has to make sure that the entry is anchored in the key server hash chain
+// (position, UID hash, and signature key). Only keys of Exporter and Contact
+// are allowed.
+func (t *Transcript) VerifyKeyHistory(check func(key *Key) error) error {
+	for _, key := range t.KeyHistory {
+		if key.Identity != t.Exporter && key.Identity != t.Contact {
+			return log.Errorf("transcript: key history contains foreign identity %s",
+				key.Identity)
+		}
+		if err := check(key); err != nil {
+			log.Errorf("transcript: key of %s at position %d: %s", key.Identity,
+				key.Position, err)
+			return log.Error(ErrKeyNotAnchored)
+		}
+	}
+	return nil
+}
+
+// Write writes the transcript as indented JSON to w.
+func (t *Transcript) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return log.Error(err)
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return log.Error(err)
+	}
+	return nil
+}
+
+// Read reads a transcript in JSON encoding from r.
+func Read(r io.Reader) (*Transcript, error) {
+	var t Transcript
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, log.Error(err)
+	}
+	return &t, nil
+}
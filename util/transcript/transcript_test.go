@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+)
+
+func TestTranscript(t *testing.T) {
+	key, err := cipher.Ed25519Generate(cipher.RandReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigPubKey := base64.Encode(key.PublicKey()[:])
+	tr := &Transcript{
+		Exporter: "alice@mute.berlin",
+		Contact:  "bob@mute.berlin",
+		Created:  1451606400,
+		Messages: []*Message{
+			{
+				MsgNum:    1,
+				From:      "alice@mute.berlin",
+				To:        "bob@mute.berlin",
+				Date:      1451606400,
+				Message:   "subject\nbody",
+				Signature: "none",
+			},
+		},
+		KeyHistory: []*Key{
+			{Identity: "alice@mute.berlin", SigPubKey: sigPubKey},
+		},
+	}
+	if err := tr.Sign(sigPubKey, key.PrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tr.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.String()
+	tr, err = Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Verify(); err != nil {
+		t.Error(err)
+	}
+	// tamper with message
+	tr.Messages[0].Message = "subject\nother body"
+	if err := tr.Verify(); err != ErrInvalidSignature {
+		t.Errorf("Verify() = %v, want %v", err, ErrInvalidSignature)
+	}
+	// unknown signature key
+	tr, err = Read(bytes.NewBufferString(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.KeyHistory[0].Identity = "bob@mute.berlin"
+	if err := tr.Verify(); err != ErrUnknownSigKey {
+		t.Errorf("Verify() = %v, want %v", err, ErrUnknownSigKey)
+	}
+}
+
+func TestVerifyKeyHistory(t *testing.T) {
+	tr := &Transcript{
+		Exporter: "alice@mute.berlin",
+		Contact:  "bob@mute.berlin",
+		KeyHistory: []*Key{
+			{Identity: "alice@mute.berlin", Position: 1},
+			{Identity: "bob@mute.berlin", Position: 2},
+		},
+	}
+	var checked int
+	err := tr.VerifyKeyHistory(func(key *Key) error {
+		checked++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if checked != 2 {
+		t.Errorf("checked = %d, want 2", checked)
+	}
+	// key not found in hash chain
+	err = tr.VerifyKeyHistory(func(key *Key) error {
+		if key.Position == 2 {
+			return errors.New("not in hash chain")
+		}
+		return nil
+	})
+	if err != ErrKeyNotAnchored {
+		t.Errorf("VerifyKeyHistory() = %v, want %v", err, ErrKeyNotAnchored)
+	}
+	// key of third party
+	tr.KeyHistory[1].Identity = "eve@mute.berlin"
+	if err := tr.VerifyKeyHistory(func(key *Key) error { return nil }); err == nil {
+		t.Error("VerifyKeyHistory() should fail for foreign identity")
+	}
+}
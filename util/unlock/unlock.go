@@ -0,0 +1,221 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package unlock implements the unlocking of the local databases with a
+// keyfile or an externally stored secret (like an OS keychain entry or a
+// TPM-sealed secret) in addition to the passphrase.
+//
+// The databases are not encrypted with the passphrase directly, but with the
+// unlock secret derived from the passphrase and the secret (see Derive). In
+// combined mode both the passphrase and the secret are required to unlock the
+// databases (defense in depth), in keyfile mode the secret alone suffices.
+//
+// The unlock configuration (the mode and where to get the secret from, but
+// not the secret itself) is stored in the file ConfigFile in the home
+// directory.
+package unlock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/frankbraun/codechain/util/bzero"
+	"github.com/mutecomm/mute/cipher"
+	"github.com/mutecomm/mute/encode/base64"
+)
+
+// ConfigFile is the name of the unlock configuration file in the home
+// directory.
+const ConfigFile = "unlock.json"
+
+// Unlock modes.
+const (
+	ModeCombined = "combined" // passphrase and secret are required
+	ModeKeyfile  = "keyfile"  // secret is sufficient
+)
+
+// SecretSize is the size of generated keyfile secrets in bytes.
+const SecretSize = 32
+
+// minSecretSize is the minimum size of secrets in bytes.
+const minSecretSize = 16
+
+// Config is an unlock configuration. Either Keyfile or Command must be set.
+type Config struct {
+	Mode    string // ModeCombined or ModeKeyfile
+	Keyfile string `json:",omitempty"` // path of the keyfile
+	Command string `json:",omitempty"` // command which prints the secret
+}
+
+// Load loads the unlock configuration from homedir. If the databases are
+// unlocked with the passphrase alone, nil is returned.
+func Load(homedir string) (*Config, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(homedir, ConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, fmt.Errorf("unlock: cannot parse %s: %s", ConfigFile, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Save saves the unlock configuration cfg in homedir.
+func (cfg *Config) Save(homedir string) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(homedir, ConfigFile), buf, 0600)
+}
+
+// Remove removes the unlock configuration from homedir.
+func Remove(homedir string) error {
+	err := os.Remove(filepath.Join(homedir, ConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	switch cfg.Mode {
+	case ModeCombined, ModeKeyfile:
+	default:
+		return fmt.Errorf("unlock: mode '%s' is invalid", cfg.Mode)
+	}
+	if (cfg.Keyfile == "") == (cfg.Command == "") {
+		return fmt.Errorf("unlock: either keyfile or command must be set")
+	}
+	return nil
+}
+
+// NeedsPassphrase reports whether the passphrase is required to unlock the
+// databases with cfg.
+func (cfg *Config) NeedsPassphrase() bool {
+	return cfg == nil || cfg.Mode == ModeCombined
+}
+
+// Source describes where the secret of cfg is taken from.
+func (cfg *Config) Source() string {
+	if cfg.Keyfile != "" {
+		return fmt.Sprintf("keyfile '%s'", cfg.Keyfile)
+	}
+	return fmt.Sprintf("command '%s'", cfg.Command)
+}
+
+// Secret returns the secret of cfg, either read from the keyfile or printed
+// by the command. The returned secret should be zeroed by the caller.
+func (cfg *Config) Secret() ([]byte, error) {
+	if cfg.Keyfile != "" {
+		return ReadKeyfile(cfg.Keyfile)
+	}
+	return runCommand(cfg.Command)
+}
+
+// Unlock returns the unlock secret for passphrase (which is ignored in keyfile
+// mode). If cfg is nil, a copy of the passphrase is returned. The returned
+// secret should be zeroed by the caller.
+func (cfg *Config) Unlock(passphrase []byte) ([]byte, error) {
+	if cfg == nil {
+		return append([]byte(nil), passphrase...), nil
+	}
+	secret, err := cfg.Secret()
+	if err != nil {
+		return nil, err
+	}
+	defer bzero.Bytes(secret)
+	if cfg.Mode == ModeKeyfile {
+		passphrase = nil
+	}
+	return Derive(passphrase, secret), nil
+}
+
+// Derive derives the unlock secret from passphrase and secret. The result is
+// base64 encoded, because it is passed to the crypt engine as a passphrase
+// line.
+func Derive(passphrase, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(passphrase)
+	sum := mac.Sum(nil)
+	defer bzero.Bytes(sum)
+	return []byte(base64.Encode(sum))
+}
+
+// GenerateKeyfile writes a new keyfile with a random secret to filename.
+// Existing files are not overwritten.
+func GenerateKeyfile(filename string) error {
+	secret := make([]byte, SecretSize)
+	defer bzero.Bytes(secret)
+	if _, err := io.ReadFull(cipher.RandReader, secret); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(secret); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadKeyfile reads the secret from the keyfile filename. Any file with at
+// least 16 bytes can be used as a keyfile.
+func ReadKeyfile(filename string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minSecretSize {
+		bzero.Bytes(secret)
+		return nil, fmt.Errorf("unlock: keyfile '%s' is too short", filename)
+	}
+	return secret, nil
+}
+
+// runCommand executes the shell command command and returns its output
+// (with surrounding whitespace removed) as secret.
+func runCommand(command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unlock: command failed: %s: %s", err,
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+	secret := append([]byte(nil), bytes.TrimSpace(out)...)
+	bzero.Bytes(out)
+	if len(secret) < minSecretSize {
+		bzero.Bytes(secret)
+		return nil, fmt.Errorf("unlock: secret printed by command is too short")
+	}
+	return secret, nil
+}
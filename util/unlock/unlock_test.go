@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Mute Communications Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package unlock
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUnlock(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "unlock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	passphrase := []byte("passphrase")
+	// no configuration
+	cfg, err := Load(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != nil || !cfg.NeedsPassphrase() {
+		t.Fatal("passphrase should be sufficient without configuration")
+	}
+	secret, err := cfg.Unlock(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, passphrase) {
+		t.Error("passphrase should be used unchanged")
+	}
+	// combined mode
+	keyfile := filepath.Join(tmpdir, "keyfile")
+	if err := GenerateKeyfile(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKeyfile(keyfile); err == nil {
+		t.Error("existing keyfile should not be overwritten")
+	}
+	cfg = &Config{Mode: ModeCombined, Keyfile: keyfile}
+	if err := cfg.Save(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil || cfg.Keyfile != keyfile || !cfg.NeedsPassphrase() {
+		t.Fatalf("wrong configuration: %+v", cfg)
+	}
+	combined, err := cfg.Unlock(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.Unlock([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, passphrase) || bytes.Equal(combined, other) {
+		t.Error("combined secret should depend on passphrase and keyfile")
+	}
+	// keyfile mode
+	cfg.Mode = ModeKeyfile
+	if cfg.NeedsPassphrase() {
+		t.Error("keyfile mode should not need passphrase")
+	}
+	a, err := cfg.Unlock(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cfg.Unlock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("keyfile mode should ignore passphrase")
+	}
+	// remove configuration
+	if err := Remove(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := Load(tmpdir); err != nil || cfg != nil {
+		t.Error("configuration should be removed")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell commands not tested on windows")
+	}
+	cfg := &Config{Mode: ModeKeyfile, Command: "echo 0123456789abcdef0123"}
+	secret, err := cfg.Secret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "0123456789abcdef0123" {
+		t.Errorf("wrong secret: %q", secret)
+	}
+	cfg.Command = "echo short"
+	if _, err := cfg.Secret(); err == nil {
+		t.Error("short secret should fail")
+	}
+	cfg.Command = "exit 1"
+	if _, err := cfg.Secret(); err == nil {
+		t.Error("failing command should fail")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Mode: "none", Keyfile: "keyfile"},
+		{Mode: ModeCombined},
+		{Mode: ModeCombined, Keyfile: "keyfile", Command: "cat keyfile"},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v should be invalid", cfg)
+		}
+	}
+}